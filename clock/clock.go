@@ -0,0 +1,81 @@
+// Package clock abstracts the passage of time, so that code waiting on timeouts, intervals and
+// backoffs can be driven by a Fake clock in tests instead of sleeping.
+package clock
+
+import "time"
+
+// Clock tells the time and waits for it to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// After returns a channel receiving the current time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+	// Sleep blocks until d has elapsed.
+	Sleep(d time.Duration)
+	// NewTimer returns a Timer firing once d has elapsed.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns a Ticker firing every d, which must be positive.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a single event, like a time.Timer.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, reporting whether it was still pending.
+	Stop() bool
+	// Reset makes the timer fire once d has elapsed, reporting whether it was still pending.
+	Reset(d time.Duration) bool
+}
+
+// Ticker sends the time at intervals, like a time.Ticker. Ticks are dropped for slow receivers.
+type Ticker interface {
+	// C returns the channel the ticks are sent on.
+	C() <-chan time.Time
+	// Stop turns the ticker off; no more ticks are sent.
+	Stop()
+}
+
+// Real is the Clock of the time package.
+type Real struct{}
+
+// Or returns c, or the Real clock when c is nil, so options can leave their clock unset.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
+
+// Now returns time.Now.
+func (Real) Now() time.Time { return time.Now() }
+
+// Since returns time.Since(t).
+func (Real) Since(t time.Time) time.Duration { return time.Since(t) }
+
+// After returns time.After(d).
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep calls time.Sleep(d).
+func (Real) Sleep(d time.Duration) { time.Sleep(d) }
+
+// NewTimer wraps time.NewTimer(d).
+func (Real) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+// NewTicker wraps time.NewTicker(d).
+func (Real) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+// realTimer is a Timer backed by a time.Timer.
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// realTicker is a Ticker backed by a time.Ticker.
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,187 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when Advance or Set is called, firing the timers,
+// tickers and sleeps that fall due in the order of their deadlines. Tests use BlockUntil to
+// wait for the code under test to start waiting before moving time.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan struct{} // Closed and replaced whenever a waiter is added
+}
+
+// fakeWaiter is a pending timer, ticker or sleep of a Fake clock.
+type fakeWaiter struct {
+	fake   *Fake
+	at     time.Time      // When it fires next
+	period time.Duration  // Interval of a ticker, zero for timers
+	ch     chan time.Time // Receives the time it fired at; buffered so firing never blocks
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the time of the clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Since returns the time of the clock elapsed since t.
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After returns a channel receiving the time once the clock advanced by d.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// Sleep blocks until the clock advanced by d.
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// NewTimer returns a Timer firing once the clock advanced by d.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	w := &fakeWaiter{fake: f, ch: make(chan time.Time, 1)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scheduleLocked(w, d)
+	return w
+}
+
+// NewTicker returns a Ticker firing every time the clock advanced by d.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	w := &fakeWaiter{fake: f, period: d, ch: make(chan time.Time, 1)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scheduleLocked(w, d)
+	return fakeTicker{w}
+}
+
+// Advance moves the clock forward by d, firing everything that falls due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setLocked(f.now.Add(d))
+}
+
+// Set moves the clock to now, firing everything that falls due. Moving it backwards fires nothing.
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setLocked(now)
+}
+
+// Waiters returns the number of timers, tickers and sleeps that have not fired or been stopped.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil blocks until at least n timers, tickers and sleeps are pending, so that time is only
+// moved once the code under test waits on the clock.
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		if len(f.waiters) >= n {
+			f.mu.Unlock()
+			return
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		<-changed
+	}
+}
+
+// scheduleLocked makes w fire once the clock advanced by d, firing it at once if d is not
+// positive; the caller must hold mu.
+func (f *Fake) scheduleLocked(w *fakeWaiter, d time.Duration) {
+	w.at = f.now.Add(d)
+	if d <= 0 && w.period == 0 {
+		w.fire(f.now)
+		return
+	}
+	f.waiters = append(f.waiters, w)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// setLocked moves the clock to now, firing the waiters falling due by deadline; the caller must
+// hold mu.
+func (f *Fake) setLocked(now time.Time) {
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+		if len(f.waiters) == 0 || f.waiters[0].at.After(now) {
+			break
+		}
+		w := f.waiters[0]
+		if w.at.After(f.now) {
+			f.now = w.at
+		}
+		w.fire(f.now)
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	if now.After(f.now) {
+		f.now = now
+	}
+}
+
+// removeLocked drops w from the pending waiters, reporting whether it was pending; the caller
+// must hold mu.
+func (f *Fake) removeLocked(w *fakeWaiter) bool {
+	for i, pending := range f.waiters {
+		if pending == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fire sends now to the waiter's channel, dropping it if the last one was not received.
+func (w *fakeWaiter) fire(now time.Time) {
+	select {
+	case w.ch <- now:
+	default:
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time { return w.ch }
+
+func (w *fakeWaiter) Stop() bool {
+	w.fake.mu.Lock()
+	defer w.fake.mu.Unlock()
+	return w.fake.removeLocked(w)
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	w.fake.mu.Lock()
+	defer w.fake.mu.Unlock()
+	pending := w.fake.removeLocked(w)
+	w.fake.scheduleLocked(w, d)
+	return pending
+}
+
+// fakeTicker is the Ticker of a Fake clock.
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.fakeWaiter.Stop() }
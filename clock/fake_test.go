@@ -0,0 +1,124 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// received returns the value waiting on ch, failing if there is none.
+func received(t *testing.T, ch <-chan time.Time) time.Time {
+	t.Helper()
+	select {
+	case at := <-ch:
+		return at
+	default:
+		t.Fatal("nothing was sent")
+		return time.Time{}
+	}
+}
+
+// empty asserts nothing is waiting on ch.
+func empty(t *testing.T, ch <-chan time.Time) {
+	t.Helper()
+	select {
+	case at := <-ch:
+		t.Fatalf("unexpected fire at %s", at)
+	default:
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+
+	timer := f.NewTimer(time.Second)
+	f.Advance(999 * time.Millisecond)
+	empty(t, timer.C())
+	f.Advance(time.Millisecond)
+	assert.Equal(t, start.Add(time.Second), received(t, timer.C()))
+	assert.Zero(t, f.Waiters())
+
+	// A stopped timer never fires; a reset one fires relative to the time it was reset at.
+	assert.False(t, timer.Reset(time.Minute))
+	assert.True(t, timer.Stop())
+	f.Advance(time.Hour)
+	empty(t, timer.C())
+	assert.False(t, timer.Reset(time.Second))
+	f.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Hour+2*time.Second), received(t, timer.C()))
+
+	// A zero wait fires at once.
+	received(t, f.After(0))
+}
+
+func TestFakeFiresInDeadlineOrder(t *testing.T) {
+	start := time.Unix(0, 0)
+	f := NewFake(start)
+	late := f.After(3 * time.Second)
+	early := f.After(time.Second)
+	f.Advance(time.Hour)
+
+	// Each waiter sees the clock at its own deadline, not the end of the advance.
+	assert.Equal(t, start.Add(time.Second), received(t, early))
+	assert.Equal(t, start.Add(3*time.Second), received(t, late))
+	assert.Equal(t, start.Add(time.Hour), f.Now())
+}
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Unix(0, 0)
+	f := NewFake(start)
+	ticker := f.NewTicker(10 * time.Second)
+
+	f.Advance(10 * time.Second)
+	assert.Equal(t, start.Add(10*time.Second), received(t, ticker.C()))
+	// Ticks missed by a slow receiver are dropped, like those of a time.Ticker.
+	f.Advance(35 * time.Second)
+	assert.Equal(t, start.Add(20*time.Second), received(t, ticker.C()))
+	empty(t, ticker.C())
+	f.Advance(5 * time.Second)
+	assert.Equal(t, start.Add(50*time.Second), received(t, ticker.C()))
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	empty(t, ticker.C())
+	assert.Panics(t, func() { f.NewTicker(0) })
+}
+
+func TestFakeSleepAndBlockUntil(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	woke := make(chan time.Duration)
+	go func() {
+		began := f.Now()
+		f.Sleep(time.Minute)
+		woke <- f.Since(began)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	select {
+	case slept := <-woke:
+		assert.Equal(t, time.Minute, slept)
+	case <-time.After(time.Second):
+		t.Fatal("the sleeper did not wake up")
+	}
+}
+
+func TestFakeSetBackwards(t *testing.T) {
+	start := time.Unix(100, 0)
+	f := NewFake(start)
+	ch := f.After(time.Second)
+	f.Set(start.Add(-time.Hour))
+	assert.Equal(t, start, f.Now())
+	empty(t, ch)
+	f.Set(start.Add(time.Second))
+	require.Equal(t, start.Add(time.Second), received(t, ch))
+}
+
+func TestOr(t *testing.T) {
+	assert.Equal(t, Real{}, Or(nil))
+	f := NewFake(time.Unix(0, 0))
+	assert.Same(t, f, Or(f))
+}
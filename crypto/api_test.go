@@ -0,0 +1,12 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/internal/apitest"
+)
+
+// TestAPI compares the exported API of the package with testdata/api.txt.
+func TestAPI(t *testing.T) {
+	apitest.Check(t)
+}
@@ -0,0 +1,47 @@
+package crypto
+
+import "io"
+
+// StreamCipher encrypts and decrypts whole streams, writing whatever it needs to decrypt them,
+// such as an IV, along with the ciphertext. Packages that only move encrypted content around
+// take one, so another cipher can be plugged in without them depending on this one.
+type StreamCipher interface {
+	// Encrypt encrypts src into dst, returning the number of bytes written.
+	Encrypt(dst io.Writer, src io.Reader) (int64, error)
+	// Decrypt decrypts the output of Encrypt from src into dst, returning the number of
+	// bytes of it decrypted as Encrypt counts them, Overhead included.
+	Decrypt(dst io.Writer, src io.Reader) (int64, error)
+	// Overhead returns the number of bytes Encrypt writes besides those of the plain data.
+	Overhead() int64
+}
+
+// aesCTR is the StreamCipher of CopyEncrypt and CopyDecrypt under its key.
+type aesCTR []byte
+
+// NewAESCTR returns the StreamCipher encrypting with CopyEncrypt and decrypting with
+// CopyDecrypt under key.
+// Parameters:
+//   - key: The AES key, 16, 24 or 32 bytes long.
+//
+// Returns:
+//   - The cipher; an invalid key is reported when it is used.
+func NewAESCTR(key []byte) StreamCipher {
+	return aesCTR(key)
+}
+
+// Encrypt encrypts src into dst with CopyEncrypt, a random IV first.
+func (c aesCTR) Encrypt(dst io.Writer, src io.Reader) (int64, error) {
+	n, err := CopyEncrypt(c, src, dst)
+	return int64(n), err
+}
+
+// Decrypt decrypts src into dst with CopyDecrypt.
+func (c aesCTR) Decrypt(dst io.Writer, src io.Reader) (int64, error) {
+	n, err := CopyDecrypt(c, src, dst)
+	return int64(n), err
+}
+
+// Overhead returns the size of the IV, Overhead.
+func (c aesCTR) Overhead() int64 {
+	return Overhead
+}
@@ -3,13 +3,19 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 )
 
+// Overhead is the number of bytes CopyEncrypt writes besides the ciphertext: the IV it
+// prepends, as AES-CTR ciphertext is as long as its plaintext.
+const Overhead = aes.BlockSize
+
 // GenerateID creates a unique 32-byte hexadecimal identifier by generating random bytes and encoding them.
 // Returns:
 //   - A unique ID string or an empty string if an error occurs during random byte generation.
@@ -46,6 +52,20 @@ func NewEncryptionKey() []byte {
 	return keyBuf
 }
 
+// DeriveKey derives a 32-byte AES key for a purpose from a master key, so keys for separate
+// purposes can be handed out without revealing the master key or each other.
+// Parameters:
+//   - master: The key the derived key is computed from.
+//   - label: Name of the purpose, distinct for every derived key.
+//
+// Returns:
+//   - The HMAC-SHA256 of label keyed with master.
+func DeriveKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
 // copyStream performs encrypted copying from the source reader to the destination writer.
 // It uses the provided cipher.Stream and encrypts/decrypts data as it reads from src and writes to dst.
 // Parameters:
@@ -95,7 +115,7 @@ func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 		return 0, err
 	}
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 	stream := cipher.NewCTR(block, iv)
@@ -127,3 +147,62 @@ func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	stream := cipher.NewCTR(block, iv)
 	return copyStream(stream, block.BlockSize(), src, dst)
 }
+
+// CopyEncryptIV encrypts data from src like CopyEncrypt, with the given IV rather than a random
+// one, so content can later be appended to the encrypted output with CopyEncryptAt. An IV must
+// not be used again with the same key to encrypt other data at the same offsets.
+// Parameters:
+//   - key: The AES encryption key for encryption.
+//   - iv: The IV, one AES block long, prepended to the output.
+//   - src: The source from which plain data is read.
+//   - dst: The destination where encrypted data will be written.
+//
+// Returns:
+//   - The total number of bytes written or an error if encryption or writing fails.
+func CopyEncryptIV(key []byte, iv []byte, src io.Reader, dst io.Writer) (int, error) {
+	if _, err := dst.Write(iv); err != nil {
+		return 0, err
+	}
+	n, err := CopyEncryptAt(key, iv, 0, src, dst)
+	if err != nil {
+		return 0, err
+	}
+	return len(iv) + int(n), nil
+}
+
+// CopyEncryptAt encrypts data from src as the continuation of an output of CopyEncryptIV with
+// the same IV, offset bytes of plain data into it: the CTR counter starts offset/16 blocks past
+// the IV, skipping the keystream bytes already used by a partial block. The IV is not written,
+// so the output can be appended to the encrypted data as it is.
+// Parameters:
+//   - key: The AES encryption key for encryption.
+//   - iv: The IV the encrypted data starts with.
+//   - offset: Number of plain bytes encrypted before the data of src.
+//   - src: The source from which plain data is read.
+//   - dst: The destination where encrypted data will be written.
+//
+// Returns:
+//   - The number of bytes written or an error if encryption or writing fails.
+func CopyEncryptAt(key []byte, iv []byte, offset int64, src io.Reader, dst io.Writer) (int64, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(iv) != block.BlockSize() || offset < 0 {
+		return 0, fmt.Errorf("crypto: invalid IV of %d bytes or offset %d", len(iv), offset)
+	}
+	// The counter is the IV as a big-endian number, advanced by one per block.
+	counter := make([]byte, len(iv))
+	copy(counter, iv)
+	carry := uint64(offset) / uint64(block.BlockSize())
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%int64(block.BlockSize()))
+	stream.XORKeyStream(skip, skip)
+	n, err := copyStream(stream, 0, src, dst)
+	return int64(n), err
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/aes"
 	"crypto/md5"
 	"encoding/hex"
+	"io"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,6 +36,26 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	assert.Equal(t, payload, out.String(), "Decrypted payload should match the original")
 }
 
+// TestCopyEncryptDecryptOverPipe round-trips empty and tiny payloads through a connection,
+// where reads return whatever has arrived rather than whole buffers.
+func TestCopyEncryptDecryptOverPipe(t *testing.T) {
+	key := NewEncryptionKey()
+	for _, size := range []int{0, 1, 32<<10 - 1, 32 << 10, 32<<10 + 1} {
+		payload := bytes.Repeat([]byte{'z'}, size)
+		local, remote := net.Pipe()
+		go func() {
+			_, err := CopyEncrypt(key, bytes.NewReader(payload), local)
+			assert.Nil(t, err, "CopyEncrypt should not return an error")
+			local.Close()
+		}()
+		out := new(bytes.Buffer)
+		nw, err := CopyDecrypt(key, remote, out)
+		assert.Nil(t, err, "CopyDecrypt should not return an error for %d bytes", size)
+		assert.Equal(t, size+aes.BlockSize, nw, "Decrypted output size should match original size plus IV")
+		assert.Equal(t, string(payload), out.String(), "Decrypted payload should match the original")
+	}
+}
+
 // TestCopyDecryptWithInvalidKey tests decryption with an incorrect key.
 func TestCopyDecryptWithInvalidKey(t *testing.T) {
 	payload := "Test message"
@@ -118,3 +140,94 @@ func TestCopyEncryptDecryptWithEmptyPayload(t *testing.T) {
 	assert.Equal(t, aes.BlockSize, nw, "Decrypted output size should match the size of IV for empty payload")
 	assert.Equal(t, payload, out.String(), "Decrypted payload should match the original empty payload")
 }
+
+// TestDeriveKey checks that derived keys are stable, distinct per label and master, and usable for AES.
+func TestDeriveKey(t *testing.T) {
+	master := NewEncryptionKey()
+	key := DeriveKey(master, "namespace/a")
+	assert.Len(t, key, 32, "Derived keys should be AES-256 keys")
+	assert.Equal(t, key, DeriveKey(master, "namespace/a"), "Derivation should be deterministic")
+	assert.NotEqual(t, key, DeriveKey(master, "namespace/b"), "Labels should yield distinct keys")
+	assert.NotEqual(t, key, DeriveKey(NewEncryptionKey(), "namespace/a"), "Masters should yield distinct keys")
+	assert.NotEqual(t, master, key, "The master key should not be returned")
+}
+
+// TestCopyEncryptAt checks that content encrypted from an offset continues the encryption of
+// the content before it, across block boundaries and a counter carrying into higher bytes.
+func TestCopyEncryptAt(t *testing.T) {
+	key := NewEncryptionKey()
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	for _, iv := range [][]byte{
+		bytes.Repeat([]byte{0x01}, aes.BlockSize),
+		append(bytes.Repeat([]byte{0x00}, aes.BlockSize-2), 0xff, 0xfe),
+		bytes.Repeat([]byte{0xff}, aes.BlockSize),
+	} {
+		whole := new(bytes.Buffer)
+		_, err := CopyEncryptIV(key, iv, bytes.NewReader(payload), whole)
+		assert.Nil(t, err, "CopyEncryptIV should not return an error")
+		for _, offset := range []int{0, 1, 15, 16, 17, 500, len(payload)} {
+			parts := new(bytes.Buffer)
+			_, err := CopyEncryptIV(key, iv, bytes.NewReader(payload[:offset]), parts)
+			assert.Nil(t, err, "CopyEncryptIV should not return an error")
+			n, err := CopyEncryptAt(key, iv, int64(offset), bytes.NewReader(payload[offset:]), parts)
+			assert.Nil(t, err, "CopyEncryptAt should not return an error")
+			assert.Equal(t, int64(len(payload)-offset), n)
+			assert.Equal(t, whole.Bytes(), parts.Bytes(), "offset %d", offset)
+		}
+		out := new(bytes.Buffer)
+		_, err = CopyDecrypt(key, whole, out)
+		assert.Nil(t, err, "CopyDecrypt should not return an error")
+		assert.Equal(t, payload, out.Bytes())
+	}
+	_, err := CopyEncryptAt(key, []byte("short"), 0, bytes.NewReader(payload), io.Discard)
+	assert.NotNil(t, err, "CopyEncryptAt should refuse an IV of the wrong size")
+}
+
+// TestAESCTR round-trips a payload through the StreamCipher of CopyEncrypt and CopyDecrypt.
+func TestAESCTR(t *testing.T) {
+	c := NewAESCTR(NewEncryptionKey())
+	payload := "Foo not Bar"
+	enc := new(bytes.Buffer)
+	n, err := c.Encrypt(enc, bytes.NewReader([]byte(payload)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(enc.Len()), n)
+	assert.Equal(t, int64(len(payload))+c.Overhead(), n)
+
+	out := new(bytes.Buffer)
+	n, err = c.Decrypt(out, enc)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(payload))+c.Overhead(), n)
+	assert.Equal(t, payload, out.String())
+
+	_, err = NewAESCTR([]byte("short")).Encrypt(new(bytes.Buffer), bytes.NewReader([]byte(payload)))
+	assert.Error(t, err, "an invalid key is reported when used")
+}
+
+// TestAESEnvelope round-trips a payload through an object key wrapped under a key encryption
+// key, which only unwraps under the key encryption key and ID it was wrapped with.
+func TestAESEnvelope(t *testing.T) {
+	c := NewAESEnvelope()
+	kek := NewEncryptionKey()
+	iv, wrapped, err := c.NewKey(kek, "kek-1")
+	assert.NoError(t, err)
+	payload := "Foo not Bar"
+	enc := new(bytes.Buffer)
+	w, err := c.Encrypt(enc, kek, "kek-1", iv, wrapped)
+	assert.NoError(t, err)
+	_, err = io.WriteString(w, payload)
+	assert.NoError(t, err)
+	assert.NotEqual(t, payload, enc.String())
+
+	r, err := c.Decrypt(bytes.NewReader(enc.Bytes()), kek, "kek-1", iv, wrapped)
+	assert.NoError(t, err)
+	out, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, string(out))
+
+	_, err = c.Decrypt(bytes.NewReader(enc.Bytes()), kek, "kek-2", iv, wrapped)
+	assert.Error(t, err, "the key is bound to the ID of its key encryption key")
+	_, err = c.Decrypt(bytes.NewReader(enc.Bytes()), NewEncryptionKey(), "kek-1", iv, wrapped)
+	assert.Error(t, err, "the key only unwraps under its key encryption key")
+	_, _, err = c.NewKey([]byte("short"), "kek-1")
+	assert.Error(t, err, "an invalid key encryption key is reported")
+}
@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// envelopeSuite is the cipher suite of the EnvelopeCipher NewAESEnvelope returns.
+const envelopeSuite = "aes-256-ctr"
+
+// EnvelopeCipher encrypts each object under a key of its own, which it wraps under a key
+// encryption key, so rotating key encryption keys only needs the old ones kept for reading.
+// Packages that store encrypted objects take one, so another cipher can be plugged in without
+// them depending on this one.
+type EnvelopeCipher interface {
+	// Suite names the cipher suite, recorded with every object encrypted.
+	Suite() string
+	// NewKey generates the key and IV of one object, returning the IV and the key wrapped
+	// under kek, bound to kekID.
+	NewKey(kek []byte, kekID string) (iv []byte, wrapped []byte, err error)
+	// Encrypt returns a writer encrypting into w with the key NewKey wrapped.
+	Encrypt(w io.Writer, kek []byte, kekID string, iv []byte, wrapped []byte) (io.Writer, error)
+	// Decrypt returns a reader decrypting r with the key NewKey wrapped.
+	Decrypt(r io.Reader, kek []byte, kekID string, iv []byte, wrapped []byte) (io.Reader, error)
+}
+
+// aesEnvelope encrypts objects with AES-256 in CTR mode, their keys wrapped with AES-GCM.
+type aesEnvelope struct{}
+
+// NewAESEnvelope returns the EnvelopeCipher encrypting objects with AES-256 in CTR mode under
+// keys wrapped with AES-GCM.
+//
+// Returns:
+//   - The cipher; an invalid key encryption key is reported when it is used.
+func NewAESEnvelope() EnvelopeCipher {
+	return aesEnvelope{}
+}
+
+// Suite returns "aes-256-ctr".
+func (aesEnvelope) Suite() string {
+	return envelopeSuite
+}
+
+// NewKey generates a 32-byte key and an IV and seals the key with AES-GCM under kek, kekID as
+// additional data, the nonce first.
+func (aesEnvelope) NewKey(kek []byte, kekID string) ([]byte, []byte, error) {
+	aead, err := keyWrapper(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, iv := make([]byte, 32), make([]byte, aes.BlockSize)
+	nonce := make([]byte, aead.NonceSize())
+	for _, b := range [][]byte{dataKey, iv, nonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return iv, aead.Seal(nonce, nonce, dataKey, []byte(kekID)), nil
+}
+
+// Encrypt returns a writer encrypting into w.
+func (aesEnvelope) Encrypt(w io.Writer, kek []byte, kekID string, iv []byte, wrapped []byte) (io.Writer, error) {
+	stream, err := envelopeStream(kek, kekID, iv, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.StreamWriter{S: stream, W: w}, nil
+}
+
+// Decrypt returns a reader decrypting r.
+func (aesEnvelope) Decrypt(r io.Reader, kek []byte, kekID string, iv []byte, wrapped []byte) (io.Reader, error) {
+	stream, err := envelopeStream(kek, kekID, iv, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.StreamReader{S: stream, R: r}, nil
+}
+
+// keyWrapper returns the AEAD wrapping object keys under kek.
+func keyWrapper(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envelopeStream unwraps the key of an object and returns the CTR stream its content is
+// encrypted with.
+func envelopeStream(kek []byte, kekID string, iv []byte, wrapped []byte) (cipher.Stream, error) {
+	aead, err := keyWrapper(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid IV")
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(kekID))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping the object key: %w", err)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
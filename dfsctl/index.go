@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// runIndex manages the key index of a node's store. Its only subcommand, rebuild, discards
+// the index and rebuilds it from the objects on disk. The node must be stopped while it runs;
+// the store's lock refuses a root that is still in use.
+func runIndex(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "rebuild" {
+		fmt.Fprintln(stderr, "usage: dfsctl index rebuild --root <dir> [flags]")
+		return 2
+	}
+	flags := flag.NewFlagSet("index rebuild", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	root := flags.String("root", "", "storage root of the stopped node")
+	transform := flags.String("transform", storage.CASTransformName, "path transform the store was created with")
+	forceUnlock := flags.Bool("force-unlock", false, "take over a root still locked by a process that is no longer running")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if len(*root) == 0 {
+		fmt.Fprintln(stderr, "usage: dfsctl index rebuild --root <dir> [flags]")
+		return 2
+	}
+	// Init would create a missing root; rebuilding one that does not exist is a mistake.
+	if _, err := os.Stat(*root); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	store := storage.NewStore(storage.StoreOpts{Root: *root, PathTransformName: *transform, ForceUnlock: *forceUnlock})
+	if err := store.Init(); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: opening %s: %s\n", *root, err)
+		return 1
+	}
+	defer store.Close()
+	keys, err := store.RebuildIndex()
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: rebuilding the index of %s: %s\n", *root, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "rebuilt the index of %s: %d keys\n", store.Root, keys)
+	return 0
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// usage describes the available commands.
+const usage = `usage: dfsctl <command> [flags]
+
+commands:
+  status        show every node of the cluster
+  ls            list the keys of the cluster, optionally under --prefix
+  mount         mount the cluster as a directory (Linux builds with -tags fuse)
+  unmount       detach a mount left behind by mount
+  index         rebuild the key index of a stopped node's store from its objects
+  upgrade       bring a stopped node's store to the current on-disk format, or --dry-run
+  migrate       move a stopped node's objects to the layout of another path transform
+  decommission  hand a node's objects to its peers and shut it down
+  gc            collect a node's empty directories and orphaned objects now
+  verify        audit the replicas of every object, exiting 1 when problems are found
+  locate        show which nodes hold an object of a node, with their version and checksum
+  peer drop     disconnect a peer from a node, optionally banning it for --ban
+  selftest      check this host's crypto, disk, filesystem and network before it joins a cluster
+  snapshot      back a node up into a directory on its host while it keeps serving
+  restore       make the storage root of a stopped node from a snapshot
+`
+
+// requestTimeout bounds each request to the gateway.
+const requestTimeout = 10 * time.Second
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command named by the first argument.
+//
+// Returns: The process exit code.
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "status":
+		return runStatus(args[1:], stdout, stderr)
+	case "ls":
+		return runList(args[1:], stdout, stderr)
+	case "mount":
+		return runMount(args[1:], stdout, stderr)
+	case "unmount":
+		return runUnmount(args[1:], stdout, stderr)
+	case "index":
+		return runIndex(args[1:], stdout, stderr)
+	case "upgrade":
+		return runUpgrade(args[1:], stdout, stderr)
+	case "migrate":
+		return runMigrate(args[1:], stdout, stderr)
+	case "decommission":
+		return runDecommission(args[1:], stdout, stderr)
+	case "gc":
+		return runGC(args[1:], stdout, stderr)
+	case "verify":
+		return runVerify(args[1:], stdout, stderr)
+	case "locate":
+		return runLocate(args[1:], stdout, stderr)
+	case "peer":
+		return runPeer(args[1:], stdout, stderr)
+	case "selftest":
+		return runSelfTest(args[1:], stdout, stderr)
+	case "snapshot":
+		return runSnapshot(args[1:], stdout, stderr)
+	case "restore":
+		return runRestore(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "dfsctl: unknown command %q\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// runStatus prints the cluster overview served by a node's gateway, once or every --interval
+// with --watch.
+func runStatus(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:8080", "gateway address of any node")
+	asJSON := flags.Bool("json", false, "print the nodes as JSON")
+	watch := flags.Bool("watch", false, "refresh the view until interrupted")
+	interval := flags.Duration("interval", 2*time.Second, "refresh interval for --watch")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	for {
+		nodes, err := fetchCluster(client, *addr)
+		if err != nil {
+			fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+			if !*watch {
+				return 1
+			}
+		} else {
+			if *watch && !*asJSON {
+				// Clear the terminal so the table refreshes in place.
+				fmt.Fprint(stdout, "\033[H\033[2J")
+			}
+			if *asJSON {
+				err = writeJSON(stdout, nodes)
+			} else {
+				err = formatStatus(stdout, nodes)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+				return 1
+			}
+		}
+		if !*watch {
+			return 0
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// listLine is one line of the gateway's key listing: a key, or the error that ended it.
+type listLine struct {
+	server.KeyInfo
+	Err string `json:"error,omitempty"`
+}
+
+// runList prints the keys served by a node's gateway as they arrive, so listing a large
+// cluster starts printing at once and holds only one key in memory.
+func runList(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:8080", "gateway address of any node")
+	prefix := flags.String("prefix", "", "list only keys starting with this prefix")
+	asJSON := flags.Bool("json", false, "print each key as a line of JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	// The listing is streamed for as long as it takes; only the wait for it to start is bounded.
+	client := &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: requestTimeout}}
+	resp, err := client.Get(gatewayURL(*addr, "/keys?prefix="+url.QueryEscape(*prefix)))
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(stderr, "dfsctl: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	dec := json.NewDecoder(resp.Body)
+	enc := json.NewEncoder(stdout)
+	for {
+		var line listLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return 0
+		} else if err != nil {
+			fmt.Fprintf(stderr, "dfsctl: decoding key listing: %s\n", err)
+			return 1
+		}
+		if len(line.Err) > 0 {
+			fmt.Fprintf(stderr, "dfsctl: listing stopped early: %s\n", line.Err)
+			return 1
+		}
+		if *asJSON {
+			err = enc.Encode(line.KeyInfo)
+		} else {
+			_, err = fmt.Fprintln(stdout, formatKey(line.KeyInfo))
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+			return 1
+		}
+	}
+}
+
+// runDecommission asks the node behind a gateway to hand its objects to its peers and shut
+// down, waiting until it has. The gateway's admin token is taken from --token or, when that
+// is empty, the DFS_ADMIN_TOKEN environment variable.
+func runDecommission(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:8080", "gateway address of the node to decommission")
+	token := flags.String("token", "", "admin token of the gateway, defaults to $DFS_ADMIN_TOKEN")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long the node may take to hand off its objects")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*token) == 0 {
+		*token = os.Getenv("DFS_ADMIN_TOKEN")
+	}
+	req, err := http.NewRequest(http.MethodPost, gatewayURL(*addr, "/decommission?timeout="+url.QueryEscape(timeout.String())), nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	// The node answers once the hand-off is over, so the request outlives its timeout slightly.
+	client := &http.Client{Timeout: *timeout + requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(stderr, "dfsctl: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	fmt.Fprintf(stdout, "decommissioned the node at %s\n", *addr)
+	return 0
+}
+
+// runVerify prints the consistency audit of the cluster run by the node behind a gateway. The
+// exit code is 1 when the audit found problems, so the command can run from cron. The admin
+// token is taken from --token or, when that is empty, the DFS_ADMIN_TOKEN environment variable.
+func runVerify(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:8080", "gateway address of any node")
+	token := flags.String("token", "", "admin token of the gateway, defaults to $DFS_ADMIN_TOKEN")
+	deep := flags.Bool("deep", false, "have every node re-hash its copies of the objects, and challenge a sample of the replicas")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	timeout := flags.Duration("timeout", 10*time.Minute, "how long the audit may take")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*token) == 0 {
+		*token = os.Getenv("DFS_ADMIN_TOKEN")
+	}
+	req, err := http.NewRequest(http.MethodGet, gatewayURL(*addr, "/verify?deep="+strconv.FormatBool(*deep)), nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(stderr, "dfsctl: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	var report server.VerifyReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: decoding audit: %s\n", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = formatVerify(stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	if !report.Healthy() {
+		return 1
+	}
+	return 0
+}
+
+// runLocate prints which nodes hold an object of the node whose gateway is asked, and which
+// should, exiting 1 when no node holds a copy.
+func runLocate(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("locate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:8080", "gateway address of the node owning the object")
+	token := flags.String("token", "", "admin token of the gateway, defaults to $DFS_ADMIN_TOKEN")
+	asJSON := flags.Bool("json", false, "print the locations as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, "usage: dfsctl locate [flags] <key>\n")
+		return 2
+	}
+	if len(*token) == 0 {
+		*token = os.Getenv("DFS_ADMIN_TOKEN")
+	}
+	req, err := http.NewRequest(http.MethodGet, gatewayURL(*addr, "/files/"+url.PathEscape(flags.Arg(0))+"/locations"), nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	// Not found still lists where the copies should be.
+	if resp.StatusCode != http.StatusOK && (resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/json") {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(stderr, "dfsctl: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	var locations []server.ReplicaLocation
+	if err := json.NewDecoder(resp.Body).Decode(&locations); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: decoding locations: %s\n", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(locations)
+	} else {
+		err = formatLocations(stdout, locations)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "dfsctl: no node holds %s\n", flags.Arg(0))
+		return 1
+	}
+	return 0
+}
+
+// runPeer executes the peer subcommand named by the first argument.
+func runPeer(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "drop" {
+		fmt.Fprint(stderr, "usage: dfsctl peer drop [flags] <node-id-or-address>\n")
+		return 2
+	}
+	return runPeerDrop(args[1:], stdout, stderr)
+}
+
+// runPeerDrop has the node behind a gateway close its connection to a peer, named by node ID
+// or address, and refuse the peer's connections for --ban. The ban is forgotten when the node
+// restarts unless --persist is given. The admin token is taken from --token or, when that is
+// empty, the DFS_ADMIN_TOKEN environment variable.
+func runPeerDrop(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("peer drop", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:8080", "gateway address of the node dropping the peer")
+	token := flags.String("token", "", "admin token of the gateway, defaults to $DFS_ADMIN_TOKEN")
+	ban := flags.Duration("ban", 0, "how long the peer's connections are refused")
+	persist := flags.Bool("persist", false, "keep the ban across restarts of the node")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, "usage: dfsctl peer drop [flags] <node-id-or-address>\n")
+		return 2
+	}
+	if len(*token) == 0 {
+		*token = os.Getenv("DFS_ADMIN_TOKEN")
+	}
+	query := url.Values{"peer": {flags.Arg(0)}, "ban": {ban.String()}, "persist": {strconv.FormatBool(*persist)}}
+	req, err := http.NewRequest(http.MethodPost, gatewayURL(*addr, "/peers/drop?"+query.Encode()), nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(stderr, "dfsctl: %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	if *ban > 0 {
+		fmt.Fprintf(stdout, "dropped %s, banned for %s\n", flags.Arg(0), *ban)
+	} else {
+		fmt.Fprintf(stdout, "dropped %s\n", flags.Arg(0))
+	}
+	return 0
+}
+
+// formatVerify prints a summary of the audit followed by a table of its findings.
+func formatVerify(w io.Writer, report server.VerifyReport) error {
+	mode := "shallow"
+	if report.Deep {
+		mode = "deep"
+	}
+	fmt.Fprintf(w, "%s audit of %d nodes: %d objects, %d copies, %d problems\n", mode, report.Nodes, report.Objects, report.Copies, len(report.Findings))
+	if report.Healthy() {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROBLEM\tOWNER\tKEY\tNODES\tDETAIL")
+	for _, f := range report.Findings {
+		nodes := make([]string, len(f.Nodes))
+		for i, id := range f.Nodes {
+			nodes[i] = shortID(id)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", f.Kind, shortID(f.Owner), orDash(f.Key), strings.Join(nodes, ","), orDash(f.Detail))
+	}
+	return tw.Flush()
+}
+
+// formatLocations prints a table of the nodes holding an object, or expected to. The state of
+// stale replicas reads "confirmed (stale)" and nodes the object is not placed on are marked
+// with an asterisk.
+func formatLocations(w io.Writer, locations []server.ReplicaLocation) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tADDR\tSTATE\tVERSION\tSIZE\tCHECKSUM\tVERIFIED\tDETAIL")
+	for _, loc := range locations {
+		node, state := shortID(loc.Node), loc.State
+		if loc.Owner {
+			node += " (owner)"
+		} else if !loc.Placed {
+			node += "*"
+		}
+		if loc.Stale {
+			state += " (stale)"
+		}
+		version, size, checksum, verified := "-", "-", "-", "-"
+		if loc.State == server.LocationConfirmed {
+			version, size, checksum = strconv.FormatUint(loc.Version, 10), formatBytes(loc.Size), shortID(loc.Checksum)
+			if !loc.Verified.IsZero() {
+				verified = loc.Verified.UTC().Format(time.DateTime)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node, orDash(loc.Addr), state, version, size, checksum, verified, orDash(loc.Detail))
+	}
+	return tw.Flush()
+}
+
+// formatKey renders a key as its size, modification time, number of owners and name, followed
+// by the key it points at for an alias.
+func formatKey(key server.KeyInfo) string {
+	line := fmt.Sprintf("%10s  %s  %2d  %s", formatBytes(key.Size), key.ModTime.UTC().Format(time.DateTime), len(key.Owners), key.Key)
+	if len(key.Target) > 0 {
+		line += " -> " + key.Target
+	}
+	return line
+}
+
+// gatewayURL turns an address given on the command line into the URL of a gateway route.
+func gatewayURL(addr string, route string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + route
+}
+
+// fetchCluster asks the gateway at addr for the cluster overview.
+func fetchCluster(client *http.Client, addr string) ([]server.NodeInfo, error) {
+	resp, err := client.Get(gatewayURL(addr, "/cluster"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var nodes []server.NodeInfo
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, fmt.Errorf("decoding cluster overview: %w", err)
+	}
+	return nodes, nil
+}
+
+// writeJSON prints the nodes as indented JSON.
+func writeJSON(w io.Writer, nodes []server.NodeInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(nodes)
+}
+
+// formatStatus prints the nodes as a table. The first node is the one that was queried; nodes
+// whose release or protocol differ from it are flagged as version skewed.
+func formatStatus(w io.Writer, nodes []server.NodeInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDRESS\tUPTIME\tPEERS\tOBJECTS\tPINNED\tBYTES\tZONE\tVERSION\tCLOCK\tSTATUS")
+	for _, node := range nodes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			shortID(node.ID),
+			node.Addr,
+			formatUptime(node),
+			node.Peers,
+			node.Objects,
+			node.Pinned,
+			formatBytes(node.Bytes),
+			orDash(node.Labels["zone"]),
+			orDash(node.Version),
+			formatClockOffset(node),
+			nodeStatus(node, nodes[0]),
+		)
+	}
+	return tw.Flush()
+}
+
+// nodeStatus summarises the health of a node compared with the reference node.
+func nodeStatus(node server.NodeInfo, reference server.NodeInfo) string {
+	switch {
+	case len(node.Err) > 0:
+		return "UNREACHABLE: " + node.Err
+	case node.Version != reference.Version || node.ProtocolVersion != reference.ProtocolVersion:
+		return "VERSION SKEW"
+	case node.ClockSkewed:
+		return "CLOCK SKEW"
+	case len(node.DegradedIO) > 0:
+		return "DEGRADED IO: " + node.DegradedIO
+	case len(node.Overloaded) > 0:
+		return "OVERLOADED: " + node.Overloaded
+	default:
+		return "ok"
+	}
+}
+
+// shortID returns the first eight characters of a node ID.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return orDash(id)
+}
+
+// formatClockOffset renders how far a node's clock is off the reference node's, or a dash
+// when it was not measured.
+func formatClockOffset(node server.NodeInfo) string {
+	if node.ClockOffset == nil {
+		return "-"
+	}
+	offset := node.ClockOffset.Round(time.Millisecond)
+	if offset >= 0 {
+		return "+" + offset.String()
+	}
+	return offset.String()
+}
+
+// formatUptime renders a node's uptime, or a dash when it is unknown.
+func formatUptime(node server.NodeInfo) string {
+	if len(node.Err) > 0 || node.Uptime <= 0 {
+		return "-"
+	}
+	return node.Uptime.Round(time.Second).String()
+}
+
+// formatBytes renders a size with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// orDash returns s, or a dash when it is empty.
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
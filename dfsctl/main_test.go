@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/gateway"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startNode starts a FileServer on listenAddr with the given labels and bootstrap nodes.
+func startNode(t *testing.T, listenAddr string, labels map[string]string, nodes ...string) *server.FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFuncSHA256,
+		Transport:         tr,
+		BootstrapNodes:    nodes,
+		Labels:            labels,
+	})
+	tr.HandshakeFunc = s.Handshake
+	tr.OnNode = s.OnNode
+	tr.OnNodeClosed = s.OnNodeClosed
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+	t.Cleanup(func() {
+		s.Stop()
+		// Stop returns before the transport is closed; wait for the port to be released.
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("tcp", listenAddr)
+			if err == nil {
+				conn.Close()
+			}
+			return err != nil
+		}, 3*time.Second, 10*time.Millisecond)
+	})
+	select {
+	case <-s.Ready():
+	case err := <-errc:
+		t.Fatalf("starting node on %s: %v", listenAddr, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("node on %s not ready", listenAddr)
+	}
+	return s
+}
+
+func TestFormatStatus(t *testing.T) {
+	skew := -10 * time.Minute
+	nodes := []server.NodeInfo{
+		{ID: "0123456789abcdef", Addr: ":4100", Version: "1.2.0", ProtocolVersion: 1, Uptime: 90 * time.Second,
+			Peers: 2, Objects: 10, Bytes: 3 << 20, Labels: map[string]string{"zone": "eu-1"}},
+		{ID: "fedcba9876543210", Addr: ":4101", Version: "1.1.0", ProtocolVersion: 1},
+		{ID: "aaaa", Addr: "127.0.0.1:4002", Err: "timed out"},
+		{ID: "bbbb", Addr: ":4103", Version: "1.2.0", ProtocolVersion: 1, ClockOffset: &skew, ClockSkewed: true},
+	}
+	var out bytes.Buffer
+	require.NoError(t, formatStatus(&out, nodes))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.Contains(t, lines[0], "ZONE")
+	assert.Regexp(t, `^01234567\s+:4100\s+1m30s\s+2\s+10\s+0\s+3\.0 MiB\s+eu-1\s+1\.2\.0\s+-\s+ok$`, lines[1])
+	assert.Contains(t, lines[2], "VERSION SKEW")
+	assert.Contains(t, lines[3], "UNREACHABLE: timed out")
+	assert.Regexp(t, `-10m0s\s+CLOCK SKEW$`, lines[4])
+	assert.Equal(t, "DEGRADED IO: slow", nodeStatus(server.NodeInfo{Version: "1.2.0", ProtocolVersion: 1, DegradedIO: "slow"}, nodes[0]))
+	assert.Equal(t, "OVERLOADED: busy", nodeStatus(server.NodeInfo{Version: "1.2.0", ProtocolVersion: 1, Overloaded: "busy"}, nodes[0]))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "2.0 GiB", formatBytes(2<<30))
+}
+
+func TestStatusEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", map[string]string{"zone": "eu-1"})
+	b := startNode(t, ":4101", map[string]string{"zone": "us-2"}, ":4100")
+	require.NoError(t, a.Store("hello", strings.NewReader("hello world")))
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{}))
+	defer gw.Close()
+
+	var nodes []server.NodeInfo
+	require.Eventually(t, func() bool {
+		var out, errOut bytes.Buffer
+		if run([]string{"status", "--addr", gw.URL, "--json"}, &out, &errOut) != 0 {
+			return false
+		}
+		nodes = nil
+		return json.Unmarshal(out.Bytes(), &nodes) == nil && len(nodes) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	assert.Equal(t, a.ID, nodes[0].ID)
+	assert.Equal(t, "eu-1", nodes[0].Labels["zone"])
+	assert.Equal(t, b.ID, nodes[1].ID)
+	assert.Equal(t, "us-2", nodes[1].Labels["zone"])
+	assert.Equal(t, p2p.ProtocolVersion, nodes[1].ProtocolVersion)
+	assert.Empty(t, nodes[1].Err)
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, run([]string{"status", "--addr", strings.TrimPrefix(gw.URL, "http://")}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), a.ID[:8])
+	assert.Contains(t, out.String(), b.ID[:8])
+	assert.NotContains(t, out.String(), "UNREACHABLE")
+}
+
+func TestDecommissionEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	b := startNode(t, ":4101", nil, ":4100")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 2 }, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, b.Store("hello", strings.NewReader("hello world")))
+	gw := httptest.NewServer(gateway.New(b, gateway.Opts{AdminToken: "admin"}))
+	defer gw.Close()
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 1, run([]string{"decommission", "--addr", gw.URL, "--token", "wrong"}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "403")
+
+	t.Setenv("DFS_ADMIN_TOKEN", "admin")
+	errOut.Reset()
+	require.Equal(t, 0, run([]string{"decommission", "--addr", gw.URL, "--timeout", "10s"}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "decommissioned")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 1 }, 3*time.Second, 50*time.Millisecond,
+		"the decommissioned node should have shut down")
+}
+
+func TestGCEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	require.NoError(t, a.Store("hello", strings.NewReader("hello world")))
+	require.NoError(t, a.Store("kept", strings.NewReader("still here")))
+	require.NoError(t, a.Storage.Delete(a.ID, "hello"))
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{AdminToken: "admin"}))
+	defer gw.Close()
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 1, run([]string{"gc", "--addr", gw.URL, "--token", "wrong"}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "403")
+
+	errOut.Reset()
+	require.Equal(t, 0, run([]string{"gc", "--addr", gw.URL, "--token", "admin"}, &out, &errOut), errOut.String())
+	assert.Regexp(t, `^removed [1-9]\d* empty directories and 0 orphans, reclaiming 0 B\n$`, out.String())
+	ok, err := a.Storage.Has(a.ID, "kept")
+	require.NoError(t, err)
+	assert.True(t, ok, "GC must leave live keys alone")
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"bogus"}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "unknown command")
+}
+
+func TestMountNeedsMountpoint(t *testing.T) {
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"mount", "--write"}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "usage: dfsctl mount")
+}
+
+func TestIndexRebuild(t *testing.T) {
+	root := t.TempDir()
+	store := storage.NewStore(storage.StoreOpts{Root: root, PathTransformName: storage.CASTransformName})
+	require.NoError(t, store.Init())
+	for _, key := range []string{"a", "b"} {
+		_, err := store.Write("owner", key, strings.NewReader(key))
+		require.NoError(t, err)
+	}
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 1, run([]string{"index", "rebuild", "--root", root}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "storage root already in use by PID", "the root is refused while a node holds it")
+	require.NoError(t, store.Close())
+	// An object written by a store that never opened the index database is missing from it.
+	_, err := storage.NewStore(storage.StoreOpts{Root: root, PathTransformName: storage.CASTransformName}).
+		Write("owner", "c", strings.NewReader("c"))
+	require.NoError(t, err)
+	errOut.Reset()
+	require.Equal(t, 0, run([]string{"index", "rebuild", "--root", root}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "3 keys")
+	store = storage.NewStore(storage.StoreOpts{Root: root, PathTransformName: storage.CASTransformName})
+	require.NoError(t, store.Init())
+	keys, err := store.Keys("owner")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	require.NoError(t, store.Close())
+
+	out.Reset()
+	errOut.Reset()
+	assert.Equal(t, 2, run([]string{"index", "rebuild"}, &out, &errOut))
+	assert.Equal(t, 1, run([]string{"index", "rebuild", "--root", filepath.Join(root, "missing")}, &out, &errOut))
+	assert.Equal(t, 1, run([]string{"index", "rebuild", "--root", root, "--transform", storage.FlatTransformName}, &out, &errOut),
+		"a store must not be rebuilt with a transform it was not created with")
+}
+
+func TestUpgrade(t *testing.T) {
+	// A store laid out loose by builds before key indexes, with no FORMAT file.
+	root := t.TempDir()
+	for name, content := range map[string]string{"owner/a/a": "first", "owner/b/b": "second"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	args := []string{"upgrade", "--root", root, "--transform", storage.FlatTransformName}
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, run(append(args, "--dry-run"), &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "would upgrade from format 1 to 2 (index)")
+	assert.Contains(t, out.String(), "describe owner/a")
+	assert.NoFileExists(t, filepath.Join(root, "FORMAT"))
+
+	out.Reset()
+	require.Equal(t, 0, run(args, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "upgraded from format 1 to 2 (index)")
+	assert.Contains(t, out.String(), "upgraded from format 2 to 3 (index-db)")
+	assert.Contains(t, out.String(), "2 keys")
+	store := storage.NewStore(storage.StoreOpts{Root: root, PathTransformName: storage.FlatTransformName})
+	require.NoError(t, store.Init())
+	keys, err := store.Keys("owner")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, keys)
+	require.NoError(t, store.Close())
+
+	out.Reset()
+	require.Equal(t, 0, run(args, &out, &errOut), errOut.String())
+	assert.Equal(t, "format 3 is current\n", out.String())
+	assert.Equal(t, 2, run([]string{"upgrade"}, &out, &errOut))
+}
+
+func TestMigrate(t *testing.T) {
+	root := t.TempDir()
+	store := storage.NewStore(storage.StoreOpts{Root: root, PathTransformName: storage.CASTransformName})
+	require.NoError(t, store.Init())
+	for _, key := range []string{"a", "b"} {
+		_, err := store.Write("owner", key, strings.NewReader(key))
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Close())
+
+	cas2 := storage.NewStore(storage.StoreOpts{Root: root, PathTransformName: storage.CAS2TransformName})
+	err := cas2.Init()
+	require.ErrorIs(t, err, storage.ErrTransformMismatch)
+	assert.ErrorContains(t, err, "dfsctl migrate --root "+store.Root+" --from cas --to cas2")
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"migrate", "--root", root}, &out, &errOut))
+	assert.Equal(t, 2, run([]string{"migrate", "--root", root, "--to", "bogus"}, &out, &errOut))
+	require.Equal(t, 0, run([]string{"migrate", "--root", root, "--to", storage.CAS2TransformName}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "2 objects moved")
+
+	require.NoError(t, cas2.Init())
+	defer cas2.Close()
+	_, r, err := cas2.Read("owner", "a")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(b))
+}
+
+func TestFormatKey(t *testing.T) {
+	key := server.KeyInfo{
+		Key:     "photos/cat.jpg",
+		Size:    1536,
+		ModTime: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		Owners:  []string{"a", "b"},
+	}
+	assert.Equal(t, "   1.5 KiB  2024-05-01 12:30:00   2  photos/cat.jpg", formatKey(key))
+
+	alias := server.KeyInfo{Key: "photos/latest.jpg", ModTime: key.ModTime, Target: "photos/cat.jpg"}
+	assert.Equal(t, "       0 B  2024-05-01 12:30:00   0  photos/latest.jpg -> photos/cat.jpg", formatKey(alias))
+}
+
+func TestListEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	for _, key := range []string{"logs/1", "logs/2", "readme"} {
+		require.NoError(t, a.Store(key, strings.NewReader(key)))
+	}
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{}))
+	defer gw.Close()
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, run([]string{"ls", "--addr", gw.URL, "--prefix", "logs/"}, &out, &errOut), errOut.String())
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], "  logs/1"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "  logs/2"), lines[1])
+
+	out.Reset()
+	require.Equal(t, 0, run([]string{"ls", "--addr", gw.URL, "--json"}, &out, &errOut), errOut.String())
+	dec := json.NewDecoder(&out)
+	var keys []string
+	for dec.More() {
+		var entry server.KeyInfo
+		require.NoError(t, dec.Decode(&entry))
+		keys = append(keys, entry.Key)
+	}
+	assert.Equal(t, []string{"logs/1", "logs/2", "readme"}, keys)
+}
+
+func TestVerifyEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	b := startNode(t, ":4101", nil, ":4100")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 2 }, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, a.Store("hello", strings.NewReader("hello world")))
+	require.Eventually(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("hello"))
+		return ok
+	}, 3*time.Second, 50*time.Millisecond)
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{AdminToken: "admin"}))
+	defer gw.Close()
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 1, run([]string{"verify", "--addr", gw.URL}, &out, &errOut))
+	assert.Contains(t, errOut.String(), "403")
+
+	t.Setenv("DFS_ADMIN_TOKEN", "admin")
+	out.Reset()
+	errOut.Reset()
+	require.Equal(t, 0, run([]string{"verify", "--addr", gw.URL, "--deep"}, &out, &errOut), errOut.String())
+	assert.Equal(t, "deep audit of 2 nodes: 1 objects, 2 copies, 0 problems\n", out.String())
+
+	require.NoError(t, b.Storage.Delete(a.ID, crypto.HashKey("hello")))
+	out.Reset()
+	require.Equal(t, 1, run([]string{"verify", "--addr", gw.URL}, &out, &errOut), errOut.String())
+	assert.Regexp(t, `under-replicated\s+`+a.ID[:8]+`\s+hello\s+`+b.ID[:8]+`\s+1 copies, 2 expected`, out.String())
+
+	out.Reset()
+	require.Equal(t, 1, run([]string{"verify", "--addr", gw.URL, "--json"}, &out, &errOut), errOut.String())
+	var report server.VerifyReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Len(t, report.Findings, 1)
+	assert.Equal(t, server.FindingUnderReplicated, report.Findings[0].Kind)
+	assert.Equal(t, []string{b.ID}, report.Findings[0].Nodes)
+}
+
+func TestLocateEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	b := startNode(t, ":4101", nil, ":4100")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 2 }, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, a.Store("docs/hello", strings.NewReader("hello world")))
+	require.Eventually(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("docs/hello"))
+		return ok
+	}, 3*time.Second, 50*time.Millisecond)
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{AdminToken: "admin"}))
+	defer gw.Close()
+	t.Setenv("DFS_ADMIN_TOKEN", "admin")
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"locate", "--addr", gw.URL}, &out, &errOut))
+	require.Equal(t, 0, run([]string{"locate", "--addr", gw.URL, "docs/hello"}, &out, &errOut), errOut.String())
+	assert.Regexp(t, a.ID[:8]+` \(owner\)\s+\S+\s+confirmed\s+0\s+11 B`, out.String())
+	assert.Regexp(t, b.ID[:8]+`\s+\S+\s+confirmed\s+0\s`, out.String())
+
+	out.Reset()
+	require.NoError(t, b.Storage.Delete(a.ID, crypto.HashKey("docs/hello")))
+	require.Equal(t, 0, run([]string{"locate", "--addr", gw.URL, "--json", "docs/hello"}, &out, &errOut), errOut.String())
+	var locations []server.ReplicaLocation
+	require.NoError(t, json.Unmarshal(out.Bytes(), &locations))
+	require.Len(t, locations, 2)
+	assert.Equal(t, server.LocationAbsent, locations[1].State)
+
+	out.Reset()
+	errOut.Reset()
+	assert.Equal(t, 1, run([]string{"locate", "--addr", gw.URL, "missing"}, &out, &errOut))
+	assert.Contains(t, out.String(), "absent")
+	assert.Contains(t, errOut.String(), "no node holds missing")
+}
+
+func TestPeerDropEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	b := startNode(t, ":4101", nil, ":4100")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 2 }, 3*time.Second, 50*time.Millisecond)
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{AdminToken: "admin"}))
+	defer gw.Close()
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"peer", "drop", "--addr", gw.URL}, &out, &errOut))
+	require.Equal(t, 0, run([]string{"peer", "drop", "--addr", gw.URL, "--token", "admin", "--ban", "1m", b.ID}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "banned for 1m0s")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 1 }, 3*time.Second, 50*time.Millisecond)
+	// b keeps redialing its bootstrap node, which keeps refusing it.
+	assert.Never(t, func() bool { return len(a.ClusterInfo()) == 2 }, 300*time.Millisecond, 50*time.Millisecond)
+}
+
+func TestSelfTest(t *testing.T) {
+	root := t.TempDir()
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, run([]string{"selftest", "--root", root}, &out, &errOut), errOut.String())
+	for _, check := range []string{"crypto", "storage", "filesystem", "transport"} {
+		assert.Regexp(t, "(?m)^"+check+" +PASS ", out.String())
+	}
+	assert.Contains(t, out.String(), "100 MiB streamed")
+
+	// A seed nothing listens on fails its probe, and the command.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	seed := l.Addr().String()
+	require.NoError(t, l.Close())
+	out.Reset()
+	errOut.Reset()
+	require.Equal(t, 1, run([]string{"selftest", "--root", root, "--bootstrap", seed, "--json"}, &out, &errOut))
+	var report server.SelfTestReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	require.Len(t, report.Checks, 5)
+	assert.Equal(t, "seed "+seed, report.Checks[4].Name)
+	assert.False(t, report.Checks[4].Passed)
+	assert.True(t, report.Checks[3].Passed)
+	assert.Contains(t, errOut.String(), "self-test failed: seed "+seed)
+
+	assert.Equal(t, 2, run([]string{"selftest"}, &out, &errOut))
+}
+
+func TestSnapshotAndRestoreEndToEnd(t *testing.T) {
+	a := startNode(t, ":4100", nil)
+	startNode(t, ":4101", nil, ":4100")
+	require.Eventually(t, func() bool { return len(a.ClusterInfo()) == 2 }, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, a.Store("docs/hello", strings.NewReader("hello world")))
+	gw := httptest.NewServer(gateway.New(a, gateway.Opts{AdminToken: "admin"}))
+	defer gw.Close()
+	t.Setenv("DFS_ADMIN_TOKEN", "admin")
+
+	var out, errOut bytes.Buffer
+	assert.Equal(t, 2, run([]string{"snapshot", "--addr", gw.URL}, &out, &errOut))
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	require.Equal(t, 0, run([]string{"snapshot", "--addr", gw.URL, "--dir", dir}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "snapshot of node "+a.ID)
+
+	out.Reset()
+	root := filepath.Join(t.TempDir(), "restored")
+	assert.Equal(t, 2, run([]string{"restore", "--from", dir}, &out, &errOut))
+	require.Equal(t, 0, run([]string{"restore", "--from", dir, "--root", root}, &out, &errOut), errOut.String())
+	assert.Contains(t, out.String(), "start the node with ID "+a.ID)
+	assert.Equal(t, 1, run([]string{"restore", "--from", dir, "--root", root}, &out, &errOut), "the root holds a store already")
+}
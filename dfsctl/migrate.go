@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// runMigrate moves the objects of a stopped node's store from the path transform it was
+// created with to another, so the node can be started with the new one. The store's lock
+// refuses a root that is still in use.
+func runMigrate(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	root := flags.String("root", "", "storage root of the stopped node")
+	from := flags.String("from", storage.CASTransformName, "path transform the store was created with")
+	to := flags.String("to", "", "path transform to move the objects to")
+	forceUnlock := flags.Bool("force-unlock", false, "take over a root still locked by a process that is no longer running")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*root) == 0 || len(*to) == 0 {
+		fmt.Fprintln(stderr, "usage: dfsctl migrate --root <dir> --to <transform> [flags]")
+		return 2
+	}
+	if _, ok := storage.GetPathTransform(*to); !ok {
+		fmt.Fprintf(stderr, "dfsctl: unknown path transform %q\n", *to)
+		return 2
+	}
+	// Init would create a missing root; migrating one that does not exist is a mistake.
+	if _, err := os.Stat(*root); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	store := storage.NewStore(storage.StoreOpts{Root: *root, PathTransformName: *from, ForceUnlock: *forceUnlock})
+	if err := store.Init(); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: opening %s: %s\n", *root, err)
+		return 1
+	}
+	defer store.Close()
+	moved, err := store.MigrateTransform(*to)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: migrating %s to %q: %s\n", *root, *to, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "migrated %s from %q to %q: %d objects moved\n", store.Root, *from, *to, moved)
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/fuse"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// runMount starts a node that joins the cluster and mounts the objects it owns at the
+// mountpoint until interrupted. Reusing the --root and --id of an earlier node mounts that
+// node's objects.
+func runMount(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("mount", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	listen := flags.String("listen", ":4500", "address the mounting node listens on")
+	bootstrap := flags.String("bootstrap", "", "comma-separated addresses of nodes to join")
+	root := flags.String("root", "dfsctl_mount", "storage root of the mounting node")
+	id := flags.String("id", "", "ID of the mounting node, whose objects are shown; random when empty")
+	write := flags.Bool("write", false, "allow creating and overwriting files")
+	refresh := flags.Duration("refresh", 5*time.Second, "how long directory listings are cached")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(stderr, "usage: dfsctl mount [flags] <mountpoint>")
+		return 2
+	}
+	mountpoint := flags.Arg(0)
+
+	var nodes []string
+	if len(*bootstrap) > 0 {
+		nodes = strings.Split(*bootstrap, ",")
+	}
+	s := makeServer(*listen, *root, *id, nodes)
+	go func() {
+		if err := s.Start(); err != nil {
+			fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		}
+	}()
+	defer s.Stop()
+
+	fsys := fuse.New(fuse.NewServerBackend(s), fuse.Opts{Writable: *write, RefreshInterval: *refresh})
+	m, err := fuse.Mount(mountpoint, fsys)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: mounting %s: %s\n", mountpoint, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "mounted node %s on %s; interrupt to unmount\n", s.ID, mountpoint)
+
+	unmounted := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(unmounted)
+	}()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case <-sigs:
+		if err := m.Unmount(); err != nil {
+			fmt.Fprintf(stderr, "dfsctl: unmounting %s: %s\n", mountpoint, err)
+			return 1
+		}
+	case <-unmounted:
+	}
+	return 0
+}
+
+// runUnmount detaches a mount left behind by a dfsctl mount that did not exit cleanly.
+func runUnmount(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "usage: dfsctl unmount <mountpoint>")
+		return 2
+	}
+	if err := fuse.Unmount(args[0]); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: unmounting %s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// makeServer builds the node backing a mount, wired like the nodes started by the driver.
+func makeServer(listenAddr string, root string, id string, nodes []string) *server.FileServer {
+	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := server.NewFileServer(server.FileServerOpts{
+		ID:                id,
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       root,
+		PathTransformName: storage.CASTransformName,
+		Transport:         tcpTransport,
+		BootstrapNodes:    nodes,
+	})
+	tcpTransport.HandshakeFunc = s.Handshake
+	tcpTransport.OnNode = s.OnNode
+	tcpTransport.OnNodeClosed = s.OnNodeClosed
+	return s
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// runSelfTest checks that this host can run a node before it joins a cluster: encryption,
+// writes to the storage root, its filesystem's renames and locks, a loopback connection and,
+// with --bootstrap, the reachability of every seed. The exit code is 1 when any check fails.
+func runSelfTest(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	root := flags.String("root", "", "storage root the node will use; it must not be in use")
+	transform := flags.String("transform", storage.CASTransformName, "path transform of the store")
+	listen := flags.String("listen", ":3000", "address the node will listen on, announced to the seeds")
+	bootstrap := flags.String("bootstrap", "", "comma-separated addresses of the seeds to probe")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*root) == 0 {
+		fmt.Fprintln(stderr, "usage: dfsctl selftest --root <dir> [--bootstrap <addr,...>] [flags]")
+		return 2
+	}
+	var seeds []string
+	for _, addr := range strings.Split(*bootstrap, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			seeds = append(seeds, addr)
+		}
+	}
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: *listen, Decoder: p2p.DefaultDecoder{}})
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       *root,
+		PathTransformName: *transform,
+		Transport:         tr,
+		BootstrapNodes:    seeds,
+	})
+	report, testErr := s.SelfTest()
+	var err error
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = formatSelfTest(stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	if testErr != nil {
+		fmt.Fprintf(stderr, "dfsctl: self-test failed: %s\n", strings.ReplaceAll(testErr.Error(), "\n", "; "))
+		return 1
+	}
+	return 0
+}
+
+// formatSelfTest prints the outcome of every check as a table.
+func formatSelfTest(w io.Writer, report server.SelfTestReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tTIME\tDETAIL")
+	for _, c := range report.Checks {
+		result := "PASS"
+		if !c.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Name, result, c.Elapsed.Round(time.Millisecond), c.Detail)
+	}
+	return tw.Flush()
+}
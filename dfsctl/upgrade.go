@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// runUpgrade brings a stopped node's store to the on-disk format of this build, including
+// upgrades a node refuses to run when it starts. With --dry-run it only reports what would
+// change.
+func runUpgrade(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("upgrade", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	root := flags.String("root", "", "storage root of the stopped node")
+	transform := flags.String("transform", storage.CASTransformName, "path transform the store was created with")
+	dryRun := flags.Bool("dry-run", false, "report what the upgrade would change without changing it")
+	forceUnlock := flags.Bool("force-unlock", false, "take over a root still locked by a process that is no longer running")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*root) == 0 {
+		fmt.Fprintln(stderr, "usage: dfsctl upgrade --root <dir> [--dry-run] [flags]")
+		return 2
+	}
+	// Init would create a missing root; upgrading one that does not exist is a mistake.
+	if _, err := os.Stat(*root); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: %s\n", err)
+		return 1
+	}
+	store := storage.NewStore(storage.StoreOpts{
+		Root:              *root,
+		PathTransformName: *transform,
+		ForceUnlock:       *forceUnlock,
+		ManualUpgrade:     true,
+	})
+	if err := store.Init(); err != nil {
+		fmt.Fprintf(stderr, "dfsctl: opening %s: %s\n", *root, err)
+		return 1
+	}
+	defer store.Close()
+	report, err := store.Upgrade(*dryRun)
+	fmt.Fprintln(stdout, report)
+	if err != nil {
+		fmt.Fprintf(stderr, "dfsctl: upgrading %s: %s\n", *root, err)
+		return 1
+	}
+	return 0
+}
@@ -1,22 +1,43 @@
+// Command fs runs a node of the distributed file system as a daemon. It is configured through
+// the environment, or a config file of KEY=VALUE lines given with -config or CONFIG_FILE whose
+// values the environment overrides, so the same file can serve as a systemd EnvironmentFile.
+//
+// The daemon tells systemd it is ready through sd_notify when NOTIFY_SOCKET is set. SIGTERM and
+// SIGINT hand its objects to its peers, for at most DRAIN_TIMEOUT, and stop it; SIGHUP reloads
+// POLICY_FILE. It exits non-zero when its configuration is invalid, the node fails to start or
+// the transport or gateway fails.
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/gateway"
 	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
 	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
 	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
 )
 
-func makeServer(listenAddr string, nodes ...string) *server.FileServer {
+const (
+	exitFailure = 1 // The node failed to start, or its transport or gateway failed
+	exitUsage   = 2 // The configuration is invalid
+)
+
+func makeServer(listenAddr string, storageRoot string, pathTransform string, nodes ...string) *server.FileServer {
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddr:    listenAddr,
 		HandshakeFunc: p2p.NOPHandshakeFunc,
@@ -26,94 +47,362 @@ func makeServer(listenAddr string, nodes ...string) *server.FileServer {
 
 	fileServerOpts := server.FileServerOpts{
 		EncKey:            crypto.NewEncryptionKey(),
-		StorageRoot:       listenAddr + "_network",
-		PathTransformFunc: storage.CASPathTransformFunc,
+		StorageRoot:       storageRoot,
+		PathTransformName: pathTransform,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes, // BootstrapNodes to connect with other nodes
 	}
 
 	s := server.NewFileServer(fileServerOpts)
 
+	tcpTransport.HandshakeFunc = s.Handshake
 	tcpTransport.OnNode = s.OnNode
+	tcpTransport.OnNodeClosed = s.OnNodeClosed
 
 	return s
 }
 
-func waitForNodes(nodes []string) {
+// waitForNodes waits until every node accepts connections, or ctx is done.
+func waitForNodes(ctx context.Context, nodes []string) error {
 	for _, node := range nodes {
 		for {
-			_, err := net.Dial("tcp", node)
+			conn, err := net.Dial("tcp", node)
 			if err == nil {
+				conn.Close()
 				fmt.Printf("Successfully connected to %s\n", node)
 				break
 			}
 			fmt.Printf("Waiting for %s to be available...\n", node)
-			time.Sleep(1 * time.Second)
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 	}
+	return nil
 }
 
 func main() {
-	listenAddr := os.Getenv("NODE_PORT")
-	bootstrapNodesEnv := os.Getenv("BOOTSTRAP_NODES")
-	nodeName := os.Getenv("NODE_NAME")
+	os.Exit(run(context.Background(), os.Args[1:], os.LookupEnv))
+}
+
+// run runs the daemon until it is signalled to stop, its node or gateway fails, or ctx is
+// done, which shuts it down like SIGTERM. lookupEnv reads the environment.
+//
+// Returns: The exit status, 0 after a clean shutdown.
+func run(ctx context.Context, args []string, lookupEnv func(string) (string, bool)) int {
+	flags := flag.NewFlagSet("fs", flag.ContinueOnError)
+	configFile := flags.String("config", "", "read KEY=VALUE settings from this file; the environment overrides them")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *configFile == "" {
+		*configFile, _ = lookupEnv("CONFIG_FILE")
+	}
+	getenv, err := loadConfig(*configFile, lookupEnv)
+	if err != nil {
+		log.Printf("reading config: %s", err)
+		return exitUsage
+	}
+
+	listenAddr := getenv("NODE_PORT")
+	bootstrapNodesEnv := getenv("BOOTSTRAP_NODES")
+	pathTransform := getenv("PATH_TRANSFORM")
+	if pathTransform == "" {
+		pathTransform = storage.CASTransformName
+	}
+	storageRoot := getenv("STORAGE_ROOT")
+	if storageRoot == "" {
+		storageRoot = listenAddr + "_network"
+	}
 
 	var bootstrapNodes []string
 	if bootstrapNodesEnv != "" {
 		bootstrapNodes = strings.Split(bootstrapNodesEnv, ",")
 	}
 
-	// Wait for bootstrap nodes to be available
-	waitForNodes(bootstrapNodes)
+	s := makeServer(listenAddr, storageRoot, pathTransform, bootstrapNodes...)
+	if err := configure(s, getenv); err != nil {
+		log.Print(err)
+		return exitUsage
+	}
+	policyFile := getenv("POLICY_FILE")
+	if policyFile != "" {
+		if err := reloadPolicies(s, policyFile); err != nil {
+			log.Printf("invalid POLICY_FILE %q: %s", policyFile, err)
+			return exitUsage
+		}
+	}
+	drainTimeout := defaultDrainTimeout
+	if d := getenv("DRAIN_TIMEOUT"); d != "" {
+		var err error
+		if drainTimeout, err = time.ParseDuration(d); err != nil {
+			log.Printf("invalid DRAIN_TIMEOUT %q: %s", d, err)
+			return exitUsage
+		}
+	}
 
-	s := makeServer(listenAddr, bootstrapNodes...)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	defer signal.Stop(sigs)
 
+	// Wait for bootstrap nodes to be available
+	waitCtx, cancelWait := context.WithCancel(ctx)
 	go func() {
-		log.Fatal(s.Start())
+		for {
+			select {
+			case sig := <-sigs:
+				// There are no policies to reload before the node starts.
+				if sig != syscall.SIGHUP {
+					cancelWait()
+					return
+				}
+			case <-waitCtx.Done():
+				return
+			}
+		}
 	}()
+	err = waitForNodes(waitCtx, bootstrapNodes)
+	cancelWait()
+	if err != nil {
+		return 0
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	gatewayFailed := make(chan error, 1)
+	if gatewayAddr := getenv("GATEWAY_ADDR"); gatewayAddr != "" {
+		g := &http.Server{
+			Addr: gatewayAddr,
+			Handler: gateway.New(s, gateway.Opts{
+				Secret:     []byte(getenv("GATEWAY_SECRET")),
+				BaseURL:    getenv("GATEWAY_URL"),
+				AdminToken: getenv("GATEWAY_ADMIN_TOKEN"),
+			}),
+		}
+		defer g.Close()
+		go func() {
+			if err := g.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				gatewayFailed <- err
+			}
+		}()
+	}
 
-	if nodeName == "node3" {
-		time.Sleep(5 * time.Second) // Wait for other nodes to start
-		runDriverCode(s)
+	ready := s.Ready()
+	for {
+		select {
+		case <-ready:
+			ready = nil
+			notifySystemd(lookupEnv, "READY=1")
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				return shutdown(s, lookupEnv, drainTimeout, stopped)
+			}
+			// SIGHUP reloads the policy file.
+			if policyFile == "" {
+				continue
+			}
+			notifySystemd(lookupEnv, "RELOADING=1")
+			if err := reloadPolicies(s, policyFile); err != nil {
+				log.Printf("reloading POLICY_FILE %q: %s; keeping the current policies", policyFile, err)
+			}
+			notifySystemd(lookupEnv, "READY=1")
+		case <-ctx.Done():
+			return shutdown(s, lookupEnv, drainTimeout, stopped)
+		case err := <-gatewayFailed:
+			log.Printf("gateway failed: %s", err)
+			s.Stop()
+			<-stopped
+			return exitFailure
+		case err := <-stopped:
+			if err != nil {
+				log.Printf("file server failed: %s", err)
+				return exitFailure
+			}
+			return 0
+		}
+	}
+}
+
+// shutdown decommissions the node within drainTimeout and waits for Start to return.
+//
+// Returns: The exit status, non-zero if the node had failed.
+func shutdown(s *server.FileServer, lookupEnv func(string) (string, bool), drainTimeout time.Duration, stopped <-chan error) int {
+	notifySystemd(lookupEnv, "STOPPING=1")
+	select {
+	case <-s.Ready():
+		decommission(s, drainTimeout)
+	default:
+		// A node that is not serving yet has nothing to hand off.
+		s.Stop()
+	}
+	if err := <-stopped; err != nil {
+		log.Printf("file server failed: %s", err)
+		return exitFailure
 	}
-	select {} // Block indefinitely
+	return 0
 }
 
-func runDriverCode(s *server.FileServer) {
-	for i := 0; i < 20; i++ {
-		fmt.Println("----------------------------------------------------------------------------------")
-		fmt.Printf("iteration: %d\n", i)
-		fmt.Println("----------------------------------------------------------------------------------")
-		key := fmt.Sprintf("picture_%d.png", i)
-		data := bytes.NewReader([]byte("my very big data file here!"))
-		err := s.Store(key, data)
+// configure applies the settings read by getenv to s.
+//
+// Returns: An error naming the first invalid setting.
+func configure(s *server.FileServer, getenv func(string) string) error {
+	if gcInterval := getenv("GC_INTERVAL"); gcInterval != "" {
+		d, err := time.ParseDuration(gcInterval)
 		if err != nil {
-			fmt.Printf("Error writing file: %v\n", err)
-			continue
+			return fmt.Errorf("invalid GC_INTERVAL %q: %s", gcInterval, err)
 		}
-
-		if err := s.Storage.Delete(s.ID, key); err != nil {
-			return
+		s.GCInterval = d
+	}
+	s.PrefetchFile = getenv("PREFETCH_FILE")
+	s.MirrorAll = getenv("MIRROR_ALL") == "1"
+	s.LinkInsteadOfCopy = getenv("LINK_INSTEAD_OF_COPY") == "1"
+	s.AuditFetches = getenv("AUDIT_FETCHES") == "1"
+	s.DialOnDemand = getenv("DIAL_ON_DEMAND") == "1"
+	s.EphemeralDials = getenv("EPHEMERAL_DIALS") == "1"
+	// The store is already configured, so the option goes to it directly.
+	s.Storage.ForceUnlock = getenv("FORCE_UNLOCK") == "1"
+	s.Storage.SyncWrites = getenv("SYNC_WRITES") == "1"
+	switch check := getenv("STARTUP_CHECK"); check {
+	case "", "repair":
+		s.StartupCheck = server.CheckRepair
+	case "detect":
+		s.StartupCheck = server.CheckDetect
+	case "off":
+		s.StartupCheck = server.CheckOff
+	default:
+		return fmt.Errorf("invalid STARTUP_CHECK %q: want repair, detect or off", check)
+	}
+	if n := getenv("GET_PARALLELISM"); n != "" {
+		k, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Errorf("invalid GET_PARALLELISM %q: %s", n, err)
 		}
-
-		// Read the file back
-		r, err := s.Get(key)
+		s.GetParallelism = k
+	}
+	if n := getenv("GET_HEDGES"); n != "" {
+		k, err := strconv.Atoi(n)
 		if err != nil {
-			log.Printf("Error reading file: %v\n", err)
-			continue
+			return fmt.Errorf("invalid GET_HEDGES %q: %s", n, err)
+		}
+		s.GetHedges = k
+	}
+	if n := getenv("MAX_PEERS"); n != "" {
+		k, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_PEERS %q: %s", n, err)
+		}
+		s.MaxPeers = k
+	}
+	if n := getenv("MIN_FREE_BYTES"); n != "" {
+		k, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid MIN_FREE_BYTES %q: %s", n, err)
+		}
+		s.MinFreeBytes = k
+	}
+	if d := getenv("HEDGE_DELAY"); d != "" {
+		delay, err := time.ParseDuration(d)
+		if err != nil {
+			return fmt.Errorf("invalid HEDGE_DELAY %q: %s", d, err)
+		}
+		s.HedgeDelay = delay
+	}
+	if name := getenv("BOOTSTRAP_DNS"); name != "" {
+		if len(s.BootstrapNodes) > 0 {
+			return errors.New("BOOTSTRAP_DNS and BOOTSTRAP_NODES cannot both be set")
 		}
+		// A name with a port is looked up for A and AAAA records, one without for SRV records.
+		dns := &server.DNSBootstrap{Name: name, Service: getenv("BOOTSTRAP_DNS_SERVICE")}
+		if host, port, err := net.SplitHostPort(name); err == nil {
+			dns.Name, dns.Port = host, port
+		} else if dns.Service == "" {
+			return fmt.Errorf("invalid BOOTSTRAP_DNS %q: want host:port unless BOOTSTRAP_DNS_SERVICE is set", name)
+		}
+		if d := getenv("BOOTSTRAP_DNS_REFRESH"); d != "" {
+			refresh, err := time.ParseDuration(d)
+			if err != nil {
+				return fmt.Errorf("invalid BOOTSTRAP_DNS_REFRESH %q: %s", d, err)
+			}
+			dns.Refresh = refresh
+		}
+		s.Bootstrap = dns
+	}
+	return nil
+}
 
-		b, err := io.ReadAll(r)
+// loadConfig reads the KEY=VALUE settings of the config file at path, if any. Blank lines and
+// lines starting with # are skipped, and values may be quoted.
+//
+// Returns: A function reading a setting from the environment, or from the file when the
+// environment does not set it.
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (func(string) string, error) {
+	settings := make(map[string]string)
+	if path != "" {
+		f, err := os.Open(path)
 		if err != nil {
-			log.Printf("Error reading file contents: %v\n", err)
+			return nil, err
+		}
+		defer f.Close()
+		if settings, err = parseConfig(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return func(key string) string {
+		if v, ok := lookupEnv(key); ok {
+			return v
+		}
+		return settings[key]
+	}, nil
+}
+
+// parseConfig parses KEY=VALUE lines.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: want KEY=VALUE, got %q", n, line)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		settings[key] = value
+	}
+	return settings, scanner.Err()
+}
+
+// reloadPolicies replaces the replication policies of s with those of the policy file.
+func reloadPolicies(s *server.FileServer, path string) error {
+	policies, err := server.LoadPolicies(path)
+	if err != nil {
+		return err
+	}
+	return s.ReloadPolicies(policies)
+}
 
-		fmt.Println(string(b))
+// defaultDrainTimeout bounds the hand-off on shutdown when DRAIN_TIMEOUT is not set.
+const defaultDrainTimeout = 30 * time.Second
 
-		// Delete the file after successful read
-		// if err := s.Storage.Delete(s.ID, key); err != nil {
-		// 	log.Printf("Error deleting file: %v\n", err)
-		// }
+// decommission hands the node's objects to its peers before shutting it down, giving up on
+// the hand-off after timeout.
+func decommission(s *server.FileServer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Decommission(ctx); err != nil {
+		log.Printf("decommissioning: %s; shutting down anyway", err)
+		s.Stop()
 	}
 }
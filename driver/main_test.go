@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+// notifySocket listens where the daemon sends its sd_notify states.
+func notifySocket(t *testing.T) (string, <-chan string) {
+	// Socket paths are limited to about a hundred bytes, more than test temp dirs may take.
+	dir, err := os.MkdirTemp("", "notify")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	states := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return path, states
+}
+
+func expectState(t *testing.T, states <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-states:
+		assert.Equal(t, want, got)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the daemon did not notify %s", want)
+	}
+}
+
+func lookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+// startDaemon runs the daemon until the returned function is called to cancel it.
+func startDaemon(t *testing.T, env map[string]string) (<-chan int, <-chan string, context.CancelFunc) {
+	socket, states := notifySocket(t)
+	env["NOTIFY_SOCKET"] = socket
+	env["STORAGE_ROOT"] = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	exit := make(chan int, 1)
+	go func() { exit <- run(ctx, nil, lookup(env)) }()
+	return exit, states, cancel
+}
+
+func expectExit(t *testing.T, exit <-chan int, want int) {
+	t.Helper()
+	select {
+	case code := <-exit:
+		assert.Equal(t, want, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the daemon did not exit")
+	}
+}
+
+func TestRunShutsDownWhenCancelled(t *testing.T) {
+	exit, states, cancel := startDaemon(t, map[string]string{"NODE_PORT": freeAddr(t), "DRAIN_TIMEOUT": "1s"})
+	expectState(t, states, "READY=1")
+	cancel()
+	expectState(t, states, "STOPPING=1")
+	expectExit(t, exit, 0)
+}
+
+func TestRunFailsWhenStartFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	exit, _, _ := startDaemon(t, map[string]string{"NODE_PORT": l.Addr().String()})
+	expectExit(t, exit, exitFailure)
+}
+
+func TestRunRejectsInvalidConfig(t *testing.T) {
+	exit, _, _ := startDaemon(t, map[string]string{"NODE_PORT": freeAddr(t), "GC_INTERVAL": "often"})
+	expectExit(t, exit, exitUsage)
+}
+
+func TestConfigureDNSBootstrap(t *testing.T) {
+	s := makeServer(freeAddr(t), t.TempDir(), "")
+	env := map[string]string{"BOOTSTRAP_DNS": "dfs-headless:3000", "BOOTSTRAP_DNS_REFRESH": "10s"}
+	require.NoError(t, configure(s, func(key string) string { return env[key] }))
+	assert.Equal(t, &server.DNSBootstrap{Name: "dfs-headless", Port: "3000", Refresh: 10 * time.Second}, s.Bootstrap)
+
+	env = map[string]string{"BOOTSTRAP_DNS": "dfs-headless", "BOOTSTRAP_DNS_SERVICE": "dfs"}
+	require.NoError(t, configure(s, func(key string) string { return env[key] }))
+	assert.Equal(t, &server.DNSBootstrap{Name: "dfs-headless", Service: "dfs"}, s.Bootstrap)
+
+	env = map[string]string{"BOOTSTRAP_DNS": "dfs-headless"}
+	assert.ErrorContains(t, configure(s, func(key string) string { return env[key] }), "invalid BOOTSTRAP_DNS")
+	s = makeServer(freeAddr(t), t.TempDir(), "", "node1:3000")
+	env = map[string]string{"BOOTSTRAP_DNS": "dfs-headless:3000"}
+	assert.ErrorContains(t, configure(s, func(key string) string { return env[key] }), "cannot both be set")
+}
+
+func TestConfigFileUnderEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fs.conf")
+	conf := "# A node\nNODE_PORT=:3000\n\nGATEWAY_URL = \"http://example.com\"\nGATEWAY_SECRET='s3cret'\n"
+	require.NoError(t, os.WriteFile(path, []byte(conf), 0o600))
+	getenv, err := loadConfig(path, lookup(map[string]string{"NODE_PORT": ":4000"}))
+	require.NoError(t, err)
+	assert.Equal(t, ":4000", getenv("NODE_PORT"), "the environment overrides the file")
+	assert.Equal(t, "http://example.com", getenv("GATEWAY_URL"))
+	assert.Equal(t, "s3cret", getenv("GATEWAY_SECRET"))
+	assert.Empty(t, getenv("GC_INTERVAL"))
+
+	_, err = parseConfig(strings.NewReader("NODE_PORT=:3000\nnonsense\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// notifySystemd sends state, such as READY=1, to the service manager over the socket named by
+// NOTIFY_SOCKET, as sd_notify does. Nothing is sent when the variable is not set; failures are
+// only logged, since the daemon runs the same without a service manager.
+func notifySystemd(lookupEnv func(string) (string, bool), state string) {
+	socket, ok := lookupEnv("NOTIFY_SOCKET")
+	if !ok || socket == "" {
+		return
+	}
+	// A leading @ names a socket in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("notifying the service manager of %s: %s", state, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("notifying the service manager of %s: %s", state, err)
+	}
+}
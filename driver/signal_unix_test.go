@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunShutsDownOnSIGTERM(t *testing.T) {
+	exit, states, _ := startDaemon(t, map[string]string{"NODE_PORT": freeAddr(t)})
+	expectState(t, states, "READY=1")
+	// The daemon handles SIGTERM from now on, so it does not kill the test.
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	expectState(t, states, "STOPPING=1")
+	expectExit(t, exit, 0)
+}
+
+func TestRunReloadsPoliciesOnSIGHUP(t *testing.T) {
+	policies := filepath.Join(t.TempDir(), "policies.json")
+	require.NoError(t, os.WriteFile(policies, []byte(`{"tmp/": {"replication_factor": 1}}`), 0o600))
+	exit, states, cancel := startDaemon(t, map[string]string{"NODE_PORT": freeAddr(t), "POLICY_FILE": policies})
+	expectState(t, states, "READY=1")
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	expectState(t, states, "RELOADING=1")
+	expectState(t, states, "READY=1")
+	cancel()
+	expectState(t, states, "STOPPING=1")
+	expectExit(t, exit, 0)
+}
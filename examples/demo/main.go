@@ -0,0 +1,151 @@
+// Command demo joins a running cluster as a node of its own and exercises it: it stores
+// objects, drops its local copies and reads them back from its peers. It is configured
+// through the environment like the daemon: NODE_PORT, BOOTSTRAP_NODES, STORAGE_ROOT and
+// MIN_REPLICAS.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// joinTimeout bounds the wait for the node to connect to a peer.
+const joinTimeout = 30 * time.Second
+
+// durableStoreTimeout bounds the wait for acknowledged replicas when MIN_REPLICAS is set.
+const durableStoreTimeout = 10 * time.Second
+
+func main() {
+	listenAddr := os.Getenv("NODE_PORT")
+	if listenAddr == "" {
+		listenAddr = ":4000"
+	}
+	storageRoot := os.Getenv("STORAGE_ROOT")
+	if storageRoot == "" {
+		storageRoot = listenAddr + "_demo"
+	}
+	var bootstrapNodes []string
+	if nodes := os.Getenv("BOOTSTRAP_NODES"); nodes != "" {
+		bootstrapNodes = strings.Split(nodes, ",")
+	}
+	minReplicas := 0
+	if n := os.Getenv("MIN_REPLICAS"); n != "" {
+		var err error
+		if minReplicas, err = strconv.Atoi(n); err != nil {
+			log.Fatalf("invalid MIN_REPLICAS %q: %s", n, err)
+		}
+	}
+	proxy, err := p2p.ProxyFromEnvironment()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		Proxy:         proxy,
+	})
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:         crypto.NewEncryptionKey(),
+		StorageRoot:    storageRoot,
+		Transport:      tr,
+		BootstrapNodes: bootstrapNodes,
+	})
+	tr.HandshakeFunc = s.Handshake
+	tr.OnNode = s.OnNode
+	tr.OnNodeClosed = s.OnNodeClosed
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	if err := join(s, stopped); err != nil {
+		log.Fatal(err)
+	}
+	runDemo(s, minReplicas)
+	s.Stop()
+	if err := <-stopped; err != nil {
+		log.Fatal(err)
+	}
+}
+
+// join waits for the node to start and connect to a peer.
+func join(s *server.FileServer, stopped <-chan error) error {
+	select {
+	case <-s.Ready():
+	case err := <-stopped:
+		return fmt.Errorf("starting: %w", err)
+	}
+	deadline := time.Now().Add(joinTimeout)
+	for {
+		info, err := s.Stats()
+		if err != nil {
+			return err
+		}
+		if info.Peers > 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no peer connected within %s", joinTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// store stores a file, waiting for minReplicas peers to acknowledge it when non-zero.
+func store(s *server.FileServer, key string, r io.Reader, minReplicas int) error {
+	if minReplicas == 0 {
+		return s.Store(key, r)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), durableStoreTimeout)
+	defer cancel()
+	_, err := s.StoreDurable(ctx, key, r, minReplicas)
+	return err
+}
+
+// runDemo stores objects, deletes the local copies and reads them back from the network.
+func runDemo(s *server.FileServer, minReplicas int) {
+	for i := 0; i < 20; i++ {
+		fmt.Println("----------------------------------------------------------------------------------")
+		fmt.Printf("iteration: %d\n", i)
+		fmt.Println("----------------------------------------------------------------------------------")
+		key := fmt.Sprintf("picture_%d.png", i)
+		data := bytes.NewReader([]byte("my very big data file here!"))
+		err := store(s, key, data, minReplicas)
+		if err != nil {
+			fmt.Printf("Error writing file: %v\n", err)
+			continue
+		}
+
+		if err := s.DropLocalCopy(key); err != nil {
+			return
+		}
+
+		// Read the file back
+		r, err := s.Get(key)
+		if err != nil {
+			log.Printf("Error reading file: %v\n", err)
+			continue
+		}
+
+		b, err := io.ReadAll(r)
+		if err != nil {
+			log.Printf("Error reading file contents: %v\n", err)
+			continue
+		}
+
+		fmt.Println(string(b))
+	}
+}
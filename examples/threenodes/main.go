@@ -0,0 +1,82 @@
+// Command threenodes runs a cluster of three nodes in one process: it stores an object on the
+// first node, drops that node's copy so the object must come back from a replica over the
+// network, reads it back and shuts the cluster down. The nodes listen on
+// 127.0.0.1:4000 to 4002 and keep their storage in a temporary directory.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// startTimeout bounds the wait for the nodes to start and connect to each other.
+const startTimeout = 30 * time.Second
+
+func main() {
+	dir, err := os.MkdirTemp("", "threenodes")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := run(os.Stdout, server.LocalClusterOpts{Dir: dir}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run starts the cluster, stores and reads back an object, printing what it does to w, and
+// stops the cluster.
+func run(w io.Writer, opts server.LocalClusterOpts) error {
+	opts.Nodes = 3
+	cluster := server.NewLocalCluster(opts)
+	if err := cluster.Start(startTimeout); err != nil {
+		return err
+	}
+	err := demo(w, cluster.Nodes)
+	if stopErr := cluster.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// demo stores an object on the first node, replicated to the others, drops the first node's
+// copy and reads the object back through the network.
+func demo(w io.Writer, nodes []*server.FileServer) error {
+	const key = "picture.png"
+	content := []byte("my very big data file here!")
+	first := nodes[0]
+	// Waiting for both peers to acknowledge their replicas lets the reads below find them.
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	if _, err := first.StoreDurable(ctx, key, bytes.NewReader(content), len(nodes)-1); err != nil {
+		return fmt.Errorf("storing %s: %w", key, err)
+	}
+	fmt.Fprintf(w, "stored %s on %s\n", key, first.Transport.Addr())
+
+	// Without a local copy the first node must fetch the object from a peer.
+	if err := first.DropLocalCopy(key); err != nil {
+		return fmt.Errorf("dropping the local copy of %s: %w", key, err)
+	}
+	fmt.Fprintf(w, "dropped the local copy of %s on %s\n", key, first.Transport.Addr())
+
+	info, r, err := first.GetWithInfo(key)
+	if err != nil {
+		return fmt.Errorf("reading %s back: %w", key, err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading %s back: %w", key, err)
+	}
+	if !bytes.Equal(got, content) {
+		return fmt.Errorf("%s read back holds %q", key, got)
+	}
+	fmt.Fprintf(w, "read %s back on %s from %s (%s): %s\n", key, first.Transport.Addr(), info.Source.Addr, info.Source.Kind, got)
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build example
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// TestThreeNodes runs the example over an in-memory network, so it needs no free ports. Run
+// it with -tags example.
+func TestThreeNodes(t *testing.T) {
+	var out bytes.Buffer
+	err := run(&out, server.LocalClusterOpts{Dir: t.TempDir(), Network: p2p.NewMemoryNetwork(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"stored picture.png on 127.0.0.1:4000",
+		"dropped the local copy of picture.png on 127.0.0.1:4000",
+		"(remote): my very big data file here!",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
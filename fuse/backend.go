@@ -0,0 +1,76 @@
+// Package fuse exposes the objects of a FileServer as a directory tree. Keys are interpreted
+// as slash-separated paths. The kernel mount lives behind the "fuse" build tag on Linux;
+// everything else in the package is plain Go and works on any platform.
+package fuse
+
+import (
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// ErrUnsupported is returned by Mount and Unmount in builds without FUSE support.
+var ErrUnsupported = errors.New("fuse: mounting needs a Linux build with -tags fuse")
+
+// Backend is the object store a filesystem is served from.
+type Backend interface {
+	// Keys lists every object that can be shown in the filesystem.
+	Keys() ([]string, error)
+	// Stat describes the object with the given key.
+	Stat(key string) (ObjectAttr, error)
+	// Open reads the object with the given key from offset to its end.
+	Open(key string, offset int64) (io.ReadCloser, error)
+	// Store writes the object with the given key, replacing any previous content.
+	Store(key string, r io.Reader) error
+}
+
+// ObjectAttr describes a stored object.
+type ObjectAttr struct {
+	Size    int64     // Size of the content in bytes
+	ModTime time.Time // Time the object was written
+}
+
+// serverBackend serves the objects a FileServer holds for its own ID.
+type serverBackend struct {
+	server *server.FileServer // Node the objects are read from and stored through
+}
+
+// NewServerBackend returns a Backend listing the keys the FileServer holds for its own ID,
+// reading them with GetRange and writing them with Store.
+func NewServerBackend(s *server.FileServer) Backend {
+	return serverBackend{server: s}
+}
+
+// Keys lists the keys held for the server's ID.
+func (b serverBackend) Keys() ([]string, error) {
+	return b.server.Storage.Keys(b.server.ID)
+}
+
+// Stat returns the plain size and modification time recorded in the object's metadata.
+func (b serverBackend) Stat(key string) (ObjectAttr, error) {
+	meta, err := b.server.Storage.Stat(b.server.ID, key)
+	if err != nil {
+		return ObjectAttr{}, err
+	}
+	return ObjectAttr{Size: meta.PlainSize, ModTime: meta.ModTime}, nil
+}
+
+// Open reads the object from offset with FileServer.GetRange.
+func (b serverBackend) Open(key string, offset int64) (io.ReadCloser, error) {
+	return b.server.GetRange(key, offset, -1)
+}
+
+// Store writes the object with FileServer.Store. Peers that missed the replication are
+// caught up later, so a partial broadcast failure still counts as stored.
+func (b serverBackend) Store(key string, r io.Reader) error {
+	err := b.server.Store(key, r)
+	var be *server.BroadcastError
+	if errors.As(err, &be) {
+		log.Printf("fuse: storing %q: %s", key, err)
+		return nil
+	}
+	return err
+}
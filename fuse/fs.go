@@ -0,0 +1,450 @@
+package fuse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRefreshInterval is how long a listing of the keys is reused when Opts.RefreshInterval
+// is not set.
+const defaultRefreshInterval = 5 * time.Second
+
+// ErrIsDir is returned when a file operation names a directory.
+var ErrIsDir = errors.New("fuse: is a directory")
+
+// ErrNotDir is returned when a directory operation names a file.
+var ErrNotDir = errors.New("fuse: not a directory")
+
+// Opts holds the configuration of an FS.
+type Opts struct {
+	Writable        bool          // Lets files be created and overwritten; the filesystem is read-only otherwise
+	RefreshInterval time.Duration // How long a listing of the keys is reused, defaults to defaultRefreshInterval
+}
+
+// FS maps slash-separated paths onto the objects of a Backend. Paths are relative to the
+// root of the filesystem, which is the empty path. FS holds all the logic of a mount and is
+// safe for concurrent use.
+type FS struct {
+	Opts                                  // Embeds options to make configuration easier
+	backend   Backend                     // Store the objects are served from
+	mu        sync.Mutex                  // Guards the fields below
+	tree      *dir                        // Directories built from the last listing of the keys
+	builtAt   time.Time                   // When tree was built
+	created   map[string][]string         // Path segments of files created but not yet stored, by key
+	madeDirs  map[string][]string         // Path segments of directories made with Mkdir, by path
+	writers   map[string]map[*Writer]bool // Open writers by key, for the size of unstored files
+	mountedAt time.Time                   // Modification time reported for directories
+	now       func() time.Time            // Clock deciding when the listing is refreshed
+}
+
+// Attr describes a file or directory.
+type Attr struct {
+	Mode    fs.FileMode // Type and permission bits
+	Size    int64       // Size of a file's content in bytes
+	ModTime time.Time   // Time the content was last written
+}
+
+// New returns a filesystem serving the objects of backend.
+func New(backend Backend, opts Opts) *FS {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultRefreshInterval
+	}
+	return &FS{
+		Opts:      opts,
+		backend:   backend,
+		created:   make(map[string][]string),
+		madeDirs:  make(map[string][]string),
+		writers:   make(map[string]map[*Writer]bool),
+		mountedAt: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// splitPath returns the segments of a path; the root has none.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// root returns the directory tree, listing the keys again when the last listing is stale.
+// The caller must hold f.mu.
+func (f *FS) root() (*dir, error) {
+	if f.tree != nil && f.now().Sub(f.builtAt) < f.RefreshInterval {
+		return f.tree, nil
+	}
+	keys, err := f.backend.Keys()
+	if err != nil {
+		return nil, err
+	}
+	tree := buildTree(keys)
+	for _, parts := range f.madeDirs {
+		tree.mkdirAll(parts)
+	}
+	for key, parts := range f.created {
+		tree.add(parts, key)
+	}
+	f.tree, f.builtAt = tree, f.now()
+	return tree, nil
+}
+
+// mkdirAll makes the directory at the path parts below d and its missing parents.
+func (d *dir) mkdirAll(parts []string) {
+	for _, part := range parts {
+		child, ok := d.dirs[part]
+		if !ok {
+			child = newDir()
+			d.dirs[part] = child
+			delete(d.files, part)
+		}
+		d = child
+	}
+}
+
+// resolve finds the directory or the key of the file at path. The caller must hold f.mu.
+func (f *FS) resolve(path string) (*dir, string, error) {
+	tree, err := f.root()
+	if err != nil {
+		return nil, "", err
+	}
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return tree, "", nil
+	}
+	parent, ok := tree.walk(parts[:len(parts)-1])
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	}
+	name := parts[len(parts)-1]
+	if d, ok := parent.dirs[name]; ok {
+		return d, "", nil
+	}
+	if key, ok := parent.files[name]; ok {
+		return nil, key, nil
+	}
+	return nil, "", fs.ErrNotExist
+}
+
+// Stat describes the file or directory at path. Files report the size and modification time
+// recorded by the backend, or the size of the pending content while they are being written.
+func (f *FS) Stat(path string) (Attr, error) {
+	f.mu.Lock()
+	d, key, err := f.resolve(path)
+	var pending *Writer
+	for w := range f.writers[key] {
+		pending = w
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return Attr{}, err
+	}
+	if d != nil {
+		return Attr{Mode: fs.ModeDir | f.perm(0o555), ModTime: f.mountedAt}, nil
+	}
+	if pending != nil {
+		return Attr{Mode: f.perm(0o444), Size: pending.Size(), ModTime: f.now()}, nil
+	}
+	attr, err := f.backend.Stat(key)
+	if err != nil {
+		return Attr{}, err
+	}
+	return Attr{Mode: f.perm(0o444), Size: attr.Size, ModTime: attr.ModTime}, nil
+}
+
+// perm adds the owner write bit to mode when the filesystem is writable.
+func (f *FS) perm(mode fs.FileMode) fs.FileMode {
+	if f.Writable {
+		return mode | 0o200
+	}
+	return mode
+}
+
+// ReadDir lists the directory at path sorted by name.
+func (f *FS) ReadDir(path string) ([]Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, ErrNotDir
+	}
+	return d.entries(), nil
+}
+
+// Mkdir makes an empty directory at path. It lasts until the filesystem is closed, and
+// afterwards only if files were stored below it.
+func (f *FS) Mkdir(path string) error {
+	if !f.Writable {
+		return fs.ErrPermission
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, _, err := f.resolve(path); err == nil {
+		return fs.ErrExist
+	}
+	parts, err := f.parentOf(path)
+	if err != nil {
+		return err
+	}
+	f.madeDirs[strings.Join(parts, "/")] = parts
+	f.tree.mkdirAll(parts)
+	return nil
+}
+
+// parentOf checks that the parent directory of path exists and returns the segments of path.
+// The caller must hold f.mu.
+func (f *FS) parentOf(path string) ([]string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return nil, fs.ErrExist
+	}
+	d, _, err := f.resolve(strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, ErrNotDir
+	}
+	return parts, nil
+}
+
+// Open opens the file at path for reading.
+func (f *FS) Open(path string) (*Reader, error) {
+	f.mu.Lock()
+	d, key, err := f.resolve(path)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		return nil, ErrIsDir
+	}
+	return &Reader{backend: f.backend, key: key}, nil
+}
+
+// OpenWrite opens the file at path for writing, creating it when it does not exist. The
+// content is stored in the backend when the writer is flushed.
+//
+// Parameters:
+//   - path: Path of the file.
+//   - truncate: Whether writing starts from empty content rather than the stored content.
+//
+// Returns: A writer for the file, and any errors.
+func (f *FS) OpenWrite(path string, truncate bool) (*Writer, error) {
+	if !f.Writable {
+		return nil, fs.ErrPermission
+	}
+	f.mu.Lock()
+	d, key, err := f.resolve(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		var parts []string
+		if parts, err = f.parentOf(path); err == nil {
+			key = strings.Join(parts, "/")
+			f.created[key] = parts
+			f.tree.add(parts, key)
+			truncate = true
+		}
+	}
+	if err == nil && d != nil {
+		err = ErrIsDir
+	}
+	var w *Writer
+	if err == nil {
+		w = &Writer{fs: f, key: key, dirty: truncate}
+		if f.writers[key] == nil {
+			f.writers[key] = make(map[*Writer]bool)
+		}
+		f.writers[key][w] = true
+	}
+	f.mu.Unlock()
+	if err != nil || truncate {
+		return w, err
+	}
+	rc, err := f.backend.Open(key, 0)
+	if err == nil {
+		w.buf, err = io.ReadAll(rc)
+		rc.Close()
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Truncate changes the size of the file at path. Writers open on the file are truncated and
+// store the change when flushed; otherwise the truncated content is stored at once.
+func (f *FS) Truncate(path string, size int64) error {
+	if !f.Writable {
+		return fs.ErrPermission
+	}
+	f.mu.Lock()
+	d, key, err := f.resolve(path)
+	var open []*Writer
+	for w := range f.writers[key] {
+		open = append(open, w)
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		return ErrIsDir
+	}
+	for _, w := range open {
+		w.Truncate(size)
+	}
+	if len(open) > 0 {
+		return nil
+	}
+	w, err := f.OpenWrite(path, size == 0)
+	if err != nil {
+		return err
+	}
+	w.Truncate(size)
+	return w.Close()
+}
+
+// Reader reads a file by streaming it from the backend. Reads that continue where the last
+// one stopped reuse the stream; any other read reopens it at the new offset.
+type Reader struct {
+	backend Backend       // Store the file is read from
+	key     string        // Key of the file
+	mu      sync.Mutex    // Guards the fields below
+	rc      io.ReadCloser // Open stream, positioned at pos
+	pos     int64         // Offset of the next byte of rc
+}
+
+// ReadAt reads len(p) bytes from offset off. Fewer bytes are returned, without an error, only
+// at the end of the file.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rc == nil || r.pos != off {
+		if r.rc != nil {
+			r.rc.Close()
+		}
+		rc, err := r.backend.Open(r.key, off)
+		if err != nil {
+			r.rc = nil
+			return 0, err
+		}
+		r.rc, r.pos = rc, off
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.pos += int64(n)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// Close releases the stream.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// Writer buffers the content of a file being written and stores it on Flush.
+type Writer struct {
+	fs    *FS        // Filesystem the file belongs to
+	key   string     // Key the content is stored under
+	mu    sync.Mutex // Guards the fields below
+	buf   []byte     // Content of the file
+	dirty bool       // Whether buf differs from the stored content
+}
+
+// WriteAt writes p at offset off, growing the file as needed.
+func (w *Writer) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(w.buf)) {
+		w.buf = append(w.buf, make([]byte, end-int64(len(w.buf)))...)
+	}
+	copy(w.buf[off:], p)
+	w.dirty = true
+	return len(p), nil
+}
+
+// ReadAt reads the pending content at offset off, so files opened for reading and writing
+// see their own writes.
+func (w *Writer) ReadAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if off >= int64(len(w.buf)) {
+		return 0, nil
+	}
+	return copy(p, w.buf[off:]), nil
+}
+
+// Truncate changes the size of the file.
+func (w *Writer) Truncate(size int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if size <= int64(len(w.buf)) {
+		w.buf = w.buf[:size]
+	} else {
+		w.buf = append(w.buf, make([]byte, size-int64(len(w.buf)))...)
+	}
+	w.dirty = true
+}
+
+// Size returns the size of the pending content.
+func (w *Writer) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int64(len(w.buf))
+}
+
+// Flush stores the content when it changed since the last flush.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	if err := w.fs.backend.Store(w.key, bytes.NewReader(w.buf)); err != nil {
+		return err
+	}
+	w.dirty = false
+	w.fs.mu.Lock()
+	delete(w.fs.created, w.key)
+	// The next listing must include the stored key before the file is no longer pending.
+	w.fs.tree = nil
+	w.fs.mu.Unlock()
+	return nil
+}
+
+// Close flushes the content and releases the writer. A file created by the writer that
+// could not be stored disappears once its last writer is closed.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	f := w.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.writers[w.key], w)
+	if len(f.writers[w.key]) > 0 {
+		return err
+	}
+	delete(f.writers, w.key)
+	if _, ok := f.created[w.key]; ok {
+		delete(f.created, w.key)
+		f.tree = nil
+	}
+	return err
+}
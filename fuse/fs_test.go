@@ -0,0 +1,263 @@
+package fuse
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memBackend keeps objects in memory and counts how often they are opened.
+type memBackend struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	opens   int
+}
+
+func newMemBackend(objects map[string]string) *memBackend {
+	b := &memBackend{objects: make(map[string][]byte)}
+	for key, content := range objects {
+		b.objects[key] = []byte(content)
+	}
+	return b
+}
+
+func (b *memBackend) Keys() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (b *memBackend) Stat(key string) (ObjectAttr, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.objects[key]
+	if !ok {
+		return ObjectAttr{}, fs.ErrNotExist
+	}
+	return ObjectAttr{Size: int64(len(content))}, nil
+}
+
+func (b *memBackend) Open(key string, offset int64) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.objects[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	b.opens++
+	return io.NopCloser(bytes.NewReader(content[min(offset, int64(len(content))):])), nil
+}
+
+func (b *memBackend) Store(key string, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = content
+	return nil
+}
+
+func (b *memBackend) content(key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.objects[key]
+	return string(content), ok
+}
+
+func TestPathsFromKeys(t *testing.T) {
+	fsys := New(newMemBackend(map[string]string{
+		"a/b/c.txt": "hello",
+		"a/d":       "",
+		"top":       "x",
+		"a":         "shadowed by the directory",
+		"bad//key":  "",
+		"../escape": "",
+	}), Opts{})
+
+	entries, err := fsys.ReadDir("")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Name: "a", IsDir: true}, {Name: "top"}}, entries)
+	entries, err = fsys.ReadDir("/a/")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Name: "b", IsDir: true}, {Name: "d"}}, entries)
+
+	attr, err := fsys.Stat("a/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), attr.Size)
+	assert.Equal(t, fs.FileMode(0o444), attr.Mode)
+	attr, err = fsys.Stat("a/b")
+	require.NoError(t, err)
+	assert.True(t, attr.Mode.IsDir())
+
+	_, err = fsys.Stat("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fsys.Stat("top/x")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fsys.ReadDir("top")
+	assert.ErrorIs(t, err, ErrNotDir)
+	_, err = fsys.Open("a")
+	assert.ErrorIs(t, err, ErrIsDir)
+}
+
+func TestListingRefreshes(t *testing.T) {
+	backend := newMemBackend(map[string]string{"one": "1"})
+	fsys := New(backend, Opts{RefreshInterval: time.Minute})
+	now := time.Now()
+	fsys.now = func() time.Time { return now }
+	_, err := fsys.ReadDir("")
+	require.NoError(t, err)
+
+	require.NoError(t, backend.Store("two", strings.NewReader("2")))
+	entries, err := fsys.ReadDir("")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	now = now.Add(time.Minute)
+	entries, err = fsys.ReadDir("")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Name: "one"}, {Name: "two"}}, entries)
+}
+
+func TestReaderStreams(t *testing.T) {
+	backend := newMemBackend(map[string]string{"f": "0123456789"})
+	r, err := New(backend, Opts{}).Open("f")
+	require.NoError(t, err)
+	defer r.Close()
+
+	p := make([]byte, 4)
+	for off, want := range []string{"0123", "4567"} {
+		n, err := r.ReadAt(p, int64(off*4))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(p[:n]))
+	}
+	assert.Equal(t, 1, backend.opens, "sequential reads reuse the stream")
+
+	n, err := r.ReadAt(p, 8)
+	require.NoError(t, err)
+	assert.Equal(t, "89", string(p[:n]), "short read at the end of the file")
+	n, err = r.ReadAt(p, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "2345", string(p[:n]))
+	assert.Equal(t, 2, backend.opens, "reading backwards reopens the stream")
+}
+
+func TestWritesNeedWritable(t *testing.T) {
+	fsys := New(newMemBackend(map[string]string{"f": "x"}), Opts{})
+	_, err := fsys.OpenWrite("f", false)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorIs(t, fsys.Mkdir("d"), fs.ErrPermission)
+}
+
+func TestWriterStoresOnFlush(t *testing.T) {
+	backend := newMemBackend(map[string]string{"f": "hello world"})
+	fsys := New(backend, Opts{Writable: true})
+
+	require.NoError(t, fsys.Mkdir("docs"))
+	w, err := fsys.OpenWrite("docs/new.txt", false)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("draft"), 0)
+	require.NoError(t, err)
+	attr, err := fsys.Stat("docs/new.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), attr.Size, "unstored files report their pending size")
+	_, ok := backend.content("docs/new.txt")
+	assert.False(t, ok)
+
+	require.NoError(t, w.Close())
+	content, _ := backend.content("docs/new.txt")
+	assert.Equal(t, "draft", content)
+	entries, err := fsys.ReadDir("docs")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Name: "new.txt"}}, entries)
+
+	// Writing without truncating edits the stored content in place.
+	w, err = fsys.OpenWrite("f", false)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("WORLD"), 6)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	content, _ = backend.content("f")
+	assert.Equal(t, "hello WORLD", content)
+
+	_, err = fsys.OpenWrite("missing/file", true)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fsys.OpenWrite("docs", true)
+	assert.ErrorIs(t, err, ErrIsDir)
+}
+
+func TestServerBackend(t *testing.T) {
+	s := server.NewFileServer(server.FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFuncSHA256,
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":4300",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		}),
+	})
+	require.NoError(t, s.Store("photos/2024/cat.jpg", strings.NewReader("meow meow")))
+	fsys := New(NewServerBackend(s), Opts{Writable: true})
+
+	entries, err := fsys.ReadDir("photos/2024")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{{Name: "cat.jpg"}}, entries)
+	attr, err := fsys.Stat("photos/2024/cat.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), attr.Size)
+
+	r, err := fsys.Open("photos/2024/cat.jpg")
+	require.NoError(t, err)
+	defer r.Close()
+	p := make([]byte, 4)
+	n, err := r.ReadAt(p, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "meow", string(p[:n]))
+
+	w, err := fsys.OpenWrite("photos/dog.jpg", true)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("woof"), 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	got, err := s.Get("photos/dog.jpg")
+	require.NoError(t, err)
+	content, err := io.ReadAll(got)
+	require.NoError(t, err)
+	assert.Equal(t, "woof", string(content))
+}
+
+func TestTruncate(t *testing.T) {
+	backend := newMemBackend(map[string]string{"f": "hello world", "g": "hello"})
+	fsys := New(backend, Opts{Writable: true})
+
+	require.NoError(t, fsys.Truncate("f", 5))
+	content, _ := backend.content("f")
+	assert.Equal(t, "hello", content, "without writers the change is stored at once")
+
+	// Open writers see the truncation, as the kernel truncates O_TRUNC opens after opening.
+	w, err := fsys.OpenWrite("g", false)
+	require.NoError(t, err)
+	require.NoError(t, fsys.Truncate("g", 0))
+	_, err = w.WriteAt([]byte("bye"), 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	content, _ = backend.content("g")
+	assert.Equal(t, "bye", content)
+}
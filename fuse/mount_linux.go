@@ -0,0 +1,255 @@
+//go:build linux && fuse
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os/exec"
+	"path"
+	"syscall"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	gofuse "github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// Mounted is an FS mounted into the kernel.
+type Mounted struct {
+	server *gofuse.Server // Serves the kernel's requests for the mount
+}
+
+// Mount mounts fsys at mountpoint. The mount is read-only unless fsys is writable, and the
+// kernel caches entries and attributes for the refresh interval of fsys.
+//
+// Parameters:
+//   - mountpoint: Existing directory the filesystem is mounted on.
+//   - fsys: Filesystem to serve.
+//
+// Returns: The mount, and any errors.
+func Mount(mountpoint string, fsys *FS) (*Mounted, error) {
+	ttl := fsys.RefreshInterval
+	opts := &gofs.Options{
+		EntryTimeout: &ttl,
+		AttrTimeout:  &ttl,
+		// DirectMount lets root mount without fusermount installed, as in containers.
+		MountOptions: gofuse.MountOptions{FsName: "dfs", Name: "dfs", DirectMount: true},
+	}
+	if !fsys.Writable {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	srv, err := gofs.Mount(mountpoint, &node{fsys: fsys}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Mounted{server: srv}, nil
+}
+
+// Unmount detaches the filesystem from the kernel.
+func (m *Mounted) Unmount() error {
+	return m.server.Unmount()
+}
+
+// Wait blocks until the filesystem is unmounted.
+func (m *Mounted) Wait() {
+	m.server.Wait()
+}
+
+// Unmount detaches the filesystem mounted at mountpoint by another process, such as a mount
+// whose process died, with fusermount.
+func Unmount(mountpoint string) error {
+	err := exec.Command("fusermount3", "-u", mountpoint).Run()
+	if errors.Is(err, exec.ErrNotFound) {
+		err = exec.Command("fusermount", "-u", mountpoint).Run()
+	}
+	return err
+}
+
+// node is a file or directory of the mount, identified by its path.
+type node struct {
+	gofs.Inode
+	fsys *FS    // Filesystem the node belongs to
+	path string // Path of the node within fsys
+}
+
+var (
+	_ gofs.NodeLookuper  = (*node)(nil)
+	_ gofs.NodeReaddirer = (*node)(nil)
+	_ gofs.NodeGetattrer = (*node)(nil)
+	_ gofs.NodeSetattrer = (*node)(nil)
+	_ gofs.NodeOpener    = (*node)(nil)
+	_ gofs.NodeCreater   = (*node)(nil)
+	_ gofs.NodeMkdirer   = (*node)(nil)
+)
+
+// child returns the inode for the entry name of the directory n.
+func (n *node) child(ctx context.Context, name string, out *gofuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	p := path.Join(n.path, name)
+	attr, err := n.fsys.Stat(p)
+	if err != nil {
+		return nil, errno(err)
+	}
+	fillAttr(&out.Attr, attr)
+	return n.NewInode(ctx, &node{fsys: n.fsys, path: p}, gofs.StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT}), 0
+}
+
+// Lookup finds the entry name of the directory.
+func (n *node) Lookup(ctx context.Context, name string, out *gofuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	return n.child(ctx, name, out)
+}
+
+// Readdir lists the directory.
+func (n *node) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	entries, err := n.fsys.ReadDir(n.path)
+	if err != nil {
+		return nil, errno(err)
+	}
+	list := make([]gofuse.DirEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = gofuse.DirEntry{Name: entry.Name, Mode: syscall.S_IFREG}
+		if entry.IsDir {
+			list[i].Mode = syscall.S_IFDIR
+		}
+	}
+	return gofs.NewListDirStream(list), 0
+}
+
+// Getattr describes the node.
+func (n *node) Getattr(ctx context.Context, fh gofs.FileHandle, out *gofuse.AttrOut) syscall.Errno {
+	attr, err := n.fsys.Stat(n.path)
+	if err != nil {
+		return errno(err)
+	}
+	fillAttr(&out.Attr, attr)
+	return 0
+}
+
+// Setattr supports changing the size of a file, which is how the kernel truncates files
+// opened with O_TRUNC; other attributes are fixed.
+func (n *node) Setattr(ctx context.Context, fh gofs.FileHandle, in *gofuse.SetAttrIn, out *gofuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if err := n.fsys.Truncate(n.path, int64(size)); err != nil {
+			return errno(err)
+		}
+	}
+	return n.Getattr(ctx, fh, out)
+}
+
+// Open opens the file for reading, or for writing when the flags ask for it.
+func (n *node) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		r, err := n.fsys.Open(n.path)
+		if err != nil {
+			return nil, 0, errno(err)
+		}
+		return &readHandle{r: r}, 0, 0
+	}
+	w, err := n.fsys.OpenWrite(n.path, flags&syscall.O_TRUNC != 0)
+	if err != nil {
+		return nil, 0, errno(err)
+	}
+	return &writeHandle{w: w}, gofuse.FOPEN_DIRECT_IO, 0
+}
+
+// Create makes a file in the directory and opens it for writing.
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *gofuse.EntryOut) (*gofs.Inode, gofs.FileHandle, uint32, syscall.Errno) {
+	w, err := n.fsys.OpenWrite(path.Join(n.path, name), true)
+	if err != nil {
+		return nil, nil, 0, errno(err)
+	}
+	inode, e := n.child(ctx, name, out)
+	if e != 0 {
+		w.Close()
+		return nil, nil, 0, e
+	}
+	return inode, &writeHandle{w: w}, gofuse.FOPEN_DIRECT_IO, 0
+}
+
+// Mkdir makes a directory in the directory.
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *gofuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	if err := n.fsys.Mkdir(path.Join(n.path, name)); err != nil {
+		return nil, errno(err)
+	}
+	return n.child(ctx, name, out)
+}
+
+// readHandle serves reads of a file opened read-only.
+type readHandle struct {
+	r *Reader // Streams the file from the backend
+}
+
+// Read reads from the file at off.
+func (h *readHandle) Read(ctx context.Context, dest []byte, off int64) (gofuse.ReadResult, syscall.Errno) {
+	n, err := h.r.ReadAt(dest, off)
+	if err != nil {
+		return nil, errno(err)
+	}
+	return gofuse.ReadResultData(dest[:n]), 0
+}
+
+// Release closes the stream.
+func (h *readHandle) Release(ctx context.Context) syscall.Errno {
+	return errno(h.r.Close())
+}
+
+// writeHandle serves a file opened for writing.
+type writeHandle struct {
+	w *Writer // Buffers the content until it is flushed
+}
+
+// Read reads the pending content at off.
+func (h *writeHandle) Read(ctx context.Context, dest []byte, off int64) (gofuse.ReadResult, syscall.Errno) {
+	n, _ := h.w.ReadAt(dest, off)
+	return gofuse.ReadResultData(dest[:n]), 0
+}
+
+// Write writes data at off.
+func (h *writeHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, err := h.w.WriteAt(data, off)
+	return uint32(n), errno(err)
+}
+
+// Flush stores the content; the kernel flushes on every close of the file.
+func (h *writeHandle) Flush(ctx context.Context) syscall.Errno {
+	return errno(h.w.Flush())
+}
+
+// Release closes the writer.
+func (h *writeHandle) Release(ctx context.Context) syscall.Errno {
+	return errno(h.w.Close())
+}
+
+// fillAttr copies attr into the kernel's attribute structure.
+func fillAttr(out *gofuse.Attr, attr Attr) {
+	out.Mode = uint32(attr.Mode.Perm())
+	if attr.Mode.IsDir() {
+		out.Mode |= syscall.S_IFDIR
+	} else {
+		out.Mode |= syscall.S_IFREG
+	}
+	out.Size = uint64(attr.Size)
+	out.Blocks = (out.Size + 511) / 512
+	out.SetTimes(nil, &attr.ModTime, &attr.ModTime)
+}
+
+// errno maps an error of the filesystem or the FileServer to the errno returned to the kernel.
+func errno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, server.ErrKeyNotFound):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EROFS
+	case errors.Is(err, ErrIsDir):
+		return syscall.EISDIR
+	case errors.Is(err, ErrNotDir):
+		return syscall.ENOTDIR
+	default:
+		return syscall.EIO
+	}
+}
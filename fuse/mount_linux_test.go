@@ -0,0 +1,45 @@
+//go:build linux && fuse
+
+package fuse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("no FUSE device: %s", err)
+	}
+	backend := newMemBackend(map[string]string{"docs/readme.txt": "hello"})
+	dir := t.TempDir()
+	m, err := Mount(dir, New(backend, Opts{Writable: true}))
+	if err != nil {
+		t.Skipf("cannot mount: %s", err)
+	}
+	defer m.Unmount()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "docs"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "readme.txt", entries[0].Name())
+	content, err := os.ReadFile(filepath.Join(dir, "docs", "readme.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "new.txt"), []byte("written through the mount"), 0o644))
+	stored, _ := backend.content("docs/new.txt")
+	assert.Equal(t, "written through the mount", stored)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "readme.txt"), []byte("bye"), 0o644))
+	stored, _ = backend.content("docs/readme.txt")
+	assert.Equal(t, "bye", stored)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "photos", "2024"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "photos", "2024", "cat.jpg"), []byte("meow"), 0o644))
+	stored, _ = backend.content("photos/2024/cat.jpg")
+	assert.Equal(t, "meow", stored)
+}
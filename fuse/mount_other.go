@@ -0,0 +1,24 @@
+//go:build !(linux && fuse)
+
+package fuse
+
+// Mounted is an FS mounted into the kernel. Builds without FUSE support cannot mount.
+type Mounted struct{}
+
+// Mount returns ErrUnsupported: this build has no FUSE support.
+func Mount(mountpoint string, fsys *FS) (*Mounted, error) {
+	return nil, ErrUnsupported
+}
+
+// Unmount returns ErrUnsupported: this build has no FUSE support.
+func (m *Mounted) Unmount() error {
+	return ErrUnsupported
+}
+
+// Wait returns at once: this build has no FUSE support.
+func (m *Mounted) Wait() {}
+
+// Unmount returns ErrUnsupported: this build has no FUSE support.
+func Unmount(mountpoint string) error {
+	return ErrUnsupported
+}
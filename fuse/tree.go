@@ -0,0 +1,95 @@
+package fuse
+
+import (
+	"sort"
+	"strings"
+)
+
+// dir is a directory of the tree built from the object keys.
+type dir struct {
+	dirs  map[string]*dir   // Subdirectories by name
+	files map[string]string // Keys of the files in the directory by name
+}
+
+// Entry is one item of a directory listing.
+type Entry struct {
+	Name  string // Name of the item within its directory
+	IsDir bool   // Whether the item is a directory
+}
+
+// newDir returns an empty directory.
+func newDir() *dir {
+	return &dir{dirs: make(map[string]*dir), files: make(map[string]string)}
+}
+
+// buildTree arranges keys into directories by splitting them on slashes. Keys that are not
+// valid paths are left out, and when a key names both a file and the directory of other
+// keys, such as "a" and "a/b", the directory wins.
+func buildTree(keys []string) *dir {
+	root := newDir()
+	for _, key := range keys {
+		if parts, ok := splitKey(key); ok {
+			root.add(parts, key)
+		}
+	}
+	root.prune()
+	return root
+}
+
+// splitKey returns the path segments of a key, or false when the key has empty, "." or ".."
+// segments and so cannot be shown as a path.
+func splitKey(key string) ([]string, bool) {
+	parts := strings.Split(key, "/")
+	for _, part := range parts {
+		if len(part) == 0 || part == "." || part == ".." {
+			return nil, false
+		}
+	}
+	return parts, true
+}
+
+// add records the file with the given key at the path parts below d.
+func (d *dir) add(parts []string, key string) {
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := d.dirs[part]
+		if !ok {
+			child = newDir()
+			d.dirs[part] = child
+		}
+		d = child
+	}
+	d.files[parts[len(parts)-1]] = key
+}
+
+// prune drops files shadowed by a directory of the same name.
+func (d *dir) prune() {
+	for name, child := range d.dirs {
+		delete(d.files, name)
+		child.prune()
+	}
+}
+
+// walk returns the directory at the path parts below d.
+func (d *dir) walk(parts []string) (*dir, bool) {
+	for _, part := range parts {
+		child, ok := d.dirs[part]
+		if !ok {
+			return nil, false
+		}
+		d = child
+	}
+	return d, true
+}
+
+// entries lists the directory sorted by name.
+func (d *dir) entries() []Entry {
+	entries := make([]Entry, 0, len(d.dirs)+len(d.files))
+	for name := range d.dirs {
+		entries = append(entries, Entry{Name: name, IsDir: true})
+	}
+	for name := range d.files {
+		entries = append(entries, Entry{Name: name})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
@@ -0,0 +1,610 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+)
+
+// Opts holds the configuration of a Gateway.
+type Opts struct {
+	Secret     []byte // Key presigned URLs are signed with; without it no object can be served
+	BaseURL    string // Scheme and host put in front of presigned URLs, e.g. https://files.example.com
+	AdminToken string // Bearer token the admin routes require; without it they are refused
+}
+
+// Gateway exposes a FileServer over HTTP.
+type Gateway struct {
+	Opts                      // Embeds options to make configuration easier
+	server *server.FileServer // Node the gateway serves
+	mux    *http.ServeMux     // Routes requests to their handlers
+	now    func() time.Time   // Clock used to issue and check presigned URLs
+}
+
+// New returns a gateway serving the given FileServer.
+//
+// Routes:
+//   - GET /cluster: JSON array of server.NodeInfo describing the node and its peers.
+//   - GET /keys: The keys of the cluster in sorted order, streamed as one JSON server.KeyInfo
+//     per line. Adding prefix=P lists only the keys starting with P.
+//   - GET /objects: Downloads the object named by a URL from PresignGet. Adding version=N
+//     downloads that version of a versioned object instead of the newest. The X-DFS-Source
+//     header tells whether the newest version was read from disk, the cache or peers
+//     ("local", "cache" or "remote"), and X-DFS-Peer names the node IDs of those peers.
+//     Objects are served with the Content-Type recorded when they were stored and their
+//     checksum as ETag; If-None-Match listing it is answered with 304 Not Modified.
+//   - PUT /objects: Stores the request body under the key named by a URL from PresignPut,
+//     recording the request's Content-Type, or the type sniffed from the body without one.
+//     With an X-DFS-Link-Target header, the key is instead made an alias of the key the
+//     header names, with FileServer.Link, and the body is ignored.
+//   - POST /decommission: Hands the node's objects to its peers and shuts it down, answering
+//     once it is done. Adding timeout=D bounds the hand-off, defaultDecommissionTimeout when
+//     absent. Requires AdminToken.
+//   - GET /check: JSON object of the storage.CheckReport of each owner from the storage check
+//     the node ran at startup, keyed by owner ID. Requires AdminToken.
+//   - GET /mirror: JSON server.MirrorStatus of the latest backfill of a node with MirrorAll
+//     set, whose progress reads like "backfill: 1203/5000 objects". Requires AdminToken.
+//   - GET /verify: JSON server.VerifyReport of a consistency audit of the cluster. Adding
+//     deep=1 has every node re-hash its copies. Requires AdminToken.
+//   - POST /peers/drop: Closes the connection to the peer named by peer=ID or address with
+//     FileServer.DropPeer. Adding ban=D refuses its connections for D, and persist=1 keeps
+//     the ban across restarts of the node. Requires AdminToken.
+//   - GET /files/{key}/locations: JSON array of server.ReplicaLocation telling which nodes hold
+//     the node's object stored under key, from FileServer.Locate; 404 with the array when
+//     no node confirmed a copy. Requires AdminToken.
+//   - GET /maintenance: JSON server.MaintenanceStatus telling when each maintenance job last
+//     ran, for how long, and when it falls due next. Requires AdminToken.
+//   - POST /maintenance/pause, POST /maintenance/resume: Holds back the maintenance jobs
+//     falling due, such as for a window where latency matters, or lets them run again.
+//     Requires AdminToken.
+//   - POST /snapshot: Backs the node up into the directory dir=D on its host with
+//     FileServer.Snapshot while it keeps serving, answering with the JSON
+//     server.SnapshotManifest once it is done. Requires AdminToken.
+//   - POST /gc: Collects the garbage of the node's storage with FileServer.GC, answering with
+//     the JSON storage.GCReport of what was reclaimed. Requires AdminToken.
+//
+// Every response carries the request ID the node logged the request with in X-Request-Id,
+// the one the client sent in that header if it is valid, so a failure can be traced across
+// the nodes that served it.
+func New(s *server.FileServer, opts Opts) *Gateway {
+	g := &Gateway{Opts: opts, server: s, mux: http.NewServeMux(), now: time.Now}
+	g.mux.HandleFunc("/cluster", g.handleCluster)
+	g.mux.HandleFunc("/keys", g.handleKeys)
+	g.mux.HandleFunc(objectsRoute, g.handleObject)
+	g.mux.HandleFunc("/decommission", g.handleDecommission)
+	g.mux.HandleFunc("/check", g.handleCheck)
+	g.mux.HandleFunc("/mirror", g.handleMirror)
+	g.mux.HandleFunc("/verify", g.handleVerify)
+	g.mux.HandleFunc("/peers/drop", g.handleDropPeer)
+	g.mux.HandleFunc(filesRoute, g.handleFiles)
+	g.mux.HandleFunc("/maintenance", g.handleMaintenance)
+	g.mux.HandleFunc("/maintenance/pause", g.handlePauseMaintenance(true))
+	g.mux.HandleFunc("/maintenance/resume", g.handlePauseMaintenance(false))
+	g.mux.HandleFunc("/snapshot", g.handleSnapshot)
+	g.mux.HandleFunc("/gc", g.handleGC)
+	return g
+}
+
+// headerRequestID carries the request ID of a request and its response.
+const headerRequestID = "X-Request-Id"
+
+// ServeHTTP dispatches a request to the matching route, under the request ID the client sent
+// or a new one.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rid := r.Header.Get(headerRequestID)
+	if !validRequestID(rid) {
+		rid = g.server.NewRequestID()
+	}
+	w.Header().Set(headerRequestID, rid)
+	g.mux.ServeHTTP(w, r.WithContext(server.WithRequestID(r.Context(), rid)))
+}
+
+// validRequestID reports whether a request ID sent by a client may be logged as it is: at most
+// 64 letters, digits, dots, dashes and underscores.
+func validRequestID(rid string) bool {
+	if len(rid) == 0 || len(rid) > 64 {
+		return false
+	}
+	for _, c := range rid {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// handleCluster writes the cluster overview returned by FileServer.ClusterInfo.
+func (g *Gateway) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.server.ClusterInfo())
+}
+
+// listFlushLines is the number of keys written between flushes of a /keys response.
+const listFlushLines = 100
+
+// listError ends a /keys response whose listing failed part-way.
+type listError struct {
+	Err string `json:"error"` // Why the listing stopped
+}
+
+// handleKeys streams the keys listed by FileServer.ListNetwork as JSON lines, flushing as they
+// arrive so clients can start on them before the listing finishes. A listing that fails once
+// the response has started ends with a listError line.
+func (g *Gateway) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	lines := 0
+	for entry, err := range g.server.ListNetwork(r.URL.Query().Get("prefix")) {
+		if err != nil {
+			log.Printf("gateway: listing keys: %s", err)
+			enc.Encode(listError{Err: err.Error()})
+			return
+		}
+		if err := enc.Encode(entry); err != nil {
+			// The client went away.
+			return
+		}
+		if lines++; flusher != nil && lines%listFlushLines == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+// defaultDecommissionTimeout bounds a /decommission request without a timeout parameter.
+const defaultDecommissionTimeout = 5 * time.Minute
+
+// handleDecommission decommissions the node with FileServer.Decommission.
+func (g *Gateway) handleDecommission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	timeout := defaultDecommissionTimeout
+	if param := r.URL.Query().Get("timeout"); len(param) > 0 {
+		d, err := time.ParseDuration(param)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout "+strconv.Quote(param), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	if err := g.server.Decommission(ctx); err != nil {
+		log.Printf("gateway: decommissioning: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCheck writes the storage check reports returned by FileServer.CheckReports.
+func (g *Gateway) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.server.CheckReports())
+}
+
+// handleMirror writes the backfill progress returned by FileServer.MirrorStatus.
+func (g *Gateway) handleMirror(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.server.MirrorStatus())
+}
+
+// handleVerify writes the audit returned by FileServer.VerifyCluster.
+func (g *Gateway) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	deep, _ := strconv.ParseBool(r.URL.Query().Get("deep"))
+	writeJSON(w, http.StatusOK, g.server.VerifyCluster(deep))
+}
+
+// handleDropPeer drops a peer with FileServer.DropPeer, or FileServer.DropPeerPersist when
+// persist is set.
+func (g *Gateway) handleDropPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+	peer := query.Get("peer")
+	if len(peer) == 0 {
+		http.Error(w, "peer is required", http.StatusBadRequest)
+		return
+	}
+	var ban time.Duration
+	if param := query.Get("ban"); len(param) > 0 {
+		d, err := time.ParseDuration(param)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid ban "+strconv.Quote(param), http.StatusBadRequest)
+			return
+		}
+		ban = d
+	}
+	drop := g.server.DropPeer
+	if persist, _ := strconv.ParseBool(query.Get("persist")); persist {
+		drop = g.server.DropPeerPersist
+	}
+	if err := drop(peer, ban); err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMaintenance writes the status returned by FileServer.MaintenanceStatus.
+func (g *Gateway) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.server.MaintenanceStatus())
+}
+
+// handlePauseMaintenance returns a handler pausing the node's maintenance, or resuming it.
+func (g *Gateway) handlePauseMaintenance(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !g.authorizedAdmin(r) {
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		}
+		if pause {
+			g.server.PauseMaintenance()
+		} else {
+			g.server.ResumeMaintenance()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleSnapshot takes a snapshot of the node with FileServer.Snapshot.
+func (g *Gateway) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	dir := r.URL.Query().Get("dir")
+	if len(dir) == 0 {
+		http.Error(w, "dir is required", http.StatusBadRequest)
+		return
+	}
+	manifest, err := g.server.Snapshot(dir)
+	if err != nil {
+		log.Printf("gateway: snapshot to %s: %s", dir, err)
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+// handleGC runs FileServer.GC and writes its report.
+func (g *Gateway) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	report, err := g.server.GC()
+	if err != nil {
+		log.Printf("gateway: gc: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// authorizedAdmin reports whether a request carries the AdminToken as its bearer token.
+func (g *Gateway) authorizedAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return len(g.AdminToken) > 0 && ok && subtle.ConstantTimeCompare([]byte(token), []byte(g.AdminToken)) == 1
+}
+
+// filesRoute prefixes the routes describing one of the node's objects by its key.
+const filesRoute = "/files/"
+
+// handleFiles serves the routes under filesRoute. The key is the rest of the path up to the
+// last element, so it may hold slashes of its own.
+func (g *Gateway) handleFiles(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, filesRoute), "/locations")
+	if !ok || len(key) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.authorizedAdmin(r) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return
+	}
+	locations, err := g.server.Locate(key)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, locations)
+	case locations != nil:
+		// No copy was confirmed, but where the copies should be still helps.
+		writeJSON(w, statusFor(err), locations)
+	default:
+		http.Error(w, err.Error(), statusFor(err))
+	}
+}
+
+// handleObject serves a presigned download or upload once its signature and expiry check out.
+func (g *Gateway) handleObject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := g.verify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Has(paramVersion) {
+		g.getVersion(w, claims.key, r.URL.Query().Get(paramVersion))
+	} else if r.Method == http.MethodGet {
+		g.getObject(w, r, claims.key)
+	} else {
+		g.putObject(w, r, claims)
+	}
+}
+
+// Headers describing where a download was served from.
+const (
+	headerSource = "X-DFS-Source" // Kind of the server.FetchSource
+	headerPeer   = "X-DFS-Peer"   // Node IDs of the peers the object was fetched from
+)
+
+// headerLinkTarget names the key an upload makes its key an alias of, instead of storing its body.
+const headerLinkTarget = "X-DFS-Link-Target"
+
+// getObject streams an object to the client with the content type recorded when it was
+// stored, sniffed from its first bytes when none was, and its checksum as ETag. A request whose
+// If-None-Match lists the ETag is answered with 304 Not Modified, without reading the object
+// when this node holds it.
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	match := r.Header.Get("If-None-Match")
+	if info, err := g.server.StatKey(key); len(match) > 0 && err == nil && notModified(w, match, info) {
+		return
+	}
+	info, rc, err := g.server.GetContext(r.Context(), key, server.TransferOpts{})
+	if err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+	defer rc.Close()
+	if notModified(w, match, info) {
+		return
+	}
+	body := io.Reader(rc)
+	contentType := info.ContentType
+	if len(contentType) == 0 {
+		// Peeking leaves the bytes in the buffer the body is then read from.
+		br := bufio.NewReaderSize(rc, sniffLen)
+		head, _ := br.Peek(sniffLen)
+		contentType = server.DetectContentType(head)
+		body = br
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set(headerSource, info.Source.Kind)
+	if len(info.Source.PeerID) > 0 {
+		w.Header().Set(headerPeer, info.Source.PeerID)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("gateway: [req %s] serving %q: %s", server.RequestIDFromContext(r.Context()), key, err)
+	}
+}
+
+// sniffLen is the most bytes server.DetectContentType looks at.
+const sniffLen = 512
+
+// etag returns the ETag of an object, empty for objects stored before checksums.
+func etag(info server.ObjectInfo) string {
+	if len(info.Checksum) == 0 {
+		return ""
+	}
+	return `"` + info.Checksum + `"`
+}
+
+// notModified sets the ETag of an object and, when the If-None-Match header match lists it,
+// answers 304 Not Modified.
+//
+// Returns: Whether the request was answered.
+func notModified(w http.ResponseWriter, match string, info server.ObjectInfo) bool {
+	tag := etag(info)
+	if len(tag) == 0 {
+		return false
+	}
+	w.Header().Set("ETag", tag)
+	for _, listed := range strings.Split(match, ",") {
+		listed = strings.TrimPrefix(strings.TrimSpace(listed), "W/")
+		if listed == tag || listed == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// getVersion streams one version of an object to the client.
+func (g *Gateway) getVersion(w http.ResponseWriter, key string, param string) {
+	version, err := strconv.ParseUint(param, 10, 64)
+	if err != nil || version == 0 {
+		http.Error(w, "version must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	rc, err := g.server.GetVersion(key, version)
+	if err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("gateway: serving %q version %d: %s", key, version, err)
+	}
+}
+
+// putObject stores the request body, rejecting bodies larger than the signed size limit. The
+// body is read in full before it is stored, so a rejected or broken upload never replaces
+// an existing object; Store buffers the content for replication anyway.
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, claims presignClaims) {
+	if target := r.Header.Get(headerLinkTarget); len(target) > 0 {
+		g.linkObject(w, r, claims.key, target)
+		return
+	}
+	body := io.Reader(r.Body)
+	if claims.maxSize > 0 {
+		if r.ContentLength > claims.maxSize {
+			http.Error(w, "request body exceeds the signed size limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = io.LimitReader(r.Body, claims.maxSize+1)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if claims.maxSize > 0 && int64(len(content)) > claims.maxSize {
+		http.Error(w, "request body exceeds the signed size limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta := server.ObjectMetadata{ContentType: r.Header.Get("Content-Type")}
+	if err := g.server.StoreContext(r.Context(), claims.key, bytes.NewReader(content), server.TransferOpts{Metadata: meta}); err != nil {
+		var be *server.BroadcastError
+		if !errors.As(err, &be) {
+			http.Error(w, err.Error(), statusFor(err))
+			return
+		}
+		// The object is stored locally and the missed peers are caught up later.
+		log.Printf("gateway: [req %s] storing %q: %s", server.RequestIDFromContext(r.Context()), claims.key, err)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// linkObject points the alias named by a URL from PresignPut at target.
+func (g *Gateway) linkObject(w http.ResponseWriter, r *http.Request, alias string, target string) {
+	if err := g.server.Link(alias, target); err != nil {
+		var be *server.BroadcastError
+		if !errors.As(err, &be) {
+			http.Error(w, err.Error(), statusFor(err))
+			return
+		}
+		// The alias is recorded locally and the missed peers are told when they reconnect.
+		log.Printf("gateway: [req %s] linking %q: %s", server.RequestIDFromContext(r.Context()), alias, err)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// statusClientClosed answers a request the client gave up on before it was served.
+const statusClientClosed = 499
+
+// statusFor maps an error returned by the FileServer to the HTTP status of its server.Kind.
+func statusFor(err error) int {
+	switch server.ErrorKind(err) {
+	case server.KindNotFound:
+		return http.StatusNotFound
+	case server.KindInvalid:
+		return http.StatusBadRequest
+	case server.KindDenied:
+		return http.StatusForbidden
+	case server.KindImmutable, server.KindConflict:
+		return http.StatusConflict
+	case server.KindNoSpace:
+		return http.StatusInsufficientStorage
+	case server.KindUnavailable:
+		return http.StatusServiceUnavailable
+	case server.KindTimeout:
+		return http.StatusGatewayTimeout
+	case server.KindCanceled:
+		return statusClientClosed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON writes v as the JSON body of a response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("gateway: writing response: %s", err)
+	}
+}
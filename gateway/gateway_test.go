@@ -0,0 +1,566 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/server"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGateway returns a gateway over a FileServer without peers, served by an httptest server.
+func newTestGateway(t *testing.T) (*Gateway, *httptest.Server) {
+	return newTestGatewayOpts(t, server.FileServerOpts{})
+}
+
+// newTestGatewayOpts returns a gateway like newTestGateway, over a FileServer configured with
+// opts in addition to its storage and transport.
+func newTestGatewayOpts(t *testing.T, opts server.FileServerOpts) (*Gateway, *httptest.Server) {
+	opts.Transport = p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":4200",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	opts.EncKey = crypto.NewEncryptionKey()
+	opts.StorageRoot = t.TempDir()
+	opts.PathTransformFunc = storage.CASPathTransformFuncSHA256
+	s := server.NewFileServer(opts)
+	g := New(s, Opts{Secret: []byte("test secret")})
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+	g.BaseURL = ts.URL
+	return g, ts
+}
+
+// do sends a request to a presigned URL.
+func do(t *testing.T, method string, u string, body string) *http.Response {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestPresignedRoundTrip(t *testing.T) {
+	g, _ := newTestGateway(t)
+	put, err := g.PresignPut("photos/cat.jpg", time.Minute, 0)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, do(t, http.MethodPut, put, "meow").StatusCode)
+
+	get, err := g.PresignGet("photos/cat.jpg", time.Minute)
+	require.NoError(t, err)
+	resp := do(t, http.MethodGet, get, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "meow", string(content))
+
+	// The upload link cannot be used to download, nor the download link to upload.
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, put, "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPut, get, "woof").StatusCode)
+}
+
+func TestLinkHeaderCreatesAlias(t *testing.T) {
+	g, _ := newTestGateway(t)
+	put, err := g.PresignPut("models/v42", time.Minute, 0)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, do(t, http.MethodPut, put, "weights").StatusCode)
+
+	link := func(alias string, target string) *http.Response {
+		u, err := g.PresignPut(alias, time.Minute, 0)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, u, strings.NewReader("ignored"))
+		require.NoError(t, err)
+		req.Header.Set(headerLinkTarget, target)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusCreated, link("models/latest", "models/v42").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, link("models/v42", "models/latest").StatusCode, "the key names an object")
+
+	get, err := g.PresignGet("models/latest", time.Minute)
+	require.NoError(t, err)
+	resp := do(t, http.MethodGet, get, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "weights", string(content))
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	g, _ := newTestGateway(t)
+	get, err := g.PresignGet("missing", time.Minute)
+	require.NoError(t, err)
+
+	// A failed download quotes the ID the node made up for it.
+	resp := do(t, http.MethodGet, get, "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	rid := resp.Header.Get(headerRequestID)
+	require.NotEmpty(t, rid)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "(request "+rid+")")
+
+	// The client's own ID is kept, unless it could not be logged as it is.
+	for sent, kept := range map[string]bool{"client-42": true, "bad id; forged": false} {
+		req, err := http.NewRequest(http.MethodGet, get, nil)
+		require.NoError(t, err)
+		req.Header.Set(headerRequestID, sent)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, kept, resp.Header.Get(headerRequestID) == sent, sent)
+		assert.NotEmpty(t, resp.Header.Get(headerRequestID))
+	}
+}
+
+func TestDownloadSourceHeaders(t *testing.T) {
+	g, _ := newTestGatewayOpts(t, server.FileServerOpts{CacheBytes: 1 << 20})
+	put, err := g.PresignPut("docs/readme", time.Minute, 0)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, do(t, http.MethodPut, put, "hello").StatusCode)
+	get, err := g.PresignGet("docs/readme", time.Minute)
+	require.NoError(t, err)
+
+	resp := do(t, http.MethodGet, get, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "local", resp.Header.Get("X-DFS-Source"))
+	assert.Empty(t, resp.Header.Get("X-DFS-Peer"))
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	resp = do(t, http.MethodGet, get, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "cache", resp.Header.Get("X-DFS-Source"))
+}
+
+func TestContentTypeAndETag(t *testing.T) {
+	g, _ := newTestGateway(t)
+	binary := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(binary)
+	objects := []struct {
+		key, body, declared, want string
+	}{
+		{key: "cat.png", body: "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", want: "image/png"},
+		{key: "cat.json", body: `{"name": "cat", "lives": 9}`, want: "application/json"},
+		{key: "cat.bin", body: string(binary), want: "application/octet-stream"},
+		{key: "cat.css", body: "body {}", declared: "text/css", want: "text/css"},
+	}
+	for _, o := range objects {
+		put, err := g.PresignPut(o.key, time.Minute, 0)
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, put, strings.NewReader(o.body))
+		require.NoError(t, err)
+		if len(o.declared) > 0 {
+			req.Header.Set("Content-Type", o.declared)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode, o.key)
+
+		get, err := g.PresignGet(o.key, time.Minute)
+		require.NoError(t, err)
+		resp = do(t, http.MethodGet, get, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, o.key)
+		assert.Equal(t, o.want, resp.Header.Get("Content-Type"), o.key)
+		sum := sha256.Sum256([]byte(o.body))
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		assert.Equal(t, etag, resp.Header.Get("ETag"), o.key)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, o.body, string(body), o.key)
+		assert.Equal(t, int64(len(body)), resp.ContentLength, o.key)
+
+		// A client holding the object gets 304 without it; one holding other content gets it.
+		req, err = http.NewRequest(http.MethodGet, get, nil)
+		require.NoError(t, err)
+		req.Header.Set("If-None-Match", `"stale", `+etag)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, o.key)
+		assert.Equal(t, etag, resp.Header.Get("ETag"), o.key)
+		assert.Empty(t, body, o.key)
+		req.Header.Set("If-None-Match", `"stale"`)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, o.key)
+	}
+}
+
+func TestPresignedTamperedKey(t *testing.T) {
+	g, _ := newTestGateway(t)
+	get, err := g.PresignGet("public", time.Minute)
+	require.NoError(t, err)
+	u, err := url.Parse(get)
+	require.NoError(t, err)
+	q := u.Query()
+	q.Set(paramKey, "private")
+	u.RawQuery = q.Encode()
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, u.String(), "").StatusCode)
+
+	q.Del(paramSignature)
+	u.RawQuery = q.Encode()
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, u.String(), "").StatusCode)
+}
+
+func TestPresignedExpired(t *testing.T) {
+	g, _ := newTestGateway(t)
+	get, err := g.PresignGet("missing", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, get, "").StatusCode)
+
+	g.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	resp := do(t, http.MethodGet, get, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), errExpired.Error())
+}
+
+func TestPresignedSizeLimit(t *testing.T) {
+	g, ts := newTestGateway(t)
+	put, err := g.PresignPut("small", time.Minute, 4)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, do(t, http.MethodPut, put, "too large").StatusCode)
+
+	// A body sent without a Content-Length is still held to the limit.
+	req, err := http.NewRequest(http.MethodPut, put, io.MultiReader(strings.NewReader("too "), strings.NewReader("large")))
+	require.NoError(t, err)
+	req.ContentLength = -1
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	get, err := g.PresignGet("small", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, get, "").StatusCode)
+
+	assert.Equal(t, http.StatusCreated, do(t, http.MethodPut, put, "tiny").StatusCode)
+	assert.Equal(t, http.StatusOK, do(t, http.MethodGet, get, "").StatusCode)
+}
+
+func TestPresignWithoutSecret(t *testing.T) {
+	g, _ := newTestGateway(t)
+	g.Secret = nil
+	_, err := g.PresignGet("key", time.Minute)
+	assert.ErrorIs(t, err, ErrNoSecret)
+}
+
+func TestPresignedGetVersion(t *testing.T) {
+	g, _ := newTestGateway(t)
+	g.server.VersionedPrefixes = []string{""}
+	put, err := g.PresignPut("notes.txt", time.Minute, 0)
+	require.NoError(t, err)
+	for _, body := range []string{"first", "second"} {
+		require.Equal(t, http.StatusCreated, do(t, http.MethodPut, put, body).StatusCode)
+	}
+
+	get, err := g.PresignGet("notes.txt", time.Minute)
+	require.NoError(t, err)
+	for version, want := range map[string]string{"": "second", "1": "first", "2": "second"} {
+		u := get
+		if len(version) > 0 {
+			u += "&version=" + version
+		}
+		resp := do(t, http.MethodGet, u, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, version)
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(content), version)
+	}
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, get+"&version=7", "").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, do(t, http.MethodGet, get+"&version=latest", "").StatusCode)
+}
+
+func TestPresignedEmptyObject(t *testing.T) {
+	g, _ := newTestGateway(t)
+	put, err := g.PresignPut("empty", time.Minute, 0)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, do(t, http.MethodPut, put, "").StatusCode)
+
+	get, err := g.PresignGet("empty", time.Minute)
+	require.NoError(t, err)
+	resp := do(t, http.MethodGet, get, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("Content-Length"))
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, content)
+}
+
+func TestListKeysStreamsLines(t *testing.T) {
+	g, ts := newTestGateway(t)
+	for _, key := range []string{"photos/cat.jpg", "photos/dog.jpg", "notes.txt"} {
+		require.NoError(t, g.server.Store(key, strings.NewReader(key)))
+	}
+
+	resp := do(t, http.MethodGet, ts.URL+"/keys?prefix="+url.QueryEscape("photos/"), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	dec := json.NewDecoder(resp.Body)
+	var keys []string
+	for dec.More() {
+		var entry server.KeyInfo
+		require.NoError(t, dec.Decode(&entry))
+		assert.Equal(t, []string{g.server.ID}, entry.Owners)
+		assert.Equal(t, int64(len(entry.Key)), entry.Size)
+		keys = append(keys, entry.Key)
+	}
+	assert.Equal(t, []string{"photos/cat.jpg", "photos/dog.jpg"}, keys)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(t, http.MethodPost, ts.URL+"/keys", "").StatusCode)
+}
+
+func TestDecommissionNeedsAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, ts.URL+"/decommission", "").StatusCode,
+		"the route is refused while no admin token is configured")
+
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, ts.URL+"/decommission", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(t, http.MethodGet, ts.URL+"/decommission", "").StatusCode)
+
+	post := func(query string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/decommission"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusBadRequest, post("?timeout=soon").StatusCode)
+	// Without peers there is nothing to hand off.
+	assert.Equal(t, http.StatusNoContent, post("?timeout=5s").StatusCode)
+}
+
+func TestCheckReportsNeedAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, ts.URL+"/check", "").StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/check", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var reports map[string]storage.CheckReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	assert.Empty(t, reports, "the node has not been started, so it has not checked its storage")
+}
+
+func TestMirrorStatusNeedsAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, ts.URL+"/mirror", "").StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/mirror", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var status server.MirrorStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, "backfill: not started", status.Progress)
+}
+
+func TestDropPeerNeedsAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, ts.URL+"/peers/drop?peer=x", "").StatusCode)
+
+	post := func(query string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/peers/drop"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusBadRequest, post("").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, post("?peer=x&ban=forever").StatusCode)
+	assert.Equal(t, http.StatusNotFound, post("?peer=x").StatusCode, "nothing to drop and nothing to ban")
+	// A peer that is not connected can still be banned ahead of its connections.
+	assert.Equal(t, http.StatusNoContent, post("?peer=10.0.0.1&ban=1m").StatusCode)
+}
+
+func TestMaintenanceNeedsAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, ts.URL+"/maintenance", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, ts.URL+"/maintenance/pause", "").StatusCode)
+
+	send := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, send(http.MethodGet, "/maintenance/pause").StatusCode)
+	assert.Equal(t, http.StatusNoContent, send(http.MethodPost, "/maintenance/pause").StatusCode)
+	resp := send(http.MethodGet, "/maintenance")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var status server.MaintenanceStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.True(t, status.Paused)
+	assert.Equal(t, http.StatusNoContent, send(http.MethodPost, "/maintenance/resume").StatusCode)
+	assert.False(t, g.server.MaintenanceStatus().Paused)
+}
+
+func TestSnapshotNeedsAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, ts.URL+"/snapshot?dir="+url.QueryEscape(dir), "").StatusCode)
+	_, err := g.server.Storage.Write(g.server.ID, "report", strings.NewReader("quarterly numbers"))
+	require.NoError(t, err)
+
+	post := func(query string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/snapshot"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusBadRequest, post("").StatusCode)
+	resp := post("?dir=" + url.QueryEscape(dir))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var manifest server.SnapshotManifest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&manifest))
+	assert.Equal(t, g.server.ID, manifest.Node)
+	require.Len(t, manifest.Objects, 1)
+	assert.Equal(t, "report", manifest.Objects[0].Key)
+	assert.Equal(t, http.StatusInternalServerError, post("?dir="+url.QueryEscape(dir)).StatusCode, "the directory holds a snapshot already")
+}
+
+func TestGCNeedsAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodPost, ts.URL+"/gc", "").StatusCode)
+	_, err := g.server.Storage.Write(g.server.ID, "report", strings.NewReader("quarterly numbers"))
+	require.NoError(t, err)
+	require.NoError(t, g.server.Storage.Delete(g.server.ID, "report"))
+
+	send := func(method string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+"/gc", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, send(http.MethodGet).StatusCode)
+	resp := send(http.MethodPost)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report storage.GCReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Positive(t, report.DirsRemoved, "the deleted object's directories are empty")
+}
+
+func TestStatusForFetchErrors(t *testing.T) {
+	missed := server.PeerResult{Peer: "a", Outcome: server.OutcomeNotFound}
+	stalled := server.PeerResult{Peer: "b", Outcome: server.OutcomeTimeout}
+	assert.Equal(t, http.StatusNotFound, statusFor(&server.FetchError{Key: "k", Peers: []server.PeerResult{missed}}))
+	assert.Equal(t, http.StatusServiceUnavailable, statusFor(&server.FetchError{Key: "k", Peers: []server.PeerResult{missed, stalled}}))
+	assert.Equal(t, http.StatusInsufficientStorage, statusFor(fmt.Errorf("storing (k): %w", server.ErrNoSpace)))
+}
+
+func TestStatusForErrorKinds(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		kind   server.Kind
+		status int
+	}{
+		{fmt.Errorf("getting (k): %w", server.ErrKeyNotFound), server.KindNotFound, http.StatusNotFound},
+		{fmt.Errorf("%w: empty key", server.ErrInvalidKey), server.KindInvalid, http.StatusBadRequest},
+		{&server.DeniedError{Peer: "a", Reason: "no"}, server.KindDenied, http.StatusForbidden},
+		{fmt.Errorf("storing (k): %w", server.ErrImmutable), server.KindImmutable, http.StatusConflict},
+		{server.ErrLeased, server.KindConflict, http.StatusConflict},
+		{fmt.Errorf("storing (k): %w", server.ErrNoSpace), server.KindNoSpace, http.StatusInsufficientStorage},
+		{server.ErrUnavailable, server.KindUnavailable, http.StatusServiceUnavailable},
+		{fmt.Errorf("transfer 1: %w", context.DeadlineExceeded), server.KindTimeout, http.StatusGatewayTimeout},
+		{fmt.Errorf("transfer 1: %w", context.Canceled), server.KindCanceled, statusClientClosed},
+		{errors.New("disk on fire"), server.KindInternal, http.StatusInternalServerError},
+	} {
+		assert.Equal(t, tc.kind, server.ErrorKind(tc.err), tc.err.Error())
+		assert.Equal(t, tc.status, statusFor(tc.err), tc.err.Error())
+	}
+
+	// The same kinds reach clients of presigned links.
+	g, _ := newTestGateway(t)
+	require.NoError(t, g.server.StoreWithMetadata("frozen", strings.NewReader("ice"), server.ObjectMetadata{Immutable: true}))
+	put, err := g.PresignPut("frozen", time.Minute, 0)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, do(t, http.MethodPut, put, "water").StatusCode)
+	get, err := g.PresignGet("missing", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, get, "").StatusCode)
+	get, err = g.PresignGet("", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, do(t, http.MethodGet, get, "").StatusCode)
+}
+
+func TestLocationsNeedAdminToken(t *testing.T) {
+	g, ts := newTestGateway(t)
+	g.AdminToken = "admin"
+	assert.Equal(t, http.StatusForbidden, do(t, http.MethodGet, ts.URL+"/files/docs/a.txt/locations", "").StatusCode)
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusNotFound, get("/files/docs/a.txt").StatusCode)
+	resp := get("/files/docs/a.txt/locations")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "no node holds the object")
+
+	require.NoError(t, g.server.Store("docs/a.txt", strings.NewReader("hello")))
+	resp = get("/files/docs/a.txt/locations")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var locations []server.ReplicaLocation
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&locations))
+	require.Len(t, locations, 1)
+	assert.Equal(t, g.server.ID, locations[0].Node)
+	assert.Equal(t, server.LocationConfirmed, locations[0].State)
+	assert.Equal(t, int64(len("hello")), locations[0].Size)
+}
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrNoSecret is returned when presigning without a gateway secret.
+var ErrNoSecret = errors.New("gateway: no secret configured for presigned URLs")
+
+// errSignature is reported for presigned requests whose signature does not match.
+var errSignature = errors.New("signature mismatch")
+
+// errExpired is reported for presigned requests used after their expiry.
+var errExpired = errors.New("link expired")
+
+// objectsRoute serves presigned object downloads and uploads.
+const objectsRoute = "/objects"
+
+// Query parameters of a presigned URL.
+const (
+	paramKey       = "key"
+	paramExpires   = "expires"
+	paramMaxSize   = "max_size"
+	paramSignature = "signature"
+	// paramVersion selects a version of the object. It is not signed: a download link grants
+	// access to every version of its key.
+	paramVersion = "version"
+)
+
+// presignClaims are the fields covered by the signature of a presigned URL.
+type presignClaims struct {
+	method  string // HTTP method the URL may be used with
+	key     string // Object the URL grants access to
+	expires int64  // Unix time after which the URL is rejected
+	maxSize int64  // Largest body accepted by a presigned PUT; zero means no limit
+}
+
+// PresignGet returns a URL that downloads key until expiry has passed.
+//
+// Parameters:
+//   - key: Object the URL grants access to.
+//   - expiry: How long the URL stays valid.
+//
+// Returns: The presigned URL, and ErrNoSecret when the gateway has no secret.
+func (g *Gateway) PresignGet(key string, expiry time.Duration) (string, error) {
+	return g.presign(presignClaims{method: http.MethodGet, key: key, expires: g.now().Add(expiry).Unix()})
+}
+
+// PresignPut returns a URL that uploads key until expiry has passed.
+//
+// Parameters:
+//   - key: Object the URL grants access to.
+//   - expiry: How long the URL stays valid.
+//   - maxSize: Largest body accepted, in bytes; zero means no limit.
+//
+// Returns: The presigned URL, and ErrNoSecret when the gateway has no secret.
+func (g *Gateway) PresignPut(key string, expiry time.Duration, maxSize int64) (string, error) {
+	return g.presign(presignClaims{method: http.MethodPut, key: key, expires: g.now().Add(expiry).Unix(), maxSize: maxSize})
+}
+
+// presign builds the URL carrying the claims and their signature.
+func (g *Gateway) presign(c presignClaims) (string, error) {
+	if len(g.Secret) == 0 {
+		return "", ErrNoSecret
+	}
+	q := url.Values{}
+	q.Set(paramKey, c.key)
+	q.Set(paramExpires, strconv.FormatInt(c.expires, 10))
+	if c.maxSize > 0 {
+		q.Set(paramMaxSize, strconv.FormatInt(c.maxSize, 10))
+	}
+	q.Set(paramSignature, g.sign(c))
+	return g.BaseURL + objectsRoute + "?" + q.Encode(), nil
+}
+
+// sign returns the hex-encoded HMAC-SHA256 of the claims. The method is signed too, so a
+// download link cannot be used to upload.
+func (g *Gateway) sign(c presignClaims) string {
+	mac := hmac.New(sha256.New, g.Secret)
+	mac.Write([]byte(c.method + "\n" + c.key + "\n" + strconv.FormatInt(c.expires, 10) + "\n" + strconv.FormatInt(c.maxSize, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature and expiry of a presigned request.
+//
+// Returns: The claims of the request, and any errors.
+func (g *Gateway) verify(r *http.Request) (presignClaims, error) {
+	q := r.URL.Query()
+	c := presignClaims{method: r.Method, key: q.Get(paramKey)}
+	var err error
+	if c.expires, err = strconv.ParseInt(q.Get(paramExpires), 10, 64); err != nil {
+		return c, errSignature
+	}
+	if s := q.Get(paramMaxSize); len(s) > 0 {
+		if c.maxSize, err = strconv.ParseInt(s, 10, 64); err != nil || c.maxSize <= 0 {
+			return c, errSignature
+		}
+	}
+	got, err := hex.DecodeString(q.Get(paramSignature))
+	if err != nil || len(g.Secret) == 0 {
+		return c, errSignature
+	}
+	want, _ := hex.DecodeString(g.sign(c))
+	if !hmac.Equal(got, want) {
+		return c, errSignature
+	}
+	if g.now().Unix() > c.expires {
+		return c, errExpired
+	}
+	return c, nil
+}
@@ -2,10 +2,17 @@ module github.com/muhammadmahdiamirpour/distributed-file-system
 
 go 1.23.1
 
-require github.com/stretchr/testify v1.9.0
+require (
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/net v0.33.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
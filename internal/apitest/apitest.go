@@ -0,0 +1,177 @@
+// Package apitest checks the exported API of a package against a golden list of its
+// declarations, so a change that would break the package's users fails its tests until the
+// list is updated on purpose with go test -run TestAPI -update-api.
+package apitest
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// golden is the file, relative to the package directory, holding its export list.
+const golden = "testdata/api.txt"
+
+var update = flag.Bool("update-api", false, "rewrite the golden export lists of the packages tested")
+
+// Check compares the exported declarations of the package in the working directory, as go
+// test runs it, with its golden list.
+func Check(t *testing.T) {
+	t.Helper()
+	got, err := Exports(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, []byte(strings.Join(got, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	b, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading the export list: %s (create it with -update-api)", err)
+	}
+	want := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	for _, line := range want {
+		if !slices.Contains(got, line) {
+			t.Errorf("removed or changed: %s", line)
+		}
+	}
+	for _, line := range got {
+		if !slices.Contains(want, line) {
+			t.Errorf("added: %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log("if the change is intended, update the export list with -update-api")
+	}
+}
+
+// Exports lists the exported declarations of the package in dir, one per line and sorted:
+// its constants, variables, functions, types, the exported fields of its structs and the
+// exported methods of its types and interfaces. Only the files built on this platform are
+// read, leaving out tests.
+//
+// Returns: The declarations and any errors reading the package.
+func Exports(dir string) ([]string, error) {
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	var lines []string
+	for _, name := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			lines = append(lines, declExports(decl)...)
+		}
+	}
+	slices.Sort(lines)
+	return slices.Compact(lines), nil
+}
+
+// declExports lists the exported declarations of one top-level declaration.
+func declExports(decl ast.Decl) []string {
+	var lines []string
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if !d.Name.IsExported() {
+			break
+		}
+		if d.Recv == nil {
+			return []string{"func " + d.Name.Name + signature(d.Type)}
+		}
+		recv := types.ExprString(d.Recv.List[0].Type)
+		if ast.IsExported(baseType(recv)) {
+			lines = append(lines, fmt.Sprintf("method (%s) %s%s", recv, d.Name.Name, signature(d.Type)))
+		}
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.ValueSpec:
+				for _, name := range s.Names {
+					if name.IsExported() {
+						lines = append(lines, d.Tok.String()+" "+name.Name)
+					}
+				}
+			case *ast.TypeSpec:
+				if s.Name.IsExported() {
+					lines = append(lines, typeExports(s)...)
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// typeExports lists an exported type with its exported fields or interface methods.
+func typeExports(s *ast.TypeSpec) []string {
+	name := s.Name.Name
+	switch t := s.Type.(type) {
+	case *ast.StructType:
+		lines := []string{"type " + name + " struct"}
+		for _, field := range t.Fields.List {
+			typ := types.ExprString(field.Type)
+			if len(field.Names) == 0 && ast.IsExported(baseType(typ)) {
+				lines = append(lines, fmt.Sprintf("field %s.%s embedded", name, typ))
+			}
+			for _, f := range field.Names {
+				if f.IsExported() {
+					lines = append(lines, fmt.Sprintf("field %s.%s %s", name, f.Name, typ))
+				}
+			}
+		}
+		return lines
+	case *ast.InterfaceType:
+		lines := []string{"type " + name + " interface"}
+		for _, m := range t.Methods.List {
+			if len(m.Names) == 0 {
+				lines = append(lines, fmt.Sprintf("method %s.%s embedded", name, types.ExprString(m.Type)))
+			}
+			for _, n := range m.Names {
+				if n.IsExported() {
+					lines = append(lines, fmt.Sprintf("method %s.%s%s", name, n.Name, signature(m.Type.(*ast.FuncType))))
+				}
+			}
+		}
+		return lines
+	}
+	if s.Assign.IsValid() {
+		return []string{fmt.Sprintf("type %s = %s", name, types.ExprString(s.Type))}
+	}
+	return []string{fmt.Sprintf("type %s %s", name, types.ExprString(s.Type))}
+}
+
+// signature formats the parameters and results of a function type.
+func signature(f *ast.FuncType) string {
+	return strings.TrimPrefix(types.ExprString(f), "func")
+}
+
+// baseType returns the name of a type without its package qualifier, pointer or type
+// arguments.
+func baseType(typ string) string {
+	typ = strings.TrimLeft(typ, "*")
+	if i := strings.IndexByte(typ, '['); i >= 0 {
+		typ = typ[:i]
+	}
+	if i := strings.LastIndexByte(typ, '.'); i >= 0 {
+		typ = typ[i+1:]
+	}
+	return typ
+}
@@ -2,7 +2,11 @@
 package p2p
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -35,6 +39,27 @@ func (dec GOBDecoder) Decode(reader io.Reader, msg *RPC) error {
 	return gob.NewDecoder(reader).Decode(msg)
 }
 
+// MaxMessageSize is the largest payload a single message frame may carry.
+const MaxMessageSize = 16 << 20
+
+// payloadPrealloc is the most DefaultDecoder allocates for a payload before its bytes arrive.
+const payloadPrealloc = 64 << 10
+
+// EncodeMessage frames a payload as a discrete message for DefaultDecoder: the IncomingMessage
+// type byte, the payload length as a big-endian uint32, then the payload itself.
+//
+// Returns: The framed message, or an error if the payload exceeds MaxMessageSize.
+func EncodeMessage(payload []byte) ([]byte, error) {
+	if len(payload) > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the %d byte limit", len(payload), MaxMessageSize)
+	}
+	frame := make([]byte, 5+len(payload))
+	frame[0] = IncomingMessage
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame, nil
+}
+
 // DefaultDecoder is a struct that implements the Decoder interface with custom decoding logic.
 // It can detect if an incoming message is a stream or a standard payload.
 type DefaultDecoder struct{}
@@ -51,24 +76,75 @@ type DefaultDecoder struct{}
 //   - Reads the first byte of the incoming message to determine if it's a stream.
 //   - If the first byte matches the IncomingStream constant, it marks the message as a stream
 //     by setting `msg.Stream` to true and returns immediately without further decoding.
-//   - Otherwise, it reads the rest of the message into `msg.Payload`.
+//   - Chunk and window frames of multiplexed streams are decoded into `msg.Chunk`, `msg.StreamID`,
+//     `msg.Payload` and `msg.Window`, and the frames opening answers to requests into
+//     `msg.StreamID` and `msg.Reply`.
+//   - Otherwise, it reads the length-prefixed payload written by EncodeMessage into `msg.Payload`.
 //
-// Returns: Error if the read operation fails, nil otherwise.
+// Returns: Error if the read operation fails or the frame is malformed, nil otherwise.
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
 		return err
 	}
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+	switch header[0] {
+	case IncomingStream:
 		msg.Stream = true
 		return nil
+	case IncomingReply:
+		if _, err := io.ReadFull(r, header[1:13]); err != nil {
+			return unexpectedEOF(err)
+		}
+		msg.StreamID = binary.BigEndian.Uint32(header[1:5])
+		msg.Reply = binary.BigEndian.Uint64(header[5:13])
+		if msg.Reply == 0 {
+			return fmt.Errorf("stream %d answers no request", msg.StreamID)
+		}
+		return nil
+	case IncomingChunk, IncomingWindow:
+		if _, err := io.ReadFull(r, header[1:9]); err != nil {
+			return unexpectedEOF(err)
+		}
+		msg.StreamID = binary.BigEndian.Uint32(header[1:5])
+		n := binary.BigEndian.Uint32(header[5:9])
+		if header[0] == IncomingWindow {
+			if n == 0 {
+				return fmt.Errorf("empty window update for stream %d", msg.StreamID)
+			}
+			msg.Window = n
+			return nil
+		}
+		msg.Chunk = true
+		return readPayload(r, n, msg)
+	case IncomingMessage:
+	default:
+		return fmt.Errorf("unknown frame type 0x%x", header[0])
 	}
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	if _, err := io.ReadFull(r, header[1:5]); err != nil {
 		return err
 	}
-	msg.Payload = buf[:n]
+	return readPayload(r, binary.BigEndian.Uint32(header[1:5]), msg)
+}
+
+// readPayload reads a payload of size bytes that follows a frame header into `msg.Payload`.
+func readPayload(r io.Reader, size uint32, msg *RPC) error {
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the %d byte limit", size, MaxMessageSize)
+	}
+	// Grow the payload as its bytes arrive rather than trusting the length up front, so a
+	// frame announcing more than it carries cannot make the reader allocate the maximum.
+	payload := bytes.NewBuffer(make([]byte, 0, min(size, payloadPrealloc)))
+	if _, err := io.CopyN(payload, r, int64(size)); err != nil {
+		return unexpectedEOF(err)
+	}
+	msg.Payload = payload.Bytes()
 	return nil
 }
+
+// unexpectedEOF reports a frame cut short as io.ErrUnexpectedEOF rather than a clean io.EOF.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -3,6 +3,7 @@ package p2p
 import (
 	"bytes"
 	"encoding/gob"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,8 +15,9 @@ func TestDefaultDecoder(t *testing.T) {
 	var rpc RPC
 
 	// Test decoding a standard message.
-	message := append([]byte{IncomingMessage}, []byte("test message")...)
-	err := decoder.Decode(bytes.NewReader(message), &rpc)
+	message, err := EncodeMessage([]byte("test message"))
+	assert.Nil(t, err)
+	err = decoder.Decode(bytes.NewReader(message), &rpc)
 	assert.Nil(t, err)
 	assert.False(t, rpc.Stream) // Not a stream
 	assert.Equal(t, []byte("test message"), rpc.Payload)
@@ -27,6 +29,62 @@ func TestDefaultDecoder(t *testing.T) {
 	assert.True(t, rpc.Stream) // It should be marked as a stream
 }
 
+// TestDefaultDecoderFraming tests that messages larger than a single read and back-to-back frames decode intact.
+func TestDefaultDecoderFraming(t *testing.T) {
+	decoder := DefaultDecoder{}
+	large := bytes.Repeat([]byte("x"), 64*1024)
+	first, err := EncodeMessage(large)
+	assert.Nil(t, err)
+	second, err := EncodeMessage([]byte("second"))
+	assert.Nil(t, err)
+	r := bytes.NewReader(append(append(first, second...), IncomingStream))
+
+	var rpc RPC
+	assert.Nil(t, decoder.Decode(r, &rpc))
+	assert.Equal(t, large, rpc.Payload)
+	rpc = RPC{}
+	assert.Nil(t, decoder.Decode(r, &rpc))
+	assert.Equal(t, []byte("second"), rpc.Payload)
+	rpc = RPC{}
+	assert.Nil(t, decoder.Decode(r, &rpc))
+	assert.True(t, rpc.Stream)
+
+	// Oversized and unknown frames are rejected.
+	oversized := []byte{IncomingMessage, 0xff, 0xff, 0xff, 0xff}
+	assert.Error(t, decoder.Decode(bytes.NewReader(oversized), &rpc))
+	assert.Error(t, decoder.Decode(bytes.NewReader([]byte{0x7f}), &rpc))
+	_, err = EncodeMessage(make([]byte, MaxMessageSize+1))
+	assert.Error(t, err)
+}
+
+// TestDefaultDecoderMuxFrames tests that chunk and window frames of multiplexed streams decode.
+func TestDefaultDecoderMuxFrames(t *testing.T) {
+	decoder := DefaultDecoder{}
+	r := bytes.NewReader(append(append(encodeChunk(7, []byte("piece")), encodeChunk(7, nil)...), encodeWindow(7, 42)...))
+
+	var rpc RPC
+	assert.Nil(t, decoder.Decode(r, &rpc))
+	assert.Equal(t, RPC{Chunk: true, StreamID: 7, Payload: []byte("piece")}, rpc)
+	rpc = RPC{}
+	assert.Nil(t, decoder.Decode(r, &rpc))
+	assert.True(t, rpc.Chunk)
+	assert.Empty(t, rpc.Payload)
+	rpc = RPC{}
+	assert.Nil(t, decoder.Decode(r, &rpc))
+	assert.Equal(t, RPC{StreamID: 7, Window: 42}, rpc)
+	rpc = RPC{}
+	assert.Nil(t, decoder.Decode(bytes.NewReader(encodeReply(8, 1<<40)), &rpc))
+	assert.Equal(t, RPC{StreamID: 8, Reply: 1 << 40}, rpc)
+
+	// Oversized chunks, empty window updates, answers to no request and truncated headers
+	// are rejected.
+	assert.Error(t, decoder.Decode(bytes.NewReader([]byte{IncomingChunk, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}), &rpc))
+	assert.Error(t, decoder.Decode(bytes.NewReader(encodeWindow(1, 0)), &rpc))
+	assert.Error(t, decoder.Decode(bytes.NewReader(encodeReply(1, 0)), &rpc))
+	assert.ErrorIs(t, decoder.Decode(bytes.NewReader(encodeReply(1, 2)[:9]), &rpc), io.ErrUnexpectedEOF)
+	assert.ErrorIs(t, decoder.Decode(bytes.NewReader([]byte{IncomingWindow, 0, 0}), &rpc), io.ErrUnexpectedEOF)
+}
+
 // TestGOBDecoder tests the GOBDecoder implementation.
 func TestGOBDecoder(t *testing.T) {
 	decoder := GOBDecoder{}
@@ -50,3 +108,43 @@ func TestGOBDecoder(t *testing.T) {
 	assert.Equal(t, originalRPC.Payload, rpc.Payload)
 	assert.Equal(t, originalRPC.Stream, rpc.Stream)
 }
+
+// FuzzDefaultDecoder feeds arbitrary bytes to DefaultDecoder, which must reject malformed
+// frames with an error, never allocate past MaxMessageSize and decode what EncodeMessage
+// frames back intact.
+func FuzzDefaultDecoder(f *testing.F) {
+	message, err := EncodeMessage([]byte("payload"))
+	assert.Nil(f, err)
+	f.Add(message)
+	f.Add([]byte{IncomingStream})
+	f.Add([]byte{IncomingMessage, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{IncomingMessage, 0, 0, 0, 9, 'x'})
+	f.Add([]byte{0x7f})
+	f.Add(encodeChunk(1, []byte("chunk")))
+	f.Add(encodeWindow(1, muxWindow))
+	f.Add(encodeReply(1, 2))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bytes.NewReader(b)
+		for {
+			var rpc RPC
+			if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+				break
+			}
+			if len(rpc.Payload) > MaxMessageSize {
+				t.Fatalf("decoded a payload of %d bytes", len(rpc.Payload))
+			}
+		}
+
+		frame, err := EncodeMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rpc RPC
+		if err := (DefaultDecoder{}).Decode(bytes.NewReader(frame), &rpc); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, rpc.Payload) {
+			t.Fatalf("payload changed in transit: %q became %q", b, rpc.Payload)
+		}
+	})
+}
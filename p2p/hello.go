@@ -0,0 +1,253 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ProtocolVersion is the wire protocol version advertised in the hello frame. Version 2
+// marks objects sent in answer to get requests as found or missing explicitly, so empty
+// objects can be told apart from missing ones. Version 3 adds the object's checksum, so
+// bytes damaged in transit are rejected. Version 4 sends those objects in chunks, so a
+// sender can stop early when the requester cancels. Version 5 opens every connection with
+// helloMagic, so connections from anything other than a node are refused on their first bytes.
+const ProtocolVersion uint16 = 5
+
+// handshakeTimeout bounds how long a hello exchange may take before the connection is dropped.
+const handshakeTimeout = 10 * time.Second
+
+// helloMagic is sent first on every connection, followed by the ProtocolVersion as two
+// big-endian bytes and then the hello frame. A connection opening with anything else is not
+// from a node and is closed before any of its bytes are decoded.
+const helloMagic = "\x00dfs-peer"
+
+// notPeerPeekTimeout bounds the wait for more of the first bytes of a connection that is not
+// from a node, which are only read to describe it.
+const notPeerPeekTimeout = 50 * time.Millisecond
+
+// notPeerPeekSize is how many of the first bytes of a connection that is not from a node are
+// read to describe it.
+const notPeerPeekSize = 24
+
+// NotPeerError is returned by the hello handshake when a connection does not open with the
+// magic every node sends, such as a browser or TLS client pointed at the peer port.
+type NotPeerError struct {
+	First []byte // First bytes the connection sent
+}
+
+// Error describes the connection by its first bytes.
+func (e *NotPeerError) Error() string {
+	msg := fmt.Sprintf("not a peer: connection opened with %q", e.First)
+	switch {
+	case len(e.First) >= 2 && e.First[0] == 0x16 && e.First[1] == 0x03:
+		msg += " (looks like a TLS handshake)"
+	case bytes.Contains(e.First, []byte(" HTTP/")) || bytes.HasPrefix(e.First, []byte("GET ")) || bytes.HasPrefix(e.First, []byte("POST ")):
+		msg += " (looks like an HTTP request)"
+	}
+	return msg
+}
+
+// Capabilities is a bitset of optional features a node supports. Bits a node does not know
+// about are carried along but never acted on, so newer nodes can advertise new features.
+type Capabilities uint64
+
+const (
+	// CapBatch marks support for batched store and get messages.
+	CapBatch Capabilities = 1 << iota
+	// CapSyncTree marks support for reconciling keys by walking Merkle summaries.
+	CapSyncTree
+	// CapInline marks support for small replicas carried inside their store message.
+	CapInline
+	// CapChunkedStreams marks support for objects streamed in chunks, which the requester can
+	// cancel part-way. Without it objects follow their header as one run of bytes.
+	CapChunkedStreams
+	// CapRangeGet marks support for requests for a byte range of an object.
+	CapRangeGet
+	// CapStoreAck marks support for acknowledging replicas once they are stored.
+	CapStoreAck
+	// CapMirror marks support for the object listings and pulls of mirroring nodes.
+	CapMirror
+	// CapTypedMessages marks support for messages whose payload is identified by a numeric
+	// tag rather than a gob interface registration.
+	CapTypedMessages
+	// CapNamespaceGrants marks support for receiving the keys of other nodes' namespaces.
+	CapNamespaceGrants
+	// CapPins marks support for the placement pins announced by the owners of objects.
+	CapPins
+	// CapReadRepair marks support for describing each copy offered in answer to a get request
+	// with its version and write time, which lets the requester repair stale copies.
+	CapReadRepair
+	// CapVerify marks support for the object listings of cluster verification.
+	CapVerify
+	// CapReserve marks support for reserving keys for create-if-absent stores.
+	CapReserve
+	// CapAppend marks support for content appended to replicas in place.
+	CapAppend
+	// CapDeletePrefix marks support for deleting the replicas of many objects in one message.
+	CapDeletePrefix
+	// CapMux marks support for multiplexed streams, which share the connection with messages
+	// and other streams rather than holding it until they are read.
+	CapMux
+	// CapCoalesce marks support for control messages packed together into one batched message.
+	CapCoalesce
+	// CapClock marks support for pings measuring how far the clocks of peers are off.
+	CapClock
+	// CapReliable marks support for control messages that are acknowledged once applied and
+	// sent again until they are.
+	CapReliable
+	// CapChallenge marks support for proving a replica is held by hashing a range of it.
+	CapChallenge
+	// CapLease marks support for leases granting one node exclusive write access to a key.
+	CapLease
+	// CapLocate marks support for describing the copy of an object a node holds, by its owner
+	// and hashed key.
+	CapLocate
+	// CapAliases marks support for aliases shared by the cluster, announced as they change.
+	CapAliases
+	// CapBusy marks support for get requests and replicas refused as busy while the node is at
+	// its admission limits, with a suggestion of when to try again.
+	CapBusy
+	// CapReplies marks support for multiplexed streams answering a request by the ID its
+	// requester gave it, which the requester claims whatever order the answers arrive in.
+	CapReplies
+)
+
+// Has reports whether every bit of flag is set.
+func (c Capabilities) Has(flag Capabilities) bool {
+	return c&flag == flag
+}
+
+// HelloFrame is the metadata exchanged by HelloHandshakeFunc when a connection is set up.
+// It is gob-encoded, so fields added by newer versions are ignored by older nodes.
+//
+// Fields:
+//   - NodeID: Identifier of the node.
+//   - AdvertiseAddr: Address other nodes can dial to reach the node.
+//   - ProtocolVersion: Wire protocol version spoken by the node.
+//   - Capabilities: Optional features the node supports.
+//   - Labels: Free-form node attributes such as zone=eu-1 or role=edge.
+//   - Peers: Advertised addresses of the nodes the node is connected to, by node ID, so the
+//     receiver learns how to reach nodes it is not connected to itself.
+//   - Incarnation: Random number drawn each time the node starts, so peers can tell it
+//     restarted; zero from nodes that predate it.
+//   - NoListen: Whether the node only dials out, so it cannot be dialed and, unless
+//     AcceptReplicas is set, takes no replicas.
+//   - AcceptReplicas: Whether a NoListen node takes replicas from the peers connected to it.
+type HelloFrame struct {
+	NodeID          string
+	AdvertiseAddr   string
+	ProtocolVersion uint16
+	Capabilities    Capabilities
+	Labels          map[string]string
+	Peers           map[string]string
+	Incarnation     uint32
+	NoListen        bool
+	AcceptReplicas  bool
+}
+
+// readMagic reads the magic and protocol version a node opens its connection with, failing
+// as soon as the bytes read stop matching the magic.
+//
+// Returns: A *NotPeerError if the connection did not open with the magic, or any errors
+// reading it.
+func readMagic(conn net.Conn) error {
+	buf := make([]byte, len(helloMagic)+2)
+	got := 0
+	for got < len(buf) {
+		n, err := conn.Read(buf[got:])
+		got += n
+		if checked := min(got, len(helloMagic)); string(buf[:checked]) != helloMagic[:checked] {
+			return &NotPeerError{First: peekMore(conn, buf[:got])}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peekMore reads up to notPeerPeekSize bytes of a connection whose first bytes are first,
+// waiting briefly for those not arrived yet.
+//
+// Returns: The bytes read.
+func peekMore(conn net.Conn, first []byte) []byte {
+	b := make([]byte, notPeerPeekSize)
+	got := copy(b, first)
+	if got < len(b) && conn.SetReadDeadline(time.Now().Add(notPeerPeekTimeout)) == nil {
+		n, _ := io.ReadAtLeast(conn, b[got:], len(b)-got)
+		got += n
+	}
+	return b[:got]
+}
+
+// EncodeHello frames a hello as a single message.
+//
+// Returns: The framed hello and any errors.
+func EncodeHello(h HelloFrame) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(h); err != nil {
+		return nil, err
+	}
+	return EncodeMessage(buf.Bytes())
+}
+
+// DecodeHello reads one hello frame written by EncodeHello.
+//
+// Returns: The decoded hello and any errors.
+func DecodeHello(r io.Reader) (HelloFrame, error) {
+	var rpc RPC
+	if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+		return HelloFrame{}, err
+	}
+	if rpc.Stream {
+		return HelloFrame{}, errors.New("expected a hello frame, got a stream")
+	}
+	var h HelloFrame
+	if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&h); err != nil {
+		return HelloFrame{}, fmt.Errorf("decoding hello: %w", err)
+	}
+	return h, nil
+}
+
+// HelloHandshakeFunc returns a handshake that sends local to the remote node and records the
+// hello it receives back, which is then available from the node's Hello method. Both are
+// preceded by helloMagic; a connection that does not open with it fails with a *NotPeerError.
+func HelloHandshakeFunc(local HelloFrame) HandshakeFunc {
+	return func(node Node) error {
+		hello, err := EncodeHello(local)
+		if err != nil {
+			return err
+		}
+		frame := binary.BigEndian.AppendUint16([]byte(helloMagic), ProtocolVersion)
+		frame = append(frame, hello...)
+		if err := node.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+			return err
+		}
+		// Send concurrently so two nodes greeting each other over an unbuffered connection
+		// cannot block on each other's writes.
+		sent := make(chan error, 1)
+		go func() {
+			sent <- node.Send(frame)
+		}()
+		var remote HelloFrame
+		if err = readMagic(node); err == nil {
+			remote, err = DecodeHello(node)
+		}
+		if serr := <-sent; err == nil {
+			err = serr
+		}
+		if err != nil {
+			return fmt.Errorf("hello with %s: %w", node.RemoteAddr(), err)
+		}
+		if hs, ok := node.(interface{ setHello(HelloFrame) }); ok {
+			hs.setHello(remote)
+		}
+		return node.SetDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelloRoundTrip(t *testing.T) {
+	want := HelloFrame{
+		NodeID:          "node-a",
+		AdvertiseAddr:   ":4000",
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    CapBatch,
+		Labels:          map[string]string{"zone": "eu-1", "role": "edge"},
+		Peers:           map[string]string{"node-b": ":4001"},
+		Incarnation:     0xdeadbeef,
+		NoListen:        true,
+		AcceptReplicas:  true,
+	}
+	frame, err := EncodeHello(want)
+	require.NoError(t, err)
+	got, err := DecodeHello(bytes.NewReader(frame))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.True(t, got.Capabilities.Has(CapBatch))
+}
+
+func TestHelloForwardCompatible(t *testing.T) {
+	// A hello from a newer node with a field and capability bit this version does not know.
+	type futureHello struct {
+		NodeID          string
+		ProtocolVersion uint16
+		Capabilities    Capabilities
+		Labels          map[string]string
+		Codecs          []string
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(futureHello{
+		NodeID:          "node-b",
+		ProtocolVersion: ProtocolVersion + 1,
+		Capabilities:    CapBatch | 1<<40,
+		Labels:          map[string]string{"zone": "us-2", "tier": "cold"},
+		Codecs:          []string{"zstd"},
+	}))
+	frame, err := EncodeMessage(buf.Bytes())
+	require.NoError(t, err)
+
+	got, err := DecodeHello(bytes.NewReader(frame))
+	require.NoError(t, err)
+	assert.Equal(t, "node-b", got.NodeID)
+	assert.True(t, got.Capabilities.Has(CapBatch))
+	assert.Equal(t, "us-2", got.Labels["zone"])
+}
+
+func TestHelloHandshake(t *testing.T) {
+	client, server := tcpPair(t)
+	a, b := NewTCPPeer(client, true), NewTCPPeer(server, false)
+	helloA := HelloFrame{NodeID: "a", ProtocolVersion: ProtocolVersion, Labels: map[string]string{"zone": "eu-1"}}
+	helloB := HelloFrame{NodeID: "b", ProtocolVersion: ProtocolVersion, Capabilities: CapBatch}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- HelloHandshakeFunc(helloB)(b)
+	}()
+	require.NoError(t, HelloHandshakeFunc(helloA)(a))
+	require.NoError(t, <-errc)
+	assert.Equal(t, helloB, a.Hello())
+	assert.Equal(t, helloA, b.Hello())
+}
+
+// lockedBuffer is a buffer safe for concurrent use, collecting log output.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends b to the buffer.
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns what was written so far.
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestRefuseNotPeer connects to a node with an HTTP request and a TLS handshake, which are
+// closed on their first bytes without a peer being registered, with a single log line.
+func TestRefuseNotPeer(t *testing.T) {
+	nodes := make(chan Node, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: HelloHandshakeFunc(HelloFrame{NodeID: "a", ProtocolVersion: ProtocolVersion}),
+		Decoder:       DefaultDecoder{},
+		OnNode:        func(n Node) error { nodes <- n; return nil },
+	})
+	require.NoError(t, tr.ListenAndAccept())
+	defer tr.Close()
+	var logged lockedBuffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0xa5, 0x01, 0x00, 0x00, 0xa1, 0x03, 0x03}
+	for _, junk := range [][]byte{[]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), clientHello} {
+		conn, err := net.Dial("tcp", tr.listener.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write(junk)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		// The node's own greeting may arrive before it hangs up, which resets the connection if
+		// the rest of the junk was left unread.
+		_, err = io.ReadAll(conn)
+		var netErr net.Error
+		require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the connection should be closed right away")
+		conn.Close()
+	}
+	select {
+	case <-nodes:
+		t.Fatal("a connection that is not from a node was registered as a peer")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	require.Len(t, lines, 1, "only one of the two connections should be logged")
+	assert.Contains(t, lines[0], `GET / HTTP/1.1`)
+	assert.Contains(t, lines[0], "looks like an HTTP request")
+}
+
+func TestNotPeerError(t *testing.T) {
+	err := &NotPeerError{First: []byte{0x16, 0x03, 0x01, 0x02, 0x00}}
+	assert.Contains(t, err.Error(), "looks like a TLS handshake")
+
+	client, server := tcpPair(t)
+	go client.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	err2 := HelloHandshakeFunc(HelloFrame{NodeID: "a"})(NewTCPPeer(server, false))
+	var notPeer *NotPeerError
+	require.ErrorAs(t, err2, &notPeer)
+	assert.Equal(t, "SSH-2.0-OpenSSH_9.6\r\n", string(notPeer.First))
+}
@@ -1,17 +1,36 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 // Node represents a remote node in the network and extends the net.Conn interface,
 // providing methods for sending data and closing streams specifically in the context
 // of a distributed network.
 // Methods:
-//   - Send([]byte) error: Sends a byte slice of data to the node. Returns an error if the send operation fails.
-//   - CloseStream(): Closes the data stream to the node, typically used when a message or transmission has been completed.
+//   - Send([]byte) error: Sends a byte slice of data to the node, together with any bytes buffered by Write.
+//     Returns an error if the send operation fails.
+//   - Flush() error: Sends the bytes buffered by Write. Writes may be buffered until Send, Flush or a ReadFrom
+//     handing the connection to a stream copy, so a sender that ends with a Write must Flush.
+//   - AcceptStream() io.ReadCloser: Blocks until the next incoming stream arrives and returns it, to be closed once
+//     read so the node's further frames are received.
+//   - OpenStream() io.WriteCloser: Starts a multiplexed stream to the node, which must advertise CapMux; closing it
+//     ends the stream.
+//   - OpenReply(id uint64) io.WriteCloser: Starts a multiplexed stream answering the request the node sent with id,
+//     which must advertise CapReplies; closing it ends the stream.
+//   - AwaitReply(id uint64, done <-chan struct{}) io.ReadCloser: Blocks until the stream answering the request sent
+//     to the node with id arrives and returns it, or returns nil once done is closed or the connection drops.
+//   - Hello() HelloFrame: Returns the metadata the node sent during the handshake.
 type Node interface {
 	net.Conn
 	Send([]byte) error
-	CloseStream()
+	Flush() error
+	AcceptStream() io.ReadCloser
+	OpenStream() io.WriteCloser
+	OpenReply(id uint64) io.WriteCloser
+	AwaitReply(id uint64, done <-chan struct{}) io.ReadCloser
+	Hello() HelloFrame
 }
 
 // Link is an abstraction that represents a communication channel between nodes in the network,
@@ -22,10 +41,12 @@ type Node interface {
 //   - ListenAndAccept() error: Starts listening for incoming connections and accepts them. Returns an error if the operation fails.
 //   - Consume() <-chan RPC: Provides a read-only channel to consume incoming RPC (Remote Procedure Call) messages from connected nodes.
 //   - Close() error: Closes the link and any active connections, returning an error if the close operation encounters issues.
+//   - Err() <-chan error: Provides a channel reporting the fatal error, if any, that made the link stop accepting connections.
 type Link interface {
 	Addr() string
 	Dial(string) error
 	ListenAndAccept() error
 	Consume() <-chan RPC
 	Close() error
+	Err() <-chan error
 }
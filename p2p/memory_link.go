@@ -0,0 +1,352 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// memoryPollInterval bounds how long a blocked read goes without rechecking its deadline
+	// and the partitions of its link.
+	memoryPollInterval = 5 * time.Millisecond
+	// firstEphemeralPort numbers the local end of the first connection dialed.
+	firstEphemeralPort = 49152
+	// memoryBacklog is the number of dialed connections a listener holds before they are accepted.
+	memoryBacklog = 128
+)
+
+// MemoryNetwork connects transports within one process without sockets, so tests can shape
+// the conditions between nodes through Policy. Addresses look like TCP addresses; one without
+// a host, such as ":3000", is on 127.0.0.1 as it would be when dialed over TCP.
+//
+// Fields:
+//   - Policy: The conditions of every link, changeable while connections are open.
+//   - mu: Guards listeners and nextPort.
+//   - listeners: Open listeners by address.
+//   - nextPort: Port of the local end of the next connection dialed.
+type MemoryNetwork struct {
+	Policy    *NetworkPolicy
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+// NewMemoryNetwork returns an empty network with every link healthy.
+//
+// Parameters:
+//   - seed: Seeds the random faults drawn by Policy.
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		Policy:    NewNetworkPolicy(seed),
+		listeners: make(map[string]*memoryListener),
+		nextPort:  firstEphemeralPort,
+	}
+}
+
+// Transport returns a TCPTransport that listens and dials through the network instead of
+// sockets; its Listen and Connect options are replaced.
+func (n *MemoryNetwork) Transport(opts TCPTransportOpts) *TCPTransport {
+	local := memoryHost(opts.ListenAddr)
+	opts.Listen = func(_ string, address string) (net.Listener, error) {
+		return n.listen(address)
+	}
+	opts.Connect = func(_ string, address string) (net.Conn, error) {
+		return n.dial(local, address)
+	}
+	return NewTCPTransport(opts)
+}
+
+// memoryHost places an address without a host on 127.0.0.1.
+func memoryHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if len(host) == 0 || host == "localhost" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// listen opens a listener at address.
+func (n *MemoryNetwork) listen(address string) (*memoryListener, error) {
+	addr := memoryHost(address)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: memoryAddr(addr), Err: syscall.EADDRINUSE}
+	}
+	l := &memoryListener{
+		network: n,
+		addr:    addr,
+		conns:   make(chan net.Conn, memoryBacklog),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// dial connects the node listening at from to the one listening at to.
+func (n *MemoryNetwork) dial(from string, to string) (net.Conn, error) {
+	to = memoryHost(to)
+	refused := &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(to), Err: syscall.ECONNREFUSED}
+	if n.Policy.partitioned(from, to) || n.Policy.partitioned(to, from) {
+		return nil, refused
+	}
+	n.mu.Lock()
+	l, ok := n.listeners[to]
+	host, _, _ := net.SplitHostPort(from)
+	local := net.JoinHostPort(host, strconv.Itoa(n.nextPort))
+	n.nextPort++
+	n.mu.Unlock()
+	if !ok {
+		return nil, refused
+	}
+	out, in := newMemoryPipe(), newMemoryPipe()
+	client := &memoryConn{network: n, local: local, remote: to, from: from, to: to, in: in, out: out}
+	server := &memoryConn{network: n, local: to, remote: local, from: to, to: from, in: out, out: in}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, refused
+	}
+}
+
+// memoryAddr is the address of one end of a memory connection.
+type memoryAddr string
+
+// Network names the network of the address.
+func (a memoryAddr) Network() string { return "memory" }
+
+// String returns the address in host:port form.
+func (a memoryAddr) String() string { return string(a) }
+
+// memoryListener accepts the connections dialed to one address of a MemoryNetwork.
+type memoryListener struct {
+	network *MemoryNetwork
+	addr    string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Accept waits for the next connection dialed to the listener.
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener, freeing its address. Accepted connections stay open.
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.addr)
+		l.network.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.addr)
+}
+
+// chunk is the bytes of one write together with when they can be read.
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// memoryPipe carries the bytes written by one end of a memory connection to the other.
+// Writes never block on the reader, as with a socket's buffers.
+type memoryPipe struct {
+	mu     sync.Mutex
+	chunks []chunk
+	closed bool
+	signal chan struct{} // Poked when bytes arrive or the pipe is closed
+}
+
+// newMemoryPipe returns an empty, open pipe.
+func newMemoryPipe() *memoryPipe {
+	return &memoryPipe{signal: make(chan struct{}, 1)}
+}
+
+// push queues data to be read once latency has passed, never ahead of earlier writes.
+//
+// Returns: Whether the pipe was still open.
+func (p *memoryPipe) push(data []byte, latency time.Duration) bool {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return false
+	}
+	at := time.Now().Add(latency)
+	if last := len(p.chunks) - 1; last >= 0 && at.Before(p.chunks[last].at) {
+		at = p.chunks[last].at
+	}
+	p.chunks = append(p.chunks, chunk{data: data, at: at})
+	p.mu.Unlock()
+	p.poke()
+	return true
+}
+
+// poke wakes a blocked reader.
+func (p *memoryPipe) poke() {
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// read copies bytes that are due into b.
+//
+// Returns: Bytes read, how long until the next bytes are due when none are, and io.EOF once
+// the pipe is closed and drained.
+func (p *memoryPipe) read(b []byte) (int, time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.chunks) == 0 {
+		if p.closed {
+			return 0, 0, io.EOF
+		}
+		return 0, memoryPollInterval, nil
+	}
+	if wait := time.Until(p.chunks[0].at); wait > 0 {
+		return 0, min(wait, memoryPollInterval), nil
+	}
+	n := copy(b, p.chunks[0].data)
+	if p.chunks[0].data = p.chunks[0].data[n:]; len(p.chunks[0].data) == 0 {
+		p.chunks = p.chunks[1:]
+	}
+	return n, 0, nil
+}
+
+// close stops the pipe; bytes already written can still be read.
+func (p *memoryPipe) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.poke()
+}
+
+// memoryConn is one end of a connection over a MemoryNetwork.
+type memoryConn struct {
+	network      *MemoryNetwork
+	local        string      // Address of this end
+	remote       string      // Address of the other end
+	from         string      // Listen address of this end's node, where its writes leave from
+	to           string      // Listen address of the other end's node
+	in           *memoryPipe // Bytes written by the other end
+	out          *memoryPipe // Bytes written by this end
+	writeMu      sync.Mutex  // Keeps writes whole and in order
+	closed       atomic.Bool
+	readDeadline atomic.Pointer[time.Time]
+}
+
+// Read reads the bytes written by the other end once the link's latency has passed. Reads on
+// a connection whose nodes are partitioned from each other fail as if it was reset.
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		if c.closed.Load() {
+			return 0, net.ErrClosed
+		}
+		n, wait, err := c.in.read(b)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		if c.network.Policy.severed(c.from, c.to) {
+			c.Close()
+			return 0, &net.OpError{Op: "read", Net: "memory", Addr: memoryAddr(c.remote), Err: syscall.ECONNRESET}
+		}
+		if d := c.readDeadline.Load(); d != nil && !d.IsZero() {
+			if !time.Now().Before(*d) {
+				return 0, os.ErrDeadlineExceeded
+			}
+			wait = min(wait, time.Until(*d))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.in.signal:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Write sends b over the link to the other end, subject to the link's policy. Dropped bytes
+// count as written, as they would on a lossy network.
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	f := c.network.Policy.transmit(c.from, c.to, len(b))
+	data := append([]byte(nil), b...)
+	if f.corrupt >= 0 {
+		data[f.corrupt] ^= 0xff
+	}
+	if f.cut >= 0 {
+		data = data[:f.cut]
+	}
+	if !f.drop && !c.out.push(data, f.latency) {
+		// The other end closed the connection.
+		return 0, &net.OpError{Op: "write", Net: "memory", Addr: memoryAddr(c.remote), Err: syscall.EPIPE}
+	}
+	time.Sleep(f.pace)
+	if f.cut >= 0 {
+		c.Close()
+		return f.cut, fmt.Errorf("memory connection to %s cut after the scripted byte count: %w", c.remote, net.ErrClosed)
+	}
+	return len(b), nil
+}
+
+// Close closes both directions of the connection. The other end can still read the bytes
+// already written to it before seeing io.EOF.
+func (c *memoryConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+// LocalAddr returns the address of this end.
+func (c *memoryConn) LocalAddr() net.Addr { return memoryAddr(c.local) }
+
+// RemoteAddr returns the address of the other end.
+func (c *memoryConn) RemoteAddr() net.Addr { return memoryAddr(c.remote) }
+
+// SetDeadline sets the read deadline; writes never block on the other end.
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the time after which blocked and future reads fail.
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(&t)
+	c.in.poke()
+	return nil
+}
+
+// SetWriteDeadline is accepted for net.Conn; writes never block on the other end.
+func (c *memoryConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,207 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryPair dials b from a over a fresh listener at b and returns both ends.
+func memoryPair(t testing.TB, n *MemoryNetwork, a string, b string) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := n.listen(b)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+	client, err := n.dial(memoryHost(a), b)
+	require.NoError(t, err)
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// readWithin reads up to size bytes from conn, giving up after d.
+func readWithin(conn net.Conn, size int, d time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, size)
+	n, err := io.ReadFull(conn, b)
+	return b[:n], err
+}
+
+func TestMemoryNetworkDelivers(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	client, server := memoryPair(t, n, ":5000", ":5001")
+	assert.Equal(t, "127.0.0.1:5001", client.RemoteAddr().String())
+	assert.Equal(t, client.LocalAddr().String(), server.RemoteAddr().String())
+
+	_, err := client.Write([]byte("hello"))
+	require.NoError(t, err)
+	got, err := readWithin(server, 5, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	// Bytes written before a close are still delivered, then the reader sees EOF.
+	_, err = server.Write([]byte("bye"))
+	require.NoError(t, err)
+	require.NoError(t, server.Close())
+	got, err = io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(got))
+	_, err = client.Write([]byte("late"))
+	assert.ErrorIs(t, err, syscall.EPIPE)
+
+	_, err = n.dial("127.0.0.1:5000", ":5999")
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestMemoryTransportConnectsNodes(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	nodes := make(chan Node, 2)
+	newTransport := func(addr string) *TCPTransport {
+		tr := n.Transport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnNode: func(node Node) error {
+				nodes <- node
+				return nil
+			},
+		})
+		require.NoError(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+	a, b := newTransport(":5000"), newTransport(":5001")
+	require.NoError(t, a.Dial(b.Addr()))
+	first, second := <-nodes, <-nodes
+	outbound := first
+	if first.RemoteAddr().String() != "127.0.0.1:5001" {
+		outbound = second
+	}
+	frame, err := EncodeMessage([]byte{'x'})
+	require.NoError(t, err)
+	require.NoError(t, outbound.Send(frame))
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, []byte{'x'}, rpc.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestNetworkPolicyLatencyAndBandwidth(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	client, server := memoryPair(t, n, ":5000", ":5001")
+	n.Policy.SetLink(":5000", ":5001", LinkPolicy{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	_, err := client.Write([]byte("slow"))
+	require.NoError(t, err)
+	_, err = readWithin(server, 4, time.Second)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// 200 bytes at 2000 bytes per second hold the writer back for 100ms.
+	n.Policy.SetLink(":5000", ":5001", LinkPolicy{Bandwidth: 2000})
+	start = time.Now()
+	_, err = client.Write(make([]byte, 200))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.EqualValues(t, 200, n.Policy.Carried(":5000", ":5001"))
+	assert.Zero(t, n.Policy.Carried(":5001", ":5000"))
+}
+
+func TestNetworkPolicyPartitions(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	client, server := memoryPair(t, n, ":5000", ":5001")
+
+	// A one-way partition loses bytes in one direction only and keeps the connection open.
+	n.Policy.Partition(":5000", ":5001")
+	_, err := client.Write([]byte("lost"))
+	require.NoError(t, err)
+	_, err = readWithin(server, 1, 50*time.Millisecond)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	_, err = server.Write([]byte("back"))
+	require.NoError(t, err)
+	got, err := readWithin(client, 4, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "back", string(got))
+	_, err = n.dial("127.0.0.1:5002", ":5001")
+	require.NoError(t, err, "links of other nodes are unaffected")
+	_, err = n.dial("127.0.0.1:5000", ":5001")
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	// Partitioning the other way too cuts the connection.
+	n.Policy.PartitionBetween(":5000", ":5001")
+	_, err = readWithin(client, 1, time.Second)
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+
+	n.Policy.Heal()
+	assert.Equal(t, LinkPolicy{}, n.Policy.Link(":5000", ":5001"))
+	conn, err := n.dial("127.0.0.1:5000", ":5001")
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestNetworkPolicyScriptedFaults(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	client, server := memoryPair(t, n, ":5000", ":5001")
+	n.Policy.SetLink(":5000", ":5001", LinkPolicy{CorruptAt: 7, DisconnectAt: 10})
+
+	_, err := client.Write([]byte("abcd"))
+	require.NoError(t, err)
+	// The write crossing byte 10 is cut short and closes the connection.
+	nw, err := client.Write([]byte("efghijkl"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Equal(t, 6, nw)
+	got, err := io.ReadAll(server)
+	require.NoError(t, err)
+	want := []byte("abcdefghij")
+	want[6] ^= 0xff
+	assert.Equal(t, want, got)
+
+	// Scripted faults fire once, so a new connection over the link is healthy.
+	client, server = memoryPair(t, n, ":5000", ":5002")
+	n.Policy.SetLink(":5000", ":5002", LinkPolicy{DisconnectAt: 3})
+	client.Write([]byte("abc"))
+	n.Policy.SetLink(":5000", ":5002", LinkPolicy{})
+	_, err = client.Write([]byte("d"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestNetworkPolicyRandomFaults(t *testing.T) {
+	// The seeded source makes the faults repeat from run to run.
+	run := func() []byte {
+		n := NewMemoryNetwork(42)
+		client, server := memoryPair(t, n, ":5000", ":5001")
+		n.Policy.SetLink(":5000", ":5001", LinkPolicy{DropRate: 0.3, CorruptRate: 0.3})
+		for i := 0; i < 100; i++ {
+			_, err := client.Write(bytes.Repeat([]byte{byte(i)}, 4))
+			require.NoError(t, err)
+		}
+		client.Close()
+		got, err := io.ReadAll(server)
+		require.NoError(t, err)
+		return got
+	}
+	first := run()
+	assert.Equal(t, first, run())
+	assert.Less(t, len(first), 400, "no write was dropped")
+	assert.Greater(t, len(first), 200, "too many writes were dropped")
+	assert.Zero(t, len(first)%4, "writes are dropped whole")
+}
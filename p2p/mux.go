@@ -0,0 +1,417 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Streams between nodes advertising CapMux are multiplexed: rather than following a marker
+// as one run of bytes, which holds the receiver's read loop until the stream is read, a
+// stream is sent as chunk frames tagged with its ID, interleaved with other frames. The read
+// loop hands each chunk to its stream's buffer and moves on, so messages and other streams
+// keep flowing while a long stream is received. A sender may have at most muxWindow bytes
+// of a stream unread by the receiver, which grants more with window updates as it reads.
+
+const (
+	// muxChunkSize is the most bytes of a multiplexed stream one chunk frame carries.
+	muxChunkSize = 32 << 10
+	// muxWindow is the most bytes of a multiplexed stream sent ahead of what the receiver has
+	// read, and so the most the receiver buffers for it.
+	muxWindow = 256 << 10
+	// maxMuxStreams bounds the incoming multiplexed streams open at once on a connection.
+	maxMuxStreams = 1024
+)
+
+// errStreamClosed is returned by writes to a multiplexed stream after it was closed.
+var errStreamClosed = errors.New("write to closed stream")
+
+// encodeChunk frames a piece of the multiplexed stream id; an empty piece ends the stream.
+func encodeChunk(id uint32, data []byte) []byte {
+	frame := make([]byte, 9+len(data))
+	frame[0] = IncomingChunk
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(data)))
+	copy(frame[9:], data)
+	return frame
+}
+
+// encodeWindow frames a window update letting the sender of stream id send n more bytes.
+func encodeWindow(id uint32, n uint32) []byte {
+	frame := make([]byte, 9)
+	frame[0] = IncomingWindow
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], n)
+	return frame
+}
+
+// encodeReply frames the opening of the multiplexed stream id answering the request reply.
+func encodeReply(id uint32, reply uint64) []byte {
+	frame := make([]byte, 13)
+	frame[0] = IncomingReply
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint64(frame[5:13], reply)
+	return frame
+}
+
+// pendingStream is an incoming stream waiting for AcceptStream.
+type pendingStream struct {
+	stream  io.ReadCloser
+	claimed chan struct{} // Closed once AcceptStream has handed the stream over
+}
+
+// closedStream is handed over by AcceptStream once the connection has dropped.
+type closedStream struct{}
+
+// Read fails as the connection is closed.
+func (closedStream) Read([]byte) (int, error) { return 0, net.ErrClosed }
+
+// Close does nothing.
+func (closedStream) Close() error { return nil }
+
+// connStream is a stream sent as one run of bytes after an IncomingStream marker, read from
+// the connection itself while the read loop waits for it to be closed.
+type connStream struct {
+	peer *TCPPeer
+	once sync.Once
+}
+
+// Read reads the stream's bytes from the connection.
+func (s *connStream) Read(b []byte) (int, error) {
+	return s.peer.Conn.Read(b)
+}
+
+// Close resumes the read loop; closing the stream again does nothing.
+func (s *connStream) Close() error {
+	s.once.Do(s.peer.wg.Done)
+	return nil
+}
+
+// muxStream is an incoming multiplexed stream, buffering the chunks the read loop receives
+// until the handler it was handed to reads them.
+type muxStream struct {
+	peer    *TCPPeer
+	id      uint32
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	ended   bool          // The sender ended the stream
+	closed  bool          // The handler closed the stream; chunks still arriving are discarded
+	unacked int           // Bytes read or discarded since the last window update
+	ready   chan struct{} // Poked when chunks arrive or the stream ends
+}
+
+// Read reads the bytes received on the stream, waiting for more until the sender ends it.
+func (s *muxStream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			grant := s.consumedLocked(n)
+			s.mu.Unlock()
+			s.grant(grant)
+			return n, nil
+		}
+		ended := s.ended
+		s.mu.Unlock()
+		if ended {
+			return 0, io.EOF
+		}
+		select {
+		case <-s.ready:
+		case <-s.peer.closed:
+			s.mu.Lock()
+			waiting := s.buf.Len() == 0 && !s.ended
+			s.mu.Unlock()
+			if waiting {
+				return 0, net.ErrClosed
+			}
+		}
+	}
+}
+
+// Close discards the rest of the stream, letting the sender finish it without waiting for
+// reads; closing the stream again does nothing.
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.unacked += s.buf.Len()
+	s.buf.Reset()
+	grant := 0
+	if !s.ended {
+		grant, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+	s.grant(grant)
+	return nil
+}
+
+// consumedLocked records n bytes read or discarded; the caller must hold mu.
+//
+// Returns: The bytes to grant the sender, once enough have been consumed to be worth a
+// window update, else zero.
+func (s *muxStream) consumedLocked(n int) int {
+	s.unacked += n
+	if s.ended || s.unacked < muxWindow/2 {
+		return 0
+	}
+	grant := s.unacked
+	s.unacked = 0
+	return grant
+}
+
+// grant lets the sender send n more bytes of the stream. A failed update means the
+// connection dropped, which reads of the stream report.
+func (s *muxStream) grant(n int) {
+	if n > 0 {
+		s.peer.Send(encodeWindow(s.id, uint32(n)))
+	}
+}
+
+// poke wakes a blocked reader.
+func (s *muxStream) poke() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// muxWriter writes an outgoing multiplexed stream in chunks, waiting for window updates once
+// the receiver has muxWindow bytes of it unread.
+type muxWriter struct {
+	peer   *TCPPeer
+	id     uint32
+	mu     sync.Mutex
+	credit int           // Bytes that may be sent before the next window update
+	closed bool          // Whether the stream was ended
+	ready  chan struct{} // Poked when window updates arrive
+}
+
+// Write sends b on the stream, waiting for the receiver to read what it was sent before.
+func (w *muxWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n, err := w.reserve(min(len(b), muxChunkSize))
+		if err != nil {
+			return written, err
+		}
+		if err := w.peer.Send(encodeChunk(w.id, b[:n])); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// reserve waits until some of want bytes may be sent and takes them from the window.
+//
+// Returns: The bytes that may be sent, at most want, and an error if the stream or the
+// connection was closed meanwhile.
+func (w *muxWriter) reserve(want int) (int, error) {
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, errStreamClosed
+		}
+		if w.credit > 0 {
+			n := min(want, w.credit)
+			w.credit -= n
+			w.mu.Unlock()
+			return n, nil
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.ready:
+		case <-w.peer.closed:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+// Close ends the stream; closing it again does nothing.
+func (w *muxWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+	w.peer.muxMu.Lock()
+	delete(w.peer.outgoing, w.id)
+	w.peer.muxMu.Unlock()
+	return w.peer.Send(encodeChunk(w.id, nil))
+}
+
+// OpenStream starts a multiplexed stream to the node. Only nodes advertising CapMux can
+// receive one. The stream is written in chunks that interleave with other frames, and
+// must be closed to end it.
+func (p *TCPPeer) OpenStream() io.WriteCloser {
+	w := &muxWriter{
+		peer:   p,
+		id:     p.nextStream.Add(1),
+		credit: muxWindow,
+		ready:  make(chan struct{}, 1),
+	}
+	p.muxMu.Lock()
+	p.outgoing[w.id] = w
+	p.muxMu.Unlock()
+	return w
+}
+
+// OpenReply starts a multiplexed stream answering the request the node sent with id, which
+// the node claims with AwaitReply whatever order its answers arrive in. Only nodes
+// advertising CapReplies can receive one. The stream must be closed to end it.
+func (p *TCPPeer) OpenReply(id uint64) io.WriteCloser {
+	w := p.OpenStream().(*muxWriter)
+	// A failed frame means the connection dropped, which writes to the stream report.
+	p.Send(encodeReply(w.id, id))
+	return w
+}
+
+// pendingReply is a stream answering a request, from when it arrives or a caller of
+// AwaitReply starts waiting for it, whichever is first, until it is claimed.
+type pendingReply struct {
+	stream  *muxStream    // Nil until the stream arrives
+	arrived chan struct{} // Closed once stream is set
+	claimed chan struct{} // Closed once AwaitReply has handed the stream over
+}
+
+// AwaitReply waits for the stream answering the request sent to the node with id and hands
+// it over, however many streams answering other requests arrive first; the caller reads the
+// answer from it and closes it when done.
+//
+// Returns: The stream, or nil if done is closed or the connection drops before it arrives.
+// A stream arriving after its requester stopped waiting is discarded once
+// StreamClaimTimeout has passed.
+func (p *TCPPeer) AwaitReply(id uint64, done <-chan struct{}) io.ReadCloser {
+	p.muxMu.Lock()
+	reply := p.replyLocked(id)
+	p.muxMu.Unlock()
+	select {
+	case <-reply.arrived:
+	case <-done:
+	case <-p.closed:
+	}
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+	if p.replies[id] != reply {
+		// Another caller claimed the stream, or it expired, meanwhile.
+		return nil
+	}
+	delete(p.replies, id)
+	if reply.stream == nil {
+		return nil
+	}
+	close(reply.claimed)
+	return reply.stream
+}
+
+// replyLocked returns the pending answer to the request id, adding it if there is none; the
+// caller must hold muxMu.
+func (p *TCPPeer) replyLocked(id uint64) *pendingReply {
+	reply, ok := p.replies[id]
+	if !ok {
+		reply = &pendingReply{arrived: make(chan struct{}), claimed: make(chan struct{})}
+		p.replies[id] = reply
+	}
+	return reply
+}
+
+// receiveReply opens the multiplexed stream id, answering the request reply, for AwaitReply
+// to claim; its chunks follow.
+//
+// Returns: The pending answer, and an error if the stream is already open, the request was
+// already answered, or the sender opened too many streams.
+func (p *TCPPeer) receiveReply(id uint32, reply uint64) (*pendingReply, error) {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+	if _, ok := p.incoming[id]; ok {
+		return nil, fmt.Errorf("stream %d opened twice", id)
+	}
+	if len(p.incoming) >= maxMuxStreams {
+		return nil, fmt.Errorf("more than %d streams open at once", maxMuxStreams)
+	}
+	pending := p.replyLocked(reply)
+	if pending.stream != nil {
+		return nil, fmt.Errorf("request %d answered twice", reply)
+	}
+	pending.stream = &muxStream{peer: p, id: id, ready: make(chan struct{}, 1)}
+	p.incoming[id] = pending.stream
+	close(pending.arrived)
+	return pending, nil
+}
+
+// receiveChunk adds a chunk decoded by the read loop to its stream, opening the stream on
+// its first chunk.
+//
+// Returns: The stream when the chunk opened it, and an error if the sender overran the
+// stream's window or opened too many streams.
+func (p *TCPPeer) receiveChunk(id uint32, data []byte) (*muxStream, error) {
+	p.muxMu.Lock()
+	s, ok := p.incoming[id]
+	if !ok {
+		if len(p.incoming) >= maxMuxStreams {
+			p.muxMu.Unlock()
+			return nil, fmt.Errorf("more than %d streams open at once", maxMuxStreams)
+		}
+		s = &muxStream{peer: p, id: id, ready: make(chan struct{}, 1)}
+		p.incoming[id] = s
+	}
+	if len(data) == 0 {
+		delete(p.incoming, id)
+	}
+	p.muxMu.Unlock()
+
+	s.mu.Lock()
+	switch {
+	case len(data) == 0:
+		s.ended = true
+	case s.closed:
+		// Let the sender finish a stream nobody reads.
+		s.unacked += len(data)
+	case s.buf.Len()+len(data) > muxWindow:
+		s.mu.Unlock()
+		return nil, fmt.Errorf("stream %d overran its %d byte window", id, muxWindow)
+	default:
+		s.buf.Write(data)
+	}
+	grant := 0
+	if s.closed {
+		grant, s.unacked = s.unacked, 0
+	}
+	s.mu.Unlock()
+	s.grant(grant)
+	s.poke()
+	if ok {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// receiveWindow lets the outgoing stream id send n more bytes. Updates for streams already
+// closed are ignored.
+func (p *TCPPeer) receiveWindow(id uint32, n uint32) {
+	p.muxMu.Lock()
+	w, ok := p.outgoing[id]
+	p.muxMu.Unlock()
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	w.credit += int(n)
+	w.mu.Unlock()
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,176 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LinkPolicy describes the conditions of the link carrying bytes from one node to another.
+// The zero LinkPolicy is a healthy link.
+//
+// Fields:
+//   - Latency: Delay before written bytes can be read at the other end.
+//   - Bandwidth: Bytes per second the link carries, zero for no limit. Writers are held back
+//     for as long as their bytes take to cross the link.
+//   - DropRate: Probability that a write is lost in transit.
+//   - CorruptRate: Probability that a write arrives with one of its bytes flipped.
+//   - Partitioned: Whether writes over the link are lost. Connections between two nodes
+//     partitioned both ways are cut, and no new ones can be opened.
+//   - CorruptAt: Flips the Nth byte the link carries, counting from one; zero flips none.
+//   - DisconnectAt: Cuts the connection once the link has carried this many bytes; zero never
+//     cuts it.
+//
+// CorruptAt and DisconnectAt count from when the policy is set and fire once.
+type LinkPolicy struct {
+	Latency      time.Duration
+	Bandwidth    int64
+	DropRate     float64
+	CorruptRate  float64
+	Partitioned  bool
+	CorruptAt    int64
+	DisconnectAt int64
+}
+
+// link names the direction from one node's listen address to another's.
+type link struct {
+	from string
+	to   string
+}
+
+// linkState is the policy of a link together with the bytes it carried since it was set.
+type linkState struct {
+	LinkPolicy
+	carried int64
+}
+
+// fate is what becomes of one write over a link.
+type fate struct {
+	latency time.Duration // Delay before the bytes can be read
+	pace    time.Duration // Time the bytes take to cross the link
+	drop    bool          // Whether the bytes are lost
+	corrupt int           // Offset of the byte to flip, or -1
+	cut     int           // Bytes delivered before the connection is cut, or -1
+}
+
+// NetworkPolicy holds the conditions of every link of a MemoryNetwork. Links are named by the
+// listen addresses of the nodes at either end and may be changed at any time, affecting
+// connections already open. Random faults are drawn from a seeded source so runs repeat.
+type NetworkPolicy struct {
+	mu    sync.Mutex
+	links map[link]*linkState
+	rand  *rand.Rand
+}
+
+// NewNetworkPolicy returns a policy under which every link is healthy.
+//
+// Parameters:
+//   - seed: Seeds the random source for dropped and corrupted writes.
+func NewNetworkPolicy(seed int64) *NetworkPolicy {
+	return &NetworkPolicy{
+		links: make(map[link]*linkState),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetLink sets the conditions of the link from one node to another.
+func (p *NetworkPolicy) SetLink(from string, to string, policy LinkPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.links[link{memoryHost(from), memoryHost(to)}] = &linkState{LinkPolicy: policy}
+}
+
+// SetBetween sets the conditions of the links between two nodes in both directions.
+func (p *NetworkPolicy) SetBetween(a string, b string, policy LinkPolicy) {
+	p.SetLink(a, b, policy)
+	p.SetLink(b, a, policy)
+}
+
+// Link returns the conditions of the link from one node to another.
+func (p *NetworkPolicy) Link(from string, to string) LinkPolicy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.links[link{memoryHost(from), memoryHost(to)}]; ok {
+		return l.LinkPolicy
+	}
+	return LinkPolicy{}
+}
+
+// Carried returns the bytes the link from one node to another carried since its conditions
+// were last set, or zero when they never were.
+func (p *NetworkPolicy) Carried(from string, to string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.links[link{memoryHost(from), memoryHost(to)}]; ok {
+		return l.carried
+	}
+	return 0
+}
+
+// Partition loses every write from one node to another while leaving the reverse direction
+// working, so connections stay open but only carry bytes one way.
+func (p *NetworkPolicy) Partition(from string, to string) {
+	policy := p.Link(from, to)
+	policy.Partitioned = true
+	p.SetLink(from, to, policy)
+}
+
+// PartitionBetween cuts two nodes off from each other: open connections between them are
+// dropped and new ones are refused until the partition heals.
+func (p *NetworkPolicy) PartitionBetween(a string, b string) {
+	p.Partition(a, b)
+	p.Partition(b, a)
+}
+
+// Heal restores every link to health.
+func (p *NetworkPolicy) Heal() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.links = make(map[link]*linkState)
+}
+
+// partitioned reports whether the link from one node to another loses every write.
+func (p *NetworkPolicy) partitioned(from string, to string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.links[link{from, to}]
+	return ok && l.Partitioned
+}
+
+// severed reports whether two nodes are partitioned from each other in both directions.
+func (p *NetworkPolicy) severed(a string, b string) bool {
+	return p.partitioned(a, b) && p.partitioned(b, a)
+}
+
+// transmit decides the fate of a write of n bytes over the link from one node to another.
+func (p *NetworkPolicy) transmit(from string, to string, n int) fate {
+	f := fate{corrupt: -1, cut: -1}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.links[link{from, to}]
+	if !ok {
+		return f
+	}
+	f.latency = l.Latency
+	if l.Bandwidth > 0 {
+		f.pace = time.Duration(int64(n) * int64(time.Second) / l.Bandwidth)
+	}
+	if l.Partitioned || (l.DropRate > 0 && p.rand.Float64() < l.DropRate) {
+		f.drop = true
+		return f
+	}
+	start := l.carried
+	l.carried += int64(n)
+	if n > 0 && l.CorruptRate > 0 && p.rand.Float64() < l.CorruptRate {
+		f.corrupt = p.rand.Intn(n)
+	}
+	if l.CorruptAt > start && l.CorruptAt <= l.carried {
+		f.corrupt = int(l.CorruptAt - start - 1)
+		l.CorruptAt = 0
+	}
+	if l.DisconnectAt > 0 && l.DisconnectAt <= l.carried {
+		f.cut = int(max(l.DisconnectAt-start, 0))
+		l.DisconnectAt = 0
+	}
+	return f
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFunc picks the proxy a transport dials a node at addr through, returning nil to dial
+// it directly. Proxies are SOCKS5, with the socks5 or socks5h scheme, or HTTP proxies
+// tunnelling with CONNECT, with the http scheme; either may carry credentials in the URL.
+type ProxyFunc func(addr string) (*url.URL, error)
+
+// ProxyError is returned by Dial when a node could not be reached through a proxy, so it can
+// be told apart from a node that could not be reached directly. It covers the proxy being
+// unreachable, refusing the credentials or failing to connect to the node.
+type ProxyError struct {
+	Proxy string // URL of the proxy, without its password; empty if none could be picked
+	Addr  string // Address of the node dialed
+	Err   error  // What went wrong
+}
+
+// Error describes the failure, naming the proxy and the node.
+func (e *ProxyError) Error() string {
+	if len(e.Proxy) == 0 {
+		return fmt.Sprintf("picking a proxy for %s: %s", e.Addr, e.Err)
+	}
+	return fmt.Sprintf("dialing %s through proxy %s: %s", e.Addr, e.Proxy, e.Err)
+}
+
+// Unwrap returns what went wrong.
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// parseProxyURL parses the URL of a proxy, taking one without a scheme, as proxy environment
+// variables often are, as an HTTP proxy.
+//
+// Returns: The URL, or an error if it is malformed or names an unsupported kind of proxy.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("proxy URL %s: unsupported scheme %q, want socks5, socks5h or http", u.Redacted(), u.Scheme)
+	}
+	if len(u.Hostname()) == 0 || len(u.Port()) == 0 {
+		return nil, fmt.Errorf("proxy URL %s: a host and port are required", u.Redacted())
+	}
+	return u, nil
+}
+
+// FixedProxy returns a ProxyFunc dialing every node through the proxy at rawURL.
+//
+// Returns: The ProxyFunc, or an error if rawURL is not a valid proxy URL.
+func FixedProxy(rawURL string) (ProxyFunc, error) {
+	u, err := parseProxyURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return func(string) (*url.URL, error) { return u, nil }, nil
+}
+
+// ProxyFromEnvironment returns a ProxyFunc following the proxy environment variables:
+// ALL_PROXY, or HTTPS_PROXY when it is not set, names the proxy, and NO_PROXY the nodes dialed
+// directly, as do addresses without a host and loopback addresses. The lowercase variables
+// are read too.
+//
+// Returns: The ProxyFunc, nil when no proxy is set, or an error if the proxy URL is invalid.
+func ProxyFromEnvironment() (ProxyFunc, error) {
+	raw := getenvAny("ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy")
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	u, err := parseProxyURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	cfg := httpproxy.Config{HTTPSProxy: u.String(), NoProxy: getenvAny("NO_PROXY", "no_proxy")}
+	pick := cfg.ProxyFunc()
+	return func(addr string) (*url.URL, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && len(host) == 0 {
+			return nil, nil
+		}
+		return pick(&url.URL{Scheme: "https", Host: addr})
+	}, nil
+}
+
+// getenvAny returns the value of the first of the environment variables that is set.
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// dialProxy connects to the node at addr through the proxy at u, reaching the proxy with
+// connect.
+//
+// Returns: The connection, or a *ProxyError.
+func dialProxy(u *url.URL, addr string, connect func(network string, address string) (net.Conn, error)) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if u.Scheme == "http" {
+		conn, err = dialHTTPConnect(u, addr, connect)
+	} else {
+		var d proxy.Dialer
+		if d, err = proxy.FromURL(u, connectDialer(connect)); err == nil {
+			conn, err = d.Dial("tcp", addr)
+		}
+	}
+	if err != nil {
+		return nil, &ProxyError{Proxy: u.Redacted(), Addr: addr, Err: err}
+	}
+	return conn, nil
+}
+
+// connectDialer adapts a Connect option to the dialer the SOCKS5 client reaches its proxy with.
+type connectDialer func(network string, address string) (net.Conn, error)
+
+// Dial connects to address.
+func (c connectDialer) Dial(network string, address string) (net.Conn, error) {
+	return c(network, address)
+}
+
+// dialHTTPConnect asks the HTTP proxy at u for a tunnel to addr.
+//
+// Returns: The tunnel, or an error if the proxy could not be reached or refused it.
+func dialHTTPConnect(u *url.URL, addr string, connect func(network string, address string) (net.Conn, error)) (net.Conn, error) {
+	conn, err := connect("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("proxy refused the tunnel: " + resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// The node may speak first; what the proxy sent past its answer is the node's.
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads the buffered bytes, then the connection.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
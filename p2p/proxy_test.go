@@ -0,0 +1,231 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveProxy accepts connections on a new loopback listener, connecting each to the address
+// tunnel reads from its client, until the test ends.
+//
+// Returns: The proxy's address.
+func serveProxy(t *testing.T, tunnel func(conn net.Conn, r *bufio.Reader) (string, error)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				addr, err := tunnel(conn, r)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, r)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// socks5Tunnel is the handshake of a minimal SOCKS5 proxy without authentication, which
+// resolves names to the loopback address.
+func socks5Tunnel(conn net.Conn, r *bufio.Reader) (string, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, make([]byte, greeting[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	var host string
+	switch header[3] {
+	case 1:
+		ip := make(net.IP, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+			return "", err
+		}
+		host = "127.0.0.1"
+	default:
+		return "", fmt.Errorf("address type %d", header[3])
+	}
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	_, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), err
+}
+
+// connectTunnel is the handshake of a minimal HTTP proxy tunnelling with CONNECT, which
+// resolves names to the loopback address.
+func connectTunnel(conn net.Conn, r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", errors.New("not a CONNECT request")
+	}
+	_, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return net.JoinHostPort("127.0.0.1", port), err
+}
+
+// firewalled opens connections to the addresses allowed only, as a network that reaches the
+// outside through a proxy.
+func firewalled(allowed ...string) func(string, string) (net.Conn, error) {
+	return func(network string, address string) (net.Conn, error) {
+		for _, a := range allowed {
+			if a == address {
+				return net.Dial(network, address)
+			}
+		}
+		return nil, fmt.Errorf("dial %s: blocked by the firewall", address)
+	}
+}
+
+// TestDialThroughProxy dials a node only reachable through a proxy, over SOCKS5 and HTTP
+// CONNECT.
+func TestDialThroughProxy(t *testing.T) {
+	tunnels := map[string]func(net.Conn, *bufio.Reader) (string, error){
+		"socks5": socks5Tunnel,
+		"http":   connectTunnel,
+	}
+	for scheme, tunnel := range tunnels {
+		t.Run(scheme, func(t *testing.T) {
+			nodes := make(chan Node, 1)
+			server := NewTCPTransport(TCPTransportOpts{
+				ListenAddr:    "127.0.0.1:0",
+				HandshakeFunc: mockSuccessHandshake,
+				Decoder:       DefaultDecoder{},
+				OnNode:        func(n Node) error { nodes <- n; return nil },
+			})
+			require.NoError(t, server.ListenAndAccept())
+			defer server.Close()
+			_, port, err := net.SplitHostPort(server.listener.Addr().String())
+			require.NoError(t, err)
+			addr := net.JoinHostPort("peer.internal", port)
+
+			proxyAddr := serveProxy(t, tunnel)
+			opts := TCPTransportOpts{
+				HandshakeFunc: mockSuccessHandshake,
+				Decoder:       DefaultDecoder{},
+				Connect:       firewalled(proxyAddr),
+			}
+			assert.Error(t, NewTCPTransport(opts).Dial(addr), "the node should only be reachable through the proxy")
+
+			opts.Proxy, err = FixedProxy(scheme + "://" + proxyAddr)
+			require.NoError(t, err)
+			require.NoError(t, NewTCPTransport(opts).Dial(addr))
+			select {
+			case <-nodes:
+			case <-time.After(3 * time.Second):
+				t.Fatal("the node was not reached through the proxy")
+			}
+		})
+	}
+}
+
+func TestProxyFailureIsTold(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	downAddr := l.Addr().String()
+	l.Close()
+	proxy, err := FixedProxy("socks5://user:secret@" + downAddr)
+	require.NoError(t, err)
+	tr := NewTCPTransport(TCPTransportOpts{HandshakeFunc: mockSuccessHandshake, Decoder: DefaultDecoder{}, Proxy: proxy})
+
+	err = tr.Dial("peer.internal:4000")
+	var perr *ProxyError
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, "peer.internal:4000", perr.Addr)
+	assert.NotContains(t, err.Error(), "secret", "the proxy password should not be shown")
+}
+
+func TestBadProxyURLFailsFast(t *testing.T) {
+	for _, raw := range []string{"ftp://proxy:21", "socks5://", "http://proxy", "socks5://proxy:1080/%zz"} {
+		_, err := FixedProxy(raw)
+		assert.Error(t, err, raw)
+	}
+	t.Setenv("ALL_PROXY", "gopher://proxy:70")
+	_, err := ProxyFromEnvironment()
+	assert.Error(t, err)
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+	proxy, err := ProxyFromEnvironment()
+	require.NoError(t, err)
+	assert.Nil(t, proxy, "no proxy is set")
+
+	t.Setenv("HTTPS_PROXY", "proxy.corp:3128")
+	t.Setenv("NO_PROXY", "internal.corp")
+	proxy, err = ProxyFromEnvironment()
+	require.NoError(t, err)
+	for addr, want := range map[string]string{
+		"peer.example.com:4000": "http://proxy.corp:3128",
+		"db.internal.corp:4000": "",
+		"127.0.0.1:4000":        "",
+		":4000":                 "",
+	} {
+		u, err := proxy(addr)
+		require.NoError(t, err)
+		if len(want) == 0 {
+			assert.Nil(t, u, addr)
+		} else if assert.NotNil(t, u, addr) {
+			assert.Equal(t, want, u.String(), addr)
+		}
+	}
+
+	// ALL_PROXY takes precedence.
+	t.Setenv("ALL_PROXY", "socks5://gateway.corp:1080")
+	proxy, err = ProxyFromEnvironment()
+	require.NoError(t, err)
+	u, err := proxy("peer.example.com:4000")
+	require.NoError(t, err)
+	assert.Equal(t, "socks5://gateway.corp:1080", u.String())
+}
@@ -9,6 +9,20 @@ const (
 	// It is represented by the byte value 0x2.
 	IncomingStream = 0x2
 	FileNotFound   = 0x3
+
+	// IncomingChunk frames a piece of a multiplexed stream: the stream ID and the length of the
+	// piece, each a big-endian uint32, then the piece. An empty piece ends the stream.
+	IncomingChunk = 0x4
+
+	// IncomingWindow frames a window update for a multiplexed stream: the stream ID and the
+	// bytes its sender may send on top of what it was granted before, each a big-endian uint32.
+	IncomingWindow = 0x5
+
+	// IncomingReply frames the opening of a multiplexed stream answering a request: the stream
+	// ID as a big-endian uint32 and the ID the requester gave the request as a big-endian
+	// uint64. The stream's pieces follow as IncomingChunk frames; its requester claims it with
+	// AwaitReply rather than AcceptStream.
+	IncomingReply = 0x6
 )
 
 // RPC is a structure representing a data container for transferring information over the network between nodes.
@@ -16,8 +30,16 @@ const (
 //   - From string: Identifies the sender of the RPC message, typically as an address string.
 //   - Payload []byte: The byte slice containing the actual data or message content being transferred.
 //   - Stream bool: A boolean flag indicating whether the RPC is a continuous stream (true) or a single message (false).
+//   - Chunk bool: Whether the RPC is a piece of the multiplexed stream StreamID, carried in Payload.
+//   - StreamID uint32: The multiplexed stream a chunk or window update is for.
+//   - Window uint32: The bytes a window update grants the sender of StreamID, zero for other RPCs.
+//   - Reply uint64: The request the multiplexed stream StreamID answers, zero for other RPCs.
 type RPC struct {
-	From    string
-	Payload []byte
-	Stream  bool
+	From     string
+	Payload  []byte
+	Stream   bool
+	Chunk    bool
+	StreamID uint32
+	Window   uint32
+	Reply    uint64
 }
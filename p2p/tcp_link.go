@@ -1,11 +1,19 @@
 package p2p
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/url"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
 )
 
 // TCPPeer represents a remote node in a TCP-based network connection.
@@ -16,31 +24,194 @@ import (
 //     A boolean indicating if this peer connection was established by dialing out
 //     (true) or by accepting an incoming connection
 //     (false).
-//   - Wg: A WaitGroup for synchronizing the closing of streams associated with the peer.
+//   - Wg: A WaitGroup the read loop waits on while a stream sent after an IncomingStream marker is read.
+//   - streamch: Poked when an incoming stream is queued for AcceptStream.
+//   - closed: Closed once the read loop has exited.
+//   - pendingMu: Guards pending.
+//   - pending: Incoming streams waiting for AcceptStream, in the order they were opened.
+//   - writeMu: Serialises writes so concurrent frames are never interleaved on the connection.
+//   - w: Buffers writes to the connection until a frame is complete, nil when writes are not buffered.
+//   - hello: The metadata the remote node sent during the handshake.
+//   - muxMu: Guards incoming, outgoing and replies.
+//   - incoming: Multiplexed streams being received, by the ID the remote node gave them.
+//   - outgoing: Multiplexed streams being sent, by ID.
+//   - nextStream: ID of the last multiplexed stream opened to the remote node.
+//   - replies: Streams answering requests sent to the remote node, or callers of AwaitReply
+//     waiting for them, by the ID of the request.
 type TCPPeer struct {
 	net.Conn
-	outbound bool
-	wg       *sync.WaitGroup
+	outbound   bool
+	wg         *sync.WaitGroup
+	streamch   chan struct{}
+	closed     chan struct{}
+	pendingMu  sync.Mutex
+	pending    []*pendingStream
+	writeMu    sync.Mutex
+	w          *bufio.Writer
+	hello      HelloFrame
+	muxMu      sync.Mutex
+	incoming   map[uint32]*muxStream
+	outgoing   map[uint32]*muxWriter
+	nextStream atomic.Uint32
+	replies    map[uint64]*pendingReply
+}
+
+// Hello returns the metadata the remote node sent during the handshake, or the zero
+// HelloFrame if the handshake did not exchange one.
+func (p *TCPPeer) Hello() HelloFrame {
+	return p.hello
+}
+
+// setHello records the remote node's hello; it is called by the handshake before the peer is shared.
+func (p *TCPPeer) setHello(h HelloFrame) {
+	p.hello = h
+}
+
+// AcceptStream waits for the next incoming stream, in the order the streams were opened,
+// and hands it over; the caller reads the stream's bytes from it and closes it when done.
+// A stream sent after an IncomingStream marker is read from the connection itself, which
+// carries nothing else until the stream is closed; a multiplexed one is read from the
+// chunks buffered for it while other frames keep arriving. Once the connection is dropped,
+// the stream handed over fails every read.
+func (p *TCPPeer) AcceptStream() io.ReadCloser {
+	for {
+		p.pendingMu.Lock()
+		if len(p.pending) > 0 {
+			next := p.pending[0]
+			p.pending = p.pending[1:]
+			more := len(p.pending) > 0
+			p.pendingMu.Unlock()
+			close(next.claimed)
+			if more {
+				p.pokeStreams()
+			}
+			return next.stream
+		}
+		p.pendingMu.Unlock()
+		select {
+		case <-p.streamch:
+		case <-p.closed:
+			return closedStream{}
+		}
+	}
+}
+
+// queueStream queues an incoming stream for AcceptStream.
+func (p *TCPPeer) queueStream(stream io.ReadCloser) *pendingStream {
+	next := &pendingStream{stream: stream, claimed: make(chan struct{})}
+	p.pendingMu.Lock()
+	p.pending = append(p.pending, next)
+	p.pendingMu.Unlock()
+	p.pokeStreams()
+	return next
+}
+
+// unqueueStream withdraws a stream no caller of AcceptStream claimed.
+//
+// Returns: Whether the stream was still queued, rather than handed over meanwhile.
+func (p *TCPPeer) unqueueStream(stream *pendingStream) bool {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+	for i, queued := range p.pending {
+		if queued == stream {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
 }
 
-// CloseStream signals the completion of a stream by decrementing the WaitGroup counter.
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// pokeStreams wakes a caller of AcceptStream.
+func (p *TCPPeer) pokeStreams() {
+	select {
+	case p.streamch <- struct{}{}:
+	default:
+	}
 }
 
 // NewTCPPeer creates and returns a new TCPPeer instance, initializing its connection, outbound status, and WaitGroup.
+// Writes are buffered in defaultWriteBufferSize bytes.
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
 		wg:       &sync.WaitGroup{},
+		streamch: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		w:        bufio.NewWriterSize(conn, defaultWriteBufferSize),
+		incoming: make(map[uint32]*muxStream),
+		outgoing: make(map[uint32]*muxWriter),
+		replies:  make(map[uint64]*pendingReply),
+	}
+}
+
+// setWriteBuffer buffers the writes to the peer in size bytes, or not at all when size is
+// negative; it is called before the peer is shared.
+func (p *TCPPeer) setWriteBuffer(size int) {
+	switch {
+	case size < 0:
+		p.w = nil
+	case size > 0:
+		p.w = bufio.NewWriterSize(p.Conn, size)
+	}
+}
+
+// Write buffers b to be sent with the next Send, Flush or ReadFrom, so the small writes
+// making up a header reach the connection in one piece.
+func (p *TCPPeer) Write(b []byte) (int, error) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if p.w == nil {
+		return p.Conn.Write(b)
+	}
+	return p.w.Write(b)
+}
+
+// Flush writes the buffered bytes to the connection.
+func (p *TCPPeer) Flush() error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.flushLocked()
+}
+
+// flushLocked writes the buffered bytes to the connection; the caller must hold writeMu.
+func (p *TCPPeer) flushLocked() error {
+	if p.w == nil {
+		return nil
 	}
+	return p.w.Flush()
 }
 
-// Send transmits a byte slice of data to the peer over the network connection.
+// ReadFrom flushes the buffered bytes, then copies r to the peer until EOF. When the connection
+// supports it, as *net.TCPConn does, the copy is delegated to the connection so file sources are
+// sent with sendfile or splice instead of through a userspace buffer; other connections fall
+// back to io.Copy.
+//
+// Returns: Number of bytes written and any errors.
+func (p *TCPPeer) ReadFrom(r io.Reader) (int64, error) {
+	if err := p.Flush(); err != nil {
+		return 0, err
+	}
+	if rf, ok := p.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(p.Conn, r)
+}
+
+// Send transmits a byte slice of data to the peer over the network connection, together with
+// any bytes buffered by Write. Concurrent calls are serialised, so a frame built with
+// EncodeMessage always arrives in one piece, and a frame that fits the buffer in one write.
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if p.w == nil {
+		_, err := p.Conn.Write(b)
+		return err
+	}
+	if _, err := p.w.Write(b); err != nil {
+		return err
+	}
+	return p.flushLocked()
 }
 
 // TCPTransportOpts contains configuration options for initializing a TCPTransport instance.
@@ -50,13 +221,52 @@ func (p *TCPPeer) Send(b []byte) error {
 //   - HandshakeFunc: A function used to perform any necessary handshake when establishing a peer connection.
 //   - Decoder: A decoder instance to decode incoming data into RPC structs.
 //   - OnNode: A callback function that is invoked when a new node (peer) is established.
+//   - OnNodeClosed: A callback function that is invoked when the connection to a node accepted by OnNode drops.
+//   - Listen: Opens the listener used by ListenAndAccept, defaults to net.Listen.
+//   - Connect: Opens the connections made by Dial, defaults to net.Dial.
+//   - Proxy: Picks the proxy Dial connects to each node through, which Connect then opens the
+//     connection to; nil dials every node directly. Connections accepted by ListenAndAccept
+//     are never proxied. See FixedProxy and ProxyFromEnvironment.
+//   - MaxAcceptFailures: Consecutive transient accept errors tolerated before the transport gives up,
+//     defaults to defaultMaxAcceptFailures.
+//   - Clock: Times the backoff between accept errors, defaults to the real clock.
+//   - WriteBufferSize: Bytes of the buffer collecting the writes to each peer until a frame is
+//     complete, defaults to defaultWriteBufferSize; a negative size disables buffering.
+//   - StreamClaimTimeout: How long the read loop waits for a handler to claim an incoming stream
+//     with AcceptStream before dropping the connection as out of step, defaults to
+//     defaultStreamClaimTimeout. A stream answering a request nobody claims with AwaitReply
+//     within it is discarded instead.
 type TCPTransportOpts struct {
-	ListenAddr    string
-	HandshakeFunc HandshakeFunc
-	Decoder       Decoder
-	OnNode        func(Node) error
+	ListenAddr         string
+	HandshakeFunc      HandshakeFunc
+	Decoder            Decoder
+	OnNode             func(Node) error
+	OnNodeClosed       func(Node)
+	Listen             func(network string, address string) (net.Listener, error)
+	Connect            func(network string, address string) (net.Conn, error)
+	Proxy              ProxyFunc
+	MaxAcceptFailures  int
+	Clock              clock.Clock
+	WriteBufferSize    int
+	StreamClaimTimeout time.Duration
 }
 
+// Backoff applied between transient accept errors, doubling from the minimum up to the maximum.
+const (
+	minAcceptBackoff         = 5 * time.Millisecond
+	maxAcceptBackoff         = time.Second
+	defaultMaxAcceptFailures = 20
+)
+
+// defaultStreamClaimTimeout is how long an incoming stream may wait for a handler when
+// StreamClaimTimeout is not set. The message announcing a stream is handled once the ones
+// queued before it are, so this leaves time for a busy peer's queue.
+const defaultStreamClaimTimeout = time.Minute
+
+// defaultWriteBufferSize is the write buffer of a peer when WriteBufferSize is not set, well
+// above the size of a control frame so each one reaches the connection in a single write.
+const defaultWriteBufferSize = 64 << 10
+
 // TCPTransport manages TCP-based network transport for communication between nodes in a network.
 //
 // Fields:
@@ -65,16 +275,73 @@ type TCPTransportOpts struct {
 //   - rpcch: A channel for receiving RPC messages from other nodes.
 //   - mu: A mutex for synchronizing access to peer connections.
 //   - Peers: A map of active peer nodes, keyed by their network addresses.
+//   - errch: Receives the error that stopped the accept loop.
+//   - notPeers: Limits the logging of connections that are not from nodes.
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
 	mu       sync.RWMutex
 	peers    map[net.Addr]Node
+	errch    chan error
+	notPeers notPeerLog
+}
+
+// notPeerLogInterval is the least time between two log lines about connections that are not
+// from nodes, so a scanner or a retrying client hitting the peer port cannot flood the log.
+const notPeerLogInterval = 10 * time.Second
+
+// notPeerLog rate-limits the log lines about connections that are not from nodes, counting
+// those it leaves out.
+type notPeerLog struct {
+	mu         sync.Mutex
+	last       time.Time // When the last line was logged
+	suppressed int       // Connections not logged since then
+}
+
+// logNotPeer logs that the connection from addr was refused for err, unless a line was
+// logged within notPeerLogInterval.
+func (t *TCPTransport) logNotPeer(addr net.Addr, err *NotPeerError) {
+	l := &t.notPeers
+	now := clock.Or(t.Clock).Now()
+	l.mu.Lock()
+	if !l.last.IsZero() && now.Sub(l.last) < notPeerLogInterval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	l.mu.Unlock()
+	if suppressed > 0 {
+		log.Printf("refused connection from %s: %s; %d more such connections not logged", addr, err, suppressed)
+		return
+	}
+	log.Printf("refused connection from %s: %s", addr, err)
 }
 
+// Dial connects to the node listening at addr, through the proxy Proxy picks for it if any,
+// and handles the connection like an accepted one. Failures at the proxy are returned as a
+// *ProxyError.
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	connect := t.Connect
+	if connect == nil {
+		connect = net.Dial
+	}
+	var proxyURL *url.URL
+	if t.Proxy != nil {
+		var err error
+		if proxyURL, err = t.Proxy(addr); err != nil {
+			return &ProxyError{Addr: addr, Err: err}
+		}
+	}
+	var conn net.Conn
+	var err error
+	if proxyURL != nil {
+		conn, err = dialProxy(proxyURL, addr, connect)
+	} else {
+		conn, err = connect("tcp", addr)
+	}
 	if err != nil {
 		return err
 	}
@@ -87,6 +354,7 @@ func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
+		errch:            make(chan error, 1),
 	}
 }
 
@@ -100,11 +368,21 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcch
 }
 
+// Err returns a channel that receives the error that made the transport stop accepting
+// connections. It receives nothing when the transport is closed normally.
+func (t *TCPTransport) Err() <-chan error {
+	return t.errch
+}
+
 // ListenAndAccept starts listening on the configured address
 // and begins accepting incoming connections in a separate goroutine.
 func (t *TCPTransport) ListenAndAccept() error {
 	var err error
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	listen := t.Listen
+	if listen == nil {
+		listen = net.Listen
+	}
+	t.listener, err = listen("tcp", t.ListenAddr)
 	if err != nil {
 		return err
 	}
@@ -117,6 +395,10 @@ func (t *TCPTransport) ListenAndAccept() error {
 
 // Close closes the listener, stopping the transport from accepting further connections.
 func (t *TCPTransport) Close() error {
+	// A transport that only dialed out has no listener.
+	if t.listener == nil {
+		return nil
+	}
 	return t.listener.Close()
 }
 
@@ -127,6 +409,18 @@ func (t *TCPTransport) Close() error {
 //   - outbound: Indicates if the connection was dialed (outbound) or accepted (inbound).
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
+	peer := NewTCPPeer(conn, outbound)
+	peer.setWriteBuffer(t.WriteBufferSize)
+	if err = t.HandshakeFunc(peer); err != nil {
+		var notPeer *NotPeerError
+		if errors.As(err, &notPeer) {
+			// Whatever connected is not a node: closed quietly, before any of its bytes are decoded.
+			close(peer.closed)
+			conn.Close()
+			t.logNotPeer(conn.RemoteAddr(), notPeer)
+			return
+		}
+	}
 	defer func() {
 		fmt.Printf("dropping peer connection: %s", err)
 		err = conn.Close()
@@ -134,8 +428,8 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}()
-	peer := NewTCPPeer(conn, outbound)
-	if err = t.HandshakeFunc(peer); err != nil {
+	defer close(peer.closed)
+	if err != nil {
 		err = conn.Close()
 		if err != nil {
 			fmt.Printf("TCP handshake error: %s\n", err)
@@ -149,6 +443,9 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	if t.OnNodeClosed != nil {
+		defer t.OnNodeClosed(peer)
+	}
 	for {
 		rpc := RPC{}
 		err = t.Decoder.Decode(conn, &rpc)
@@ -156,8 +453,33 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 		rpc.From = conn.RemoteAddr().String()
-		if rpc.Stream {
+		switch {
+		case rpc.Chunk:
+			var opened *muxStream
+			if opened, err = peer.receiveChunk(rpc.StreamID, rpc.Payload); err != nil {
+				return
+			}
+			if opened != nil {
+				go t.expireStream(peer, peer.queueStream(opened))
+			}
+			continue
+		case rpc.Window > 0:
+			peer.receiveWindow(rpc.StreamID, rpc.Window)
+			continue
+		case rpc.Reply != 0:
+			var reply *pendingReply
+			if reply, err = peer.receiveReply(rpc.StreamID, rpc.Reply); err != nil {
+				return
+			}
+			go t.expireReply(peer, rpc.Reply, reply)
+			continue
+		case rpc.Stream:
 			peer.wg.Add(1)
+			if !t.awaitClaim(peer, peer.queueStream(&connStream{peer: peer})) {
+				peer.wg.Done()
+				err = fmt.Errorf("no handler claimed the stream within %s", t.streamClaimTimeout())
+				return
+			}
 			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
 			peer.wg.Wait()
 			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
@@ -169,17 +491,116 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	}
 }
 
+// awaitClaim waits for a caller of AcceptStream to claim an incoming stream, withdrawing it
+// after StreamClaimTimeout. A stream nobody claims was announced by no message, so the
+// bytes after it cannot be told apart from the next frame.
+//
+// Returns: Whether the stream was claimed.
+func (t *TCPTransport) awaitClaim(peer *TCPPeer, stream *pendingStream) bool {
+	timer := clock.Or(t.Clock).NewTimer(t.streamClaimTimeout())
+	defer timer.Stop()
+	select {
+	case <-stream.claimed:
+		return true
+	case <-timer.C():
+		return !peer.unqueueStream(stream)
+	case <-peer.closed:
+		return false
+	}
+}
+
+// expireStream drops the connection if a multiplexed stream is not claimed within
+// StreamClaimTimeout, like a stream marker nobody claims.
+func (t *TCPTransport) expireStream(peer *TCPPeer, stream *pendingStream) {
+	if !t.awaitClaim(peer, stream) {
+		log.Printf("[%s] no handler claimed stream within %s, dropping connection", peer.RemoteAddr(), t.streamClaimTimeout())
+		peer.Close()
+	}
+}
+
+// expireReply discards a stream answering a request if it is not claimed within
+// StreamClaimTimeout, as its requester stopped waiting for it. Unlike a stream announced by
+// a message, it was framed on its own, so the connection stays in step.
+func (t *TCPTransport) expireReply(peer *TCPPeer, id uint64, reply *pendingReply) {
+	timer := clock.Or(t.Clock).NewTimer(t.streamClaimTimeout())
+	defer timer.Stop()
+	select {
+	case <-reply.claimed:
+		return
+	case <-peer.closed:
+		return
+	case <-timer.C():
+	}
+	peer.muxMu.Lock()
+	unclaimed := peer.replies[id] == reply
+	if unclaimed {
+		delete(peer.replies, id)
+	}
+	peer.muxMu.Unlock()
+	if unclaimed {
+		reply.stream.Close()
+	}
+}
+
+// streamClaimTimeout returns StreamClaimTimeout, or its default when it is not set.
+func (t *TCPTransport) streamClaimTimeout() time.Duration {
+	if t.StreamClaimTimeout <= 0 {
+		return defaultStreamClaimTimeout
+	}
+	return t.StreamClaimTimeout
+}
+
 // startAcceptLoop continuously accepts incoming connections and spawns a goroutine to handle each one.
+// Transient accept errors are retried with exponential backoff. A permanent error, or more than
+// MaxAcceptFailures transient errors in a row, closes the listener and is reported through Err.
 func (t *TCPTransport) startAcceptLoop() {
+	maxFailures := t.MaxAcceptFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxAcceptFailures
+	}
+	var (
+		failures int
+		backoff  time.Duration
+	)
 	for {
 		conn, err := t.listener.Accept()
 		if errors.Is(err, net.ErrClosed) {
 			return
 		}
 		if err != nil {
-			fmt.Printf("TCP accept error: %s\n", err)
+			failures++
+			if !isTransientAcceptError(err) || failures > maxFailures {
+				t.listener.Close()
+				t.errch <- fmt.Errorf("accepting connections on %s: %w", t.ListenAddr, err)
+				return
+			}
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else {
+				backoff = min(2*backoff, maxAcceptBackoff)
+			}
+			fmt.Printf("TCP accept error: %s; retrying in %s\n", err, backoff)
+			clock.Or(t.Clock).Sleep(backoff)
+			continue
 		}
+		failures, backoff = 0, 0
 		fmt.Printf("new incoming connection %+v\n", conn)
 		go t.handleConn(conn, false)
 	}
 }
+
+// isTransientAcceptError reports whether an Accept error may clear up on its own, such as
+// running out of file descriptors or a connection aborted before it was accepted. It replaces
+// the deprecated net.Error Temporary method, which also matched errors that never recover.
+func isTransientAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EAGAIN, syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
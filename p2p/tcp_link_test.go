@@ -1,11 +1,19 @@
 package p2p
 
 import (
-	"log"
+	"bytes"
+	"encoding/binary"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -29,24 +37,15 @@ func TestTCPTransport_Basic(t *testing.T) {
 	tr := NewTCPTransport(opts)
 	assert.Equal(t, tr.ListenAddr, ":3000")
 
-	// Start transport in goroutine
-	go func() {
-		err := tr.ListenAndAccept()
-		assert.Nil(t, err)
-	}()
-
-	// Give time for server to start
-	time.Sleep(100 * time.Millisecond)
+	// The transport listens once ListenAndAccept returns
+	require.NoError(t, tr.ListenAndAccept())
 
 	// Test basic connection
 	conn, err := net.Dial("tcp", ":3000")
 	require.NoError(t, err)
-	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
-			log.Fatal("error closing connection: ", err)
-		}
-	}(conn)
+	defer func() {
+		assert.NoError(t, conn.Close())
+	}()
 
 	// Cleanup
 	err = tr.Close()
@@ -66,9 +65,6 @@ func TestTCPTransport_Dial(t *testing.T) {
 	err := serverTr.ListenAndAccept()
 	require.NoError(t, err)
 
-	// Give time for server to start
-	time.Sleep(100 * time.Millisecond)
-
 	// Client transport
 	clientOpts := TCPTransportOpts{
 		ListenAddr:    ":3002",
@@ -81,9 +77,6 @@ func TestTCPTransport_Dial(t *testing.T) {
 	err = clientTr.Dial(":3001")
 	assert.Nil(t, err)
 
-	// Give time for connection to establish
-	time.Sleep(100 * time.Millisecond)
-
 	// Cleanup - make sure to check if listener exists before closing
 	if serverTr.listener != nil {
 		err = serverTr.Close()
@@ -103,29 +96,577 @@ func TestTCPTransport_HandshakeFailure(t *testing.T) {
 		Decoder:       DefaultDecoder{},
 	}
 	tr := NewTCPTransport(opts)
-
-	go func() {
-		err := tr.ListenAndAccept()
-		assert.Nil(t, err)
-	}()
-	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, tr.ListenAndAccept())
 
 	// Connection should be closed after failed handshake
 	conn, err := net.Dial("tcp", ":3003")
 	require.NoError(t, err)
-	defer func(conn net.Conn) {
-		err := conn.Close()
-		if err != nil {
-			log.Fatal("error closing connection: ", err)
-		}
-	}(conn)
+	defer func() {
+		assert.NoError(t, conn.Close())
+	}()
 
 	// Try to read - should fail due to connection being closed after handshake failure
 	buf := make([]byte, 1)
 	_, err = conn.Read(buf)
 	assert.Error(t, err)
 
-	if err := tr.Close(); err != nil {
-		log.Fatal("error closing connection: ", err)
+	assert.NoError(t, tr.Close())
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// tempFile writes size bytes to a temporary file and returns it opened for reading.
+func tempFile(t testing.TB, size int) *os.File {
+	path := filepath.Join(t.TempDir(), "payload")
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte{'d'}, size), 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestTCPPeerReadFrom(t *testing.T) {
+	const size = 1<<20 + 7
+	pipeLocal, pipeRemote := net.Pipe()
+	tcpLocal, tcpRemote := tcpPair(t)
+	tests := []struct {
+		name   string
+		local  net.Conn
+		remote net.Conn
+	}{
+		{"tcp", tcpLocal, tcpRemote},
+		{"pipe fallback", pipeLocal, pipeRemote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tempFile(t, size)
+			received := make(chan int64)
+			go func() {
+				n, _ := io.Copy(io.Discard, io.LimitReader(tt.remote, size))
+				received <- n
+			}()
+			n, err := io.CopyN(NewTCPPeer(tt.local, true), f, size)
+			require.NoError(t, err)
+			assert.Equal(t, int64(size), n)
+			assert.Equal(t, int64(size), <-received)
+		})
+	}
+}
+
+// writerOnly hides every method of the wrapped writer except Write, as stream wrappers do.
+type writerOnly struct {
+	io.Writer
+}
+
+func BenchmarkTCPPeerSend(b *testing.B) {
+	const size = 64 << 20
+	for _, bm := range []struct {
+		name string
+		dst  func(*TCPPeer) io.Writer
+	}{
+		{"ReadFrom", func(p *TCPPeer) io.Writer { return p }},
+		{"Buffered", func(p *TCPPeer) io.Writer { return writerOnly{p} }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			local, remote := tcpPair(b)
+			f := tempFile(b, size)
+			go io.Copy(io.Discard, remote)
+			peer := NewTCPPeer(local, true)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.CopyN(bm.dst(peer), f, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// countingConn counts the writes made to the wrapped connection.
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestTCPPeerBuffersWritesUntilFrameEnds(t *testing.T) {
+	local, remote := net.Pipe()
+	received := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(remote)
+		received <- b
+	}()
+	conn := &countingConn{Conn: local}
+	peer := NewTCPPeer(conn, true)
+
+	// A message frame is a single write.
+	frame, err := EncodeMessage([]byte("control"))
+	require.NoError(t, err)
+	require.NoError(t, peer.Send(frame))
+	assert.Equal(t, 1, conn.writes)
+
+	// A stream marker and header written piecewise reach the connection together, flushed
+	// ahead of the stream bytes copied after them.
+	_, err = peer.Write([]byte{IncomingStream})
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(peer, binary.LittleEndian, int64(6)))
+	assert.Equal(t, 1, conn.writes, "writes are buffered until the frame ends")
+	_, err = peer.ReadFrom(strings.NewReader("stream"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, conn.writes, "one write for the header, one for the stream")
+
+	// Flush sends a header no stream follows.
+	require.NoError(t, binary.Write(peer, binary.LittleEndian, int64(0)))
+	require.NoError(t, peer.Flush())
+	assert.Equal(t, 4, conn.writes)
+	require.NoError(t, peer.Flush())
+	assert.Equal(t, 4, conn.writes, "flushing an empty buffer writes nothing")
+
+	local.Close()
+	want := append(frame, IncomingStream)
+	want = binary.LittleEndian.AppendUint64(want, 6)
+	want = append(want, "stream"...)
+	want = binary.LittleEndian.AppendUint64(want, 0)
+	assert.Equal(t, want, <-received)
+}
+
+func TestTCPPeerUnbufferedWrites(t *testing.T) {
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() { local.Close() })
+	conn := &countingConn{Conn: local}
+	peer := NewTCPPeer(conn, true)
+	peer.setWriteBuffer(-1)
+
+	_, err := peer.Write([]byte{IncomingStream})
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(peer, binary.LittleEndian, int64(6)))
+	assert.Equal(t, 2, conn.writes, "every write reaches the connection at once")
+	require.NoError(t, peer.Flush())
+	assert.Equal(t, 2, conn.writes)
+}
+
+// BenchmarkTCPPeerSmallBroadcasts sends 10k small streamed requests, each a stream marker
+// followed by its payload, with and without the write buffer.
+func BenchmarkTCPPeerSmallBroadcasts(b *testing.B) {
+	const messages = 10_000
+	payload := bytes.Repeat([]byte{'m'}, 64)
+	for _, bm := range []struct {
+		name string
+		size int
+	}{
+		{"Unbuffered", -1},
+		{"Buffered", 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			local, remote := tcpPair(b)
+			go io.Copy(io.Discard, remote)
+			peer := NewTCPPeer(local, true)
+			peer.setWriteBuffer(bm.size)
+			b.SetBytes(messages * int64(len(payload)+1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < messages; j++ {
+					if _, err := peer.Write([]byte{IncomingStream}); err != nil {
+						b.Fatal(err)
+					}
+					if err := peer.Send(payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
 	}
 }
+
+// sleepRecorder is a fake clock recording every sleep, which returns at once after moving the
+// clock past it.
+type sleepRecorder struct {
+	*clock.Fake
+	sleeps []time.Duration
+}
+
+func (c *sleepRecorder) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.Advance(d)
+}
+
+// scriptedListener returns the scripted results from Accept in order, then keeps returning
+// the last error until it is closed.
+type scriptedListener struct {
+	mu      sync.Mutex
+	results []error // nil entries accept a connection
+	closed  bool
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	err := l.results[0]
+	if len(l.results) > 1 {
+		l.results = l.results[1:]
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (l *scriptedListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestTCPTransportAcceptBackoff(t *testing.T) {
+	transient := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	tests := []struct {
+		name        string
+		results     []error
+		maxFailures int
+		wantSleeps  []time.Duration
+		wantErr     error
+	}{
+		{
+			name:        "gives up after repeated transient errors",
+			results:     []error{transient},
+			maxFailures: 4,
+			wantSleeps:  []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+			wantErr:     syscall.EMFILE,
+		},
+		{
+			name:        "success resets the backoff",
+			results:     []error{transient, transient, nil, transient},
+			maxFailures: 3,
+			wantSleeps: []time.Duration{
+				5 * time.Millisecond, 10 * time.Millisecond,
+				5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond,
+			},
+			wantErr: syscall.EMFILE,
+		},
+		{
+			name:        "permanent error is fatal at once",
+			results:     []error{assert.AnError},
+			maxFailures: 10,
+			wantErr:     assert.AnError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln := &scriptedListener{results: tt.results}
+			clk := &sleepRecorder{Fake: clock.NewFake(time.Unix(0, 0))}
+			tr := NewTCPTransport(TCPTransportOpts{
+				ListenAddr:        ":0",
+				HandshakeFunc:     NOPHandshakeFunc,
+				Decoder:           DefaultDecoder{},
+				Listen:            func(string, string) (net.Listener, error) { return ln, nil },
+				MaxAcceptFailures: tt.maxFailures,
+				Clock:             clk,
+			})
+			require.NoError(t, tr.ListenAndAccept())
+
+			select {
+			case err := <-tr.Err():
+				assert.ErrorIs(t, err, tt.wantErr)
+			case <-time.After(3 * time.Second):
+				t.Fatal("transport did not report the fatal accept error")
+			}
+			assert.Equal(t, tt.wantSleeps, clk.sleeps)
+			assert.True(t, ln.closed, "the listener should be closed once the transport gives up")
+		})
+	}
+}
+
+func TestIsTransientAcceptError(t *testing.T) {
+	assert.True(t, isTransientAcceptError(&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ENFILE)}))
+	assert.True(t, isTransientAcceptError(syscall.ECONNABORTED))
+	assert.False(t, isTransientAcceptError(syscall.EBADF))
+	assert.False(t, isTransientAcceptError(assert.AnError))
+}
+
+func TestTCPPeerAcceptStream(t *testing.T) {
+	t.Run("stream lifecycle", func(t *testing.T) {
+		local, remote := net.Pipe()
+		peers := make(chan Node, 1)
+		tr := NewTCPTransport(TCPTransportOpts{
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnNode: func(n Node) error {
+				peers <- n
+				return nil
+			},
+		})
+		go tr.handleConn(local, false)
+		peer := <-peers
+
+		go remote.Write([]byte{IncomingStream, 'x'})
+		stream := peer.AcceptStream()
+		b := make([]byte, 1)
+		_, err := io.ReadFull(stream, b)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("x"), b)
+		require.NoError(t, stream.Close())
+		assert.NoError(t, stream.Close(), "a second close must be a no-op")
+
+		frame, err := EncodeMessage([]byte("after the stream"))
+		require.NoError(t, err)
+		go remote.Write(frame)
+		select {
+		case rpc := <-tr.Consume():
+			assert.Equal(t, []byte("after the stream"), rpc.Payload)
+		case <-time.After(3 * time.Second):
+			t.Fatal("read loop did not resume after the stream was closed")
+		}
+		remote.Close()
+	})
+
+	t.Run("unclaimed stream", func(t *testing.T) {
+		local, remote := net.Pipe()
+		peers := make(chan Node, 1)
+		closed := make(chan struct{})
+		tr := NewTCPTransport(TCPTransportOpts{
+			HandshakeFunc:      NOPHandshakeFunc,
+			Decoder:            DefaultDecoder{},
+			StreamClaimTimeout: 50 * time.Millisecond,
+			OnNode: func(n Node) error {
+				peers <- n
+				return nil
+			},
+			OnNodeClosed: func(Node) { close(closed) },
+		})
+		go tr.handleConn(local, false)
+		peer := <-peers
+
+		// A stream marker no message announced leaves the connection out of step, so it is dropped.
+		go remote.Write([]byte{IncomingStream, IncomingMessage, 0, 0, 0, 1, 'x'})
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("connection with an unclaimed stream was not dropped")
+		}
+		_, err := remote.Read(make([]byte, 1))
+		assert.Error(t, err)
+		stream := peer.AcceptStream()
+		_, err = stream.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, net.ErrClosed, "a stream accepted on a dropped connection must fail")
+		assert.NoError(t, stream.Close())
+	})
+}
+
+// pipePeers connects two transports over an in-memory pipe.
+//
+// Returns: Each transport's peer for the other.
+func pipePeers(t *testing.T, opts TCPTransportOpts) (*TCPTransport, *TCPPeer, *TCPTransport, *TCPPeer) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	connect := func(conn net.Conn, outbound bool) (*TCPTransport, *TCPPeer) {
+		peers := make(chan Node, 1)
+		o := opts
+		o.HandshakeFunc = NOPHandshakeFunc
+		o.Decoder = DefaultDecoder{}
+		o.OnNode = func(n Node) error {
+			peers <- n
+			return nil
+		}
+		tr := NewTCPTransport(o)
+		go tr.handleConn(conn, outbound)
+		return tr, (<-peers).(*TCPPeer)
+	}
+	trA, a := connect(local, true)
+	trB, b := connect(remote, false)
+	return trA, a, trB, b
+}
+
+func TestTCPPeerMux(t *testing.T) {
+	t.Run("interleaved streams", func(t *testing.T) {
+		_, a, trB, b := pipePeers(t, TCPTransportOpts{})
+
+		// A stream bigger than the window is held up until it is read, while a second stream
+		// and a message sent after it get through.
+		big := bytes.Repeat([]byte("0123456789abcdef"), muxWindow/4)
+		first := a.OpenStream()
+		written := make(chan error, 1)
+		go func() {
+			_, err := first.Write(big)
+			if err == nil {
+				err = first.Close()
+			}
+			written <- err
+		}()
+		bigStream := b.AcceptStream()
+
+		second := a.OpenStream()
+		_, err := second.Write([]byte("small"))
+		require.NoError(t, err)
+		require.NoError(t, second.Close())
+		frame, err := EncodeMessage([]byte("meanwhile"))
+		require.NoError(t, err)
+		require.NoError(t, a.Send(frame))
+
+		small, err := io.ReadAll(b.AcceptStream())
+		require.NoError(t, err)
+		assert.Equal(t, []byte("small"), small)
+		select {
+		case rpc := <-trB.Consume():
+			assert.Equal(t, []byte("meanwhile"), rpc.Payload)
+		case <-time.After(3 * time.Second):
+			t.Fatal("message stuck behind an unread stream")
+		}
+		select {
+		case err := <-written:
+			t.Fatalf("stream written past its window before being read: %v", err)
+		default:
+		}
+
+		got, err := io.ReadAll(bigStream)
+		require.NoError(t, err)
+		assert.Equal(t, big, got)
+		require.NoError(t, <-written)
+		require.NoError(t, bigStream.Close())
+	})
+
+	t.Run("closed early", func(t *testing.T) {
+		_, a, _, b := pipePeers(t, TCPTransportOpts{})
+
+		// The sender finishes a stream the receiver stops reading.
+		w := a.OpenStream()
+		written := make(chan error, 1)
+		go func() {
+			_, err := w.Write(make([]byte, 4*muxWindow))
+			if err == nil {
+				err = w.Close()
+			}
+			written <- err
+		}()
+		stream := b.AcceptStream()
+		_, err := io.ReadFull(stream, make([]byte, 10))
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		select {
+		case err := <-written:
+			require.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("sender stuck on a stream the receiver closed")
+		}
+	})
+
+	t.Run("unclaimed stream", func(t *testing.T) {
+		_, a, _, b := pipePeers(t, TCPTransportOpts{StreamClaimTimeout: 50 * time.Millisecond})
+
+		w := a.OpenStream()
+		_, err := w.Write([]byte("nobody reads this"))
+		require.NoError(t, err)
+		select {
+		case <-b.closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("connection with an unclaimed stream was not dropped")
+		}
+	})
+
+	t.Run("replies", func(t *testing.T) {
+		_, a, _, b := pipePeers(t, TCPTransportOpts{})
+
+		// Answers are claimed by the request they answer, whatever order they arrive in.
+		for _, answer := range []struct {
+			id   uint64
+			body string
+		}{{2, "second"}, {1, "first"}} {
+			w := b.OpenReply(answer.id)
+			_, err := w.Write([]byte(answer.body))
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+		}
+		for _, answer := range []struct {
+			id   uint64
+			body string
+		}{{1, "first"}, {2, "second"}} {
+			stream := a.AwaitReply(answer.id, nil)
+			require.NotNil(t, stream)
+			got, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			assert.Equal(t, answer.body, string(got))
+			require.NoError(t, stream.Close())
+		}
+	})
+
+	t.Run("abandoned reply", func(t *testing.T) {
+		_, a, _, b := pipePeers(t, TCPTransportOpts{StreamClaimTimeout: 50 * time.Millisecond})
+
+		// A requester that stops waiting gets nothing, and its answer arriving late is
+		// discarded without dropping the connection.
+		done := make(chan struct{})
+		close(done)
+		assert.Nil(t, a.AwaitReply(1, done))
+		w := b.OpenReply(1)
+		_, err := w.Write([]byte("too late"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.Eventually(t, func() bool {
+			a.muxMu.Lock()
+			defer a.muxMu.Unlock()
+			return len(a.replies) == 0
+		}, 3*time.Second, 10*time.Millisecond)
+
+		w = b.OpenStream()
+		_, err = w.Write([]byte("still connected"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		got, err := io.ReadAll(a.AcceptStream())
+		require.NoError(t, err)
+		assert.Equal(t, "still connected", string(got))
+	})
+
+	t.Run("dropped connection", func(t *testing.T) {
+		_, a, _, b := pipePeers(t, TCPTransportOpts{})
+
+		w := a.OpenStream()
+		_, err := w.Write([]byte("partial"))
+		require.NoError(t, err)
+		stream := b.AcceptStream()
+		_, err = io.ReadFull(stream, make([]byte, 7))
+		require.NoError(t, err)
+		a.Close()
+		_, err = stream.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, net.ErrClosed)
+	})
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultBusyRetryAfter is the wait suggested to peers refused as busy when BusyRetryAfter
+	// is not set.
+	defaultBusyRetryAfter = 50 * time.Millisecond
+	// maxBusyRetries is the most times a fetch is asked again because every peer holding the
+	// object was busy, each waiting longer than the last.
+	maxBusyRetries = 8
+	// busyHeaderSize marks a busy answer to a get request in the Size of its objectHeader.
+	busyHeaderSize = -2
+	// overloadedAfter is how long requests must keep being refused as busy before the node
+	// reports itself overloaded.
+	overloadedAfter = 2 * time.Second
+	// overloadGap is the longest pause between refusals that still counts as one stretch of
+	// shedding load.
+	overloadGap = time.Second
+)
+
+// ErrBusy is returned when a peer refused a request because it was at its admission limits.
+var ErrBusy = errors.New("node is busy")
+
+// admissionKind is a kind of work of peers the admission limits count separately.
+type admissionKind int
+
+const (
+	admitGet     admissionKind = iota // Whole and ranged objects being served to peers
+	admitReplica                      // Replicas being received from peers
+	admissionKinds
+)
+
+// admission counts the work of peers in flight against MaxServingGets, MaxReceivingReplicas and
+// MaxInflightBytes, refusing work past them rather than letting it queue up, and remembers how
+// long it has been refusing work to tell when the node is overloaded.
+type admission struct {
+	clock     clock.Clock           // Times the refusals
+	mu        sync.Mutex            // Guards the fields below
+	limits    [admissionKinds]int   // Most work in flight of each kind, zero for no limit
+	maxBytes  int64                 // Most bytes in flight across kinds, zero for no limit
+	running   [admissionKinds]int   // Work in flight of each kind
+	bytes     int64                 // Bytes of the work in flight
+	shedStart time.Time             // First refusal of the current stretch of shedding load, zero before any
+	lastShed  time.Time             // Latest refusal
+	rejected  [admissionKinds]int64 // Work refused of each kind, for the log
+}
+
+// admissionLoad is a snapshot of the work an admission counts.
+type admissionLoad struct {
+	running [admissionKinds]int
+	bytes   int64
+}
+
+// newAdmission returns an admission without limits until limit is called.
+func newAdmission(clk clock.Clock) *admission {
+	return &admission{clock: clk}
+}
+
+// limit sets the most gets served, replicas received and bytes in flight, zero for no limit.
+func (a *admission) limit(gets int, replicas int, bytes int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.limits = [admissionKinds]int{admitGet: gets, admitReplica: replicas}
+	a.maxBytes = bytes
+}
+
+// acquire counts work of size bytes as in flight, unless it is past the limits and may be
+// refused. Work larger than MaxInflightBytes is taken when no other bytes are in flight, so
+// it is not refused forever.
+//
+// Returns: A function marking the work done, and false when the work was refused.
+func (a *admission) acquire(kind admissionKind, size int64, refusable bool) (func(), bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	full := a.limits[kind] > 0 && a.running[kind] >= a.limits[kind]
+	full = full || a.maxBytes > 0 && a.bytes > 0 && a.bytes+size > a.maxBytes
+	if full && refusable {
+		now := a.clock.Now()
+		if a.shedStart.IsZero() || now.Sub(a.lastShed) > overloadGap {
+			a.shedStart = now
+		}
+		a.lastShed = now
+		a.rejected[kind]++
+		return nil, false
+	}
+	a.running[kind]++
+	a.bytes += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.running[kind]--
+			a.bytes -= size
+		})
+	}, true
+}
+
+// snapshot returns the work in flight.
+func (a *admission) snapshot() admissionLoad {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return admissionLoad{running: a.running, bytes: a.bytes}
+}
+
+// overloaded describes why the node counts as overloaded: it has kept refusing work for
+// overloadedAfter, without pausing for longer than overloadGap.
+//
+// Returns: The reason, or an empty string while the node is not overloaded.
+func (a *admission) overloaded() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.shedStart.IsZero() || a.clock.Since(a.lastShed) > overloadGap {
+		return ""
+	}
+	shedding := a.lastShed.Sub(a.shedStart)
+	if shedding < overloadedAfter {
+		return ""
+	}
+	return fmt.Sprintf("refusing work as busy for %s, %d gets and %d replicas since the node started",
+		shedding.Round(time.Second), a.rejected[admitGet], a.rejected[admitReplica])
+}
+
+// busyRetryAfter returns the wait suggested to peers refused as busy.
+func (s *FileServer) busyRetryAfter() time.Duration {
+	if s.BusyRetryAfter > 0 {
+		return s.BusyRetryAfter
+	}
+	return defaultBusyRetryAfter
+}
+
+// admitGet counts a get request of peer for an object as served, unless this node is at its
+// admission limits and the peer understands being refused as busy. Peers predating CapBusy
+// are always served, so they do not take the refusal for a miss.
+//
+// Returns: A function marking the request served, and false when it was refused.
+func (s *FileServer) admitGet(peer p2p.Node, id string, key string) (func(), bool) {
+	var size int64
+	if s.MaxInflightBytes > 0 {
+		if meta, err := s.Storage.Stat(id, key); err == nil {
+			size = meta.Size
+		}
+	}
+	release, ok := s.admission.acquire(admitGet, size, s.capsOf(peer).busy)
+	if !ok {
+		s.metrics.getsShed.Add(1)
+	}
+	return release, ok
+}
+
+// admitReceive counts a replica of size bytes sent by peer as being received, as admitGet
+// does for get requests.
+func (s *FileServer) admitReceive(peer p2p.Node, size int64) (func(), bool) {
+	release, ok := s.admission.acquire(admitReplica, size, s.capsOf(peer).busy)
+	if !ok {
+		s.metrics.replicasShed.Add(1)
+	}
+	return release, ok
+}
+
+// busyHeader answers a get request refused past the admission limits in place of the object's
+// header, carrying the wait suggested before asking again in milliseconds in the first bytes
+// of Sum. Only peers supporting CapBusy are sent it.
+func busyHeader(retryAfter time.Duration) objectHeader {
+	h := objectHeader{Size: busyHeaderSize}
+	binary.LittleEndian.PutUint64(h.Sum[:8], uint64(retryAfter.Milliseconds()))
+	return h
+}
+
+// busy reports whether the header answers a request the peer refused as busy, and how long
+// the peer suggested waiting before asking again.
+func (h objectHeader) busy() (time.Duration, bool) {
+	if h.Found || h.Size != busyHeaderSize {
+		return 0, false
+	}
+	return time.Duration(binary.LittleEndian.Uint64(h.Sum[:8])) * time.Millisecond, true
+}
+
+// refused reports whether the header answers a request the peer denied or refused as busy,
+// saying nothing of the copy it holds.
+func (h objectHeader) refused() bool {
+	_, busy := h.busy()
+	return busy || h.denied()
+}
+
+// busyBackoff returns how long a fetch waits before asking again, the attempt-th time every
+// peer holding the object was busy: the wait they suggested, longer with each attempt, and
+// spread by up to as much again so the fetches refused together do not all come back at once.
+func busyBackoff(suggested time.Duration, attempt int) time.Duration {
+	if suggested <= 0 {
+		suggested = defaultBusyRetryAfter
+	}
+	wait := suggested * time.Duration(attempt)
+	return wait + time.Duration(mrand.Int63n(int64(suggested)))
+}
+
+// resendBusy sends one of this node's objects again to a peer that refused its replica as busy,
+// once the wait the peer suggested is over.
+func (s *FileServer) resendBusy(from string, hashedKey string, wait time.Duration) {
+	select {
+	case <-s.Clock.After(wait):
+	case <-s.quitch:
+		return
+	}
+	peer, ok := s.peer(from)
+	if !ok {
+		return
+	}
+	key, ok := s.keyOfHash(hashedKey)
+	if !ok {
+		return
+	}
+	// The refused push counts as delivered, so it would be skipped as sent recently.
+	s.pushes.forget(objectRef{owner: s.ID, key: hashedKey})
+	if err := s.replicateKeyTo([]p2p.Node{peer}, key); err != nil {
+		log.Printf("[%s] sending (%s) again to (%s): %s", s.Transport.Addr(), key, from, err)
+		s.deferFailed(err, []p2p.Node{peer}, key)
+	}
+}
+
+// keyOfHash returns the plain key of one of this node's objects from its hashed key, and
+// whether the node holds such an object.
+func (s *FileServer) keyOfHash(hashedKey string) (string, bool) {
+	keys, err := s.Storage.KeysWithPrefix(s.ID, "")
+	if err != nil {
+		log.Printf("[%s] listing keys to find (%s): %s", s.Transport.Addr(), hashedKey, err)
+		return "", false
+	}
+	for _, key := range keys {
+		if crypto.HashKey(key) == hashedKey {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionShedsBurstOfGets(t *testing.T) {
+	const (
+		limit = 4
+		shed  = 2
+	)
+	network := p2p.NewMemoryNetwork(1)
+	holder := makeMemoryServer(t, network, ":4000")
+	holder.MaxServingGets = limit
+	holder.InlineThreshold = -1
+	// Every get admitted is held open until the test releases them, so the others find the
+	// holder at its limit.
+	served := make(chan string, limit+shed)
+	hold := make(chan struct{})
+	holder.testHookServed = func(key string, _ int64) {
+		served <- key
+		<-hold
+	}
+	// The requesters only ask again after a busy answer once the test advances their clock.
+	clk := clock.NewFake(time.Unix(0, 0))
+	servers := []*FileServer{holder}
+	for i := range limit + shed {
+		s := makeMemoryServer(t, network, fmt.Sprintf(":%d", 4001+i), ":4000")
+		s.Clock = clk
+		servers = append(servers, s)
+	}
+	startCluster(t, servers...)
+
+	// Every requester's object is held by the holder alone.
+	data := randomData(t, 4<<10)
+	for _, s := range servers[1:] {
+		require.NoError(t, s.Store("burst", bytes.NewReader(data)))
+		require.NoError(t, s.Storage.Delete(s.ID, "burst"))
+	}
+	waitFor(t, func() bool {
+		for _, s := range servers[1:] {
+			if ok, _ := holder.Storage.Has(s.ID, crypto.HashKey("burst")); !ok {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A node handles one message of a peer at a time, so the burst comes from a get of each.
+	var wg sync.WaitGroup
+	for _, s := range servers[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.Get("burst")
+			if !assert.NoError(t, err) {
+				return
+			}
+			got, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, data, got)
+		}()
+	}
+	for range limit {
+		<-served
+	}
+	// Every get refused as busy waits to be asked again.
+	waitFor(t, func() bool {
+		var retries int64
+		for _, s := range servers[1:] {
+			retries += s.Metrics()["busy_retries"]
+		}
+		return retries == shed
+	})
+	assert.Equal(t, int64(shed), holder.Metrics()["gets_shed"])
+	assert.Equal(t, int64(limit), holder.Metrics()["gets_inflight"])
+	assert.Equal(t, limit, holder.admission.snapshot().running[admitGet])
+
+	// Once the admitted gets are served, the refused ones are asked again and fit.
+	close(hold)
+	waitFor(t, func() bool { return holder.Metrics()["gets_inflight"] == 0 })
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		clk.Advance(2 * holder.busyRetryAfter())
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	assert.Len(t, served, shed)
+	assert.Equal(t, int64(shed), holder.Metrics()["gets_shed"])
+}
+
+func TestBusyAnswers(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	b.MaxServingGets = 1
+	b.BusyRetryAfter = 20 * time.Millisecond
+	startCluster(t, a, b)
+
+	require.NoError(t, a.Store("report", bytes.NewReader([]byte("quarterly numbers"))))
+	waitFor(t, func() bool { ok, _ := b.Storage.Has(a.ID, crypto.HashKey("report")); return ok })
+	require.NoError(t, a.Storage.Delete(a.ID, "report"))
+
+	// While b is serving its one get, a is told it is busy and how long to wait.
+	release, ok := b.admission.acquire(admitGet, 0, false)
+	require.True(t, ok)
+	_, err := a.Get("report")
+	var ferr *FetchError
+	require.ErrorAs(t, err, &ferr)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	require.Len(t, ferr.Peers, 1)
+	assert.Equal(t, OutcomeBusy, ferr.Peers[0].Outcome)
+	assert.ErrorIs(t, ferr.Peers[0].Err, ErrBusy)
+	assert.Equal(t, 20*time.Millisecond, ferr.Peers[0].RetryAfter)
+	assert.Equal(t, int64(maxBusyRetries), a.Metrics()["busy_retries"])
+	assert.Equal(t, KindUnavailable, ErrorKind(err))
+
+	// Once b is free again the get goes through.
+	release()
+	r, err := a.Get("report")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("quarterly numbers"), got)
+}
+
+func TestBusyReplicaSentAgain(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	a.InlineThreshold = -1
+	b.MaxReceivingReplicas = 1
+	b.BusyRetryAfter = 50 * time.Millisecond
+	startCluster(t, a, b)
+
+	release, ok := b.admission.acquire(admitReplica, 0, false)
+	require.True(t, ok)
+	require.NoError(t, a.Store("ledger", bytes.NewReader(randomData(t, 8<<10))))
+	waitFor(t, func() bool { return a.Metrics()["replicas_busy"] == 1 })
+	assert.Equal(t, int64(1), b.Metrics()["replicas_shed"])
+	ok, _ = b.Storage.Has(a.ID, crypto.HashKey("ledger"))
+	assert.False(t, ok)
+
+	// The replica is sent again once b has room for it.
+	release()
+	waitFor(t, func() bool { ok, _ := b.Storage.Has(a.ID, crypto.HashKey("ledger")); return ok })
+}
+
+func TestAdmissionLimitsAndOverload(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	a := newAdmission(clk)
+	a.limit(2, 0, 100)
+
+	first, ok := a.acquire(admitGet, 60, true)
+	require.True(t, ok)
+	_, ok = a.acquire(admitGet, 50, true)
+	assert.False(t, ok, "past the bytes in flight")
+	second, ok := a.acquire(admitGet, 40, true)
+	require.True(t, ok)
+	_, ok = a.acquire(admitGet, 0, true)
+	assert.False(t, ok, "past the gets in flight")
+	_, ok = a.acquire(admitGet, 0, false)
+	assert.True(t, ok, "work that cannot be refused is always taken")
+	replica, ok := a.acquire(admitReplica, 0, true)
+	require.True(t, ok, "replicas are not limited")
+	first()
+	first()
+	second()
+	replica()
+	load := a.snapshot()
+	assert.Equal(t, 1, load.running[admitGet])
+	assert.Zero(t, load.bytes)
+	_, ok = a.acquire(admitGet, 500, true)
+	assert.True(t, ok, "work larger than the limit is taken when no bytes are in flight")
+
+	// Refusing work for a sustained time counts as overloaded, until the refusals stop.
+	for range 4 {
+		_, ok = a.acquire(admitGet, 0, true)
+		require.False(t, ok)
+		assert.Empty(t, a.overloaded())
+		clk.Advance(500 * time.Millisecond)
+	}
+	_, ok = a.acquire(admitGet, 0, true)
+	require.False(t, ok)
+	assert.Contains(t, a.overloaded(), "refusing work as busy")
+	clk.Advance(2 * overloadGap)
+	assert.Empty(t, a.overloaded())
+
+	// A pause in the refusals starts the stretch over.
+	_, ok = a.acquire(admitGet, 0, true)
+	require.False(t, ok)
+	assert.Empty(t, a.overloaded())
+}
+
+func TestBusyHeader(t *testing.T) {
+	h := busyHeader(1500 * time.Millisecond)
+	wait, busy := h.busy()
+	assert.True(t, busy)
+	assert.Equal(t, 1500*time.Millisecond, wait)
+	assert.True(t, h.refused())
+	assert.False(t, h.denied())
+	_, busy = deniedHeader.busy()
+	assert.False(t, busy)
+	_, busy = objectHeader{}.busy()
+	assert.False(t, busy)
+	assert.False(t, objectHeader{}.refused())
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// aliasFileName is the file in the storage root holding the aliases known to this node.
+	aliasFileName = ".dfs-aliases.json"
+	// maxAliasDepth is the most aliases resolved in a row before resolution gives up, as the
+	// chain is too long or loops through aliases pointed at each other by different nodes.
+	maxAliasDepth = 8
+)
+
+// ErrAliasLoop is returned for an alias that leads back to itself, or through more than
+// maxAliasDepth aliases, before reaching a key that names an object.
+var ErrAliasLoop = errors.New("alias loop")
+
+// MessageAlias tells peers an alias was pointed at a key, or removed. Aliases are shared by
+// the cluster, so every node keeps the latest change it heard of for each alias name.
+type MessageAlias struct {
+	Alias  string    // Plain name of the alias
+	Target string    // Plain key the alias points at, empty when the alias was removed
+	Time   time.Time // When the alias was changed, by the clock of the node changing it
+	Node   string    // ID of the node that changed the alias, deciding between changes made at the same time
+}
+
+// aliasRecord is the latest change to an alias, as persisted.
+type aliasRecord struct {
+	Alias  string    `json:"alias"`
+	Target string    `json:"target,omitempty"` // Empty when the alias was removed
+	Time   time.Time `json:"time"`
+	Node   string    `json:"node"`
+}
+
+// supersedes reports whether r is a later change than other: the last write wins, and changes
+// made at the same time are ordered by node ID so every node picks the same one.
+func (r aliasRecord) supersedes(other aliasRecord) bool {
+	if !r.Time.Equal(other.Time) {
+		return r.Time.After(other.Time)
+	}
+	return r.Node > other.Node
+}
+
+// aliasTable is the aliases a node knows of, the latest change to each by name. Removed
+// aliases are kept as records without a target, so an older change arriving late does not
+// bring them back. It is persisted after every change so aliases survive restarts.
+type aliasTable struct {
+	mu      sync.Mutex
+	path    string                 // Location of the persisted table, empty until load is called
+	entries map[string]aliasRecord // Latest change by alias name
+}
+
+// newAliasTable returns an empty table that is not persisted until load is called.
+func newAliasTable() *aliasTable {
+	return &aliasTable{entries: make(map[string]aliasRecord)}
+}
+
+// load attaches the table to path, restoring the alias changes saved there.
+func (t *aliasTable) load(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	var saved []aliasRecord
+	if err := loadJSON(path, "aliases", &saved); err != nil {
+		return err
+	}
+	for _, r := range saved {
+		t.applyLocked(r)
+	}
+	return nil
+}
+
+// apply records a change to an alias unless a later one is known.
+//
+// Returns: Whether the change was recorded.
+func (t *aliasTable) apply(r aliasRecord) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.applyLocked(r) {
+		return false
+	}
+	t.saveLocked()
+	return true
+}
+
+// applyLocked records a change unless a later one is known, and reports whether it did; the
+// caller must hold mu.
+func (t *aliasTable) applyLocked(r aliasRecord) bool {
+	if known, ok := t.entries[r.Alias]; ok && !r.supersedes(known) {
+		return false
+	}
+	t.entries[r.Alias] = r
+	return true
+}
+
+// change records a change made on this node at now, after any change known to the alias so
+// it wins over them however the clocks of the nodes compare. A new target must not lead
+// back to the alias.
+//
+// Returns: The change recorded, or an error wrapping ErrAliasLoop.
+func (t *aliasTable) change(alias string, target string, node string, now time.Time) (aliasRecord, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(target) > 0 {
+		if _, chain, err := t.resolveLocked(target); err != nil {
+			return aliasRecord{}, err
+		} else if slices.Contains(chain, alias) {
+			return aliasRecord{}, fmt.Errorf("%w: (%s) leads back to (%s)", ErrAliasLoop, target, alias)
+		}
+	}
+	// Peers compare changes by wall clock, which is all they receive.
+	r := aliasRecord{Alias: alias, Target: target, Time: now.Round(0), Node: node}
+	if known, ok := t.entries[alias]; ok && !r.supersedes(known) {
+		r.Time = known.Time.Add(time.Nanosecond)
+	}
+	t.entries[alias] = r
+	t.saveLocked()
+	return r, nil
+}
+
+// target returns the key an alias points at directly, and whether key names an alias.
+func (t *aliasTable) target(key string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.entries[key]
+	return r.Target, ok && len(r.Target) > 0
+}
+
+// resolve follows a key through the aliases it names to the key of an object. The chain is
+// followed in one pass over the table, so a reader sees each alias either before or after a
+// change, never a mix of both.
+//
+// Returns: The key reached, key itself when it is not an alias, and an error wrapping
+// ErrAliasLoop if the chain loops or is longer than maxAliasDepth.
+func (t *aliasTable) resolve(key string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	target, _, err := t.resolveLocked(key)
+	return target, err
+}
+
+// resolveLocked resolves key as for resolve, also returning the keys passed through, key
+// first; the caller must hold mu.
+func (t *aliasTable) resolveLocked(key string) (string, []string, error) {
+	chain := []string{key}
+	for {
+		r, ok := t.entries[key]
+		if !ok || len(r.Target) == 0 {
+			return key, chain, nil
+		}
+		if slices.Contains(chain, r.Target) {
+			return "", chain, fmt.Errorf("%w: (%s) leads back to (%s)", ErrAliasLoop, chain[0], r.Target)
+		}
+		if len(chain) > maxAliasDepth {
+			return "", chain, fmt.Errorf("%w: (%s) passes through more than %d aliases", ErrAliasLoop, chain[0], maxAliasDepth)
+		}
+		key = r.Target
+		chain = append(chain, key)
+	}
+}
+
+// list returns the aliases starting with prefix in sorted order, without those removed.
+func (t *aliasTable) list(prefix string) []aliasRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []aliasRecord
+	for alias, r := range t.entries {
+		if len(r.Target) > 0 && strings.HasPrefix(alias, prefix) {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Alias < list[j].Alias })
+	return list
+}
+
+// all returns the latest change to every alias, removals included.
+func (t *aliasTable) all() []aliasRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]aliasRecord, 0, len(t.entries))
+	for _, r := range t.entries {
+		list = append(list, r)
+	}
+	return list
+}
+
+// saveLocked saves the latest change of every alias, sorted by name; the caller must hold mu.
+func (t *aliasTable) saveLocked() {
+	if len(t.path) == 0 {
+		return
+	}
+	saved := make([]aliasRecord, 0, len(t.entries))
+	for _, r := range t.entries {
+		saved = append(saved, r)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Alias < saved[j].Alias })
+	if err := saveJSON(t.path, saved, 0o644); err != nil {
+		log.Printf("persisting aliases to %s: %s", t.path, err)
+	}
+}
+
+// loadAliases attaches the alias table to its file in the storage root.
+func (s *FileServer) loadAliases() error {
+	return s.aliases.load(filepath.Join(s.Storage.Root, aliasFileName))
+}
+
+// Link points an alias at a key, so Get, GetRange and StatKey of the alias read the object
+// stored under the key, without copying it. An alias can point at another alias. Aliases are
+// shared by the cluster: every peer is told of the change, and where two nodes point an alias
+// at once, every node keeps the later change, or the one of the node with the higher ID when
+// both were made at the same time. A node resolves an alias to its own object under the
+// target key, as Get of the target on that node would.
+//
+// The target need not exist yet; reading a dangling alias fails naming its target. An alias
+// takes precedence over an object stored under its name later, until it is deleted.
+//
+// Parameters:
+//   - alias: Name of the alias, which must not name an object held by this node.
+//   - target: Key the alias points at.
+//
+// Returns: An error wrapping ErrInvalidKey for an empty or clashing name, ErrAliasLoop if
+// target leads back to alias, or any errors telling peers. A *BroadcastError means the
+// alias was recorded, but the peers it names were not told of it.
+func (s *FileServer) Link(alias string, target string) error {
+	if err := checkKey(alias); err != nil {
+		return err
+	}
+	if err := checkKey(target); err != nil {
+		return err
+	}
+	if alias == target {
+		return fmt.Errorf("%w: alias (%s) points at itself", ErrAliasLoop, alias)
+	}
+	if _, isAlias := s.aliases.target(alias); !isAlias {
+		if ok, err := s.Storage.Has(s.ID, alias); err != nil {
+			return err
+		} else if ok {
+			return fmt.Errorf("%w: (%s) names an object", ErrInvalidKey, alias)
+		}
+	}
+	r, err := s.aliases.change(alias, target, s.ID, s.Clock.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] pointed alias (%s) at (%s)", s.Transport.Addr(), alias, target)
+	return s.announceAlias(r)
+}
+
+// unlink removes an alias, leaving the key it points at as it is.
+func (s *FileServer) unlink(rid string, alias string) error {
+	r, err := s.aliases.change(alias, "", s.ID, s.Clock.Now())
+	if err != nil {
+		return err
+	}
+	s.logf(rid, "removed alias (%s)", alias)
+	return s.announceAlias(r)
+}
+
+// aliasError names the target an alias was resolved to in an error reading it.
+func aliasError(alias string, target string, err error) error {
+	if alias == target {
+		return err
+	}
+	return fmt.Errorf("alias (%s) points at (%s): %w", alias, target, err)
+}
+
+// announceAlias tells every peer that supports aliases of a change to one.
+func (s *FileServer) announceAlias(r aliasRecord) error {
+	peers, _ := s.peersWith(s.peerList(), func(c peerCaps) bool { return c.aliases })
+	return s.sendCoalesced(peers, &Message{Payload: MessageAlias(r)})
+}
+
+// shareAliases tells a peer that just connected of every alias change this node knows, so
+// aliases changed while the two were apart converge.
+func (s *FileServer) shareAliases(peer p2p.Node) {
+	if !s.capsOf(peer).aliases {
+		return
+	}
+	for _, r := range s.aliases.all() {
+		if err := s.sendCoalesced([]p2p.Node{peer}, &Message{Payload: MessageAlias(r)}); err != nil {
+			log.Printf("[%s] telling (%s) of alias (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), r.Alias, err)
+		}
+	}
+}
+
+// handleMessageAlias records a change to an alias a peer announced, unless a later one is
+// known.
+func (s *FileServer) handleMessageAlias(_ string, msg MessageAlias) error {
+	if len(msg.Alias) == 0 || len(msg.Node) == 0 {
+		return fmt.Errorf("%w: alias change without a name or node", ErrInvalidKey)
+	}
+	s.aliases.apply(aliasRecord(msg))
+	return nil
+}
+
+// aliasPager pages through the aliases starting with prefix, all in one page, as KeyInfo
+// entries naming their targets.
+func (s *FileServer) aliasPager(prefix string) listPager {
+	return func(string) ([]KeyInfo, string, error) {
+		records := s.aliases.list(prefix)
+		entries := make([]KeyInfo, 0, len(records))
+		for _, r := range records {
+			entries = append(entries, KeyInfo{Key: r.Alias, ModTime: r.Time, Target: r.Target})
+		}
+		return entries, "", nil
+	}
+}
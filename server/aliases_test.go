@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aliasRecordOf returns the change to an alias s knows.
+func aliasRecordOf(s *FileServer, alias string) aliasRecord {
+	s.aliases.mu.Lock()
+	defer s.aliases.mu.Unlock()
+	return s.aliases.entries[alias]
+}
+
+func TestAliasChains(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	data := []byte("weights of the forty-second model")
+	require.NoError(t, a.Store("models/v42", bytes.NewReader(data)))
+	require.NoError(t, a.Link("models/stable", "models/v42"))
+	require.NoError(t, a.Link("models/latest", "models/stable"))
+
+	r, err := a.Get("models/latest")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	rc, err := a.GetRange("models/latest", 8, 2)
+	require.NoError(t, err)
+	got, err = io.ReadAll(rc)
+	require.NoError(t, rc.Close())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("of"), got)
+	info, err := a.StatKey("models/latest")
+	require.NoError(t, err)
+	assert.Equal(t, "models/latest", info.Key)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	// Peers learn the aliases, and listings mark them with their targets.
+	waitFor(t, func() bool { target, _ := b.aliases.target("models/latest"); return target == "models/stable" })
+	var listed []KeyInfo
+	for entry, err := range b.ListNetwork("models/") {
+		require.NoError(t, err)
+		listed = append(listed, entry)
+	}
+	require.Len(t, listed, 3)
+	assert.Equal(t, "models/latest", listed[0].Key)
+	assert.Equal(t, "models/stable", listed[0].Target)
+	assert.Equal(t, "models/stable", listed[1].Key)
+	assert.Equal(t, "models/v42", listed[1].Target)
+	assert.Equal(t, "models/v42", listed[2].Key)
+	assert.Empty(t, listed[2].Target)
+	assert.Equal(t, []string{a.ID}, listed[2].Owners)
+
+	// Deleting an alias leaves what it points at, on every node.
+	require.NoError(t, a.Delete("models/stable"))
+	waitFor(t, func() bool { _, ok := b.aliases.target("models/stable"); return !ok })
+	_, err = a.Get("models/stable")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = a.StatKey("models/v42")
+	assert.NoError(t, err)
+	_, err = a.Get("models/latest")
+	assert.ErrorIs(t, err, ErrKeyNotFound, "the alias of the deleted alias dangles")
+}
+
+func TestAliasErrors(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	// A dangling alias fails naming the target that is missing.
+	require.NoError(t, a.Link("reports/latest", "reports/q3"))
+	_, err := a.Get("reports/latest")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Contains(t, err.Error(), "reports/q3")
+	_, err = a.StatKey("reports/latest")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Contains(t, err.Error(), "reports/q3")
+
+	// Aliases may not name objects or lead back to themselves.
+	require.NoError(t, a.Store("reports/q2", bytes.NewReader([]byte("second quarter"))))
+	assert.ErrorIs(t, a.Link("reports/q2", "reports/q3"), ErrInvalidKey)
+	assert.ErrorIs(t, a.Link("reports/q3", "reports/latest"), ErrAliasLoop)
+	assert.ErrorIs(t, a.Link("reports/q3", "reports/q3"), ErrAliasLoop)
+	assert.Equal(t, KindInvalid, ErrorKind(a.Link("reports/q3", "reports/latest")))
+
+	// Loops made by changes on different nodes are caught when resolving.
+	waitFor(t, func() bool { _, ok := b.aliases.target("reports/latest"); return ok })
+	b.aliases.apply(aliasRecord{Alias: "reports/q3", Target: "reports/latest", Time: time.Now(), Node: b.ID})
+	_, err = b.Get("reports/latest")
+	assert.ErrorIs(t, err, ErrAliasLoop)
+
+	// Chains longer than maxAliasDepth are refused too.
+	for i := range maxAliasDepth + 1 {
+		require.NoError(t, a.Link(fmt.Sprintf("chain/%d", i), fmt.Sprintf("chain/%d", i+1)))
+	}
+	require.NoError(t, a.Store(fmt.Sprintf("chain/%d", maxAliasDepth+1), bytes.NewReader([]byte("end"))))
+	_, err = a.Get("chain/0")
+	assert.ErrorIs(t, err, ErrAliasLoop)
+	_, err = a.Get("chain/1")
+	assert.NoError(t, err)
+}
+
+func TestAliasConcurrentRepointing(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	for round := range 5 {
+		var wg sync.WaitGroup
+		for _, s := range []*FileServer{a, b} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, s.Link("models/latest", fmt.Sprintf("models/%d-%s", round, s.ID)))
+			}()
+		}
+		wg.Wait()
+		// Both nodes settle on the same change, the later one or that of the higher node ID.
+		waitFor(t, func() bool {
+			ra, rb := aliasRecordOf(a, "models/latest"), aliasRecordOf(b, "models/latest")
+			return ra.Target == rb.Target && ra.Node == rb.Node && ra.Time.Equal(rb.Time)
+		})
+		winner := aliasRecordOf(a, "models/latest")
+		assert.Contains(t, []string{fmt.Sprintf("models/%d-%s", round, a.ID), fmt.Sprintf("models/%d-%s", round, b.ID)}, winner.Target)
+	}
+}
+
+func TestAliasTableLastWriterWins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), aliasFileName)
+	table := newAliasTable()
+	require.NoError(t, table.load(path))
+	now := time.Unix(1000, 0)
+	assert.True(t, table.apply(aliasRecord{Alias: "latest", Target: "v1", Time: now, Node: "a"}))
+	assert.False(t, table.apply(aliasRecord{Alias: "latest", Target: "v0", Time: now.Add(-time.Second), Node: "z"}), "older changes lose")
+	assert.True(t, table.apply(aliasRecord{Alias: "latest", Target: "v2", Time: now, Node: "b"}), "ties go to the higher node ID")
+	assert.False(t, table.apply(aliasRecord{Alias: "latest", Target: "v1", Time: now, Node: "a"}))
+
+	// A local change wins over those known even when this node's clock is behind.
+	r, err := table.change("latest", "v3", "a", now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.True(t, r.Time.After(now))
+	_, err = table.change("latest", "", "a", now)
+	require.NoError(t, err)
+	target, err := table.resolve("latest")
+	require.NoError(t, err)
+	assert.Equal(t, "latest", target, "a removed alias resolves to itself")
+
+	// Removals are remembered across restarts, so a late change does not revive the alias.
+	reloaded := newAliasTable()
+	require.NoError(t, reloaded.load(path))
+	assert.False(t, reloaded.apply(aliasRecord{Alias: "latest", Target: "v2", Time: now, Node: "b"}))
+	assert.Empty(t, reloaded.list(""))
+}
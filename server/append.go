@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// MessageAppendFile carries content appended to one of the sender's objects to a peer holding
+// its replica, encrypted to continue the replica. The encrypted bytes follow as a stream.
+type MessageAppendFile struct {
+	ID        string // Identifier of the node owning the object
+	Key       string // Hashed key of the object
+	IV        []byte // IV the replica must be encrypted with for the bytes to continue it
+	Offset    int64  // Size the replica must have, where the bytes are appended
+	Size      int64  // Number of bytes appended
+	Checksum  string // Hex-encoded SHA-256 of the bytes appended
+	Namespace string // Namespace of the key, empty if it has none
+}
+
+// MessageAppendRejected tells the owner of an object that a peer could not apply an append to
+// its replica, so the owner sends it the whole object again.
+type MessageAppendRejected struct {
+	Key    string // Hashed key of the object
+	Reason string // Why the append was refused
+}
+
+// Append adds the content from the reader to the end of the object stored under key, creating
+// it when there is none. Rather than the whole object, peers holding a replica are sent the
+// bytes added, encrypted to continue their replica: all replicas of an object appended to share
+// an IV, recorded with the object, and the CTR counter is advanced to the offset the bytes
+// start at. The first append to an object sends it whole to record that IV, as do appends to
+// peers that predate them. A peer whose replica does not end where an append starts, which it
+// missed an earlier one, refuses it and is sent the whole object again. Versioned and
+// immutable keys cannot be appended to.
+//
+// Returns: Number of bytes appended, and any errors as for Store.
+func (s *FileServer) Append(key string, r io.Reader) (int64, error) {
+	if s.versioned(key) {
+		return 0, fmt.Errorf("appending (%s): versioned keys keep each write whole and cannot be appended to", key)
+	}
+	if s.immutable(s.ID, key) {
+		return 0, fmt.Errorf("appending (%s): %w", key, ErrImmutable)
+	}
+	if err := s.checkLease(key); err != nil {
+		return 0, err
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	n, err := s.Storage.Append(s.ID, key, bytes.NewReader(content))
+	if err != nil {
+		return n, err
+	}
+	meta, err := s.Storage.Metadata(s.ID, key)
+	if err != nil {
+		return n, err
+	}
+	s.objectStored(objectRef{owner: s.ID, key: crypto.HashKey(key)})
+	s.publish(NotifyStore, key)
+	peers := s.placement(key, s.peerList())
+	s.deferReplication(key)
+	if err := s.replicateAppend(peers, key, meta, content); err != nil {
+		s.deferFailed(err, peers, key)
+		return n, err
+	}
+	return n, nil
+}
+
+// replicateAppend sends content just appended to key to peers, leaving the object with meta.
+// Peers that take appends get the content alone, unless no IV is recorded for the replicas
+// of key yet, in which case one is recorded and every peer gets the whole object.
+//
+// Returns: A *BroadcastError naming the peers the content did not reach, or any other errors.
+func (s *FileServer) replicateAppend(peers []p2p.Node, key string, meta storage.Metadata, content []byte) error {
+	if meta.ReplicaIV == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return err
+		}
+		if err := s.Storage.SetReplicaIV(s.ID, key, iv); err != nil {
+			return err
+		}
+		return s.replicateKeyTo(peers, key)
+	}
+	appending, whole := s.peersWith(peers, func(c peerCaps) bool { return c.append })
+	berr := &BroadcastError{failed: make(map[string]error), total: len(peers)}
+	if len(whole) > 0 {
+		err := s.replicateKeyTo(whole, key)
+		var perr *BroadcastError
+		if errors.As(err, &perr) {
+			for addr, err := range perr.failed {
+				berr.failed[addr] = err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(appending) > 0 {
+		start := meta.Size - int64(len(content))
+		enc := new(bytes.Buffer)
+		if _, err := crypto.CopyEncryptAt(s.dataKey(key), meta.ReplicaIV, start, bytes.NewReader(content), enc); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(enc.Bytes())
+		msg := MessageAppendFile{
+			ID:        s.ID,
+			Key:       crypto.HashKey(key),
+			IV:        meta.ReplicaIV,
+			Offset:    int64(len(meta.ReplicaIV)) + start,
+			Size:      int64(enc.Len()),
+			Checksum:  hex.EncodeToString(sum[:]),
+			Namespace: keyNamespace(key),
+		}
+		for addr, err := range s.sendAppend(appending, msg, enc.Bytes()) {
+			berr.failed[addr] = err
+		}
+	}
+	if len(berr.failed) > 0 {
+		return berr
+	}
+	return nil
+}
+
+// sendAppend sends an append followed by the bytes appended to each of peers.
+//
+// Returns: The send error of every peer the append did not reach, keyed by address.
+func (s *FileServer) sendAppend(peers []p2p.Node, msg MessageAppendFile, data []byte) map[string]error {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	failed := make(map[string]error)
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		if _, err := s.sendMessage([]p2p.Node{peer}, &Message{Payload: msg}); err != nil {
+			failed[addr] = err
+			continue
+		}
+		if err := s.sendStream(peer, data); err != nil {
+			failed[addr] = err
+		}
+	}
+	return failed
+}
+
+// handleMessageAppendFile appends the bytes following the message to the replica it names.
+// An append that does not continue the replica held, or arrives damaged, is refused with a
+// MessageAppendRejected so the owner sends the whole object again.
+func (s *FileServer) handleMessageAppendFile(from string, msg MessageAppendFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	stream := peer.AcceptStream()
+	defer stream.Close()
+	lr := &io.LimitedReader{R: stream, N: msg.Size}
+	if err := s.admitReplica(from, "", msg.ID, msg.Namespace, msg.Key, msg.Offset+msg.Size); err != nil {
+		// Keep the connection aligned with the next message.
+		_, derr := io.Copy(io.Discard, lr)
+		return errors.Join(err, derr)
+	}
+	if reason := s.appendMismatch(msg); len(reason) > 0 {
+		_, derr := io.Copy(io.Discard, lr)
+		return errors.Join(s.rejectAppend(peer, msg.Key, reason), derr)
+	}
+	h := sha256.New()
+	n, err := s.Storage.Append(msg.ID, msg.Key, io.TeeReader(lr, h))
+	if _, derr := io.Copy(io.Discard, lr); derr != nil {
+		return errors.Join(err, derr)
+	}
+	if err == nil && (n != msg.Size || hex.EncodeToString(h.Sum(nil)) != msg.Checksum) {
+		err = errors.Join(storage.ErrContentCorrupted, s.Storage.Truncate(msg.ID, msg.Key, msg.Offset))
+	}
+	if err != nil {
+		return errors.Join(err, s.rejectAppend(peer, msg.Key, err.Error()))
+	}
+	s.objectStored(objectRef{owner: msg.ID, key: msg.Key})
+	return nil
+}
+
+// appendMismatch checks that an append continues the replica held.
+//
+// Returns: Why the append cannot be applied, empty when it can.
+func (s *FileServer) appendMismatch(msg MessageAppendFile) string {
+	meta, err := s.Storage.Metadata(msg.ID, msg.Key)
+	if err != nil {
+		return fmt.Sprintf("no replica to append to: %s", err)
+	}
+	if meta.Immutable {
+		return ErrImmutable.Error()
+	}
+	if meta.Size != msg.Offset {
+		return fmt.Sprintf("replica holds %d bytes, append starts at %d", meta.Size, msg.Offset)
+	}
+	_, r, err := s.Storage.Read(msg.ID, msg.Key)
+	if err != nil {
+		return err.Error()
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	iv := make([]byte, len(msg.IV))
+	if _, err := io.ReadFull(r, iv); err != nil || !bytes.Equal(iv, msg.IV) {
+		return "replica is encrypted with another IV"
+	}
+	return ""
+}
+
+// rejectAppend tells the owner of an object that an append to its replica was refused.
+//
+// Returns: An error giving reason, joined with any error telling the owner.
+func (s *FileServer) rejectAppend(peer p2p.Node, key string, reason string) error {
+	err := fmt.Errorf("append (%s) refused: %s", key, reason)
+	msg := &Message{Payload: MessageAppendRejected{Key: key, Reason: reason}}
+	if _, serr := s.sendMessage([]p2p.Node{peer}, msg); serr != nil {
+		err = errors.Join(err, serr)
+	}
+	return err
+}
+
+// handleMessageAppendRejected sends the whole object to a peer that refused an append to its
+// replica.
+func (s *FileServer) handleMessageAppendRejected(from string, msg MessageAppendRejected) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	log.Printf("[%s] peer (%s) refused append (%s): %s", s.Transport.Addr(), from, msg.Key, msg.Reason)
+	keys, err := s.Storage.Keys(s.ID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if crypto.HashKey(key) != msg.Key {
+			continue
+		}
+		// Appends made meanwhile reach the peer after the whole object, so they continue it.
+		s.appendMu.Lock()
+		defer s.appendMu.Unlock()
+		s.metrics.appendResyncs.Add(1)
+		return s.replicateKey(peer, key)
+	}
+	// The object was deleted since; the peer learns so as for any delete.
+	return nil
+}
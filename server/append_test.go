@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replicaContent decrypts the replica of owner's key held by holder, returning an empty string
+// if it holds none or is still writing it.
+func replicaContent(t *testing.T, holder *FileServer, owner *FileServer, key string) string {
+	t.Helper()
+	_, r, err := holder.Storage.Read(owner.ID, crypto.HashKey(key))
+	if err != nil {
+		return ""
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	plain := new(bytes.Buffer)
+	if _, err := crypto.CopyDecrypt(owner.dataKey(key), r, plain); err != nil {
+		return ""
+	}
+	return plain.String()
+}
+
+// localContent returns the content of one of s's own objects.
+func localContent(t *testing.T, s *FileServer, key string) string {
+	t.Helper()
+	_, r, err := s.Storage.Read(s.ID, key)
+	require.NoError(t, err)
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestAppendSequential(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	require.NoError(t, a.Store("log", strings.NewReader("first;")))
+	want := "first;"
+	for _, record := range []string{"second;", "a record longer than one AES block;", "", "last;"} {
+		n, err := a.Append("log", strings.NewReader(record))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(record)), n)
+		want += record
+	}
+	assert.Equal(t, want, localContent(t, a, "log"))
+	require.NoError(t, a.Storage.Verify(a.ID, "log"))
+	waitFor(t, func() bool { return replicaContent(t, b, a, "log") == want })
+	require.NoError(t, b.Storage.Verify(a.ID, crypto.HashKey("log")))
+	assert.Zero(t, a.Metrics()["append_resyncs"])
+
+	// Appending creates a missing key.
+	_, err := a.Append("fresh", strings.NewReader("created;"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return replicaContent(t, b, a, "fresh") == "created;" })
+
+	// Versioned and immutable keys are refused.
+	a.VersionedPrefixes = []string{"versioned/"}
+	_, err = a.Append("versioned/log", strings.NewReader("x"))
+	assert.Error(t, err)
+	require.NoError(t, a.StoreWithMetadata("frozen", strings.NewReader("x"), ObjectMetadata{Immutable: true}))
+	_, err = a.Append("frozen", strings.NewReader("y"))
+	assert.ErrorIs(t, err, ErrImmutable)
+}
+
+func TestAppendReplicasConverge(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 && len(c.peerList()) == 2 })
+
+	require.NoError(t, a.Store("log", bytes.NewReader(randomData(t, 1000))))
+	for i := 0; i < 20; i++ {
+		_, err := a.Append("log", bytes.NewReader(randomData(t, 37*i)))
+		require.NoError(t, err)
+	}
+	want := localContent(t, a, "log")
+	for _, s := range []*FileServer{b, c} {
+		waitFor(t, func() bool { return replicaContent(t, s, a, "log") == want })
+	}
+	// The replicas share their IV, so they are identical byte for byte.
+	mb, err := b.Storage.Metadata(a.ID, crypto.HashKey("log"))
+	require.NoError(t, err)
+	mc, err := c.Storage.Metadata(a.ID, crypto.HashKey("log"))
+	require.NoError(t, err)
+	assert.Equal(t, mb.Checksum, mc.Checksum)
+	assert.Zero(t, a.Metrics()["append_resyncs"])
+}
+
+func TestAppendOffsetMismatchResyncs(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	require.NoError(t, a.Store("log", strings.NewReader("first;")))
+	_, err := a.Append("log", strings.NewReader("second;"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return replicaContent(t, b, a, "log") == "first;second;" })
+
+	// The replica loses its last byte, as if it missed part of an append: the next append no
+	// longer continues it, so b refuses it and a sends the whole object again.
+	hashed := crypto.HashKey("log")
+	meta, err := b.Storage.Metadata(a.ID, hashed)
+	require.NoError(t, err)
+	require.NoError(t, b.Storage.Truncate(a.ID, hashed, meta.Size-1))
+	_, err = a.Append("log", strings.NewReader("third;"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return replicaContent(t, b, a, "log") == "first;second;third;" })
+	assert.Equal(t, int64(1), a.Metrics()["append_resyncs"])
+
+	// The replica sent again takes later appends.
+	_, err = a.Append("log", strings.NewReader("fourth;"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return replicaContent(t, b, a, "log") == "first;second;third;fourth;" })
+	assert.Equal(t, int64(1), a.Metrics()["append_resyncs"])
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// ErrUnauthorized is returned when the Authorizer of a node denied a request of a peer.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Operation is a kind of request a peer makes of a node, which its Authorizer allows or denies.
+type Operation string
+
+const (
+	// OpStore covers storing a replica, whole, inline, batched, appended to or staged by a
+	// transaction.
+	OpStore Operation = "store"
+	// OpGet covers fetching an object, whole, in ranges or batched.
+	OpGet Operation = "get"
+	// OpDelete covers deleting a replica, alone or with its key prefix.
+	OpDelete Operation = "delete"
+	// OpList covers listing the keys a node owns.
+	OpList Operation = "list"
+)
+
+// Effects of an AuthzRule.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// deniedHeader answers a get request the Authorizer denied in place of the object's header. A
+// peer that does not know it takes it for an object it lacks.
+var deniedHeader = objectHeader{Size: -1}
+
+// denied reports whether the header answers a request the peer denied.
+func (h objectHeader) denied() bool {
+	return !h.Found && h.Size == deniedHeader.Size
+}
+
+// PeerInfo describes the peer making a request, as the Authorizer sees it.
+type PeerInfo struct {
+	ID     string            // Node ID the peer announced in its handshake, empty if it announced none
+	Addr   string            // Address of the peer's connection
+	Labels map[string]string // Labels the peer advertised in its handshake
+}
+
+// name returns the node ID of the peer, or its address if it announced none.
+func (p PeerInfo) name() string {
+	if len(p.ID) > 0 {
+		return p.ID
+	}
+	return p.Addr
+}
+
+// Authorizer decides which requests of peers a node serves. It is asked for every replica
+// stored, object fetched, replica deleted and key listing a peer requests.
+//
+// The namespace is the part of the key before its first slash, as the requesting node
+// declares it; it is empty for keys without one and when the requester does not know the
+// key, as for replicas repaired or handed over by nodes other than the owner. The key is the
+// hashed key replicas are held under, or the plain key prefix of a listing or prefix delete,
+// whose namespace is that of the prefix: empty when the prefix has no slash, as it may then
+// span namespaces.
+type Authorizer interface {
+	// Authorize returns nil to serve the request, or an error saying why it is denied.
+	Authorize(peer PeerInfo, op Operation, ns string, key string) error
+}
+
+// DeniedError is returned when a peer denied a request of this node. It matches
+// ErrUnauthorized with errors.Is.
+type DeniedError struct {
+	Peer   string // Address of the peer
+	Reason string // Why the peer denied the request
+}
+
+// Error names the peer and its reason.
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("denied by (%s): %s", e.Peer, e.Reason)
+}
+
+// Is reports whether target is ErrUnauthorized.
+func (e *DeniedError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// AuthzRule allows or denies the requests it matches: those of peers advertising all its
+// labels, for keys of one of its namespaces, of one of its operations. A rule leaving any of
+// them out matches every peer, namespace or operation.
+type AuthzRule struct {
+	Effect     string            `json:"effect"`               // EffectAllow or EffectDeny
+	Labels     map[string]string `json:"labels,omitempty"`     // Labels the peer must advertise with these values
+	Namespaces []string          `json:"namespaces,omitempty"` // Namespaces covered, "" for keys outside any
+	Ops        []Operation       `json:"ops,omitempty"`        // Operations covered
+}
+
+// matches reports whether the rule covers a request.
+func (r AuthzRule) matches(peer PeerInfo, op Operation, ns string) bool {
+	for label, value := range r.Labels {
+		if v, ok := peer.Labels[label]; !ok || v != value {
+			return false
+		}
+	}
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, ns) {
+		return false
+	}
+	return len(r.Ops) == 0 || slices.Contains(r.Ops, op)
+}
+
+// RuleAuthorizer is an Authorizer deciding each request with the first of its rules that
+// matches it, or with its default effect if none does.
+type RuleAuthorizer struct {
+	Rules   []AuthzRule `json:"rules"`             // Rules in the order they are tried
+	Default string      `json:"default,omitempty"` // Effect when no rule matches, EffectAllow when empty
+}
+
+// Authorize allows or denies a request as the first matching rule says.
+func (a *RuleAuthorizer) Authorize(peer PeerInfo, op Operation, ns string, key string) error {
+	for i, r := range a.Rules {
+		if !r.matches(peer, op, ns) {
+			continue
+		}
+		if r.Effect == EffectAllow {
+			return nil
+		}
+		return fmt.Errorf("rule %d denies %s in namespace %q to (%s): %w", i, op, ns, peer.name(), ErrUnauthorized)
+	}
+	if a.Default == EffectDeny {
+		return fmt.Errorf("no rule allows %s in namespace %q to (%s): %w", op, ns, peer.name(), ErrUnauthorized)
+	}
+	return nil
+}
+
+// validate reports rules with an unknown effect or operation.
+func (a *RuleAuthorizer) validate() error {
+	if a.Default != "" && a.Default != EffectAllow && a.Default != EffectDeny {
+		return fmt.Errorf("default effect %q is neither %s nor %s", a.Default, EffectAllow, EffectDeny)
+	}
+	for i, r := range a.Rules {
+		if r.Effect != EffectAllow && r.Effect != EffectDeny {
+			return fmt.Errorf("rule %d: effect %q is neither %s nor %s", i, r.Effect, EffectAllow, EffectDeny)
+		}
+		for _, op := range r.Ops {
+			switch op {
+			case OpStore, OpGet, OpDelete, OpList:
+			default:
+				return fmt.Errorf("rule %d: unknown operation %q", i, op)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadAuthorizer reads the rules of a RuleAuthorizer from a JSON file, such as
+// {"rules": [{"effect": "deny", "labels": {"role": "edge"}, "namespaces": ["prod"], "ops": ["store", "delete"]}]}.
+//
+// Returns: The authorizer, or an error if the file cannot be read or a rule is invalid.
+func LoadAuthorizer(path string) (*RuleAuthorizer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a RuleAuthorizer
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("reading authorization rules %s: %w", path, err)
+	}
+	if err := a.validate(); err != nil {
+		return nil, fmt.Errorf("authorization rules %s: %w", path, err)
+	}
+	return &a, nil
+}
+
+// keyNamespace returns the namespace a key is declared in to the peers it is sent to: the
+// part before its first slash, or "" if it has none.
+func keyNamespace(key string) string {
+	ns, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return ns
+}
+
+// authorize asks the Authorizer whether the peer at from may run op on a key of owner's,
+// recording a denial in the audit log under span, the request the peer sent it for. Without an
+// Authorizer every request is allowed.
+//
+// Returns: nil if the request is allowed, or an error wrapping ErrUnauthorized.
+func (s *FileServer) authorize(from string, span string, op Operation, owner string, ns string, key string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	info := PeerInfo{Addr: from}
+	if peer, ok := s.peer(from); ok {
+		hello := peer.Hello()
+		info.ID, info.Labels = hello.NodeID, hello.Labels
+	}
+	err := s.Authorizer.Authorize(info, op, ns, key)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrUnauthorized) {
+		err = fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+	s.metrics.requestsDenied.Add(1)
+	s.logf(span, "denied %s of (%s) to (%s): %s", op, key, from, err)
+	if aerr := s.audit(auditEntry{Op: "deny", Request: op, Owner: owner, Namespace: ns, Key: key, Peer: info.name(), RequestID: span}); aerr != nil {
+		s.logf(span, "recording denial in the audit log: %s", aerr)
+	}
+	return fmt.Errorf("%s of (%s): %w", op, key, err)
+}
+
+// sendRefusal answers a MessageGetFile the Authorizer denied, or that was refused as busy,
+// with header in the form of an answer for an object the peer lacks.
+func (s *FileServer) sendRefusal(peer p2p.Node, q query, header objectHeader) error {
+	buf := new(bytes.Buffer)
+	if s.capsOf(peer).repair {
+		if err := binary.Write(buf, binary.LittleEndian, objectStamp{}); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(buf, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	return s.sendAnswer(peer, q, buf.Bytes())
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// edgeRules lets nodes labelled role=edge fetch from the prod namespace but not write to it.
+var edgeRules = &RuleAuthorizer{Rules: []AuthzRule{
+	{Effect: EffectAllow, Labels: map[string]string{"role": "edge"}, Namespaces: []string{"prod"}, Ops: []Operation{OpGet}},
+	{Effect: EffectDeny, Labels: map[string]string{"role": "edge"}, Namespaces: []string{"prod"}},
+}}
+
+// TestEdgeMayGetButNotStoreProd runs a node authorizing its peers with edgeRules. The edge
+// node's replica of a prod key is refused over the wire and the denial audited, while its
+// other keys are stored as before and its prod objects are served back to it.
+func TestEdgeMayGetButNotStoreProd(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.Authorizer = edgeRules
+	edge := makeMemoryServer(t, network, ":4001", ":4000")
+	edge.Labels = map[string]string{"role": "edge"}
+	startCluster(t, a, edge)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	require.NoError(t, edge.Store("prod/report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return edge.Metrics()["replicas_denied"] == 1 })
+	assert.Zero(t, replicaCount(edge, "prod/report", a))
+	assert.Equal(t, int64(1), a.Metrics()["requests_denied"])
+	audit, err := os.ReadFile(filepath.Join(a.Storage.Root, auditLogFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(audit), `"op":"deny"`)
+	assert.Contains(t, string(audit), `"peer":"`+edge.ID+`"`)
+	assert.Contains(t, string(audit), `"request":"store","namespace":"prod"`)
+
+	require.NoError(t, edge.Store("scratch/notes", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(edge, "scratch/notes", a) == 1 })
+
+	// A replica the node took before the rules applied is still served to the edge node.
+	rep, err := edge.prepareReplica("prod/report", bytes.NewReader([]byte("draft")))
+	require.NoError(t, err)
+	_, err = a.Storage.Write(edge.ID, rep.key, bytes.NewReader(rep.data))
+	require.NoError(t, err)
+	require.NoError(t, edge.Storage.Delete(edge.ID, "prod/report"))
+	requireGet(t, edge, "prod/report", []byte("draft"))
+	assert.Equal(t, int64(1), a.Metrics()["requests_denied"])
+}
+
+func TestDeniedGetAndListAreReported(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.Authorizer = &RuleAuthorizer{Rules: []AuthzRule{{Effect: EffectDeny, Ops: []Operation{OpGet, OpList}}}}
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	require.NoError(t, b.Store("report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(b, "report", a) == 1 })
+	require.NoError(t, b.Storage.Delete(b.ID, "report"))
+	_, err := b.Get("report")
+	var ferr *FetchError
+	require.ErrorAs(t, err, &ferr)
+	require.Len(t, ferr.Peers, 1)
+	assert.Equal(t, OutcomeDenied, ferr.Peers[0].Outcome)
+	assert.ErrorIs(t, err, ErrUnavailable, "a denial does not say the object is missing")
+
+	var listErr error
+	for _, err := range b.ListNetwork("") {
+		if err != nil {
+			listErr = err
+		}
+	}
+	assert.ErrorIs(t, listErr, ErrUnauthorized)
+}
+
+func TestLoadAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authz.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [
+		{"effect": "allow", "labels": {"role": "edge"}, "namespaces": ["prod"], "ops": ["get"]},
+		{"effect": "deny", "labels": {"role": "edge"}, "namespaces": ["prod"]}
+	]}`), 0o644))
+	a, err := LoadAuthorizer(path)
+	require.NoError(t, err)
+	assert.Equal(t, edgeRules, a)
+
+	edge := PeerInfo{ID: "edge-1", Labels: map[string]string{"role": "edge", "zone": "eu-1"}}
+	assert.NoError(t, a.Authorize(edge, OpGet, "prod", "key"))
+	assert.ErrorIs(t, a.Authorize(edge, OpStore, "prod", "key"), ErrUnauthorized)
+	assert.NoError(t, a.Authorize(edge, OpStore, "scratch", "key"))
+	assert.NoError(t, a.Authorize(PeerInfo{ID: "core-1"}, OpStore, "prod", "key"))
+
+	for _, bad := range []string{`{"rules": [{"effect": "maybe"}]}`, `{"rules": [{"effect": "deny", "ops": ["stat"]}]}`, `{"default": "never"}`} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0o644))
+		_, err := LoadAuthorizer(path)
+		assert.Error(t, err, bad)
+	}
+	require.NoError(t, os.WriteFile(path, []byte(`{"default": "deny"}`), 0o644))
+	a, err = LoadAuthorizer(path)
+	require.NoError(t, err)
+	err = a.Authorize(edge, OpList, "", "")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.Contains(t, err.Error(), "edge-1")
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// banFileName is the file in the storage root holding the bans that outlive a restart.
+const banFileName = ".dfs-bans.json"
+
+// ErrPeerNotFound is returned by DropPeer when no connected peer has the given node ID or
+// address and no ban was asked for.
+var ErrPeerNotFound = errors.New("peer not found")
+
+// ban is a node ID or IP address whose connections are refused until a deadline.
+type ban struct {
+	NodeID  string    `json:"node_id,omitempty"` // Banned node, empty when the ban is by IP
+	IP      string    `json:"ip,omitempty"`      // Banned IP address, empty when the ban is by node ID
+	Until   time.Time `json:"until"`             // When the ban runs out
+	persist bool      // Whether the ban is saved to outlive a restart
+}
+
+// banTable is the peers banned with DropPeer, by node ID once it is known and by IP address
+// otherwise, so a banned node redialing from another port is still refused. Only the bans
+// asked to persist are saved, after every change to them.
+type banTable struct {
+	mu   sync.Mutex
+	path string         // Location of the persisted bans, empty until load is called
+	ids  map[string]ban // Bans by node ID
+	ips  map[string]ban // Bans by IP address
+}
+
+// newBanTable returns an empty table that is not persisted until load is called.
+func newBanTable() *banTable {
+	return &banTable{ids: make(map[string]ban), ips: make(map[string]ban)}
+}
+
+// load attaches the table to path, restoring the bans saved there that have not run out by now.
+func (t *banTable) load(path string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	var saved []ban
+	if err := loadJSON(path, "bans", &saved); err != nil {
+		return err
+	}
+	for _, b := range saved {
+		if !b.Until.After(now) {
+			continue
+		}
+		b.persist = true
+		if len(b.NodeID) > 0 {
+			t.ids[b.NodeID] = b
+		} else if len(b.IP) > 0 {
+			t.ips[b.IP] = b
+		}
+	}
+	return nil
+}
+
+// add records a ban, by node ID when id is set and by IP address otherwise.
+func (t *banTable) add(b ban) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(b.NodeID) > 0 {
+		t.ids[b.NodeID] = b
+	} else {
+		t.ips[b.IP] = b
+	}
+	if b.persist {
+		t.saveLocked()
+	}
+}
+
+// banned reports whether the node with the given ID, or the given IP address, is banned at
+// now; an empty id or ip is not looked up. Bans that ran out are forgotten.
+//
+// Returns: When the ban runs out, and whether there is one.
+func (t *banTable) banned(id string, ip string, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until := t.untilLocked(t.ids, id, now)
+	if byIP := t.untilLocked(t.ips, ip, now); byIP.After(until) {
+		until = byIP
+	}
+	return until, !until.IsZero()
+}
+
+// untilLocked returns when the ban under key in m runs out, or the zero time if there is none
+// at now, forgetting it if it ran out; the caller must hold mu.
+func (t *banTable) untilLocked(m map[string]ban, key string, now time.Time) time.Time {
+	b, ok := m[key]
+	if !ok || len(key) == 0 {
+		return time.Time{}
+	}
+	if !b.Until.After(now) {
+		delete(m, key)
+		if b.persist {
+			t.saveLocked()
+		}
+		return time.Time{}
+	}
+	return b.Until
+}
+
+// saveLocked saves the bans asked to persist; the caller must hold mu.
+func (t *banTable) saveLocked() {
+	if len(t.path) == 0 {
+		return
+	}
+	saved := make([]ban, 0)
+	for _, m := range []map[string]ban{t.ids, t.ips} {
+		for _, b := range m {
+			if b.persist {
+				saved = append(saved, b)
+			}
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		if saved[i].NodeID != saved[j].NodeID {
+			return saved[i].NodeID < saved[j].NodeID
+		}
+		return saved[i].IP < saved[j].IP
+	})
+	if err := saveJSON(t.path, saved, 0o644); err != nil {
+		log.Printf("persisting bans to %s: %s", t.path, err)
+	}
+}
+
+// loadBans attaches the ban table to its file in the storage root.
+func (s *FileServer) loadBans() error {
+	return s.bans.load(filepath.Join(s.Storage.Root, banFileName), s.Clock.Now())
+}
+
+// DropPeer closes the connection to a misbehaving peer and refuses its connections for ban:
+// neither its redials nor this node's are let through, and fetches do not dial it on demand.
+// The ban is by node ID once the node is known, so it holds when the node redials from
+// another port, and by IP address otherwise. Bans are held in memory only; DropPeerPersist
+// keeps them across restarts. Every drop is recorded in the audit log in the storage root
+// first, and a drop that cannot be recorded is not made.
+//
+// Parameters:
+//   - idOrAddr: Node ID of the peer, the address it is connected from, its bootstrap address,
+//     or an IP address to ban.
+//   - ban: How long the peer's connections are refused; zero or negative only drops it.
+//
+// Returns: An error wrapping ErrPeerNotFound if no such peer is connected and ban is not
+// positive, or any error recording the drop.
+func (s *FileServer) DropPeer(idOrAddr string, ban time.Duration) error {
+	return s.dropPeer(idOrAddr, ban, false)
+}
+
+// DropPeerPersist drops a peer like DropPeer, saving the ban in the storage root so that it
+// outlives a restart of the node.
+func (s *FileServer) DropPeerPersist(idOrAddr string, ban time.Duration) error {
+	return s.dropPeer(idOrAddr, ban, true)
+}
+
+// dropPeer drops a peer for DropPeer, persisting the ban if persist is set.
+func (s *FileServer) dropPeer(idOrAddr string, d time.Duration, persist bool) error {
+	peer, connected := s.findPeer(idOrAddr)
+	if !connected && d <= 0 {
+		return fmt.Errorf("dropping (%s): %w", idOrAddr, ErrPeerNotFound)
+	}
+	entry := auditEntry{Op: "drop-peer", Owner: s.ID, Peer: idOrAddr}
+	b := s.banFor(idOrAddr, peer)
+	if d > 0 {
+		b.Until = s.Clock.Now().Add(d)
+		b.persist = persist
+		entry.BannedUntil = &b.Until
+	}
+	if err := s.audit(entry); err != nil {
+		return fmt.Errorf("dropping (%s): %w", idOrAddr, err)
+	}
+	if d > 0 {
+		s.bans.add(b)
+		log.Printf("[%s] banned peer (%s) until %s", s.Transport.Addr(), idOrAddr, b.Until.Format(time.RFC3339))
+	}
+	if !connected {
+		return nil
+	}
+	addr := peer.RemoteAddr().String()
+	s.peerLock.Lock()
+	if s.peers[addr] == peer {
+		delete(s.peers, addr)
+		delete(s.leaving, addr)
+		delete(s.fetchOnly, addr)
+	}
+	s.peerLock.Unlock()
+	log.Printf("[%s] dropping peer (%s)", s.Transport.Addr(), addr)
+	return peer.Close()
+}
+
+// findPeer returns the connected peer with the given node ID, remote address or bootstrap
+// address.
+func (s *FileServer) findPeer(idOrAddr string) (p2p.Node, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if peer, ok := s.peers[idOrAddr]; ok {
+		return peer, true
+	}
+	if peer, ok := s.bootstrapPeers[idOrAddr]; ok {
+		return peer, true
+	}
+	for _, peer := range s.peers {
+		if id := peer.Hello().NodeID; len(id) > 0 && id == idOrAddr {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+// banFor returns the ban of a peer, by node ID when it is known from its handshake or as a
+// bootstrap node, and by IP address when idOrAddr is an address of an unknown node.
+func (s *FileServer) banFor(idOrAddr string, peer p2p.Node) ban {
+	if peer != nil {
+		if id := peer.Hello().NodeID; len(id) > 0 {
+			return ban{NodeID: id}
+		}
+		return ban{IP: hostOf(peer.RemoteAddr().String())}
+	}
+	s.peerLock.Lock()
+	id, ok := s.bootstrapIDs[idOrAddr]
+	s.peerLock.Unlock()
+	if ok {
+		return ban{NodeID: id}
+	}
+	if ip := net.ParseIP(hostOf(idOrAddr)); ip != nil {
+		return ban{IP: ip.String()}
+	}
+	return ban{NodeID: idOrAddr}
+}
+
+// peerBanned reports whether a peer that completed the handshake is banned.
+func (s *FileServer) peerBanned(p p2p.Node) (time.Time, bool) {
+	return s.bans.banned(p.Hello().NodeID, hostOf(p.RemoteAddr().String()), s.Clock.Now())
+}
+
+// dialBanned reports whether the bootstrap node at addr is banned, by the node ID it had when
+// last connected or by the IP address it is dialed at.
+func (s *FileServer) dialBanned(addr string) (time.Time, bool) {
+	s.peerLock.Lock()
+	id := s.bootstrapIDs[addr]
+	s.peerLock.Unlock()
+	return s.bans.banned(id, hostOf(addr), s.Clock.Now())
+}
+
+// hostOf returns the host of an address, or the address itself when it has no port.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropPeerBansUntilExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	b.Clock = clk
+	startCluster(t, a, b)
+
+	require.NoError(t, b.DropPeer(a.ID, time.Minute))
+	waitFor(t, func() bool { return !hasPeers(a) && !hasPeers(b) })
+	audit, err := os.ReadFile(filepath.Join(b.Storage.Root, auditLogFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(audit), `"op":"drop-peer"`)
+
+	// The dropped node redialing from a new port is refused by its node ID.
+	require.NoError(t, a.Transport.Dial(":4001"))
+	assert.Never(t, func() bool { return hasPeers(b) }, 200*time.Millisecond, 10*time.Millisecond)
+
+	// Once the ban runs out, b redials its bootstrap node and is let through.
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	waitFor(t, func() bool { return hasPeers(a) && hasPeers(b) })
+}
+
+func TestBanTablePersistsOnlyAskedBans(t *testing.T) {
+	now := time.Unix(0, 0)
+	path := filepath.Join(t.TempDir(), banFileName)
+	bans := newBanTable()
+	require.NoError(t, bans.load(path, now))
+	bans.add(ban{NodeID: "kept", Until: now.Add(time.Hour), persist: true})
+	bans.add(ban{IP: "10.0.0.1", Until: now.Add(time.Hour)})
+	_, ok := bans.banned("", "10.0.0.1", now)
+	assert.True(t, ok)
+
+	restarted := newBanTable()
+	require.NoError(t, restarted.load(path, now))
+	until, ok := restarted.banned("kept", "", now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour), until.In(now.Location()))
+	_, ok = restarted.banned("", "10.0.0.1", now)
+	assert.False(t, ok, "a ban not asked to persist outlived the restart")
+	_, ok = restarted.banned("kept", "", now.Add(time.Hour))
+	assert.False(t, ok, "a ban outlived its deadline")
+}
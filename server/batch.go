@@ -0,0 +1,536 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// defaultBatchInFlight bounds the number of objects per batch frame when BatchInFlight is not set.
+const defaultBatchInFlight = 64
+
+// StoreItem is a single object passed to StoreBatch.
+type StoreItem struct {
+	Key  string    // Key to store the object under
+	Data io.Reader // Content of the object
+}
+
+// StoreResult reports the outcome of storing one StoreItem.
+type StoreResult struct {
+	Key      string           // Key of the item
+	Size     int64            // Number of plaintext bytes written locally
+	Err      error            // Local failure; when set the item was not stored or replicated
+	PeerErrs map[string]error // Peers the item could not be replicated to, keyed by address
+}
+
+// GetResult reports the outcome of fetching one key with GetBatch.
+type GetResult struct {
+	Key  string     // Requested key
+	Info ObjectInfo // Description of the object when Err is nil
+	Data []byte     // Content of the object when Err is nil
+	Err  error      // Why the object could not be fetched
+}
+
+// BatchEntry declares one object inside a batch stream.
+type BatchEntry struct {
+	Key       string // Hashed key of the object
+	Size      int64  // Number of stream bytes belonging to the object
+	Checksum  string // Hex-encoded SHA-256 of those bytes
+	Namespace string // Namespace of the key, empty if it has none
+}
+
+// MessageStoreBatch announces a stream carrying several encrypted objects back to back.
+type MessageStoreBatch struct {
+	ID      string       // Identifier of the node owning the objects
+	Entries []BatchEntry // Objects in stream order
+}
+
+// MessageGetBatch requests several objects in a single stream response.
+type MessageGetBatch struct {
+	ID         string   // Identifier of the node owning the objects
+	Keys       []string // Hashed keys to retrieve
+	RequestID  uint64   // Identifier a MessageCancel names the request by, zero if it cannot be cancelled
+	Namespaces []string // Namespace of each key, in the same order; empty if the keys have none
+}
+
+// batchInFlight returns the maximum number of objects sent in one batch frame.
+func (s *FileServer) batchInFlight() int {
+	if s.BatchInFlight > 0 {
+		return s.BatchInFlight
+	}
+	return defaultBatchInFlight
+}
+
+// StoreBatch stores several objects locally and replicates them to every peer, sending at most
+// BatchInFlight objects per control message and stream. Failures are reported per item in the
+// returned results without aborting the rest of the batch; the error is reserved for failures
+// affecting the batch as a whole.
+func (s *FileServer) StoreBatch(items []StoreItem) ([]StoreResult, error) {
+	results := make([]StoreResult, len(items))
+	limit := s.batchInFlight()
+	// Every frame goes to the peers connected when the batch started, so a peer dropping
+	// part-way through is reported for the items it missed.
+	peers := replicaPeers(s.peerList())
+	for start := 0; start < len(items); start += limit {
+		end := min(start+limit, len(items))
+		if err := s.storeBatchFrame(peers, items[start:end], results[start:end]); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// storeBatchFrame writes items locally and replicates them in one control message and stream.
+// Peers that do not support batches are sent the replicas one at a time instead. Bootstrap
+// nodes that are offline or fail to receive the frame are queued to catch up later.
+func (s *FileServer) storeBatchFrame(peers []p2p.Node, items []StoreItem, results []StoreResult) error {
+	var (
+		entries  []BatchEntry
+		replicas []replica
+		indexes  []int
+	)
+	for i, item := range items {
+		results[i].Key = item.Key
+		if err := checkKey(item.Key); err != nil {
+			results[i].Err = err
+			continue
+		}
+		content, err := io.ReadAll(item.Data)
+		if err == nil {
+			var held bool
+			if held, err = s.checkWritable(item.Key, bytes.NewReader(content)); held {
+				results[i].Size = int64(len(content))
+				continue
+			}
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		n, err := s.Storage.Write(s.ID, item.Key, bytes.NewReader(content))
+		if noSpace(err) {
+			s.diskFull(err)
+			err = fmt.Errorf("storing (%s): %w", item.Key, errors.Join(ErrNoSpace, err))
+		}
+		if err == nil {
+			err = s.recordContentType(item.Key, "", content)
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Size = n
+		s.objectStored(objectRef{owner: s.ID, key: crypto.HashKey(item.Key)})
+		s.publish(NotifyStore, item.Key)
+
+		rep, err := s.prepareReplica(item.Key, bytes.NewReader(content))
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if placed := s.placement(item.Key, peers); len(placed) < len(peers) {
+			// Pinned objects skip the frame, which goes to every peer.
+			s.storePinned(placed, rep, &results[i])
+			continue
+		}
+		entries = append(entries, BatchEntry{
+			Key:       rep.key,
+			Size:      int64(len(rep.data)),
+			Checksum:  rep.checksum,
+			Namespace: rep.namespace,
+		})
+		replicas = append(replicas, rep)
+		indexes = append(indexes, i)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	peers, legacy := s.peersWith(peers, func(c peerCaps) bool { return c.batch })
+	for _, peer := range legacy {
+		s.storeBatchSingly(peer, replicas, indexes, results)
+	}
+
+	msg := Message{Payload: MessageStoreBatch{ID: s.ID, Entries: entries}}
+	frames := make(map[bool][]byte, 2) // Frame of the message by whether it is typed
+	for _, typed := range []bool{false, true} {
+		frame, err := frameMessage(&msg, typed)
+		if err != nil {
+			return err
+		}
+		frames[typed] = frame
+	}
+	keys := make([]string, len(indexes))
+	for j, i := range indexes {
+		keys[j] = items[i].Key
+	}
+	s.deferReplication(keys...)
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		s.flushOutbox(peer)
+		err := peer.Send(frames[s.capsOf(peer).typed])
+		var stream io.WriteCloser
+		if err == nil {
+			stream, err = s.openStream(peer)
+		}
+		for _, rep := range replicas {
+			if err != nil {
+				break
+			}
+			_, err = stream.Write(rep.data)
+		}
+		if stream != nil {
+			err = errors.Join(err, stream.Close())
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("[%s] batch replication to (%s) failed: %s", s.Transport.Addr(), addr, err)
+		if baddr, ok := s.bootstrapAddr(addr); ok {
+			s.pending.add(baddr, keys...)
+		}
+		for _, i := range indexes {
+			addPeerErr(&results[i], addr, err)
+		}
+	}
+	fmt.Printf("[%s] replicated batch of %d objects\n", s.Transport.Addr(), len(entries))
+	return nil
+}
+
+// storePinned replicates an object of a batch to the nodes it is pinned to, queueing it for
+// those of them that are offline bootstrap nodes or fail to receive it.
+func (s *FileServer) storePinned(peers []p2p.Node, rep replica, result *StoreResult) {
+	s.deferReplication(result.Key)
+	_, err := s.replicate(peers, rep)
+	var berr *BroadcastError
+	if !errors.As(err, &berr) {
+		return
+	}
+	s.deferFailed(err, peers, result.Key)
+	for addr, err := range berr.failed {
+		addPeerErr(result, addr, err)
+	}
+}
+
+// storeBatchSingly replicates the objects of a batch frame to a peer that does not support
+// batches, one message and stream each. Objects that fail are queued for the peer if it is a
+// bootstrap node.
+func (s *FileServer) storeBatchSingly(peer p2p.Node, replicas []replica, indexes []int, results []StoreResult) {
+	addr := peer.RemoteAddr().String()
+	for j, rep := range replicas {
+		if _, err := s.replicate([]p2p.Node{peer}, rep); err != nil {
+			var berr *BroadcastError
+			if errors.As(err, &berr) {
+				err = berr.failed[addr]
+			}
+			log.Printf("[%s] replication of (%s) to (%s) failed: %s", s.Transport.Addr(), rep.key, addr, err)
+			if baddr, ok := s.bootstrapAddr(addr); ok {
+				s.pending.add(baddr, results[indexes[j]].Key)
+			}
+			addPeerErr(&results[indexes[j]], addr, err)
+		}
+	}
+}
+
+// addPeerErr records that an item could not be replicated to the peer at addr.
+func addPeerErr(result *StoreResult, addr string, err error) {
+	if result.PeerErrs == nil {
+		result.PeerErrs = make(map[string]error)
+	}
+	result.PeerErrs[addr] = err
+}
+
+// GetBatch retrieves several objects, serving local copies directly and requesting the rest
+// from peers at most BatchInFlight keys at a time. Failures are reported per key in the
+// returned results; the error is reserved for failures affecting the batch as a whole.
+func (s *FileServer) GetBatch(keys []string) ([]GetResult, error) {
+	results := make([]GetResult, len(keys))
+	var missing []int
+	for i, key := range keys {
+		results[i].Key = key
+		if err := checkKey(key); err != nil {
+			results[i].Err = err
+			continue
+		}
+		ok, err := s.Storage.Has(s.ID, key)
+		if err != nil {
+			log.Printf("[%s] could not check local disk for (%s), trying peers: %s", s.Transport.Addr(), key, err)
+		}
+		if ok {
+			info, r, err := s.readLocal("", key)
+			if err == nil {
+				results[i].Info = info
+				results[i].Data, results[i].Err = readAllAndClose(r)
+				continue
+			}
+			if !errors.Is(err, storage.ErrContentCorrupted) {
+				results[i].Err = err
+				continue
+			}
+			s.reportCorruption(key, err)
+		}
+		if s.negCache.has(negativeKey(s.ID, crypto.HashKey(key))) {
+			s.metrics.negativeCacheHits.Add(1)
+			results[i].Err = fmt.Errorf("%w: %s (cached miss)", ErrKeyNotFound, key)
+			continue
+		}
+		missing = append(missing, i)
+	}
+
+	limit := s.batchInFlight()
+	for start := 0; start < len(missing); start += limit {
+		end := min(start+limit, len(missing))
+		if err := s.getBatchFrame(keys, missing[start:end], results); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// getBatchFrame requests the keys at the given indexes from every peer in a single message and
+// stores whichever copies arrive first. Peers that do not support batches are not sent the
+// message; keys the others do not hold are then fetched one at a time.
+func (s *FileServer) getBatchFrame(keys []string, indexes []int, results []GetResult) error {
+	hashed := make([]string, len(indexes))
+	namespaces := make([]string, len(indexes))
+	for j, i := range indexes {
+		hashed[j] = crypto.HashKey(keys[i])
+		namespaces[j] = keyNamespace(keys[i])
+	}
+	requestID := s.nextRequestID()
+	msg := Message{Payload: MessageGetBatch{ID: s.ID, Keys: hashed, RequestID: requestID, Namespaces: namespaces}, ReplyID: requestID}
+	timedOut := func() {
+		for _, i := range indexes {
+			results[i].Err = fmt.Errorf("%w waiting for file %s from the network", ErrTimeout, keys[i])
+		}
+	}
+	// The timeout runs from the start, so a fetch waiting for its turn to ask peers that
+	// answer by order gives up like one waiting for their answers.
+	timer := s.Clock.NewTimer(2 * time.Second)
+	defer timer.Stop()
+	batchPeers, legacy := s.peersWith(s.peerList(), func(c peerCaps) bool { return c.batch })
+	// Peers that cannot route answers to requests by ID answer in the order they were asked,
+	// so no other fetch may ask them until every one asked has answered or been given up.
+	_, ordered := s.peersWith(batchPeers, func(c peerCaps) bool { return c.replies })
+	if len(ordered) > 0 {
+		select {
+		case s.fetchTurn <- struct{}{}:
+		case <-timer.C():
+			timedOut()
+			return nil
+		}
+	}
+	release := func() {
+		if len(ordered) > 0 {
+			<-s.fetchTurn
+		}
+	}
+	peers, err := s.sendMessage(batchPeers, &msg)
+	askedAll := err == nil && len(legacy) == 0
+	var berr *BroadcastError
+	if err != nil && !errors.As(err, &berr) {
+		release()
+		return err
+	}
+	if berr != nil {
+		log.Printf("[%s] batch fetch: %s", s.Transport.Addr(), berr)
+	}
+
+	abandoned := make(chan struct{})
+	done := make(chan map[int]error, 1)
+	go func() {
+		defer release()
+		received := make(map[int]error, len(indexes))
+		allAnswered := askedAll
+		for _, peer := range peers {
+			if err := s.readBatchResponse(peer, requestID, abandoned, keys, indexes, received); err != nil {
+				log.Printf("[%s] batch response from (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+				allAnswered = false
+			}
+		}
+		for _, i := range indexes {
+			if _, ok := received[i]; !ok {
+				if allAnswered {
+					s.negCache.add(negativeKey(s.ID, crypto.HashKey(keys[i])))
+				}
+				received[i] = fmt.Errorf("%w: file %s not found on any peers", ErrKeyNotFound, keys[i])
+			}
+		}
+		done <- received
+	}()
+
+	select {
+	case received := <-done:
+		for _, i := range indexes {
+			if err := received[i]; err != nil && (len(legacy) == 0 || !errors.Is(err, ErrKeyNotFound)) {
+				results[i].Err = err
+				continue
+			}
+			var (
+				info ObjectInfo
+				r    io.ReadCloser
+				err  error
+			)
+			if received[i] != nil {
+				info, r, err = s.GetWithInfo(keys[i])
+			} else {
+				info, r, err = s.readLocal("", keys[i])
+			}
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].Info = info
+			results[i].Data, results[i].Err = readAllAndClose(r)
+		}
+	case <-timer.C():
+		close(abandoned)
+		go s.cancelRequest(peers, requestID)
+		timedOut()
+	}
+	return nil
+}
+
+// readBatchResponse consumes one peer's answer to the MessageGetBatch sent with id, writing
+// every object that has not already been received into local storage. The whole response is
+// read even for objects already obtained from another peer so the connection stays in sync. A
+// response the peer truncated because the request was cancelled ends with errStreamTruncated,
+// and one not in by the time abandoned is closed with errAnswerAbandoned.
+func (s *FileServer) readBatchResponse(peer p2p.Node, id uint64, abandoned <-chan struct{}, keys []string, indexes []int, received map[int]error) error {
+	stream := s.awaitAnswer(peer, id, abandoned)
+	if stream == nil {
+		return errAnswerAbandoned
+	}
+	defer stream.Close()
+	for _, i := range indexes {
+		var header objectHeader
+		if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+			return err
+		}
+		if !header.Found {
+			continue
+		}
+		cr := streamReader(stream, header.Size, s.capsOf(peer).chunked)
+		if err, ok := received[i]; ok && err == nil {
+			if _, err := io.Copy(io.Discard, cr); err != nil {
+				return err
+			}
+			continue
+		}
+		sum := sha256.New()
+		_, err := s.Storage.WriteDecrypt(s.dataCipher(keys[i]), s.ID, keys[i], io.TeeReader(cr, sum))
+		if _, derr := io.Copy(io.Discard, cr); derr != nil {
+			return errors.Join(derr, s.Storage.Delete(s.ID, keys[i]))
+		}
+		if err == nil {
+			if err = header.verify(sum); err != nil {
+				err = errors.Join(err, s.Storage.Delete(s.ID, keys[i]))
+			}
+		}
+		received[i] = err
+	}
+	return nil
+}
+
+// handleMessageStoreBatch stores every object of an incoming batch stream, discarding objects
+// whose bytes do not match their declared checksum.
+func (s *FileServer) handleMessageStoreBatch(from string, msg MessageStoreBatch) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	stream := peer.AcceptStream()
+	defer stream.Close()
+	var errs []error
+	for _, e := range msg.Entries {
+		lr := &io.LimitedReader{R: stream, N: e.Size}
+		err := s.admitReplica(from, "", msg.ID, e.Namespace, e.Key, e.Size)
+		held := false
+		if err == nil {
+			held, err = s.admitOverwrite(from, msg.ID, e.Key, e.Checksum)
+		}
+		if held {
+			// The immutable copy held is this one; its bytes are skipped.
+			if _, err := io.Copy(io.Discard, lr); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			continue
+		}
+		if err == nil {
+			_, err = s.Storage.Write(msg.ID, e.Key, lr)
+			if err == nil {
+				s.diskWritable()
+			}
+			err = s.refuseIfFull(from, msg.ID, e.Key, err, true)
+		}
+		if lr.N > 0 {
+			// Keep the stream aligned with the next entry even if the write failed.
+			if _, derr := io.Copy(io.Discard, lr); derr != nil {
+				return errors.Join(append(errs, err, derr)...)
+			}
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err == nil {
+			err = s.checkReplica(msg.ID, e.Key, e.Checksum)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("batch entry (%s): %w", e.Key, err))
+			continue
+		}
+		s.objectStored(objectRef{owner: msg.ID, key: e.Key})
+	}
+	fmt.Printf("[%s] stored batch of %d objects\n", s.Transport.Addr(), len(msg.Entries)-len(errs))
+	return errors.Join(errs...)
+}
+
+// handleMessageGetBatch answers a MessageGetBatch with a single stream holding, for every
+// requested key, an objectHeader followed by its stored bytes. The stream ends early, after a
+// truncated object, if the request is cancelled.
+func (s *FileServer) handleMessageGetBatch(from string, q query, msg MessageGetBatch) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	cancelled := s.serving.begin(from, msg.RequestID)
+	defer s.serving.end(from, msg.RequestID)
+	stream, err := s.openAnswer(peer, q)
+	if err != nil {
+		return err
+	}
+	var denials []error
+	for i, key := range msg.Keys {
+		var ns string
+		if i < len(msg.Namespaces) {
+			ns = msg.Namespaces[i]
+		}
+		if err := s.authorize(from, "", OpGet, msg.ID, ns, key); err != nil {
+			denials = append(denials, err)
+			if err := binary.Write(stream, binary.LittleEndian, deniedHeader); err != nil {
+				return errors.Join(append(denials, stream.Close())...)
+			}
+			continue
+		}
+		if err := s.sendObject("", peer, stream, msg.ID, key, cancelled); err != nil {
+			return ignoreCancelled(errors.Join(err, stream.Close()))
+		}
+	}
+	return errors.Join(append(denials, stream.Close())...)
+}
+
+// readAllAndClose reads r to the end and closes it.
+func readAllAndClose(r io.ReadCloser) ([]byte, error) {
+	b, err := io.ReadAll(r)
+	return b, errors.Join(err, r.Close())
+}
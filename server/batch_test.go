@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchItems returns n items of the given size with distinct keys and contents.
+func batchItems(n int, size int) []StoreItem {
+	items := make([]StoreItem, n)
+	for i := range items {
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		items[i] = StoreItem{Key: fmt.Sprintf("batch_%d", i), Data: bytes.NewReader(data)}
+	}
+	return items
+}
+
+// countObjects counts the objects stored under root for the given owner id.
+func countObjects(t testing.TB, root string, id string) int {
+	n := 0
+	err := filepath.WalkDir(filepath.Join(root, id), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && strings.HasSuffix(path, ".meta") {
+			n++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return n
+}
+
+func TestStoreAndGetBatch(t *testing.T) {
+	a := makeServer(t, ":4000")
+	a.BatchInFlight = 7
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	items := batchItems(50, 4<<10)
+	results, err := a.StoreBatch(items)
+	require.NoError(t, err)
+	for _, r := range results {
+		require.NoError(t, r.Err)
+		assert.Empty(t, r.PeerErrs)
+		assert.Equal(t, int64(4<<10), r.Size)
+	}
+	waitFor(t, func() bool { return countObjects(t, b.StorageRoot, a.ID) == len(items) })
+
+	// Drop half of the local copies so GetBatch mixes local and remote hits.
+	keys := make([]string, 0, len(items)+1)
+	for i, item := range items {
+		keys = append(keys, item.Key)
+		if i%2 == 0 {
+			require.NoError(t, a.Storage.Delete(a.ID, item.Key))
+		}
+	}
+	keys = append(keys, "batch_missing")
+	got, err := a.GetBatch(keys)
+	require.NoError(t, err)
+	for i, r := range got[:len(items)] {
+		require.NoError(t, r.Err, r.Key)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 4<<10), r.Data, r.Key)
+		assert.Equal(t, int64(4<<10), r.Info.Size)
+	}
+	assert.ErrorIs(t, got[len(items)].Err, ErrKeyNotFound)
+}
+
+func TestStoreBatchSurvivesPeerDisconnect(t *testing.T) {
+	a := makeServer(t, ":4000")
+	a.BatchInFlight = 5
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool {
+		a.peerLock.Lock()
+		defer a.peerLock.Unlock()
+		return len(a.peers) == 2
+	})
+
+	items := batchItems(300, 4<<10)
+	done := make(chan []StoreResult)
+	go func() {
+		results, err := a.StoreBatch(items)
+		assert.NoError(t, err)
+		done <- results
+	}()
+
+	// Cut b off from a part-way through the batch.
+	waitFor(t, func() bool { return countObjects(t, b.StorageRoot, a.ID) >= 10 })
+	b.peerLock.Lock()
+	for _, peer := range b.peers {
+		peer.Close()
+	}
+	b.peerLock.Unlock()
+
+	results := <-done
+	var peerFailures int
+	for _, r := range results {
+		require.NoError(t, r.Err, "local writes must not be affected by a replica failure")
+		if len(r.PeerErrs) > 0 {
+			peerFailures++
+			assert.Len(t, r.PeerErrs, 1, "only the disconnected peer may fail")
+		}
+	}
+	assert.Positive(t, peerFailures, "the disconnect should be reported per item")
+	waitFor(t, func() bool { return countObjects(t, c.StorageRoot, a.ID) == len(items) })
+	for _, item := range items[:10] {
+		ok, err := c.Storage.Has(a.ID, crypto.HashKey(item.Key))
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
+
+// benchmarkCluster starts a three node cluster for the store benchmarks.
+func benchmarkCluster(b *testing.B) *FileServer {
+	s1 := makeServer(b, ":4000")
+	s2 := makeServer(b, ":4001", ":4000")
+	s3 := makeServer(b, ":4002", ":4000", ":4001")
+	startCluster(b, s1, s2, s3)
+	waitFor(b, func() bool {
+		s1.peerLock.Lock()
+		defer s1.peerLock.Unlock()
+		return len(s1.peers) == 2
+	})
+	return s1
+}
+
+func BenchmarkStoreSequential(b *testing.B) {
+	s := benchmarkCluster(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, item := range batchItems(1000, 4<<10) {
+			if err := s.Store(item.Key, item.Data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStoreBatch(b *testing.B) {
+	s := benchmarkCluster(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := s.StoreBatch(batchItems(1000, 4<<10)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
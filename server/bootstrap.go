@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultDNSRefresh is how often DNSBootstrap looks its name up again when Refresh is not set.
+	defaultDNSRefresh = 30 * time.Second
+	// seedLookupTimeout bounds each lookup of the seed addresses.
+	seedLookupTimeout = 10 * time.Second
+)
+
+// BootstrapSource supplies the addresses of the seed nodes a server connects to and keeps
+// connected to, the bootstrap nodes. Set one as FileServerOpts.Bootstrap; BootstrapNodes is
+// used as a StaticBootstrap otherwise.
+type BootstrapSource interface {
+	// Seeds returns the current seed addresses, as host:port. An error leaves the seeds known
+	// from the last lookup in place.
+	Seeds(ctx context.Context) ([]string, error)
+	// RefreshInterval returns how often Seeds is called again once it succeeded, zero to call
+	// it only until it first succeeds.
+	RefreshInterval() time.Duration
+}
+
+// StaticBootstrap is a fixed list of seed addresses.
+type StaticBootstrap []string
+
+// Seeds returns the addresses of the list, leaving out empty ones.
+func (b StaticBootstrap) Seeds(context.Context) ([]string, error) {
+	var seeds []string
+	for _, addr := range b {
+		if len(addr) > 0 {
+			seeds = append(seeds, addr)
+		}
+	}
+	return seeds, nil
+}
+
+// RefreshInterval returns zero, as the list never changes.
+func (StaticBootstrap) RefreshInterval() time.Duration {
+	return 0
+}
+
+// Resolver looks up the DNS records DNSBootstrap needs; *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSBootstrap finds the seed addresses by looking a DNS name up, such as the name of a
+// headless service in front of every node of the cluster. Each A and AAAA record of Name is a
+// seed listening on Port; when Service is set the SRV records of the service under Name are
+// looked up instead, each target a seed listening on the port of its record. The name is
+// looked up again every Refresh, so nodes joining the cluster are dialed as they appear and
+// those gone from it are forgotten once they are disconnected.
+//
+// Fields:
+//   - Name: DNS name to look up.
+//   - Port: Port the nodes listen on, required unless Service is set.
+//   - Service: SRV service, such as "dfs", looked up over TCP under Name when set.
+//   - Refresh: How often to look the name up again, defaults to defaultDNSRefresh.
+//   - Resolver: Resolver to look the name up with, net.DefaultResolver when nil.
+type DNSBootstrap struct {
+	Name     string
+	Port     string
+	Service  string
+	Refresh  time.Duration
+	Resolver Resolver
+}
+
+// Seeds looks the name up and returns the addresses of the records found, sorted. An answer
+// without any record is an error rather than an empty list, so a DNS server briefly answering
+// nothing does not make every disconnected seed be forgotten.
+func (d *DNSBootstrap) Seeds(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var seeds []string
+	if len(d.Service) > 0 {
+		_, records, err := resolver.LookupSRV(ctx, d.Service, "tcp", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, srv := range records {
+			ips, err := resolver.LookupIPAddr(ctx, strings.TrimSuffix(srv.Target, "."))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for _, ip := range ips {
+				seeds = append(seeds, net.JoinHostPort(ip.IP.String(), strconv.Itoa(int(srv.Port))))
+			}
+		}
+		if len(seeds) == 0 && len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+	} else {
+		if len(d.Port) == 0 {
+			return nil, fmt.Errorf("looking up seeds of %s: no port set", d.Name)
+		}
+		ips, err := resolver.LookupIPAddr(ctx, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			seeds = append(seeds, net.JoinHostPort(ip.IP.String(), d.Port))
+		}
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("looking up seeds of %s: no records", d.Name)
+	}
+	slices.Sort(seeds)
+	return slices.Compact(seeds), nil
+}
+
+// RefreshInterval returns Refresh, or defaultDNSRefresh when it is not set.
+func (d *DNSBootstrap) RefreshInterval() time.Duration {
+	if d.Refresh > 0 {
+		return d.Refresh
+	}
+	return defaultDNSRefresh
+}
+
+// bootstrapSource returns the configured source of seed addresses.
+func (s *FileServer) bootstrapSource() BootstrapSource {
+	if s.Bootstrap != nil {
+		return s.Bootstrap
+	}
+	return StaticBootstrap(s.BootstrapNodes)
+}
+
+// seedList returns the current seed addresses.
+func (s *FileServer) seedList() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	return slices.Clone(s.seeds)
+}
+
+// isSeedLocked reports whether addr is a current seed address; the caller must hold peerLock.
+func (s *FileServer) isSeedLocked(addr string) bool {
+	return slices.Contains(s.seeds, addr)
+}
+
+// refreshSeeds looks the seed addresses up with source. Addresses not seen before become
+// seeds and are dialed, and watched when MirrorAll is set. Seeds gone from the answer are
+// forgotten with the replications queued for them, once they are disconnected: a node removed
+// from DNS is not dialed again. Addresses found to reach this node itself are left out.
+func (s *FileServer) refreshSeeds(source BootstrapSource) error {
+	ctx, cancel := context.WithTimeout(context.Background(), seedLookupTimeout)
+	defer cancel()
+	found, err := source.Seeds(ctx)
+	if err != nil {
+		return err
+	}
+	var added, pruned []string
+	s.peerLock.Lock()
+	seeds := make([]string, 0, len(found))
+	for _, addr := range s.seeds {
+		listed := slices.Contains(found, addr)
+		_, connected := s.bootstrapPeers[addr]
+		if connected || listed {
+			// A seed gone from the answer is kept while connected, and not redialed once it
+			// disconnects unless it comes back.
+			if !listed {
+				s.goneSeeds[addr] = true
+			} else if s.goneSeeds[addr] {
+				delete(s.goneSeeds, addr)
+				if !connected {
+					added = append(added, addr)
+				}
+			}
+			seeds = append(seeds, addr)
+			continue
+		}
+		pruned = append(pruned, addr)
+		s.goneSeeds[addr] = true
+		delete(s.seedIPs, addr)
+		delete(s.redialWait, addr)
+		delete(s.bootstrapAt, addr)
+	}
+	for _, addr := range found {
+		if len(addr) > 0 && !slices.Contains(seeds, addr) && !s.selfSeeds[addr] {
+			seeds = append(seeds, addr)
+			added = append(added, addr)
+			delete(s.goneSeeds, addr)
+		}
+	}
+	s.seeds = seeds
+	s.peerLock.Unlock()
+	for _, addr := range pruned {
+		log.Printf("[%s] seed %s is gone, forgetting it", s.Transport.Addr(), addr)
+		s.pending.drop(addr)
+	}
+	for _, addr := range added {
+		if s.MirrorAll {
+			if err := s.Watch(addr); err != nil {
+				log.Printf("[%s] mirror: %s", s.Transport.Addr(), err)
+			}
+		}
+		go s.dialLoop(addr)
+	}
+	return nil
+}
+
+// seedLoop looks the seed addresses up again every refresh interval of source until the
+// server is stopped. Failed lookups are logged and retried with a backoff, no later than the
+// next refresh; a source without a refresh interval is only retried until it succeeds.
+func (s *FileServer) seedLoop(source BootstrapSource, failed bool) {
+	backoff := minRedialBackoff
+	for {
+		wait := source.RefreshInterval()
+		if failed {
+			if wait <= 0 || backoff < wait {
+				wait = backoff
+			}
+			backoff = min(2*backoff, maxRedialBackoff)
+		} else {
+			backoff = minRedialBackoff
+		}
+		if wait <= 0 {
+			return
+		}
+		select {
+		case <-s.quitch:
+			return
+		case <-s.Clock.After(wait):
+		}
+		failed = s.refreshSeedsLogged(source) != nil
+	}
+}
+
+// refreshSeedsLogged runs refreshSeeds, logging and counting a failed lookup.
+func (s *FileServer) refreshSeedsLogged(source BootstrapSource) error {
+	err := s.refreshSeeds(source)
+	if err != nil {
+		s.metrics.seedLookupFailures.Add(1)
+		log.Printf("[%s] looking up seeds, retrying: %s", s.Transport.Addr(), err)
+	}
+	return err
+}
+
+// forgetSelfSeed stops treating addr as a seed, as it reached this node itself, and drops the
+// replications queued for it.
+func (s *FileServer) forgetSelfSeed(addr string) {
+	s.peerLock.Lock()
+	s.selfSeeds[addr] = true
+	s.seeds = slices.DeleteFunc(s.seeds, func(seed string) bool { return seed == addr })
+	s.peerLock.Unlock()
+	s.pending.drop(addr)
+	log.Printf("[%s] seed %s is this node, not dialing it again", s.Transport.Addr(), addr)
+}
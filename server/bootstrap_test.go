@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubResolver answers lookups from record sets the test changes, every target on 127.0.0.1.
+type stubResolver struct {
+	mu      sync.Mutex
+	ports   []uint16 // Ports of the SRV records
+	err     error    // Returned by every lookup when set
+	lookups int      // SRV lookups made
+}
+
+func (r *stubResolver) set(err error, ports ...uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err, r.ports = err, ports
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if host == "empty.test" {
+		return nil, nil
+	}
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+// srvLookups returns how many SRV lookups were made.
+func (r *stubResolver) srvLookups() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	var records []*net.SRV
+	for _, port := range r.ports {
+		records = append(records, &net.SRV{Target: "node.dfs.test.", Port: port})
+	}
+	return "_" + service + "._" + proto + "." + name, records, nil
+}
+
+func TestDNSBootstrapSeeds(t *testing.T) {
+	r := &stubResolver{}
+	seeds, err := (&DNSBootstrap{Name: "dfs.test", Port: "3000", Resolver: r}).Seeds(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:3000"}, seeds)
+
+	r.set(nil, 4001, 4000, 4001)
+	srv := &DNSBootstrap{Name: "dfs.test", Service: "dfs", Resolver: r}
+	seeds, err = srv.Seeds(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4000", "127.0.0.1:4001"}, seeds)
+	assert.Equal(t, defaultDNSRefresh, srv.RefreshInterval())
+
+	_, err = (&DNSBootstrap{Name: "dfs.test", Resolver: r}).Seeds(context.Background())
+	assert.ErrorContains(t, err, "no port")
+	_, err = (&DNSBootstrap{Name: "empty.test", Port: "3000", Resolver: r}).Seeds(context.Background())
+	assert.ErrorContains(t, err, "no records", "an empty answer forgets no seed")
+	r.set(nil)
+	_, err = srv.Seeds(context.Background())
+	assert.ErrorContains(t, err, "no records")
+}
+
+func TestDNSBootstrapFollowsRecords(t *testing.T) {
+	const interval = time.Second
+	clk := clock.NewFake(time.Unix(0, 0))
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	x := makeMemoryServer(t, network, ":4010")
+	x.Clock = clk
+	r := &stubResolver{ports: []uint16{4000}}
+	x.Bootstrap = &DNSBootstrap{Name: "dfs.test", Service: "dfs", Refresh: interval, Resolver: r}
+	var (
+		mu    sync.Mutex
+		dials = map[string]int{}
+	)
+	dialsTo := func(addr string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dials[addr]
+	}
+	tr := x.Transport.(*p2p.TCPTransport)
+	connect := tr.Connect
+	tr.Connect = func(network string, address string) (net.Conn, error) {
+		mu.Lock()
+		dials[address]++
+		mu.Unlock()
+		return connect(network, address)
+	}
+	connected := func(addr string) func() bool {
+		return func() bool {
+			x.peerLock.Lock()
+			defer x.peerLock.Unlock()
+			_, ok := x.bootstrapPeers[addr]
+			return ok
+		}
+	}
+	// refresh advances the clock of x an interval at a time until its seeds were looked up at
+	// least n more times.
+	refresh := func(n int) {
+		want := r.srvLookups() + n
+		waitFor(t, func() bool {
+			clk.Advance(interval)
+			return r.srvLookups() >= want
+		})
+	}
+	startCluster(t, a, b, c, x)
+	waitFor(t, connected("127.0.0.1:4000"))
+	refresh(3)
+	assert.Zero(t, dialsTo("127.0.0.1:4001"), "not in DNS yet")
+
+	// A node appearing in DNS is dialed.
+	r.set(nil, 4000, 4001, 4002)
+	refresh(1)
+	waitFor(t, connected("127.0.0.1:4001"))
+	waitFor(t, connected("127.0.0.1:4002"))
+	assert.Equal(t, int64(3), x.Metrics()["bootstrap_seeds"])
+
+	// Failed lookups are retried and leave the seeds as they were.
+	r.set(errors.New("dns server unreachable"), 4000, 4001, 4002)
+	failures := x.Metrics()["seed_lookup_failures"]
+	refresh(3)
+	assert.GreaterOrEqual(t, x.Metrics()["seed_lookup_failures"], failures+3)
+	assert.Len(t, x.seedList(), 3)
+	assert.Len(t, x.peerList(), 3)
+
+	// A banned node gone from DNS is forgotten and not dialed once its ban runs out, while a
+	// connected node gone from DNS is kept.
+	require.NoError(t, x.DropPeer(b.ID, 3*interval))
+	waitFor(t, func() bool { return !connected("127.0.0.1:4001")() })
+	r.set(nil, 4000)
+	refresh(1)
+	assert.Equal(t, []string{"127.0.0.1:4000", "127.0.0.1:4002"}, x.seedList())
+	refresh(5)
+	assert.Equal(t, 1, dialsTo("127.0.0.1:4001"), "dialed again after it was gone")
+	assert.False(t, connected("127.0.0.1:4001")())
+
+	// Once the node kept disconnects it is forgotten too, without being redialed.
+	require.NoError(t, x.DropPeer(c.ID, 0))
+	waitFor(t, func() bool { return !connected("127.0.0.1:4002")() })
+	refresh(5)
+	assert.Equal(t, []string{"127.0.0.1:4000"}, x.seedList())
+	assert.Equal(t, 1, dialsTo("127.0.0.1:4002"), "dialed again after it was gone")
+
+	// A node back in DNS is dialed again.
+	r.set(nil, 4000, 4002)
+	refresh(1)
+	waitFor(t, connected("127.0.0.1:4002"))
+	assert.Equal(t, 2, dialsTo("127.0.0.1:4002"))
+
+	// A record that reaches the node itself is dialed once and never again.
+	r.set(nil, 4000, 4002, 4010)
+	refresh(1)
+	waitFor(t, func() bool {
+		x.peerLock.Lock()
+		defer x.peerLock.Unlock()
+		return x.selfSeeds["127.0.0.1:4010"]
+	})
+	refresh(5)
+	assert.Equal(t, 1, dialsTo("127.0.0.1:4010"))
+	assert.Equal(t, []string{"127.0.0.1:4000", "127.0.0.1:4002"}, x.seedList())
+	for _, p := range x.peerList() {
+		assert.False(t, strings.HasSuffix(p.RemoteAddr().String(), ":4010"), "connected to itself")
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultCacheObjectMax is the largest object cached when CacheObjectMax is not set.
+const defaultCacheObjectMax = 64 << 10
+
+// objectCache keeps the content of recently read small objects in memory so repeated Gets
+// skip the disk and the checksum. It holds at most maxBytes of content, evicting the least
+// recently used objects first.
+//
+// Writes invalidate entries after they reach the disk. A read that started before such an
+// invalidation may have seen the old content, so its result is not cached; once a write or
+// delete has returned, the cache never serves what it replaced.
+type objectCache struct {
+	mu        sync.Mutex
+	maxBytes  int64                      // Content held at most, in bytes
+	maxObject int64                      // Largest object cached, in bytes
+	bytes     int64                      // Content held, in bytes
+	entries   map[cacheKey]*list.Element // Cached objects, their elements holding *cacheEntry
+	order     *list.List                 // Cached objects, most recently used at the front
+	fills     map[cacheKey][]*cacheFill  // Reads in flight that may fill the cache, by object
+}
+
+// cacheKey identifies an object by its owner ID and key.
+type cacheKey struct {
+	id  string
+	key string
+}
+
+// cacheEntry is a single cached object.
+type cacheEntry struct {
+	key  cacheKey
+	info ObjectInfo
+	data []byte
+}
+
+// cacheFill is a read from disk whose result may be cached once it completes.
+type cacheFill struct {
+	key   cacheKey
+	stale bool // Set when the object changed while it was read
+}
+
+// newObjectCache returns a cache holding up to maxBytes of objects no larger than maxObject,
+// or nil when maxBytes is not positive.
+func newObjectCache(maxBytes int64, maxObject int64) *objectCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if maxObject <= 0 {
+		maxObject = defaultCacheObjectMax
+	}
+	return &objectCache{
+		maxBytes:  maxBytes,
+		maxObject: min(maxObject, maxBytes),
+		entries:   make(map[cacheKey]*list.Element),
+		order:     list.New(),
+		fills:     make(map[cacheKey][]*cacheFill),
+	}
+}
+
+// get returns the cached content of an object and marks it recently used. The returned
+// slice must not be modified.
+func (c *objectCache) get(id string, key string) (ObjectInfo, []byte, bool) {
+	if c == nil {
+		return ObjectInfo{}, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey{id, key}]
+	if !ok {
+		return ObjectInfo{}, nil, false
+	}
+	c.order.MoveToFront(el)
+	entry := el.Value.(*cacheEntry)
+	return entry.info, entry.data, true
+}
+
+// begin registers a read of an object from disk, before any of it is read. The read must be
+// ended with finish.
+func (c *objectCache) begin(id string, key string) *cacheFill {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := &cacheFill{key: cacheKey{id, key}}
+	c.fills[f.key] = append(c.fills[f.key], f)
+	return f
+}
+
+// finish ends a read registered with begin, caching what it read unless the object changed
+// in the meantime or is too large.
+//
+// Parameters:
+//   - f: The read, as returned by begin.
+//   - info: Description of the object read.
+//   - data: Its content, or nil when the read failed. The cache keeps the slice.
+func (c *objectCache) finish(f *cacheFill, info ObjectInfo, data []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fills := c.fills[f.key]
+	for i, other := range fills {
+		if other == f {
+			fills = append(fills[:i], fills[i+1:]...)
+			break
+		}
+	}
+	if len(fills) == 0 {
+		delete(c.fills, f.key)
+	} else {
+		c.fills[f.key] = fills
+	}
+	if f.stale || data == nil || int64(len(data)) > c.maxObject {
+		return
+	}
+	c.remove(f.key)
+	c.entries[f.key] = c.order.PushFront(&cacheEntry{key: f.key, info: info, data: data})
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate forgets an object and keeps reads of it in flight from caching what they read.
+// An empty id and key forget every object. Its signature matches storage.StoreOpts.OnChange.
+func (c *objectCache) invalidate(id string, key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(id) == 0 && len(key) == 0 {
+		for _, fills := range c.fills {
+			for _, f := range fills {
+				f.stale = true
+			}
+		}
+		c.entries = make(map[cacheKey]*list.Element)
+		c.order.Init()
+		c.bytes = 0
+		return
+	}
+	k := cacheKey{id, key}
+	for _, f := range c.fills[k] {
+		f.stale = true
+	}
+	c.remove(k)
+}
+
+// remove drops an object from the cache. c.mu must be held.
+func (c *objectCache) remove(k cacheKey) {
+	el, ok := c.entries[k]
+	if !ok {
+		return
+	}
+	c.order.Remove(el)
+	delete(c.entries, k)
+	c.bytes -= int64(len(el.Value.(*cacheEntry).data))
+}
+
+// len returns the number of objects cached and the bytes they hold.
+func (c *objectCache) len() (int, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.bytes
+}
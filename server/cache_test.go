@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeCachedServer returns a server, never started, that caches up to cacheBytes of objects.
+func makeCachedServer(t testing.TB, cacheBytes int64) *FileServer {
+	return NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFuncSHA256,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":4000"}),
+		CacheBytes:        cacheBytes,
+	})
+}
+
+// readKey reads the content stored under key.
+func readKey(s *FileServer, key string) ([]byte, error) {
+	_, r, err := s.GetWithInfo(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestObjectCache(t *testing.T) {
+	c := newObjectCache(10, 4)
+	put := func(key string, data string) {
+		c.finish(c.begin("id", key), ObjectInfo{Key: key}, []byte(data))
+	}
+
+	put("a", "aaaa")
+	put("b", "bbbb")
+	_, data, ok := c.get("id", "a")
+	require.True(t, ok)
+	assert.Equal(t, "aaaa", string(data))
+	_, _, ok = c.get("other", "a")
+	assert.False(t, ok, "objects of other owners must not be served")
+
+	// "a" was used last, so "b" is evicted to make room.
+	put("c", "cccc")
+	_, _, ok = c.get("id", "b")
+	assert.False(t, ok, "the least recently used object should be evicted")
+	n, size := c.len()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, int64(8), size)
+
+	put("d", "ddddd")
+	_, _, ok = c.get("id", "d")
+	assert.False(t, ok, "objects larger than the object limit must not be cached")
+
+	fill := c.begin("id", "e")
+	c.invalidate("id", "e")
+	c.finish(fill, ObjectInfo{Key: "e"}, []byte("e"))
+	_, _, ok = c.get("id", "e")
+	assert.False(t, ok, "a read racing an invalidation must not be cached")
+
+	c.invalidate("id", "a")
+	_, _, ok = c.get("id", "a")
+	assert.False(t, ok)
+	c.invalidate("", "")
+	n, size = c.len()
+	assert.Zero(t, n)
+	assert.Zero(t, size)
+
+	var disabled *objectCache = newObjectCache(0, 0)
+	disabled.finish(disabled.begin("id", "a"), ObjectInfo{}, []byte("a"))
+	_, _, ok = disabled.get("id", "a")
+	assert.False(t, ok)
+}
+
+func TestGetServesFromCache(t *testing.T) {
+	s := makeCachedServer(t, 1<<20)
+	require.NoError(t, s.Store("hot", bytes.NewReader([]byte("first"))))
+
+	for i := 0; i < 3; i++ {
+		got, err := readKey(s, "hot")
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(got))
+	}
+	assert.Equal(t, int64(2), s.Metrics()["cache_hits"])
+	assert.Equal(t, int64(1), s.Metrics()["cache_misses"])
+
+	// Writes that bypass the server, as replicas and restores do, still invalidate the entry.
+	_, err := s.Storage.Write(s.ID, "hot", bytes.NewReader([]byte("second")))
+	require.NoError(t, err)
+	got, err := readKey(s, "hot")
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(got))
+
+	require.NoError(t, s.Delete("hot"))
+	_, err = readKey(s, "hot")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, s.Storage.Clear())
+	require.NoError(t, s.Store("hot", bytes.NewReader([]byte("third"))))
+	_, err = readKey(s, "hot")
+	require.NoError(t, err)
+	require.NoError(t, s.Storage.Clear())
+	_, err = readKey(s, "hot")
+	assert.ErrorIs(t, err, ErrKeyNotFound, "clearing the store must empty the cache")
+}
+
+// TestCacheInvalidationRaces reads a key continuously while it is rewritten and deleted, and
+// checks that every read started after a write returned sees that write or a later one.
+func TestCacheInvalidationRaces(t *testing.T) {
+	s := makeCachedServer(t, 1<<20)
+	const key = "racy"
+	var (
+		latest atomic.Int64 // Highest version whose Store returned, -1 once deleted
+		stop   = make(chan struct{})
+		wg     sync.WaitGroup
+	)
+	require.NoError(t, s.Store(key, bytes.NewReader([]byte("0"))))
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				floor := latest.Load()
+				got, err := readKey(s, key)
+				if floor < 0 {
+					if !errors.Is(err, ErrKeyNotFound) {
+						t.Errorf("read after delete returned %q, %v", got, err)
+					}
+					return
+				}
+				if err != nil {
+					// A read from disk can overlap a rewrite of the file it opened.
+					continue
+				}
+				var version int64
+				if _, err := fmt.Sscan(string(got), &version); err != nil {
+					t.Errorf("read %q: %v", got, err)
+					return
+				}
+				if version < floor {
+					t.Errorf("read version %d after version %d was stored", version, floor)
+					return
+				}
+			}
+		}()
+	}
+	for v := int64(1); v <= 200; v++ {
+		require.NoError(t, s.Store(key, bytes.NewReader([]byte(fmt.Sprint(v)))))
+		latest.Store(v)
+		if got, err := readKey(s, key); err == nil {
+			assert.Equal(t, fmt.Sprint(v), string(got))
+		}
+	}
+	require.NoError(t, s.Delete(key))
+	latest.Store(-1)
+	_, err := readKey(s, key)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	close(stop)
+	wg.Wait()
+}
+
+// benchmarkGet reads a 4 KiB object repeatedly from a server caching up to cacheBytes.
+func benchmarkGet(b *testing.B, cacheBytes int64) {
+	s := makeCachedServer(b, cacheBytes)
+	data := bytes.Repeat([]byte{'c'}, 4<<10)
+	if err := s.Store("bench", bytes.NewReader(data)); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := readKey(s, "bench"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetCached reads a 4 KiB object served from the object cache.
+func BenchmarkGetCached(b *testing.B) { benchmarkGet(b, 1<<20) }
+
+// BenchmarkGetUncached reads a 4 KiB object from disk.
+func BenchmarkGetUncached(b *testing.B) { benchmarkGet(b, 0) }
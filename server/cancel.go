@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// objectChunkSize is the most object bytes sent in one chunk. The sender checks whether the
+// request was cancelled between chunks.
+const objectChunkSize = 128 << 10
+
+// truncatedChunk is sent in place of a chunk length when the sender stops an object early.
+const truncatedChunk = ^uint32(0)
+
+// errStreamTruncated is returned while reading an object whose sender stopped early because
+// the request was cancelled. The stream ends with the truncation trailer, so the connection
+// stays in sync.
+var errStreamTruncated = errors.New("object stream truncated by its sender")
+
+// errRequestCancelled is returned while sending an object whose requester cancelled it.
+var errRequestCancelled = errors.New("request cancelled by the requester")
+
+// MessageCancel tells a peer that the requester gave up on a get request, so the peer stops
+// streaming its answer. It is handled as soon as it arrives rather than queued behind the
+// peer's other messages, since the answer being cancelled occupies the peer's worker.
+type MessageCancel struct {
+	RequestID uint64 // Identifier the request was sent with
+}
+
+// requestTable holds the cancellation flags of the get requests of each peer. Peers number
+// their requests in increasing order and this node answers them in that order, so a
+// cancellation for a request not answered yet is kept until the request is, while one for a
+// request already answered is dropped.
+type requestTable struct {
+	mu    sync.Mutex               // Guards peers
+	peers map[string]*peerRequests // Requests by peer address
+}
+
+// peerRequests is the state of one peer's get requests.
+type peerRequests struct {
+	last  uint64                  // Highest request ID answering started for
+	flags map[uint64]*atomic.Bool // Cancellation flags of requests being answered or cancelled early
+}
+
+// requests returns the state of a peer, creating it if needed. t.mu must be held.
+func (t *requestTable) requests(peer string) *peerRequests {
+	if t.peers == nil {
+		t.peers = make(map[string]*peerRequests)
+	}
+	r, ok := t.peers[peer]
+	if !ok {
+		r = &peerRequests{flags: make(map[uint64]*atomic.Bool)}
+		t.peers[peer] = r
+	}
+	return r
+}
+
+// begin returns the cancellation flag of a request whose answer is starting, which may already
+// be set. Requests without an ID cannot be cancelled.
+func (t *requestTable) begin(peer string, id uint64) *atomic.Bool {
+	if id == 0 {
+		return new(atomic.Bool)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.requests(peer)
+	r.last = max(r.last, id)
+	flag, ok := r.flags[id]
+	if !ok {
+		flag = new(atomic.Bool)
+		r.flags[id] = flag
+	}
+	return flag
+}
+
+// end forgets a request once it is answered.
+func (t *requestTable) end(peer string, id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.peers[peer]; ok {
+		delete(r.flags, id)
+	}
+}
+
+// cancel sets the flag of a request being answered, or of one not answered yet.
+func (t *requestTable) cancel(peer string, id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.requests(peer)
+	if flag, ok := r.flags[id]; ok {
+		flag.Store(true)
+		return
+	}
+	if id > r.last {
+		flag := new(atomic.Bool)
+		flag.Store(true)
+		r.flags[id] = flag
+	}
+}
+
+// drop forgets the requests of a peer that disconnected.
+func (t *requestTable) drop(peer string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, peer)
+}
+
+// ignoreCancelled returns nil for errors from answering a request that was cancelled, which
+// is not a failure of this node.
+func ignoreCancelled(err error) error {
+	if errors.Is(err, errRequestCancelled) {
+		return nil
+	}
+	return err
+}
+
+// nextRequestID returns a new identifier for a get request, never zero, carrying the
+// incarnation of the node.
+func (s *FileServer) nextRequestID() uint64 {
+	return correlationID(s.incarnation, s.requestSeq.Add(1))
+}
+
+// cancelRequest asks the peers answering a get request to stop streaming their answers. Peers
+// that do not stream in chunks cannot stop early and are not asked. The message is sent under
+// streamMu so it is not interleaved with an outgoing stream.
+func (s *FileServer) cancelRequest(peers []p2p.Node, id uint64) {
+	peers, _ = s.peersWith(peers, func(c peerCaps) bool { return c.chunked })
+	if len(peers) == 0 {
+		return
+	}
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if _, err := s.sendMessage(peers, &Message{Payload: MessageCancel{RequestID: id}}); err != nil {
+		log.Printf("[%s] cancelling request %d: %s", s.Transport.Addr(), id, err)
+	}
+}
+
+// writeChunks copies size bytes of r to w in chunks of at most objectChunkSize, each preceded
+// by its length. Once cancelled is set, the object is ended with the truncation trailer
+// instead of its next chunk.
+//
+// Returns: Number of content bytes written and any errors, wrapping errRequestCancelled when
+// the object was truncated.
+func writeChunks(w io.Writer, r io.Reader, size int64, cancelled *atomic.Bool) (int64, error) {
+	var n int64
+	for n < size {
+		if cancelled != nil && cancelled.Load() {
+			if err := binary.Write(w, binary.LittleEndian, truncatedChunk); err != nil {
+				return n, err
+			}
+			return n, errRequestCancelled
+		}
+		chunk := min(size-n, objectChunkSize)
+		if err := binary.Write(w, binary.LittleEndian, uint32(chunk)); err != nil {
+			return n, err
+		}
+		// Peers implementing io.ReaderFrom hand the file to the connection, which can use sendfile.
+		m, err := io.CopyN(w, r, chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// chunkReader reads the bytes of an object written by writeChunks.
+type chunkReader struct {
+	r     io.Reader // Stream the chunks are read from
+	left  int64     // Object bytes not read yet
+	chunk int64     // Bytes left in the current chunk
+	err   error     // Error returned by every read once the stream failed or was truncated
+}
+
+// newChunkReader returns a reader for an object of size bytes sent in chunks over r.
+func newChunkReader(r io.Reader, size int64) *chunkReader {
+	return &chunkReader{r: r, left: size}
+}
+
+// Read reads object bytes, returning errStreamTruncated once the sender stopped early.
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.left == 0 {
+		return 0, io.EOF
+	}
+	if c.chunk == 0 {
+		var length uint32
+		if err := binary.Read(c.r, binary.LittleEndian, &length); err != nil {
+			c.err = unexpectedEOF(err)
+			return 0, c.err
+		}
+		switch {
+		case length == truncatedChunk:
+			c.err = errStreamTruncated
+			return 0, c.err
+		case length == 0 || int64(length) > c.left:
+			c.err = fmt.Errorf("invalid chunk of %d bytes with %d object bytes left", length, c.left)
+			return 0, c.err
+		}
+		c.chunk = int64(length)
+	}
+	if int64(len(b)) > c.chunk {
+		b = b[:c.chunk]
+	}
+	n, err := c.r.Read(b)
+	c.chunk -= int64(n)
+	c.left -= int64(n)
+	if err != nil && (c.left > 0 || !errors.Is(err, io.EOF)) {
+		c.err = unexpectedEOF(err)
+		return n, c.err
+	}
+	return n, nil
+}
+
+// unexpectedEOF reports the end of a stream in the middle of an object as io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
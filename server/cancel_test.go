@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunksRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("chunk"), objectChunkSize/2)
+	var buf bytes.Buffer
+	n, err := writeChunks(&buf, bytes.NewReader(data), int64(len(data)), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	got, err := io.ReadAll(newChunkReader(&buf, int64(len(data))))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// A cancelled object ends with the trailer, which the reader tells from a broken stream.
+	var cancelled atomic.Bool
+	cancelled.Store(true)
+	buf.Reset()
+	n, err = writeChunks(&buf, bytes.NewReader(data), int64(len(data)), &cancelled)
+	assert.ErrorIs(t, err, errRequestCancelled)
+	assert.Zero(t, n)
+	_, err = io.ReadAll(newChunkReader(&buf, int64(len(data))))
+	assert.ErrorIs(t, err, errStreamTruncated)
+	assert.Zero(t, buf.Len(), "nothing follows the trailer")
+
+	buf.Reset()
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, uint32(10)))
+	buf.WriteString("short")
+	_, err = io.ReadAll(newChunkReader(&buf, 10))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestRequestTable(t *testing.T) {
+	var table requestTable
+	// A cancellation can overtake the request it names.
+	table.cancel("peer", 2)
+	assert.True(t, table.begin("peer", 2).Load())
+	table.end("peer", 2)
+
+	flag := table.begin("peer", 3)
+	assert.False(t, flag.Load())
+	table.cancel("peer", 3)
+	assert.True(t, flag.Load())
+	table.end("peer", 3)
+
+	// Cancelling a request already answered leaves nothing behind.
+	table.cancel("peer", 1)
+	table.cancel("peer", 3)
+	assert.Empty(t, table.peers["peer"].flags)
+	assert.False(t, table.begin("peer", 0).Load(), "requests without an ID are never cancelled")
+	table.drop("peer")
+	assert.Empty(t, table.peers)
+}
+
+func TestCancelledGetStopsServing(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	const size = 8 << 20
+	data := randomData(t, size)
+	require.NoError(t, a.Store("large", bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("large"))
+		return ok
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, "large"))
+
+	served := make(chan int64, 1)
+	b.testHookServed = func(_ string, n int64) { served <- n }
+	network.Policy.SetLink(":4001", ":4000", p2p.LinkPolicy{Bandwidth: 8 << 20})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _, err := a.GetContext(ctx, "large", TransferOpts{
+		ProgressInterval: 64 << 10,
+		Progress: func(p TransferProgress) {
+			if p.Phase == TransferFetch && p.Done >= 1<<20 {
+				cancel()
+			}
+		},
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case n := <-served:
+		assert.Less(t, n, int64(size/2), "the server should stop reading well before the end of the object")
+	case <-time.After(3 * time.Second):
+		t.Fatal("the server did not stop serving the cancelled object")
+	}
+	waitFor(t, func() bool { return b.Metrics()["requests_cancelled"] == 1 })
+
+	// The fetch drops its partial copy once it read the truncated stream.
+	a.fetches.Wait()
+	ok, err := a.Storage.Has(a.ID, "large")
+	require.NoError(t, err)
+	assert.False(t, ok, "the partial copy must not be kept")
+
+	// The truncated stream left the connection in sync, so the object can still be fetched.
+	network.Policy.SetLink(":4001", ":4000", p2p.LinkPolicy{})
+	b.testHookServed = nil
+	r, err := a.Get("large")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// supportedCaps is every optional feature this version of the server implements.
+const supportedCaps = p2p.CapBatch | p2p.CapSyncTree | p2p.CapInline | p2p.CapChunkedStreams | p2p.CapRangeGet | p2p.CapStoreAck | p2p.CapMirror | p2p.CapTypedMessages | p2p.CapNamespaceGrants | p2p.CapPins | p2p.CapReadRepair | p2p.CapVerify | p2p.CapReserve | p2p.CapAppend | p2p.CapDeletePrefix | p2p.CapMux | p2p.CapCoalesce | p2p.CapClock | p2p.CapReliable | p2p.CapChallenge | p2p.CapLease | p2p.CapLocate | p2p.CapAliases | p2p.CapBusy | p2p.CapReplies
+
+// peerCaps holds the optional features both this node and a peer support. The send and receive
+// paths consult it to decide how to talk to the peer, falling back to the older behaviour for
+// every feature either side lacks.
+type peerCaps struct {
+	batch    bool // Batched store and get messages; otherwise objects go one message each
+	syncTree bool // Merkle summaries for sync; otherwise full key lists are compared
+	inline   bool // Small replicas inside their store message; otherwise they are streamed
+	chunked  bool // Objects streamed in cancellable chunks; otherwise as one run of bytes
+	ranges   bool // Range requests, used by parallel downloads; otherwise objects are fetched whole
+	acks     bool // Acknowledgements of stored replicas; otherwise they never count as durable
+	mirror   bool // Object listings and pulls; otherwise mirrors only get the replicas they are sent
+	typed    bool // Payloads identified by their tag; otherwise by their gob interface registration
+	grants   bool // Namespace keys can be granted; otherwise the peer only stores namespaces as ciphertext
+	pins     bool // Placement pins are announced; otherwise the peer does not learn where objects are pinned
+	repair   bool // Get answers carry an objectStamp; otherwise the peer's copies are never read repaired
+	verify   bool // Object listings for VerifyCluster; otherwise the peer is reported as unaudited
+	reserve  bool // Keys can be reserved for StoreIfAbsent; otherwise the peer is not asked
+	append   bool // Appends are sent as the bytes added; otherwise the peer gets the whole object again
+	prefixes bool // Prefix deletes are sent as one message; otherwise the peer is sent a delete per key
+	mux      bool // Streams are multiplexed with other traffic; otherwise each holds the connection until read
+	coalesce bool // Deletes and notifications are packed into batched messages; otherwise each goes in its own frame
+	clock    bool // Pings measure the offset of the peer's clock; otherwise its skew goes undetected
+	reliable bool // Deletes, pins, alias changes and pruned versions are acknowledged and retried; otherwise each is sent once
+	proofs   bool // Replicas can be challenged to prove they are held; otherwise the peer's copies go unchallenged
+	leases   bool // Keys can be leased; otherwise the peer neither grants leases nor refuses stores of leased keys
+	locate   bool // Copies of an object can be described for Locate; otherwise the peer's copies are only expected
+	aliases  bool // Alias changes are announced; otherwise the peer does not resolve the cluster's aliases
+	busy     bool // Requests past the admission limits are refused as busy; otherwise the peer's are served however loaded this node is
+	replies  bool // Answers are routed to their request by its ID; otherwise they are matched to requests by order, one fetch at a time
+}
+
+// capsOf returns the features this node and the peer both support.
+func (s *FileServer) capsOf(peer p2p.Node) peerCaps {
+	common := s.caps & peer.Hello().Capabilities
+	return peerCaps{
+		batch:    common.Has(p2p.CapBatch),
+		syncTree: common.Has(p2p.CapSyncTree),
+		inline:   common.Has(p2p.CapInline),
+		chunked:  common.Has(p2p.CapChunkedStreams),
+		ranges:   common.Has(p2p.CapRangeGet),
+		acks:     common.Has(p2p.CapStoreAck),
+		mirror:   common.Has(p2p.CapMirror),
+		typed:    common.Has(p2p.CapTypedMessages),
+		grants:   common.Has(p2p.CapNamespaceGrants),
+		pins:     common.Has(p2p.CapPins),
+		repair:   common.Has(p2p.CapReadRepair),
+		verify:   common.Has(p2p.CapVerify),
+		reserve:  common.Has(p2p.CapReserve),
+		append:   common.Has(p2p.CapAppend),
+		prefixes: common.Has(p2p.CapDeletePrefix),
+		mux:      common.Has(p2p.CapMux),
+		coalesce: common.Has(p2p.CapCoalesce),
+		clock:    common.Has(p2p.CapClock),
+		reliable: common.Has(p2p.CapReliable),
+		proofs:   common.Has(p2p.CapChallenge),
+		leases:   common.Has(p2p.CapLease),
+		locate:   common.Has(p2p.CapLocate),
+		aliases:  common.Has(p2p.CapAliases),
+		busy:     common.Has(p2p.CapBusy),
+		replies:  common.Has(p2p.CapReplies | p2p.CapMux),
+	}
+}
+
+// peersWith splits peers into those for which has reports true and the rest.
+func (s *FileServer) peersWith(peers []p2p.Node, has func(peerCaps) bool) (with []p2p.Node, without []p2p.Node) {
+	for _, peer := range peers {
+		if has(s.capsOf(peer)) {
+			with = append(with, peer)
+		} else {
+			without = append(without, peer)
+		}
+	}
+	return with, without
+}
+
+// downgraded counts the connected peers talked to without each feature, keyed by metric name.
+func (s *FileServer) downgraded() map[string]int64 {
+	counts := map[string]int64{
+		"peers_without_batch":     0,
+		"peers_without_sync_tree": 0,
+		"peers_without_inline":    0,
+		"peers_legacy_framing":    0,
+		"peers_without_ranges":    0,
+		"peers_without_acks":      0,
+		"peers_without_mirror":    0,
+		"peers_untyped_messages":  0,
+		"peers_without_grants":    0,
+		"peers_without_pins":      0,
+		"peers_without_repair":    0,
+		"peers_without_verify":    0,
+		"peers_without_reserve":   0,
+		"peers_without_append":    0,
+		"peers_without_prefixes":  0,
+		"peers_without_mux":       0,
+		"peers_uncoalesced":       0,
+		"peers_without_clock":     0,
+		"peers_without_reliable":  0,
+		"peers_without_proofs":    0,
+		"peers_without_leases":    0,
+		"peers_without_locate":    0,
+		"peers_without_aliases":   0,
+		"peers_without_busy":      0,
+		"peers_without_replies":   0,
+	}
+	for _, peer := range s.peerList() {
+		caps := s.capsOf(peer)
+		for name, ok := range map[string]bool{
+			"peers_without_batch":     caps.batch,
+			"peers_without_sync_tree": caps.syncTree,
+			"peers_without_inline":    caps.inline,
+			"peers_legacy_framing":    caps.chunked,
+			"peers_without_ranges":    caps.ranges,
+			"peers_without_acks":      caps.acks,
+			"peers_without_mirror":    caps.mirror,
+			"peers_untyped_messages":  caps.typed,
+			"peers_without_grants":    caps.grants,
+			"peers_without_pins":      caps.pins,
+			"peers_without_repair":    caps.repair,
+			"peers_without_verify":    caps.verify,
+			"peers_without_reserve":   caps.reserve,
+			"peers_without_append":    caps.append,
+			"peers_without_prefixes":  caps.prefixes,
+			"peers_without_mux":       caps.mux,
+			"peers_uncoalesced":       caps.coalesce,
+			"peers_without_clock":     caps.clock,
+			"peers_without_reliable":  caps.reliable,
+			"peers_without_proofs":    caps.proofs,
+			"peers_without_leases":    caps.leases,
+			"peers_without_locate":    caps.locate,
+			"peers_without_aliases":   caps.aliases,
+			"peers_without_busy":      caps.busy,
+			"peers_without_replies":   caps.replies,
+		} {
+			if !ok {
+				counts[name]++
+			}
+		}
+	}
+	return counts
+}
+
+// writeStream writes size bytes of r to w in chunks when chunked is set, or as one run of
+// bytes for peers that do not support chunks, which cannot be cancelled.
+//
+// Returns: Number of content bytes written and any errors.
+func writeStream(w io.Writer, r io.Reader, size int64, cancelled *atomic.Bool, chunked bool) (int64, error) {
+	if !chunked {
+		return io.CopyN(w, r, size)
+	}
+	return writeChunks(w, r, size, cancelled)
+}
+
+// streamReader returns a reader for an object of size bytes sent over r by writeStream.
+func streamReader(r io.Reader, size int64, chunked bool) io.Reader {
+	if !chunked {
+		return &eofReader{r: io.LimitReader(r, size), left: size}
+	}
+	return newChunkReader(r, size)
+}
+
+// eofReader reports a stream ending before the object as io.ErrUnexpectedEOF.
+type eofReader struct {
+	r    io.Reader // Object bytes
+	left int64     // Object bytes not read yet
+}
+
+// Read reads object bytes.
+func (e *eofReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	e.left -= int64(n)
+	if errors.Is(err, io.EOF) && e.left > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
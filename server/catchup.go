@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// pendingFileName is the file in the storage root holding the replications owed to offline peers.
+const pendingFileName = ".dfs-pending.json"
+
+// Defaults for draining the pending replication queue and re-dialing bootstrap nodes.
+const (
+	defaultCatchUpConcurrency = 2
+	defaultCatchUpRate        = 100
+	minRedialBackoff          = 100 * time.Millisecond
+	maxRedialBackoff          = 5 * time.Second
+	// stableConnection is how long a connection to a bootstrap node lasts before its closing
+	// is redialed at once rather than after a backoff.
+	stableConnection = time.Second
+)
+
+// pendingQueue records, per bootstrap node address, the keys that could not be replicated to
+// it. It is persisted after every change so owed replications survive a restart.
+type pendingQueue struct {
+	mu      sync.Mutex
+	path    string                         // Location of the persisted queue, empty until load is called
+	entries map[string]map[string]struct{} // Bootstrap address to pending keys
+}
+
+// newPendingQueue returns an empty queue that is not persisted until load is called.
+func newPendingQueue() *pendingQueue {
+	return &pendingQueue{entries: make(map[string]map[string]struct{})}
+}
+
+// load attaches the queue to path, restoring the replications saved there as pending.
+func (q *pendingQueue) load(path string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path = path
+	var saved map[string][]string
+	if err := loadJSON(path, "pending replications", &saved); err != nil {
+		return err
+	}
+	for addr, keys := range saved {
+		for _, key := range keys {
+			q.addLocked(addr, key)
+		}
+	}
+	return nil
+}
+
+// add records that key still has to be replicated to the node at addr.
+func (q *pendingQueue) add(addr string, keys ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, key := range keys {
+		q.addLocked(addr, key)
+	}
+	q.saveLocked()
+}
+
+// addLocked adds an entry; the caller must hold mu.
+func (q *pendingQueue) addLocked(addr string, key string) {
+	if q.entries[addr] == nil {
+		q.entries[addr] = make(map[string]struct{})
+	}
+	q.entries[addr][key] = struct{}{}
+}
+
+// remove forgets that key has to be replicated to the node at addr.
+func (q *pendingQueue) remove(addr string, key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.entries[addr], key)
+	if len(q.entries[addr]) == 0 {
+		delete(q.entries, addr)
+	}
+	q.saveLocked()
+}
+
+// drop forgets every key pending for the node at addr.
+func (q *pendingQueue) drop(addr string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.entries[addr]; !ok {
+		return
+	}
+	delete(q.entries, addr)
+	q.saveLocked()
+}
+
+// keys returns the keys pending for the node at addr in sorted order.
+func (q *pendingQueue) keys(addr string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	keys := make([]string, 0, len(q.entries[addr]))
+	for key := range q.entries[addr] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveLocked saves the pending keys of every node; the caller must hold mu.
+func (q *pendingQueue) saveLocked() {
+	if len(q.path) == 0 {
+		return
+	}
+	saved := make(map[string][]string, len(q.entries))
+	for addr, keys := range q.entries {
+		for key := range keys {
+			saved[addr] = append(saved[addr], key)
+		}
+		sort.Strings(saved[addr])
+	}
+	if err := saveJSON(q.path, saved, 0o644); err != nil {
+		log.Printf("persisting pending replications to %s: %s", q.path, err)
+	}
+}
+
+// loadPending attaches the pending replication queue to its file in the storage root.
+func (s *FileServer) loadPending() error {
+	return s.pending.load(filepath.Join(s.Storage.Root, pendingFileName))
+}
+
+// bootstrapAddr returns the seed address of the bootstrap nodes that the remote address belongs
+// to, if any. Seeds named by host name match the addresses their name resolved to when they
+// were last dialed, so no lookup is made on the connection path.
+func (s *FileServer) bootstrapAddr(remote string) (string, bool) {
+	rhost, rport, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", false
+	}
+	rip := net.ParseIP(rhost)
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	for _, addr := range s.seeds {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || port != rport {
+			continue
+		}
+		if len(host) == 0 || host == "localhost" {
+			// Dialing an address without a host connects to the local system.
+			if rip != nil && rip.IsLoopback() {
+				return addr, true
+			}
+			continue
+		}
+		ips := s.seedIPs[addr]
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		}
+		for _, ip := range ips {
+			if ip.Equal(rip) {
+				return addr, true
+			}
+		}
+	}
+	return "", false
+}
+
+// resolveSeed records the addresses the host name of the seed address addr resolves to, for
+// bootstrapAddr to match its connections against. A failed lookup keeps the addresses last
+// recorded; the dial that follows reports it.
+func (s *FileServer) resolveSeed(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || len(host) == 0 || host == "localhost" || net.ParseIP(host) != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), seedLookupTimeout)
+	defer cancel()
+	found, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return
+	}
+	ips := make([]net.IP, 0, len(found))
+	for _, ip := range found {
+		ips = append(ips, ip.IP)
+	}
+	s.peerLock.Lock()
+	s.seedIPs[addr] = ips
+	s.peerLock.Unlock()
+}
+
+// offlineBootstrapNodes returns the seed addresses without a live connection, other than those
+// of nodes that left the cluster.
+func (s *FileServer) offlineBootstrapNodes() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	var offline []string
+	for _, addr := range s.seeds {
+		if _, ok := s.bootstrapPeers[addr]; len(addr) > 0 && !ok && !s.departed[addr] {
+			offline = append(offline, addr)
+		}
+	}
+	return offline
+}
+
+// deferReplication queues keys for every bootstrap node that is currently offline, leaving
+// out the nodes pinned keys are not placed on.
+func (s *FileServer) deferReplication(keys ...string) {
+	for _, addr := range s.offlineBootstrapNodes() {
+		var placed []string
+		for _, key := range keys {
+			if s.placedOn(key, addr) {
+				placed = append(placed, key)
+			}
+		}
+		if len(placed) > 0 {
+			s.pending.add(addr, placed...)
+		}
+	}
+}
+
+// deferFailed queues keys for the bootstrap nodes among peers that a replication failed to
+// reach: those named by a *BroadcastError, or all of them if the replica was never sent.
+func (s *FileServer) deferFailed(err error, peers []p2p.Node, keys ...string) {
+	var addrs []string
+	var berr *BroadcastError
+	if errors.As(err, &berr) {
+		for addr := range berr.Failed() {
+			addrs = append(addrs, addr)
+		}
+	} else {
+		for _, peer := range peers {
+			addrs = append(addrs, peer.RemoteAddr().String())
+		}
+	}
+	for _, addr := range addrs {
+		if baddr, ok := s.bootstrapAddr(addr); ok {
+			s.pending.add(baddr, keys...)
+		}
+	}
+}
+
+// dialLoop connects to a bootstrap node, retrying with exponential backoff until it
+// succeeds, the server is stopped or the address is forgotten as a seed. A node banned with
+// DropPeer is not dialed before its ban runs out.
+func (s *FileServer) dialLoop(addr string) {
+	backoff := minRedialBackoff
+	for {
+		s.peerLock.Lock()
+		_, connected := s.bootstrapPeers[addr]
+		forgotten := s.goneSeeds[addr] || s.selfSeeds[addr]
+		s.peerLock.Unlock()
+		if connected || forgotten {
+			return
+		}
+		if until, banned := s.dialBanned(addr); banned {
+			// A banned node is dialed once its ban runs out.
+			select {
+			case <-s.quitch:
+				return
+			case <-s.Clock.After(until.Sub(s.Clock.Now())):
+			}
+			continue
+		}
+		fmt.Printf("[%s] attempting to connect with remote: %s\n", s.Transport.Addr(), addr)
+		s.resolveSeed(addr)
+		err := s.Transport.Dial(addr)
+		if err == nil {
+			return
+		}
+		log.Printf("[%s] dial error, retrying in %s: %s", s.Transport.Addr(), backoff, err)
+		select {
+		case <-s.quitch:
+			return
+		case <-s.Clock.After(backoff):
+		}
+		backoff = min(2*backoff, maxRedialBackoff)
+	}
+}
+
+// redialWaitLocked returns how long to wait before redialing the bootstrap node at addr, whose
+// connection just closed. A node closing connections soon after they are made, such as one
+// refusing this node, is redialed after a backoff that grows with each such connection rather
+// than at once; the caller must hold peerLock.
+func (s *FileServer) redialWaitLocked(addr string) time.Duration {
+	if s.Clock.Since(s.bootstrapAt[addr]) >= stableConnection {
+		delete(s.redialWait, addr)
+		return 0
+	}
+	wait := min(max(2*s.redialWait[addr], minRedialBackoff), maxRedialBackoff)
+	s.redialWait[addr] = wait
+	return wait
+}
+
+// redialAfter redials the bootstrap node at addr with dialLoop once wait has passed.
+func (s *FileServer) redialAfter(addr string, wait time.Duration) {
+	if wait > 0 {
+		select {
+		case <-s.quitch:
+			return
+		case <-s.Clock.After(wait):
+		}
+	}
+	s.dialLoop(addr)
+}
+
+// drainPending replicates the keys queued for the bootstrap node at addr now that it is
+// connected, limited to CatchUpRate objects per second and CatchUpConcurrency nodes at a time.
+// Keys deleted locally in the meantime are dropped; the rest stay queued if the node drops again.
+func (s *FileServer) drainPending(addr string, peer p2p.Node) {
+	keys := s.pending.keys(addr)
+	if len(keys) == 0 {
+		return
+	}
+	select {
+	case s.catchUpSem <- struct{}{}:
+		defer func() { <-s.catchUpSem }()
+	case <-s.quitch:
+		return
+	}
+	rate := s.CatchUpRate
+	if rate <= 0 {
+		rate = defaultCatchUpRate
+	}
+	interval := time.Second / time.Duration(rate)
+	fmt.Printf("[%s] catching up %s on %d objects\n", s.Transport.Addr(), addr, len(keys))
+	for _, key := range keys {
+		ok, err := s.Storage.Has(s.ID, key)
+		if err != nil {
+			log.Printf("[%s] catch-up of (%s) to %s: %s", s.Transport.Addr(), key, addr, err)
+			continue
+		}
+		if !ok {
+			s.pending.remove(addr, key)
+			continue
+		}
+		if err := s.replicateKey(peer, key); err != nil {
+			log.Printf("[%s] catch-up to %s stopped: %s", s.Transport.Addr(), addr, err)
+			return
+		}
+		s.pending.remove(addr, key)
+		select {
+		case <-s.quitch:
+			return
+		case <-s.Clock.After(interval):
+		}
+	}
+}
+
+// replicateKey sends the local copy of key to a single peer.
+func (s *FileServer) replicateKey(peer p2p.Node, key string) error {
+	return s.replicateKeyTo([]p2p.Node{peer}, key)
+}
+
+// replicateKeyTo sends the local copy of key to peers, as replicate does. A key appended to is
+// encrypted with the IV recorded for its replicas, so the peers' replicas can take later appends.
+func (s *FileServer) replicateKeyTo(peers []p2p.Node, key string) (err error) {
+	_, r, err := s.Storage.Read(s.ID, key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() {
+			err = errors.Join(err, rc.Close())
+		}()
+	}
+	// Read once the object is open: a write replacing it since clears the IV, so the IV is
+	// never used for content other than what it encrypted before.
+	meta, _ := s.Storage.Metadata(s.ID, key)
+	rep, err := s.prepareReplicaIV(key, meta.ReplicaIV, r)
+	if err != nil {
+		return err
+	}
+	rep.version = meta.Version
+	_, err = s.replicate(peers, rep)
+	return err
+}
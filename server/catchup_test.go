@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingQueuePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), pendingFileName)
+	q := newPendingQueue()
+	require.NoError(t, q.load(path))
+	q.add(":4001", "b", "a")
+	q.add(":4002", "c")
+	q.remove(":4002", "c")
+
+	reloaded := newPendingQueue()
+	require.NoError(t, reloaded.load(path))
+	assert.Equal(t, []string{"a", "b"}, reloaded.keys(":4001"))
+	assert.Empty(t, reloaded.keys(":4002"))
+}
+
+func TestCatchUpAfterReconnect(t *testing.T) {
+	b := makeServer(t, ":4001")
+	a := makeServer(t, ":4000", ":4001")
+	startCluster(t, b, a)
+
+	// Take b offline: stop it and drop its connections so a notices.
+	b.Stop()
+	for _, peer := range b.peerList() {
+		require.NoError(t, peer.Close())
+	}
+	waitFor(t, func() bool { return len(a.peerList()) == 0 })
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("offline_%d", i)
+		require.NoError(t, a.Store(keys[i], bytes.NewReader([]byte(keys[i]))))
+	}
+	assert.Len(t, a.pending.keys(":4001"), len(keys))
+
+	// A node coming back on b's address receives everything it missed.
+	c := makeServer(t, ":4001")
+	startCluster(t, c)
+	require.Eventually(t, func() bool {
+		for _, key := range keys {
+			if ok, _ := c.Storage.Has(a.ID, crypto.HashKey(key)); !ok {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return len(a.pending.keys(":4001")) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestDialLoopBackoff(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	var dials atomic.Int32
+	s := NewFileServer(FileServerOpts{
+		StorageRoot: t.TempDir(),
+		Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{
+			ListenAddr:    ":4000",
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+			Connect: func(string, string) (net.Conn, error) {
+				dials.Add(1)
+				return nil, syscall.ECONNREFUSED
+			},
+		}),
+		Clock: clk,
+	})
+	done := make(chan struct{})
+	go func() {
+		s.dialLoop(":4001")
+		close(done)
+	}()
+
+	// Every failed dial waits twice as long as the last one before redialing, up to the maximum.
+	backoffs := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		1600 * time.Millisecond, 3200 * time.Millisecond, maxRedialBackoff, maxRedialBackoff,
+	}
+	for i, backoff := range backoffs {
+		clk.BlockUntil(1)
+		require.Equal(t, int32(i+1), dials.Load())
+		clk.Advance(backoff - time.Nanosecond)
+		assert.Equal(t, int32(i+1), dials.Load(), "redialed before the backoff ran out")
+		clk.Advance(time.Nanosecond)
+	}
+	clk.BlockUntil(1)
+	assert.Equal(t, int32(len(backoffs)+1), dials.Load())
+
+	s.Stop()
+	<-done
+}
+
+func TestBootstrapAddrMatchesResolvedSeeds(t *testing.T) {
+	s := NewFileServer(FileServerOpts{StorageRoot: t.TempDir(), Transport: p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":4000"})})
+	s.seeds = []string{"node1:3000", "10.0.0.9:3000", ":3001"}
+	// A seed named by host name matches only the addresses recorded when it was dialed.
+	_, ok := s.bootstrapAddr("10.0.0.7:3000")
+	assert.False(t, ok, "node1 was never resolved")
+	s.seedIPs["node1:3000"] = []net.IP{net.ParseIP("10.0.0.7")}
+	addr, ok := s.bootstrapAddr("10.0.0.7:3000")
+	assert.True(t, ok)
+	assert.Equal(t, "node1:3000", addr)
+	_, ok = s.bootstrapAddr("10.0.0.7:3001")
+	assert.False(t, ok)
+
+	addr, _ = s.bootstrapAddr("10.0.0.9:3000")
+	assert.Equal(t, "10.0.0.9:3000", addr)
+	addr, _ = s.bootstrapAddr("127.0.0.1:3001")
+	assert.Equal(t, ":3001", addr)
+
+	// Addresses given as IPs and the local system are never looked up.
+	s.resolveSeed("10.0.0.9:3000")
+	s.resolveSeed(":3001")
+	assert.Len(t, s.seedIPs, 1)
+}
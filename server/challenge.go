@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	mrand "math/rand"
+	"slices"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultChallengeSampleRate is the fraction of this node's objects whose replicas are
+	// challenged in each round when ChallengeSampleRate is not set.
+	defaultChallengeSampleRate = 0.01
+	// challengeLength is the most bytes of a replica one challenge has its holder hash, so a
+	// challenge costs the holder a small read whatever the size of the object.
+	challengeLength = 4 << 10
+	// challengeTimeout bounds the wait for the answer to a challenge, past which the replica
+	// is suspect.
+	challengeTimeout = 10 * time.Second
+)
+
+// FindingSuspect is the kind of VerifyFinding reported for replicas that failed a challenge.
+const FindingSuspect = "suspect"
+
+// MessageChallenge asks a peer to prove it holds a replica by hashing a range of the bytes it
+// stored, the encrypted object, with a key only this request carries. The peer answers with a
+// challengeResponse.
+type MessageChallenge struct {
+	ID     string // Identifier of the node owning the object
+	Key    string // Hashed key of the replica
+	Nonce  []byte // Key of the HMAC, drawn at random for each challenge
+	Offset int64  // First byte of the range hashed
+	Length int64  // Bytes in the range, at most challengeLength
+}
+
+// challengeResponse is the stream sent in answer to MessageChallenge.
+type challengeResponse struct {
+	Missing bool   // Whether the peer holds no copy
+	Size    int64  // Bytes of the copy held
+	Version uint64 // Version of the copy, zero when its key is not versioned
+	IV      []byte // IV the copy starts with, so the challenger can encrypt the range itself
+	MAC     []byte // HMAC-SHA256 of the range, keyed with the nonce
+	Err     string // Why the challenge could not be answered
+}
+
+// ChallengeReport is the outcome of ChallengeReplicas.
+type ChallengeReport struct {
+	Challenged int             `json:"challenged"` // Replicas challenged
+	Suspect    []VerifyFinding `json:"suspect"`    // Replicas that failed, as FindingSuspect findings
+}
+
+// challengeSampleRate returns the fraction of objects whose replicas are challenged in a
+// round, negative when VerifyCluster challenges none.
+func (s *FileServer) challengeSampleRate() float64 {
+	if s.ChallengeSampleRate == 0 {
+		return defaultChallengeSampleRate
+	}
+	return s.ChallengeSampleRate
+}
+
+// ChallengeReplicas picks each of this node's objects with probability rate and challenges
+// every peer it is placed on to prove it still holds the replica: the peer hashes a random
+// range of its copy, which is compared with the same range encrypted from this node's copy.
+// Replicas that are missing, of the wrong size, hash differently or go unanswered are
+// suspect; each is sent again to its peer, or placed on another peer if that fails.
+//
+// Returns: The replicas challenged and those found suspect.
+func (s *FileServer) ChallengeReplicas(rate float64) ChallengeReport {
+	var report ChallengeReport
+	keys, err := s.Storage.Keys(s.ID)
+	if err != nil {
+		log.Printf("[%s] listing keys to challenge: %s", s.Transport.Addr(), err)
+		return report
+	}
+	for _, key := range keys {
+		if mrand.Float64() >= rate {
+			continue
+		}
+		peers, _ := s.peersWith(s.placement(key, s.peerList()), func(caps peerCaps) bool { return caps.proofs })
+		for _, peer := range peers {
+			detail, ok := s.challenge(peer, key)
+			if detail == "" && !ok {
+				continue
+			}
+			report.Challenged++
+			s.metrics.replicasChallenged.Add(1)
+			if ok {
+				continue
+			}
+			id := peerPlacementNode(peer).id
+			report.Suspect = append(report.Suspect, VerifyFinding{Kind: FindingSuspect, Owner: s.ID, Key: key, Nodes: []string{id}, Detail: detail})
+			s.metrics.replicasSuspect.Add(1)
+			log.Printf("[%s] replica of (%s) on (%s) is suspect: %s", s.Transport.Addr(), key, peer.RemoteAddr(), detail)
+			if err := s.rereplicate(key, peer); err != nil {
+				log.Printf("[%s] replicating (%s) again: %s", s.Transport.Addr(), key, err)
+			}
+		}
+	}
+	return report
+}
+
+// challenge asks the peer to prove it holds the replica of key.
+//
+// Returns: Whether the replica passed, and why it did not; a replica that was not challenged,
+// because this node's copy is gone or the peer holds another version, neither passed nor
+// failed, with an empty reason.
+func (s *FileServer) challenge(peer p2p.Node, key string) (detail string, ok bool) {
+	meta, err := s.Storage.Stat(s.ID, key)
+	if err != nil {
+		return "", false
+	}
+	size := crypto.Overhead + meta.PlainSize
+	msg := MessageChallenge{ID: s.ID, Key: crypto.HashKey(key), Nonce: make([]byte, sha256.Size), Offset: mrand.Int63n(size)}
+	msg.Length = min(challengeLength, size-msg.Offset)
+	if _, err := rand.Read(msg.Nonce); err != nil {
+		return "", false
+	}
+	var resp challengeResponse
+	if err := s.exchange(peer, &Message{Payload: msg}, &resp, challengeTimeout); err != nil {
+		return "no answer: " + err.Error(), false
+	}
+	switch {
+	case len(resp.Err) > 0:
+		return "could not hash its copy: " + resp.Err, false
+	case resp.Missing:
+		return "holds no copy", false
+	case resp.Version != meta.Version:
+		// Which version is right is for VerifyCluster to report.
+		return "", false
+	case resp.Size != size:
+		return fmt.Sprintf("holds %d bytes, %d expected", resp.Size, size), false
+	case len(resp.IV) != aes.BlockSize:
+		return "sent an invalid IV", false
+	}
+	want, err := s.challengeMAC(key, msg, resp.IV)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(want, resp.MAC) {
+		return fmt.Sprintf("bytes %d to %d differ", msg.Offset, msg.Offset+msg.Length), false
+	}
+	return "", true
+}
+
+// challengeMAC computes the answer to a challenge from this node's copy of key, encrypting
+// the range with the IV the peer's copy starts with.
+//
+// Returns: The HMAC of the range and any errors reading the copy.
+func (s *FileServer) challengeMAC(key string, msg MessageChallenge, iv []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, msg.Nonce)
+	end := msg.Offset + msg.Length
+	if msg.Offset < int64(len(iv)) {
+		mac.Write(iv[msg.Offset:min(end, int64(len(iv)))])
+	}
+	start := max(msg.Offset-int64(len(iv)), 0)
+	if plainEnd := end - int64(len(iv)); plainEnd > start {
+		_, r, err := s.Storage.Read(s.ID, key)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+		if _, err := io.CopyN(io.Discard, r, start); err != nil {
+			return nil, err
+		}
+		if _, err := crypto.CopyEncryptAt(s.dataKey(key), iv, start, io.LimitReader(r, plainEnd-start), mac); err != nil {
+			return nil, err
+		}
+	}
+	return mac.Sum(nil), nil
+}
+
+// handleMessageChallenge answers a MessageChallenge by hashing the range of the replica asked
+// for. A challenge that could not be answered still gets a response, so the requester's
+// connection stays in sync.
+func (s *FileServer) handleMessageChallenge(from string, q query, msg MessageChallenge) error {
+	return s.sendValue(from, q, s.answerChallenge(msg))
+}
+
+// answerChallenge hashes the range of a replica a MessageChallenge asks for.
+func (s *FileServer) answerChallenge(msg MessageChallenge) challengeResponse {
+	if msg.Offset < 0 || msg.Length < 0 || msg.Length > challengeLength {
+		return challengeResponse{Err: fmt.Sprintf("invalid range of %d bytes at %d", msg.Length, msg.Offset)}
+	}
+	size, r, err := s.Storage.Read(msg.ID, msg.Key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return challengeResponse{Missing: true}
+	}
+	if err != nil {
+		return challengeResponse{Err: err.Error()}
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	resp := challengeResponse{Size: size, IV: make([]byte, aes.BlockSize)}
+	if meta, err := s.Storage.Metadata(msg.ID, msg.Key); err == nil {
+		resp.Version = meta.Version
+	}
+	n, err := io.ReadFull(r, resp.IV)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return challengeResponse{Err: err.Error()}
+	}
+	resp.IV = resp.IV[:n]
+	// A short copy is hashed as far as it goes, and fails the challenge on its size.
+	content := io.MultiReader(bytes.NewReader(resp.IV), r)
+	mac := hmac.New(sha256.New, msg.Nonce)
+	if _, err := io.CopyN(io.Discard, content, msg.Offset); err == nil {
+		if _, err := io.CopyN(mac, content, msg.Length); err != nil && !errors.Is(err, io.EOF) {
+			return challengeResponse{Err: err.Error()}
+		}
+	} else if !errors.Is(err, io.EOF) {
+		return challengeResponse{Err: err.Error()}
+	}
+	resp.MAC = mac.Sum(nil)
+	return resp
+}
+
+// rereplicate sends this node's copy of key to the peer whose replica failed a challenge, in
+// place of that replica. If the peer cannot take it, the replica is placed on a connected
+// peer the object is not placed on yet, so the count of healthy replicas is kept.
+func (s *FileServer) rereplicate(key string, suspect p2p.Node) error {
+	meta, err := s.Storage.Metadata(s.ID, key)
+	if err != nil {
+		return err
+	}
+	_, r, err := s.Storage.Read(s.ID, key)
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	rep, err := s.prepareReplicaIV(key, meta.ReplicaIV, r)
+	if err != nil {
+		return err
+	}
+	rep.version = meta.Version
+	// The suspect copy counts as delivered, so it would not be pushed again.
+	s.pushes.forget(objectRef{owner: s.ID, key: rep.key})
+	_, err = s.replicate([]p2p.Node{suspect}, rep)
+	if err == nil {
+		return nil
+	}
+	placed := s.placement(key, s.peerList())
+	for _, peer := range replicaPeers(s.peerList()) {
+		if peer == suspect || slices.Contains(placed, peer) {
+			continue
+		}
+		if _, perr := s.replicate([]p2p.Node{peer}, rep); perr == nil {
+			log.Printf("[%s] placed (%s) on (%s) in place of the replica on (%s)", s.Transport.Addr(), key, peer.RemoteAddr(), suspect.RemoteAddr())
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// truncateReplica cuts the replica of owner's key held by holder short on disk, as a lost
+// write would, leaving its metadata claiming the whole object.
+func truncateReplica(t *testing.T, holder *FileServer, owner *FileServer, key string) {
+	t.Helper()
+	path := fmt.Sprintf("%s/%s/%s", holder.StorageRoot, owner.ID, storage.CASPathTransformFuncSHA256(crypto.HashKey(key)).FullPath())
+	require.NoError(t, os.Truncate(path, 100))
+	has, err := holder.Storage.Has(owner.ID, crypto.HashKey(key))
+	require.NoError(t, err)
+	require.True(t, has, "the truncated replica should still be reported")
+}
+
+func TestChallengeFlagsTruncatedReplica(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	data := randomData(t, 64<<10)
+	require.NoError(t, a.Store("report", bytes.NewReader(data)))
+	waitFor(t, func() bool { return replicaCount(a, "report", b, c) == 2 })
+
+	report := a.ChallengeReplicas(1)
+	assert.Equal(t, 2, report.Challenged)
+	assert.Empty(t, report.Suspect, "healthy replicas should pass")
+
+	truncateReplica(t, c, a, "report")
+	report = a.ChallengeReplicas(1)
+	assert.Equal(t, 2, report.Challenged)
+	require.Len(t, report.Suspect, 1)
+	assert.Equal(t, FindingSuspect, report.Suspect[0].Kind)
+	assert.Equal(t, []string{c.ID}, report.Suspect[0].Nodes)
+	assert.Equal(t, "report", report.Suspect[0].Key)
+	assert.Equal(t, int64(1), a.Metrics()["replicas_suspect"])
+
+	// The replica was sent again in place of the truncated one.
+	waitFor(t, func() bool { return replicaContent(t, c, a, "report") == string(data) })
+	assert.Empty(t, a.ChallengeReplicas(1).Suspect)
+}
+
+func TestDeepVerifyChallengesReplicas(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.ChallengeSampleRate = 1
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	data := randomData(t, 16<<10)
+	require.NoError(t, a.Store("report", bytes.NewReader(data)))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 1 })
+	truncateReplica(t, b, a, "report")
+
+	report := a.VerifyCluster(true)
+	assert.Equal(t, 1, report.Challenged)
+	assert.Contains(t, report.Findings, VerifyFinding{Kind: FindingSuspect, Owner: a.ID, Key: "report", Nodes: []string{b.ID},
+		Detail: fmt.Sprintf("holds 100 bytes, %d expected", 16+len(data))})
+	waitFor(t, func() bool { return replicaContent(t, b, a, "report") == string(data) })
+	assert.True(t, a.VerifyCluster(true).Healthy(), "the replica should have been restored")
+	assert.Zero(t, a.VerifyCluster(false).Challenged, "a shallow verification challenges nothing")
+}
+
+func TestChallengeLoop(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.ChallengeInterval = 20 * time.Millisecond
+	a.ChallengeSampleRate = 1
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	data := randomData(t, 16<<10)
+	require.NoError(t, a.Store("report", bytes.NewReader(data)))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 1 })
+	truncateReplica(t, b, a, "report")
+	waitFor(t, func() bool { return replicaContent(t, b, a, "report") == string(data) })
+	assert.Positive(t, a.Metrics()["replicas_suspect"])
+}
+
+func TestChallengeFlagsDamagedReplica(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	// Each challenge of so small an object hashes from a random offset to its end, the IV included.
+	require.NoError(t, a.Store("tiny", bytes.NewReader([]byte("ten bytes!"))))
+	waitFor(t, func() bool { return replicaCount(a, "tiny", b) == 1 })
+	for range 20 {
+		require.Empty(t, a.ChallengeReplicas(1).Suspect)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s", b.StorageRoot, a.ID, storage.CASPathTransformFuncSHA256(crypto.HashKey("tiny")).FullPath())
+	stored, err := os.ReadFile(path)
+	require.NoError(t, err)
+	stored[len(stored)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, stored, 0o644))
+	report := a.ChallengeReplicas(1)
+	require.Len(t, report.Suspect, 1)
+	assert.Contains(t, report.Suspect[0].Detail, "differ")
+	waitFor(t, func() bool { return replicaContent(t, b, a, "tiny") == "ten bytes!" })
+}
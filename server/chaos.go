@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// chaosEnv is the environment variable that, set to "1", lets a build without the chaos tag
+// inject faults.
+const chaosEnv = "DFS_CHAOS"
+
+const (
+	// defaultChaosHandlerDelay is the longest a message's handling is delayed when
+	// MaxHandlerDelay is not set.
+	defaultChaosHandlerDelay = 100 * time.Millisecond
+	// defaultChaosInterval is how often a peer may be disconnected when Interval is not set.
+	defaultChaosInterval = time.Second
+)
+
+// ErrChaosDisabled is returned by Start when FileServerOpts.Chaos is set but fault injection
+// was not enabled, by building with the chaos tag or setting DFS_CHAOS=1.
+var ErrChaosDisabled = errors.New("chaos injection is not enabled")
+
+// ChaosConfig makes a node inject faults into its own work, for soak tests and staging
+// clusters exercising failure paths. Each fault is drawn with its own probability from a
+// random source seeded by Seed, so a seed draws the same sequence of faults every run, though
+// which operation each lands on depends on timing. Every fault injected is logged with a
+// "chaos:" marker and counted in the chaos_* metrics.
+//
+// Fields:
+//   - Seed: Seeds the random sources faults are drawn from.
+//   - HandlerDelay: Probability that handling a message from a peer is delayed.
+//   - MaxHandlerDelay: Longest delay, defaults to defaultChaosHandlerDelay.
+//   - DropControl: Probability that a delete, pin, pruned version, notification or
+//     acknowledgement is not sent to a peer.
+//   - DiskFull: Probability that writing an object fails as if the disk were full.
+//   - Disconnect: Probability, every Interval, that the connection to a peer is closed.
+//   - Interval: How often a peer may be disconnected, defaults to defaultChaosInterval.
+type ChaosConfig struct {
+	Seed            int64
+	HandlerDelay    float64
+	MaxHandlerDelay time.Duration
+	DropControl     float64
+	DiskFull        float64
+	Disconnect      float64
+	Interval        time.Duration
+}
+
+// chaosFault is a kind of fault, each drawn from a random source of its own.
+type chaosFault int
+
+const (
+	chaosDelay chaosFault = iota
+	chaosDrop
+	chaosDiskFull
+	chaosDisconnect
+	chaosFaults
+)
+
+// chaos draws the faults a node injects.
+type chaos struct {
+	mu      sync.Mutex
+	cfg     ChaosConfig
+	sources [chaosFaults]*rand.Rand // Random source of each kind of fault
+}
+
+// newChaos returns the faults drawn for cfg, with its defaults filled in.
+func newChaos(cfg ChaosConfig) *chaos {
+	if cfg.MaxHandlerDelay <= 0 {
+		cfg.MaxHandlerDelay = defaultChaosHandlerDelay
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultChaosInterval
+	}
+	c := &chaos{cfg: cfg}
+	for i := range c.sources {
+		c.sources[i] = rand.New(rand.NewSource(cfg.Seed + int64(i)))
+	}
+	return c
+}
+
+// chaosAllowed reports whether this process may inject faults.
+func chaosAllowed() bool {
+	return chaosBuild || os.Getenv(chaosEnv) == "1"
+}
+
+// probability returns the probability of a kind of fault; the caller must hold mu.
+func (c *chaos) probability(fault chaosFault) float64 {
+	switch fault {
+	case chaosDelay:
+		return c.cfg.HandlerDelay
+	case chaosDrop:
+		return c.cfg.DropControl
+	case chaosDiskFull:
+		return c.cfg.DiskFull
+	case chaosDisconnect:
+		return c.cfg.Disconnect
+	}
+	return 0
+}
+
+// roll draws whether to inject a fault. A nil chaos never injects any.
+func (c *chaos) roll(fault chaosFault) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.probability(fault)
+	return p > 0 && c.sources[fault].Float64() < p
+}
+
+// intn draws a number in [0, n) from the source of a kind of fault.
+func (c *chaos) intn(fault chaosFault, n int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sources[fault].Int63n(n)
+}
+
+// pause stops every kind of fault from being injected from now on.
+func (c *chaos) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg.HandlerDelay, c.cfg.DropControl, c.cfg.DiskFull, c.cfg.Disconnect = 0, 0, 0, 0
+}
+
+// startChaos sets up the faults of Chaos, refusing them unless fault injection is enabled.
+func (s *FileServer) startChaos() error {
+	if s.Chaos == nil {
+		return nil
+	}
+	if !chaosAllowed() {
+		return fmt.Errorf("%w: build with -tags chaos or set %s=1", ErrChaosDisabled, chaosEnv)
+	}
+	s.chaos = newChaos(*s.Chaos)
+	s.Storage.WrapWrites = s.chaosWrites
+	log.Printf("[%s] chaos: injecting faults with seed %d", s.Transport.Addr(), s.Chaos.Seed)
+	go s.chaosLoop()
+	return nil
+}
+
+// chaosDelay sometimes holds up handling a message from a peer.
+func (s *FileServer) chaosDelay(from string, msg *Message) {
+	if !s.chaos.roll(chaosDelay) {
+		return
+	}
+	d := time.Duration(s.chaos.intn(chaosDelay, int64(s.chaos.cfg.MaxHandlerDelay)))
+	s.metrics.chaosDelays.Add(1)
+	log.Printf("[%s] chaos: delaying %T from (%s) by %s", s.Transport.Addr(), msg.Payload, from, d)
+	select {
+	case <-s.Clock.After(d):
+	case <-s.quitch:
+	}
+}
+
+// chaosDrop sometimes leaves peers out of sending a control message.
+//
+// Returns: The peers to send the message to.
+func (s *FileServer) chaosDrop(peers []p2p.Node, msg *Message) []p2p.Node {
+	if s.chaos == nil {
+		return peers
+	}
+	kept := peers[:0:0]
+	for _, peer := range peers {
+		if s.chaos.roll(chaosDrop) {
+			s.metrics.chaosDropped.Add(1)
+			log.Printf("[%s] chaos: dropping %T to (%s)", s.Transport.Addr(), msg.Payload, peer.RemoteAddr())
+			continue
+		}
+		kept = append(kept, peer)
+	}
+	return kept
+}
+
+// chaosWrites wraps the file an object is written through, sometimes failing the write as if
+// the disk were full.
+func (s *FileServer) chaosWrites(w io.Writer) io.Writer {
+	if !s.chaos.roll(chaosDiskFull) {
+		return w
+	}
+	s.metrics.chaosDiskFull.Add(1)
+	log.Printf("[%s] chaos: failing an object write with ENOSPC", s.Transport.Addr())
+	return chaosFullDisk{}
+}
+
+// chaosFullDisk is a file on a disk that has filled up.
+type chaosFullDisk struct{}
+
+// Write fails with ENOSPC.
+func (chaosFullDisk) Write([]byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "chaos", Err: syscall.ENOSPC}
+}
+
+// chaosLoop sometimes closes the connection to a peer, every Interval until the server is
+// stopped.
+func (s *FileServer) chaosLoop() {
+	ticker := s.Clock.NewTicker(s.chaos.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			peers := s.peerList()
+			if len(peers) == 0 || !s.chaos.roll(chaosDisconnect) {
+				continue
+			}
+			// Peers are ordered so the seed picks the same one given the same peers.
+			sort.Slice(peers, func(i, j int) bool {
+				return peers[i].RemoteAddr().String() < peers[j].RemoteAddr().String()
+			})
+			peer := peers[s.chaos.intn(chaosDisconnect, int64(len(peers)))]
+			s.metrics.chaosDisconnects.Add(1)
+			log.Printf("[%s] chaos: disconnecting (%s)", s.Transport.Addr(), peer.RemoteAddr())
+			peer.Close()
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !chaos
+
+package server
+
+// chaosBuild is false outside builds with the chaos tag, where FileServerOpts.Chaos is only
+// honoured with DFS_CHAOS=1 set.
+const chaosBuild = false
@@ -0,0 +1,6 @@
+//go:build chaos
+
+package server
+
+// chaosBuild lets FileServerOpts.Chaos inject faults without DFS_CHAOS being set.
+const chaosBuild = true
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosRequiresGuard(t *testing.T) {
+	if chaosBuild {
+		t.Skip("built with the chaos tag")
+	}
+	t.Setenv(chaosEnv, "")
+	network := p2p.NewMemoryNetwork(1)
+	s := makeMemoryServer(t, network, ":4000")
+	s.Chaos = &ChaosConfig{DropControl: 1}
+	err := s.Start()
+	assert.ErrorIs(t, err, ErrChaosDisabled)
+}
+
+func TestChaosDropsControlFrames(t *testing.T) {
+	t.Setenv(chaosEnv, "1")
+	network := p2p.NewMemoryNetwork(1)
+	clk := clock.NewFake(time.Unix(0, 0))
+	a := makeMemoryServer(t, network, ":4000")
+	// The delete is sent again only once the test moves a's clock, and goes out at once.
+	a.Clock = clk
+	a.CoalesceWindow = -1
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+	require.NoError(t, a.Store("report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 1 })
+
+	// Faults start once the cluster is up, so its setup is not disturbed.
+	a.chaos = newChaos(ChaosConfig{Seed: 1, DropControl: 1})
+	require.NoError(t, a.Delete("report"))
+	waitFor(t, func() bool { return a.Metrics()["chaos_frames_dropped"] >= 1 })
+	settle(t, a, b)
+	assert.Equal(t, 1, replicaCount(a, "report", b), "the delete should have been dropped")
+
+	// Once faults stop, the delete is sent again and applied.
+	a.chaos.pause()
+	clk.Advance(a.ackRetryInterval())
+	a.retryReliable(a.peerList()[0])
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 0 })
+}
+
+func TestChaosFailsWrites(t *testing.T) {
+	t.Setenv(chaosEnv, "1")
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.Chaos = &ChaosConfig{Seed: 1, DiskFull: 1}
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	err := a.Store("report", bytes.NewReader([]byte("draft")))
+	assert.True(t, errors.Is(err, ErrNoSpace) && errors.Is(err, syscall.ENOSPC), "got %v", err)
+	assert.Equal(t, int64(1), a.Metrics()["chaos_disk_full"])
+}
+
+func TestChaosSeedRepeats(t *testing.T) {
+	draw := func() []bool {
+		c := newChaos(ChaosConfig{Seed: 42, HandlerDelay: 0.5, DropControl: 0.5})
+		var faults []bool
+		for range 20 {
+			faults = append(faults, c.roll(chaosDelay), c.roll(chaosDrop))
+		}
+		return faults
+	}
+	assert.Equal(t, draw(), draw())
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"maps"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// StartupCheck selects what Start does with the storage consistency check.
+type StartupCheck int
+
+const (
+	CheckRepair StartupCheck = iota // Check the store and repair what is found, the default
+	CheckDetect                     // Check the store and only report what is found
+	CheckOff                        // Skip the check
+)
+
+// checkStorage runs the storage consistency check for every owner with objects in the store
+// and logs what it found. After a repair this node's own objects that were indexed but
+// missing are fetched back from the cluster once a peer connects.
+func (s *FileServer) checkStorage() error {
+	if s.StartupCheck == CheckOff {
+		return nil
+	}
+	ids, err := s.Storage.Owners()
+	if err != nil {
+		return err
+	}
+	repair := s.StartupCheck == CheckRepair
+	reports := make(map[string]storage.CheckReport, len(ids))
+	var refetch []string
+	for _, id := range ids {
+		report, err := s.Storage.Check(id, repair)
+		if err != nil {
+			return fmt.Errorf("checking storage of (%s): %w", id, err)
+		}
+		reports[id] = report
+		if report.Clean() {
+			continue
+		}
+		log.Printf("[%s] storage check of (%s): %s", s.Transport.Addr(), id, report)
+		if report.Repaired && id == s.ID {
+			refetch = append(refetch, report.Missing...)
+		}
+	}
+	s.checkMu.Lock()
+	s.checks = reports
+	s.checkMu.Unlock()
+	if len(refetch) > 0 {
+		go s.prefetchOnceConnected(refetch)
+	}
+	return nil
+}
+
+// CheckReports returns the reports of the storage check run at startup by owner ID. It is
+// empty before Start and when the check is off.
+func (s *FileServer) CheckReports() map[string]storage.CheckReport {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+	return maps.Clone(s.checks)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartupCheckRefetchesMissing(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+	require.NoError(t, a.Store("kept", bytes.NewReader([]byte("still on disk"))))
+	require.NoError(t, a.Store("lost", bytes.NewReader([]byte("only on b"))))
+	waitFor(t, func() bool {
+		ok, err := b.Storage.Has(a.ID, crypto.HashKey("lost"))
+		return err == nil && ok
+	})
+	a.Stop()
+	for _, peer := range a.peerList() {
+		require.NoError(t, peer.Close())
+	}
+	waitFor(t, func() bool { return len(b.peerList()) == 0 })
+	// The storage root is released before the listener closes.
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", ":4000")
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+
+	// The node goes down losing an object its index still lists, and a write in progress.
+	root := a.Storage.Root
+	require.NoError(t, os.Remove(filepath.Join(root, a.ID, a.Storage.PathTransformFunc("lost").FullPath())))
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".dfs-probe-crashed"), nil, 0o644))
+
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":4002",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	opts := a.FileServerOpts
+	opts.Transport = tr
+	opts.BootstrapNodes = []string{":4001"}
+	c := NewFileServer(opts)
+	tr.HandshakeFunc = c.Handshake
+	tr.OnNode = c.OnNode
+	tr.OnNodeClosed = c.OnNodeClosed
+	startCluster(t, c)
+
+	waitFor(t, func() bool { return len(c.CheckReports()) > 0 })
+	report := c.CheckReports()[c.ID]
+	assert.True(t, report.Repaired)
+	assert.Equal(t, []string{"lost"}, report.Missing)
+	assert.Equal(t, []string{".dfs-probe-crashed"}, report.TempFiles)
+	assert.NoFileExists(t, filepath.Join(root, ".dfs-probe-crashed"))
+	waitFor(t, func() bool {
+		ok, err := c.Storage.Has(c.ID, "lost")
+		return err == nil && ok
+	})
+	got, err := readKey(c, "lost")
+	require.NoError(t, err)
+	assert.Equal(t, "only on b", string(got))
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// Version is the release of this node, reported to operators by ClusterInfo. Release
+// builds set it with -ldflags "-X .../server.Version=...".
+var Version = "dev"
+
+// nodeInfoTimeout bounds how long ClusterInfo waits for each peer.
+const nodeInfoTimeout = 2 * time.Second
+
+// MessageNodeInfo asks a peer to describe itself with a NodeInfo.
+type MessageNodeInfo struct{}
+
+// NodeInfo describes one node of the cluster.
+type NodeInfo struct {
+	ID              string                           `json:"id"`                        // Node ID
+	Addr            string                           `json:"addr"`                      // Address the node listens on, or the address it was reached at
+	Version         string                           `json:"version"`                   // Release of the node
+	ProtocolVersion uint16                           `json:"protocol_version"`          // Wire protocol version spoken by the node
+	Uptime          time.Duration                    `json:"uptime"`                    // Time since the node was started
+	Peers           int                              `json:"peers"`                     // Number of connected peers
+	Objects         int                              `json:"objects"`                   // Objects held on disk, for every owner
+	Pinned          int                              `json:"pinned,omitempty"`          // Objects pinned to the node with Pin
+	Bytes           int64                            `json:"bytes"`                     // Size of the objects held on disk
+	Labels          map[string]string                `json:"labels,omitempty"`          // Labels the node advertises, such as zone
+	OriginBytes     map[string]int64                 `json:"origin_bytes,omitempty"`    // Bytes held on disk by owner node ID
+	OriginRejected  map[string]int64                 `json:"origin_rejected,omitempty"` // Replicas refused for exceeding their origin's quota, by owner node ID
+	ReceiveRates    map[string]int64                 `json:"receive_rates,omitempty"`   // Bytes per second replicas recently arrived at, by sending peer address; low rates point at a slow disk
+	WritesRefused   string                           `json:"writes_refused,omitempty"`  // Why the node refuses stores and replicas, such as a full disk; empty while it accepts them
+	ClockOffset     *time.Duration                   `json:"clock_offset,omitempty"`    // How far the node's clock is ahead of the queried node's, negative when behind; nil for the queried node and peers not measured yet
+	ClockSkewed     bool                             `json:"clock_skewed,omitempty"`    // Whether ClockOffset is past the queried node's MaxClockSkew
+	ClockUntrusted  bool                             `json:"clock_untrusted,omitempty"` // Whether ClockOffset is past the queried node's ExcludeClockSkew, so read repair ignores the write times of the node's copies
+	DegradedIO      string                           `json:"degraded_io,omitempty"`     // Why the node's disk IO counts as degraded by its SlowIOLatency and SlowIOThroughput; empty while it does not
+	IO              map[storage.IOOp]storage.OpStats `json:"io,omitempty"`              // Recent timing of the node's disk writes, reads and deletes, by kind
+	Overloaded      string                           `json:"overloaded,omitempty"`      // Why the node counts as overloaded, having refused requests past its admission limits for a sustained time; empty while it does not
+	Err             string                           `json:"error,omitempty"`           // Why the node could not be described, e.g. it is unreachable
+}
+
+// Stats describes this node.
+//
+// Returns: Information about the node and any errors reading its storage usage.
+func (s *FileServer) Stats() (NodeInfo, error) {
+	info := NodeInfo{
+		ID:              s.ID,
+		Addr:            s.Transport.Addr(),
+		Version:         Version,
+		ProtocolVersion: p2p.ProtocolVersion,
+		Peers:           len(s.peerList()),
+		Labels:          s.Labels,
+		Pinned:          s.pins.count(s.ID),
+	}
+	if started := s.startedAt.Load(); started != nil {
+		info.Uptime = s.Clock.Since(*started)
+	}
+	var err error
+	info.Objects, info.Bytes, err = s.Storage.Usage()
+	if err != nil {
+		return info, err
+	}
+	info.OriginBytes, err = s.Storage.UsageByOwner()
+	info.OriginRejected = s.originRejections()
+	info.ReceiveRates = s.receiveStats.snapshot()
+	if err := s.ReadyForWrites(); err != nil {
+		info.WritesRefused = err.Error()
+	}
+	disk := s.Storage.Stats()
+	info.DegradedIO, info.IO = disk.Degraded, disk.Ops
+	info.Overloaded = s.admission.overloaded()
+	return info, err
+}
+
+// ClusterInfo describes this node followed by every connected peer. Peers that do not answer
+// are still listed, with Err set and their ID and labels taken from the handshake. Peers
+// carry the offset of their clock this node measured.
+func (s *FileServer) ClusterInfo() []NodeInfo {
+	self, err := s.Stats()
+	if err != nil {
+		self.Err = err.Error()
+	}
+	nodes := []NodeInfo{self}
+	for _, peer := range s.peerList() {
+		var info NodeInfo
+		if err := s.exchange(peer, &Message{Payload: MessageNodeInfo{}}, &info, nodeInfoTimeout); err != nil {
+			hello := peer.Hello()
+			info = NodeInfo{
+				ID:              hello.NodeID,
+				Addr:            peer.RemoteAddr().String(),
+				ProtocolVersion: hello.ProtocolVersion,
+				Labels:          hello.Labels,
+				Err:             err.Error(),
+			}
+		}
+		s.describeClock(&info, peer)
+		s.recordDegraded(peer, info)
+		nodes = append(nodes, info)
+	}
+	return nodes
+}
+
+// handleMessageNodeInfo answers a MessageNodeInfo with this node's Stats.
+func (s *FileServer) handleMessageNodeInfo(from string, q query) error {
+	info, err := s.Stats()
+	if err != nil {
+		info.Err = err.Error()
+	}
+	return s.sendValue(from, q, info)
+}
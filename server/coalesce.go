@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultCoalesceWindow is how long a queued message waits for others when CoalesceWindow
+	// is not set.
+	defaultCoalesceWindow = 20 * time.Millisecond
+	// defaultCoalesceEntries is the most messages packed into one MessageBatch when
+	// CoalesceMaxEntries is not set.
+	defaultCoalesceEntries = 100
+)
+
+// MessageBatch carries the messages queued for a peer within the coalescing window, which the
+// receiver handles in order as if each had arrived on its own. Only deletes, pins, alias
+// changes, pruned versions, live notifications and acknowledgements are queued; requests,
+// answers and anything else a node waits on are sent at once.
+type MessageBatch struct {
+	Entries []Message // Messages in the order they were sent
+}
+
+// outbox holds the messages waiting to be packed into a MessageBatch for each peer.
+type outbox struct {
+	mu     sync.Mutex
+	queues map[p2p.Node]*outboxQueue // Messages waiting for each peer
+}
+
+// outboxQueue is the messages waiting for one peer.
+type outboxQueue struct {
+	sendMu  sync.Mutex // Held while the queue is taken and sent, so batches leave in the order they were queued
+	entries []Message  // Messages waiting, guarded by the outbox's mu
+}
+
+// newOutbox returns an outbox with nothing queued.
+func newOutbox() *outbox {
+	return &outbox{queues: make(map[p2p.Node]*outboxQueue)}
+}
+
+// drop forgets the messages queued for a peer whose connection closed.
+func (o *outbox) drop(peer p2p.Node) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.queues, peer)
+}
+
+// coalesceWindow returns how long a queued message waits for others, negative when
+// coalescing is disabled.
+func (s *FileServer) coalesceWindow() time.Duration {
+	if s.CoalesceWindow == 0 {
+		return defaultCoalesceWindow
+	}
+	return s.CoalesceWindow
+}
+
+// coalesceEntries returns the most messages packed into one MessageBatch.
+func (s *FileServer) coalesceEntries() int {
+	if s.CoalesceMaxEntries <= 0 {
+		return defaultCoalesceEntries
+	}
+	return s.CoalesceMaxEntries
+}
+
+// sendCoalesced sends a message to peers, queueing it for those supporting coalescing until
+// CoalesceWindow passes or CoalesceMaxEntries messages are queued for them, when the queue
+// goes out as one MessageBatch. sendMessage flushes a peer's queue before sending it anything
+// else, so the peer receives every message in the order it was sent.
+//
+// Deletes, pins, alias changes and pruned versions are numbered for peers supporting acknowledgements and
+// sent again until they are acknowledged; see sendReliable.
+//
+// Returns: A *BroadcastError naming the peers not supporting coalescing or acknowledgements
+// that could not be reached, or any encoding errors. Peers a queue cannot be sent to are only
+// logged.
+func (s *FileServer) sendCoalesced(peers []p2p.Node, msg *Message) error {
+	if class := deliveryOf(msg.Payload); class != deliveryBestEffort && s.ackRetryInterval() > 0 {
+		var tracked []p2p.Node
+		tracked, peers = s.peersWith(peers, func(caps peerCaps) bool { return caps.reliable })
+		s.sendReliable(tracked, msg, class)
+		if len(peers) == 0 {
+			return nil
+		}
+	}
+	// Messages numbered for delivery are dropped, or not, when sent as a MessageReliable.
+	peers = s.chaosDrop(peers, msg)
+	if s.coalesceWindow() < 0 {
+		_, err := s.sendMessage(peers, msg)
+		return err
+	}
+	queued, direct := s.peersWith(peers, func(caps peerCaps) bool { return caps.coalesce })
+	for _, peer := range queued {
+		s.queueMessage(peer, *msg)
+	}
+	if len(direct) == 0 {
+		return nil
+	}
+	_, err := s.sendMessage(direct, msg)
+	return err
+}
+
+// queueMessage adds a message to a peer's queue, sending the queue once it is full and
+// otherwise starting the window of its first message.
+func (s *FileServer) queueMessage(peer p2p.Node, msg Message) {
+	o := s.outbox
+	o.mu.Lock()
+	q, ok := o.queues[peer]
+	if !ok {
+		q = &outboxQueue{}
+		o.queues[peer] = q
+	}
+	q.entries = append(q.entries, msg)
+	n := len(q.entries)
+	o.mu.Unlock()
+	if n >= s.coalesceEntries() {
+		s.flushOutbox(peer)
+		return
+	}
+	if n == 1 {
+		go func() {
+			select {
+			case <-s.Clock.After(s.coalesceWindow()):
+			case <-s.quitch:
+			}
+			s.flushOutbox(peer)
+		}()
+	}
+}
+
+// flushOutbox sends the messages queued for a peer, a single one as it is and more as a
+// MessageBatch.
+func (s *FileServer) flushOutbox(peer p2p.Node) {
+	o := s.outbox
+	o.mu.Lock()
+	q, ok := o.queues[peer]
+	o.mu.Unlock()
+	if !ok {
+		return
+	}
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+	o.mu.Lock()
+	entries := q.entries
+	q.entries = nil
+	o.mu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+	msg := &Message{Payload: MessageBatch{Entries: entries}}
+	if len(entries) == 1 {
+		msg = &entries[0]
+	}
+	frame, err := frameMessage(msg, s.capsOf(peer).typed)
+	if err == nil {
+		err = peer.Send(frame)
+	}
+	if err != nil {
+		log.Printf("[%s] sending %d queued messages to (%s): %s", s.Transport.Addr(), len(entries), peer.RemoteAddr(), err)
+		return
+	}
+	s.metrics.coalescedFrames.Add(1)
+	s.metrics.coalescedMessages.Add(int64(len(entries)))
+}
+
+// handleMessageBatch handles the messages of a batch in order.
+func (s *FileServer) handleMessageBatch(from string, msg MessageBatch) error {
+	var errs []error
+	for i := range msg.Entries {
+		entry := &msg.Entries[i]
+		if _, nested := entry.Payload.(MessageBatch); nested {
+			errs = append(errs, fmt.Errorf("batch from (%s) holds another batch", from))
+			continue
+		}
+		if err := s.admitMessage(from, entry.Payload); err != nil {
+			errs = append(errs, s.rejectMessage(from, err))
+			continue
+		}
+		if err := s.handleMessage(from, entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeletesAreCoalesced(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	clk := clock.NewFake(time.Unix(0, 0))
+	a := makeMemoryServer(t, network, ":4000")
+	// The window only passes when the test advances the clock, so only full queues go out before.
+	a.Clock = clk
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	const n = 250
+	items := make([]StoreItem, n)
+	for i := range items {
+		items[i] = StoreItem{Key: fmt.Sprintf("tmp/%04d", i), Data: bytes.NewReader([]byte("x"))}
+	}
+	_, err := a.StoreBatch(items)
+	require.NoError(t, err)
+	held := func(s *FileServer) int {
+		keys, _ := s.Storage.KeysWithPrefix(a.ID, "")
+		return len(keys)
+	}
+	waitFor(t, func() bool { return held(b) == n && held(c) == n })
+
+	waiters := clk.Waiters()
+	for _, item := range items {
+		require.NoError(t, a.Delete(item.Key))
+	}
+	full := n / a.coalesceEntries()
+	metrics := a.Metrics()
+	assert.Equal(t, int64(2*full), metrics["coalesced_frames"], "only full queues go out before the window passes")
+	assert.Equal(t, int64(2*full*a.coalesceEntries()), metrics["coalesced_messages"])
+
+	// Every queue started a window of its own; the last one of each peer sends the rest.
+	clk.BlockUntil(waiters + 2*(full+1))
+	clk.Advance(a.coalesceWindow())
+	waitFor(t, func() bool { return held(b) == 0 && held(c) == 0 })
+	metrics = a.Metrics()
+	assert.Equal(t, int64(2*(full+1)), metrics["coalesced_frames"])
+	assert.Equal(t, int64(2*n), metrics["coalesced_messages"])
+}
+
+// TestCoalescedDeleteKeepsOrder checks that a replica stored right after a delete of the same
+// key is not overtaken by the delete waiting in the outbox.
+func TestCoalescedDeleteKeepsOrder(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.CoalesceWindow = time.Hour
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	require.NoError(t, a.Store("key", bytes.NewReader([]byte("old"))))
+	waitFor(t, func() bool { return replicaContent(t, b, a, "key") == "old" })
+	require.NoError(t, a.Delete("key"))
+	require.NoError(t, a.Store("key", bytes.NewReader([]byte("new"))))
+	waitFor(t, func() bool { return replicaContent(t, b, a, "key") == "new" })
+	assert.Never(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("key"))
+		return !ok
+	}, 100*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(t, int64(1), a.Metrics()["coalesced_messages"])
+}
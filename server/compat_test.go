@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capProfiles are the feature sets of the nodes in a mixed-version cluster: a current node, a
+// node predating every optional feature and nodes lacking one feature each.
+var capProfiles = map[string]p2p.Capabilities{
+	"current":        supportedCaps,
+	"none":           0,
+	"no-batch":       supportedCaps &^ p2p.CapBatch,
+	"no-sync-tree":   supportedCaps &^ p2p.CapSyncTree,
+	"no-inline":      supportedCaps &^ p2p.CapInline,
+	"legacy-framing": supportedCaps &^ p2p.CapChunkedStreams,
+	"no-ranges":      supportedCaps &^ p2p.CapRangeGet,
+	"no-acks":        supportedCaps &^ p2p.CapStoreAck,
+	"no-mirror":      supportedCaps &^ p2p.CapMirror,
+	"untyped":        supportedCaps &^ p2p.CapTypedMessages,
+	"no-grants":      supportedCaps &^ p2p.CapNamespaceGrants,
+	"no-pins":        supportedCaps &^ p2p.CapPins,
+	"no-repair":      supportedCaps &^ p2p.CapReadRepair,
+	"no-verify":      supportedCaps &^ p2p.CapVerify,
+	"no-reserve":     supportedCaps &^ p2p.CapReserve,
+	"no-append":      supportedCaps &^ p2p.CapAppend,
+	"no-prefixes":    supportedCaps &^ p2p.CapDeletePrefix,
+	"no-mux":         supportedCaps &^ p2p.CapMux,
+	"no-coalescing":  supportedCaps &^ p2p.CapCoalesce,
+	"no-clock":       supportedCaps &^ p2p.CapClock,
+	"no-reliable":    supportedCaps &^ p2p.CapReliable,
+	"no-challenge":   supportedCaps &^ p2p.CapChallenge,
+	"no-lease":       supportedCaps &^ p2p.CapLease,
+	"no-locate":      supportedCaps &^ p2p.CapLocate,
+	"no-aliases":     supportedCaps &^ p2p.CapAliases,
+	"no-busy":        supportedCaps &^ p2p.CapBusy,
+	"no-replies":     supportedCaps &^ p2p.CapReplies,
+}
+
+// capMessages are the messages only nodes with a feature know.
+var capMessages = map[p2p.Capabilities][]any{
+	p2p.CapBatch:           {MessageStoreBatch{}, MessageGetBatch{}},
+	p2p.CapSyncTree:        {MessageSyncTree{}},
+	p2p.CapInline:          {MessageStoreFileInline{}},
+	p2p.CapRangeGet:        {MessageGetRange{}},
+	p2p.CapStoreAck:        {MessageStoreAck{}},
+	p2p.CapMirror:          {MessageMirrorList{}, MessageMirrorPull{}},
+	p2p.CapNamespaceGrants: {MessageGrantKey{}, MessageGrantNamespace{}},
+	p2p.CapPins:            {MessagePin{}},
+	p2p.CapVerify:          {MessageVerifyKeys{}},
+	p2p.CapReserve:         {MessageReserveKey{}, MessageReserveAnswer{}, MessageReleaseKey{}},
+	p2p.CapAppend:          {MessageAppendFile{}, MessageAppendRejected{}},
+	p2p.CapDeletePrefix:    {MessageDeletePrefix{}},
+	p2p.CapCoalesce:        {MessageBatch{}},
+	p2p.CapClock:           {MessagePing{}, MessagePong{}},
+	p2p.CapReliable:        {MessageReliable{}, MessageAck{}},
+	p2p.CapChallenge:       {MessageChallenge{}},
+	p2p.CapLease:           {MessageLease{}},
+	p2p.CapLocate:          {MessageLocate{}},
+	p2p.CapAliases:         {MessageAlias{}},
+}
+
+// actAs makes s advertise only caps and, like a node predating the features it lacks, answer
+// their messages with a MessageProtocolError.
+func actAs(s *FileServer, caps p2p.Capabilities) {
+	s.caps = caps
+	s.dispatch.mu.Lock()
+	defer s.dispatch.mu.Unlock()
+	for flag, msgs := range capMessages {
+		if caps.Has(flag) {
+			continue
+		}
+		for _, msg := range msgs {
+			tag, _ := messages.tagOf(msg)
+			delete(s.dispatch.handlers, tag)
+		}
+	}
+}
+
+// capPairs returns the pairs of profiles the compatibility matrix runs: every profile with a
+// current node and with a node predating every feature, each in both directions. Each feature
+// is then exercised missing on either side without running every profile against every other.
+func capPairs() [][2]string {
+	seen := make(map[[2]string]bool)
+	var pairs [][2]string
+	for name := range capProfiles {
+		for _, other := range []string{"current", "none"} {
+			for _, pair := range [][2]string{{name, other}, {other, name}} {
+				if !seen[pair] {
+					seen[pair] = true
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+func TestCompatibilityMatrix(t *testing.T) {
+	for _, pair := range capPairs() {
+		nameA, nameB := pair[0], pair[1]
+		capsA, capsB := capProfiles[nameA], capProfiles[nameB]
+		t.Run(nameA+"/"+nameB, func(t *testing.T) {
+			// Every pair has a network of its own, so the pairs run side by side.
+			t.Parallel()
+			network := p2p.NewMemoryNetwork(1)
+			a := makeMemoryServer(t, network, ":4000")
+			actAs(a, capsA)
+			a.GetParallelism = 2
+			b := makeMemoryServer(t, network, ":4001", ":4000")
+			actAs(b, capsB)
+			startCluster(t, a, b)
+			checkConformance(t, a, b)
+			assert.Zero(t, a.Metrics()["protocol_errors"], "a sent a message b does not know")
+			assert.Zero(t, b.Metrics()["protocol_errors"], "b sent a message a does not know")
+
+			// Each connection is counted in every mode either side forces it into.
+			common := capsA & capsB
+			metrics := a.Metrics()
+			for name, flag := range map[string]p2p.Capabilities{
+				"peers_without_batch":     p2p.CapBatch,
+				"peers_without_sync_tree": p2p.CapSyncTree,
+				"peers_without_inline":    p2p.CapInline,
+				"peers_legacy_framing":    p2p.CapChunkedStreams,
+				"peers_without_ranges":    p2p.CapRangeGet,
+				"peers_without_acks":      p2p.CapStoreAck,
+				"peers_without_mirror":    p2p.CapMirror,
+				"peers_untyped_messages":  p2p.CapTypedMessages,
+				"peers_without_grants":    p2p.CapNamespaceGrants,
+				"peers_without_pins":      p2p.CapPins,
+				"peers_without_repair":    p2p.CapReadRepair,
+				"peers_without_verify":    p2p.CapVerify,
+				"peers_without_reserve":   p2p.CapReserve,
+				"peers_without_append":    p2p.CapAppend,
+				"peers_without_prefixes":  p2p.CapDeletePrefix,
+				"peers_without_mux":       p2p.CapMux,
+				"peers_uncoalesced":       p2p.CapCoalesce,
+				"peers_without_clock":     p2p.CapClock,
+				"peers_without_reliable":  p2p.CapReliable,
+				"peers_without_proofs":    p2p.CapChallenge,
+				"peers_without_leases":    p2p.CapLease,
+				"peers_without_locate":    p2p.CapLocate,
+				"peers_without_aliases":   p2p.CapAliases,
+				"peers_without_busy":      p2p.CapBusy,
+				"peers_without_replies":   p2p.CapReplies | p2p.CapMux,
+			} {
+				want := int64(0)
+				if !common.Has(flag) {
+					want = 1
+				}
+				assert.Equal(t, want, metrics[name], name)
+			}
+		})
+	}
+}
+
+// handledWatch wakes the tests waiting on a node each time it finished handling a message.
+type handledWatch struct {
+	mu      sync.Mutex
+	handled chan struct{} // Closed and replaced once a message is handled
+}
+
+// watchHandled wraps the handlers s has registered so far to wake the returned watch after
+// every message they handle.
+func watchHandled(s *FileServer) *handledWatch {
+	w := &handledWatch{handled: make(chan struct{})}
+	s.dispatch.mu.Lock()
+	defer s.dispatch.mu.Unlock()
+	for tag, handler := range s.dispatch.handlers {
+		s.dispatch.handlers[tag] = func(from string, msg *Message) error {
+			defer w.wake()
+			return handler(from, msg)
+		}
+	}
+	return w
+}
+
+// wake wakes everything waiting in until.
+func (w *handledWatch) wake() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.handled)
+	w.handled = make(chan struct{})
+}
+
+// until blocks until cond holds, checking it again after every message the node handles, as
+// what a peer sends lands by the time the message carrying it is handled.
+func (w *handledWatch) until(cond func() bool) {
+	for {
+		w.mu.Lock()
+		handled := w.handled
+		w.mu.Unlock()
+		if cond() {
+			return
+		}
+		<-handled
+	}
+}
+
+// checkConformance stores, fetches, batches, syncs and deletes objects between two connected
+// nodes, which must behave the same whatever features they share.
+func checkConformance(t *testing.T, a *FileServer, b *FileServer) {
+	t.Helper()
+	aHandled, bHandled := watchHandled(a), watchHandled(b)
+	objects := map[string][]byte{
+		"small": randomData(t, 1<<10),
+		"large": randomData(t, 3<<19),
+	}
+	for key, data := range objects {
+		require.NoError(t, a.Store(key, bytes.NewReader(data)), key)
+	}
+	for key := range objects {
+		bHandled.until(func() bool {
+			ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+	}
+	for key, data := range objects {
+		r, err := a.Get(key)
+		require.NoError(t, err, key)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err, key)
+		assert.Equal(t, data, got, key)
+	}
+
+	batch := []StoreItem{
+		{Key: "batch/0", Data: bytes.NewReader(objects["small"])},
+		{Key: "batch/1", Data: bytes.NewReader(objects["large"])},
+	}
+	stored, err := b.StoreBatch(batch)
+	require.NoError(t, err)
+	for _, res := range stored {
+		require.NoError(t, res.Err, res.Key)
+		require.Empty(t, res.PeerErrs, res.Key)
+		aHandled.until(func() bool {
+			ok, _ := a.Storage.Has(b.ID, crypto.HashKey(res.Key))
+			return ok
+		})
+		require.NoError(t, b.Storage.Delete(b.ID, res.Key))
+	}
+	fetched, err := b.GetBatch([]string{"batch/0", "batch/1"})
+	require.NoError(t, err)
+	for i, res := range fetched {
+		require.NoError(t, res.Err, res.Key)
+		assert.Equal(t, [][]byte{objects["small"], objects["large"]}[i], res.Data, res.Key)
+	}
+
+	// Only a peer that can acknowledge replicas makes an object durable.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = a.StoreDurable(ctx, "durable", bytes.NewReader(objects["small"]), 1)
+	if a.capsOf(a.peerList()[0]).acks {
+		require.NoError(t, err)
+	} else {
+		require.ErrorIs(t, err, ErrNotDurable)
+	}
+	bHandled.until(func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("durable"))
+		return ok
+	})
+
+	// Appends reach the peer as the bytes added or as the whole object, as it supports.
+	for i := 0; i < 2; i++ {
+		_, err = a.Append("log", bytes.NewReader(objects["small"]))
+		require.NoError(t, err)
+	}
+	appended := string(objects["small"]) + string(objects["small"])
+	bHandled.until(func() bool { return replicaContent(t, b, a, "log") == appended })
+
+	_, err = b.SyncWith(b.peerList()[0].RemoteAddr().String(), a.ID)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Delete("small"))
+	bHandled.until(func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("small"))
+		return !ok
+	})
+}
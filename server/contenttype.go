@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// sniffLen is the most bytes DetectContentType looks at.
+const sniffLen = 512
+
+// DetectContentType returns the MIME type of content starting with head, like
+// http.DetectContentType, which looks at no more than the first 512 bytes. Text that is JSON
+// as far as head goes, starting with an object or array, is application/json rather than plain
+// text.
+func DetectContentType(head []byte) string {
+	head = head[:min(len(head), sniffLen)]
+	contentType := http.DetectContentType(head)
+	if contentType == "text/plain; charset=utf-8" && jsonPrefix(head) {
+		return "application/json"
+	}
+	return contentType
+}
+
+// jsonPrefix reports whether head starts an object or array and is valid JSON, or the start
+// of valid JSON cut short.
+func jsonPrefix(head []byte) bool {
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) == 0 || (head[0] != '{' && head[0] != '[') {
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(head))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return errors.Is(err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// recordContentType records the MIME type of one of this node's objects: contentType when the
+// caller gave one, else the type sniffed from head, the first bytes of its content.
+func (s *FileServer) recordContentType(key string, contentType string, head []byte) error {
+	if len(contentType) == 0 {
+		contentType = DetectContentType(head)
+	}
+	return s.Storage.SetContentType(s.ID, key, contentType)
+}
+
+// sniffFile reads the first bytes of a file for recordContentType without moving its offset.
+func sniffFile(f io.ReaderAt) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := f.ReadAt(head, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return head[:n], err
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pngHeader is the start of a PNG image.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+
+// binaryData returns bytes no content type is sniffed from, the same on every run.
+func binaryData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestDetectContentType(t *testing.T) {
+	for content, want := range map[string]string{
+		string(pngHeader):            "image/png",
+		`{"name": "cat", "age": 3}`:  "application/json",
+		"[1, 2, 3" + `, {"cut": "sh`: "application/json",
+		"[INFO] started":             "text/plain; charset=utf-8",
+		"<!DOCTYPE html><p>hi":       "text/html; charset=utf-8",
+		string(binaryData(1024)):     "application/octet-stream",
+	} {
+		assert.Equal(t, want, DetectContentType([]byte(content)), content)
+	}
+}
+
+func TestStoreRecordsContentType(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	require.NoError(t, a.Store("cat.png", bytes.NewReader(append(pngHeader, binaryData(2048)...))))
+	require.NoError(t, a.Store("cat.json", bytes.NewReader([]byte(`{"name": "cat"}`))))
+	require.NoError(t, a.Store("cat.bin", bytes.NewReader(binaryData(4096))))
+	require.NoError(t, a.StoreWithMetadata("cat.css", bytes.NewReader([]byte("body {}")), ObjectMetadata{ContentType: "text/css"}))
+	path := filepath.Join(t.TempDir(), "cat.gif")
+	require.NoError(t, os.WriteFile(path, []byte("GIF89a and the rest of the image"), 0o644))
+	require.NoError(t, a.StoreFilePath("cat.gif", path))
+
+	for key, want := range map[string]string{
+		"cat.png":  "image/png",
+		"cat.json": "application/json",
+		"cat.bin":  "application/octet-stream",
+		"cat.css":  "text/css",
+		"cat.gif":  "image/gif",
+	} {
+		info, err := a.StatKey(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, info.ContentType, key)
+		info, r, err := a.GetWithInfo(key)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, r)
+		require.NoError(t, err)
+		r.Close()
+		assert.Equal(t, want, info.ContentType, key)
+	}
+
+	// Storing other content sniffs it afresh, while appending keeps the type.
+	require.NoError(t, a.Store("cat.json", bytes.NewReader(pngHeader)))
+	info, err := a.StatKey("cat.json")
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", info.ContentType)
+	_, err = a.Append("cat.json", bytes.NewReader([]byte("more")))
+	require.NoError(t, err)
+	info, err = a.StatKey("cat.json")
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", info.ContentType)
+}
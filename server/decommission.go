@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// ErrDraining is returned when a replica is sent to a node that is being decommissioned.
+var ErrDraining = errors.New("node is draining")
+
+// MessageLeaving announces that the sending node is being decommissioned. Peers stop placing
+// replicas on it straight away instead of waiting for its connection to drop.
+type MessageLeaving struct {
+	ID string // Identifier of the leaving node
+}
+
+// Decommission takes the node out of the cluster without losing data. It stops accepting
+// replicas, announces that it is leaving, then hands every object it holds to each peer taking
+// replicas that lacks it, except the object's owner, which holds the original. Once every such
+// peer is confirmed to hold the objects handed to it the server is stopped.
+//
+// Objects are handed over at their current version; older versions stay behind. A failed
+// hand-off leaves the node running but draining, so it can be retried.
+//
+// Parameters:
+//   - ctx: Bounds the hand-off; once it is done the remaining objects are not sent.
+//
+// Returns: Any errors handing objects over, or the context's error.
+func (s *FileServer) Decommission(ctx context.Context) error {
+	s.draining.Store(true)
+	if err := s.broadcast(&Message{Payload: MessageLeaving{ID: s.ID}}); err != nil {
+		log.Printf("[%s] announcing departure: %s", s.Transport.Addr(), err)
+	}
+	ids, err := s.Storage.Owners()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, peer := range replicaPeers(s.peerList()) {
+		for _, id := range ids {
+			if id == peer.Hello().NodeID {
+				continue
+			}
+			if err := s.handOff(ctx, peer, id); err != nil {
+				errs = append(errs, err)
+			}
+			if err := ctx.Err(); err != nil {
+				return errors.Join(append(errs, err)...)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	fmt.Printf("[%s] decommissioned, shutting down\n", s.Transport.Addr())
+	s.Stop()
+	return nil
+}
+
+// handOff sends a peer the objects of owner id that it lacks, then asks it again which it
+// lacks; the peer handles messages in order, so the second answer confirms every object sent.
+// This node's own objects are only sent to the peers their replication policy places them on.
+func (s *FileServer) handOff(ctx context.Context, peer p2p.Node, id string) error {
+	missing, err := s.missingOn(peer, id)
+	if err != nil {
+		return err
+	}
+	if id == s.ID {
+		missing = s.placedFor(peer, missing)
+	}
+	for _, key := range missing {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if id == s.ID {
+			err = s.replicateKey(peer, key)
+		} else {
+			err = s.forwardReplica(peer, id, key)
+		}
+		if err != nil {
+			return fmt.Errorf("handing (%s) to (%s): %w", key, peer.RemoteAddr(), err)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	left, err := s.missingOn(peer, id)
+	if err != nil {
+		return err
+	}
+	if id == s.ID {
+		left = s.placedFor(peer, left)
+	}
+	if len(left) > 0 {
+		return fmt.Errorf("peer (%s) did not take %d of %d objects of (%s)", peer.RemoteAddr(), len(left), len(missing), id)
+	}
+	fmt.Printf("[%s] handed %d objects of (%s) to (%s)\n", s.Transport.Addr(), len(missing), id, peer.RemoteAddr())
+	return nil
+}
+
+// missingOn returns the keys this node holds for owner id that the peer does not. This
+// node's own objects are listed by their plain keys, although peers hold them hashed.
+func (s *FileServer) missingOn(peer p2p.Node, id string) ([]string, error) {
+	resp, err := s.exchangeSync(peer, &Message{Payload: MessageSyncKeys{ID: id}})
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.Storage.Keys(id)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool, len(resp.All))
+	for _, key := range resp.All {
+		held[key] = true
+	}
+	var missing []string
+	for _, key := range local {
+		remote := key
+		if id == s.ID {
+			remote = crypto.HashKey(key)
+		}
+		if !held[remote] {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// forwardReplica sends a peer the replica this node holds for another owner, as it was
+// received.
+func (s *FileServer) forwardReplica(peer p2p.Node, id string, key string) (err error) {
+	meta, err := s.Storage.Metadata(id, key)
+	if err != nil {
+		return err
+	}
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() {
+			err = errors.Join(err, rc.Close())
+		}()
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	rep := replica{id: id, key: key, data: data, checksum: meta.Checksum, version: meta.Version}
+	_, err = s.replicate([]p2p.Node{peer}, rep)
+	return err
+}
+
+// handleMessageLeaving stops placing replicas on a peer that announced it is leaving. A
+// leaving bootstrap node is no longer redialed or queued for once it disconnects.
+func (s *FileServer) handleMessageLeaving(from string, msg MessageLeaving) error {
+	addr, isBootstrap := s.bootstrapAddr(from)
+	s.peerLock.Lock()
+	if _, ok := s.peers[from]; ok {
+		s.leaving[from] = true
+	}
+	if isBootstrap {
+		s.departed[addr] = true
+	}
+	s.peerLock.Unlock()
+	if isBootstrap {
+		s.pending.drop(addr)
+	}
+	s.reliable.forget(msg.ID)
+	log.Printf("[%s] peer (%s), node %s, is leaving the cluster", s.Transport.Addr(), from, msg.ID)
+	return nil
+}
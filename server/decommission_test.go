@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecommissionHandsOffObjects(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	c := makeMemoryServer(t, network, ":4002")
+	a := makeMemoryServer(t, network, ":4000", ":4002")
+	b := makeMemoryServer(t, network, ":4001", ":4002", ":4000")
+	startCluster(t, c, a, b)
+	for _, s := range []*FileServer{a, b, c} {
+		waitFor(t, func() bool { return len(s.peerList()) == 2 })
+	}
+
+	// While a and b cannot reach each other, a's replicas only reach c.
+	network.Policy.PartitionBetween(":4000", ":4001")
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+	objects := make(map[string][]byte)
+	for i, size := range []int{10, 1 << 10, 64 << 10} {
+		key := fmt.Sprintf("a/%d", i)
+		objects[key] = randomData(t, size)
+		require.NoError(t, a.Store(key, bytes.NewReader(objects[key])))
+	}
+	require.NoError(t, c.Store("c/0", bytes.NewReader([]byte("owned by c"))))
+	network.Policy.Heal()
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 })
+	ok, err := b.Storage.Has(a.ID, crypto.HashKey("a/0"))
+	require.NoError(t, err)
+	require.False(t, ok, "b should only get a's objects from c")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, c.Decommission(ctx))
+
+	// Every object c held for others is on each remaining node.
+	for key := range objects {
+		require.NoError(t, b.Storage.Verify(a.ID, crypto.HashKey(key)), key)
+	}
+	for _, s := range []*FileServer{a, b} {
+		require.NoError(t, s.Storage.Verify(c.ID, crypto.HashKey("c/0")))
+	}
+
+	// c is gone and, although both nodes bootstrap from it, nobody waits for it to return.
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+	assert.Empty(t, a.offlineBootstrapNodes())
+	assert.Empty(t, b.offlineBootstrapNodes())
+	require.NoError(t, a.Store("after", bytes.NewReader([]byte("after c left"))))
+
+	for key, data := range objects {
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+		r, err := a.Get(key)
+		require.NoError(t, err, key)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, key)
+	}
+}
+
+func TestDrainingNodeRefusesReplicas(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	b.draining.Store(true)
+	require.NoError(t, a.Store("refused", bytes.NewReader([]byte("nowhere to go"))))
+	waitFor(t, func() bool { return a.Metrics()["replicas_rejected"] == 1 })
+	ok, err := b.Storage.Has(a.ID, crypto.HashKey("refused"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+const (
+	// deletePrefixTimeout bounds how long DeletePrefix waits for each peer to drop its replicas.
+	deletePrefixTimeout = 30 * time.Second
+	// deletePrefixBatch is the most keys one MessageDeletePrefix lists, keeping it well within
+	// p2p.MaxMessageSize; larger deletes are sent in several.
+	deletePrefixBatch = 100_000
+)
+
+// ErrDeleteAll is returned by DeletePrefix for an empty prefix unless AllowDeleteAll is set.
+var ErrDeleteAll = errors.New("deleting every key requires AllowDeleteAll")
+
+// MessageDeletePrefix asks a peer to drop its replicas of objects the sender deleted with
+// DeletePrefix. The receiver answers with a deletePrefixResponse.
+type MessageDeletePrefix struct {
+	ID     string   // Identifier of the node owning the objects
+	Prefix string   // Plain prefix of the keys deleted
+	Keys   []string // Hashed keys of the objects deleted, as replicas cannot be matched to the prefix
+}
+
+// deletePrefixResponse is the stream sent in answer to MessageDeletePrefix.
+type deletePrefixResponse struct {
+	Deleted int    // Replicas dropped
+	Err     string // Why some replicas could not be dropped, empty when all were
+	Denied  bool   // Whether the Authorizer denied the deletion, so none were dropped
+}
+
+// DeleteReport describes what DeletePrefix deleted.
+type DeleteReport struct {
+	Prefix   string         // Plain prefix of the keys deleted, namespace included
+	Deleted  int            // Objects deleted on this node
+	Kept     []string       // Keys left in place because they are immutable
+	Replicas map[string]int // Replicas dropped by each peer that answered, keyed by address
+}
+
+// DeletePrefix deletes this node's objects whose keys start with prefix, within the namespace
+// ns unless it is empty, along with the replicas peers hold of them. The keys are taken from
+// the key index and deleted in one pass; each peer is then sent a single MessageDeletePrefix
+// listing them rather than a delete per key, and answers with the number of replicas it
+// dropped. A range tombstone is left for the prefix, so Get does not pull deleted keys back
+// from peers that missed the delete while it is within TombstoneRetention; keys stored again
+// are held locally and served as usual. Immutable objects are kept. Peers that predate prefix
+// deletes are sent a MessageDeleteFile per key and are not counted. An empty prefix deletes a
+// whole namespace, or every key when ns is empty too, and is refused with ErrDeleteAll unless
+// AllowDeleteAll is set.
+//
+// Returns: What was deleted, and any errors. A *BroadcastError means the objects were deleted
+// locally and on every peer except those it names.
+func (s *FileServer) DeletePrefix(ns string, prefix string) (DeleteReport, error) {
+	if len(prefix) == 0 && !s.AllowDeleteAll {
+		return DeleteReport{}, ErrDeleteAll
+	}
+	if len(ns) > 0 {
+		prefix = ns + "/" + prefix
+	}
+	report := DeleteReport{Prefix: prefix, Replicas: make(map[string]int)}
+	keys, err := s.Storage.KeysWithPrefix(s.ID, prefix)
+	if err != nil {
+		return report, err
+	}
+	now := s.Clock.Now()
+	hashed := make([]string, 0, len(keys))
+	tombstones := []tombstone{{Owner: s.ID, Key: prefix, Time: now, Prefix: true}}
+	var errs []error
+	for _, key := range keys {
+		if s.immutable(s.ID, key) {
+			report.Kept = append(report.Kept, key)
+			continue
+		}
+		if err := s.Storage.Delete(s.ID, key); err != nil {
+			errs = append(errs, fmt.Errorf("deleting (%s): %w", key, err))
+			continue
+		}
+		report.Deleted++
+		hashedKey := crypto.HashKey(key)
+		hashed = append(hashed, hashedKey)
+		s.pushes.forget(objectRef{owner: s.ID, key: hashedKey})
+		tombstones = append(tombstones, tombstone{Owner: s.ID, Key: hashedKey, Time: now})
+		s.publish(NotifyDelete, key)
+	}
+	s.tombstones.addAll(tombstones)
+	if err := s.broadcastDeletePrefix(prefix, hashed, &report); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return report, errs[0]
+	}
+	return report, errors.Join(errs...)
+}
+
+// broadcastDeletePrefix asks every peer to drop its replicas of the objects under keys, the
+// hashed keys DeletePrefix deleted for prefix, counting those dropped in report.
+//
+// Returns: A *BroadcastError naming the peers that could not be asked or did not drop them all.
+func (s *FileServer) broadcastDeletePrefix(prefix string, keys []string, report *DeleteReport) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	peers := s.peerList()
+	berr := &BroadcastError{failed: make(map[string]error), total: len(peers)}
+	batched, single := s.peersWith(peers, func(c peerCaps) bool { return c.prefixes })
+	for _, peer := range batched {
+		addr := peer.RemoteAddr().String()
+		for start := 0; start < len(keys); start += deletePrefixBatch {
+			batch := keys[start:min(start+deletePrefixBatch, len(keys))]
+			var resp deletePrefixResponse
+			msg := &Message{Payload: MessageDeletePrefix{ID: s.ID, Prefix: prefix, Keys: batch}}
+			err := s.exchange(peer, msg, &resp, deletePrefixTimeout)
+			switch {
+			case err != nil:
+			case resp.Denied:
+				err = &DeniedError{Peer: addr, Reason: resp.Err}
+			case len(resp.Err) > 0:
+				err = newRemoteError(resp.Err)
+			}
+			report.Replicas[addr] += resp.Deleted
+			if err != nil {
+				berr.failed[addr] = err
+				break
+			}
+		}
+	}
+	for _, key := range keys {
+		if len(single) == 0 {
+			break
+		}
+		_, err := s.sendMessage(single, &Message{Payload: MessageDeleteFile{ID: s.ID, Key: key, Namespace: keyNamespace(prefix)}})
+		var perr *BroadcastError
+		if errors.As(err, &perr) {
+			for addr, err := range perr.failed {
+				berr.failed[addr] = err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(berr.failed) > 0 {
+		return berr
+	}
+	return nil
+}
+
+// handleMessageDeletePrefix drops the replicas a peer deleted with DeletePrefix, remembering
+// the deletions for mirrors, and answers with the number dropped. Immutable replicas are kept,
+// and none are dropped if the Authorizer denies deleting the prefix.
+func (s *FileServer) handleMessageDeletePrefix(from string, q query, msg MessageDeletePrefix) error {
+	if err := s.authorize(from, "", OpDelete, msg.ID, keyNamespace(msg.Prefix), msg.Prefix); err != nil {
+		return errors.Join(s.sendValue(from, q, deletePrefixResponse{Err: err.Error(), Denied: true}), err)
+	}
+	var (
+		resp       deletePrefixResponse
+		errs       []error
+		now        = s.Clock.Now()
+		tombstones = make([]tombstone, 0, len(msg.Keys))
+	)
+	for _, key := range msg.Keys {
+		tombstones = append(tombstones, tombstone{Owner: msg.ID, Key: key, Time: now})
+		if s.immutable(msg.ID, key) {
+			errs = append(errs, fmt.Errorf("deleting replica (%s): %w", key, ErrImmutable))
+			continue
+		}
+		ok, err := s.Storage.Has(msg.ID, key)
+		if err == nil && ok {
+			err = s.Storage.Delete(msg.ID, key)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deleting replica (%s): %w", key, err))
+			continue
+		}
+		if ok {
+			resp.Deleted++
+		}
+	}
+	s.tombstones.addAll(tombstones)
+	err := errors.Join(errs...)
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
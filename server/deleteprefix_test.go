@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeletePrefix(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 && len(c.peerList()) == 2 })
+
+	data := randomData(t, 64)
+	var logs, images []string
+	for i := 0; i < 250; i++ {
+		logs = append(logs, fmt.Sprintf("logs/%03d", i))
+		images = append(images, fmt.Sprintf("images/%03d", i))
+	}
+	for _, key := range append(append([]string{}, logs...), images...) {
+		require.NoError(t, a.Store(key, bytes.NewReader(data)), key)
+	}
+	// b owns an object under the same prefix, which a's delete leaves alone.
+	require.NoError(t, b.Store("logs/000", bytes.NewReader(data)))
+	for _, s := range []*FileServer{b, c} {
+		waitFor(t, func() bool {
+			for _, key := range images {
+				if ok, _ := s.Storage.Has(a.ID, crypto.HashKey(key)); !ok {
+					return false
+				}
+			}
+			for _, key := range logs {
+				if ok, _ := s.Storage.Has(a.ID, crypto.HashKey(key)); !ok {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	report, err := a.DeletePrefix("", "logs/")
+	require.NoError(t, err)
+	assert.Equal(t, 250, report.Deleted)
+	assert.Empty(t, report.Kept)
+	assert.Len(t, report.Replicas, 2)
+	for addr, n := range report.Replicas {
+		assert.Equal(t, 250, n, addr)
+	}
+
+	for _, s := range []*FileServer{b, c} {
+		for _, key := range logs {
+			ok, err := s.Storage.Has(a.ID, crypto.HashKey(key))
+			require.NoError(t, err)
+			assert.False(t, ok, key)
+		}
+		for _, key := range images {
+			ok, err := s.Storage.Has(a.ID, crypto.HashKey(key))
+			require.NoError(t, err)
+			assert.True(t, ok, key)
+		}
+	}
+	for _, key := range logs {
+		ok, err := a.Storage.Has(a.ID, key)
+		require.NoError(t, err)
+		assert.False(t, ok, key)
+	}
+	keys, err := a.Storage.Keys(a.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, images, keys)
+	ok, err := b.Storage.Has(b.ID, "logs/000")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// A deleted key is not pulled back from a peer that missed the delete, while a key stored
+	// again under the prefix is served as usual.
+	_, err = c.Storage.Write(a.ID, crypto.HashKey("logs/001"), bytes.NewReader(data))
+	require.NoError(t, err)
+	_, err = a.Get("logs/001")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	require.NoError(t, a.Store("logs/002", bytes.NewReader(data)))
+	r, err := a.Get("logs/002")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Deleting a prefix with no keys left is a no-op.
+	report, err = a.DeletePrefix("", "logs/1")
+	require.NoError(t, err)
+	assert.Zero(t, report.Deleted)
+}
+
+func TestDeletePrefixNamespace(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	for _, key := range []string{"tenant/a", "tenant/b", "tenant-2/a", "other"} {
+		require.NoError(t, a.Store(key, bytes.NewReader(randomData(t, 16))))
+	}
+	require.NoError(t, a.StoreWithMetadata("tenant/frozen", bytes.NewReader(randomData(t, 16)), ObjectMetadata{Immutable: true}))
+
+	// Deleting a whole namespace or every key needs AllowDeleteAll.
+	_, err := a.DeletePrefix("tenant", "")
+	assert.ErrorIs(t, err, ErrDeleteAll)
+	_, err = a.DeletePrefix("", "")
+	assert.ErrorIs(t, err, ErrDeleteAll)
+
+	a.AllowDeleteAll = true
+	report, err := a.DeletePrefix("tenant", "")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant/", report.Prefix)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Equal(t, []string{"tenant/frozen"}, report.Kept)
+	keys, err := a.Storage.Keys(a.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"tenant/frozen", "tenant-2/a", "other"}, keys)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrNoSpace is returned when a node's disk is full, or has less free space than
+// MinFreeBytes, and refuses writes. Senders of the replicas it refuses are told so with a
+// MessageStoreRejected and place them on other nodes.
+var ErrNoSpace = errors.New("no space left for writes")
+
+// fullPeerBackoff is how long a peer that refused a replica for lack of space is left out of
+// placements.
+const fullPeerBackoff = time.Minute
+
+// noSpace reports whether err is the disk, or the user's disk quota, running out of space.
+func noSpace(err error) bool {
+	return errors.Is(err, ErrNoSpace) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// spaceState tracks whether this node and its peers have room for writes.
+type spaceState struct {
+	mu   sync.Mutex
+	err  error                // Why this node refuses writes, nil while it accepts them
+	full map[string]time.Time // Until when peers that refused replicas for lack of space are left out of placements, by node ID
+}
+
+// ReadyForWrites reports whether this node accepts stores and replicas. A node whose disk
+// filled up refuses them, while it goes on serving reads, until a write succeeds again.
+//
+// Returns: nil while writes are accepted, or an error wrapping ErrNoSpace saying why not.
+func (s *FileServer) ReadyForWrites() error {
+	s.space.mu.Lock()
+	defer s.space.mu.Unlock()
+	return s.space.err
+}
+
+// diskFull marks this node as not ready for writes because of err. The first time, the change
+// is logged, counted and passed to OnDiskFull.
+func (s *FileServer) diskFull(err error) {
+	if !errors.Is(err, ErrNoSpace) {
+		err = fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+	s.space.mu.Lock()
+	first := s.space.err == nil
+	s.space.err = err
+	s.space.mu.Unlock()
+	if !first {
+		return
+	}
+	s.metrics.diskFull.Add(1)
+	log.Printf("[%s] not ready for writes: %s", s.Transport.Addr(), err)
+	if s.OnDiskFull != nil {
+		s.OnDiskFull(err)
+	}
+}
+
+// diskWritable marks this node as ready for writes again after one succeeded.
+func (s *FileServer) diskWritable() {
+	s.space.mu.Lock()
+	was := s.space.err
+	s.space.err = nil
+	s.space.mu.Unlock()
+	if was != nil {
+		log.Printf("[%s] ready for writes again", s.Transport.Addr())
+	}
+}
+
+// checkFreeSpace compares the free space of the disk with MinFreeBytes. Platforms where it
+// cannot be measured never fall below it.
+//
+// Returns: An error wrapping ErrNoSpace if the disk has less free space than MinFreeBytes.
+func (s *FileServer) checkFreeSpace() error {
+	if s.MinFreeBytes <= 0 {
+		return nil
+	}
+	free, err := s.Storage.FreeBytes()
+	if err != nil || free >= s.MinFreeBytes {
+		return nil
+	}
+	return fmt.Errorf("%d bytes free, fewer than the %d kept free: %w", free, s.MinFreeBytes, ErrNoSpace)
+}
+
+// refuseIfFull refuses a replica that could not be written because the disk is full: the
+// partial object is removed when partial is set, the node marked not ready for writes and the
+// sender told with a MessageStoreRejected, so it places the replica elsewhere. Other errors
+// are returned as they are.
+//
+// Returns: err, joined with any errors removing the partial object or telling the sender.
+func (s *FileServer) refuseIfFull(from string, id string, key string, err error, partial bool) error {
+	if !noSpace(err) {
+		return err
+	}
+	if partial {
+		err = errors.Join(err, s.Storage.Delete(id, key))
+	}
+	s.diskFull(err)
+	return s.refuseReplica(from, id, key, err, fmt.Errorf("replica (%s): %w", key, ErrNoSpace))
+}
+
+// peerFull leaves the peer at addr out of placements for fullPeerBackoff, after it refused a
+// replica for lack of space.
+func (s *FileServer) peerFull(addr string) {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return
+	}
+	id := peerPlacementNode(peer).id
+	s.space.mu.Lock()
+	defer s.space.mu.Unlock()
+	if s.space.full == nil {
+		s.space.full = make(map[string]time.Time)
+	}
+	s.space.full[id] = s.Clock.Now().Add(fullPeerBackoff)
+}
+
+// fullPeers returns the node IDs of the peers left out of placements for lack of space.
+func (s *FileServer) fullPeers() []string {
+	now := s.Clock.Now()
+	s.space.mu.Lock()
+	defer s.space.mu.Unlock()
+	var ids []string
+	for id, until := range s.space.full {
+		if now.After(until) {
+			delete(s.space.full, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// redrive sends one of this node's objects, whose replica a peer refused for lack of space,
+// to the peers its policy places it on now that the full peer is left out. Objects no policy
+// limits are sent to every peer already, so they have nowhere else to go; peers sent the
+// object recently are not sent it again.
+func (s *FileServer) redrive(hashedKey string) {
+	// Replicas name objects by hashed key only.
+	key, ok := s.keyOfHash(hashedKey)
+	if !ok {
+		return
+	}
+	if _, ok := s.policyPlacement(key); !ok {
+		return
+	}
+	peers := s.placement(key, s.peerList())
+	if len(peers) == 0 {
+		return
+	}
+	if err := s.replicateKeyTo(peers, key); err != nil {
+		log.Printf("[%s] placing (%s) elsewhere: %s", s.Transport.Addr(), key, err)
+		s.deferFailed(err, peers, key)
+	}
+}
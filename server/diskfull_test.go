@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// diskFullWriter fails every write with ENOSPC while full is set.
+type diskFullWriter struct {
+	w    io.Writer
+	full *atomic.Bool
+}
+
+func (d diskFullWriter) Write(b []byte) (int, error) {
+	if d.full.Load() {
+		return 0, syscall.ENOSPC
+	}
+	return d.w.Write(b)
+}
+
+func TestFullPeerReplicaPlacedElsewhere(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	require.NoError(t, a.ReloadPolicies(map[string]Policy{"scratch/": {ReplicationFactor: 1}}))
+	peers := []*FileServer{
+		makeMemoryServer(t, network, ":4001", ":4000"),
+		makeMemoryServer(t, network, ":4002", ":4000"),
+		makeMemoryServer(t, network, ":4003", ":4000"),
+	}
+	full := make(map[*FileServer]*atomic.Bool)
+	var fullErr atomic.Value
+	for _, s := range peers {
+		full[s] = new(atomic.Bool)
+		s.Storage.WrapWrites = func(w io.Writer) io.Writer { return diskFullWriter{w: w, full: full[s]} }
+		s.OnDiskFull = func(err error) { fullErr.Store(err) }
+	}
+	startCluster(t, append([]*FileServer{a}, peers...)...)
+	waitFor(t, func() bool { return len(a.peerList()) == 3 })
+
+	const key = "scratch/object"
+	placed, ok := a.policyPlacement(key)
+	require.True(t, ok)
+	require.Len(t, placed, 1)
+	var target *FileServer
+	var others []*FileServer
+	for _, s := range peers {
+		if s.ID == placed[0] {
+			target = s
+		} else {
+			others = append(others, s)
+		}
+	}
+	require.NotNil(t, target)
+	require.NoError(t, target.Store("mine", bytes.NewReader([]byte("held before the disk filled"))))
+
+	full[target].Store(true)
+	data := randomData(t, 256<<10)
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+
+	// The target refuses the replica, and a places it on another peer.
+	waitFor(t, func() bool { return a.Metrics()["replicas_no_space"] == 1 })
+	waitFor(t, func() bool { return replicaCount(a, key, others...) == 1 })
+	assert.Zero(t, replicaCount(a, key, target))
+	keys, err := target.Storage.KeysWithPrefix(a.ID, "")
+	require.NoError(t, err)
+	assert.NotContains(t, keys, crypto.HashKey(key), "the partial replica was kept")
+
+	// The target refuses writes, but still serves reads.
+	assert.ErrorIs(t, target.ReadyForWrites(), ErrNoSpace)
+	assert.ErrorIs(t, fullErr.Load().(error), syscall.ENOSPC)
+	assert.Equal(t, int64(1), target.Metrics()["disk_full"])
+	info, err := target.Stats()
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.WritesRefused)
+	r, err := target.Get("mine")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "held before the disk filled", string(got))
+
+	// A write that succeeds once space is freed makes the target ready again.
+	full[target].Store(false)
+	require.NoError(t, a.Store("everywhere", bytes.NewReader([]byte("x"))))
+	waitFor(t, func() bool { return target.ReadyForWrites() == nil })
+}
+
+func TestMinFreeBytesRefusesReplicas(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	if _, err := b.Storage.FreeBytes(); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("free disk space cannot be measured on this platform")
+	}
+	b.MinFreeBytes = 1 << 62
+	startCluster(t, a, b)
+
+	require.NoError(t, a.Store("key", bytes.NewReader([]byte("data"))))
+	waitFor(t, func() bool { return a.Metrics()["replicas_no_space"] == 1 })
+	assert.Zero(t, replicaCount(a, "key", b))
+	assert.ErrorIs(t, b.ReadyForWrites(), ErrNoSpace)
+}
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultHandlerWorkers bounds the messages handled at once when HandlerWorkers is not set.
+	defaultHandlerWorkers = 16
+	// defaultMaxProtocolErrors is the number of malformed messages tolerated from a peer when
+	// MaxProtocolErrors is not set.
+	defaultMaxProtocolErrors = 10
+)
+
+// MessageProtocolError tells a peer that a message it sent could not be handled, e.g. because
+// the receiver does not know its payload type.
+type MessageProtocolError struct {
+	Err string // What was wrong with the message
+}
+
+// messageHandler handles one decoded message from a peer.
+type messageHandler func(from string, msg *Message) error
+
+// dispatcher routes decoded messages to the handler registered for their MessageType. Each
+// peer's messages are handled one at a time, in the order they arrived, by a worker that
+// exists only while the peer has messages queued; workers of different peers run in parallel
+// up to the size of the worker pool.
+type dispatcher struct {
+	mu       sync.Mutex                     // Guards handlers, queues and strikes
+	handlers map[MessageType]messageHandler // Handlers by payload tag
+	queues   map[string][]*Message          // Messages waiting for each peer's worker, keyed by peer address
+	workers  chan struct{}                  // Limits how many messages are handled at once
+	strikes  map[string]int                 // Malformed messages received on each connection, keyed by peer address
+}
+
+// newDispatcher returns a dispatcher handling at most workers messages at once.
+func newDispatcher(workers int) *dispatcher {
+	if workers <= 0 {
+		workers = defaultHandlerWorkers
+	}
+	return &dispatcher{
+		handlers: make(map[MessageType]messageHandler),
+		queues:   make(map[string][]*Message),
+		workers:  make(chan struct{}, workers),
+		strikes:  make(map[string]int),
+	}
+}
+
+// Subscribe registers handler for messages whose payload is of type T, replacing any handler
+// registered for T before, including the built-in ones. T must have been registered with
+// RegisterMessage. Messages of types without a handler are answered with a
+// MessageProtocolError.
+//
+// Parameters:
+//   - s: Server whose incoming messages are routed.
+//   - handler: Called with the address of the sending peer and the payload. Messages from
+//     one peer are handled in order, one at a time; the connection carries no further
+//     messages from that peer until handler returns.
+//
+// Returns: An error if T is not registered.
+func Subscribe[T any](s *FileServer, handler func(from string, msg T)) error {
+	return handle(s, func(from string, msg T) error {
+		handler(from, msg)
+		return nil
+	})
+}
+
+// handle registers a handler whose errors are logged.
+//
+// Returns: An error if T is not registered.
+func handle[T any](s *FileServer, handler func(from string, msg T) error) error {
+	return handleTraced(s, func(from string, _ string, msg T) error { return handler(from, msg) })
+}
+
+// handleTraced registers a handler like handle, passing it the span of the request the
+// message was sent for, which the handler logs its part of the request with; empty for
+// messages sent for no request or by peers that predate request IDs.
+//
+// Returns: An error if T is not registered.
+func handleTraced[T any](s *FileServer, handler func(from string, span string, msg T) error) error {
+	return handleQuery(s, func(from string, q query, msg T) error { return handler(from, q.span, msg) })
+}
+
+// query is what a handler answering a message knows of it besides its payload.
+type query struct {
+	span  string // Span the request is logged under, as passed by handleTraced
+	reply uint64 // ID the answer is routed back with, zero when the peer matches answers to requests by order
+}
+
+// handleQuery registers a handler like handleTraced for messages the handler answers,
+// passing it the query, which the answer is sent for with openAnswer or sendValue.
+//
+// Returns: An error if T is not registered.
+func handleQuery[T any](s *FileServer, handler func(from string, q query, msg T) error) error {
+	tag, ok := messages.tagOf(*new(T))
+	if !ok {
+		return fmt.Errorf("message type %T is not registered", *new(T))
+	}
+	s.dispatch.mu.Lock()
+	defer s.dispatch.mu.Unlock()
+	s.dispatch.handlers[tag] = func(from string, msg *Message) error {
+		return handler(from, query{span: s.span(msg.RequestID), reply: msg.ReplyID}, msg.Payload.(T))
+	}
+	return nil
+}
+
+// registerHandlers subscribes the handlers of the built-in messages, which are all registered
+// by this package's init, so a failure is a programming error.
+func (s *FileServer) registerHandlers() {
+	err := errors.Join(
+		handleTraced(s, s.handleMessageStoreFile),
+		handleTraced(s, s.handleMessageStoreFileInline),
+		handleQuery(s, s.handleMessageGetFile),
+		handleQuery(s, s.handleMessageGetRange),
+		handle(s, s.handleMessageStoreAck),
+		handle(s, s.handleMessageStoreBatch),
+		handleQuery(s, s.handleMessageGetBatch),
+		handleQuery(s, s.handleMessageSyncTree),
+		handleQuery(s, s.handleMessageSyncKeys),
+		handleQuery(s, func(from string, q query, _ MessageNodeInfo) error { return s.handleMessageNodeInfo(from, q) }),
+		handle(s, s.handleMessageSubscribe),
+		handle(s, s.handleMessageNotify),
+		handle(s, func(_ string, msg MessageNotifyAck) error { return s.handleMessageNotifyAck(msg) }),
+		handleQuery(s, s.handleMessageTxPrepare),
+		handleQuery(s, s.handleMessageTxCommit),
+		handle(s, func(_ string, msg MessageTxAbort) error { return s.handleMessageTxAbort(msg) }),
+		handleTraced(s, s.handleMessageDeleteFile),
+		handleQuery(s, s.handleMessageRestoreFile),
+		handle(s, func(_ string, msg MessageDeleteVersions) error { return s.handleMessageDeleteVersions(msg) }),
+		handleQuery(s, s.handleMessageGetVersion),
+		handle(s, s.handleMessageProtocolError),
+		handle(s, s.handleMessageStoreRejected),
+		handleQuery(s, s.handleMessageListKeys),
+		handle(s, s.handleMessageLeaving),
+		handleQuery(s, func(from string, q query, _ MessageMirrorList) error { return s.handleMessageMirrorList(from, q) }),
+		handle(s, s.handleMessageMirrorPull),
+		handleQuery(s, s.handleMessageGrantKey),
+		handleQuery(s, s.handleMessageGrantNamespace),
+		handle(s, s.handleMessagePin),
+		handleQuery(s, s.handleMessageVerifyKeys),
+		handle(s, s.handleMessageReserveKey),
+		handle(s, s.handleMessageReserveAnswer),
+		handle(s, s.handleMessageReleaseKey),
+		handle(s, s.handleMessageAppendFile),
+		handle(s, s.handleMessageAppendRejected),
+		handleQuery(s, s.handleMessageDeletePrefix),
+		handle(s, s.handleMessageBatch),
+		handle(s, s.handleMessagePing),
+		handle(s, s.handleMessagePong),
+		handle(s, s.handleMessageReliable),
+		handle(s, s.handleMessageAck),
+		handleQuery(s, s.handleMessageChallenge),
+		handleQuery(s, s.handleMessageLease),
+		handleQuery(s, s.handleMessageLocate),
+		handle(s, s.handleMessageAlias),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// enqueue queues a message for the worker of the peer that sent it, starting the worker if
+// the peer has none.
+func (s *FileServer) enqueue(from string, msg *Message) {
+	d := s.dispatch
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue, running := d.queues[from]
+	d.queues[from] = append(queue, msg)
+	if !running {
+		s.handlers.Add(1)
+		go s.drainQueue(from)
+	}
+}
+
+// drainQueue handles the queued messages of one peer in order until none are left.
+func (s *FileServer) drainQueue(from string) {
+	defer s.handlers.Done()
+	d := s.dispatch
+	for {
+		d.mu.Lock()
+		queue := d.queues[from]
+		if len(queue) == 0 {
+			delete(d.queues, from)
+			d.mu.Unlock()
+			return
+		}
+		msg := queue[0]
+		d.queues[from] = queue[1:]
+		d.mu.Unlock()
+
+		select {
+		case <-s.quitch:
+			continue
+		case d.workers <- struct{}{}:
+		}
+		s.chaosDelay(from, msg)
+		if err := s.handleMessage(from, msg); err != nil {
+			s.logf(s.span(msg.RequestID), "handling %T from (%s): %s", msg.Payload, from, err)
+		}
+		<-d.workers
+	}
+}
+
+// handleMessage passes a message to the handler registered for its payload's tag, answering
+// messages of unknown types with a MessageProtocolError. A handler that panics on what a
+// peer sent is counted as a malformed message rather than bringing the node down.
+func (s *FileServer) handleMessage(from string, msg *Message) (err error) {
+	tag, _ := messages.tagOf(msg.Payload)
+	s.dispatch.mu.Lock()
+	handler, ok := s.dispatch.handlers[tag]
+	s.dispatch.mu.Unlock()
+	if !ok {
+		return s.rejectMessage(from, fmt.Errorf("no handler for message of type %T", msg.Payload))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handling %T: panic: %v", msg.Payload, r)
+			s.strike(from, err)
+		}
+	}()
+	return handler(from, msg)
+}
+
+// replicaPushes are the messages placing replicas on their receiver, which a node that takes
+// no replicas is never sent.
+var replicaPushes = map[MessageType]bool{
+	MessageTypeStoreFile:       true,
+	MessageTypeStoreFileInline: true,
+	MessageTypeStoreBatch:      true,
+	MessageTypeAppendFile:      true,
+}
+
+// replicaAnswers are the messages only the holders of replicas send, answering their pushes,
+// which a peer that takes no replicas has no reason to.
+var replicaAnswers = map[MessageType]bool{
+	MessageTypeStoreAck:       true,
+	MessageTypeStoreRejected:  true,
+	MessageTypeAppendRejected: true,
+}
+
+// receive decodes a message a peer sent with decodeMessageFrom, for the features this node and
+// the peer both support, and checks with admitMessage that the peer may send it. A connection
+// that already closed is held to this node's features alone.
+//
+// Returns: The message, and an error if it may not be handled.
+func (s *FileServer) receive(from string, b []byte) (Message, error) {
+	common := s.caps
+	if peer, ok := s.peer(from); ok {
+		common &= peer.Hello().Capabilities
+	}
+	msg, err := decodeMessageFrom(b, common)
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, s.admitMessage(from, msg.Payload)
+}
+
+// admitMessage checks that the role of this node and of the peer in the cluster allow the
+// peer to send a message: replicas are not pushed to a node that takes none, and a peer that
+// takes none does not answer pushes. Messages of peers no longer connected are admitted.
+func (s *FileServer) admitMessage(from string, payload any) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil
+	}
+	tag, _ := messages.tagOf(payload)
+	if err := checkTag(tag, s.caps&peer.Hello().Capabilities); err != nil {
+		return err
+	}
+	if replicaPushes[tag] && s.NoListen && !s.AcceptReplicas {
+		return fmt.Errorf("%w: %s to a node that takes no replicas", errMessageRefused, tag)
+	}
+	if replicaAnswers[tag] && !takesReplicas(peer) {
+		return fmt.Errorf("%w: %s from a peer that takes no replicas", errMessageRefused, tag)
+	}
+	return nil
+}
+
+// rejectMessage answers a message that could not be handled with a MessageProtocolError.
+func (s *FileServer) rejectMessage(from string, reason error) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found: %w", from, reason)
+	}
+	defer s.strike(from, reason)
+	if _, err := s.sendMessage([]p2p.Node{peer}, &Message{Payload: MessageProtocolError{Err: reason.Error()}}); err != nil {
+		return fmt.Errorf("rejecting message from (%s): %w", from, err)
+	}
+	return reason
+}
+
+// strike counts a malformed or unknown message received from a peer, disconnecting it once
+// MaxProtocolErrors have arrived on its connection: a peer sending them that often is out
+// of step with this node or not a node at all, and would otherwise be answered forever.
+func (s *FileServer) strike(from string, reason error) {
+	s.metrics.malformedMessages.Add(1)
+	d := s.dispatch
+	d.mu.Lock()
+	d.strikes[from]++
+	out := d.strikes[from] >= s.MaxProtocolErrors
+	if out {
+		delete(d.strikes, from)
+	}
+	d.mu.Unlock()
+	if !out {
+		return
+	}
+	peer, ok := s.peer(from)
+	if !ok {
+		return
+	}
+	s.metrics.peersDisconnected.Add(1)
+	log.Printf("[%s] disconnecting peer (%s) after %d malformed messages, the last: %s", s.Transport.Addr(), from, s.MaxProtocolErrors, reason)
+	if err := peer.Close(); err != nil {
+		log.Printf("[%s] closing connection to (%s): %s", s.Transport.Addr(), from, err)
+	}
+}
+
+// forgetStrikes drops the malformed messages counted for a connection that closed.
+func (d *dispatcher) forgetStrikes(from string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.strikes, from)
+}
+
+// handleMessageProtocolError records that a peer could not handle a message this node sent.
+func (s *FileServer) handleMessageProtocolError(from string, msg MessageProtocolError) error {
+	s.metrics.protocolErrors.Add(1)
+	log.Printf("[%s] peer (%s) rejected a message: %s", s.Transport.Addr(), from, msg.Err)
+	return nil
+}
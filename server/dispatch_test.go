@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// messagePing is a custom message type subscribed to by the dispatch tests.
+type messagePing struct {
+	Seq int
+}
+
+// messageUnhandled is a message type no server subscribes to.
+type messageUnhandled struct{}
+
+func init() {
+	if err := errors.Join(
+		RegisterMessage[messagePing](MessageTypeCustom),
+		RegisterMessage[messageUnhandled](MessageTypeCustom+1),
+	); err != nil {
+		panic(err)
+	}
+}
+
+func TestSubscribeRoutesCustomMessages(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	var (
+		mu   sync.Mutex
+		seqs []int
+		from string
+	)
+	require.NoError(t, Subscribe(b, func(addr string, msg messagePing) {
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, msg.Seq)
+		from = addr
+	}))
+	startCluster(t, a, b)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		require.NoError(t, a.broadcast(&Message{Payload: messagePing{Seq: i}}))
+	}
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seqs) == n
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for i, seq := range seqs {
+		assert.Equal(t, i, seq, "messages from one peer must be handled in order")
+	}
+	_, ok := b.peer(from)
+	assert.True(t, ok, "the handler must be given the sending peer's address")
+}
+
+func TestUnknownMessageGetsProtocolError(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	require.NoError(t, a.broadcast(&Message{Payload: messageUnhandled{}}))
+	waitFor(t, func() bool { return a.Metrics()["protocol_errors"] == 1 })
+	assert.Zero(t, b.Metrics()["protocol_errors"])
+
+	// The connection keeps working after the rejection.
+	var got sync.WaitGroup
+	got.Add(1)
+	require.NoError(t, Subscribe(b, func(string, messagePing) { got.Done() }))
+	require.NoError(t, a.broadcast(&Message{Payload: messagePing{}}))
+	got.Wait()
+}
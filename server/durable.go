@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// ErrNotDurable is wrapped by the *DurabilityError StoreDurable returns when fewer peers than
+// required acknowledged the replica.
+var ErrNotDurable = errors.New("object not durable on enough peers")
+
+// errNoAcks is reported for peers too old to acknowledge replicas.
+var errNoAcks = errors.New("peer cannot acknowledge replicas")
+
+// MessageStoreAck tells the sender of a replica that asked for it whether the replica is
+// stored. With SyncWrites set on the receiver it is only sent once the replica is on disk.
+type MessageStoreAck struct {
+	AckID uint64 // Identifier the replica was sent with
+	Err   string // Why the replica was not stored, empty when it was
+}
+
+// DurabilityError reports that a StoreDurable call did not reach the required number of
+// acknowledged replicas. The object is still stored locally and on the peers it reached.
+type DurabilityError struct {
+	Want  int      // Acknowledged replicas required
+	Acked []string // Addresses of the peers that acknowledged, sorted
+}
+
+// Error describes how many and which peers acknowledged the replica.
+func (e *DurabilityError) Error() string {
+	acked := "none"
+	if len(e.Acked) > 0 {
+		acked = strings.Join(e.Acked, ", ")
+	}
+	return fmt.Sprintf("%s: %d of %d replicas acknowledged, by %s", ErrNotDurable, len(e.Acked), e.Want, acked)
+}
+
+// Unwrap returns ErrNotDurable.
+func (e *DurabilityError) Unwrap() error {
+	return ErrNotDurable
+}
+
+// storeAck is an acknowledgement received from a peer.
+type storeAck struct {
+	from string // Address of the peer
+	err  error  // Why the peer did not store the replica, nil when it did
+}
+
+// ackTable routes acknowledgements to the StoreDurable calls waiting for them.
+type ackTable struct {
+	incarnation uint32                   // Incarnation of the node, carried by the identifiers
+	mu          sync.Mutex               // Guards next and waiting
+	next        uint64                   // Sequence of the last identifier handed out
+	waiting     map[uint64]chan storeAck // Acknowledgements by identifier of the call waiting for them
+}
+
+// begin returns a new acknowledgement identifier and the channel its acknowledgements from up
+// to peers peers are delivered on, with room for each of them to fail once more on restart.
+func (a *ackTable) begin(peers int) (uint64, <-chan storeAck) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.waiting == nil {
+		a.waiting = make(map[uint64]chan storeAck)
+	}
+	a.next++
+	id := correlationID(a.incarnation, a.next)
+	ch := make(chan storeAck, 2*peers)
+	a.waiting[id] = ch
+	return id, ch
+}
+
+// end stops delivering the acknowledgements of id; later ones are dropped.
+func (a *ackTable) end(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.waiting, id)
+}
+
+// fail hands every call waiting for acknowledgements a failure from the peer at addr, which
+// will not acknowledge what it was sent.
+func (a *ackTable) fail(addr string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, ch := range a.waiting {
+		select {
+		case ch <- storeAck{from: addr, err: err}:
+		default:
+		}
+	}
+}
+
+// deliver hands an acknowledgement to the call waiting for it, if any.
+func (a *ackTable) deliver(id uint64, ack storeAck) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ch, ok := a.waiting[id]; ok {
+		select {
+		case ch <- ack:
+		default:
+		}
+	}
+}
+
+// StoreDurable stores a file like Store, then waits until at least minReplicas peers
+// acknowledge that they stored its replica, so the object survives this node failing as soon
+// as the call returns. Peers with SyncWrites set acknowledge only once the replica is flushed
+// to disk. Peers too old to acknowledge replicas never count.
+//
+// Parameters:
+//   - ctx: Bounds the replication and the wait for acknowledgements.
+//   - key: Key of the file.
+//   - r: Content of the file.
+//   - minReplicas: Acknowledged replicas required; zero returns once the replicas are sent.
+//
+// Returns: The outcome, with PeerErrs naming the peers that failed, refused or had not
+// acknowledged by the deadline, and a *DurabilityError if too few acknowledged. Replicas that
+// landed are kept either way.
+func (s *FileServer) StoreDurable(ctx context.Context, key string, r io.Reader, minReplicas int) (StoreResult, error) {
+	result := StoreResult{Key: key}
+	if err := checkKey(key); err != nil {
+		result.Err = err
+		return result, err
+	}
+	peers := replicaPeers(s.peerList())
+	ackPeers, legacy := s.peersWith(peers, func(c peerCaps) bool { return c.acks })
+	id, acks := s.acks.begin(len(ackPeers))
+	defer s.acks.end(id)
+
+	t := s.transfers.start(ctx, s.requestID(ctx), "store", key, TransferOpts{})
+	size, err := s.storeReplicated(t, key, r, peers, id, ObjectMetadata{})
+	s.transfers.done(t)
+	result.Size = size
+	var berr *BroadcastError
+	if err != nil && !errors.As(err, &berr) {
+		result.Err = err
+		return result, err
+	}
+	pending := make(map[string]bool, len(ackPeers))
+	for _, peer := range ackPeers {
+		pending[peer.RemoteAddr().String()] = true
+	}
+	if berr != nil {
+		for addr, err := range berr.failed {
+			addPeerErr(&result, addr, err)
+			delete(pending, addr)
+		}
+	}
+	for _, peer := range legacy {
+		addPeerErr(&result, peer.RemoteAddr().String(), errNoAcks)
+	}
+
+	var acked []string
+	for len(acked) < minReplicas && len(pending) > 0 {
+		select {
+		case ack := <-acks:
+			if !pending[ack.from] {
+				continue
+			}
+			delete(pending, ack.from)
+			if ack.err != nil {
+				addPeerErr(&result, ack.from, ack.err)
+				continue
+			}
+			acked = append(acked, ack.from)
+		case <-ctx.Done():
+			for addr := range pending {
+				addPeerErr(&result, addr, ctx.Err())
+			}
+			pending = nil
+		}
+	}
+	if len(acked) >= minReplicas {
+		return result, nil
+	}
+	sort.Strings(acked)
+	return result, &DurabilityError{Want: minReplicas, Acked: acked}
+}
+
+// ackReplica acknowledges a replica to its sender when it asked for it, reporting err, which
+// is returned unchanged unless sending the acknowledgement fails too.
+func (s *FileServer) ackReplica(from string, key string, ackID uint64, err error) error {
+	if ackID == 0 {
+		return err
+	}
+	if s.testHookBeforeAck != nil {
+		s.testHookBeforeAck(key)
+	}
+	ack := MessageStoreAck{AckID: ackID}
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	peer, ok := s.peer(from)
+	if !ok {
+		return errors.Join(err, fmt.Errorf("acknowledging (%s): peer (%s) not found", key, from))
+	}
+	if _, serr := s.sendMessage([]p2p.Node{peer}, &Message{Payload: ack}); serr != nil {
+		return errors.Join(err, fmt.Errorf("acknowledging (%s): %w", key, serr))
+	}
+	return err
+}
+
+// handleMessageStoreAck hands an acknowledgement to the StoreDurable call waiting for it.
+func (s *FileServer) handleMessageStoreAck(from string, msg MessageStoreAck) error {
+	if s.staleAnswer(from, "acknowledgement", msg.AckID) {
+		return nil
+	}
+	ack := storeAck{from: from}
+	if len(msg.Err) > 0 {
+		ack.err = newRemoteError(msg.Err)
+		log.Printf("[%s] peer (%s) did not store a replica: %s", s.Transport.Addr(), from, msg.Err)
+	}
+	s.acks.deliver(msg.AckID, ack)
+	return nil
+}
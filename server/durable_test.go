@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// durableCluster starts a writer at :4000 with two peers storing with SyncWrites set.
+func durableCluster(t *testing.T) (*FileServer, *FileServer, *FileServer) {
+	t.Helper()
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	b.Storage.SyncWrites = true
+	c.Storage.SyncWrites = true
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+	return a, b, c
+}
+
+func TestStoreDurableWaitsForAcks(t *testing.T) {
+	a, b, c := durableCluster(t)
+	data := randomData(t, 1<<10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := a.StoreDurable(ctx, "key", bytes.NewReader(data), 2)
+	require.NoError(t, err)
+	assert.Empty(t, result.PeerErrs)
+	assert.Equal(t, int64(len(data)), result.Size)
+
+	// Both replicas were acknowledged, so they are stored by the time the call returns.
+	for _, s := range []*FileServer{b, c} {
+		ok, err := s.Storage.Has(a.ID, crypto.HashKey("key"))
+		require.NoError(t, err)
+		assert.True(t, ok, s.Transport.Addr())
+	}
+}
+
+func TestStoreDurableReportsPartialDurability(t *testing.T) {
+	a, b, c := durableCluster(t)
+	// c acknowledges only once the call gave up waiting for it.
+	late := make(chan struct{})
+	c.testHookBeforeAck = func(string) { <-late }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	result, err := a.StoreDurable(ctx, "key", bytes.NewReader(randomData(t, 1<<10)), 2)
+	require.ErrorIs(t, err, ErrNotDurable)
+	var derr *DurabilityError
+	require.True(t, errors.As(err, &derr))
+	assert.Equal(t, 2, derr.Want)
+	require.Len(t, derr.Acked, 1)
+	assert.Equal(t, b.peerList()[0].LocalAddr().String(), derr.Acked[0])
+	require.Len(t, result.PeerErrs, 1)
+	for _, err := range result.PeerErrs {
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+
+	// The late replica is kept.
+	close(late)
+	waitFor(t, func() bool {
+		ok, _ := c.Storage.Has(a.ID, crypto.HashKey("key"))
+		return ok
+	})
+}
@@ -0,0 +1,21 @@
+package server
+
+import "github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+
+// takesReplicas reports whether replicas may be placed on peer: any peer but one that does
+// not listen, unless it set AcceptReplicas.
+func takesReplicas(peer p2p.Node) bool {
+	hello := peer.Hello()
+	return !hello.NoListen || hello.AcceptReplicas
+}
+
+// replicaPeers returns those of peers that take replicas.
+func replicaPeers(peers []p2p.Node) []p2p.Node {
+	kept := peers[:0:0]
+	for _, peer := range peers {
+		if takesReplicas(peer) {
+			kept = append(kept, peer)
+		}
+	}
+	return kept
+}
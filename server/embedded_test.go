@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNoListenNode runs a node without a listener against a two node cluster. Its objects are
+// replicated out and fetched back in over the connections it dialed, while the cluster never
+// dials it nor places replicas on it.
+func TestNoListenNode(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	c.NoListen = true
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(c.peerList()) == 2 && len(a.peerList()) == 2 && len(b.peerList()) == 2 })
+
+	require.Error(t, a.Transport.Dial(":4002"), "the node should not listen")
+	for _, s := range []*FileServer{a, b} {
+		assert.NotContains(t, s.Hello().Peers, c.ID, "the node should not be advertised")
+	}
+
+	// Stores replicate outward, and Gets fetch inward.
+	data := randomData(t, 64<<10)
+	require.NoError(t, c.Store("report", bytes.NewReader(data)))
+	waitFor(t, func() bool { return replicaCount(c, "report", a, b) == 2 })
+	require.NoError(t, c.Storage.Delete(c.ID, "report"))
+	requireGet(t, c, "report", data)
+
+	// No replica is ever pushed to the node.
+	require.NoError(t, a.Store("notes", bytes.NewReader([]byte("draft"))))
+	_, err := a.StoreBatch([]StoreItem{{Key: "batched", Data: bytes.NewReader([]byte("draft"))}})
+	require.NoError(t, err)
+	res, err := b.StoreDurable(context.Background(), "durable", bytes.NewReader([]byte("draft")), 1)
+	require.NoError(t, err)
+	assert.Empty(t, res.PeerErrs)
+	waitFor(t, func() bool {
+		return replicaCount(a, "notes", b) == 1 && replicaCount(a, "batched", b) == 1
+	})
+	owners, err := c.Storage.Owners()
+	require.NoError(t, err)
+	assert.Equal(t, []string{c.ID}, owners)
+}
+
+func TestNoListenNodeAcceptingReplicas(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	c.NoListen, c.AcceptReplicas = true, true
+	startCluster(t, a, c)
+
+	require.NoError(t, a.Store("notes", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(a, "notes", c) == 1 })
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodesWithDifferentContentTransforms(t *testing.T) {
+	keys := func(keyID string) ([]byte, error) {
+		if keyID != "at-rest" {
+			return nil, errors.New("unknown key")
+		}
+		return bytes.Repeat([]byte{7}, 32), nil
+	}
+	gzip := storage.ContentTransform{ID: storage.GzipCodec}
+	aes := storage.ContentTransform{ID: storage.AESCTRCodec, Params: map[string]string{"key": "at-rest"}}
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.GetParallelism = 3
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	d := makeMemoryServer(t, network, ":4003", ":4000")
+	configs := map[*FileServer][]storage.ContentTransform{a: {gzip}, b: {aes}, c: {gzip, aes}, d: nil}
+	for s, transforms := range configs {
+		s.Storage.ContentTransforms, s.Storage.LookupKey = transforms, keys
+	}
+	startCluster(t, a, b, c, d)
+	waitFor(t, func() bool { return len(a.peerList()) == 3 })
+
+	// Several range chunks, so peers serve ranges of their encoded replicas.
+	data := randomData(t, 3*rangeChunkSize+100)
+	require.NoError(t, a.Store("report", bytes.NewReader(data)))
+	waitFor(t, func() bool { return replicaCount(a, "report", b, c, d) == 3 })
+	for s, transforms := range configs {
+		owner, key := a.ID, crypto.HashKey("report")
+		if s == a {
+			owner, key = a.ID, "report"
+		}
+		encoding, err := s.Storage.Encoding(owner, key)
+		require.NoError(t, err)
+		require.Len(t, encoding, len(transforms))
+		for i := range transforms {
+			assert.Equal(t, transforms[i].ID, encoding[i].ID)
+		}
+	}
+
+	// Replicas encoded differently hold the same content, so none counts as stale.
+	locations, err := a.Locate("report")
+	require.NoError(t, err)
+	for _, loc := range locations[1:] {
+		assert.Equal(t, LocationConfirmed, loc.State)
+		assert.False(t, loc.Stale, loc.Node)
+		assert.Equal(t, locations[1].Checksum, loc.Checksum)
+	}
+
+	// The owner, now configured to encrypt, fetches its object back from the peers.
+	a.Storage.ContentTransforms = []storage.ContentTransform{aes}
+	require.NoError(t, a.DropLocalCopy("report"))
+	_, r, err := a.GetWithInfo("report")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, r.Close())
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.NoError(t, a.Storage.Verify(a.ID, "report"))
+}
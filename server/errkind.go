@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// ErrInvalidKey is returned when a key cannot name an object, such as an empty one.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrTimeout is returned when a peer did not answer a request in time.
+var ErrTimeout = errors.New("timed out")
+
+// Kind classifies an error returned by the FileServer by what the caller can do about it.
+type Kind string
+
+const (
+	// KindNone is the kind of a nil error.
+	KindNone Kind = ""
+	// KindNotFound means the object, peer or transfer named does not exist. Not retryable.
+	KindNotFound Kind = "not-found"
+	// KindInvalid means the request can never succeed as made, such as for an empty key. Not
+	// retryable.
+	KindInvalid Kind = "invalid"
+	// KindDenied means a namespace key is missing or a peer's Authorizer denied the request.
+	// Not retryable.
+	KindDenied Kind = "denied"
+	// KindImmutable means the object is immutable and holds other content. Not retryable.
+	KindImmutable Kind = "immutable"
+	// KindConflict means another node holds a lease on the key. Retryable once it expires.
+	KindConflict Kind = "conflict"
+	// KindNoSpace means this node or a peer has no space left, or a peer's quota for this node
+	// is used up. Retryable, as space is freed or the object is placed elsewhere.
+	KindNoSpace Kind = "no-space"
+	// KindUnavailable means some node needed could not be reached or could not tell: the
+	// object may exist, or the request may succeed, once it can. Retryable.
+	KindUnavailable Kind = "unavailable"
+	// KindTimeout means a peer or the caller's deadline ran out. Retryable.
+	KindTimeout Kind = "timeout"
+	// KindCanceled means the caller cancelled the request. Not retryable.
+	KindCanceled Kind = "canceled"
+	// KindInternal means anything else, such as a local disk failing. Not retryable.
+	KindInternal Kind = "internal"
+)
+
+// kindOf maps the errors the FileServer wraps to their kinds, checked in order: an error
+// wrapping several takes the kind of the first.
+var kindOf = []struct {
+	err  error
+	kind Kind
+}{
+	{context.Canceled, KindCanceled},
+	{ErrInvalidKey, KindInvalid},
+	{ErrDeleteAll, KindInvalid},
+	{ErrNotDir, KindInvalid},
+	{ErrAliasLoop, KindInvalid},
+	{ErrAccessDenied, KindDenied},
+	{ErrUnauthorized, KindDenied},
+	{ErrImmutable, KindImmutable},
+	{ErrKeyNotFound, KindNotFound},
+	{ErrPeerNotFound, KindNotFound},
+	{ErrTransferNotFound, KindNotFound},
+	{ErrListExpired, KindNotFound},
+	{storage.ErrNotInTrash, KindNotFound},
+	{fs.ErrNotExist, KindNotFound},
+	{ErrLeased, KindConflict},
+	{ErrNoSpace, KindNoSpace},
+	{ErrQuotaExceeded, KindNoSpace},
+	{ErrTimeout, KindTimeout},
+	{ErrUnavailable, KindUnavailable},
+	{ErrDraining, KindUnavailable},
+	{ErrBusy, KindUnavailable},
+	{ErrNotDurable, KindUnavailable},
+	{ErrReplicaSize, KindUnavailable},
+	{errPeerRestarted, KindUnavailable},
+	{errStreamTruncated, KindUnavailable},
+	{errRequestCancelled, KindUnavailable},
+}
+
+// ErrorKind classifies an error returned by the FileServer. Errors wrapping none of the
+// errors the server classifies are KindTimeout when they report a timeout, KindUnavailable
+// when they are a *BroadcastError of send failures, and KindInternal otherwise.
+func ErrorKind(err error) Kind {
+	if err == nil {
+		return KindNone
+	}
+	for _, k := range kindOf {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return KindTimeout
+	}
+	var berr *BroadcastError
+	if errors.As(err, &berr) {
+		return KindUnavailable
+	}
+	return KindInternal
+}
+
+// Retryable reports whether a request that failed with an error of the kind may succeed if
+// made again unchanged.
+func (k Kind) Retryable() bool {
+	switch k {
+	case KindConflict, KindNoSpace, KindUnavailable, KindTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsRetryable reports whether a request that failed with err may succeed if made again.
+func IsRetryable(err error) bool {
+	return ErrorKind(err).Retryable()
+}
+
+// IsNotFound reports whether err means the object, or whatever else was named, does not exist.
+func IsNotFound(err error) bool {
+	return ErrorKind(err) == KindNotFound
+}
+
+// checkKey returns an error wrapping ErrInvalidKey if key cannot name an object.
+func checkKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+	return nil
+}
+
+// remoteError is an error a peer sent as text. It matches with errors.Is the error of this
+// package its text names, so it is classified like the error the peer returned.
+type remoteError struct {
+	text string
+	err  error // Classified error named by text, nil if none is
+}
+
+// newRemoteError rebuilds the error a peer sent as text.
+func newRemoteError(text string) error {
+	e := &remoteError{text: text}
+	for _, k := range kindOf {
+		if strings.Contains(text, k.err.Error()) {
+			e.err = k.err
+			break
+		}
+	}
+	return e
+}
+
+// Error returns the text the peer sent.
+func (e *remoteError) Error() string {
+	return e.text
+}
+
+// Unwrap returns the classified error named by the text, if any.
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
+
+// Defaults of a RetryPolicy.
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 5 * time.Second
+)
+
+// RetryPolicy bounds the attempts Retry makes.
+type RetryPolicy struct {
+	Attempts   int           // Most calls made, the first included; defaults to 3
+	Backoff    time.Duration // Wait before the second call, doubled before each further one; defaults to 100ms
+	MaxBackoff time.Duration // Longest wait between calls; defaults to 5s
+}
+
+// Retry calls fn until it succeeds, fails with an error IsRetryable rejects, policy.Attempts
+// calls were made or ctx is done, waiting with exponential backoff between calls.
+//
+// Returns: The error of the last call, or one wrapping ctx.Err() and it when ctx was done
+// while waiting.
+func Retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	attempts := policy.Attempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !IsRetryable(err) || attempt == attempts {
+			return err
+		}
+		timer := time.NewTimer(min(backoff, maxBackoff))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w, after: %w", ctx.Err(), err)
+		}
+		backoff *= 2
+	}
+}
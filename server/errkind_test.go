@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorKinds(t *testing.T) {
+	s := makeServer(t, ":3000")
+	require.NoError(t, s.StoreWithMetadata("frozen", strings.NewReader("ice"), ObjectMetadata{Immutable: true}))
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	batchErr := func(items []StoreItem) error {
+		results, err := s.StoreBatch(items)
+		require.NoError(t, err)
+		return results[0].Err
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		kind Kind
+	}{
+		{"get missing", func() error { _, err := s.Get("missing"); return err }(), KindNotFound},
+		{"cancel finished transfer", s.CancelTransfer(42), KindNotFound},
+		{"store empty key", s.Store("", strings.NewReader("x")), KindInvalid},
+		{"get empty key", func() error { _, err := s.Get(""); return err }(), KindInvalid},
+		{"delete empty key", s.Delete(""), KindInvalid},
+		{"batch empty key", batchErr([]StoreItem{{Key: "", Data: strings.NewReader("x")}}), KindInvalid},
+		{"durable empty key", func() error {
+			_, err := s.StoreDurable(context.Background(), "", strings.NewReader("x"), 0)
+			return err
+		}(), KindInvalid},
+		{"atomic duplicate key", s.StoreAtomic([]StoreItem{{Key: "k", Data: strings.NewReader("1")}, {Key: "k", Data: strings.NewReader("2")}}), KindInvalid},
+		{"overwrite immutable", s.Store("frozen", strings.NewReader("water")), KindImmutable},
+		{"delete immutable", s.Delete("frozen"), KindImmutable},
+		{"store past deadline", s.StoreContext(expired, "late", strings.NewReader("x"), TransferOpts{}), KindTimeout},
+		{"store cancelled", s.StoreContext(cancelled, "late", strings.NewReader("x"), TransferOpts{}), KindCanceled},
+		{"peer timed out", &FetchError{Key: "k", Peers: []PeerResult{{Peer: "a", Outcome: OutcomeTimeout}}}, KindUnavailable},
+		{"peer unreachable", &BroadcastError{failed: map[string]error{"a": errors.New("broken pipe")}, total: 1}, KindUnavailable},
+		{"peer out of space", &BroadcastError{failed: map[string]error{"a": newRemoteError("storing (k): no space left for writes")}, total: 1}, KindNoSpace},
+		{"peer denied", newRemoteError("denied by (a): unauthorized"), KindDenied},
+		{"peer holds lease", fmt.Errorf("storing (k): %w", ErrLeased), KindConflict},
+		{"peer did not answer", fmt.Errorf("%w waiting for an answer from (a)", ErrTimeout), KindTimeout},
+		{"local disk", errors.New("input/output error"), KindInternal},
+		{"success", nil, KindNone},
+	} {
+		assert.Equal(t, tc.kind, ErrorKind(tc.err), tc.name)
+		assert.Equal(t, tc.kind.Retryable(), IsRetryable(tc.err), tc.name)
+		assert.Equal(t, tc.kind == KindNotFound, IsNotFound(tc.err), tc.name)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	calls := 0
+	err := Retry(context.Background(), policy, func() error {
+		if calls++; calls < 3 {
+			return ErrUnavailable
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = Retry(context.Background(), policy, func() error {
+		calls++
+		return ErrUnavailable
+	})
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 3, calls, "gives up after Attempts calls")
+
+	calls = 0
+	err = Retry(context.Background(), policy, func() error {
+		calls++
+		return ErrImmutable
+	})
+	assert.ErrorIs(t, err, ErrImmutable)
+	assert.Equal(t, 1, calls, "permanent errors are not retried")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = Retry(ctx, RetryPolicy{Attempts: 10, Backoff: time.Hour}, func() error {
+		calls++
+		cancel()
+		return ErrUnavailable
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// exchange sends a request to one peer and decodes the value it streams back into v. Peers
+// supporting CapReplies route the answer to the request by its ID; with other peers, answers
+// are matched to requests by order, so the exchange holds fetchTurn until the answer has been
+// read.
+//
+// Parameters:
+//   - peer: Peer the request is sent to.
+//   - msg: The request.
+//   - v: Pointer the answer is decoded into.
+//   - timeout: How long to wait for the answer, including for fetchTurn.
+//
+// Returns: Any errors sending the request or reading the answer.
+func (s *FileServer) exchange(peer p2p.Node, msg *Message, v any, timeout time.Duration) error {
+	return s.exchangeStream(peer, msg, nil, v, timeout)
+}
+
+// exchangeStream is exchange for requests followed by a stream: when payload is not nil it is
+// streamed to the peer right after msg, before the answer is awaited.
+func (s *FileServer) exchangeStream(peer p2p.Node, msg *Message, payload []byte, v any, timeout time.Duration) error {
+	timer := s.Clock.NewTimer(timeout)
+	defer timer.Stop()
+	timedOut := fmt.Errorf("%w waiting for an answer from (%s)", ErrTimeout, peer.RemoteAddr())
+	ordered := !s.capsOf(peer).replies
+	if ordered {
+		select {
+		case s.fetchTurn <- struct{}{}:
+		case <-timer.C():
+			return timedOut
+		}
+	}
+	req := *msg
+	req.ReplyID = s.nextRequestID()
+	if err := s.sendRequest(peer, &req, payload); err != nil {
+		if ordered {
+			<-s.fetchTurn
+		}
+		return err
+	}
+	// Decode into a private buffer so a late answer cannot race the caller reading v.
+	abandoned := make(chan struct{})
+	done := make(chan []byte, 1)
+	errc := make(chan error, 1)
+	go func() {
+		if ordered {
+			defer func() { <-s.fetchTurn }()
+		}
+		b, err := readValue(s.awaitAnswer(peer, req.ReplyID, abandoned))
+		if err != nil {
+			errc <- err
+			return
+		}
+		done <- b
+	}()
+	select {
+	case b := <-done:
+		return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+	case err := <-errc:
+		return err
+	case <-timer.C():
+		close(abandoned)
+		return timedOut
+	}
+}
+
+// sendRequest sends msg to the peer, followed by payload as a stream when it is not nil.
+// Requests with a stream hold streamMu so no other stream is interleaved with theirs.
+func (s *FileServer) sendRequest(peer p2p.Node, msg *Message, payload []byte) error {
+	if payload == nil {
+		_, err := s.sendMessage([]p2p.Node{peer}, msg)
+		return err
+	}
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	if _, err := s.sendMessage([]p2p.Node{peer}, msg); err != nil {
+		return err
+	}
+	return s.sendStream(peer, payload)
+}
+
+// readValue reads a size-prefixed, gob-encoded value from an answer stream, nil when the
+// answer was abandoned.
+func readValue(stream io.ReadCloser) ([]byte, error) {
+	if stream == nil {
+		return nil, errAnswerAbandoned
+	}
+	defer stream.Close()
+	var size int64
+	if err := binary.Read(stream, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > p2p.MaxMessageSize {
+		return nil, fmt.Errorf("answer of %d bytes exceeds the %d byte limit", size, p2p.MaxMessageSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// sendValue streams a gob-encoded value to the peer at from as the answer to its query q.
+func (s *FileServer) sendValue(from string, q query, v any) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	b := binary.LittleEndian.AppendUint64(nil, uint64(buf.Len()))
+	return s.sendAnswer(peer, q, append(b, buf.Bytes()...))
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// ErrUnavailable is returned by Get when no peer served an object but some peer could not
+// tell whether it holds it: it could not be reached, did not answer in time or sent a damaged
+// copy. Unlike ErrKeyNotFound, the object may well exist.
+var ErrUnavailable = errors.New("object unavailable")
+
+// PeerOutcome is how a peer asked for an object failed to serve it.
+type PeerOutcome string
+
+const (
+	// OutcomeNotFound means the peer answered that it does not hold the object.
+	OutcomeNotFound PeerOutcome = "not-found"
+	// OutcomeTimeout means the peer had not finished answering when the fetch gave up.
+	OutcomeTimeout PeerOutcome = "timeout"
+	// OutcomeConnError means the request could not be sent or the answer could not be read.
+	OutcomeConnError PeerOutcome = "connection-error"
+	// OutcomeChecksumMismatch means the peer's copy did not match the checksum it announced.
+	OutcomeChecksumMismatch PeerOutcome = "checksum-mismatch"
+	// OutcomeDenied means the peer's Authorizer denied the request.
+	OutcomeDenied PeerOutcome = "denied"
+	// OutcomeBusy means the peer was at its admission limits and refused the request.
+	OutcomeBusy PeerOutcome = "busy"
+)
+
+// PeerResult is the outcome of asking one peer for an object.
+type PeerResult struct {
+	Peer       string        // Address of the peer
+	Outcome    PeerOutcome   // How the peer failed to serve the object
+	Err        error         // Why, for connection errors and checksum mismatches; ErrUnauthorized for denials and ErrBusy for busy peers
+	Elapsed    time.Duration // Time from asking the peer to its answer, or to giving up on it
+	RetryAfter time.Duration // How long a busy peer suggested waiting before asking again
+}
+
+// FetchError is returned by Get when no peer served an object, describing how every peer asked
+// answered. It matches ErrKeyNotFound with errors.Is only when every peer affirmatively
+// answered that it does not hold the object, which includes when there were no peers to ask,
+// and ErrUnavailable otherwise.
+type FetchError struct {
+	Key     string        // Plain key of the object
+	Peers   []PeerResult  // Outcome of every peer asked, in the order they were asked
+	Elapsed time.Duration // Time from the first request to giving up
+}
+
+// NotFound reports whether every peer asked answered that it does not hold the object.
+func (e *FetchError) NotFound() bool {
+	for _, p := range e.Peers {
+		if p.Outcome != OutcomeNotFound {
+			return false
+		}
+	}
+	return true
+}
+
+// Error names the outcome of every peer asked, unless all of them lack the object.
+func (e *FetchError) Error() string {
+	if e.NotFound() {
+		return fmt.Sprintf("file %s not found on any peers", e.Key)
+	}
+	msgs := make([]string, 0, len(e.Peers))
+	for _, p := range e.Peers {
+		msg := fmt.Sprintf("%s: %s after %s", p.Peer, p.Outcome, p.Elapsed.Round(time.Millisecond))
+		if p.Err != nil {
+			msg += fmt.Sprintf(" (%s)", p.Err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return fmt.Sprintf("file %s unavailable from the network after %s: %s", e.Key, e.Elapsed.Round(time.Millisecond), strings.Join(msgs, "; "))
+}
+
+// retryAfter returns the shortest wait suggested by the peers that were busy, and whether any
+// was.
+func (e *FetchError) retryAfter() (time.Duration, bool) {
+	var wait time.Duration
+	busy := false
+	for _, p := range e.Peers {
+		if p.Outcome == OutcomeBusy && (!busy || p.RetryAfter < wait) {
+			wait, busy = p.RetryAfter, true
+		}
+	}
+	return wait, busy
+}
+
+// Unwrap returns ErrKeyNotFound if the object is definitely absent, and ErrUnavailable if
+// some peer could not tell.
+func (e *FetchError) Unwrap() error {
+	if e.NotFound() {
+		return ErrKeyNotFound
+	}
+	return ErrUnavailable
+}
+
+// fetchOutcomes collects the outcomes of the peers asked by one fetch, shared between the
+// fetch and the goroutines reading the answers. Peers asked that never answer are taken to
+// have timed out.
+type fetchOutcomes struct {
+	key   string
+	began time.Time
+	mu    sync.Mutex              // Guards the fields below
+	sent  map[p2p.Node]time.Time  // When each peer was asked
+	order []p2p.Node              // Peers asked, in order
+	done  map[p2p.Node]PeerResult // Outcome of every peer that answered without serving the object
+}
+
+// newFetchOutcomes starts collecting the outcomes of a fetch of key begun at began.
+func newFetchOutcomes(key string, began time.Time) *fetchOutcomes {
+	return &fetchOutcomes{
+		key:   key,
+		began: began,
+		sent:  make(map[p2p.Node]time.Time),
+		done:  make(map[p2p.Node]PeerResult),
+	}
+}
+
+// asked records that peer was asked at.
+func (o *fetchOutcomes) asked(peer p2p.Node, at time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.sent[peer]; !ok {
+		o.order = append(o.order, peer)
+	}
+	o.sent[peer] = at
+}
+
+// broadcast records that peers were asked at with a single broadcast, which berr, if not nil,
+// names the peers it did not reach of; those are recorded as connection errors.
+func (o *fetchOutcomes) broadcast(peers []p2p.Node, berr *BroadcastError, at time.Time) {
+	for _, peer := range peers {
+		o.asked(peer, at)
+		if berr == nil {
+			continue
+		}
+		if err, ok := berr.failed[peer.RemoteAddr().String()]; ok {
+			o.failed(peer, err, at)
+		}
+	}
+}
+
+// missed records that peer answered with header that it does not hold the object, or that it
+// denied the request or was busy.
+func (o *fetchOutcomes) missed(peer p2p.Node, header objectHeader, at time.Time) {
+	if header.denied() {
+		o.set(peer, PeerResult{Outcome: OutcomeDenied, Err: ErrUnauthorized}, at)
+		return
+	}
+	if wait, busy := header.busy(); busy {
+		o.set(peer, PeerResult{Outcome: OutcomeBusy, Err: ErrBusy, RetryAfter: wait}, at)
+		return
+	}
+	o.set(peer, PeerResult{Outcome: OutcomeNotFound}, at)
+}
+
+// failed records why peer's answer could not be read or stored: a checksum mismatch when err
+// wraps storage.ErrContentCorrupted, and a connection error otherwise.
+func (o *fetchOutcomes) failed(peer p2p.Node, err error, at time.Time) {
+	outcome := OutcomeConnError
+	if errors.Is(err, storage.ErrContentCorrupted) {
+		outcome = OutcomeChecksumMismatch
+	}
+	o.set(peer, PeerResult{Outcome: outcome, Err: err}, at)
+}
+
+// set records the outcome of a peer asked, filling in its address and the time it took.
+func (o *fetchOutcomes) set(peer p2p.Node, res PeerResult, at time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res.Peer = peer.RemoteAddr().String()
+	res.Elapsed = at.Sub(o.sent[peer])
+	o.done[peer] = res
+}
+
+// err returns the error of the fetch given up at, with every peer asked that has no outcome
+// yet timed out.
+func (o *fetchOutcomes) err(at time.Time) *FetchError {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e := &FetchError{Key: o.key, Peers: make([]PeerResult, 0, len(o.order)), Elapsed: at.Sub(o.began)}
+	for _, peer := range o.order {
+		res, ok := o.done[peer]
+		if !ok {
+			res = PeerResult{Peer: peer.RemoteAddr().String(), Outcome: OutcomeTimeout, Elapsed: at.Sub(o.sent[peer])}
+		}
+		e.Peers = append(e.Peers, res)
+	}
+	return e
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGetClassifiesFetchErrors fetches a key no node holds from two peers under different
+// faults, and checks that only answers from every peer make the key definitely absent.
+func TestGetClassifiesFetchErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    func(policy *p2p.NetworkPolicy)
+		want     error
+		outcomes []PeerOutcome
+		wait     time.Duration // Time the fetch waits for the peers, passed on the fake clock
+	}{
+		{
+			name:     "all not found",
+			fault:    func(*p2p.NetworkPolicy) {},
+			want:     ErrKeyNotFound,
+			outcomes: []PeerOutcome{OutcomeNotFound, OutcomeNotFound},
+		},
+		{
+			name: "one down one not found",
+			fault: func(policy *p2p.NetworkPolicy) {
+				policy.SetLink(":4000", ":4002", p2p.LinkPolicy{DisconnectAt: 1})
+			},
+			want:     ErrUnavailable,
+			outcomes: []PeerOutcome{OutcomeNotFound, OutcomeConnError},
+		},
+		{
+			name: "one stalled",
+			fault: func(policy *p2p.NetworkPolicy) {
+				policy.Partition(":4002", ":4000")
+			},
+			want:     ErrUnavailable,
+			outcomes: []PeerOutcome{OutcomeNotFound, OutcomeTimeout},
+			wait:     2 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := p2p.NewMemoryNetwork(1)
+			clk := clock.NewFake(time.Unix(0, 0))
+			a := makeMemoryServer(t, network, ":4000")
+			a.Clock = clk
+			b := makeMemoryServer(t, network, ":4001", ":4000")
+			c := makeMemoryServer(t, network, ":4002", ":4000")
+			startCluster(t, a, b, c)
+			waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+			tt.fault(network.Policy)
+			answered := make(chan struct{}, 2)
+			a.testHookAnswer = func(p2p.Node) { answered <- struct{}{} }
+			errc := make(chan error, 1)
+			go func() {
+				_, err := a.Get("missing")
+				errc <- err
+			}()
+			if tt.wait > 0 {
+				// The fetch stops waiting for the stalled peer once its timeout passes, after
+				// the other peer answered.
+				<-answered
+				clk.Advance(tt.wait)
+			}
+			err := <-errc
+			require.Error(t, err)
+			assert.ErrorIs(t, err, tt.want)
+			if tt.want == ErrUnavailable {
+				assert.NotErrorIs(t, err, ErrKeyNotFound, "a peer that could not tell made the key absent")
+			}
+			var ferr *FetchError
+			require.True(t, errors.As(err, &ferr))
+			outcomes := make([]PeerOutcome, len(ferr.Peers))
+			for i, p := range ferr.Peers {
+				outcomes[i] = p.Outcome
+			}
+			assert.ElementsMatch(t, tt.outcomes, outcomes)
+			assert.Equal(t, tt.wait, ferr.Elapsed)
+		})
+	}
+}
+
+// TestFetchDiscardsLateAnswer times a fetch out while its peer holds the answer back, and
+// checks that the answer arriving late is not taken for the next fetch's.
+func TestFetchDiscardsLateAnswer(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	clk := clock.NewFake(time.Unix(0, 0))
+	a := makeMemoryServer(t, network, ":4000")
+	a.Clock = clk
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	data := map[string][]byte{"first": randomData(t, 64<<10), "second": randomData(t, 64<<10)}
+	for key, content := range data {
+		require.NoError(t, a.Store(key, bytes.NewReader(content)))
+		waitFor(t, func() bool {
+			ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+	}
+
+	asked := make(chan struct{})
+	stall := make(chan struct{})
+	b.testHookGetFile = func(key string) {
+		if key == crypto.HashKey("first") {
+			close(asked)
+			<-stall
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := a.Get("first")
+		errc <- err
+	}()
+	<-asked
+	clk.Advance(fetchTimeout)
+	require.ErrorIs(t, <-errc, ErrUnavailable)
+
+	// The peer answers both fetches in order once released; the first answer has nobody
+	// waiting for it any more.
+	close(stall)
+	r, err := a.Get("second")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data["second"], got)
+}
+
+// TestRequestsDoNotWaitForFetches holds back the answer of a peer answering by order, and
+// checks that a request to a peer routing its answers is answered meanwhile rather than queued
+// behind the fetch.
+func TestRequestsDoNotWaitForFetches(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	clk := clock.NewFake(time.Unix(0, 0))
+	a := makeMemoryServer(t, network, ":4000")
+	a.Clock = clk
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	actAs(b, supportedCaps&^p2p.CapReplies)
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	require.NoError(t, a.Store("key", bytes.NewReader(randomData(t, 64<<10))))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("key"))
+		return ok
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, "key"))
+
+	asked := make(chan struct{})
+	stall := make(chan struct{})
+	b.testHookGetFile = func(key string) {
+		if key == crypto.HashKey("key") {
+			close(asked)
+			<-stall
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := a.Get("key")
+		errc <- err
+	}()
+	<-asked
+
+	// The clock stands still, so the request only completes if it does not wait for the
+	// fetch to be answered or time out.
+	peers := a.peerList()
+	i := slices.IndexFunc(peers, func(peer p2p.Node) bool { return peer.Hello().NodeID == c.ID })
+	require.GreaterOrEqual(t, i, 0)
+	var info NodeInfo
+	require.NoError(t, a.exchange(peers[i], &Message{Payload: MessageNodeInfo{}}, &info, nodeInfoTimeout))
+	assert.Equal(t, c.ID, info.ID)
+
+	close(stall)
+	require.NoError(t, <-errc)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialRaw connects to the node listening at addr as a bare peer listening at from, which
+// greets it with a hello like a node would but leaves every byte after that to the caller.
+func dialRaw(t testing.TB, network *p2p.MemoryNetwork, from string, addr string) p2p.Node {
+	t.Helper()
+	nodes := make(chan p2p.Node, 1)
+	tr := network.Transport(p2p.TCPTransportOpts{
+		ListenAddr:         from,
+		HandshakeFunc:      p2p.HelloHandshakeFunc(p2p.HelloFrame{NodeID: "raw", ProtocolVersion: p2p.ProtocolVersion, Capabilities: supportedCaps}),
+		Decoder:            p2p.DefaultDecoder{},
+		StreamClaimTimeout: 10 * time.Millisecond,
+		OnNode: func(n p2p.Node) error {
+			nodes <- n
+			return nil
+		},
+	})
+	require.NoError(t, tr.Dial(addr))
+	select {
+	case n := <-nodes:
+		t.Cleanup(func() { n.Close() })
+		return n
+	case <-time.After(3 * time.Second):
+		t.Fatalf("could not connect to (%s)", addr)
+		return nil
+	}
+}
+
+// messageSeeds are the encodings of every built-in message, in both wire forms, from which
+// the fuzz targets mutate their inputs.
+func messageSeeds(t testing.TB) [][]byte {
+	var seeds [][]byte
+	for _, payload := range builtinMessages {
+		for _, typed := range []bool{true, false} {
+			b, err := encodeMessage(&Message{Payload: payload}, typed)
+			require.NoError(t, err)
+			seeds = append(seeds, b)
+		}
+	}
+	return seeds
+}
+
+// FuzzDecodeMessage feeds arbitrary bytes to decodeMessage, which must reject what it cannot
+// decode with an error.
+func FuzzDecodeMessage(f *testing.F) {
+	for _, seed := range messageSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		decodeMessage(b)
+	})
+}
+
+// FuzzHandleMessage hands every message that decodes to its handler as if a peer sent it,
+// followed by a stream of arbitrary bytes. The handler must return, at the latest once the
+// peer disconnects, and must not take the node down.
+func FuzzHandleMessage(f *testing.F) {
+	network := p2p.NewMemoryNetwork(1)
+	s := makeMemoryServer(f, network, ":4000")
+	const claimTimeout = 100 * time.Millisecond
+	s.Transport.(*p2p.TCPTransport).StreamClaimTimeout = claimTimeout
+	s.MaxProtocolErrors = 1 << 30
+	startCluster(f, s, makeMemoryServer(f, network, ":4001", ":4000"))
+	for _, seed := range messageSeeds(f) {
+		f.Add(seed, []byte{})
+		f.Add(seed, []byte("stream bytes"))
+	}
+	f.Fuzz(func(t *testing.T, payload []byte, stream []byte) {
+		msg, err := decodeMessage(payload)
+		if err != nil {
+			return
+		}
+		peer := dialRaw(t, network, ":5000", ":4000")
+		from := peer.LocalAddr().String()
+		waitFor(t, func() bool {
+			_, ok := s.peer(from)
+			return ok
+		})
+		if len(stream) > 0 {
+			require.NoError(t, peer.Send(append([]byte{p2p.IncomingStream}, stream...)))
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.handleMessage(from, &msg)
+		}()
+		select {
+		case <-done:
+			return
+		case <-time.After(claimTimeout):
+		}
+		// A handler still running once a stream would have been dropped unclaimed is waiting
+		// for more of a stream; it gives up once the peer is gone.
+		peer.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handling %T did not return after the peer disconnected", msg.Payload)
+		}
+	})
+}
+
+// TestGarbageBlaster fires random bytes, malformed frames and frames carrying garbage at a
+// live node, which must drop the offending connections and keep serving its other peers.
+func TestGarbageBlaster(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.Transport.(*p2p.TCPTransport).StreamClaimTimeout = 100 * time.Millisecond
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	rng := rand.New(rand.NewSource(1))
+	garbage := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	frame := func(payload []byte) []byte {
+		b, err := p2p.EncodeMessage(payload)
+		require.NoError(t, err)
+		return b
+	}
+	seeds := messageSeeds(t)
+	blasts := map[string]func() []byte{
+		"random bytes":     func() []byte { return garbage(1 + rng.Intn(4096)) },
+		"unknown frame":    func() []byte { return append([]byte{0x7f}, garbage(16)...) },
+		"absurd length":    func() []byte { return []byte{p2p.IncomingMessage, 0xff, 0xff, 0xff, 0xff} },
+		"truncated frame":  func() []byte { return []byte{p2p.IncomingMessage, 0, 0, 1, 0, 'x'} },
+		"unclaimed stream": func() []byte { return append([]byte{p2p.IncomingStream}, garbage(64)...) },
+		"unclaimed chunk": func() []byte {
+			return append([]byte{p2p.IncomingChunk, 0, 0, 0, byte(rng.Intn(256)), 0, 0, 0, 16}, garbage(16)...)
+		},
+		"absurd chunk":      func() []byte { return []byte{p2p.IncomingChunk, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff} },
+		"empty window":      func() []byte { return []byte{p2p.IncomingWindow, 0, 0, 0, 1, 0, 0, 0, 0} },
+		"garbage message":   func() []byte { return frame(garbage(1 + rng.Intn(512))) },
+		"truncated message": func() []byte { s := seeds[rng.Intn(len(seeds))]; return frame(s[:rng.Intn(len(s))]) },
+	}
+	port := 5000
+	for name, blast := range blasts {
+		for i := 0; i < 5; i++ {
+			port++
+			peer := dialRaw(t, network, ":"+strconv.Itoa(port), ":4000")
+			for j := 0; j < 3*defaultMaxProtocolErrors; j++ {
+				if peer.Send(blast()) != nil {
+					break
+				}
+			}
+			from := peer.LocalAddr().String()
+			dropped := func() bool {
+				_, ok := a.peer(from)
+				return !ok
+			}
+			if name != "truncated frame" {
+				// Every blast but a frame waiting for the rest of its payload gets the peer dropped.
+				waitFor(t, dropped)
+			}
+			peer.Close()
+			waitFor(t, dropped)
+		}
+	}
+
+	// The node still replicates to and serves its real peer.
+	data := randomData(t, 1<<10)
+	require.NoError(t, a.Store("after", bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("after"))
+		return ok
+	})
+	require.NoError(t, b.Store("reply", bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := a.Storage.Has(b.ID, crypto.HashKey("reply"))
+		return ok
+	})
+	require.NoError(t, b.Storage.Delete(b.ID, "reply"))
+	r, err := b.Get("reply")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Len(t, a.peerList(), 1)
+	assert.Positive(t, a.Metrics()["peers_disconnected"])
+}
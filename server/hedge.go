@@ -0,0 +1,386 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultHedgeDelay is how long a hedged fetch waits for a peer whose first-byte latency
+	// was never measured before asking the next one, when HedgeDelay is not set.
+	defaultHedgeDelay = 100 * time.Millisecond
+	// minHedgeDelay bounds the delay derived from a peer's first-byte latencies, so a peer that
+	// answers within a millisecond does not get every fetch hedged.
+	minHedgeDelay = 10 * time.Millisecond
+	// firstByteSamples is the number of recent first-byte latencies kept for each peer.
+	firstByteSamples = 32
+)
+
+// latencies holds the recent first-byte latencies of each peer, from which hedged fetches take
+// how long a peer is usually given to start answering.
+type latencies struct {
+	mu      sync.Mutex                 // Guards samples
+	samples map[string][]time.Duration // Latest firstByteSamples latencies by peer address, oldest first
+}
+
+// record adds a first-byte latency of the peer.
+func (l *latencies) record(addr string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == nil {
+		l.samples = make(map[string][]time.Duration)
+	}
+	samples := append(l.samples[addr], d)
+	if len(samples) > firstByteSamples {
+		samples = samples[len(samples)-firstByteSamples:]
+	}
+	l.samples[addr] = samples
+}
+
+// p95 returns the 95th percentile of the peer's recent first-byte latencies, and false if none
+// were recorded.
+func (l *latencies) p95(addr string) (time.Duration, bool) {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.samples[addr]...)
+	l.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*95-1)/100], true
+}
+
+// drop forgets the latencies of a peer that disconnected.
+func (l *latencies) drop(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.samples, addr)
+}
+
+// hedgeDelay returns how long a hedged fetch waits for the peer to start answering before it
+// also asks the next peer.
+func (s *FileServer) hedgeDelay(peer p2p.Node) time.Duration {
+	if s.HedgeDelay > 0 {
+		return s.HedgeDelay
+	}
+	if d, ok := s.firstBytes.p95(peer.RemoteAddr().String()); ok {
+		return max(d, minHedgeDelay)
+	}
+	return defaultHedgeDelay
+}
+
+// hedgeRequest is a get request sent by a hedged fetch.
+type hedgeRequest struct {
+	peer  p2p.Node  // Peer asked for the object
+	id    uint64    // Identifier a MessageCancel names the request by
+	sent  time.Time // When the request was sent
+	hedge bool      // Whether the request was sent because the earlier ones were slow to answer
+}
+
+// hedgeResult is the outcome of one request of a hedged fetch. Every request has exactly one.
+type hedgeResult struct {
+	req    hedgeRequest
+	found  bool         // Whether the peer held the object
+	header objectHeader // Header the peer answered with, telling a denial from a miss
+	stored bool         // Whether the peer's copy was written to local storage
+	bytes  int64        // Encrypted bytes of the stored copy
+	err    error        // Why the answer could not be read or stored
+}
+
+// hedgedFetch is the state of one fetchHedged call shared with the goroutines reading the
+// answers of its requests.
+type hedgedFetch struct {
+	s         *FileServer
+	t         *transfer        // Transfer the fetch is reported to
+	key       string           // Plain key of the object
+	hashedKey string           // Key the object is held under on peers
+	results   chan hedgeResult // Outcome of every request, buffered for one per peer
+	outcomes  *fetchOutcomes   // How every peer asked failed to serve the object
+	wg        sync.WaitGroup   // Goroutines still reading answers
+	abandoned chan struct{}    // Closed once the answers not in yet are given up
+	abandon   func()           // Closes abandoned, however many times it is called
+	mu        sync.Mutex       // Guards the fields below
+	asked     []hedgeRequest   // Requests sent so far
+	winner    *hedgeRequest    // Request whose answer is being stored, nil until one is found
+}
+
+// fetchHedged asks the best-ranked peer for an object and, if it has not started answering
+// within its hedge delay, also asks the next one, up to GetHedges extra peers. The first peer
+// to answer with the object has it decrypted into local storage while the others are
+// cancelled. Peers answering that they lack the object, or failing, are followed by the next
+// ranked peer right away; such fallbacks do not count as hedges.
+//
+// Parameters:
+//   - t: Transfer the fetch is reported to.
+//   - key: Plain key of the object.
+//   - hashedKey: Key the object is held under on peers.
+//
+// Returns: The object's description and content, and any errors; a *FetchError when no peer
+// served the object.
+func (s *FileServer) fetchHedged(t *transfer, key string, hashedKey string) (ObjectInfo, io.ReadCloser, error) {
+	// The timeout runs from the start, so a fetch waiting for its turn to ask peers that
+	// answer by order gives up like one waiting for their answers.
+	began := s.Clock.Now()
+	timer := s.Clock.NewTimer(fetchTimeout)
+	ranked := s.peerStats.fastest(s.fetchPeers(), len(s.fetchPeers()))
+	abandoned := make(chan struct{})
+	f := &hedgedFetch{
+		s:         s,
+		t:         t,
+		key:       key,
+		hashedKey: hashedKey,
+		results:   make(chan hedgeResult, len(ranked)),
+		outcomes:  newFetchOutcomes(key, began),
+		abandoned: abandoned,
+		abandon:   sync.OnceFunc(func() { close(abandoned) }),
+	}
+	// Peers that cannot route answers to requests by ID answer in the order they were asked,
+	// so no other fetch may ask them until every one asked has answered or been given up.
+	_, ordered := s.peersWith(ranked, func(c peerCaps) bool { return c.replies })
+	if len(ordered) > 0 {
+		select {
+		case s.fetchTurn <- struct{}{}:
+		case <-t.done():
+			timer.Stop()
+			return ObjectInfo{}, nil, t.err()
+		case <-timer.C():
+			f.outcomes.broadcast(ranked, nil, began)
+			return ObjectInfo{}, nil, f.outcomes.err(s.Clock.Now())
+		}
+	}
+	// Answers still read once the caller returns, drained or lost, are given up when the
+	// fetch times out.
+	defer func() {
+		go func() {
+			finished := make(chan struct{})
+			go func() {
+				f.wg.Wait()
+				close(finished)
+			}()
+			select {
+			case <-finished:
+			case <-timer.C():
+				f.abandon()
+				<-finished
+			}
+			timer.Stop()
+			if len(ordered) > 0 {
+				<-s.fetchTurn
+			}
+		}()
+	}()
+
+	next, hedges, outstanding := 0, 0, 0
+	// ask sends the request to the next ranked peer that can be reached.
+	ask := func(hedge bool) (p2p.Node, bool) {
+		for next < len(ranked) {
+			peer := ranked[next]
+			next++
+			if err := f.ask(peer, hedge); err != nil {
+				s.logf(t.requestID(), "fetching (%s) from (%s): %s", key, peer.RemoteAddr(), err)
+				continue
+			}
+			outstanding++
+			return peer, true
+		}
+		return nil, false
+	}
+
+	// giveUp returns the error of a fetch no peer served, caching a miss every peer reported.
+	giveUp := func() error {
+		ferr := f.outcomes.err(s.Clock.Now())
+		if ferr.NotFound() {
+			s.negCache.add(negativeKey(s.ID, hashedKey))
+		}
+		return ferr
+	}
+
+	peer, ok := ask(false)
+	if !ok {
+		return ObjectInfo{}, nil, giveUp()
+	}
+	hedgeTimer := s.Clock.NewTimer(s.hedgeDelay(peer))
+	defer hedgeTimer.Stop()
+	for {
+		select {
+		case res := <-f.results:
+			outstanding--
+			if res.stored {
+				if res.req.hedge {
+					s.metrics.hedgesWon.Add(1)
+				}
+				return s.serveFetched(t.requestID(), key, remoteSource([]p2p.Node{res.req.peer}, s.Clock.Since(began), res.bytes))
+			}
+			if res.err != nil {
+				s.logf(t.requestID(), "receiving (%s) from (%s): %s", key, res.req.peer.RemoteAddr(), res.err)
+				f.outcomes.failed(res.req.peer, res.err, s.Clock.Now())
+			} else if !res.found {
+				f.outcomes.missed(res.req.peer, res.header, s.Clock.Now())
+			}
+			if outstanding > 0 {
+				continue
+			}
+			// Every peer asked so far failed or lacks the object, so the next one is asked.
+			if peer, ok = ask(false); ok {
+				hedgeTimer.Reset(s.hedgeDelay(peer))
+				continue
+			}
+			return ObjectInfo{}, nil, giveUp()
+		case <-hedgeTimer.C():
+			if hedges >= s.GetHedges || f.found() {
+				continue
+			}
+			if peer, ok = ask(true); ok {
+				hedges++
+				s.metrics.hedges.Add(1)
+				s.logf(t.requestID(), "no answer for (%s) yet, also asking (%s)", key, peer.RemoteAddr())
+				hedgeTimer.Reset(s.hedgeDelay(peer))
+			}
+		case <-t.done():
+			// The peers stop streaming and their answers are drained in the background; those
+			// not in yet are given up.
+			f.abandon()
+			go f.cancel(nil)
+			return ObjectInfo{}, nil, t.err()
+		case <-timer.C():
+			f.abandon()
+			go f.cancel(nil)
+			return ObjectInfo{}, nil, f.outcomes.err(s.Clock.Now())
+		}
+	}
+}
+
+// ask sends the get request to a peer and starts reading its answer.
+func (f *hedgedFetch) ask(peer p2p.Node, hedge bool) error {
+	req := hedgeRequest{peer: peer, id: f.s.nextRequestID(), hedge: hedge}
+	msg := Message{Payload: MessageGetFile{ID: f.s.ID, Key: f.hashedKey, RequestID: req.id, Namespace: keyNamespace(f.key)}, RequestID: f.t.requestID(), ReplyID: req.id}
+	f.s.streamMu.Lock()
+	req.sent = f.s.Clock.Now()
+	_, err := f.s.sendMessage([]p2p.Node{peer}, &msg)
+	f.s.streamMu.Unlock()
+	f.outcomes.asked(peer, req.sent)
+	if err != nil {
+		f.outcomes.failed(peer, err, f.s.Clock.Now())
+		return err
+	}
+	f.mu.Lock()
+	f.asked = append(f.asked, req)
+	f.mu.Unlock()
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.results <- f.receive(req)
+	}()
+	return nil
+}
+
+// receive reads a peer's answer, unless it is given up before it arrives. The first copy of the object found is written to local
+// storage; copies found after it are drained.
+func (f *hedgedFetch) receive(req hedgeRequest) hedgeResult {
+	s, peer := f.s, req.peer
+	stream := s.awaitAnswer(peer, req.id, f.abandoned)
+	if stream == nil {
+		return hedgeResult{req: req, err: errAnswerAbandoned}
+	}
+	s.firstBytes.record(peer.RemoteAddr().String(), s.Clock.Since(req.sent))
+	caps := s.capsOf(peer)
+	if caps.repair {
+		// Hedged fetches ask too few peers to compare their copies, so stamps go unused.
+		var stamp objectStamp
+		if err := binary.Read(stream, binary.LittleEndian, &stamp); err != nil {
+			return hedgeResult{req: req, err: err}
+		}
+	}
+	var header objectHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		return hedgeResult{req: req, err: err}
+	}
+	if !header.Found {
+		stream.Close()
+		return hedgeResult{req: req, header: header}
+	}
+	objectReader := streamReader(stream, header.Size, caps.chunked)
+	if !f.claim(req) {
+		// Another peer is already supplying the object; drain this copy to keep the connection in sync
+		_, err := io.Copy(io.Discard, objectReader)
+		stream.Close()
+		if err != nil && !errors.Is(err, errStreamTruncated) {
+			s.logf(f.t.requestID(), "draining response from (%s): %s", peer.RemoteAddr(), err)
+		}
+		return hedgeResult{req: req, found: true}
+	}
+
+	f.t.phase(TransferFetch, peer.RemoteAddr().String(), header.Size)
+	started := s.Clock.Now()
+	sum := sha256.New()
+	n, err := s.Storage.WriteDecrypt(s.dataCipher(f.key), s.ID, f.key, f.t.reader(io.TeeReader(objectReader, sum)))
+	if _, derr := io.Copy(io.Discard, objectReader); err == nil {
+		err = derr
+	}
+	if err == nil {
+		// Bytes damaged on the way must not be kept as the object.
+		err = header.verify(sum)
+	}
+	stream.Close()
+	if err != nil {
+		// Drop the partial copy so it is not served as the object.
+		if derr := s.Storage.Delete(s.ID, f.key); derr != nil {
+			s.logf(f.t.requestID(), "discarding partial (%s): %s", f.key, derr)
+		}
+		f.release(req)
+		return hedgeResult{req: req, found: true, err: err}
+	}
+	s.logf(f.t.requestID(), "received (%d) bytes of (%s) over the network from (%s)", n, f.key, peer.RemoteAddr())
+	s.peerStats.record(peer.RemoteAddr().String(), header.Size, s.Clock.Since(started))
+	return hedgeResult{req: req, found: true, stored: true, bytes: header.Size}
+}
+
+// claim makes req the request whose answer is stored, cancelling every other request, unless
+// another answer is already being stored.
+func (f *hedgedFetch) claim(req hedgeRequest) bool {
+	f.mu.Lock()
+	if f.winner != nil {
+		f.mu.Unlock()
+		return false
+	}
+	f.winner = &req
+	f.mu.Unlock()
+	go f.cancel(&req)
+	return true
+}
+
+// release lets another answer be stored after storing req's failed.
+func (f *hedgedFetch) release(req hedgeRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.winner != nil && f.winner.id == req.id {
+		f.winner = nil
+	}
+}
+
+// found reports whether an answer carrying the object is being stored.
+func (f *hedgedFetch) found() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.winner != nil
+}
+
+// cancel cancels every request sent except keep, which may be nil. Requests already answered
+// are not affected.
+func (f *hedgedFetch) cancel(keep *hedgeRequest) {
+	f.mu.Lock()
+	asked := append([]hedgeRequest(nil), f.asked...)
+	f.mu.Unlock()
+	for _, req := range asked {
+		if keep == nil || req.id != keep.id {
+			f.s.cancelRequest([]p2p.Node{req.peer}, req.id)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatenciesP95(t *testing.T) {
+	var l latencies
+	_, ok := l.p95("peer")
+	assert.False(t, ok)
+	for i := 1; i <= 100; i++ {
+		l.record("peer", time.Duration(i)*time.Millisecond)
+	}
+	d, ok := l.p95("peer")
+	require.True(t, ok)
+	// Only the latest firstByteSamples are kept: 69ms to 100ms.
+	assert.Equal(t, 99*time.Millisecond, d)
+	l.drop("peer")
+	_, ok = l.p95("peer")
+	assert.False(t, ok)
+}
+
+func TestHedgedGet(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	a.GetHedges = 1
+	a.HedgeDelay = 50 * time.Millisecond
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	const key = "hedged"
+	hashedKey := crypto.HashKey(key)
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("tail latency"))))
+	for _, s := range []*FileServer{b, c} {
+		waitFor(t, func() bool {
+			ok, _ := s.Storage.Has(a.ID, hashedKey)
+			return ok
+		})
+	}
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+
+	// c ranks first but stalls before answering.
+	var fast string
+	for _, peer := range a.peerList() {
+		rate := int64(1 << 20)
+		if peer.Hello().NodeID == c.ID {
+			rate = 1 << 30
+		} else {
+			fast = peer.RemoteAddr().String()
+		}
+		a.peerStats.record(peer.RemoteAddr().String(), rate, time.Second)
+	}
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	c.testHookGetFile = func(string) { <-stall }
+
+	started := time.Now()
+	info, r, err := a.GetWithInfo(key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, "tail latency", string(data))
+	assert.Less(t, time.Since(started), 500*time.Millisecond)
+	assert.Equal(t, fast, info.Peer, "served by the fast peer")
+	assert.Equal(t, SourceRemote, info.Source.Kind)
+	assert.Equal(t, b.ID, info.Source.PeerID, "the source names the winner")
+	assert.EqualValues(t, 1, a.Metrics()["get_hedges"])
+	assert.EqualValues(t, 1, a.Metrics()["get_hedges_won"])
+}
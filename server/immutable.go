@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// auditLogFileName is the file in the storage root recording, one JSON object per line, the
+// operations that overrode the protection of an object.
+const auditLogFileName = ".dfs-audit.log"
+
+// ErrImmutable is returned when an immutable object would be overwritten with different
+// content, or deleted without ForceDelete.
+var ErrImmutable = errors.New("object is immutable")
+
+// ObjectMetadata is set on an object stored with StoreWithMetadata.
+type ObjectMetadata struct {
+	Immutable   bool   // Whether the object is write-once: never overwritten with other content, and deleted only by ForceDelete
+	ContentType string // MIME type the object is served with, sniffed from its first 512 bytes when empty
+}
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time   time.Time    `json:"time"`             // When the operation ran
+	Op     string       `json:"op"`               // What was done: "force-delete", "drop-peer", "deny", or "fetch" with AuditFetches
+	Owner  string       `json:"owner"`            // Identifier of the node owning the object
+	Key    string       `json:"key"`              // Key of the object, hashed on the nodes holding replicas
+	Source *FetchSource `json:"source,omitempty"` // Where a fetched object came from
+
+	Peer        string     `json:"peer,omitempty"`         // Node ID or address of a peer dropped with DropPeer, or denied a request
+	BannedUntil *time.Time `json:"banned_until,omitempty"` // When the ban of a dropped peer runs out, nil if it was not banned
+	Request     Operation  `json:"request,omitempty"`      // Operation the Authorizer denied
+	Namespace   string     `json:"namespace,omitempty"`    // Namespace the denied request declared
+	RequestID   string     `json:"request_id,omitempty"`   // Request ID of the operation audited, with the span of the node when a peer started it
+}
+
+// StoreWithMetadata stores a file like Store, recording meta with it. Immutability is
+// replicated with the object, so every node holding a copy enforces it: an immutable object
+// is never overwritten with different content, on this node or by a replica sent to a peer,
+// and only ForceDelete removes it. Storing the content an immutable key already holds succeeds
+// without writing anything.
+//
+// Returns: Any errors, as for Store. An error wrapping ErrImmutable means the key is
+// immutable and holds other content.
+func (s *FileServer) StoreWithMetadata(key string, r io.Reader, meta ObjectMetadata) error {
+	return s.StoreContext(context.Background(), key, r, TransferOpts{Metadata: meta})
+}
+
+// immutable reports whether a stored object is marked immutable.
+func (s *FileServer) immutable(id string, key string) bool {
+	meta, err := s.Storage.Metadata(id, key)
+	return err == nil && meta.Immutable
+}
+
+// checkWritable reports whether content may be stored under one of this node's keys. The
+// content is only read when the key is immutable.
+//
+// Returns: Whether the key is immutable and already holds content, so nothing needs writing,
+// and an error wrapping ErrImmutable if it holds other content, or ErrLeased if another node
+// holds a lease on the key.
+func (s *FileServer) checkWritable(key string, content io.Reader) (bool, error) {
+	if err := s.checkLease(key); err != nil {
+		return false, err
+	}
+	meta, err := s.Storage.Metadata(s.ID, key)
+	if err != nil || !meta.Immutable {
+		return false, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != meta.Checksum {
+		return false, fmt.Errorf("storing (%s): %w", key, ErrImmutable)
+	}
+	return true, nil
+}
+
+// admitOverwrite decides whether a replica may replace the copy held under its key. A copy
+// marked immutable is only replaced by itself: a replica with its checksum is accepted without
+// being written, and one with another checksum is refused, telling the sender with a
+// MessageStoreRejected.
+//
+// Returns: Whether the replica is already held, and an error wrapping ErrImmutable if it was
+// refused.
+func (s *FileServer) admitOverwrite(from string, id string, key string, checksum string) (bool, error) {
+	meta, err := s.Storage.Metadata(id, key)
+	if err != nil || !meta.Immutable {
+		return false, nil
+	}
+	if meta.Checksum == checksum {
+		return true, nil
+	}
+	err = fmt.Errorf("replica (%s): %w", key, ErrImmutable)
+	return false, s.refuseReplica(from, id, key, err, ErrImmutable)
+}
+
+// markImmutable records that a replica received was stored as immutable by its owner.
+func (s *FileServer) markImmutable(id string, key string, immutable bool) error {
+	if !immutable {
+		return nil
+	}
+	return s.Storage.SetImmutable(id, key)
+}
+
+// ForceDelete deletes an object like Delete, even if it is immutable. Every node removing an
+// immutable copy records it in the audit log in its storage root first, and a deletion that
+// cannot be recorded is not made.
+//
+// Returns: Any errors, as for Delete.
+func (s *FileServer) ForceDelete(key string) error {
+	rid := s.NewRequestID()
+	if err := checkKey(key); err != nil {
+		return withRequestID(rid, err)
+	}
+	if s.immutable(s.ID, key) {
+		if err := s.audit(auditEntry{Op: "force-delete", Owner: s.ID, Key: key, RequestID: rid}); err != nil {
+			return withRequestID(rid, fmt.Errorf("deleting (%s): %w", key, err))
+		}
+		s.logf(rid, "force deleting immutable (%s)", key)
+	}
+	return withRequestID(rid, s.deleteObject(rid, key, true))
+}
+
+// audit appends an entry to the audit log, timed now.
+func (s *FileServer) audit(entry auditEntry) error {
+	entry.Time = s.Clock.Now().UTC()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.Storage.Root, auditLogFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return errors.Join(err, f.Close())
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImmutableObjects(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	const key = "contracts/signed"
+	hashedKey := crypto.HashKey(key)
+	require.NoError(t, a.StoreWithMetadata(key, bytes.NewReader([]byte("signed by both")), ObjectMetadata{Immutable: true}))
+	waitFor(t, func() bool { return b.immutable(a.ID, hashedKey) })
+
+	// Storing the content the key holds succeeds; other content is refused.
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("signed by both"))))
+	assert.ErrorIs(t, a.Store(key, bytes.NewReader([]byte("amended"))), ErrImmutable)
+	_, r, err := a.GetWithInfo(key)
+	require.NoError(t, err)
+	b1, err := io.ReadAll(r)
+	require.NoError(t, r.Close())
+	require.NoError(t, err)
+	assert.Equal(t, "signed by both", string(b1))
+
+	// b accepts the replica it holds again but refuses to overwrite it with other content.
+	held, err := b.Storage.Metadata(a.ID, hashedKey)
+	require.NoError(t, err)
+	_, sr, err := b.Storage.Read(a.ID, hashedKey)
+	require.NoError(t, err)
+	data, err := io.ReadAll(sr)
+	require.NoError(t, err)
+	require.NoError(t, sr.(io.Closer).Close())
+	same := replica{id: a.ID, key: hashedKey, data: data, checksum: held.Checksum}
+	_, err = a.replicate(a.peerList(), same)
+	require.NoError(t, err)
+	forged, err := a.prepareReplica(key, bytes.NewReader([]byte("forged")))
+	require.NoError(t, err)
+	_, err = a.replicate(a.peerList(), forged)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return a.Metrics()["replicas_rejected"] == 1 })
+	after, err := b.Storage.Metadata(a.ID, hashedKey)
+	require.NoError(t, err)
+	assert.Equal(t, held, after)
+
+	// Only a forced delete removes the object, and every node records it.
+	assert.ErrorIs(t, a.Delete(key), ErrImmutable)
+	assert.ErrorIs(t, b.handleMessageDeleteFile("", "", MessageDeleteFile{ID: a.ID, Key: hashedKey}), ErrImmutable)
+	ok, err := b.Storage.Has(a.ID, hashedKey)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.NoError(t, a.ForceDelete(key))
+	ok, err = a.Storage.Has(a.ID, key)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, hashedKey)
+		return !ok
+	})
+	for _, s := range []*FileServer{a, b} {
+		log, err := os.ReadFile(filepath.Join(s.Storage.Root, auditLogFileName))
+		require.NoError(t, err)
+		assert.Contains(t, string(log), `"op":"force-delete"`)
+	}
+
+	// Once deleted, the key can be stored again.
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("amended"))))
+}
+
+func TestImmutableReplicaFromOtherNode(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000", ":4001")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 })
+
+	const key = "ledger"
+	hashedKey := crypto.HashKey(key)
+	content := bytes.Repeat([]byte("entry"), 2000)
+	require.NoError(t, a.StoreWithMetadata(key, bytes.NewReader(content), ObjectMetadata{Immutable: true}))
+	for _, s := range []*FileServer{b, c} {
+		waitFor(t, func() bool { return s.immutable(a.ID, hashedKey) })
+	}
+	held, err := c.Storage.Metadata(a.ID, hashedKey)
+	require.NoError(t, err)
+
+	// A replica streamed by another peer cannot replace c's copy either.
+	var toC p2p.Node
+	for _, peer := range b.peerList() {
+		if peer.Hello().NodeID == c.ID {
+			toC = peer
+		}
+	}
+	require.NotNil(t, toC)
+	data := bytes.Repeat([]byte("x"), 10000)
+	sum := sha256.Sum256(data)
+	_, err = b.replicate([]p2p.Node{toC}, replica{id: a.ID, key: hashedKey, data: data, checksum: hex.EncodeToString(sum[:])})
+	require.NoError(t, err)
+	waitFor(t, func() bool { return b.Metrics()["replicas_rejected"] == 1 })
+	after, err := c.Storage.Metadata(a.ID, hashedKey)
+	require.NoError(t, err)
+	assert.Equal(t, held, after)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// errPeerRestarted fails the acknowledgements a peer owed before it restarted.
+var errPeerRestarted = errors.New("peer restarted")
+
+// newIncarnation draws the random, non-zero number identifying one run of a node.
+func newIncarnation() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if n := binary.LittleEndian.Uint32(b[:]); n != 0 {
+			return n
+		}
+	}
+}
+
+// correlationID returns the identifier answers to a request are routed back with: the
+// incarnation of the node asking in the high half, so answers meant for an earlier run of
+// the node are told apart from those meant for this one, and seq in the low half.
+func correlationID(incarnation uint32, seq uint64) uint64 {
+	return uint64(incarnation)<<32 | seq&0xffffffff
+}
+
+// incarnationOf returns the incarnation a correlation ID was handed out by.
+func incarnationOf(id uint64) uint32 {
+	return uint32(id >> 32)
+}
+
+// staleAnswer reports whether an answer from a peer names a request of an earlier run of this
+// node, counting and logging it so it is dropped rather than handed to a request of this run
+// that happens to share its sequence.
+func (s *FileServer) staleAnswer(from string, kind string, id uint64) bool {
+	if incarnationOf(id) == s.incarnation {
+		return false
+	}
+	s.metrics.staleAnswers.Add(1)
+	log.Printf("[%s] dropping %s %d from (%s) meant for an earlier run", s.Transport.Addr(), kind, id, from)
+	return true
+}
+
+// nodeRun is the run of a node last seen connected.
+type nodeRun struct {
+	incarnation uint32 // Incarnation the node advertised
+	addr        string // Address of the connection it advertised it on
+}
+
+// noteIncarnation records the incarnation a new peer advertised.
+//
+// Returns: The address of the connection to the node's previous run and true when the node
+// was seen before with another incarnation.
+func (s *FileServer) noteIncarnation(p p2p.Node) (string, bool) {
+	hello := p.Hello()
+	if len(hello.NodeID) == 0 || hello.Incarnation == 0 {
+		return "", false
+	}
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	last, seen := s.incarnations[hello.NodeID]
+	s.incarnations[hello.NodeID] = nodeRun{incarnation: hello.Incarnation, addr: p.RemoteAddr().String()}
+	if !seen || last.incarnation == hello.Incarnation {
+		return "", false
+	}
+	return last.addr, true
+}
+
+// peerRestarted resets what this node kept for the previous run of a peer that came back as a
+// new process: the acknowledgements it owed fail, the pushes and requests it was part of are
+// forgotten, the keys reserved for its calls are released and its notifications, numbered
+// anew if it lost its log, are processed from the start again. Keys queued for it are sent
+// again by the catch-up its connection starts.
+func (s *FileServer) peerRestarted(p p2p.Node, lastAddr string) {
+	id := p.Hello().NodeID
+	s.metrics.peerRestarts.Add(1)
+	log.Printf("[%s] node %s restarted, resetting its state", s.Transport.Addr(), id)
+	s.acks.fail(lastAddr, errPeerRestarted)
+	for _, addr := range []string{lastAddr, p.RemoteAddr().String()} {
+		s.pushes.drop(addr)
+		s.serving.drop(addr)
+	}
+	s.reservations.releaseNode(id)
+	s.peerLock.Lock()
+	delete(s.notifySeen, id)
+	s.peerLock.Unlock()
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationID(t *testing.T) {
+	id := correlationID(0xdeadbeef, 1<<32+7)
+	assert.EqualValues(t, 0xdeadbeef, incarnationOf(id))
+	assert.EqualValues(t, 7, id&0xffffffff)
+	assert.NotZero(t, newIncarnation())
+}
+
+// TestPeerRestart restarts b as a new process with the same node ID while a still holds state
+// for its first run: a resets that state, and answers a sends to requests of the first run are
+// dropped by the second rather than handed to its own requests of the same sequence.
+func TestPeerRestart(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+	require.NoError(t, b.Store("key", bytes.NewReader([]byte("first run"))))
+
+	// State a keeps for b's first run, and a request of that run a has yet to answer.
+	firstAddr := a.peerList()[0].RemoteAddr().String()
+	a.peerLock.Lock()
+	a.notifySeen[b.ID] = 7
+	a.peerLock.Unlock()
+	a.reservations.reserve("reserved", reserver{Node: b.ID, Seq: 1})
+	ackID, acks := a.acks.begin(1)
+	defer a.acks.end(ackID)
+	staleID, _ := b.acks.begin(1)
+
+	b.Stop()
+	for _, peer := range b.peerList() {
+		require.NoError(t, peer.Close())
+	}
+	waitFor(t, func() bool { return len(a.peerList()) == 0 })
+	restarted := makeMemoryServer(t, network, ":4002", ":4000")
+	restarted.ID = b.ID
+	startCluster(t, restarted)
+	waitFor(t, func() bool { return a.Metrics()["peer_restarts"] == 1 })
+
+	select {
+	case ack := <-acks:
+		assert.Equal(t, firstAddr, ack.from)
+		assert.ErrorIs(t, ack.err, errPeerRestarted)
+	case <-time.After(time.Second):
+		t.Fatal("the acknowledgement owed by the first run did not fail")
+	}
+	a.peerLock.Lock()
+	_, seen := a.notifySeen[b.ID]
+	a.peerLock.Unlock()
+	assert.False(t, seen, "notifications of the new run should be processed from the start")
+	other := reserver{Node: "other", Seq: 1}
+	assert.Equal(t, other, a.reservations.reserve("reserved", other), "the first run's reservation should be released")
+
+	// The new run hands out the sequence the first run's request had.
+	id, answers := restarted.acks.begin(1)
+	defer restarted.acks.end(id)
+	require.Equal(t, staleID&0xffffffff, id&0xffffffff)
+	require.NotEqual(t, staleID, id)
+	peer := a.peerList()[0]
+	_, err := a.sendMessage([]p2p.Node{peer}, &Message{Payload: MessageStoreAck{AckID: staleID}})
+	require.NoError(t, err)
+	_, err = a.sendMessage([]p2p.Node{peer}, &Message{Payload: MessageReserveAnswer{RequestID: staleID}})
+	require.NoError(t, err)
+	waitFor(t, func() bool { return restarted.Metrics()["stale_answers_dropped"] == 2 })
+	select {
+	case ack := <-answers:
+		t.Fatalf("an answer to the first run was delivered to the second: %+v", ack)
+	default:
+	}
+
+	// Answers to the new run's requests still arrive.
+	_, err = a.sendMessage([]p2p.Node{peer}, &Message{Payload: MessageStoreAck{AckID: id}})
+	require.NoError(t, err)
+	select {
+	case ack := <-answers:
+		assert.NoError(t, ack.err)
+	case <-time.After(time.Second):
+		t.Fatal("the acknowledgement of the new run was not delivered")
+	}
+}
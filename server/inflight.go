@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// localWrite is a Store of one of this node's keys in flight, from when its content starts
+// being read until the local copy is written. Gets of the key wait for it, or follow the
+// content as it is read, rather than serving the copy it replaces or asking peers.
+type localWrite struct {
+	mu      sync.Mutex
+	content []byte        // Content read so far
+	size    int64         // Size of the content when known up front, -1 otherwise
+	read    bool          // Whether the content was read in full
+	changed chan struct{} // Closed, and replaced, whenever content, read or err change
+	done    chan struct{} // Closed once the local copy is written or the Store failed
+	err     error         // Why the Store failed, set before done is closed
+	finish  sync.Once     // Closes done once
+}
+
+// writeTable tracks the Stores in flight on this node by key.
+type writeTable struct {
+	mu     sync.Mutex
+	writes map[string]*localWrite
+}
+
+// begin records that key is being stored with content of size bytes, -1 when unknown. A
+// later Store of the same key takes over from an earlier one still in flight.
+func (wt *writeTable) begin(key string, size int64) *localWrite {
+	w := &localWrite{size: size, changed: make(chan struct{}), done: make(chan struct{})}
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.writes == nil {
+		wt.writes = make(map[string]*localWrite)
+	}
+	wt.writes[key] = w
+	return w
+}
+
+// get returns the Store of key in flight, if any.
+func (wt *writeTable) get(key string) (*localWrite, bool) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	w, ok := wt.writes[key]
+	return w, ok
+}
+
+// end records that the Store of key written by w finished, failing with err if not nil.
+// Only the first call for a write has any effect.
+func (wt *writeTable) end(key string, w *localWrite, err error) {
+	w.finish.Do(func() {
+		wt.mu.Lock()
+		if wt.writes[key] == w {
+			delete(wt.writes, key)
+		}
+		wt.mu.Unlock()
+		w.mu.Lock()
+		w.err = err
+		w.notifyLocked()
+		w.mu.Unlock()
+		close(w.done)
+	})
+}
+
+// notifyLocked wakes the readers following the write; the caller must hold mu.
+func (w *localWrite) notifyLocked() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// readAll reads the content of the Store from r, like io.ReadAll, making each chunk
+// available to followers as it arrives.
+//
+// Returns: The content, and any errors reading it.
+func (w *localWrite) readAll(r io.Reader) ([]byte, error) {
+	b := make([]byte, 0, 512)
+	for {
+		// Followers only read up to len(b), so the spare capacity is written without the lock.
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		eof := errors.Is(err, io.EOF)
+		if n > 0 || eof {
+			w.mu.Lock()
+			w.content = b
+			w.read = eof
+			w.notifyLocked()
+			w.mu.Unlock()
+		}
+		if eof {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+	}
+}
+
+// wait blocks until the Store finished or ctx is done.
+//
+// Returns: An error wrapping ctx.Err() if ctx was done first.
+func (w *localWrite) wait(ctx context.Context) error {
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the local write: %w", ctx.Err())
+	}
+}
+
+// followReader reads the content of a Store in flight as it arrives. Having read all of it,
+// it waits for the local copy to be written and fails if that failed.
+type followReader struct {
+	ctx context.Context // Bounds the wait for more content
+	w   *localWrite     // Store followed
+	off int             // Bytes of the content read so far
+}
+
+// Read reads content as it becomes available.
+func (f *followReader) Read(b []byte) (int, error) {
+	for {
+		f.w.mu.Lock()
+		if f.off < len(f.w.content) {
+			n := copy(b, f.w.content[f.off:])
+			f.off += n
+			f.w.mu.Unlock()
+			return n, nil
+		}
+		read, err, changed := f.w.read, f.w.err, f.w.changed
+		f.w.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if read {
+			if err := f.w.wait(f.ctx); err != nil {
+				return 0, err
+			}
+			f.w.mu.Lock()
+			err = f.w.err
+			f.w.mu.Unlock()
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-changed:
+		case <-f.ctx.Done():
+			return 0, fmt.Errorf("following the local write: %w", f.ctx.Err())
+		}
+	}
+}
+
+// Close stops following the write.
+func (f *followReader) Close() error {
+	return nil
+}
+
+// getWriting serves a Get of a key being stored on this node, which never asks peers: with
+// FollowWrites the content is streamed as the Store reads it, and otherwise the Get waits
+// until the local copy is written, for as long as t allows.
+//
+// Returns: The object's description and content when followed, ok false when the Get should
+// go on to read the local copy, and any errors.
+func (s *FileServer) getWriting(t *transfer, key string) (info ObjectInfo, rc io.ReadCloser, ok bool, err error) {
+	w, writing := s.writing.get(key)
+	if !writing {
+		return ObjectInfo{}, nil, false, nil
+	}
+	ctx := context.Background()
+	if t != nil {
+		ctx = t.ctx
+	}
+	if s.FollowWrites {
+		info := ObjectInfo{Key: key, Size: w.size, Source: FetchSource{Kind: SourceLocal}}
+		return info, &followReader{ctx: ctx, w: w}, true, nil
+	}
+	if err := w.wait(ctx); err != nil {
+		return ObjectInfo{}, nil, false, fmt.Errorf("getting (%s): %w", key, err)
+	}
+	return ObjectInfo{}, nil, false, nil
+}
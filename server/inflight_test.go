@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedReader serves content in two halves, the second only once release is closed.
+type gatedReader struct {
+	first, second []byte
+	release       chan struct{}
+}
+
+func (g *gatedReader) Read(b []byte) (int, error) {
+	if len(g.first) > 0 {
+		n := copy(b, g.first)
+		g.first = g.first[n:]
+		return n, nil
+	}
+	<-g.release
+	if len(g.second) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, g.second)
+	g.second = g.second[n:]
+	return n, nil
+}
+
+// slowStore starts storing data on s through a gatedReader, returning the channel releasing
+// its second half and the one receiving the outcome of the Store.
+func slowStore(t *testing.T, s *FileServer, key string, data []byte) (chan struct{}, chan error) {
+	t.Helper()
+	release := make(chan struct{})
+	stored := make(chan error, 1)
+	half := len(data) / 2
+	go func() {
+		stored <- s.Store(key, &gatedReader{first: data[:half], second: data[half:], release: release})
+	}()
+	waitFor(t, func() bool {
+		w, ok := s.writing.get(key)
+		if !ok {
+			return false
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.content) == half
+	})
+	return release, stored
+}
+
+// noFetches fails the test if a peer is asked for an object.
+func noFetches(t *testing.T, peers ...*FileServer) {
+	var asked atomic.Int64
+	for _, p := range peers {
+		p.testHookGetFile = func(string) { asked.Add(1) }
+	}
+	t.Cleanup(func() { assert.Zero(t, asked.Load(), "peers were asked for the object") })
+}
+
+func TestGetWaitsForLocalWrite(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	noFetches(t, b)
+
+	data := randomData(t, 256<<10)
+	release, stored := slowStore(t, a, "video", data)
+
+	got := make(chan []byte, 1)
+	go func() {
+		r, err := a.Get("video")
+		if !assert.NoError(t, err) {
+			got <- nil
+			return
+		}
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		got <- b
+	}()
+	select {
+	case <-got:
+		t.Fatal("Get returned before the write finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-stored)
+	assert.Equal(t, data, <-got)
+}
+
+func TestGetWaitForLocalWriteBoundedByDeadline(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	noFetches(t, b)
+
+	release, stored := slowStore(t, a, "video", randomData(t, 64<<10))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := a.GetContext(ctx, "video", TransferOpts{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+	require.NoError(t, <-stored)
+}
+
+func TestGetFollowsLocalWrite(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.FollowWrites = true
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	noFetches(t, b)
+
+	data := randomData(t, 256<<10)
+	release, stored := slowStore(t, a, "video", data)
+	info, r, err := a.GetWithInfo("video")
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(-1), info.Size)
+
+	// The first half is served while the rest is still being read.
+	half := make([]byte, len(data)/2)
+	_, err = io.ReadFull(r, half)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data[:len(half)], half))
+
+	close(release)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data[len(half):], rest)
+	require.NoError(t, <-stored)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+const (
+	// defaultInlineThreshold is the largest object sent inline when InlineThreshold is not set.
+	defaultInlineThreshold = 4 << 10
+	// maxInlineThreshold keeps inline objects, with the rest of their message, within one frame.
+	maxInlineThreshold = p2p.MaxMessageSize - 64<<10
+)
+
+// MessageStoreFileInline carries a small encrypted replica in the message itself, sparing the
+// receiver the stream hand-over of MessageStoreFile.
+type MessageStoreFileInline struct {
+	ID        string // Identifier of the node owning the object
+	Key       string // Hashed key of the object
+	Checksum  string // Hex-encoded SHA-256 of Data
+	Version   uint64 // Version of the object, zero when its key is not versioned
+	Immutable bool   // Whether the owner stored the object as immutable
+	AckID     uint64 // Identifier of the MessageStoreAck wanted once the replica is stored, zero for none
+	Data      []byte // Encrypted object
+	Namespace string // Namespace of the key, empty if it has none or the sender does not know it
+}
+
+// inlineThreshold returns the largest object, in bytes on the wire, sent inline; a negative
+// InlineThreshold disables inlining.
+func (s *FileServer) inlineThreshold() int {
+	switch {
+	case s.InlineThreshold < 0:
+		return -1
+	case s.InlineThreshold == 0:
+		return defaultInlineThreshold
+	default:
+		return min(s.InlineThreshold, maxInlineThreshold)
+	}
+}
+
+// sendInline sends a replica small enough to fit in its message to one peer, asking for an
+// acknowledgement named ackID unless it is zero.
+func (s *FileServer) sendInline(t *transfer, peer p2p.Node, rep replica, ackID uint64) error {
+	msg := &Message{Payload: MessageStoreFileInline{
+		ID:        rep.id,
+		Key:       rep.key,
+		Checksum:  rep.checksum,
+		Version:   rep.version,
+		Immutable: rep.immutable,
+		AckID:     ackID,
+		Data:      rep.data,
+		Namespace: rep.namespace,
+	}, RequestID: t.requestID()}
+	if _, err := s.sendMessage([]p2p.Node{peer}, msg); err != nil {
+		var berr *BroadcastError
+		if errors.As(err, &berr) {
+			return berr.failed[peer.RemoteAddr().String()]
+		}
+		return err
+	}
+	s.metrics.inlineReplicasSent.Add(1)
+	t.phase(TransferReplicate, peer.RemoteAddr().String(), int64(len(rep.data)))
+	t.add(len(rep.data))
+	return nil
+}
+
+// handleMessageStoreFileInline writes a replica carried in its message, discarding it if it
+// does not match its checksum, then acknowledges it if the sender asked to.
+func (s *FileServer) handleMessageStoreFileInline(from string, span string, msg MessageStoreFileInline) (err error) {
+	defer func() {
+		err = s.ackReplica(from, msg.Key, msg.AckID, err)
+	}()
+	sum := sha256.Sum256(msg.Data)
+	if hex.EncodeToString(sum[:]) != msg.Checksum {
+		return fmt.Errorf("replica (%s): %w", msg.Key, storage.ErrContentCorrupted)
+	}
+	if err := s.admitReplica(from, span, msg.ID, msg.Namespace, msg.Key, int64(len(msg.Data))); err != nil {
+		return err
+	}
+	if held, err := s.admitOverwrite(from, msg.ID, msg.Key, msg.Checksum); held || err != nil {
+		return err
+	}
+	if msg.Version > 0 {
+		_, err = s.Storage.WriteVersion(msg.ID, msg.Key, msg.Version, bytes.NewReader(msg.Data))
+	} else {
+		_, err = s.Storage.Write(msg.ID, msg.Key, bytes.NewReader(msg.Data))
+	}
+	if err != nil {
+		return s.refuseIfFull(from, msg.ID, msg.Key, err, msg.Version == 0)
+	}
+	s.diskWritable()
+	if err := s.markImmutable(msg.ID, msg.Key, msg.Immutable); err != nil {
+		return err
+	}
+	s.objectStored(objectRef{owner: msg.ID, key: msg.Key})
+	s.logf(span, "stored replica (%s) of %d inline bytes from (%s)", msg.Key, len(msg.Data), from)
+	return nil
+}
+
+// sendObjectInline answers a MessageGetFile for a small object with a single write holding
+// the stream marker, the object header and the object, rather than one write for each.
+//
+// Returns: Whether the object was small enough to be sent, and any errors sending it.
+func (s *FileServer) sendObjectInline(peer p2p.Node, q query, id string, key string) (bool, error) {
+	meta, err := s.Storage.Stat(id, key)
+	if err != nil || meta.Size > int64(s.inlineThreshold()) {
+		return false, nil
+	}
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return false, nil
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	buf := new(bytes.Buffer)
+	if err := s.writeStamp(buf, peer, id, key); err != nil {
+		return false, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, objectHeader{Found: true, Size: meta.Size, Sum: s.objectSum(id, key)}); err != nil {
+		return false, err
+	}
+	if _, err := writeStream(buf, r, meta.Size, nil, s.capsOf(peer).chunked); err != nil {
+		// The object changed since it was measured; fall back to streaming it.
+		return false, nil
+	}
+	s.metrics.inlineObjectsServed.Add(1)
+	return true, s.sendAnswer(peer, q, buf.Bytes())
+}
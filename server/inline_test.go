@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInlineThresholdBoundary(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	// Replicas carry the IV in front of the content, so the plaintext limit is a block smaller.
+	limit := defaultInlineThreshold - aes.BlockSize
+	for _, tc := range []struct {
+		size   int
+		inline bool
+	}{
+		{0, true},
+		{limit - 1, true},
+		{limit, true},
+		{limit + 1, false},
+		{limit + 100, false},
+	} {
+		key := fmt.Sprintf("inline_%d", tc.size)
+		data := bytes.Repeat([]byte{'i'}, tc.size)
+		sent := a.Metrics()["inline_replicas_sent"]
+		require.NoError(t, a.Store(key, bytes.NewReader(data)), key)
+		assert.Equal(t, tc.inline, a.Metrics()["inline_replicas_sent"] > sent, key)
+		waitFor(t, func() bool {
+			ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+		require.NoError(t, b.Storage.Verify(a.ID, crypto.HashKey(key)), key)
+
+		served := b.Metrics()["inline_objects_served"]
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+		r, err := a.Get(key)
+		require.NoError(t, err, key)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, key)
+		assert.Equal(t, tc.inline, b.Metrics()["inline_objects_served"] > served, key)
+	}
+}
+
+func TestInlineDisabled(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	a.InlineThreshold = -1
+	startCluster(t, a, b)
+
+	require.NoError(t, a.Store("tiny", bytes.NewReader([]byte("t"))))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("tiny"))
+		return ok
+	})
+	assert.Zero(t, a.Metrics()["inline_replicas_sent"])
+}
+
+// benchmarkStore stores 1 KiB objects replicated to one peer.
+func benchmarkStore(b *testing.B, inlineThreshold int) {
+	s := makeServer(b, ":4000")
+	peer := makeServer(b, ":4001", ":4000")
+	s.InlineThreshold = inlineThreshold
+	startCluster(b, s, peer)
+	data := bytes.Repeat([]byte{'b'}, 1<<10)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.Store(fmt.Sprintf("bench_%d", i), bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStoreInline stores 1 KiB objects sent inline.
+func BenchmarkStoreInline(b *testing.B) { benchmarkStore(b, 0) }
+
+// BenchmarkStoreStreamed stores 1 KiB objects streamed as before inlining.
+func BenchmarkStoreStreamed(b *testing.B) { benchmarkStore(b, -1) }
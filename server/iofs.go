@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotDir is returned by the ReadDir of an FS view for a path naming a file.
+var ErrNotDir = errors.New("not a directory")
+
+// fsView is the read-only fs.FS FS returns.
+type fsView struct {
+	s      *FileServer
+	prefix string // Prefix of the keys shown, "<namespace>/" or "" for every key
+}
+
+// FS returns a read-only view of the objects this node stores under its own ID as an fs.FS,
+// for libraries that take one, such as http.FS or template.ParseFS. Keys are interpreted as
+// slash-separated paths; keys that are not valid paths are left out, and when a key names
+// both a file and the directory of other keys, such as "a" and "a/b", the directory wins.
+//
+// Files are opened with Get, so one missing locally is fetched from peers; directories and
+// Stat are answered from the keys and metadata held locally without reading any content.
+// Paths that name nothing are reported with an error wrapping fs.ErrNotExist.
+//
+// Parameters:
+//   - s: Node whose objects are shown.
+//   - ns: Namespace whose keys, named "<ns>/...", are shown with the namespace stripped, or
+//     "" to show every key.
+//
+// Returns: The view, which also implements fs.StatFS and fs.ReadDirFS.
+func FS(s *FileServer, ns string) fs.FS {
+	v := fsView{s: s}
+	if len(ns) > 0 {
+		v.prefix = ns + "/"
+	}
+	return v
+}
+
+// Open opens the file or directory at name.
+func (v fsView) Open(name string) (fs.File, error) {
+	info, err := v.stat("open", name)
+	if errors.Is(err, fs.ErrNotExist) && name != "." {
+		// Files held only by peers are fetched.
+		return v.openFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &fsDir{info: info, view: v, name: name}, nil
+	}
+	return v.openFile(name)
+}
+
+// Stat describes the file or directory at name without reading it.
+func (v fsView) Stat(name string) (fs.FileInfo, error) {
+	return v.stat("stat", name)
+}
+
+// ReadDir lists the directory at name, sorted by file name.
+func (v fsView) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := v.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNotDir}
+	}
+	return v.readDir(name)
+}
+
+// dirPrefix returns the prefix of the keys below the directory at name.
+func (v fsView) dirPrefix(name string) string {
+	if name == "." {
+		return v.prefix
+	}
+	return v.prefix + name + "/"
+}
+
+// stat describes the file or directory at name for the operation op.
+func (v fsView) stat(op string, name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	isDir, err := v.isDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if isDir {
+		return fsInfo{name: pathBase(name), dir: true}, nil
+	}
+	info, err := v.s.StatKey(v.prefix + name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fsError(err)}
+	}
+	return fsInfo{name: pathBase(name), size: info.Size, modTime: info.ModTime}, nil
+}
+
+// isDir reports whether name is the root or the directory of a key that is a valid path.
+func (v fsView) isDir(name string) (bool, error) {
+	if name == "." {
+		return true, nil
+	}
+	prefix := v.dirPrefix(name)
+	keys, err := v.s.Storage.KeysWithPrefix(v.s.ID, prefix)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if fs.ValidPath(key[len(prefix):]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readDir lists the directory at name, which must be one.
+func (v fsView) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := v.dirPrefix(name)
+	keys, err := v.s.Storage.KeysWithPrefix(v.s.ID, prefix)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make(map[string]fs.DirEntry)
+	for _, key := range keys {
+		rest := key[len(prefix):]
+		if !fs.ValidPath(rest) {
+			continue
+		}
+		base, _, nested := strings.Cut(rest, "/")
+		if nested {
+			entries[base] = fs.FileInfoToDirEntry(fsInfo{name: base, dir: true})
+			continue
+		}
+		if _, ok := entries[base]; ok {
+			continue
+		}
+		info, err := v.stat("readdir", pathJoin(name, base))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[base] = fs.FileInfoToDirEntry(info)
+	}
+	list := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// openFile opens the file at name with Get.
+func (v fsView) openFile(name string) (fs.File, error) {
+	info, rc, err := v.s.GetWithInfo(v.prefix + name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fsError(err)}
+	}
+	return &fsFile{info: fsInfo{name: pathBase(name), size: info.Size, modTime: info.ModTime}, rc: rc}, nil
+}
+
+// fsError maps a key missing from the cluster to fs.ErrNotExist, keeping the original error.
+func fsError(err error) error {
+	if errors.Is(err, ErrKeyNotFound) {
+		return errors.Join(fs.ErrNotExist, err)
+	}
+	return err
+}
+
+// pathBase returns the last element of a valid path.
+func pathBase(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// pathJoin returns the path of name within the directory dir.
+func pathJoin(dir string, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// fsInfo describes a file or directory of an FS view. Files are read-only and directories
+// carry no modification time.
+type fsInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i fsInfo) Name() string       { return i.name }
+func (i fsInfo) Size() int64        { return i.size }
+func (i fsInfo) ModTime() time.Time { return i.modTime }
+func (i fsInfo) IsDir() bool        { return i.dir }
+func (i fsInfo) Sys() any           { return nil }
+
+// Mode is read-only for everyone.
+func (i fsInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// fsFile is a file opened from an FS view.
+type fsFile struct {
+	info fsInfo
+	rc   io.ReadCloser
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Read(b []byte) (int, error) { return f.rc.Read(b) }
+func (f *fsFile) Close() error               { return f.rc.Close() }
+
+// fsDir is a directory opened from an FS view. Its entries are listed on the first ReadDir.
+type fsDir struct {
+	info    fs.FileInfo
+	view    fsView
+	name    string
+	entries []fs.DirEntry // Entries not returned yet, nil until listed
+	listed  bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+// Read fails, as directories have no content.
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of the directory, or all the rest when n is not
+// positive, as specified by fs.ReadDirFile.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.view.readDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if n <= 0 {
+		rest := d.entries
+		d.entries = nil
+		return rest, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	next := d.entries[:n]
+	d.entries = d.entries[n:]
+	return next, nil
+}
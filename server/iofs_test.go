@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSServesStoredObjects(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	objects := map[string]string{
+		"index.html":        "<h1>home</h1>",
+		"docs/a.txt":        "a",
+		"docs/sub/b.txt":    "b",
+		"site/x.html":       "x",
+		"site/assets/y.css": "y",
+		"bad//key":          "left out",
+	}
+	for key, data := range objects {
+		require.NoError(t, a.Store(key, bytes.NewReader([]byte(data))))
+	}
+
+	require.NoError(t, fstest.TestFS(FS(a, ""), "index.html", "docs/a.txt", "docs/sub/b.txt", "site/x.html", "site/assets/y.css"))
+	require.NoError(t, fstest.TestFS(FS(a, "site"), "x.html", "assets/y.css"))
+
+	fsys := FS(a, "")
+	_, err := fs.Stat(fsys, "missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fsys.Open("missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fs.ReadDir(fsys, "index.html")
+	assert.ErrorIs(t, err, ErrNotDir)
+
+	// A file this node lost is fetched from its peer on open, though it is no longer listed.
+	waitFor(t, func() bool { ok, _ := b.Storage.Has(a.ID, crypto.HashKey("docs/a.txt")); return ok })
+	require.NoError(t, a.Storage.Delete(a.ID, crypto.HashKey("docs/a.txt")))
+	data, err := fs.ReadFile(fsys, "docs/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+}
+
+func TestFSOverHTTP(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	require.NoError(t, a.Store("site/index.html", bytes.NewReader([]byte("<h1>home</h1>"))))
+	require.NoError(t, a.Store("site/css/main.css", bytes.NewReader([]byte("body {}"))))
+
+	srv := httptest.NewServer(http.FileServer(http.FS(FS(a, "site"))))
+	defer srv.Close()
+
+	for path, want := range map[string]string{"/": "<h1>home</h1>", "/css/main.css": "body {}"} {
+		res, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode, path)
+		assert.Equal(t, want, string(body), path)
+	}
+	res, err := http.Get(srv.URL + "/missing.html")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+// ExampleFS serves the objects of the "site" namespace of a node over HTTP.
+func ExampleFS() {
+	var s *FileServer // A started node
+	http.Handle("/", http.FileServer(http.FS(FS(s, "site"))))
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"log"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// slowIO is the storage's OnSlowIO: it counts the local disk turning degraded and passes the
+// change on to OnSlowIO.
+func (s *FileServer) slowIO(reason string) {
+	if len(reason) > 0 {
+		s.metrics.slowIO.Add(1)
+	}
+	if s.OnSlowIO != nil {
+		s.OnSlowIO(reason)
+	}
+}
+
+// checkDegradedPeers asks every peer for its NodeInfo and records which report a degraded
+// disk. Peers that do not answer keep what they reported last.
+func (s *FileServer) checkDegradedPeers() {
+	for _, peer := range s.peerList() {
+		var info NodeInfo
+		if err := s.exchange(peer, &Message{Payload: MessageNodeInfo{}}, &info, nodeInfoTimeout); err != nil {
+			log.Printf("[%s] asking (%s) about its disk: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			continue
+		}
+		s.recordDegraded(peer, info)
+	}
+}
+
+// recordDegraded records whether a peer reported a degraded disk in its NodeInfo, so fetches
+// rank it after the others, when DegradedCheckInterval is set.
+func (s *FileServer) recordDegraded(peer p2p.Node, info NodeInfo) {
+	if s.DegradedCheckInterval <= 0 || len(info.Err) > 0 {
+		return
+	}
+	addr := peer.RemoteAddr().String()
+	if s.peerStats.setDegraded(addr, len(info.DegradedIO) > 0) {
+		log.Printf("[%s] peer (%s) reports degraded disk IO: %s", s.Transport.Addr(), addr, info.DegradedIO)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowWriter makes every write take 100ms on the store's IO clock while slow is set, as a
+// failing disk does.
+type slowWriter struct {
+	w     io.Writer
+	slow  *atomic.Bool
+	clock *clock.Fake
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	if w.slow.Load() {
+		w.clock.Advance(100 * time.Millisecond)
+	}
+	return w.w.Write(p)
+}
+
+// TestDegradedDiskIsReported slows the disk of one node of three. The node reports its IO as
+// degraded in its health and metrics, and its peer ranks it last as a source of fetches until
+// it recovers.
+func TestDegradedDiskIsReported(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.DegradedCheckInterval = time.Hour
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	var slow atomic.Bool
+	var reasons atomic.Int64
+	ioClock := clock.NewFake(time.Now())
+	b.Storage.IOClock = ioClock
+	b.Storage.WrapWrites = func(w io.Writer) io.Writer { return slowWriter{w: w, slow: &slow, clock: ioClock} }
+	b.Storage.SlowIOLatency = 80 * time.Millisecond
+	b.OnSlowIO = func(reason string) {
+		if len(reason) > 0 {
+			reasons.Add(1)
+		}
+	}
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 })
+
+	store := func(n int) {
+		t.Helper()
+		for i := range n {
+			require.NoError(t, b.Store(fmt.Sprintf("log-%d", i), bytes.NewReader([]byte("entry"))))
+		}
+	}
+	slow.Store(true)
+	store(16)
+	info, err := b.Stats()
+	require.NoError(t, err)
+	assert.Contains(t, info.DegradedIO, "write latency")
+	assert.Equal(t, int64(16), info.IO["write"].Count)
+	assert.Equal(t, 100*time.Millisecond, info.IO["write"].P99, "every write took the 100ms injected")
+	assert.Equal(t, int64(1), b.Metrics()["storage_io_degraded"])
+	assert.Equal(t, int64(1), b.Metrics()["slow_io"])
+	assert.Equal(t, int64(100000), b.Metrics()["storage_write_p99_us"])
+	assert.Equal(t, int64(1), reasons.Load())
+
+	var toB p2p.Node
+	for _, node := range a.ClusterInfo()[1:] {
+		if node.ID == b.ID {
+			assert.Contains(t, node.DegradedIO, "write latency")
+		}
+	}
+	for _, peer := range a.peerList() {
+		if peer.Hello().NodeID == b.ID {
+			toB = peer
+		}
+	}
+	ranked := a.peerStats.fastest(a.peerList(), 2)
+	assert.Equal(t, toB, ranked[1], "a peer with a degraded disk is ranked last")
+
+	// Once b's disk recovers, a no longer ranks it last.
+	slow.Store(false)
+	store(144)
+	waitFor(t, func() bool { return replicaCount(b, "log-143", a, c) == 2 })
+	info, err = b.Stats()
+	require.NoError(t, err)
+	assert.Empty(t, info.DegradedIO)
+	assert.Zero(t, b.Metrics()["storage_io_degraded"])
+	a.checkDegradedPeers()
+	a.peerStats.mu.Lock()
+	defer a.peerStats.mu.Unlock()
+	assert.Empty(t, a.peerStats.degraded)
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// leaseOwners is the number of nodes whose grants decide a lease: the first of this node
+	// and its connected peers in the rendezvous order of the key, as objects are placed.
+	leaseOwners = 3
+	// leaseTimeout bounds the wait for a peer to answer a lease request.
+	leaseTimeout = 5 * time.Second
+)
+
+// ErrLeased is returned when a lease is refused because another node holds one on the key,
+// and when a key is stored by a node other than the one holding its lease.
+var ErrLeased = errors.New("key is leased by another node")
+
+// MessageLease asks a peer to grant, renew or release the sender's lease on a key. The lease
+// is granted unless another node holds one that has not expired. The peer answers with a
+// leaseResponse.
+type MessageLease struct {
+	Key       string        // Hashed key leased
+	Namespace string        // Namespace the sender declares the key in, as for MessageStoreFile
+	TTL       time.Duration // How long the lease lasts from when the peer grants it; zero releases it
+}
+
+// leaseResponse is the answer to MessageLease.
+type leaseResponse struct {
+	Granted bool   // Whether the peer recorded the lease for the sender, or released it
+	Holder  string // Node ID of the node holding the lease when it was refused
+	Err     string // Why the peer could not decide
+}
+
+// lease is a key leased to a node until it expires.
+type lease struct {
+	holder  string    // Node ID of the node holding the lease
+	expires time.Time // When the lease lapses unless renewed
+}
+
+// leaseTable is the leases a node knows of, granted by it to itself and its peers. Every node
+// asked for a lease records it, whether or not its grant counts, so stores of the key are
+// refused wherever they are made.
+type leaseTable struct {
+	mu      sync.Mutex
+	entries map[string]lease // Leases by hashed key
+}
+
+// newLeaseTable returns an empty table.
+func newLeaseTable() *leaseTable {
+	return &leaseTable{entries: make(map[string]lease)}
+}
+
+// grant leases key to holder until ttl past now, renewing holder's own lease, unless another
+// node holds a lease on it that has not expired. A ttl of zero releases holder's lease.
+//
+// Returns: The node holding the lease afterwards, holder when it was granted or released.
+func (t *leaseTable) grant(key string, holder string, ttl time.Duration, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.entries[key]; ok && l.holder != holder && now.Before(l.expires) {
+		return l.holder
+	}
+	if ttl <= 0 {
+		delete(t.entries, key)
+	} else {
+		t.entries[key] = lease{holder: holder, expires: now.Add(ttl)}
+	}
+	return holder
+}
+
+// holder returns the node holding an unexpired lease on key, if any.
+func (t *leaseTable) holder(key string, now time.Time) (lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.entries[key]
+	if ok && !now.Before(l.expires) {
+		delete(t.entries, key)
+		return lease{}, false
+	}
+	return l, ok
+}
+
+// held returns the unexpired leases of holder with the time left on each, by hashed key.
+func (t *leaseTable) held(holder string, now time.Time) map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	held := make(map[string]time.Duration)
+	for key, l := range t.entries {
+		if l.holder == holder && now.Before(l.expires) {
+			held[key] = l.expires.Sub(now)
+		}
+	}
+	return held
+}
+
+// Lease is exclusive write access to a key across the cluster, held by the node that acquired
+// it with AcquireLease until it is released or expires. Stores of the key by other nodes fail
+// with ErrLeased meanwhile; every caller on the holding node shares the lease.
+type Lease struct {
+	Key string // Key leased
+	s   *FileServer
+}
+
+// Expires returns when the lease lapses unless it is renewed, or the zero time if it is no
+// longer held.
+func (l Lease) Expires() time.Time {
+	held, ok := l.s.leases.holder(crypto.HashKey(l.Key), l.s.Clock.Now())
+	if !ok || held.holder != l.s.ID {
+		return time.Time{}
+	}
+	return held.expires
+}
+
+// Renew extends the lease to ttl from now, with the agreement of a majority of the key's
+// lease owners as for AcquireLease.
+//
+// Returns: An error wrapping ErrLeased if another node took the lease after it expired.
+func (l Lease) Renew(ttl time.Duration) error {
+	return l.s.requestLease(l.Key, ttl)
+}
+
+// Release gives up the lease on this node and every peer, so other nodes may store the key
+// and lease it at once.
+//
+// Returns: Any errors telling the peers; the lease still expires on those that were not told.
+func (l Lease) Release() error {
+	return l.s.requestLease(l.Key, 0)
+}
+
+// AcquireLease leases a key to this node for ttl, so it is the only node storing the key until
+// the lease is released or expires. The lease is asked of this node and every peer; it is
+// granted if a majority of the key's lease owners grant it, the first leaseOwners of these
+// nodes in the rendezvous order of the key, and each grants it unless another node holds an
+// unexpired lease on the key. Every node asked records the lease, so it is kept when the
+// owners change, and peers that connect later are told of it by this node. Peers too old to
+// lease keys are not asked.
+//
+// Returns: The lease, or an error wrapping ErrLeased if another node holds one on the key. A
+// lease that is not granted is released on the nodes that granted it.
+func (s *FileServer) AcquireLease(key string, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("leasing (%s): the lease must last longer than %s", key, ttl)
+	}
+	if err := s.requestLease(key, ttl); err != nil {
+		return Lease{}, err
+	}
+	return Lease{Key: key, s: s}, nil
+}
+
+// requestLease asks this node and its peers to lease key to this node for ttl, or to release
+// the lease if ttl is zero.
+func (s *FileServer) requestLease(key string, ttl time.Duration) error {
+	hashedKey := crypto.HashKey(key)
+	peers, _ := s.peersWith(s.peerList(), func(c peerCaps) bool { return c.leases })
+	owners := s.leaseOwners(hashedKey, peers)
+	granted := make([]p2p.Node, 0, len(peers))
+	votes := 0
+	holder := s.leases.grant(hashedKey, s.ID, ttl, s.Clock.Now())
+	if holder == s.ID && owners[s.ID] {
+		votes++
+	}
+	var errs []error
+	msg := MessageLease{Key: hashedKey, Namespace: keyNamespace(key), TTL: ttl}
+	for _, peer := range peers {
+		var resp leaseResponse
+		err := s.exchange(peer, &Message{Payload: msg}, &resp, leaseTimeout)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("peer (%s): %w", peer.RemoteAddr(), err))
+		case len(resp.Err) > 0:
+			errs = append(errs, fmt.Errorf("peer (%s): %s", peer.RemoteAddr(), resp.Err))
+		case resp.Granted:
+			granted = append(granted, peer)
+			if owners[peerPlacementNode(peer).id] {
+				votes++
+			}
+		default:
+			holder = resp.Holder
+		}
+	}
+	if ttl <= 0 {
+		if err := errors.Join(errs...); err != nil {
+			return fmt.Errorf("releasing the lease on (%s): %w", key, err)
+		}
+		return nil
+	}
+	if votes > len(owners)/2 {
+		return nil
+	}
+	// Nodes that granted a lease that is not held would refuse the key to the others.
+	s.leases.grant(hashedKey, s.ID, 0, s.Clock.Now())
+	for _, peer := range granted {
+		var resp leaseResponse
+		if err := s.exchange(peer, &Message{Payload: MessageLease{Key: hashedKey, Namespace: msg.Namespace}}, &resp, leaseTimeout); err != nil {
+			log.Printf("[%s] releasing the lease on (%s) on (%s): %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+		}
+	}
+	err := fmt.Errorf("leasing (%s): %d of %d lease owners granted it", key, votes, len(owners))
+	if holder != s.ID {
+		return fmt.Errorf("%w, node %s holds it: %w", err, holder, ErrLeased)
+	}
+	return errors.Join(err, errors.Join(errs...))
+}
+
+// leaseOwners returns the node IDs whose grants decide a lease on a key: the first leaseOwners
+// of this node and the peers in the rendezvous order of the key.
+func (s *FileServer) leaseOwners(hashedKey string, peers []p2p.Node) map[string]bool {
+	nodes := []placementNode{{id: s.ID}}
+	for _, peer := range peers {
+		nodes = append(nodes, peerPlacementNode(peer))
+	}
+	owners := make(map[string]bool, leaseOwners)
+	for _, id := range placeOn(hashedKey, nodes, Policy{ReplicationFactor: leaseOwners}) {
+		owners[id] = true
+	}
+	return owners
+}
+
+// checkLease reports whether this node may store key.
+//
+// Returns: An error wrapping ErrLeased if another node holds a lease on the key.
+func (s *FileServer) checkLease(key string) error {
+	if l, ok := s.leases.holder(crypto.HashKey(key), s.Clock.Now()); ok && l.holder != s.ID {
+		s.metrics.storesLeased.Add(1)
+		return fmt.Errorf("storing (%s): node %s holds its lease: %w", key, l.holder, ErrLeased)
+	}
+	return nil
+}
+
+// admitLeased decides whether a replica of owner id's object may be stored, refusing it with
+// a MessageStoreRejected if another node holds a lease on the key.
+//
+// Returns: An error wrapping ErrLeased if the replica was refused.
+func (s *FileServer) admitLeased(from string, id string, key string) error {
+	l, ok := s.leases.holder(key, s.Clock.Now())
+	if !ok || l.holder == id {
+		return nil
+	}
+	s.metrics.storesLeased.Add(1)
+	err := fmt.Errorf("replica (%s): node %s holds its lease: %w", key, l.holder, ErrLeased)
+	return s.refuseReplica(from, id, key, err, ErrLeased)
+}
+
+// shareLeases tells a peer that just connected of the leases this node holds, so it refuses
+// stores of their keys by other nodes.
+func (s *FileServer) shareLeases(peer p2p.Node) {
+	if !s.capsOf(peer).leases {
+		return
+	}
+	for key, ttl := range s.leases.held(s.ID, s.Clock.Now()) {
+		var resp leaseResponse
+		if err := s.exchange(peer, &Message{Payload: MessageLease{Key: key, TTL: ttl}}, &resp, leaseTimeout); err != nil {
+			log.Printf("[%s] telling (%s) of the lease on (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), key, err)
+		}
+	}
+}
+
+// handleMessageLease grants, renews or releases the lease of the peer on a key, and answers
+// with the outcome. A peer its Authorizer does not allow to store the key is refused.
+func (s *FileServer) handleMessageLease(from string, q query, msg MessageLease) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	holder := peerPlacementNode(peer).id
+	if err := s.authorize(from, "", OpStore, holder, msg.Namespace, msg.Key); err != nil {
+		return errors.Join(err, s.sendValue(from, q, leaseResponse{Err: err.Error()}))
+	}
+	granted := s.leases.grant(msg.Key, holder, msg.TTL, s.Clock.Now())
+	return s.sendValue(from, q, leaseResponse{Granted: granted == holder, Holder: granted})
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLeaseContention has two nodes of a cluster of three lease the same key. The first wins,
+// the other's stores of the key are refused until the lease expires, and it leases the key
+// itself afterwards.
+func TestLeaseContention(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	clk := clock.NewFake(time.Now())
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	for _, s := range []*FileServer{a, b, c} {
+		s.Clock = clk
+	}
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 && len(c.peerList()) == 2 })
+
+	const key = "config"
+	lease, err := a.AcquireLease(key, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, clk.Now().Add(time.Minute), lease.Expires())
+	_, err = b.AcquireLease(key, time.Minute)
+	require.ErrorIs(t, err, ErrLeased)
+	assert.Contains(t, err.Error(), a.ID)
+	for _, s := range []*FileServer{a, b, c} {
+		held, ok := s.leases.holder(crypto.HashKey(key), clk.Now())
+		require.True(t, ok, "every node records the lease")
+		assert.Equal(t, a.ID, held.holder)
+	}
+
+	assert.ErrorIs(t, b.Store(key, bytes.NewReader([]byte("b"))), ErrLeased)
+	_, err = b.Append(key, bytes.NewReader([]byte("b")))
+	assert.ErrorIs(t, err, ErrLeased)
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("a"))))
+	waitFor(t, func() bool { return replicaCount(a, key, b, c) == 2 })
+	assert.Zero(t, replicaCount(b, key, a, b, c))
+
+	// A replica of the key sent by a node that does not hold its lease is refused.
+	c.leases.grant(crypto.HashKey("other"), a.ID, time.Minute, clk.Now())
+	require.NoError(t, b.Store("other", bytes.NewReader([]byte("b"))))
+	waitFor(t, func() bool { return c.Metrics()["stores_leased"] == 1 })
+	assert.Zero(t, replicaCount(b, "other", c))
+
+	// Renewing keeps the lease past its first expiry; once it lapses, b leases the key.
+	clk.Advance(30 * time.Second)
+	require.NoError(t, lease.Renew(time.Minute))
+	clk.Advance(45 * time.Second)
+	_, err = b.AcquireLease(key, time.Minute)
+	require.ErrorIs(t, err, ErrLeased)
+	clk.Advance(15 * time.Second)
+	assert.True(t, lease.Expires().IsZero())
+	other, err := b.AcquireLease(key, time.Minute)
+	require.NoError(t, err)
+	assert.ErrorIs(t, a.Store(key, bytes.NewReader([]byte("a"))), ErrLeased)
+	require.NoError(t, b.Store(key, bytes.NewReader([]byte("b"))))
+
+	// Released, the key may be leased and stored by any node at once.
+	require.NoError(t, other.Release())
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("a"))))
+	_, err = c.AcquireLease(key, time.Minute)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+const (
+	// defaultListPageSize is the number of keys requested per page when ListPageSize is not set.
+	defaultListPageSize = 1000
+	// maxListPageSize caps the keys a node sends in one answer to MessageListKeys.
+	maxListPageSize = 10000
+	// listTimeout bounds how long ListNetwork waits for each page from a peer.
+	listTimeout = 5 * time.Second
+	// listSnapshotTTL is how long the snapshot of a listing is kept after its last page.
+	listSnapshotTTL = time.Minute
+	// maxListSnapshots bounds the listings a node keeps snapshots for; past it, the least
+	// recently paged one is dropped.
+	maxListSnapshots = 64
+)
+
+// ErrListExpired is returned for a page of a listing whose snapshot is gone, because the
+// listing sat idle for listSnapshotTTL, too many others started since or the node restarted.
+// The listing has to start over.
+var ErrListExpired = errors.New("listing snapshot expired")
+
+// MessageListKeys asks a peer for a page of the keys it owns.
+type MessageListKeys struct {
+	Prefix string // Only keys starting with Prefix are listed
+	Cursor string // Next cursor of the previous page, "" for the first page
+	Limit  int    // Most keys wanted, capped by maxListPageSize
+}
+
+// KeyInfo describes a key held by one or more nodes of the cluster.
+type KeyInfo struct {
+	Key     string    `json:"key"`              // Key the object was stored under
+	Size    int64     `json:"size"`             // Size of the newest copy in bytes
+	ModTime time.Time `json:"mod_time"`         // When the newest copy was written
+	Owners  []string  `json:"owners"`           // IDs of the nodes storing an object under the key, sorted
+	Target  string    `json:"target,omitempty"` // Key an alias points at, empty for keys naming objects; see FileServer.Link
+}
+
+// ListSnapshot names the point in time a node listed its keys at. Sequence numbers count the
+// changes to a node's keys, kept in its index database across restarts, so they compare
+// between any listings of the same node; times compare across nodes as far as their clocks agree.
+type ListSnapshot struct {
+	Node string    `json:"node"` // Node listed
+	Seq  uint64    `json:"seq"`  // Changes to the node's keys before the snapshot, zero from nodes predating snapshots
+	Time time.Time `json:"time"` // When the node took the snapshot, by its clock
+}
+
+// listResponse is the stream sent in answer to MessageListKeys.
+type listResponse struct {
+	Entries []KeyInfo // Keys of the page in sorted order
+	Next    string    // Cursor of the next page, "" when this is the last
+	Err     string    // Why the request could not be answered
+	Denied  bool      // Whether the Authorizer denied the request
+	Seq     uint64    // Sequence number of the snapshot the page was listed from
+	Time    time.Time // When that snapshot was taken
+}
+
+// snapshotTable holds the key snapshots of the listings being paged through on this node.
+type snapshotTable struct {
+	mu   sync.Mutex
+	next uint64                   // Number of the last snapshot added
+	held map[uint64]*heldSnapshot // Snapshots by number
+}
+
+// heldSnapshot is the snapshot of one listing.
+type heldSnapshot struct {
+	snap *storage.KeySnapshot
+	used time.Time // When the listing last asked for a page
+}
+
+// add holds the snapshot of a new listing, dropping those idle for listSnapshotTTL and, past
+// maxListSnapshots, the least recently paged.
+//
+// Returns: The number cursors name the snapshot by.
+func (st *snapshotTable) add(snap *storage.KeySnapshot, now time.Time) uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.held == nil {
+		st.held = make(map[uint64]*heldSnapshot)
+	}
+	for id, h := range st.held {
+		if now.Sub(h.used) > listSnapshotTTL {
+			delete(st.held, id)
+		}
+	}
+	for len(st.held) >= maxListSnapshots {
+		var oldest uint64
+		for id, h := range st.held {
+			if oldest == 0 || h.used.Before(st.held[oldest].used) {
+				oldest = id
+			}
+		}
+		delete(st.held, oldest)
+	}
+	st.next++
+	st.held[st.next] = &heldSnapshot{snap: snap, used: now}
+	return st.next
+}
+
+// get returns the snapshot numbered id, unless it was dropped or sat idle for too long.
+func (st *snapshotTable) get(id uint64, now time.Time) (*storage.KeySnapshot, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	h, ok := st.held[id]
+	if !ok {
+		return nil, false
+	}
+	if now.Sub(h.used) > listSnapshotTTL {
+		delete(st.held, id)
+		return nil, false
+	}
+	h.used = now
+	return h.snap, true
+}
+
+// drop lets the snapshot numbered id go once its listing is done.
+func (st *snapshotTable) drop(id uint64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.held, id)
+}
+
+// pageSnapshot returns the snapshot a page of a listing is served from. Cursors are
+// "<snapshot>/<position>": the first page, with an empty cursor, takes a snapshot of the keys
+// of owners, and later pages name it.
+//
+// Returns: The snapshot's number, the snapshot, the position the cursor names within it, and
+// ErrListExpired if the snapshot is gone.
+func (s *FileServer) pageSnapshot(cursor string, owners func() ([]string, error)) (uint64, *storage.KeySnapshot, string, error) {
+	now := s.Clock.Now()
+	if len(cursor) == 0 {
+		ids, err := owners()
+		if err != nil {
+			return 0, nil, "", err
+		}
+		snap, err := s.Storage.SnapshotKeys(ids...)
+		if err != nil {
+			return 0, nil, "", err
+		}
+		return s.listSnapshots.add(snap, now), snap, "", nil
+	}
+	num, pos, ok := strings.Cut(cursor, "/")
+	id, err := strconv.ParseUint(num, 10, 64)
+	if !ok || err != nil {
+		return 0, nil, "", fmt.Errorf("malformed listing cursor %q", cursor)
+	}
+	snap, ok := s.listSnapshots.get(id, now)
+	if !ok {
+		return 0, nil, "", ErrListExpired
+	}
+	return id, snap, pos, nil
+}
+
+// pageCursor returns the cursor of the page following pos in the snapshot numbered id, or ""
+// when pos is empty, letting the snapshot go as the listing is done.
+func (s *FileServer) pageCursor(id uint64, pos string) string {
+	if len(pos) == 0 {
+		s.listSnapshots.drop(id)
+		return ""
+	}
+	return strconv.FormatUint(id, 10) + "/" + pos
+}
+
+// listPageSize returns the number of keys requested per page.
+func (s *FileServer) listPageSize() int {
+	if s.ListPageSize <= 0 {
+		return defaultListPageSize
+	}
+	return min(s.ListPageSize, maxListPageSize)
+}
+
+// listPage returns a page of the keys this node owns, from the snapshot the listing took with
+// its first page, so no key is listed twice or missed however keys change between pages. Keys
+// deleted since the snapshot are left out, as there is no copy left to describe.
+//
+// Returns: The page, with the cursor of the next page, and any errors.
+func (s *FileServer) listPage(prefix string, cursor string, limit int) (listResponse, error) {
+	id, snap, pos, err := s.pageSnapshot(cursor, func() ([]string, error) { return []string{s.ID}, nil })
+	if err != nil {
+		return listResponse{}, err
+	}
+	keys, next := snap.ListKeys(s.ID, prefix, pos, limit)
+	// The page is described from the key index in one read rather than a sidecar per key.
+	metas, err := s.Storage.Lookup(s.ID, keys)
+	if err != nil {
+		return listResponse{}, err
+	}
+	entries := make([]KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		meta, ok := metas[key]
+		if !ok {
+			// Deleted since the snapshot.
+			continue
+		}
+		entries = append(entries, KeyInfo{Key: key, Size: meta.PlainSize, ModTime: meta.ModTime, Owners: []string{s.ID}})
+	}
+	return listResponse{Entries: entries, Next: s.pageCursor(id, next), Seq: snap.Seq, Time: snap.Time}, nil
+}
+
+// handleMessageListKeys answers a MessageListKeys with a page of the keys this node owns. A
+// request that could not be answered, or that the Authorizer denied, still gets a response,
+// carrying the error, so the requester's connection stays in sync.
+func (s *FileServer) handleMessageListKeys(from string, q query, msg MessageListKeys) error {
+	if err := s.authorize(from, "", OpList, s.ID, keyNamespace(msg.Prefix), msg.Prefix); err != nil {
+		return errors.Join(s.sendValue(from, q, listResponse{Err: err.Error(), Denied: true}), err)
+	}
+	limit := msg.Limit
+	if limit <= 0 || limit > maxListPageSize {
+		limit = maxListPageSize
+	}
+	resp, err := s.listPage(msg.Prefix, msg.Cursor, limit)
+	if err != nil {
+		resp = listResponse{Err: err.Error()}
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
+
+// listPager fetches the page of a source that follows cursor.
+type listPager func(cursor string) ([]KeyInfo, string, error)
+
+// peerPager pages through the keys a peer owns.
+func (s *FileServer) peerPager(peer p2p.Node, prefix string) listPager {
+	return func(cursor string) ([]KeyInfo, string, error) {
+		var resp listResponse
+		msg := &Message{Payload: MessageListKeys{Prefix: prefix, Cursor: cursor, Limit: s.listPageSize()}}
+		if err := s.exchange(peer, msg, &resp, listTimeout); err != nil {
+			return nil, "", fmt.Errorf("listing keys of (%s): %w", peer.RemoteAddr(), err)
+		}
+		if resp.Denied {
+			return nil, "", fmt.Errorf("listing keys: %w", &DeniedError{Peer: peer.RemoteAddr().String(), Reason: resp.Err})
+		}
+		if len(resp.Err) > 0 {
+			return nil, "", fmt.Errorf("listing keys of (%s): %w", peer.RemoteAddr(), newRemoteError(resp.Err))
+		}
+		return resp.Entries, resp.Next, nil
+	}
+}
+
+// listStream is the sorted keys of one source, fetched a page at a time in the background.
+type listStream struct {
+	entries chan KeyInfo // Keys in sorted order, closed after the last one or the first error
+	err     error        // Why the stream ended early; read only once entries is closed
+	head    KeyInfo      // Next key of the stream, valid while ok
+	ok      bool         // Whether head holds a key
+}
+
+// startListStream pages through a source until it is exhausted, it fails or done is closed.
+func startListStream(done <-chan struct{}, pager listPager, pageSize int) *listStream {
+	ls := &listStream{entries: make(chan KeyInfo, pageSize)}
+	go func() {
+		defer close(ls.entries)
+		cursor := ""
+		for {
+			page, next, err := pager(cursor)
+			if err != nil {
+				ls.err = err
+				return
+			}
+			for _, entry := range page {
+				select {
+				case ls.entries <- entry:
+				case <-done:
+					return
+				}
+			}
+			if len(next) == 0 {
+				return
+			}
+			cursor = next
+		}
+	}()
+	return ls
+}
+
+// advance moves the head of the stream to its next key.
+func (ls *listStream) advance() {
+	ls.head, ls.ok = <-ls.entries
+}
+
+// ListNetwork lists the keys owned by this node and every connected peer that start with
+// prefix, in sorted order. Each node is paged through concurrently, ListPageSize keys at a
+// time, so memory stays bounded however many keys the cluster holds. A key owned by several
+// nodes is listed once, with every owner and the size of its newest copy.
+//
+// Each node serves its pages from a snapshot of its keys taken for the first one, so its part
+// of the listing is consistent: keys written after the snapshot are left out, keys deleted
+// since are dropped rather than listed half-deleted, and no key is repeated or skipped. The
+// nodes' snapshots are taken independently, so the listing of the cluster as a whole is only
+// eventually consistent. Nodes that fail part-way contribute the keys listed until then;
+// their errors are yielded last, joined, with a zero KeyInfo.
+//
+// The cluster's aliases are listed too, as this node knows them, with the key each points at
+// as Target and the time it was last pointed as ModTime.
+//
+// Parameters:
+//   - prefix: Only keys starting with prefix are listed, "" for every key.
+//
+// Returns: An iterator over the keys.
+func (s *FileServer) ListNetwork(prefix string) iter.Seq2[KeyInfo, error] {
+	return func(yield func(KeyInfo, error) bool) {
+		done := make(chan struct{})
+		defer close(done)
+		pageSize := s.listPageSize()
+		pagers := []listPager{func(cursor string) ([]KeyInfo, string, error) {
+			resp, err := s.listPage(prefix, cursor, pageSize)
+			return resp.Entries, resp.Next, err
+		}, s.aliasPager(prefix)}
+		for _, peer := range s.peerList() {
+			pagers = append(pagers, s.peerPager(peer, prefix))
+		}
+		streams := make([]*listStream, len(pagers))
+		for i, pager := range pagers {
+			streams[i] = startListStream(done, pager, pageSize)
+			streams[i].advance()
+		}
+		for {
+			var merged *KeyInfo
+			for _, ls := range streams {
+				if !ls.ok || (merged != nil && ls.head.Key > merged.Key) {
+					continue
+				}
+				if merged == nil || ls.head.Key < merged.Key {
+					entry := ls.head
+					entry.Owners = append([]string(nil), entry.Owners...)
+					merged = &entry
+					continue
+				}
+				mergeKeyInfo(merged, ls.head)
+			}
+			if merged == nil {
+				break
+			}
+			for _, ls := range streams {
+				for ls.ok && ls.head.Key == merged.Key {
+					ls.advance()
+				}
+			}
+			sort.Strings(merged.Owners)
+			if !yield(*merged, nil) {
+				return
+			}
+		}
+		var errs []error
+		for _, ls := range streams {
+			if ls.err != nil {
+				errs = append(errs, ls.err)
+			}
+		}
+		if len(errs) > 0 {
+			yield(KeyInfo{}, errors.Join(errs...))
+		}
+	}
+}
+
+// mergeKeyInfo adds another node's copy of a key to merged, keeping the size and time of the
+// newest copy, and the target of an alias named like it.
+func mergeKeyInfo(merged *KeyInfo, other KeyInfo) {
+	if len(other.Target) > 0 {
+		merged.Target = other.Target
+		return
+	}
+	for _, owner := range other.Owners {
+		if !slices.Contains(merged.Owners, owner) {
+			merged.Owners = append(merged.Owners, owner)
+		}
+	}
+	if other.ModTime.After(merged.ModTime) {
+		merged.Size, merged.ModTime = other.Size, other.ModTime
+	}
+}
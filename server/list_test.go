@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listKeys collects the keys ListNetwork yields for prefix, failing the test on error.
+func listKeys(t *testing.T, s *FileServer, prefix string) []KeyInfo {
+	t.Helper()
+	var entries []KeyInfo
+	for entry, err := range s.ListNetwork(prefix) {
+		require.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// keyNames returns the keys of entries.
+func keyNames(entries []KeyInfo) []string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Key
+	}
+	return names
+}
+
+func TestListNetworkMergesNodes(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	a.ListPageSize = 1
+	startCluster(t, a, b, c)
+	// c only dials a, which may not have registered it yet.
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	for s, keys := range map[*FileServer][]string{
+		a: {"a/1", "shared/x"},
+		b: {"b/1", "b/2", "shared/x"},
+		c: {"c/1"},
+	} {
+		for _, key := range keys {
+			require.NoError(t, s.Store(key, strings.NewReader(key+" from "+s.Transport.Addr())))
+		}
+	}
+
+	entries := listKeys(t, a, "")
+	assert.Equal(t, []string{"a/1", "b/1", "b/2", "c/1", "shared/x"}, keyNames(entries))
+	owners := []string{a.ID, b.ID}
+	sort.Strings(owners)
+	assert.Equal(t, owners, entries[4].Owners)
+	assert.Equal(t, []string{c.ID}, entries[3].Owners)
+	assert.Equal(t, int64(len("c/1 from :4002")), entries[3].Size)
+
+	assert.Equal(t, []string{"b/1", "b/2"}, keyNames(listKeys(t, a, "b/")))
+	assert.Equal(t, []string{"shared/x"}, keyNames(listKeys(t, a, "s")))
+	assert.Empty(t, listKeys(t, a, "zzz"))
+}
+
+func TestListNetworkConcurrentMutation(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	a.ListPageSize = 2
+	startCluster(t, a, b)
+
+	var want []string
+	for i := 1; i <= 10; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		owner := a
+		if i%2 == 0 {
+			owner = b
+		}
+		require.NoError(t, owner.Store(key, strings.NewReader(key)))
+		want = append(want, key)
+	}
+
+	var got []string
+	for entry, err := range a.ListNetwork("k") {
+		require.NoError(t, err)
+		if len(got) == 1 {
+			// Keys land before and after the listing position and a later key is deleted.
+			require.NoError(t, a.Store("k00", strings.NewReader("new")))
+			require.NoError(t, b.Store("k99", strings.NewReader("new")))
+			require.NoError(t, a.Storage.Delete(a.ID, "k07"))
+		}
+		got = append(got, entry.Key)
+	}
+	assert.True(t, sort.StringsAreSorted(got), "keys out of order: %q", got)
+	seen := make(map[string]bool)
+	for _, key := range got {
+		assert.False(t, seen[key], "key %s listed twice", key)
+		seen[key] = true
+	}
+	for _, key := range want {
+		if key != "k07" {
+			assert.True(t, seen[key], "key %s existed throughout but was not listed", key)
+		}
+	}
+	// Each node lists from a snapshot taken for its first page.
+	assert.False(t, seen["k99"], "a key written after the snapshot is listed")
+	assert.False(t, seen["k00"], "a key written after the snapshot is listed")
+
+	// Stopping early releases the listing.
+	n := 0
+	for range a.ListNetwork("") {
+		if n++; n == 2 {
+			break
+		}
+	}
+	assert.Len(t, listKeys(t, a, "k"), 11)
+}
+
+// TestListPagesFromSnapshot pages through a node's keys while others delete and write keys
+// between and during pages. Every page comes from the same snapshot: no key is listed twice,
+// none written since is listed, none is listed without its copy, and every key that existed
+// throughout is listed.
+func TestListPagesFromSnapshot(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	const keys = 200
+	before := make(map[string]bool)
+	for i := range keys {
+		key := fmt.Sprintf("k%03d", i)
+		_, err := a.Storage.Write(a.ID, key, strings.NewReader(key))
+		require.NoError(t, err)
+		before[key] = true
+	}
+	// Odd keys are deleted, and keys sorting between the others written, as the pages are read.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range keys {
+			if i%2 == 1 {
+				a.Storage.Delete(a.ID, fmt.Sprintf("k%03d", i))
+			}
+			a.Storage.Write(a.ID, fmt.Sprintf("k%03d+", i), strings.NewReader("new"))
+		}
+	}()
+
+	seen := make(map[string]bool)
+	var snapshot ListSnapshot
+	for cursor := ""; ; {
+		resp, err := a.listPage("k", cursor, 7)
+		require.NoError(t, err)
+		if len(cursor) == 0 {
+			snapshot = ListSnapshot{Seq: resp.Seq, Time: resp.Time}
+		}
+		assert.Equal(t, snapshot, ListSnapshot{Seq: resp.Seq, Time: resp.Time}, "pages from different snapshots")
+		for _, entry := range resp.Entries {
+			require.False(t, seen[entry.Key], "key %s listed twice", entry.Key)
+			require.True(t, before[entry.Key], "key %s written after the snapshot is listed", entry.Key)
+			require.Equal(t, int64(len(entry.Key)), entry.Size, "key %s listed without its copy", entry.Key)
+			seen[entry.Key] = true
+		}
+		if cursor = resp.Next; len(cursor) == 0 {
+			break
+		}
+		// A write between pages too.
+		_, err = a.Storage.Write(a.ID, cursor[strings.Index(cursor, "/")+1:]+"~", strings.NewReader("new"))
+		require.NoError(t, err)
+	}
+	<-done
+	for i := 0; i < keys; i += 2 {
+		assert.True(t, seen[fmt.Sprintf("k%03d", i)], "key k%03d existed throughout but was not listed", i)
+	}
+
+	// The snapshot is let go once the listing is done.
+	_, err := a.listPage("k", "1/k000", 7)
+	assert.ErrorIs(t, err, ErrListExpired)
+
+	// Audits report the point in time each node was listed at.
+	report := a.VerifyCluster(false)
+	require.Len(t, report.Snapshots, 2)
+	for _, snap := range report.Snapshots {
+		assert.False(t, snap.Time.IsZero())
+	}
+	assert.Greater(t, report.Snapshots[0].Seq, snapshot.Seq)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+const (
+	// defaultLocalClusterNodes is the size of a LocalCluster when Nodes is not set.
+	defaultLocalClusterNodes = 3
+	// defaultLocalClusterPort is the port of the first node of a LocalCluster when BasePort is
+	// not set.
+	defaultLocalClusterPort = 4000
+)
+
+// LocalClusterOpts configures a LocalCluster.
+type LocalClusterOpts struct {
+	Nodes     int                               // Number of nodes, defaults to 3
+	Dir       string                            // Directory the storage root of every node is made in
+	BasePort  int                               // Port of the first node on 127.0.0.1, the others listening on the ports after it; defaults to 4000
+	Network   *p2p.MemoryNetwork                // Connects the nodes within the process when set, over TCP otherwise
+	Configure func(i int, opts *FileServerOpts) // Optional hook adjusting the options of node i before it is made
+}
+
+// LocalCluster runs several nodes in one process, each bootstrapping from the nodes before it,
+// for examples and tests of code built on the server.
+type LocalCluster struct {
+	Nodes   []*FileServer // Nodes in the order they were made
+	stopped []chan error  // Receives what Start of each node returned
+}
+
+// NewLocalCluster makes the nodes of a cluster, with their storage roots in opts.Dir and their
+// transports wired to them, without starting them.
+func NewLocalCluster(opts LocalClusterOpts) *LocalCluster {
+	n := opts.Nodes
+	if n <= 0 {
+		n = defaultLocalClusterNodes
+	}
+	port := opts.BasePort
+	if port <= 0 {
+		port = defaultLocalClusterPort
+	}
+	c := &LocalCluster{}
+	var addrs []string
+	for i := range n {
+		addr := "127.0.0.1:" + strconv.Itoa(port+i)
+		trOpts := p2p.TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: p2p.NOPHandshakeFunc,
+			Decoder:       p2p.DefaultDecoder{},
+		}
+		var tr *p2p.TCPTransport
+		if opts.Network != nil {
+			tr = opts.Network.Transport(trOpts)
+		} else {
+			tr = p2p.NewTCPTransport(trOpts)
+		}
+		nodeOpts := FileServerOpts{
+			EncKey:            crypto.NewEncryptionKey(),
+			StorageRoot:       filepath.Join(opts.Dir, "node"+strconv.Itoa(i)),
+			PathTransformFunc: storage.CASPathTransformFuncSHA256,
+			Transport:         tr,
+			BootstrapNodes:    append([]string(nil), addrs...),
+		}
+		if opts.Configure != nil {
+			opts.Configure(i, &nodeOpts)
+		}
+		s := NewFileServer(nodeOpts)
+		tr.HandshakeFunc = s.Handshake
+		tr.OnNode = s.OnNode
+		tr.OnNodeClosed = s.OnNodeClosed
+		c.Nodes = append(c.Nodes, s)
+		addrs = append(addrs, addr)
+	}
+	return c
+}
+
+// Start starts every node and waits until each is connected to all the others.
+//
+// Returns: An error if a node failed to start or the nodes were not all connected within
+// timeout; the nodes started are stopped first.
+func (c *LocalCluster) Start(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, s := range c.Nodes {
+		stopped := make(chan error, 1)
+		c.stopped = append(c.stopped, stopped)
+		go func() {
+			stopped <- s.Start()
+		}()
+		select {
+		case <-s.Ready():
+		case err := <-stopped:
+			c.stopped = c.stopped[:len(c.stopped)-1]
+			return errors.Join(fmt.Errorf("starting node at %s: %w", s.Transport.Addr(), err), c.Stop())
+		case <-time.After(time.Until(deadline)):
+			return errors.Join(fmt.Errorf("node at %s did not start within %s", s.Transport.Addr(), timeout), c.Stop())
+		}
+	}
+	for _, s := range c.Nodes {
+		for len(s.peerList()) < len(c.Nodes)-1 {
+			if time.Now().After(deadline) {
+				return errors.Join(fmt.Errorf("node at %s connected to %d of %d peers within %s", s.Transport.Addr(), len(s.peerList()), len(c.Nodes)-1, timeout), c.Stop())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// Stop stops every node started and waits for it to shut down.
+//
+// Returns: What the Start of every node returned, joined.
+func (c *LocalCluster) Stop() error {
+	for _, s := range c.Nodes {
+		s.Stop()
+	}
+	var errs []error
+	for i, stopped := range c.stopped {
+		if err := <-stopped; err != nil {
+			errs = append(errs, fmt.Errorf("node at %s: %w", c.Nodes[i].Transport.Addr(), err))
+		}
+	}
+	c.stopped = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalCluster(t *testing.T) {
+	var configured []int
+	c := NewLocalCluster(LocalClusterOpts{
+		Dir:       t.TempDir(),
+		Network:   p2p.NewMemoryNetwork(1),
+		BasePort:  5000,
+		Configure: func(i int, _ *FileServerOpts) { configured = append(configured, i) },
+	})
+	require.Len(t, c.Nodes, 3)
+	assert.Equal(t, []int{0, 1, 2}, configured)
+	assert.Equal(t, []string{"127.0.0.1:5000", "127.0.0.1:5001"}, c.Nodes[2].BootstrapNodes)
+	require.NoError(t, c.Start(10*time.Second))
+	for _, s := range c.Nodes {
+		assert.Len(t, s.peerList(), 2, s.Transport.Addr())
+	}
+
+	s := c.Nodes[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.StoreDurable(ctx, "k", strings.NewReader("content"), 2)
+	require.NoError(t, err)
+	require.NoError(t, s.DropLocalCopy("k"))
+	has, err := s.Storage.Has(s.ID, "k")
+	require.NoError(t, err)
+	assert.False(t, has)
+	assert.ErrorIs(t, s.DropLocalCopy(""), ErrInvalidKey)
+
+	info, r, err := s.GetWithInfo("k")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(got))
+	assert.Equal(t, SourceRemote, info.Source.Kind)
+
+	require.NoError(t, c.Stop())
+}
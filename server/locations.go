@@ -0,0 +1,255 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// locationTimeout bounds how long Locate waits for each peer to describe its copy.
+const locationTimeout = 2 * time.Second
+
+// States of a ReplicaLocation.
+const (
+	LocationConfirmed = "confirmed" // The node reported holding a copy
+	LocationExpected  = "expected"  // Placement puts a copy on the node, which could not be asked
+	LocationAbsent    = "absent"    // The node reported holding no copy
+)
+
+// MessageLocate asks a peer to describe its copy of an object, for Locate.
+type MessageLocate struct {
+	ID  string // Identifier of the node owning the object
+	Key string // Hashed key of the object
+}
+
+// locationAnswer is sent in answer to MessageLocate.
+type locationAnswer struct {
+	Held     bool      // Whether the node holds a copy
+	Checksum string    // Recorded checksum of the copy
+	Version  uint64    // Version of the copy, zero when its key is not versioned
+	Size     int64     // Bytes of the copy on disk
+	ModTime  time.Time // When the copy was written
+	Verified time.Time // When the copy was last found intact, zero if not since it was written
+	Err      string    // Why the copy could not be described
+}
+
+// ReplicaLocation describes where one copy of an object is, or should be.
+type ReplicaLocation struct {
+	Node     string    `json:"node"`               // ID of the node
+	Addr     string    `json:"addr,omitempty"`     // Address of the node, if connected or a bootstrap node
+	State    string    `json:"state"`              // One of the Location constants
+	Owner    bool      `json:"owner,omitempty"`    // Whether the node owns the object, holding its plaintext
+	Placed   bool      `json:"placed"`             // Whether placement puts a copy on the node
+	Stale    bool      `json:"stale,omitempty"`    // Whether the replica is older than, or differs from, the newest one
+	Checksum string    `json:"checksum,omitempty"` // Recorded checksum of the copy
+	Version  uint64    `json:"version,omitempty"`  // Version of the copy, zero when its key is not versioned
+	Size     int64     `json:"size,omitempty"`     // Bytes of the copy on disk
+	ModTime  time.Time `json:"mod_time,omitempty"` // When the copy was written
+	Verified time.Time `json:"verified,omitempty"` // When the copy was last found intact, zero if not since it was written
+	Detail   string    `json:"detail,omitempty"`   // Why an expected copy could not be confirmed
+}
+
+// describeCopy describes this node's copy of the object of owner id stored under key.
+func (s *FileServer) describeCopy(id string, key string) locationAnswer {
+	meta, err := s.Storage.Stat(id, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return locationAnswer{}
+	}
+	if err != nil {
+		return locationAnswer{Err: err.Error()}
+	}
+	answer := locationAnswer{Held: true, Checksum: meta.Checksum, Version: meta.Version, Size: meta.Size, ModTime: meta.ModTime}
+	if !meta.Verified.Before(meta.ModTime) {
+		answer.Verified = meta.Verified
+	}
+	return answer
+}
+
+// handleMessageLocate answers a MessageLocate with a description of this node's copy. A
+// request that could not be answered still gets a response, so the requester's connection
+// stays in sync.
+func (s *FileServer) handleMessageLocate(from string, q query, msg MessageLocate) error {
+	return s.sendValue(from, q, s.describeCopy(msg.ID, msg.Key))
+}
+
+// Locate reports which nodes hold one of this node's objects, and which should. It combines
+// what this node knows, its own copy and where the object's pins or replication policy place
+// it, with what the peers holding it say: the peers it is placed on are asked first, and the
+// other peers too when some of those do not confirm a copy, as the object may have been
+// replicated elsewhere since.
+//
+// Every node placement expects a copy on is reported, as confirmed, absent or, when it could
+// not be asked, expected; other nodes only when they hold a copy. Replicas older than, or
+// differing from, the newest one are marked stale.
+//
+// Parameters:
+//   - key: Key the object was stored under on this node.
+//
+// Returns: The locations, this node's first, then by state and node ID, and an error wrapping
+// ErrKeyNotFound if no node confirmed a copy.
+func (s *FileServer) Locate(key string) ([]ReplicaLocation, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	hashedKey := crypto.HashKey(key)
+	own := s.describeCopy(s.ID, key)
+	if len(own.Err) > 0 {
+		return nil, fmt.Errorf("describing the local copy of (%s): %s", key, own.Err)
+	}
+	locations := []ReplicaLocation{location(ReplicaLocation{Node: s.ID, Addr: s.Transport.Addr(), Owner: true, Placed: true}, own)}
+
+	connected, offline := s.nodesByID()
+	placed := s.placement(key, s.peerList())
+	var placedIDs []string
+	if pinned := s.pins.nodes(objectRef{owner: s.ID, key: hashedKey}); pinned != nil {
+		placedIDs = pinned
+	} else if ids, ok := s.policyPlacement(key); ok {
+		placedIDs = ids
+	} else {
+		// Nothing limits the replicas, so every node taking them should hold one.
+		for _, peer := range placed {
+			placedIDs = append(placedIDs, peerPlacementNode(peer).id)
+		}
+		for id := range offline {
+			placedIDs = append(placedIDs, id)
+		}
+	}
+	asked := make(map[string]bool)
+	ask := func(peers []p2p.Node) {
+		found := s.askLocations(peers, hashedKey)
+		for _, peer := range peers {
+			id := peerPlacementNode(peer).id
+			asked[id] = true
+			loc := found[id]
+			loc.Placed = slices.Contains(placedIDs, id)
+			if loc.State == LocationConfirmed || loc.Placed {
+				locations = append(locations, loc)
+			}
+		}
+	}
+	ask(placed)
+	confirmed := 0
+	for _, loc := range locations[1:] {
+		if loc.State == LocationConfirmed {
+			confirmed++
+		}
+	}
+	if confirmed < len(placedIDs) {
+		var others []p2p.Node
+		for _, peer := range s.peerList() {
+			if !asked[peerPlacementNode(peer).id] {
+				others = append(others, peer)
+			}
+		}
+		ask(others)
+	}
+	for _, id := range placedIDs {
+		if asked[id] || id == s.ID {
+			continue
+		}
+		loc := ReplicaLocation{Node: id, State: LocationExpected, Placed: true, Detail: "not connected"}
+		if addr, ok := offline[id]; ok {
+			loc.Addr = addr
+		} else if peer, ok := connected[id]; ok {
+			loc.Addr, loc.Detail = peer.RemoteAddr().String(), "takes no replicas"
+		}
+		locations = append(locations, loc)
+	}
+
+	markStale(locations)
+	rank := map[string]int{LocationConfirmed: 0, LocationExpected: 1, LocationAbsent: 2}
+	others := locations[1:]
+	sort.SliceStable(others, func(i, j int) bool {
+		if rank[others[i].State] != rank[others[j].State] {
+			return rank[others[i].State] < rank[others[j].State]
+		}
+		return others[i].Node < others[j].Node
+	})
+	if !slices.ContainsFunc(locations, func(loc ReplicaLocation) bool { return loc.State == LocationConfirmed }) {
+		return locations, fmt.Errorf("locating (%s): %w", key, ErrKeyNotFound)
+	}
+	return locations, nil
+}
+
+// askLocations sends MessageLocate to every peer at once. Peers predating it, and those that do
+// not answer, are reported as expected with the reason.
+//
+// Returns: The location reported by each peer, keyed by node ID.
+func (s *FileServer) askLocations(peers []p2p.Node, hashedKey string) map[string]ReplicaLocation {
+	found := make(map[string]ReplicaLocation, len(peers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		loc := ReplicaLocation{Node: peerPlacementNode(peer).id, Addr: peer.RemoteAddr().String()}
+		if !s.capsOf(peer).locate {
+			loc.State, loc.Detail = LocationExpected, "the node does not support locating replicas"
+			mu.Lock()
+			found[loc.Node] = loc
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var answer locationAnswer
+			err := s.exchange(peer, &Message{Payload: MessageLocate{ID: s.ID, Key: hashedKey}}, &answer, locationTimeout)
+			if err == nil && len(answer.Err) > 0 {
+				err = newRemoteError(answer.Err)
+			}
+			if err != nil {
+				loc.State, loc.Detail = LocationExpected, err.Error()
+			} else {
+				loc = location(loc, answer)
+			}
+			mu.Lock()
+			found[loc.Node] = loc
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return found
+}
+
+// location fills in loc from a node's description of its copy.
+func location(loc ReplicaLocation, answer locationAnswer) ReplicaLocation {
+	if !answer.Held {
+		loc.State = LocationAbsent
+		return loc
+	}
+	loc.State = LocationConfirmed
+	loc.Checksum, loc.Version, loc.Size = answer.Checksum, answer.Version, answer.Size
+	loc.ModTime, loc.Verified = answer.ModTime, answer.Verified
+	return loc
+}
+
+// markStale marks the confirmed replicas that differ from the newest one, by version then write
+// time, or that are of an older version than the owner's copy. Owners hold the plaintext, so
+// their checksum is not compared with the replicas'.
+func markStale(locations []ReplicaLocation) {
+	var owner, newest *ReplicaLocation
+	for i, loc := range locations {
+		switch {
+		case loc.State != LocationConfirmed:
+		case loc.Owner:
+			owner = &locations[i]
+		case newest == nil || loc.Version > newest.Version || loc.Version == newest.Version && loc.ModTime.After(newest.ModTime):
+			newest = &locations[i]
+		}
+	}
+	if newest == nil {
+		return
+	}
+	for i, loc := range locations {
+		if loc.State == LocationConfirmed && !loc.Owner {
+			locations[i].Stale = loc.Checksum != newest.Checksum || loc.Version != newest.Version ||
+				owner != nil && loc.Version < owner.Version
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocate(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.VersionedPrefixes = []string{""}
+	nodes := []*FileServer{a}
+	for i := 1; i <= 5; i++ {
+		nodes = append(nodes, makeMemoryServer(t, network, fmt.Sprintf(":400%d", i), ":4000"))
+	}
+	b, c, d, e, f := nodes[1], nodes[2], nodes[3], nodes[4], nodes[5]
+	actAs(f, supportedCaps&^p2p.CapLocate)
+	startCluster(t, nodes...)
+	waitFor(t, func() bool { return len(a.peerList()) == 5 })
+
+	key, hashedKey := "ledger", crypto.HashKey("ledger")
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("balance"))))
+	waitFor(t, func() bool { return replicaCount(a, key, b, c, d, e, f) == 5 })
+	// b and c hold the replica, b having verified it; d holds a stale copy, e lost its copy and
+	// f predates Locate.
+	require.NoError(t, b.Storage.Verify(a.ID, hashedKey))
+	_, err := d.Storage.Write(a.ID, hashedKey, bytes.NewReader([]byte("stale")))
+	require.NoError(t, err)
+	require.NoError(t, e.Storage.Delete(a.ID, hashedKey))
+
+	locations, err := a.Locate(key)
+	require.NoError(t, err)
+	require.Len(t, locations, 6)
+	assert.Equal(t, a.ID, locations[0].Node)
+	assert.True(t, locations[0].Owner)
+	assert.Equal(t, LocationConfirmed, locations[0].State)
+	byNode := make(map[string]ReplicaLocation)
+	for _, loc := range locations {
+		byNode[loc.Node] = loc
+		assert.True(t, loc.Placed, loc.Node)
+	}
+	for _, s := range []*FileServer{b, c} {
+		loc := byNode[s.ID]
+		assert.Equal(t, LocationConfirmed, loc.State)
+		assert.False(t, loc.Stale)
+		assert.Equal(t, uint64(1), loc.Version)
+		assert.NotEmpty(t, loc.Checksum)
+		assert.NotZero(t, loc.Size)
+	}
+	assert.Equal(t, byNode[b.ID].Checksum, byNode[c.ID].Checksum)
+	assert.False(t, byNode[b.ID].Verified.IsZero(), "b verified its replica")
+	assert.True(t, byNode[c.ID].Verified.IsZero())
+	assert.Equal(t, LocationConfirmed, byNode[d.ID].State)
+	assert.True(t, byNode[d.ID].Stale, "d holds an older version")
+	assert.Equal(t, LocationAbsent, byNode[e.ID].State)
+	assert.Equal(t, LocationExpected, byNode[f.ID].State)
+	assert.Contains(t, byNode[f.ID].Detail, "does not support")
+	var states []string
+	for _, loc := range locations[1:] {
+		states = append(states, loc.State)
+	}
+	assert.Equal(t, []string{LocationConfirmed, LocationConfirmed, LocationConfirmed, LocationExpected, LocationAbsent}, states)
+
+	_, err = a.Locate("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = a.Locate("")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestLocatePinned(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	require.NoError(t, a.Store("ledger", bytes.NewReader([]byte("balance"))))
+	waitFor(t, func() bool { return replicaCount(a, "ledger", b, c) == 2 })
+	require.NoError(t, a.Pin("ledger", []string{b.ID}))
+
+	// Only b is placed on, so c is not asked while b confirms its copy.
+	locations, err := a.Locate("ledger")
+	require.NoError(t, err)
+	require.Len(t, locations, 2)
+	assert.Equal(t, b.ID, locations[1].Node)
+	assert.Equal(t, LocationConfirmed, locations[1].State)
+
+	// Once b loses its copy, the other peers are asked too and c's copy is found.
+	require.NoError(t, b.Storage.Delete(a.ID, crypto.HashKey("ledger")))
+	locations, err = a.Locate("ledger")
+	require.NoError(t, err)
+	require.Len(t, locations, 3)
+	assert.Equal(t, c.ID, locations[1].Node)
+	assert.Equal(t, LocationConfirmed, locations[1].State)
+	assert.False(t, locations[1].Placed)
+	assert.Equal(t, b.ID, locations[2].Node)
+	assert.Equal(t, LocationAbsent, locations[2].State)
+	assert.True(t, locations[2].Placed)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// Resource classes of maintenance jobs. At most MaintenanceConcurrency jobs of each class run
+// at once.
+const (
+	ClassDiskRead  = "disk-read"  // Jobs mostly reading the local disk
+	ClassDiskWrite = "disk-write" // Jobs mostly writing to, or removing from, the local disk
+	ClassNetwork   = "network"    // Jobs mostly talking to peers
+)
+
+// maintenanceJitter is the largest fraction of its interval a run of a job is delayed by, so
+// nodes started together do not run their maintenance at the same moments.
+const maintenanceJitter = 0.1
+
+// MaintenanceJob is a background job the node runs periodically, under the limits of its
+// resource class.
+type MaintenanceJob struct {
+	Name     string        // Unique name of the job, such as "gc"
+	Interval time.Duration // Time from the end of one run to the start of the next, before jitter
+	Priority int           // Jobs falling due together start in decreasing priority
+	Class    string        // One of the Class constants
+	Run      func()        // Runs the job once; a panic is logged and the job rescheduled
+}
+
+// MaintenanceJobStatus describes a maintenance job and its runs.
+type MaintenanceJobStatus struct {
+	Name         string        `json:"name"`
+	Class        string        `json:"class"`
+	Priority     int           `json:"priority"`
+	Interval     time.Duration `json:"interval"`
+	Running      bool          `json:"running"`                 // Whether the job is running now
+	LastRun      time.Time     `json:"last_run,omitempty"`      // When the last run started, zero if it never ran
+	LastDuration time.Duration `json:"last_duration,omitempty"` // How long the last run took
+	NextRun      time.Time     `json:"next_run,omitempty"`      // When the job falls due next, zero while it runs
+	Runs         int64         `json:"runs"`                    // Runs finished, panics included
+	Panics       int64         `json:"panics,omitempty"`        // Runs that panicked
+	LastPanic    string        `json:"last_panic,omitempty"`    // What the last panicking run panicked with
+}
+
+// MaintenanceStatus describes the node's maintenance jobs.
+type MaintenanceStatus struct {
+	Paused bool                   `json:"paused"` // Whether jobs falling due are held back by PauseMaintenance
+	Jobs   []MaintenanceJobStatus `json:"jobs"`   // Every registered job, by name
+}
+
+// maintenanceJob is a registered job and its state.
+type maintenanceJob struct {
+	MaintenanceJob
+	status MaintenanceJobStatus
+}
+
+// maintenance schedules the maintenance jobs of a node: each runs once per interval, give or
+// take its jitter, and no more than limit jobs of one class run at once. Jobs falling due
+// while their class is full, or maintenance is paused, wait until a slot frees up.
+type maintenance struct {
+	clock   clock.Clock
+	limit   int                                        // Jobs of one class run at once
+	jitter  func(interval time.Duration) time.Duration // Delay added to each scheduled run
+	mu      sync.Mutex
+	jobs    []*maintenanceJob
+	running map[string]int // Running jobs per class
+	paused  bool
+	wake    chan struct{} // Signalled when a job may have become startable
+}
+
+// newMaintenance returns a scheduler running at most limit jobs of each class at once.
+func newMaintenance(clk clock.Clock, limit int) *maintenance {
+	return &maintenance{
+		clock: clk,
+		limit: max(limit, 1),
+		jitter: func(d time.Duration) time.Duration {
+			return time.Duration(mrand.Float64() * maintenanceJitter * float64(d))
+		},
+		running: make(map[string]int),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// register adds a job, first due one interval, plus jitter, from now.
+func (m *maintenance) register(job MaintenanceJob) error {
+	if len(job.Name) == 0 || job.Interval <= 0 || job.Run == nil {
+		return fmt.Errorf("maintenance job %q needs a name, a positive interval and a function", job.Name)
+	}
+	if !slices.Contains([]string{ClassDiskRead, ClassDiskWrite, ClassNetwork}, job.Class) {
+		return fmt.Errorf("maintenance job %q has unknown resource class %q", job.Name, job.Class)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slices.ContainsFunc(m.jobs, func(j *maintenanceJob) bool { return j.Name == job.Name }) {
+		return fmt.Errorf("maintenance job %q is already registered", job.Name)
+	}
+	j := &maintenanceJob{MaintenanceJob: job, status: MaintenanceJobStatus{Name: job.Name, Class: job.Class, Priority: job.Priority, Interval: job.Interval}}
+	j.status.NextRun = m.clock.Now().Add(job.Interval + m.jitter(job.Interval))
+	m.jobs = append(m.jobs, j)
+	m.signal()
+	return nil
+}
+
+// signal wakes run up to start the jobs that can start.
+func (m *maintenance) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts jobs as they fall due until quit is closed. Jobs running then finish on their own.
+func (m *maintenance) run(quit <-chan struct{}) {
+	timer := m.clock.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		timer.Stop()
+		if wait, ok := m.startDue(); ok {
+			timer.Reset(wait)
+		}
+		select {
+		case <-timer.C():
+		case <-m.wake:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// startDue starts the jobs that are due, in decreasing priority, as far as their classes allow.
+//
+// Returns: The time until the next job falls due and true, or false if none is waiting for
+// its time rather than for a slot or a resume.
+func (m *maintenance) startDue() (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused {
+		return 0, false
+	}
+	now := m.clock.Now()
+	var due []*maintenanceJob
+	var next time.Time
+	for _, j := range m.jobs {
+		switch {
+		case j.status.Running:
+		case !j.status.NextRun.After(now):
+			due = append(due, j)
+		case next.IsZero() || j.status.NextRun.Before(next):
+			next = j.status.NextRun
+		}
+	}
+	sort.SliceStable(due, func(a, b int) bool {
+		if due[a].Priority != due[b].Priority {
+			return due[a].Priority > due[b].Priority
+		}
+		return due[a].status.NextRun.Before(due[b].status.NextRun)
+	})
+	for _, j := range due {
+		if m.running[j.Class] >= m.limit {
+			continue
+		}
+		m.running[j.Class]++
+		j.status.Running, j.status.NextRun = true, time.Time{}
+		go m.execute(j)
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	return next.Sub(now), true
+}
+
+// execute runs a job once and schedules its next run from when it ended.
+func (m *maintenance) execute(j *maintenanceJob) {
+	start := m.clock.Now()
+	panicked, ok := m.call(j)
+	end := m.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running[j.Class]--
+	j.status.Running = false
+	j.status.LastRun, j.status.LastDuration = start, end.Sub(start)
+	j.status.NextRun = end.Add(j.Interval + m.jitter(j.Interval))
+	j.status.Runs++
+	if !ok {
+		j.status.Panics++
+		j.status.LastPanic = panicked
+	}
+	m.signal()
+}
+
+// call runs a job, recovering from its panic.
+//
+// Returns: What the job panicked with, and false if it panicked.
+func (m *maintenance) call(j *maintenanceJob) (panicked string, ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			panicked = fmt.Sprint(v)
+			log.Printf("maintenance job %s panicked, rescheduling it: %s\n%s", j.Name, panicked, debug.Stack())
+		}
+	}()
+	j.Run()
+	return "", true
+}
+
+// setPaused holds back, or lets through again, the jobs falling due.
+func (m *maintenance) setPaused(paused bool) {
+	m.mu.Lock()
+	m.paused = paused
+	m.mu.Unlock()
+	m.signal()
+}
+
+// status describes the scheduler and its jobs.
+func (m *maintenance) status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := MaintenanceStatus{Paused: m.paused, Jobs: make([]MaintenanceJobStatus, 0, len(m.jobs))}
+	for _, j := range m.jobs {
+		status.Jobs = append(status.Jobs, j.status)
+	}
+	sort.Slice(status.Jobs, func(a, b int) bool { return status.Jobs[a].Name < status.Jobs[b].Name })
+	return status
+}
+
+// RegisterMaintenance adds a job to the node's maintenance, first due one interval from now.
+// Jobs can be registered before or after Start.
+//
+// Returns: An error if the job has no name, function or positive interval, has an unknown
+// class, or its name is taken.
+func (s *FileServer) RegisterMaintenance(job MaintenanceJob) error {
+	return s.maintenance.register(job)
+}
+
+// PauseMaintenance holds back the maintenance jobs falling due, such as for a window where
+// latency matters, until ResumeMaintenance. Jobs already running finish.
+func (s *FileServer) PauseMaintenance() {
+	s.maintenance.setPaused(true)
+	log.Printf("[%s] maintenance paused", s.Transport.Addr())
+}
+
+// ResumeMaintenance lets the maintenance jobs held back by PauseMaintenance run, starting
+// those that fell due meanwhile.
+func (s *FileServer) ResumeMaintenance() {
+	s.maintenance.setPaused(false)
+	log.Printf("[%s] maintenance resumed", s.Transport.Addr())
+}
+
+// MaintenanceStatus describes the node's maintenance jobs: when each last ran, for how long,
+// and when it falls due next.
+func (s *FileServer) MaintenanceStatus() MaintenanceStatus {
+	return s.maintenance.status()
+}
+
+// registerMaintenance registers the built-in maintenance jobs enabled by the options.
+func (s *FileServer) registerMaintenance() error {
+	var jobs []MaintenanceJob
+	if s.GCInterval > 0 {
+		jobs = append(jobs, MaintenanceJob{Name: "gc", Interval: s.GCInterval, Class: ClassDiskWrite, Run: func() { s.GC() }})
+	}
+	if s.TrashRetention > 0 {
+		jobs = append(jobs, MaintenanceJob{Name: "trash-purge", Interval: s.TrashPurgeInterval, Priority: 1, Class: ClassDiskWrite, Run: func() { s.PurgeTrash() }})
+	}
+	if s.ChallengeInterval > 0 {
+		jobs = append(jobs, MaintenanceJob{Name: "challenges", Interval: s.ChallengeInterval, Class: ClassNetwork, Run: func() {
+			if rate := s.challengeSampleRate(); rate > 0 {
+				s.ChallengeReplicas(rate)
+			}
+		}})
+	}
+	if s.DegradedCheckInterval > 0 {
+		jobs = append(jobs, MaintenanceJob{Name: "degraded-check", Interval: s.DegradedCheckInterval, Priority: 1, Class: ClassNetwork, Run: s.checkDegradedPeers})
+	}
+	for _, job := range jobs {
+		if err := s.maintenance.register(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMaintenance returns a scheduler on a fake clock, without jitter, running until the
+// test ends.
+func newTestMaintenance(t *testing.T, limit int) (*maintenance, *clock.Fake) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	m := newMaintenance(clk, limit)
+	m.jitter = func(time.Duration) time.Duration { return 0 }
+	quit := make(chan struct{})
+	go m.run(quit)
+	t.Cleanup(func() { close(quit) })
+	return m, clk
+}
+
+// blockingJob is a maintenance job that records when it starts and runs until released.
+type blockingJob struct {
+	started chan string
+	release chan struct{}
+	running atomic.Int32
+	most    atomic.Int32
+}
+
+func newBlockingJob() *blockingJob {
+	return &blockingJob{started: make(chan string, 16), release: make(chan struct{})}
+}
+
+func (b *blockingJob) job(name string, class string, priority int) MaintenanceJob {
+	return MaintenanceJob{Name: name, Interval: time.Minute, Priority: priority, Class: class, Run: func() {
+		n := b.running.Add(1)
+		for {
+			most := b.most.Load()
+			if n <= most || b.most.CompareAndSwap(most, n) {
+				break
+			}
+		}
+		b.started <- name
+		<-b.release
+		b.running.Add(-1)
+	}}
+}
+
+func jobStatus(m *maintenance, name string) MaintenanceJobStatus {
+	for _, job := range m.status().Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return MaintenanceJobStatus{}
+}
+
+func TestMaintenanceLimitsJobsPerClass(t *testing.T) {
+	m, clk := newTestMaintenance(t, 1)
+	writes, network := newBlockingJob(), newBlockingJob()
+	require.NoError(t, m.register(writes.job("gc", ClassDiskWrite, 0)))
+	require.NoError(t, m.register(writes.job("trash-purge", ClassDiskWrite, 1)))
+	require.NoError(t, m.register(network.job("challenges", ClassNetwork, 0)))
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+
+	// The job of higher priority takes the only disk-write slot; the network job runs alongside.
+	assert.Equal(t, "trash-purge", <-writes.started)
+	assert.Equal(t, "challenges", <-network.started)
+	assert.Never(t, func() bool { return len(writes.started) > 0 }, 50*time.Millisecond, 5*time.Millisecond)
+	assert.True(t, jobStatus(m, "trash-purge").Running)
+	assert.False(t, jobStatus(m, "gc").Running)
+
+	// Once the slot frees up, the waiting job starts.
+	writes.release <- struct{}{}
+	assert.Equal(t, "gc", <-writes.started)
+	close(writes.release)
+	close(network.release)
+	assert.Equal(t, int32(1), writes.most.Load(), "disk-write jobs should never run together")
+	require.Eventually(t, func() bool { return jobStatus(m, "gc").Runs == 1 }, time.Second, 5*time.Millisecond)
+	purge := jobStatus(m, "trash-purge")
+	assert.Equal(t, int64(1), purge.Runs)
+	assert.Equal(t, time.Unix(0, 0).Add(time.Minute), purge.LastRun)
+	assert.Equal(t, purge.LastRun.Add(time.Minute), purge.NextRun)
+}
+
+func TestMaintenancePauseAndResume(t *testing.T) {
+	m, clk := newTestMaintenance(t, 1)
+	var runs atomic.Int32
+	require.NoError(t, m.register(MaintenanceJob{Name: "gc", Interval: time.Minute, Class: ClassDiskWrite, Run: func() { runs.Add(1) }}))
+	clk.BlockUntil(1)
+	m.setPaused(true)
+	require.Eventually(t, func() bool { return m.status().Paused }, time.Second, 5*time.Millisecond)
+	clk.Advance(3 * time.Minute)
+	assert.Never(t, func() bool { return runs.Load() > 0 }, 50*time.Millisecond, 5*time.Millisecond)
+
+	// Resuming runs the job that fell due meanwhile once, not once per interval missed.
+	m.setPaused(false)
+	require.Eventually(t, func() bool { return runs.Load() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Never(t, func() bool { return runs.Load() > 1 }, 50*time.Millisecond, 5*time.Millisecond)
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	require.Eventually(t, func() bool { return runs.Load() == 2 }, time.Second, 5*time.Millisecond)
+}
+
+func TestMaintenanceIsolatesPanickingJob(t *testing.T) {
+	m, clk := newTestMaintenance(t, 1)
+	var mu sync.Mutex
+	calls := 0
+	require.NoError(t, m.register(MaintenanceJob{Name: "flaky", Interval: time.Minute, Class: ClassDiskRead, Run: func() {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			panic("disk on fire")
+		}
+	}}))
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	require.Eventually(t, func() bool { return jobStatus(m, "flaky").Runs == 1 }, time.Second, 5*time.Millisecond)
+	status := jobStatus(m, "flaky")
+	assert.Equal(t, int64(1), status.Panics)
+	assert.Equal(t, "disk on fire", status.LastPanic)
+	assert.False(t, status.Running)
+	assert.Equal(t, clk.Now().Add(time.Minute), status.NextRun, "a panicking job is rescheduled")
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	require.Eventually(t, func() bool { return jobStatus(m, "flaky").Runs == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(1), jobStatus(m, "flaky").Panics)
+}
+
+func TestMaintenanceRegistration(t *testing.T) {
+	m := newMaintenance(clock.NewFake(time.Unix(0, 0)), 0)
+	run := func() {}
+	require.NoError(t, m.register(MaintenanceJob{Name: "gc", Interval: time.Minute, Class: ClassDiskWrite, Run: run}))
+	assert.Error(t, m.register(MaintenanceJob{Name: "gc", Interval: time.Minute, Class: ClassDiskWrite, Run: run}), "names are unique")
+	assert.Error(t, m.register(MaintenanceJob{Name: "scan", Interval: time.Minute, Class: "cpu", Run: run}))
+	assert.Error(t, m.register(MaintenanceJob{Name: "scan", Class: ClassDiskRead, Run: run}))
+	assert.Error(t, m.register(MaintenanceJob{Name: "scan", Interval: time.Minute, Class: ClassDiskRead}))
+
+	// Jitter delays the first run by up to a tenth of the interval.
+	for i := range 20 {
+		m := newMaintenance(clock.NewFake(time.Unix(0, 0)), 1)
+		require.NoError(t, m.register(MaintenanceJob{Name: "gc", Interval: time.Minute, Class: ClassDiskWrite, Run: run}), i)
+		next := jobStatus(m, "gc").NextRun.Sub(time.Unix(0, 0))
+		assert.GreaterOrEqual(t, next, time.Minute)
+		assert.Less(t, next, time.Minute+6*time.Second)
+	}
+}
+
+func TestServerMaintenanceJobs(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	s := makeMemoryServer(t, network, ":4000")
+	s.GCInterval, s.ChallengeInterval = time.Hour, time.Hour
+	s.TrashRetention, s.DegradedCheckInterval = 0, 0
+	startCluster(t, s, makeMemoryServer(t, network, ":4001", ":4000"))
+	status := s.MaintenanceStatus()
+	var names []string
+	for _, job := range status.Jobs {
+		names = append(names, job.Name)
+	}
+	assert.Equal(t, []string{"challenges", "gc"}, names)
+	assert.Error(t, s.RegisterMaintenance(MaintenanceJob{Name: "gc", Interval: time.Minute, Class: ClassDiskWrite, Run: func() {}}))
+
+	s.PauseMaintenance()
+	metrics := s.Metrics()
+	assert.Equal(t, int64(1), metrics["maintenance_paused"])
+	assert.Contains(t, metrics, "maintenance_gc_next_run_unix")
+	assert.Contains(t, metrics, "maintenance_challenges_last_duration_ms")
+	s.ResumeMaintenance()
+	assert.False(t, s.MaintenanceStatus().Paused)
+}
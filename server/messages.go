@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// MessageType is the tag identifying the payload type of a Message on the wire. Tags are
+// never reused or renumbered, so peers of different versions agree on what each one means.
+type MessageType uint16
+
+// Tags of the built-in message types.
+const (
+	MessageTypeStoreFile       MessageType = 1
+	MessageTypeGetFile         MessageType = 2
+	MessageTypeStoreFileInline MessageType = 3
+	MessageTypeGetRange        MessageType = 4
+	MessageTypeStoreAck        MessageType = 5
+	MessageTypeStoreBatch      MessageType = 6
+	MessageTypeGetBatch        MessageType = 7
+	MessageTypeSyncTree        MessageType = 8
+	MessageTypeSyncKeys        MessageType = 9
+	MessageTypeNodeInfo        MessageType = 10
+	MessageTypeSubscribe       MessageType = 11
+	MessageTypeNotify          MessageType = 12
+	MessageTypeNotifyAck       MessageType = 13
+	MessageTypeTxPrepare       MessageType = 14
+	MessageTypeTxCommit        MessageType = 15
+	MessageTypeTxAbort         MessageType = 16
+	MessageTypeDeleteFile      MessageType = 17
+	MessageTypeRestoreFile     MessageType = 18
+	MessageTypeDeleteVersions  MessageType = 19
+	MessageTypeGetVersion      MessageType = 20
+	MessageTypeProtocolError   MessageType = 21
+	MessageTypeStoreRejected   MessageType = 22
+	MessageTypeListKeys        MessageType = 23
+	MessageTypeLeaving         MessageType = 24
+	MessageTypeMirrorList      MessageType = 25
+	MessageTypeMirrorPull      MessageType = 26
+	MessageTypeCancel          MessageType = 27
+	MessageTypeGrantKey        MessageType = 28
+	MessageTypeGrantNamespace  MessageType = 29
+	MessageTypePin             MessageType = 30
+	MessageTypeVerifyKeys      MessageType = 31
+	MessageTypeReserveKey      MessageType = 32
+	MessageTypeReserveAnswer   MessageType = 33
+	MessageTypeReleaseKey      MessageType = 34
+	MessageTypeAppendFile      MessageType = 35
+	MessageTypeAppendRejected  MessageType = 36
+	MessageTypeDeletePrefix    MessageType = 37
+	MessageTypeBatch           MessageType = 38
+	MessageTypePing            MessageType = 39
+	MessageTypePong            MessageType = 40
+	MessageTypeReliable        MessageType = 41
+	MessageTypeAck             MessageType = 42
+	MessageTypeChallenge       MessageType = 43
+	MessageTypeLease           MessageType = 44
+	MessageTypeLocate          MessageType = 45
+	MessageTypeAlias           MessageType = 46
+)
+
+// MessageTypeCustom is the first tag available to the message types of applications,
+// registered with RegisterMessage. Lower tags are reserved for built-in messages.
+const MessageTypeCustom MessageType = 1 << 15
+
+// builtinMessages is the payload type of every built-in tag.
+var builtinMessages = map[MessageType]any{
+	MessageTypeStoreFile:       MessageStoreFile{},
+	MessageTypeGetFile:         MessageGetFile{},
+	MessageTypeStoreFileInline: MessageStoreFileInline{},
+	MessageTypeGetRange:        MessageGetRange{},
+	MessageTypeStoreAck:        MessageStoreAck{},
+	MessageTypeStoreBatch:      MessageStoreBatch{},
+	MessageTypeGetBatch:        MessageGetBatch{},
+	MessageTypeSyncTree:        MessageSyncTree{},
+	MessageTypeSyncKeys:        MessageSyncKeys{},
+	MessageTypeNodeInfo:        MessageNodeInfo{},
+	MessageTypeSubscribe:       MessageSubscribe{},
+	MessageTypeNotify:          MessageNotify{},
+	MessageTypeNotifyAck:       MessageNotifyAck{},
+	MessageTypeTxPrepare:       MessageTxPrepare{},
+	MessageTypeTxCommit:        MessageTxCommit{},
+	MessageTypeTxAbort:         MessageTxAbort{},
+	MessageTypeDeleteFile:      MessageDeleteFile{},
+	MessageTypeRestoreFile:     MessageRestoreFile{},
+	MessageTypeDeleteVersions:  MessageDeleteVersions{},
+	MessageTypeGetVersion:      MessageGetVersion{},
+	MessageTypeProtocolError:   MessageProtocolError{},
+	MessageTypeStoreRejected:   MessageStoreRejected{},
+	MessageTypeListKeys:        MessageListKeys{},
+	MessageTypeLeaving:         MessageLeaving{},
+	MessageTypeMirrorList:      MessageMirrorList{},
+	MessageTypeMirrorPull:      MessageMirrorPull{},
+	MessageTypeCancel:          MessageCancel{},
+	MessageTypeGrantKey:        MessageGrantKey{},
+	MessageTypeGrantNamespace:  MessageGrantNamespace{},
+	MessageTypePin:             MessagePin{},
+	MessageTypeVerifyKeys:      MessageVerifyKeys{},
+	MessageTypeReserveKey:      MessageReserveKey{},
+	MessageTypeReserveAnswer:   MessageReserveAnswer{},
+	MessageTypeReleaseKey:      MessageReleaseKey{},
+	MessageTypeAppendFile:      MessageAppendFile{},
+	MessageTypeAppendRejected:  MessageAppendRejected{},
+	MessageTypeDeletePrefix:    MessageDeletePrefix{},
+	MessageTypeBatch:           MessageBatch{},
+	MessageTypePing:            MessagePing{},
+	MessageTypePong:            MessagePong{},
+	MessageTypeReliable:        MessageReliable{},
+	MessageTypeAck:             MessageAck{},
+	MessageTypeChallenge:       MessageChallenge{},
+	MessageTypeLease:           MessageLease{},
+	MessageTypeLocate:          MessageLocate{},
+	MessageTypeAlias:           MessageAlias{},
+}
+
+// messageCaps is the feature both ends of a connection must support for each built-in message
+// sent on it; messages missing from it need none. Nodes never send the messages of a feature
+// either end lacks, so those arriving anyway are refused.
+var messageCaps = map[MessageType]p2p.Capabilities{
+	MessageTypeStoreBatch:      p2p.CapBatch,
+	MessageTypeGetBatch:        p2p.CapBatch,
+	MessageTypeSyncTree:        p2p.CapSyncTree,
+	MessageTypeStoreFileInline: p2p.CapInline,
+	MessageTypeGetRange:        p2p.CapRangeGet,
+	MessageTypeStoreAck:        p2p.CapStoreAck,
+	MessageTypeMirrorList:      p2p.CapMirror,
+	MessageTypeMirrorPull:      p2p.CapMirror,
+	MessageTypeGrantKey:        p2p.CapNamespaceGrants,
+	MessageTypeGrantNamespace:  p2p.CapNamespaceGrants,
+	MessageTypePin:             p2p.CapPins,
+	MessageTypeVerifyKeys:      p2p.CapVerify,
+	MessageTypeReserveKey:      p2p.CapReserve,
+	MessageTypeReserveAnswer:   p2p.CapReserve,
+	MessageTypeReleaseKey:      p2p.CapReserve,
+	MessageTypeAppendFile:      p2p.CapAppend,
+	MessageTypeAppendRejected:  p2p.CapAppend,
+	MessageTypeDeletePrefix:    p2p.CapDeletePrefix,
+	MessageTypeBatch:           p2p.CapCoalesce,
+	MessageTypePing:            p2p.CapClock,
+	MessageTypePong:            p2p.CapClock,
+	MessageTypeReliable:        p2p.CapReliable,
+	MessageTypeAck:             p2p.CapReliable,
+	MessageTypeChallenge:       p2p.CapChallenge,
+	MessageTypeLease:           p2p.CapLease,
+	MessageTypeLocate:          p2p.CapLocate,
+	MessageTypeAlias:           p2p.CapAliases,
+}
+
+var (
+	// errUnknownMessageType is returned when decoding a message whose tag is not registered.
+	errUnknownMessageType = errors.New("unknown message type")
+	// errMessageRefused is returned for a message the peer may not send on its connection.
+	errMessageRefused = errors.New("message refused")
+)
+
+// messageRegistry maps tags to payload types and back.
+type messageRegistry struct {
+	mu    sync.RWMutex
+	types map[MessageType]reflect.Type // Payload type by tag
+	tags  map[reflect.Type]MessageType // Tag by payload type
+}
+
+// messages holds every registered message type.
+var messages = &messageRegistry{
+	types: make(map[MessageType]reflect.Type),
+	tags:  make(map[reflect.Type]MessageType),
+}
+
+// register records the payload type of a tag. The type is also registered with gob, as
+// peers without p2p.CapTypedMessages receive payloads as interface values.
+func (r *messageRegistry) register(tag MessageType, payload any) error {
+	typ := reflect.TypeOf(payload)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known, ok := r.types[tag]; ok {
+		return fmt.Errorf("message tag %d is already registered for %s", tag, known)
+	}
+	if known, ok := r.tags[typ]; ok {
+		return fmt.Errorf("message type %s is already registered with tag %d", typ, known)
+	}
+	r.types[tag] = typ
+	r.tags[typ] = tag
+	gob.Register(payload)
+	return nil
+}
+
+// tagOf returns the tag of a payload's type.
+func (r *messageRegistry) tagOf(payload any) (MessageType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tag, ok := r.tags[reflect.TypeOf(payload)]
+	return tag, ok
+}
+
+// typeOf returns the payload type of a tag.
+func (r *messageRegistry) typeOf(tag MessageType) (reflect.Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	typ, ok := r.types[tag]
+	return typ, ok
+}
+
+// RegisterMessage gives the message type T the tag its payloads carry on the wire, so it can
+// be sent as a Message payload and subscribed to with Subscribe. Every node exchanging T must
+// register it with the same tag, typically from an init function.
+//
+// Parameters:
+//   - tag: Tag of T, at least MessageTypeCustom.
+//
+// Returns: An error if the tag is reserved, or if the tag or T is already registered.
+func RegisterMessage[T any](tag MessageType) error {
+	if tag < MessageTypeCustom {
+		return fmt.Errorf("message tag %d is reserved for built-in messages", tag)
+	}
+	return messages.register(tag, *new(T))
+}
+
+// String returns the name of the payload type of the tag.
+func (t MessageType) String() string {
+	if typ, ok := messages.typeOf(t); ok {
+		return typ.Name()
+	}
+	return fmt.Sprintf("MessageType(%d)", uint16(t))
+}
+
+// wireMessage is a Message as it is encoded. Peers advertising p2p.CapTypedMessages are sent
+// the payload's tag and gob encoding, which decode without any interface registration; other
+// peers are sent the payload as an interface value. Both forms decode into the same struct.
+type wireMessage struct {
+	Payload   any         // Payload of peers without p2p.CapTypedMessages
+	Type      MessageType // Tag of the payload, zero for the interface form
+	Body      []byte      // Gob encoding of the payload
+	RequestID string      // Request ID of the message, which peers that predate it skip
+	ReplyID   uint64      // ID the answer to the message is routed back with, which peers that predate it skip
+}
+
+// encodeMessage encodes a message, its payload tagged when typed is set.
+//
+// Returns: The encoded message, and an error if the payload's type is not registered.
+func encodeMessage(msg *Message, typed bool) ([]byte, error) {
+	tag, ok := messages.tagOf(msg.Payload)
+	if !ok {
+		return nil, fmt.Errorf("message type %T is not registered", msg.Payload)
+	}
+	wire := wireMessage{Payload: msg.Payload, RequestID: msg.RequestID, ReplyID: msg.ReplyID}
+	if typed {
+		body := new(bytes.Buffer)
+		if err := gob.NewEncoder(body).Encode(msg.Payload); err != nil {
+			return nil, fmt.Errorf("encoding %s: %w", tag, err)
+		}
+		wire = wireMessage{Type: tag, Body: body.Bytes(), RequestID: msg.RequestID, ReplyID: msg.ReplyID}
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(wire); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// frameMessage encodes a message with encodeMessage and frames it for p2p.Node.Send.
+func frameMessage(msg *Message, typed bool) ([]byte, error) {
+	b, err := encodeMessage(msg, typed)
+	if err != nil {
+		return nil, err
+	}
+	return p2p.EncodeMessage(b)
+}
+
+// typedWireMessage is a wireMessage without the interface form's payload, which gob skips
+// over rather than instantiate when decoding into it.
+type typedWireMessage struct {
+	Type      MessageType
+	Body      []byte
+	RequestID string
+	ReplyID   uint64
+}
+
+// decodeMessage decodes a message in either form written by encodeMessage.
+//
+// Returns: The message, and an error wrapping errUnknownMessageType if its tag is not registered.
+func decodeMessage(b []byte) (Message, error) {
+	var wire wireMessage
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&wire); err != nil {
+		return Message{}, err
+	}
+	if wire.Type == 0 {
+		return Message{Payload: wire.Payload, RequestID: wire.RequestID, ReplyID: wire.ReplyID}, nil
+	}
+	return decodeTagged(wire.Type, wire.Body, wire.RequestID, wire.ReplyID)
+}
+
+// decodeTagged decodes the payload of a message in the tagged form into the type of its tag.
+func decodeTagged(tag MessageType, body []byte, rid string, reply uint64) (Message, error) {
+	typ, ok := messages.typeOf(tag)
+	if !ok {
+		return Message{}, fmt.Errorf("%w %d", errUnknownMessageType, tag)
+	}
+	payload := reflect.New(typ)
+	if err := gob.NewDecoder(bytes.NewReader(body)).DecodeValue(payload); err != nil {
+		return Message{}, fmt.Errorf("decoding %s: %w", tag, err)
+	}
+	return Message{Payload: payload.Elem().Interface(), RequestID: rid, ReplyID: reply}, nil
+}
+
+// decodeMessageFrom decodes a message a peer sent on a connection whose ends both support the
+// features common. Messages past p2p.MaxMessageSize are refused before any of their bytes are
+// decoded, and only the tagged form is accepted on connections with p2p.CapTypedMessages, so
+// its payload can only decode into the type registered for its tag rather than any type gob
+// knows. The payload must be of a registered message type whose feature the connection has.
+//
+// Returns: The message, and an error wrapping errMessageRefused or errUnknownMessageType if it
+// may not be handled, or any error decoding it.
+func decodeMessageFrom(b []byte, common p2p.Capabilities) (Message, error) {
+	if len(b) > p2p.MaxMessageSize {
+		return Message{}, fmt.Errorf("%w: %d bytes exceed the %d byte limit", errMessageRefused, len(b), p2p.MaxMessageSize)
+	}
+	if !common.Has(p2p.CapTypedMessages) {
+		msg, err := decodeMessage(b)
+		if err != nil {
+			return Message{}, err
+		}
+		return msg, checkMessageType(msg.Payload, common)
+	}
+	var wire typedWireMessage
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&wire); err != nil {
+		return Message{}, err
+	}
+	if wire.Type == 0 {
+		return Message{}, fmt.Errorf("%w: untyped payload on a connection with typed messages", errMessageRefused)
+	}
+	if err := checkTag(wire.Type, common); err != nil {
+		return Message{}, err
+	}
+	return decodeTagged(wire.Type, wire.Body, wire.RequestID, wire.ReplyID)
+}
+
+// checkMessageType checks that a payload decoded from a peer is of a registered message type
+// allowed by checkTag.
+func checkMessageType(payload any, common p2p.Capabilities) error {
+	tag, ok := messages.tagOf(payload)
+	if !ok {
+		return fmt.Errorf("%w %T", errUnknownMessageType, payload)
+	}
+	return checkTag(tag, common)
+}
+
+// checkTag checks that messages of tag may be sent on a connection whose ends both support
+// the features common.
+func checkTag(tag MessageType, common p2p.Capabilities) error {
+	if need, ok := messageCaps[tag]; ok && !common.Has(need) {
+		return fmt.Errorf("%w: %s on a connection without its feature", errMessageRefused, tag)
+	}
+	return nil
+}
+
+func init() {
+	for tag, payload := range builtinMessages {
+		if err := messages.register(tag, payload); err != nil {
+			panic(err)
+		}
+	}
+}
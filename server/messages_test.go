@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisteredMessagesRoundTrip(t *testing.T) {
+	messages.mu.RLock()
+	types := make(map[MessageType]reflect.Type, len(messages.types))
+	for tag, typ := range messages.types {
+		types[tag] = typ
+	}
+	messages.mu.RUnlock()
+	require.Len(t, builtinMessages, int(MessageTypeAlias), "every built-in tag must be registered")
+
+	for tag, typ := range types {
+		payload := reflect.New(typ).Elem().Interface()
+		for _, typed := range []bool{false, true} {
+			b, err := encodeMessage(&Message{Payload: payload}, typed)
+			require.NoError(t, err, tag)
+			got, err := decodeMessage(b)
+			require.NoError(t, err, tag)
+			assert.Equal(t, payload, got.Payload, tag)
+		}
+	}
+}
+
+func TestBuiltinMessagesHaveHandlers(t *testing.T) {
+	s := makeServer(t, ":4000")
+	for tag := range builtinMessages {
+		if tag == MessageTypeCancel {
+			continue // Handled by the receive loop, ahead of the queues
+		}
+		assert.Contains(t, s.dispatch.handlers, tag, "no handler for %s", tag)
+	}
+}
+
+func TestRegisterMessageRejectsConflicts(t *testing.T) {
+	type messageBuiltinTag struct{}
+	type messageTaken struct{}
+	assert.Error(t, RegisterMessage[messageBuiltinTag](MessageTypeStoreFile), "built-in tags are reserved")
+	assert.Error(t, RegisterMessage[messageTaken](MessageTypeCustom), "the tag of messagePing is taken")
+	assert.Error(t, RegisterMessage[messagePing](MessageTypeCustom+100), "messagePing already has a tag")
+}
+
+func TestUnregisteredMessagesAreRefused(t *testing.T) {
+	type messageUnregistered struct{}
+	for _, typed := range []bool{false, true} {
+		_, err := encodeMessage(&Message{Payload: messageUnregistered{}}, typed)
+		assert.Error(t, err)
+	}
+	s := makeServer(t, ":4000")
+	assert.Error(t, Subscribe(s, func(string, messageUnregistered) {}))
+}
+
+func TestUnknownTagGetsProtocolError(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(wireMessage{Type: MessageTypeCustom - 1}))
+	frame, err := p2p.EncodeMessage(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, a.peerList()[0].Send(frame))
+	waitFor(t, func() bool { return a.Metrics()["protocol_errors"] == 1 })
+	assert.Zero(t, b.Metrics()["protocol_errors"])
+}
+
+// messageHostile is known to gob but is no message type, so no peer may make a node decode it.
+type messageHostile struct {
+	Blob []byte
+}
+
+func init() {
+	gob.Register(messageHostile{})
+}
+
+// hostileMessages are crafted encodings a node must refuse, by what each is.
+func hostileMessages(t *testing.T) map[string][]byte {
+	t.Helper()
+	untyped := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(untyped).Encode(wireMessage{Payload: messageHostile{Blob: []byte("x")}}))
+
+	// A body of 200 bytes is counted as 0xff 0xc8; claim 2 GiB instead.
+	huge := new(bytes.Buffer)
+	body := bytes.Repeat([]byte{0xab}, 200)
+	require.NoError(t, gob.NewEncoder(huge).Encode(wireMessage{Type: MessageTypeSyncKeys, Body: body}))
+	counted := append([]byte{0xff, 0xc8}, body...)
+	require.Equal(t, 1, bytes.Count(huge.Bytes(), counted))
+	claimed := append([]byte{0xfc, 0x7f, 0xff, 0xff, 0xff}, body...)
+
+	return map[string][]byte{
+		"unregistered type": untyped.Bytes(),
+		"oversized slice":   bytes.Replace(huge.Bytes(), counted, claimed, 1),
+		"oversized frame":   make([]byte, p2p.MaxMessageSize+1),
+	}
+}
+
+func TestDecodeRefusesHostileMessages(t *testing.T) {
+	for name, b := range hostileMessages(t) {
+		for _, common := range []p2p.Capabilities{supportedCaps, supportedCaps &^ p2p.CapTypedMessages} {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := decodeMessageFrom(b, common)
+			runtime.ReadMemStats(&after)
+			assert.Error(t, err, name)
+			assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20), "%s must be refused without allocating what it claims", name)
+		}
+	}
+
+	// Messages of a feature the connection lacks are refused before their payload is decoded.
+	b, err := encodeMessage(&Message{Payload: MessageLease{Key: "k"}}, true)
+	require.NoError(t, err)
+	_, err = decodeMessageFrom(b, supportedCaps&^p2p.CapLease)
+	assert.ErrorIs(t, err, errMessageRefused)
+	_, err = decodeMessageFrom(b, supportedCaps)
+	assert.NoError(t, err)
+}
+
+// protocolErrors routes the MessageProtocolErrors s is sent through its own handler and then
+// to the returned channel, so a test waits for each rejection rather than polling the counter.
+func protocolErrors(t *testing.T, s *FileServer) <-chan MessageProtocolError {
+	ch := make(chan MessageProtocolError, 16)
+	require.NoError(t, Subscribe(s, func(from string, msg MessageProtocolError) {
+		assert.NoError(t, s.handleMessageProtocolError(from, msg))
+		ch <- msg
+	}))
+	return ch
+}
+
+// TestHostileMessagesGetProtocolErrors sends crafted messages and messages the role of a node
+// does not allow over live connections. Each is answered with a MessageProtocolError and
+// counted as malformed, and the connections keep working.
+func TestHostileMessagesGetProtocolErrors(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	c.NoListen = true
+	aErrs, cErrs := protocolErrors(t, a), protocolErrors(t, c)
+	startCluster(t, a, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(c.peerList()) == 1 })
+
+	crafted := hostileMessages(t)
+	delete(crafted, "oversized frame") // Refused by the sender's framing already
+	for _, msg := range crafted {
+		frame, err := p2p.EncodeMessage(msg)
+		require.NoError(t, err)
+		require.NoError(t, c.peerList()[0].Send(frame))
+	}
+	for range crafted {
+		<-cErrs
+	}
+
+	// c takes no replicas, so it neither is pushed any nor answers pushes.
+	_, err := c.sendMessage(c.peerList(), &Message{Payload: MessageStoreAck{AckID: 1}})
+	require.NoError(t, err)
+	_, err = a.sendMessage(a.peerList(), &Message{Payload: MessageStoreFileInline{ID: a.ID, Key: "pushed"}})
+	require.NoError(t, err)
+	<-cErrs
+	<-aErrs
+	assert.Equal(t, int64(len(crafted))+1, c.Metrics()["protocol_errors"])
+	assert.Equal(t, int64(1), a.Metrics()["protocol_errors"])
+
+	// The connection is still in step: a store of c reaches a, and a get of c is answered.
+	require.NoError(t, c.Store("report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(c, "report", a) == 1 })
+	require.NoError(t, c.Storage.Delete(c.ID, "report"))
+	requireGet(t, c, "report", []byte("draft"))
+
+	// Each node counts a message as malformed once it answered it, and has handled everything
+	// the other sent since by the time the get is answered.
+	assert.Equal(t, int64(len(crafted))+1, a.Metrics()["malformed_messages"])
+	assert.Equal(t, int64(1), c.Metrics()["malformed_messages"])
+	assert.Zero(t, a.Metrics()["peers_disconnected"])
+	assert.Empty(t, aErrs)
+	assert.Empty(t, cErrs)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the counters exposed by FileServer.Metrics.
+type metrics struct {
+	negativeCacheHits   atomic.Int64
+	inlineReplicasSent  atomic.Int64 // Replicas sent inside MessageStoreFileInline
+	inlineObjectsServed atomic.Int64 // Get answers sent in a single write by sendObjectInline
+	protocolErrors      atomic.Int64 // Messages peers rejected with MessageProtocolError
+	readRepairs         atomic.Int64 // Stale or missing copies replaced by read repair
+	readRepairsSkipped  atomic.Int64 // Read repairs not run because the key was repaired recently
+	replicasRejected    atomic.Int64 // Replicas peers refused with MessageStoreRejected
+	cacheHits           atomic.Int64 // Gets served from the object cache
+	cacheMisses         atomic.Int64 // Gets the object cache could not serve, counted only when it is enabled
+	hedges              atomic.Int64 // Extra get requests sent by hedged fetches
+	hedgesWon           atomic.Int64 // Hedged fetches whose object came from an extra request
+	requestsCancelled   atomic.Int64 // Objects whose streaming stopped because the requester cancelled
+	appendResyncs       atomic.Int64 // Whole objects sent again to peers that refused an append
+	malformedMessages   atomic.Int64 // Messages from peers that could not be decoded or handled
+	peersDisconnected   atomic.Int64 // Peers disconnected for sending MaxProtocolErrors malformed messages
+	onDemandDials       atomic.Int64 // Connections to holders of an object dialed by fetches not connected to them
+	pushesDeduplicated  atomic.Int64 // Replica pushes that joined the same push in flight or were skipped as recently delivered
+	staleAnswers        atomic.Int64 // Answers dropped because they name requests of an earlier run of the node
+	peerRestarts        atomic.Int64 // Peers that reconnected as a new run, whose state was reset
+	misdelivered        atomic.Int64 // Replicas refused because their stream was shorter or longer than announced
+	streamsAborted      atomic.Int64 // Replica streams cut short and aborted so the peer discards them
+	coalescedFrames     atomic.Int64 // Frames sent by the outbox, each carrying one or more queued messages
+	coalescedMessages   atomic.Int64 // Messages queued in the outbox and sent in those frames
+	diskFull            atomic.Int64 // Times the node stopped accepting writes for lack of disk space
+	replicasNoSpace     atomic.Int64 // Replicas peers refused for lack of disk space
+	replicasDenied      atomic.Int64 // Replicas peers refused because their Authorizer denied storing them
+	requestsDenied      atomic.Int64 // Requests of peers this node's Authorizer denied
+	clockSkewed         atomic.Int64 // Times a peer's clock was found off by more than MaxClockSkew
+	reliableRetries     atomic.Int64 // Control messages sent again because the peer had not acknowledged them
+	reliableDuplicates  atomic.Int64 // Control messages received again after they were applied, and not applied twice
+	replicasChallenged  atomic.Int64 // Replicas peers were challenged to prove they hold
+	replicasSuspect     atomic.Int64 // Replicas that failed a challenge and were sent again
+	storesLeased        atomic.Int64 // Stores and replicas refused because another node holds the key's lease
+	slowIO              atomic.Int64 // Times the local disk's IO turned degraded
+	chaosDelays         atomic.Int64 // Message handlings delayed by ChaosConfig
+	chaosDropped        atomic.Int64 // Control messages to peers dropped by ChaosConfig
+	chaosDiskFull       atomic.Int64 // Object writes failed by ChaosConfig as if the disk were full
+	chaosDisconnects    atomic.Int64 // Peer connections closed by ChaosConfig
+	getsShed            atomic.Int64 // Get requests of peers refused as busy past the admission limits
+	replicasShed        atomic.Int64 // Replicas of peers refused as busy past the admission limits
+	replicasBusy        atomic.Int64 // Replicas peers refused as busy, sent again after the time they suggested
+	busyRetries         atomic.Int64 // Fetches asked again after every peer holding the object was busy
+	seedLookupFailures  atomic.Int64 // Lookups of the bootstrap nodes' addresses that failed and were retried
+}
+
+// Metrics returns a snapshot of the server's counters keyed by metric name, along with the
+// number of connected peers talked to without each optional feature, such as
+// peers_without_batch, which fall to zero once every node in the cluster is upgraded, and the
+// timing of the local disk's operations, such as storage_write_p99_us, with
+// storage_io_degraded set to 1 while its IO counts as degraded, and the runs of each maintenance
+// job, such as maintenance_gc_last_duration_ms, with maintenance_paused set to 1 while
+// maintenance is paused, and the gauges of the admission limits, such as gets_inflight, with
+// overloaded set to 1 while requests have been refused as busy for a sustained time, and
+// bootstrap_seeds, the number of seed addresses currently known.
+func (s *FileServer) Metrics() map[string]int64 {
+	m := map[string]int64{
+		"negative_cache_hits":   s.metrics.negativeCacheHits.Load(),
+		"inline_replicas_sent":  s.metrics.inlineReplicasSent.Load(),
+		"inline_objects_served": s.metrics.inlineObjectsServed.Load(),
+		"protocol_errors":       s.metrics.protocolErrors.Load(),
+		"read_repairs":          s.metrics.readRepairs.Load(),
+		"read_repairs_skipped":  s.metrics.readRepairsSkipped.Load(),
+		"replicas_rejected":     s.metrics.replicasRejected.Load(),
+		"cache_hits":            s.metrics.cacheHits.Load(),
+		"cache_misses":          s.metrics.cacheMisses.Load(),
+		"get_hedges":            s.metrics.hedges.Load(),
+		"get_hedges_won":        s.metrics.hedgesWon.Load(),
+		"requests_cancelled":    s.metrics.requestsCancelled.Load(),
+		"append_resyncs":        s.metrics.appendResyncs.Load(),
+		"malformed_messages":    s.metrics.malformedMessages.Load(),
+		"peers_disconnected":    s.metrics.peersDisconnected.Load(),
+		"on_demand_dials":       s.metrics.onDemandDials.Load(),
+		"pushes_deduplicated":   s.metrics.pushesDeduplicated.Load(),
+		"stale_answers_dropped": s.metrics.staleAnswers.Load(),
+		"peer_restarts":         s.metrics.peerRestarts.Load(),
+		"replicas_misdelivered": s.metrics.misdelivered.Load(),
+		"streams_aborted":       s.metrics.streamsAborted.Load(),
+		"coalesced_frames":      s.metrics.coalescedFrames.Load(),
+		"coalesced_messages":    s.metrics.coalescedMessages.Load(),
+		"disk_full":             s.metrics.diskFull.Load(),
+		"replicas_no_space":     s.metrics.replicasNoSpace.Load(),
+		"replicas_denied":       s.metrics.replicasDenied.Load(),
+		"requests_denied":       s.metrics.requestsDenied.Load(),
+		"clock_skew_warnings":   s.metrics.clockSkewed.Load(),
+		"reliable_retries":      s.metrics.reliableRetries.Load(),
+		"reliable_duplicates":   s.metrics.reliableDuplicates.Load(),
+		"replicas_challenged":   s.metrics.replicasChallenged.Load(),
+		"replicas_suspect":      s.metrics.replicasSuspect.Load(),
+		"stores_leased":         s.metrics.storesLeased.Load(),
+		"slow_io":               s.metrics.slowIO.Load(),
+		"chaos_handler_delays":  s.metrics.chaosDelays.Load(),
+		"chaos_frames_dropped":  s.metrics.chaosDropped.Load(),
+		"chaos_disk_full":       s.metrics.chaosDiskFull.Load(),
+		"chaos_disconnects":     s.metrics.chaosDisconnects.Load(),
+		"gets_shed":             s.metrics.getsShed.Load(),
+		"replicas_shed":         s.metrics.replicasShed.Load(),
+		"replicas_busy":         s.metrics.replicasBusy.Load(),
+		"busy_retries":          s.metrics.busyRetries.Load(),
+		"seed_lookup_failures":  s.metrics.seedLookupFailures.Load(),
+	}
+	for name, n := range s.downgraded() {
+		m[name] = n
+	}
+	disk := s.Storage.Stats()
+	for op, stats := range disk.Ops {
+		m["storage_"+string(op)+"_latency_us"] = stats.Latency.Microseconds()
+		m["storage_"+string(op)+"_p99_us"] = stats.P99.Microseconds()
+		m["storage_"+string(op)+"_throughput"] = stats.Throughput
+	}
+	m["storage_io_degraded"] = 0
+	if len(disk.Degraded) > 0 {
+		m["storage_io_degraded"] = 1
+	}
+	load := s.admission.snapshot()
+	m["gets_inflight"] = int64(load.running[admitGet])
+	m["replicas_inflight"] = int64(load.running[admitReplica])
+	m["inflight_bytes"] = load.bytes
+	m["bootstrap_seeds"] = int64(len(s.seedList()))
+	m["overloaded"] = 0
+	if len(s.admission.overloaded()) > 0 {
+		m["overloaded"] = 1
+	}
+	maint := s.MaintenanceStatus()
+	m["maintenance_paused"] = 0
+	if maint.Paused {
+		m["maintenance_paused"] = 1
+	}
+	for _, job := range maint.Jobs {
+		prefix := "maintenance_" + strings.ReplaceAll(job.Name, "-", "_") + "_"
+		m[prefix+"runs"] = job.Runs
+		m[prefix+"panics"] = job.Panics
+		m[prefix+"last_duration_ms"] = job.LastDuration.Milliseconds()
+		m[prefix+"last_run_unix"] = unixOrZero(job.LastRun)
+		m[prefix+"next_run_unix"] = unixOrZero(job.NextRun)
+	}
+	return m
+}
+
+// unixOrZero returns t in seconds since the Unix epoch, zero for the zero time.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// Defaults and limits for mirroring.
+const (
+	defaultMirrorConcurrency = 2
+	defaultMirrorRate        = 100
+	// mirrorBatchSize is the most objects asked of a peer in one MessageMirrorPull.
+	mirrorBatchSize = 32
+	// mirrorTimeout bounds how long a listing, or the replicas of a pull, are waited for.
+	mirrorTimeout = 10 * time.Second
+)
+
+// MessageMirrorList asks a peer for every object and tombstone it holds. The receiver answers
+// with a mirrorListing.
+type MessageMirrorList struct{}
+
+// MessageMirrorPull asks a peer to replicate objects of one owner to the sender, which lacks
+// them. The peer sends each one it holds as it would a new replica.
+type MessageMirrorPull struct {
+	Owner string   // Identifier of the node owning the objects
+	Keys  []string // Hashed keys of the objects
+}
+
+// mirrorObject is an object listed in a mirrorListing.
+type mirrorObject struct {
+	Owner   string    // Identifier of the node owning the object
+	Key     string    // Hashed key of the object
+	ModTime time.Time // When the listing node wrote its copy
+}
+
+// mirrorListing is the stream sent in answer to MessageMirrorList.
+type mirrorListing struct {
+	Objects    []mirrorObject // Objects the node holds, its own under their hashed keys
+	Tombstones []tombstone    // Deletions the node knows of
+	Err        string         // Why the request could not be answered
+}
+
+// MirrorStatus describes the latest backfill of a node with MirrorAll set.
+type MirrorStatus struct {
+	Running  bool      `json:"running"`            // Whether the backfill is still going on
+	Done     int       `json:"done"`               // Objects pulled so far
+	Failed   int       `json:"failed"`             // Objects no peer delivered
+	Total    int       `json:"total"`              // Objects the node lacked when the backfill started
+	Started  time.Time `json:"started"`            // When the backfill started, zero if none has
+	Finished time.Time `json:"finished,omitempty"` // When the backfill ended, zero while it runs
+	Progress string    `json:"progress"`           // Summary such as "backfill: 1203/5000 objects"
+}
+
+// String summarises the status, e.g. "backfill: 1203/5000 objects".
+func (st MirrorStatus) String() string {
+	if st.Started.IsZero() {
+		return "backfill: not started"
+	}
+	summary := fmt.Sprintf("backfill: %d/%d objects", st.Done, st.Total)
+	if st.Failed > 0 {
+		summary += fmt.Sprintf(", %d failed", st.Failed)
+	}
+	if !st.Running {
+		summary += ", finished"
+	}
+	return summary
+}
+
+// mirrorPull is an object a notification announced, to be pulled from the peer that sent it.
+type mirrorPull struct {
+	from string    // Address of the announcing peer
+	ref  objectRef // Object announced
+}
+
+// mirrorState is the work queued for the mirror loop and the progress of its backfill.
+type mirrorState struct {
+	clock    clock.Clock // Times the backfills
+	mu       sync.Mutex
+	wake     chan struct{}               // Signals the mirror loop that work was queued
+	backfill bool                        // Whether a backfill was requested since the last one started
+	pulls    []mirrorPull                // Objects announced by notifications
+	status   MirrorStatus                // Progress of the latest backfill
+	waiting  map[objectRef]chan struct{} // Closed when the object arrives, by object being pulled
+}
+
+// newMirrorState returns a mirror state with no work queued.
+func newMirrorState(clk clock.Clock) *mirrorState {
+	return &mirrorState{clock: clk, wake: make(chan struct{}, 1), waiting: make(map[objectRef]chan struct{})}
+}
+
+// signalLocked wakes the mirror loop; the caller must hold mu.
+func (m *mirrorState) signalLocked() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// requestBackfill asks the mirror loop for a backfill.
+func (m *mirrorState) requestBackfill() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backfill = true
+	m.signalLocked()
+}
+
+// requestPull asks the mirror loop to pull an object announced by a notification.
+func (m *mirrorState) requestPull(pull mirrorPull) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pulls = append(m.pulls, pull)
+	m.signalLocked()
+}
+
+// take returns the queued work and empties the queue.
+func (m *mirrorState) take() (bool, []mirrorPull) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	backfill, pulls := m.backfill, m.pulls
+	m.backfill, m.pulls = false, nil
+	return backfill, pulls
+}
+
+// expect returns a channel closed once the object arrives.
+func (m *mirrorState) expect(ref objectRef) <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.waiting[ref]
+	if !ok {
+		ch = make(chan struct{})
+		m.waiting[ref] = ch
+	}
+	return ch
+}
+
+// forget stops waiting for an object.
+func (m *mirrorState) forget(ref objectRef) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.waiting, ref)
+}
+
+// arrived wakes whoever waits for an object that was just stored.
+func (m *mirrorState) arrived(ref objectRef) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ch, ok := m.waiting[ref]; ok {
+		close(ch)
+		delete(m.waiting, ref)
+	}
+}
+
+// begin starts the status of a backfill of total objects.
+func (m *mirrorState) begin(total int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = MirrorStatus{Running: true, Total: total, Started: m.clock.Now()}
+}
+
+// progress counts pulled and failed objects of the running backfill.
+func (m *mirrorState) progress(done int, failed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.Done += done
+	m.status.Failed += failed
+}
+
+// finish marks the running backfill as ended.
+func (m *mirrorState) finish() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.Running = false
+	m.status.Finished = m.clock.Now()
+}
+
+// MirrorStatus returns the progress of the latest backfill of a node with MirrorAll set.
+func (s *FileServer) MirrorStatus() MirrorStatus {
+	s.mirror.mu.Lock()
+	defer s.mirror.mu.Unlock()
+	st := s.mirror.status
+	st.Progress = st.String()
+	return st
+}
+
+// startMirror starts the mirror loop, which backfills once the node is connected. The
+// notifications of every bootstrap node are subscribed to by refreshSeeds as it becomes a seed.
+func (s *FileServer) startMirror() {
+	if len(s.peerList()) > 0 {
+		s.mirror.requestBackfill()
+	}
+	go s.mirrorLoop()
+}
+
+// mirrorLoop runs backfills and pulls announced objects one after the other, so the
+// listings it exchanges with peers never overlap the replicas it asked them for.
+func (s *FileServer) mirrorLoop() {
+	for {
+		select {
+		case <-s.quitch:
+			return
+		case <-s.mirror.wake:
+		}
+		backfill, pulls := s.mirror.take()
+		if backfill {
+			s.backfill()
+		}
+		if len(pulls) > 0 {
+			s.pullAnnounced(pulls)
+		}
+	}
+}
+
+// mirrorWant is an object a backfill pulls and the peers that listed it.
+type mirrorWant struct {
+	ref     objectRef  // Object to pull
+	holders []p2p.Node // Peers holding a copy
+	first   int        // Holder asked first, spreading the objects across holders
+}
+
+// backfill lists the objects and tombstones of every peer, drops the local replicas peers
+// know to be deleted and pulls every object of another owner this node lacks, unless it was
+// deleted after the copy listed was written.
+func (s *FileServer) backfill() {
+	peers, _ := s.peersWith(s.peerList(), func(c peerCaps) bool { return c.mirror })
+	holders := make(map[objectRef][]p2p.Node)
+	modTimes := make(map[objectRef]time.Time)
+	var order []objectRef
+	for _, peer := range peers {
+		listing, err := s.listMirror(peer)
+		if err != nil {
+			log.Printf("[%s] mirror: %s", s.Transport.Addr(), err)
+			continue
+		}
+		for _, ts := range listing.Tombstones {
+			s.applyTombstone(ts)
+		}
+		for _, obj := range listing.Objects {
+			ref := objectRef{owner: obj.Owner, key: obj.Key}
+			if _, ok := holders[ref]; !ok {
+				order = append(order, ref)
+			}
+			holders[ref] = append(holders[ref], peer)
+			if obj.ModTime.After(modTimes[ref]) {
+				modTimes[ref] = obj.ModTime
+			}
+		}
+	}
+
+	var wants []mirrorWant
+	for _, ref := range order {
+		if ref.owner == s.ID || s.tombstones.covers(ref, modTimes[ref]) {
+			continue
+		}
+		if ok, err := s.Storage.Has(ref.owner, ref.key); ok || err != nil {
+			continue
+		}
+		wants = append(wants, mirrorWant{ref: ref, holders: holders[ref], first: len(wants)})
+	}
+	s.mirror.begin(len(wants))
+	defer s.mirror.finish()
+	fmt.Printf("[%s] mirror: backfilling %d objects from %d peers\n", s.Transport.Addr(), len(wants), len(peers))
+	for attempt := 0; len(wants) > 0; attempt++ {
+		wants = s.pullWants(wants, attempt)
+	}
+	fmt.Printf("[%s] mirror: %s\n", s.Transport.Addr(), s.MirrorStatus())
+}
+
+// listMirror asks a peer for its objects and tombstones.
+func (s *FileServer) listMirror(peer p2p.Node) (mirrorListing, error) {
+	var listing mirrorListing
+	if err := s.exchange(peer, &Message{Payload: MessageMirrorList{}}, &listing, mirrorTimeout); err != nil {
+		return listing, fmt.Errorf("listing objects of (%s): %w", peer.RemoteAddr(), err)
+	}
+	if len(listing.Err) > 0 {
+		return listing, fmt.Errorf("listing objects of (%s): %s", peer.RemoteAddr(), listing.Err)
+	}
+	return listing, nil
+}
+
+// pullWants asks every wanted object of the holder due in this attempt, in batches of one
+// owner's objects, MirrorConcurrency batches and MirrorRate objects per second at most.
+//
+// Returns: The objects that did not arrive and have holders left to ask.
+func (s *FileServer) pullWants(wants []mirrorWant, attempt int) []mirrorWant {
+	type batch struct {
+		peer  p2p.Node
+		owner string
+		wants []mirrorWant
+	}
+	type slot struct {
+		peer  string
+		owner string
+	}
+	var batches []*batch
+	open := make(map[slot]*batch)
+	failed := 0
+	for _, w := range wants {
+		if attempt >= len(w.holders) {
+			failed++
+			continue
+		}
+		peer := w.holders[(w.first+attempt)%len(w.holders)]
+		at := slot{peer: peer.RemoteAddr().String(), owner: w.ref.owner}
+		b, ok := open[at]
+		if !ok || len(b.wants) == mirrorBatchSize {
+			b = &batch{peer: peer, owner: w.ref.owner}
+			open[at] = b
+			batches = append(batches, b)
+		}
+		b.wants = append(b.wants, w)
+	}
+	s.mirror.progress(0, failed)
+
+	concurrency := s.MirrorConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMirrorConcurrency
+	}
+	rate := s.MirrorRate
+	if rate <= 0 {
+		rate = defaultMirrorRate
+	}
+	p := &pacer{clock: s.Clock, interval: time.Second / time.Duration(rate)}
+	var (
+		mu    sync.Mutex
+		retry []mirrorWant
+		wg    sync.WaitGroup
+		jobs  = make(chan *batch)
+	)
+	for i := 0; i < min(concurrency, len(batches)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				refs := make([]objectRef, len(b.wants))
+				for i, w := range b.wants {
+					refs[i] = w.ref
+				}
+				arrived := s.pullBatch(b.peer, b.owner, refs)
+				s.mirror.progress(len(arrived), 0)
+				mu.Lock()
+				for _, w := range b.wants {
+					if !arrived[w.ref] {
+						retry = append(retry, w)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, b := range batches {
+		if !p.wait(len(b.wants), s.quitch) {
+			break
+		}
+		jobs <- b
+	}
+	close(jobs)
+	wg.Wait()
+	return retry
+}
+
+// pullBatch asks a peer for objects of one owner and waits until they arrive, or until
+// mirrorTimeout passes without one arriving.
+//
+// Returns: The objects that arrived.
+func (s *FileServer) pullBatch(peer p2p.Node, owner string, refs []objectRef) map[objectRef]bool {
+	waits := make(map[objectRef]<-chan struct{}, len(refs))
+	keys := make([]string, len(refs))
+	for i, ref := range refs {
+		waits[ref] = s.mirror.expect(ref)
+		keys[i] = ref.key
+	}
+	defer func() {
+		for ref := range waits {
+			s.mirror.forget(ref)
+		}
+	}()
+	arrived := make(map[objectRef]bool, len(refs))
+	msg := &Message{Payload: MessageMirrorPull{Owner: owner, Keys: keys}}
+	if _, err := s.sendMessage([]p2p.Node{peer}, msg); err != nil {
+		log.Printf("[%s] mirror: pulling from (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+		return arrived
+	}
+	timeout := s.Clock.NewTimer(mirrorTimeout)
+	defer timeout.Stop()
+	for _, ref := range refs {
+		select {
+		case <-waits[ref]:
+			arrived[ref] = true
+			timeout.Reset(mirrorTimeout)
+		case <-timeout.C():
+			return arrived
+		case <-s.quitch:
+			return arrived
+		}
+	}
+	return arrived
+}
+
+// pullAnnounced pulls the objects notifications announced from the peers that announced
+// them, unless they arrived in the meantime or were deleted since.
+func (s *FileServer) pullAnnounced(pulls []mirrorPull) {
+	for _, pull := range pulls {
+		if ok, err := s.Storage.Has(pull.ref.owner, pull.ref.key); ok || err != nil {
+			continue
+		}
+		if s.tombstones.covers(pull.ref, s.Clock.Now()) {
+			continue
+		}
+		peer, ok := s.peer(pull.from)
+		if !ok || !s.capsOf(peer).mirror {
+			continue
+		}
+		if arrived := s.pullBatch(peer, pull.ref.owner, []objectRef{pull.ref}); !arrived[pull.ref] {
+			log.Printf("[%s] mirror: (%s) announced by (%s) did not arrive", s.Transport.Addr(), pull.ref.key, pull.from)
+		}
+	}
+}
+
+// mirrorNotified queues the objects a notification announces and applies the deletions it
+// reports. A gap means events were lost, so a backfill is run instead.
+func (s *FileServer) mirrorNotified(from string, publisher string, ev NotifyEvent) {
+	switch ev.Op {
+	case NotifyStore:
+		s.mirror.requestPull(mirrorPull{from: from, ref: objectRef{owner: publisher, key: crypto.HashKey(ev.Key)}})
+	case NotifyDelete:
+		s.applyTombstone(tombstone{Owner: publisher, Key: crypto.HashKey(ev.Key), Time: ev.Time})
+	case NotifyGap:
+		s.mirror.requestBackfill()
+	}
+}
+
+// pacer spaces out work shared by several workers to a number of items per interval.
+type pacer struct {
+	clock    clock.Clock // Times the items
+	mu       sync.Mutex
+	interval time.Duration // Time each item takes up
+	next     time.Time     // When the next item may start
+}
+
+// wait blocks until n more items may start, or quit is closed.
+//
+// Returns: Whether the items may start.
+func (p *pacer) wait(n int, quit <-chan struct{}) bool {
+	p.mu.Lock()
+	start := p.next
+	if now := p.clock.Now(); start.Before(now) {
+		start = now
+	}
+	p.next = start.Add(time.Duration(n) * p.interval)
+	p.mu.Unlock()
+	select {
+	case <-quit:
+		return false
+	case <-p.clock.After(start.Sub(p.clock.Now())):
+		return true
+	}
+}
+
+// handleMessageMirrorList answers a MessageMirrorList with every object this node holds,
+// listing its own objects under the hashed keys their replicas carry, and its tombstones.
+func (s *FileServer) handleMessageMirrorList(from string, q query) error {
+	listing, err := s.mirrorListing()
+	if err != nil {
+		listing = mirrorListing{Err: err.Error()}
+	}
+	return errors.Join(s.sendValue(from, q, listing), err)
+}
+
+// mirrorListing collects the objects and tombstones of this node.
+func (s *FileServer) mirrorListing() (mirrorListing, error) {
+	owners, err := s.Storage.Owners()
+	if err != nil {
+		return mirrorListing{}, err
+	}
+	listing := mirrorListing{Tombstones: s.tombstones.list()}
+	for _, owner := range owners {
+		keys, err := s.Storage.Keys(owner)
+		if err != nil {
+			return mirrorListing{}, err
+		}
+		metas, err := s.Storage.Lookup(owner, keys)
+		if err != nil {
+			return mirrorListing{}, err
+		}
+		for _, key := range keys {
+			meta, ok := metas[key]
+			if !ok {
+				// Deleted since it was listed.
+				continue
+			}
+			if owner == s.ID {
+				key = crypto.HashKey(key)
+			}
+			listing.Objects = append(listing.Objects, mirrorObject{Owner: owner, Key: key, ModTime: meta.ModTime})
+		}
+	}
+	return listing, nil
+}
+
+// handleMessageMirrorPull replicates the requested objects to the peer asking for them,
+// skipping those this node no longer holds.
+func (s *FileServer) handleMessageMirrorPull(from string, msg MessageMirrorPull) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	var plain map[string]string
+	if msg.Owner == s.ID {
+		// Own objects are held under their plain keys.
+		keys, err := s.Storage.Keys(s.ID)
+		if err != nil {
+			return err
+		}
+		plain = make(map[string]string, len(keys))
+		for _, key := range keys {
+			plain[crypto.HashKey(key)] = key
+		}
+	}
+	for _, key := range msg.Keys {
+		var err error
+		if plain != nil {
+			if k, ok := plain[key]; ok {
+				err = s.replicateKey(peer, k)
+			}
+		} else if ok, _ := s.Storage.Has(msg.Owner, key); ok {
+			err = s.replicateHeld(peer, msg.Owner, key)
+		}
+		if err != nil {
+			return fmt.Errorf("mirroring (%s) to (%s): %w", key, from, err)
+		}
+	}
+	return nil
+}
+
+// replicateHeld sends the replica of another node's object held here to a single peer, as
+// received from its owner.
+func (s *FileServer) replicateHeld(peer p2p.Node, owner string, key string) (err error) {
+	_, r, err := s.Storage.Read(owner, key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() {
+			err = errors.Join(err, rc.Close())
+		}()
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	rep := replica{id: owner, key: key, data: data, checksum: hex.EncodeToString(sum[:])}
+	if meta, err := s.Storage.Metadata(owner, key); err == nil {
+		rep.version = meta.Version
+	}
+	_, err = s.replicate([]p2p.Node{peer}, rep)
+	return err
+}
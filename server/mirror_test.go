@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mirrorKeys stores n keys on each of a and b, waits until each holds the other's replicas and
+// returns the objects as the owners and hashed keys a mirror should hold.
+func mirrorKeys(t *testing.T, a *FileServer, b *FileServer, n int) []objectRef {
+	t.Helper()
+	var refs []objectRef
+	for _, s := range []*FileServer{a, b} {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%s/%d", s.Transport.Addr(), i)
+			require.NoError(t, s.Store(key, bytes.NewReader([]byte(key))))
+			refs = append(refs, objectRef{owner: s.ID, key: crypto.HashKey(key)})
+		}
+	}
+	waitFor(t, func() bool {
+		return countObjects(t, b.StorageRoot, a.ID) == n && countObjects(t, a.StorageRoot, b.ID) == n
+	})
+	return refs
+}
+
+// holdsAll reports whether s holds every object of refs.
+func holdsAll(s *FileServer, refs []objectRef) bool {
+	for _, ref := range refs {
+		if ok, _ := s.Storage.Has(ref.owner, ref.key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMirrorAllBackfillsJoiningNode(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	refs := mirrorKeys(t, a, b, 100)
+	require.Len(t, refs, 200)
+
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	c.MirrorAll = true
+	c.MirrorRate = 1000
+	startCluster(t, c)
+	waitFor(t, func() bool { return holdsAll(c, refs) })
+	waitFor(t, func() bool { return !c.MirrorStatus().Running })
+	status := c.MirrorStatus()
+	assert.Zero(t, status.Failed)
+	assert.Contains(t, status.Progress, "backfill: ")
+
+	// Objects stored from now on reach the mirror like any replica.
+	require.NoError(t, a.Store("later", bytes.NewReader([]byte("later"))))
+	waitFor(t, func() bool {
+		ok, _ := c.Storage.Has(a.ID, crypto.HashKey("later"))
+		return ok
+	})
+}
+
+func TestMirrorAllPullsObjectsHeldOnlyByTheirOwner(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	// The object is stored while its owner has no peer to replicate it to.
+	network.Policy.PartitionBetween(":4000", ":4001")
+	waitFor(t, func() bool { return !hasPeers(a) })
+	require.NoError(t, a.Store("lonely", bytes.NewReader([]byte("lonely"))))
+
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	c.MirrorAll = true
+	startCluster(t, c)
+	waitFor(t, func() bool {
+		ok, _ := c.Storage.Has(a.ID, crypto.HashKey("lonely"))
+		return ok
+	})
+}
+
+func TestMirrorAllDoesNotResurrectDeletes(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	refs := mirrorKeys(t, a, b, 5)
+
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	c.MirrorAll = true
+	startCluster(t, c)
+	waitFor(t, func() bool { return holdsAll(c, refs) })
+
+	// The mirror misses a delete and a store while it is cut off.
+	network.Policy.PartitionBetween(":4002", ":4000")
+	network.Policy.PartitionBetween(":4002", ":4001")
+	waitFor(t, func() bool { return !hasPeers(c) })
+	gone := fmt.Sprintf("%s/%d", a.Transport.Addr(), 0)
+	require.NoError(t, a.Delete(gone))
+	require.NoError(t, b.Store("fresh", bytes.NewReader([]byte("fresh"))))
+	// b has handled the delete and a the replica of fresh before the mirror comes back.
+	settle(t, a, b)
+	settle(t, b, a)
+	ok, err := b.Storage.Has(a.ID, crypto.HashKey(gone))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	network.Policy.Heal()
+	waitFor(t, func() bool {
+		ok, _ := c.Storage.Has(b.ID, crypto.HashKey("fresh"))
+		return ok
+	})
+	waitFor(t, func() bool {
+		ok, _ := c.Storage.Has(a.ID, crypto.HashKey(gone))
+		return !ok
+	})
+	waitFor(t, func() bool { return !c.MirrorStatus().Running })
+	ok, err = c.Storage.Has(a.ID, crypto.HashKey(gone))
+	require.NoError(t, err)
+	assert.False(t, ok, "the mirror pulled a deleted object back")
+}
+
+func TestTombstonesExpire(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	table := newTombstoneTable(time.Hour, clk)
+	path := filepath.Join(t.TempDir(), tombstoneFileName)
+	require.NoError(t, table.load(path))
+	old := objectRef{owner: "a", key: "old"}
+	table.add(tombstone{Owner: old.owner, Key: old.key, Time: clk.Now()})
+	clk.Advance(30 * time.Minute)
+	table.add(tombstone{Owner: "a", Key: "new", Time: clk.Now()})
+	assert.Len(t, table.list(), 2)
+	assert.True(t, table.covers(old, time.Unix(0, 0).Add(-time.Second)))
+
+	// Tombstones are forgotten once older than the retention, in memory and on disk.
+	clk.Advance(30*time.Minute + time.Second)
+	list := table.list()
+	require.Len(t, list, 1)
+	assert.Equal(t, "new", list[0].Key)
+	table.add(tombstone{Owner: "b", Key: "other", Time: clk.Now()})
+	reloaded := newTombstoneTable(time.Hour, clk)
+	require.NoError(t, reloaded.load(path))
+	assert.Len(t, reloaded.list(), 2)
+}
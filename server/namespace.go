@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// keystoreFileName is the file in the storage root holding the namespace keys granted to this node.
+	keystoreFileName = ".dfs-keystore.json"
+	// grantTimeout bounds how long GrantNamespace waits for each answer of the peer.
+	grantTimeout = 5 * time.Second
+)
+
+// ErrAccessDenied is returned when reading an object of a namespace this node holds no key for.
+var ErrAccessDenied = errors.New("access denied")
+
+// MessageGrantKey asks a peer for the public key namespace keys granted to it are wrapped
+// for. The receiver answers with a grantKeyResponse.
+type MessageGrantKey struct{}
+
+// MessageGrantNamespace hands a peer the data key of one of the sender's namespaces, wrapped
+// with a key agreed between the sender's one-off key pair and the receiver's grant key. The
+// receiver answers with a grantResponse.
+type MessageGrantNamespace struct {
+	Namespace string // Namespace the key decrypts
+	Public    []byte // X25519 public key of the sender for this grant
+	Wrapped   []byte // Namespace key encrypted with the SHA-256 of the agreed secret
+}
+
+// grantKeyResponse is the stream sent in answer to MessageGrantKey.
+type grantKeyResponse struct {
+	Public []byte // X25519 public key of the receiver's grant key
+}
+
+// grantResponse is the stream sent in answer to MessageGrantNamespace.
+type grantResponse struct {
+	Err string // Why the key was not accepted, empty when it was
+}
+
+// keystore holds the namespace keys other nodes granted to this node and the key pair they
+// are wrapped for in transit. Granted keys are persisted wrapped with the node's master key,
+// so they survive restarts without being readable from the storage root alone.
+type keystore struct {
+	mu      sync.Mutex
+	path    string                       // Location of the persisted keys, empty until load is called
+	master  []byte                       // Key the persisted keys are wrapped with
+	private *ecdh.PrivateKey             // Grant key, regenerated by every process
+	grants  map[string]map[string][]byte // Namespace keys by owner ID and namespace
+}
+
+// newKeystore returns an empty keystore that is not persisted until load is called.
+func newKeystore(master []byte) *keystore {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		// The system's random source failing leaves nothing sensible to run on.
+		panic(fmt.Sprintf("generating grant key: %s", err))
+	}
+	return &keystore{
+		master:  master,
+		private: private,
+		grants:  make(map[string]map[string][]byte),
+	}
+}
+
+// load attaches the keystore to path, restoring the keys saved there wrapped with the master key.
+func (k *keystore) load(path string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.path = path
+	var saved map[string]map[string][]byte
+	if err := loadJSON(path, "keystore", &saved); err != nil {
+		return err
+	}
+	for owner, namespaces := range saved {
+		for ns, wrapped := range namespaces {
+			key := new(bytes.Buffer)
+			if _, err := crypto.CopyDecrypt(k.master, bytes.NewReader(wrapped), key); err != nil {
+				return fmt.Errorf("reading keystore %s: %w", path, err)
+			}
+			k.addLocked(owner, ns, key.Bytes())
+		}
+	}
+	return nil
+}
+
+// key returns the key another node granted for one of its namespaces.
+func (k *keystore) key(owner string, ns string) ([]byte, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.grants[owner][ns]
+	return key, ok
+}
+
+// add records a granted key and persists the keystore.
+func (k *keystore) add(owner string, ns string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.addLocked(owner, ns, key)
+	k.saveLocked()
+}
+
+// addLocked records a granted key; the caller must hold mu.
+func (k *keystore) addLocked(owner string, ns string, key []byte) {
+	if k.grants[owner] == nil {
+		k.grants[owner] = make(map[string][]byte)
+	}
+	k.grants[owner][ns] = key
+}
+
+// saveLocked saves the granted keys wrapped with the master key, readable by the node only;
+// the caller must hold mu.
+func (k *keystore) saveLocked() {
+	if len(k.path) == 0 {
+		return
+	}
+	saved := make(map[string]map[string][]byte, len(k.grants))
+	var err error
+	for owner, namespaces := range k.grants {
+		saved[owner] = make(map[string][]byte, len(namespaces))
+		for ns, key := range namespaces {
+			wrapped := new(bytes.Buffer)
+			if _, err = crypto.CopyEncrypt(k.master, bytes.NewReader(key), wrapped); err != nil {
+				break
+			}
+			saved[owner][ns] = wrapped.Bytes()
+		}
+	}
+	if err == nil {
+		err = saveJSON(k.path, saved, 0o600)
+	}
+	if err != nil {
+		log.Printf("persisting keystore to %s: %s", k.path, err)
+	}
+}
+
+// loadKeystore attaches the keystore to its file in the storage root.
+func (s *FileServer) loadKeystore() error {
+	return s.keys.load(filepath.Join(s.Storage.Root, keystoreFileName))
+}
+
+// namespaceOf returns the namespace of a key, the part before its first slash, and whether
+// it is one of this node's Namespaces.
+func (s *FileServer) namespaceOf(key string) (string, bool) {
+	ns, _, ok := strings.Cut(key, "/")
+	return ns, ok && slices.Contains(s.Namespaces, ns)
+}
+
+// namespaceKey returns the data key of one of this node's namespaces.
+func (s *FileServer) namespaceKey(ns string) []byte {
+	return crypto.DeriveKey(s.EncKey, "namespace/"+ns)
+}
+
+// dataKey returns the key the content of one of this node's objects is encrypted with: the
+// key of its namespace, or EncKey for keys outside the Namespaces.
+func (s *FileServer) dataKey(key string) []byte {
+	if ns, ok := s.namespaceOf(key); ok {
+		return s.namespaceKey(ns)
+	}
+	return s.EncKey
+}
+
+// dataCipher returns the cipher the content of key is encrypted with, under dataKey.
+func (s *FileServer) dataCipher(key string) crypto.StreamCipher {
+	return crypto.NewAESCTR(s.dataKey(key))
+}
+
+// GrantNamespace gives a connected peer the key of one of this node's namespaces, so it can
+// read the replicas of the namespace it holds with GetReplica. Peers without the key still
+// store the namespace's replicas, but only as ciphertext. The key is wrapped for the peer in
+// transit and kept by the peer across restarts.
+//
+// Parameters:
+//   - ns: One of the node's Namespaces.
+//   - peerID: Node ID of the peer, as advertised in its handshake.
+//
+// Returns: An error if ns is not a namespace of this node, the peer is not connected or
+// does not support grants, or the peer did not accept the key.
+func (s *FileServer) GrantNamespace(ns string, peerID string) error {
+	if !slices.Contains(s.Namespaces, ns) {
+		return fmt.Errorf("%q is not a namespace of this node", ns)
+	}
+	var peer p2p.Node
+	for _, p := range s.peerList() {
+		if p.Hello().NodeID == peerID {
+			peer = p
+			break
+		}
+	}
+	if peer == nil {
+		return fmt.Errorf("node %s is not connected", peerID)
+	}
+	if !s.capsOf(peer).grants {
+		return fmt.Errorf("node %s does not support namespace grants", peerID)
+	}
+
+	var keyResp grantKeyResponse
+	if err := s.exchange(peer, &Message{Payload: MessageGrantKey{}}, &keyResp, grantTimeout); err != nil {
+		return fmt.Errorf("fetching the grant key of node %s: %w", peerID, err)
+	}
+	remote, err := ecdh.X25519().NewPublicKey(keyResp.Public)
+	if err != nil {
+		return fmt.Errorf("grant key of node %s: %w", peerID, err)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	wrapKey, err := agreeWrapKey(private, remote)
+	if err != nil {
+		return err
+	}
+	wrapped := new(bytes.Buffer)
+	if _, err := crypto.CopyEncrypt(wrapKey, bytes.NewReader(s.namespaceKey(ns)), wrapped); err != nil {
+		return err
+	}
+
+	msg := &Message{Payload: MessageGrantNamespace{Namespace: ns, Public: private.PublicKey().Bytes(), Wrapped: wrapped.Bytes()}}
+	var resp grantResponse
+	if err := s.exchange(peer, msg, &resp, grantTimeout); err != nil {
+		return fmt.Errorf("granting %q to node %s: %w", ns, peerID, err)
+	}
+	if len(resp.Err) > 0 {
+		return fmt.Errorf("node %s refused the key of %q: %s", peerID, ns, resp.Err)
+	}
+	log.Printf("[%s] granted namespace %q to node %s", s.Transport.Addr(), ns, peerID)
+	return nil
+}
+
+// GetReplica reads an object another node owns from the replica this node holds, decrypting
+// it with the key of the object's namespace that the owner granted with GrantNamespace.
+// Objects this node owns are read as by Get.
+//
+// Parameters:
+//   - owner: Node ID of the object's owner.
+//   - key: Key the owner stored the object under.
+//
+// Returns: A reader the caller must close, and any errors. ErrAccessDenied means the owner
+// granted no key for the object's namespace; ErrKeyNotFound means no replica is held.
+func (s *FileServer) GetReplica(owner string, key string) (io.ReadCloser, error) {
+	if owner == s.ID {
+		_, r, err := s.GetWithInfo(key)
+		return r, err
+	}
+	ns, _, _ := strings.Cut(key, "/")
+	nsKey, ok := s.keys.key(owner, ns)
+	if !ok {
+		return nil, fmt.Errorf("%w: no key for namespace %q of node %s", ErrAccessDenied, ns, owner)
+	}
+	hashedKey := crypto.HashKey(key)
+	if ok, err := s.Storage.Has(owner, hashedKey); err != nil || !ok {
+		return nil, errors.Join(fmt.Errorf("%w: %s of node %s", ErrKeyNotFound, key, owner), err)
+	}
+	_, r, err := s.Storage.ReadVerified(owner, hashedKey)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := crypto.CopyDecrypt(nsKey, r, pw)
+		pw.CloseWithError(errors.Join(err, r.Close()))
+	}()
+	return pr, nil
+}
+
+// agreeWrapKey derives the key a namespace key is wrapped with from one side's private key
+// and the other side's public key; both sides arrive at the same key.
+func agreeWrapKey(private *ecdh.PrivateKey, remote *ecdh.PublicKey) ([]byte, error) {
+	secret, err := private.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(secret)
+	return sum[:], nil
+}
+
+// handleMessageGrantKey answers a peer about to grant a namespace with this node's grant key.
+func (s *FileServer) handleMessageGrantKey(from string, q query, _ MessageGrantKey) error {
+	return s.sendValue(from, q, grantKeyResponse{Public: s.keys.private.PublicKey().Bytes()})
+}
+
+// handleMessageGrantNamespace unwraps and keeps a namespace key granted by a peer. The key
+// is recorded for the node the peer identified as in its handshake, so a peer can only grant
+// keys of its own namespaces.
+func (s *FileServer) handleMessageGrantNamespace(from string, q query, msg MessageGrantNamespace) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	owner := peer.Hello().NodeID
+	key, err := s.unwrapGrant(msg)
+	if err == nil && len(owner) == 0 {
+		err = errors.New("granting node did not identify itself")
+	}
+	var resp grantResponse
+	if err != nil {
+		resp.Err = err.Error()
+	} else {
+		s.keys.add(owner, msg.Namespace, key)
+		log.Printf("[%s] node %s granted namespace %q", s.Transport.Addr(), owner, msg.Namespace)
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
+
+// unwrapGrant recovers the namespace key of a grant.
+func (s *FileServer) unwrapGrant(msg MessageGrantNamespace) ([]byte, error) {
+	remote, err := ecdh.X25519().NewPublicKey(msg.Public)
+	if err != nil {
+		return nil, err
+	}
+	wrapKey, err := agreeWrapKey(s.keys.private, remote)
+	if err != nil {
+		return nil, err
+	}
+	key := new(bytes.Buffer)
+	if _, err := crypto.CopyDecrypt(wrapKey, bytes.NewReader(msg.Wrapped), key); err != nil {
+		return nil, err
+	}
+	return key.Bytes(), nil
+}
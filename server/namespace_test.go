@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrantNamespace(t *testing.T) {
+	a := makeServer(t, ":4000")
+	a.Namespaces = []string{"ns1", "ns2"}
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	objects := map[string][]byte{
+		"ns1/report": randomData(t, 1<<10),
+		"ns2/ledger": randomData(t, 1<<10),
+	}
+	for key, data := range objects {
+		require.NoError(t, a.Store(key, bytes.NewReader(data)))
+		waitFor(t, func() bool {
+			ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+	}
+	for key := range objects {
+		_, err := b.GetReplica(a.ID, key)
+		assert.ErrorIs(t, err, ErrAccessDenied, "nothing is granted yet")
+	}
+
+	require.NoError(t, a.GrantNamespace("ns1", b.ID))
+	r, err := b.GetReplica(a.ID, "ns1/report")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, objects["ns1/report"], got)
+	_, err = b.GetReplica(a.ID, "ns2/ledger")
+	assert.ErrorIs(t, err, ErrAccessDenied)
+	_, err = b.GetReplica(a.ID, "ns1/missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// The owner still reads its namespaces back from the replicas.
+	for key, data := range objects {
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+		r, err := a.Get(key)
+		require.NoError(t, err, key)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err, key)
+		assert.Equal(t, data, got, key)
+	}
+
+	assert.Error(t, a.GrantNamespace("ns3", b.ID), "ns3 is not a namespace of a")
+	assert.Error(t, a.GrantNamespace("ns1", "unknown"), "no such peer")
+}
+
+func TestKeystorePersistsGrants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), keystoreFileName)
+	master := crypto.NewEncryptionKey()
+	k := newKeystore(master)
+	require.NoError(t, k.load(path))
+	key := crypto.NewEncryptionKey()
+	k.add("owner", "ns1", key)
+
+	reloaded := newKeystore(master)
+	require.NoError(t, reloaded.load(path))
+	got, ok := reloaded.key("owner", "ns1")
+	require.True(t, ok)
+	assert.Equal(t, key, got)
+	_, ok = reloaded.key("owner", "ns2")
+	assert.False(t, ok)
+
+	// Keys are only persisted wrapped with the master key.
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(saved), base64.StdEncoding.EncodeToString(key))
+}
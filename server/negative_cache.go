@@ -0,0 +1,94 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// negativeCache remembers keys the cluster recently reported missing so repeated Gets
+// for them can fail fast instead of broadcasting again. Entries expire after ttl and the
+// oldest entry is evicted once maxEntries is reached.
+type negativeCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+	clock      clock.Clock
+}
+
+// negativeEntry is a single cached miss.
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+// newNegativeCache returns a cache holding misses for ttl, or nil when ttl is not positive.
+func newNegativeCache(ttl time.Duration, maxEntries int, clk clock.Clock) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = defaultNegativeCacheEntries
+	}
+	return &negativeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		clock:      clock.Or(clk),
+	}
+}
+
+// add records a miss for key.
+func (c *negativeCache) add(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	for c.order.Len() >= c.maxEntries {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negativeEntry).key)
+	}
+	c.entries[key] = c.order.PushBack(&negativeEntry{key: key, expires: c.clock.Now().Add(c.ttl)})
+}
+
+// has reports whether key has an unexpired miss recorded.
+func (c *negativeCache) has(key string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if c.clock.Now().After(el.Value.(*negativeEntry).expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+// invalidate forgets any miss recorded for key.
+func (c *negativeCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
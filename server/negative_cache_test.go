@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegativeCache(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := newNegativeCache(time.Minute, 2, clk)
+
+	c.add("a")
+	assert.True(t, c.has("a"))
+	assert.False(t, c.has("b"))
+
+	c.invalidate("a")
+	assert.False(t, c.has("a"), "invalidated entries must be forgotten")
+
+	c.add("a")
+	c.add("b")
+	c.add("c")
+	assert.False(t, c.has("a"), "oldest entry should be evicted at capacity")
+	assert.True(t, c.has("b"))
+	assert.True(t, c.has("c"))
+
+	clk.Advance(time.Minute + time.Second)
+	assert.False(t, c.has("b"), "entries should expire after the TTL")
+
+	var disabled *negativeCache = newNegativeCache(0, 0, nil)
+	disabled.add("a")
+	assert.False(t, disabled.has("a"))
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// notifyFileName is the file in the storage root holding the notification log and the
+// subscribers' cursors.
+const notifyFileName = ".dfs-notify.json"
+
+// Defaults for the notification log.
+const (
+	defaultNotifyLogSize = 1024
+	defaultNotifyLogAge  = 24 * time.Hour
+	notifyBatchSize      = 256
+)
+
+// NotifyOp is the kind of a NotifyEvent.
+type NotifyOp uint8
+
+const (
+	NotifyStore  NotifyOp = iota + 1 // A key was stored on the publishing node
+	NotifyGap                        // Events the subscriber never acknowledged were dropped; it must resync with a full listing
+	NotifyDelete                     // A key was deleted on the publishing node
+	NotifyRepair                     // Stale or missing copies of a key were replaced by read repair
+	NotifyFetch                      // A key the publishing node lacked was fetched from its peers
+)
+
+// String returns the name of the operation.
+func (op NotifyOp) String() string {
+	switch op {
+	case NotifyStore:
+		return "store"
+	case NotifyGap:
+		return "gap"
+	case NotifyDelete:
+		return "delete"
+	case NotifyRepair:
+		return "repair"
+	case NotifyFetch:
+		return "fetch"
+	default:
+		return fmt.Sprintf("NotifyOp(%d)", uint8(op))
+	}
+}
+
+// NotifyEvent is one entry of a node's notification log.
+type NotifyEvent struct {
+	Seq    uint64       `json:"seq"`              // Position in the publisher's log, one more than the previous event
+	Op     NotifyOp     `json:"op"`               // What happened
+	Key    string       `json:"key,omitempty"`    // Key the event is about, empty for gaps
+	Time   time.Time    `json:"time"`             // When the event was logged
+	Source *FetchSource `json:"source,omitempty"` // Where the object of a fetch came from
+
+	RequestID string `json:"request_id,omitempty"` // Request ID of the operation that caused the event, empty if it has none
+}
+
+// NotifyFunc receives an event of the node with ID publisher. It runs on the message loop,
+// so it should hand slow work off rather than block.
+type NotifyFunc func(publisher string, ev NotifyEvent)
+
+// MessageSubscribe asks a node to send its notifications, starting with those the subscriber
+// has not acknowledged yet. Subscribers send it again after every reconnect.
+type MessageSubscribe struct {
+	NodeID string // ID of the subscribing node, under which its cursor is kept
+}
+
+// MessageNotify carries notification events, in sequence order, to a subscriber.
+type MessageNotify struct {
+	NodeID string        // ID of the publishing node
+	Events []NotifyEvent // Events the subscriber has not acknowledged
+}
+
+// MessageNotifyAck tells the publisher the highest sequence a subscriber has processed.
+type MessageNotifyAck struct {
+	NodeID string // ID of the subscribing node
+	Seq    uint64 // Highest sequence processed
+}
+
+// notifyLog is a node's outgoing notification log and the position every subscriber has
+// acknowledged. Events are kept until every subscriber acknowledged them, or until the log
+// grows beyond maxEvents or maxAge; subscribers that miss dropped events are sent a gap.
+// The log is persisted after every change so undelivered events survive a restart.
+type notifyLog struct {
+	clock     clock.Clock // Times the events
+	mu        sync.Mutex
+	path      string            // Location of the persisted log, empty until load is called
+	maxEvents int               // Most events kept
+	maxAge    time.Duration     // Oldest event kept
+	next      uint64            // Sequence of the next event
+	events    []NotifyEvent     // Retained events in sequence order
+	cursors   map[string]uint64 // Highest acknowledged sequence by subscriber node ID
+	online    map[string]string // Address of the connection of every subscriber receiving live events, by node ID
+}
+
+// savedNotifyLog is the persisted form of a notifyLog.
+type savedNotifyLog struct {
+	Next    uint64            `json:"next"`
+	Events  []NotifyEvent     `json:"events"`
+	Cursors map[string]uint64 `json:"cursors"`
+}
+
+// newNotifyLog returns an empty log that is not persisted until load is called.
+func newNotifyLog(maxEvents int, maxAge time.Duration, clk clock.Clock) *notifyLog {
+	if maxEvents <= 0 {
+		maxEvents = defaultNotifyLogSize
+	}
+	if maxAge <= 0 {
+		maxAge = defaultNotifyLogAge
+	}
+	return &notifyLog{
+		clock:     clock.Or(clk),
+		maxEvents: maxEvents,
+		maxAge:    maxAge,
+		next:      1,
+		cursors:   make(map[string]uint64),
+		online:    make(map[string]string),
+	}
+}
+
+// load attaches the log to path, restoring the events and cursors saved there.
+func (l *notifyLog) load(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+	var saved savedNotifyLog
+	if err := loadJSON(path, "notification log", &saved); err != nil {
+		return err
+	}
+	l.next, l.events = max(saved.Next, 1), saved.Events
+	for id, seq := range saved.Cursors {
+		l.cursors[id] = seq
+	}
+	return nil
+}
+
+// subscribeLocked registers a subscriber; the caller must hold mu. New subscribers start with
+// the next event.
+func (l *notifyLog) subscribeLocked(id string) {
+	if _, ok := l.cursors[id]; !ok {
+		l.cursors[id] = l.next - 1
+		l.saveLocked()
+	}
+}
+
+// appendLocked logs an event for every subscriber, and returns it; the caller must hold mu.
+// Nothing is logged while there are no subscribers.
+func (l *notifyLog) appendLocked(ev NotifyEvent, now time.Time) (NotifyEvent, bool) {
+	if len(l.cursors) == 0 {
+		return NotifyEvent{}, false
+	}
+	ev.Seq, ev.Time = l.next, now
+	l.next++
+	l.events = append(l.events, ev)
+	l.trimLocked(now)
+	l.saveLocked()
+	return ev, true
+}
+
+// ack records that subscriber id processed every event up to seq.
+func (l *notifyLog) ack(id string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cursor, ok := l.cursors[id]
+	if !ok || seq <= cursor {
+		return
+	}
+	l.cursors[id] = min(seq, l.next-1)
+	l.trimLocked(l.clock.Now())
+	l.saveLocked()
+}
+
+// trimLocked drops the events every subscriber acknowledged, then the events beyond the size
+// and age limits; the caller must hold mu.
+func (l *notifyLog) trimLocked(now time.Time) {
+	acked := l.next - 1
+	for _, cursor := range l.cursors {
+		acked = min(acked, cursor)
+	}
+	drop := 0
+	for drop < len(l.events) {
+		ev := l.events[drop]
+		if ev.Seq > acked && len(l.events)-drop <= l.maxEvents && now.Sub(ev.Time) <= l.maxAge {
+			break
+		}
+		drop++
+	}
+	l.events = append([]NotifyEvent(nil), l.events[drop:]...)
+}
+
+// backlogLocked returns the events subscriber id has not acknowledged, led by a gap when some
+// of them were dropped; the caller must hold mu.
+func (l *notifyLog) backlogLocked(id string) []NotifyEvent {
+	cursor := l.cursors[id]
+	first := l.next
+	if len(l.events) > 0 {
+		first = l.events[0].Seq
+	}
+	var backlog []NotifyEvent
+	if cursor+1 < first {
+		backlog = append(backlog, NotifyEvent{Seq: first - 1, Op: NotifyGap, Time: l.clock.Now()})
+	}
+	for _, ev := range l.events {
+		if ev.Seq > cursor {
+			backlog = append(backlog, ev)
+		}
+	}
+	return backlog
+}
+
+// saveLocked saves the retained events and the subscribers' cursors; the caller must hold mu.
+func (l *notifyLog) saveLocked() {
+	if len(l.path) == 0 {
+		return
+	}
+	if err := saveJSON(l.path, savedNotifyLog{Next: l.next, Events: l.events, Cursors: l.cursors}, 0o644); err != nil {
+		log.Printf("persisting notification log to %s: %s", l.path, err)
+	}
+}
+
+// loadNotify attaches the notification log to its file in the storage root.
+func (s *FileServer) loadNotify() error {
+	return s.notify.load(filepath.Join(s.Storage.Root, notifyFileName))
+}
+
+// Watch subscribes this node to the notifications of the bootstrap node at addr. Events are
+// passed to OnNotify in sequence order and acknowledged once it returns. Events logged while
+// this node is offline are replayed when it reconnects, before live events resume; the
+// subscription, like the publisher's log, survives restarts of the publisher, while this
+// node calls Watch again after it restarts.
+//
+// Parameters:
+//   - addr: Configured bootstrap address of the node to watch.
+//
+// Returns: Any errors subscribing to a node that is connected now.
+func (s *FileServer) Watch(addr string) error {
+	s.peerLock.Lock()
+	if !s.isBootstrapNode(addr) {
+		s.peerLock.Unlock()
+		return fmt.Errorf("watching (%s): not a bootstrap node", addr)
+	}
+	s.watching[addr] = true
+	peer, ok := s.bootstrapPeers[addr]
+	s.peerLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.subscribe(peer)
+}
+
+// isBootstrapNode reports whether addr is one of the configured bootstrap nodes or a seed
+// address found since; the caller must hold peerLock.
+func (s *FileServer) isBootstrapNode(addr string) bool {
+	return slices.Contains(s.BootstrapNodes, addr) || s.isSeedLocked(addr)
+}
+
+// subscribe asks the peer for its notifications.
+func (s *FileServer) subscribe(peer p2p.Node) error {
+	_, err := s.sendMessage([]p2p.Node{peer}, &Message{Payload: MessageSubscribe{NodeID: s.ID}})
+	return err
+}
+
+// publish logs an event and sends it to the subscribers that are connected.
+func (s *FileServer) publish(op NotifyOp, key string) {
+	s.publishEvent(NotifyEvent{Op: op, Key: key})
+}
+
+// publishEvent logs ev, numbering and timing it, and sends it to the subscribers receiving
+// live events.
+func (s *FileServer) publishEvent(ev NotifyEvent) {
+	l := s.notify
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ev, ok := l.appendLocked(ev, l.clock.Now())
+	if !ok {
+		return
+	}
+	for id, addr := range l.online {
+		if err := s.notifyLive(addr, ev); err != nil {
+			log.Printf("[%s] notifying (%s): %s", s.Transport.Addr(), addr, err)
+			delete(l.online, id)
+		}
+	}
+}
+
+// sendNotify sends events to the subscriber connected at addr in batches.
+func (s *FileServer) sendNotify(addr string, events []NotifyEvent) error {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", addr)
+	}
+	for len(events) > 0 {
+		n := min(len(events), notifyBatchSize)
+		msg := &Message{Payload: MessageNotify{NodeID: s.ID, Events: events[:n]}}
+		if _, err := s.sendMessage([]p2p.Node{peer}, msg); err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// notifyLive sends a live event to the subscriber connected at addr, packed with the other
+// messages queued for it.
+func (s *FileServer) notifyLive(addr string, ev NotifyEvent) error {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", addr)
+	}
+	return s.sendCoalesced([]p2p.Node{peer}, &Message{Payload: MessageNotify{NodeID: s.ID, Events: []NotifyEvent{ev}}})
+}
+
+// handleMessageSubscribe replays the subscriber's backlog and then sends it live events.
+// Both happen under the log's lock, so no live event overtakes the backlog.
+func (s *FileServer) handleMessageSubscribe(from string, msg MessageSubscribe) error {
+	l := s.notify
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribeLocked(msg.NodeID)
+	delete(l.online, msg.NodeID)
+	if err := s.sendNotify(from, l.backlogLocked(msg.NodeID)); err != nil {
+		return err
+	}
+	l.online[msg.NodeID] = from
+	return nil
+}
+
+// handleMessageNotify passes new events to OnNotify and acknowledges them. Events already
+// processed, which the publisher resends when an acknowledgement was lost, are skipped.
+func (s *FileServer) handleMessageNotify(from string, msg MessageNotify) error {
+	s.peerLock.Lock()
+	last := s.notifySeen[msg.NodeID]
+	s.peerLock.Unlock()
+	for _, ev := range msg.Events {
+		if ev.Seq <= last {
+			continue
+		}
+		if s.OnNotify != nil {
+			s.OnNotify(msg.NodeID, ev)
+		}
+		if s.MirrorAll {
+			s.mirrorNotified(from, msg.NodeID, ev)
+		}
+		last = ev.Seq
+	}
+	s.peerLock.Lock()
+	s.notifySeen[msg.NodeID] = last
+	s.peerLock.Unlock()
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	_, err := s.sendMessage([]p2p.Node{peer}, &Message{Payload: MessageNotifyAck{NodeID: s.ID, Seq: last}})
+	return err
+}
+
+// handleMessageNotifyAck advances the subscriber's cursor.
+func (s *FileServer) handleMessageNotifyAck(msg MessageNotifyAck) error {
+	s.notify.ack(msg.NodeID, msg.Seq)
+	return nil
+}
+
+// dropSubscriber stops sending live events to a subscriber whose connection closed.
+func (s *FileServer) dropSubscriber(addr string) {
+	l := s.notify
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, online := range l.online {
+		if online == addr {
+			delete(l.online, id)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventRecorder collects the events passed to OnNotify.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []NotifyEvent
+}
+
+func (r *eventRecorder) record(publisher string, ev NotifyEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *eventRecorder) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, len(r.events))
+	for i, ev := range r.events {
+		keys[i] = ev.Key
+	}
+	return keys
+}
+
+func TestNotifyLogGapWhenCapExceeded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), notifyFileName)
+	l := newNotifyLog(3, time.Hour, nil)
+	require.NoError(t, l.load(path))
+	l.mu.Lock()
+	l.subscribeLocked("fast")
+	l.subscribeLocked("slow")
+	now := time.Now()
+	for i := 1; i <= 5; i++ {
+		l.appendLocked(NotifyEvent{Op: NotifyStore, Key: fmt.Sprintf("k%d", i)}, now)
+	}
+	l.mu.Unlock()
+	l.ack("fast", 5)
+
+	// The slow subscriber acknowledged nothing and two events were dropped for it.
+	reloaded := newNotifyLog(3, time.Hour, nil)
+	require.NoError(t, reloaded.load(path))
+	backlog := reloaded.backlogLocked("slow")
+	require.Len(t, backlog, 4)
+	assert.Equal(t, NotifyGap, backlog[0].Op)
+	assert.Equal(t, uint64(2), backlog[0].Seq)
+	for i, ev := range backlog[1:] {
+		assert.Equal(t, NotifyStore, ev.Op)
+		assert.Equal(t, uint64(i+3), ev.Seq)
+	}
+	assert.Empty(t, reloaded.backlogLocked("fast"))
+
+	// Acknowledging the gap clears it.
+	reloaded.ack("slow", 2)
+	backlog = reloaded.backlogLocked("slow")
+	require.Len(t, backlog, 3)
+	assert.Equal(t, uint64(3), backlog[0].Seq)
+
+	// Events older than the age limit are dropped as well.
+	reloaded.mu.Lock()
+	reloaded.maxAge = time.Minute
+	reloaded.appendLocked(NotifyEvent{Op: NotifyStore, Key: "late"}, now.Add(2*time.Minute))
+	reloaded.mu.Unlock()
+	backlog = reloaded.backlogLocked("slow")
+	require.Len(t, backlog, 2)
+	assert.Equal(t, NotifyGap, backlog[0].Op)
+	assert.Equal(t, "late", backlog[1].Key)
+}
+
+func TestNotifyReplayAfterReconnect(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	var first eventRecorder
+	b.OnNotify = first.record
+	startCluster(t, a, b)
+	require.NoError(t, b.Watch(":4000"))
+	waitFor(t, func() bool {
+		a.notify.mu.Lock()
+		defer a.notify.mu.Unlock()
+		return len(a.notify.online) == 1
+	})
+	require.NoError(t, a.Store("live_0", bytes.NewReader([]byte("x"))))
+	waitFor(t, func() bool { return len(first.keys()) == 1 })
+	waitFor(t, func() bool {
+		a.notify.mu.Lock()
+		defer a.notify.mu.Unlock()
+		return a.notify.cursors[b.ID] == 1
+	})
+
+	// Take b offline, as if it restarted, and store while it is away.
+	b.Stop()
+	for _, peer := range b.peerList() {
+		require.NoError(t, peer.Close())
+	}
+	waitFor(t, func() bool { return len(a.peerList()) == 0 })
+	var missed []string
+	for i := 1; i <= 5; i++ {
+		missed = append(missed, fmt.Sprintf("offline_%d", i))
+		require.NoError(t, a.Store(missed[len(missed)-1], bytes.NewReader([]byte("x"))))
+	}
+
+	// The restarted subscriber gets the backlog in order, then live events.
+	c := makeServer(t, ":4001", ":4000")
+	c.ID = b.ID
+	var second eventRecorder
+	c.OnNotify = second.record
+	require.NoError(t, c.Watch(":4000"))
+	startCluster(t, c)
+	waitFor(t, func() bool { return len(second.keys()) == len(missed) })
+	require.NoError(t, a.Store("live_1", bytes.NewReader([]byte("x"))))
+	waitFor(t, func() bool { return len(second.keys()) == len(missed)+1 })
+
+	assert.Equal(t, append(missed, "live_1"), second.keys())
+	second.mu.Lock()
+	for i, ev := range second.events {
+		assert.Equal(t, uint64(i+2), ev.Seq)
+	}
+	second.mu.Unlock()
+	waitFor(t, func() bool {
+		a.notify.mu.Lock()
+		defer a.notify.mu.Unlock()
+		return a.notify.cursors[b.ID] == 7 && len(a.notify.events) == 0
+	})
+}
+
+func TestNotifyLogDropsOldEvents(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	l := newNotifyLog(100, time.Hour, clk)
+	l.mu.Lock()
+	l.subscribeLocked("slow")
+	l.appendLocked(NotifyEvent{Op: NotifyStore, Key: "k1"}, clk.Now())
+	clk.Advance(30 * time.Minute)
+	l.appendLocked(NotifyEvent{Op: NotifyStore, Key: "k2"}, clk.Now())
+	l.mu.Unlock()
+
+	// Once the first event is older than the log keeps, the subscriber is sent a gap in its place.
+	clk.Advance(30*time.Minute + time.Second)
+	l.mu.Lock()
+	l.appendLocked(NotifyEvent{Op: NotifyStore, Key: "k3"}, clk.Now())
+	backlog := l.backlogLocked("slow")
+	l.mu.Unlock()
+	require.Len(t, backlog, 3)
+	assert.Equal(t, NotifyGap, backlog[0].Op)
+	assert.Equal(t, clk.Now(), backlog[0].Time)
+	assert.Equal(t, []string{"k2", "k3"}, []string{backlog[1].Key, backlog[2].Key})
+}
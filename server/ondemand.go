@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// onDemandDialTimeout bounds how long a fetch waits for a node it dials to complete the
+	// handshake.
+	onDemandDialTimeout = 2 * time.Second
+	// maxHolderEntries bounds the objects whose holders are remembered.
+	maxHolderEntries = 1 << 16
+)
+
+// directory is the advertised address of every node this node has heard of, by node ID. It
+// is learnt from the handshakes of peers, which advertise their own address and those of the
+// nodes they are connected to.
+type directory struct {
+	mu    sync.Mutex
+	addrs map[string]string // Advertised address by node ID
+}
+
+// newDirectory returns an empty directory.
+func newDirectory() *directory {
+	return &directory{addrs: make(map[string]string)}
+}
+
+// learn records the addresses a peer advertised in its handshake. The address a node
+// advertises itself replaces any other; those relayed for other nodes only fill gaps.
+func (d *directory) learn(hello p2p.HelloFrame) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, addr := range hello.Peers {
+		if _, ok := d.addrs[id]; !ok && len(id) > 0 && len(addr) > 0 {
+			d.addrs[id] = addr
+		}
+	}
+	if len(hello.NodeID) > 0 && len(hello.AdvertiseAddr) > 0 {
+		d.addrs[hello.NodeID] = hello.AdvertiseAddr
+	}
+}
+
+// addr returns the advertised address of a node.
+func (d *directory) addr(id string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addr, ok := d.addrs[id]
+	return addr, ok
+}
+
+// holderTable remembers the nodes this node sent replicas of its objects to, so a fetch
+// knows whom to dial when it is connected to none of them.
+type holderTable struct {
+	mu      sync.Mutex
+	entries map[string][]string // Node IDs by hashed key
+}
+
+// newHolderTable returns an empty table.
+func newHolderTable() *holderTable {
+	return &holderTable{entries: make(map[string][]string)}
+}
+
+// add records that a node was sent a replica of an object. Once maxHolderEntries objects are
+// remembered an arbitrary one is forgotten to make room.
+func (t *holderTable) add(key string, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids, ok := t.entries[key]
+	if slices.Contains(ids, id) {
+		return
+	}
+	if !ok && len(t.entries) >= maxHolderEntries {
+		for k := range t.entries {
+			delete(t.entries, k)
+			break
+		}
+	}
+	t.entries[key] = append(ids, id)
+}
+
+// nodes returns the nodes sent a replica of an object.
+func (t *holderTable) nodes(key string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.entries[key])
+}
+
+// forget drops the holders of a deleted object.
+func (t *holderTable) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// replicaSent records that a peer received a replica.
+func (s *FileServer) replicaSent(peer p2p.Node, rep replica) {
+	if rep.id == s.ID {
+		s.holders.add(rep.key, peer.Hello().NodeID)
+	}
+}
+
+// peerAddrs returns the advertised address of every connected peer, by node ID, for the
+// handshakes of new peers.
+func (s *FileServer) peerAddrs() map[string]string {
+	addrs := make(map[string]string)
+	for _, peer := range s.peerList() {
+		if hello := peer.Hello(); len(hello.AdvertiseAddr) > 0 {
+			addrs[hello.NodeID] = hello.AdvertiseAddr
+		}
+	}
+	return addrs
+}
+
+// dialHolders connects to the nodes known to hold one of this node's objects, because they
+// were sent a replica of it or it is pinned to them, that this node has no connection to.
+// Nothing is dialed unless DialOnDemand is set. The connections are kept off replication
+// until they are released.
+//
+// Returns: The connections dialed, to be passed to releaseDialed once the fetch is done.
+func (s *FileServer) dialHolders(hashedKey string) []p2p.Node {
+	if !s.DialOnDemand {
+		return nil
+	}
+	ids := append(s.holders.nodes(hashedKey), s.pins.nodes(objectRef{owner: s.ID, key: hashedKey})...)
+	slices.Sort(ids)
+	connected, _ := s.nodesByID()
+	var dialed []p2p.Node
+	for _, id := range slices.Compact(ids) {
+		if _, ok := connected[id]; ok || id == s.ID {
+			continue
+		}
+		if _, banned := s.bans.banned(id, "", s.Clock.Now()); banned {
+			continue
+		}
+		addr, ok := s.directory.addr(id)
+		if !ok {
+			continue
+		}
+		peer, err := s.dialNode(id, addr)
+		if err != nil {
+			log.Printf("[%s] dialing holder (%s) of (%s): %s", s.Transport.Addr(), addr, hashedKey, err)
+			continue
+		}
+		s.metrics.onDemandDials.Add(1)
+		dialed = append(dialed, peer)
+	}
+	return dialed
+}
+
+// dialNode dials a node and waits for it to complete the handshake.
+//
+// Returns: The connection to the node, marked fetch-only, and any errors.
+func (s *FileServer) dialNode(id string, addr string) (p2p.Node, error) {
+	connected := make(chan p2p.Node, 1)
+	s.peerLock.Lock()
+	if _, ok := s.dialing[id]; ok {
+		s.peerLock.Unlock()
+		return nil, fmt.Errorf("node %s is already being dialed", id)
+	}
+	s.dialing[id] = connected
+	s.peerLock.Unlock()
+	defer func() {
+		s.peerLock.Lock()
+		if s.dialing[id] == connected {
+			delete(s.dialing, id)
+		}
+		s.peerLock.Unlock()
+	}()
+	if err := s.Transport.Dial(addr); err != nil {
+		return nil, err
+	}
+	select {
+	case peer := <-connected:
+		return peer, nil
+	case <-s.Clock.After(onDemandDialTimeout):
+		return nil, fmt.Errorf("no handshake within %s", onDemandDialTimeout)
+	}
+}
+
+// claimDialedLocked hands a new peer to the fetch that dialed it, if any, marking the connection
+// fetch-only; the caller must hold peerLock.
+func (s *FileServer) claimDialedLocked(p p2p.Node) {
+	connected, ok := s.dialing[p.Hello().NodeID]
+	if !ok {
+		return
+	}
+	delete(s.dialing, p.Hello().NodeID)
+	s.fetchOnly[p.RemoteAddr().String()] = true
+	connected <- p
+}
+
+// releaseDialed ends the fetch the connections were dialed for. They are closed if
+// EphemeralDials is set or keeping them would take the node past MaxPeers; otherwise they
+// become peers like any other.
+func (s *FileServer) releaseDialed(dialed []p2p.Node) {
+	for _, peer := range dialed {
+		s.peerLock.Lock()
+		keep := !s.EphemeralDials && (s.MaxPeers <= 0 || len(s.peers) <= s.MaxPeers)
+		if keep {
+			delete(s.fetchOnly, peer.RemoteAddr().String())
+		}
+		s.peerLock.Unlock()
+		if !keep {
+			peer.Close()
+		}
+	}
+}
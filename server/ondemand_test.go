@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// disconnectHolder stores key on a, replicated to b, then drops the connection between them
+// for good and a's local copy, so a can only get the key from b by dialing it.
+func disconnectHolder(t *testing.T, a *FileServer, b *FileServer, key string, data []byte) {
+	t.Helper()
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+
+	// b dialed a, and would redial it were it not marked as gone.
+	b.peerLock.Lock()
+	b.departed[a.Transport.Addr()] = true
+	b.peerLock.Unlock()
+	for _, peer := range a.peerList() {
+		peer.Close()
+	}
+	waitFor(t, func() bool { return len(a.peerList()) == 0 && len(b.peerList()) == 0 })
+}
+
+func TestGetDialsHolderOnDemand(t *testing.T) {
+	for name, tt := range map[string]struct {
+		ephemeral bool
+		maxPeers  int
+		other     bool // Whether a is connected to another node, holding no replica, when it gets the key
+		kept      bool
+	}{
+		"kept":      {kept: true},
+		"ephemeral": {ephemeral: true},
+		"max peers": {maxPeers: 1, other: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			network := p2p.NewMemoryNetwork(1)
+			a := makeMemoryServer(t, network, ":4000")
+			a.DialOnDemand = true
+			a.EphemeralDials = tt.ephemeral
+			a.MaxPeers = tt.maxPeers
+			b := makeMemoryServer(t, network, ":4001", ":4000")
+			startCluster(t, a, b)
+			waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+			data := randomData(t, 1<<10)
+			disconnectHolder(t, a, b, "key", data)
+			peers := 0
+			if tt.other {
+				startCluster(t, makeMemoryServer(t, network, ":4002", ":4000"))
+				waitFor(t, func() bool { return len(a.peerList()) == 1 })
+				peers = 1
+			}
+
+			r, err := a.Get("key")
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			assert.EqualValues(t, 1, a.Metrics()["on_demand_dials"])
+			if tt.kept {
+				assert.Len(t, a.peerList(), peers+1, "the connection should be kept as a peer")
+			} else {
+				waitFor(t, func() bool { return len(a.fetchPeers()) == peers })
+				assert.Len(t, a.peerList(), peers)
+			}
+		})
+	}
+}
+
+func TestGetWithoutDialOnDemand(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+	disconnectHolder(t, a, b, "key", randomData(t, 1<<10))
+
+	_, err := a.Get("key")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Zero(t, a.Metrics()["on_demand_dials"])
+}
+
+func TestHelloRelaysPeerAddresses(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	b := makeMemoryServer(t, network, ":4001")
+	c := makeMemoryServer(t, network, ":4002", ":4001")
+	startCluster(t, b, c)
+	waitFor(t, func() bool { return len(b.peerList()) == 1 && len(c.peerList()) == 1 })
+
+	// a only connects to c, which tells it where b is.
+	a := makeMemoryServer(t, network, ":4000", ":4002")
+	startCluster(t, a)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+	addr, ok := a.directory.addr(b.ID)
+	require.True(t, ok)
+	assert.Equal(t, ":4001", addr)
+	addr, ok = a.directory.addr(c.ID)
+	require.True(t, ok)
+	assert.Equal(t, ":4002", addr)
+}
@@ -0,0 +1,773 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// rangeChunkSize is the number of object bytes requested from one peer at a time by a
+// parallel download.
+const rangeChunkSize = 1 << 20
+
+// rangeChunkDeadline is how long a parallel download waits for a chunk before also asking
+// another source for it.
+const rangeChunkDeadline = 2 * time.Second
+
+// rangeDrainTimeout is how long a finished parallel download waits for its sources to end the
+// answers still in flight before closing the connections of those that do not.
+const rangeDrainTimeout = 2 * time.Second
+
+// locateTimeout is how long a parallel download waits for peers to say whether they hold the
+// object.
+const locateTimeout = 2 * time.Second
+
+// MessageGetRange requests a byte range of a stored object. The peer answers with an
+// objectHeader describing the whole object followed by the bytes of the range in chunks, or
+// with a header marking the object missing. A request for zero bytes only asks whether the
+// peer holds the object.
+type MessageGetRange struct {
+	ID        string // Identifier of the node owning the object
+	Key       string // Hashed key of the object
+	Offset    int64  // Position of the first byte of the range
+	Length    int64  // Number of bytes in the range; bytes past the end of the object are left out
+	RequestID uint64 // Identifier a MessageCancel names the request by
+	Namespace string // Namespace of the key, empty if it has none
+}
+
+// rangeLength returns the number of bytes of an object of size bytes that a range request for
+// length bytes at offset is answered with.
+func rangeLength(size int64, offset int64, length int64) int64 {
+	if offset >= size {
+		return 0
+	}
+	return min(length, size-offset)
+}
+
+// peerStats holds the rate at which each peer recently delivered the objects fetched from
+// it, used to pick the sources of a parallel download.
+type peerStats struct {
+	mu       sync.Mutex         // Guards rates and degraded
+	rates    map[string]float64 // Bytes per second by peer address, smoothed over recent fetches
+	degraded map[string]bool    // Peers that reported a degraded disk, by address
+}
+
+// record folds a fetch of n bytes that took d into the peer's rate.
+func (p *peerStats) record(addr string, n int64, d time.Duration) {
+	if n <= 0 || d <= 0 {
+		return
+	}
+	rate := float64(n) / d.Seconds()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rates == nil {
+		p.rates = make(map[string]float64)
+	}
+	if old, ok := p.rates[addr]; ok {
+		rate = 0.7*old + 0.3*rate
+	}
+	p.rates[addr] = rate
+}
+
+// drop forgets the rate of a peer that disconnected.
+func (p *peerStats) drop(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.rates, addr)
+	delete(p.degraded, addr)
+}
+
+// setDegraded records whether a peer reported a degraded disk.
+//
+// Returns: Whether the peer was not known to be degraded before and is now.
+func (p *peerStats) setDegraded(addr string, degraded bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !degraded {
+		delete(p.degraded, addr)
+		return false
+	}
+	if p.degraded == nil {
+		p.degraded = make(map[string]bool)
+	}
+	was := p.degraded[addr]
+	p.degraded[addr] = true
+	return !was
+}
+
+// snapshot returns the rate of every measured peer in whole bytes per second, by address, or
+// nil if none was measured.
+func (p *peerStats) snapshot() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.rates) == 0 {
+		return nil
+	}
+	rates := make(map[string]int64, len(p.rates))
+	for addr, rate := range p.rates {
+		rates[addr] = int64(rate)
+	}
+	return rates
+}
+
+// fastest returns at most k of the peers, fastest first. Peers not measured yet rank ahead of
+// the others so that they get measured, and peers that reported a degraded disk behind all.
+func (p *peerStats) fastest(peers []p2p.Node, k int) []p2p.Node {
+	p.mu.Lock()
+	rates := make([]float64, len(peers))
+	known := make([]bool, len(peers))
+	degraded := make([]bool, len(peers))
+	for i, peer := range peers {
+		rates[i], known[i] = p.rates[peer.RemoteAddr().String()]
+		degraded[i] = p.degraded[peer.RemoteAddr().String()]
+	}
+	p.mu.Unlock()
+	order := make([]int, len(peers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if degraded[a] != degraded[b] {
+			return !degraded[a]
+		}
+		if known[a] != known[b] {
+			return !known[a]
+		}
+		return rates[a] > rates[b]
+	})
+	ranked := make([]p2p.Node, 0, min(k, len(peers)))
+	for _, i := range order[:min(k, len(peers))] {
+		ranked = append(ranked, peers[i])
+	}
+	return ranked
+}
+
+// getParallel fetches an object from up to GetParallelism of the peers holding it at once,
+// each sending different chunks, then decrypts it into local storage. Peers hold identical
+// encrypted bytes, so the chunks are written at their offsets into a temporary file that is
+// verified against the object's checksum as a whole. A chunk a source takes longer than
+// rangeChunkDeadline to deliver is also requested from another source, and the chunks of a
+// source that fails go back to the others. Peers that do not support range requests are not
+// asked; when none of the others holds the object it is fetched whole instead.
+//
+// Parameters:
+//   - t: Transfer the fetch is reported to.
+//   - key: Plain key of the object.
+//   - hashedKey: Key the object is held under on peers.
+//
+// Returns: The object's description and content, and any errors; a *FetchError when no peer
+// served the object.
+func (s *FileServer) getParallel(t *transfer, key string, hashedKey string) (ObjectInfo, io.ReadCloser, error) {
+	// The timeout runs from the start, so a fetch waiting for its turn to ask peers that
+	// answer by order gives up like one waiting for their answers.
+	began := s.Clock.Now()
+	timer := s.Clock.NewTimer(locateTimeout)
+	defer timer.Stop()
+	outcomes := newFetchOutcomes(key, began)
+	targets := s.fetchPeers()
+	// Sources that cannot route answers to requests by ID answer in the order they were asked,
+	// so no other fetch may ask them until every one of them finished answering.
+	_, ordered := s.peersWith(targets, func(c peerCaps) bool { return c.replies || !c.ranges })
+	if len(ordered) > 0 {
+		select {
+		case s.fetchTurn <- struct{}{}:
+		case <-t.done():
+			return ObjectInfo{}, nil, t.err()
+		case <-timer.C():
+			outcomes.broadcast(targets, nil, began)
+			return ObjectInfo{}, nil, outcomes.err(s.Clock.Now())
+		}
+	}
+	release := func() {
+		if len(ordered) > 0 {
+			<-s.fetchTurn
+		}
+	}
+	located := make(chan locateResult, 1)
+	abandoned := make(chan struct{})
+	go func() {
+		sources, legacy, err := s.locate(t.requestID(), key, hashedKey, targets, abandoned, outcomes)
+		if err == nil && len(sources) == 0 && !legacy {
+			ferr := outcomes.err(s.Clock.Now())
+			if ferr.NotFound() {
+				s.negCache.add(negativeKey(s.ID, hashedKey))
+			}
+			err = ferr
+		}
+		if err != nil || len(sources) == 0 {
+			release()
+		}
+		located <- locateResult{sources: sources, err: err}
+	}()
+	// releaseLocate gives up the answers of a locate the caller stopped waiting for, and frees
+	// the turn once the locate is over.
+	releaseLocate := func() {
+		close(abandoned)
+		go func() {
+			if res := <-located; len(res.sources) > 0 {
+				release()
+			}
+		}()
+	}
+	var sources []rangeSource
+	select {
+	case res := <-located:
+		if res.err != nil {
+			return ObjectInfo{}, nil, res.err
+		}
+		if len(res.sources) == 0 {
+			return s.fetchWhole(t, key, hashedKey)
+		}
+		sources = res.sources
+	case <-t.done():
+		releaseLocate()
+		return ObjectInfo{}, nil, t.err()
+	case <-timer.C():
+		releaseLocate()
+		return ObjectInfo{}, nil, outcomes.err(s.Clock.Now())
+	}
+
+	peers := make([]p2p.Node, len(sources))
+	for i, src := range sources {
+		peers[i] = src.peer
+	}
+	peers = s.peerStats.fastest(peers, s.GetParallelism)
+	d, err := s.newRangeDownload(t, key, hashedKey, sources[0].header, peers)
+	if err != nil {
+		release()
+		return ObjectInfo{}, nil, err
+	}
+	fetched := make(chan error, 1)
+	s.fetches.Add(1)
+	go func() {
+		fetched <- d.run()
+		// Sources still answering are cancelled, and the turn is held until they are done.
+		go func() {
+			defer s.fetches.Done()
+			defer release()
+			d.drain()
+		}()
+	}()
+	err = <-fetched
+	if err == nil {
+		err = s.storeDownload(key, d)
+	}
+	if rerr := errors.Join(d.file.Close(), os.Remove(d.file.Name())); rerr != nil {
+		s.logf(t.requestID(), "removing the temporary copy of (%s): %s", key, rerr)
+	}
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	s.logf(t.requestID(), "received (%d) bytes of (%s) over the network from %d peers", d.size, key, len(peers))
+	return s.serveFetched(t.requestID(), key, remoteSource(d.suppliers(), s.Clock.Since(began), d.size))
+}
+
+// locateResult is the outcome of locate. The turn getParallel took, if any, is still held
+// when sources are found.
+type locateResult struct {
+	sources []rangeSource // Peers holding the object
+	err     error         // Why the object could not be located
+}
+
+// rangeSource is a peer holding an object, with the header it described the object with.
+type rangeSource struct {
+	peer   p2p.Node     // Peer holding the object
+	header objectHeader // Size and checksum of the peer's copy
+}
+
+// locate asks the peers supporting range requests whether they hold an object, with a range
+// request for zero bytes. Copies whose size or checksum disagree with the first copy found are
+// left out, since their chunks cannot be combined with its. Peers without CapReplies answer
+// by order, so fetchTurn must be held if any are asked.
+//
+// Parameters:
+//   - rid: Request ID of the get.
+//   - key: Plain key of the object.
+//   - hashedKey: Key the object is held under on peers.
+//   - targets: Peers that may hold the object.
+//   - abandoned: Closed once the answers not in yet are given up.
+//   - outcomes: Records how every peer asked that does not hold the object answered.
+//
+// Returns: The peers holding the object, whether some peers were not asked for lack of range
+// requests, and any errors.
+func (s *FileServer) locate(rid string, key string, hashedKey string, targets []p2p.Node, abandoned <-chan struct{}, outcomes *fetchOutcomes) ([]rangeSource, bool, error) {
+	id := s.nextRequestID()
+	msg := Message{Payload: MessageGetRange{ID: s.ID, Key: hashedKey, RequestID: id, Namespace: keyNamespace(key)}, RequestID: rid, ReplyID: id}
+	rangePeers, legacy := s.peersWith(targets, func(c peerCaps) bool { return c.ranges })
+	sent := s.Clock.Now()
+	peers, err := s.sendMessage(rangePeers, &msg)
+	var berr *BroadcastError
+	if err != nil && !errors.As(err, &berr) {
+		return nil, false, err
+	}
+	if berr != nil {
+		s.logf(rid, "locating (%s): %s", hashedKey, berr)
+	}
+	outcomes.broadcast(rangePeers, berr, sent)
+	var sources []rangeSource
+	for _, peer := range peers {
+		stream := s.awaitAnswer(peer, id, abandoned)
+		if stream == nil {
+			// Left to time out.
+			continue
+		}
+		var header objectHeader
+		err := binary.Read(stream, binary.LittleEndian, &header)
+		stream.Close()
+		if err != nil {
+			s.logf(rid, "reading response from (%s): %s", peer.RemoteAddr(), err)
+			outcomes.failed(peer, err, s.Clock.Now())
+			continue
+		}
+		if !header.Found {
+			outcomes.missed(peer, header, s.Clock.Now())
+			continue
+		}
+		if len(sources) > 0 && header != sources[0].header {
+			s.logf(rid, "copy of (%s) on (%s) differs from the one on (%s), leaving it out", hashedKey, peer.RemoteAddr(), sources[0].peer.RemoteAddr())
+			continue
+		}
+		sources = append(sources, rangeSource{peer: peer, header: header})
+	}
+	return sources, len(legacy) > 0, nil
+}
+
+// storeDownload verifies the assembled object against its checksum and decrypts it into local
+// storage, dropping the partial copy if that fails.
+func (s *FileServer) storeDownload(key string, d *rangeDownload) error {
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(d.file, 0, d.size)); err != nil {
+		return err
+	}
+	if err := d.header.verify(sum); err != nil {
+		return fmt.Errorf("assembling (%s): %w", key, err)
+	}
+	if _, err := s.Storage.WriteDecrypt(s.dataCipher(key), s.ID, key, io.NewSectionReader(d.file, 0, d.size)); err != nil {
+		if derr := s.Storage.Delete(s.ID, key); derr != nil {
+			log.Printf("[%s] discarding partial (%s): %s", s.Transport.Addr(), key, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// rangeDownload schedules the chunks of one object across the sources of a parallel download.
+// Each source has a worker fetching one chunk at a time, so its answers arrive in the order
+// they were requested.
+type rangeDownload struct {
+	s         *FileServer
+	t         *transfer         // Transfer the download is reported to
+	hashedKey string            // Key the object is held under on peers
+	namespace string            // Namespace of the plain key, declared with every range request
+	header    objectHeader      // Size and checksum of the object
+	size      int64             // Number of encrypted bytes in the object
+	file      *os.File          // Temporary file the chunks are written into
+	peers     []p2p.Node        // Sources, fastest first
+	mu        sync.Mutex        // Guards the fields below
+	wake      *sync.Cond        // Signalled when a chunk is queued, the download ends or a worker stops
+	queue     []int             // Chunks waiting for a source, by index
+	done      []bool            // Whether each chunk is written
+	left      int               // Chunks not written yet
+	inFlight  map[int][]request // Requests answering each chunk
+	workers   int               // Workers still fetching
+	err       error             // Why the download failed, nil while it may go on
+	stopped   chan struct{}     // Closed once every worker returned
+	used      map[string]bool   // Addresses of the sources that supplied a chunk
+}
+
+// request is a range request sent to a source.
+type request struct {
+	peer    p2p.Node  // Source asked for the chunk
+	id      uint64    // Identifier a MessageCancel names the request by
+	started time.Time // When the request was sent
+	retried bool      // Whether the chunk was also requested from another source
+}
+
+// newRangeDownload prepares the download of an object described by header from peers.
+func (s *FileServer) newRangeDownload(t *transfer, key string, hashedKey string, header objectHeader, peers []p2p.Node) (*rangeDownload, error) {
+	file, err := s.Storage.CreateTemp()
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(header.Size); err != nil {
+		return nil, errors.Join(err, file.Close(), os.Remove(file.Name()))
+	}
+	chunks := int((header.Size + rangeChunkSize - 1) / rangeChunkSize)
+	d := &rangeDownload{
+		s:         s,
+		t:         t,
+		hashedKey: hashedKey,
+		namespace: keyNamespace(key),
+		header:    header,
+		size:      header.Size,
+		file:      file,
+		peers:     peers,
+		done:      make([]bool, chunks),
+		left:      chunks,
+		inFlight:  make(map[int][]request),
+		stopped:   make(chan struct{}),
+		used:      make(map[string]bool),
+	}
+	d.wake = sync.NewCond(&d.mu)
+	for i := 0; i < chunks; i++ {
+		d.queue = append(d.queue, i)
+	}
+	return d, nil
+}
+
+// run fetches every chunk, returning once the object is assembled or cannot be.
+func (d *rangeDownload) run() error {
+	d.t.phase(TransferFetch, d.peers[0].RemoteAddr().String(), d.size)
+	var wg sync.WaitGroup
+	d.workers = len(d.peers)
+	for _, peer := range d.peers {
+		wg.Add(1)
+		go func(peer p2p.Node) {
+			defer wg.Done()
+			d.work(peer)
+		}(peer)
+	}
+	go func() {
+		wg.Wait()
+		close(d.stopped)
+	}()
+	watched := make(chan struct{})
+	go d.watch(watched)
+	defer close(watched)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.left > 0 && d.err == nil {
+		d.wake.Wait()
+	}
+	if d.left == 0 {
+		return nil
+	}
+	return fmt.Errorf("fetching (%s): %w", d.hashedKey, d.err)
+}
+
+// watch requests again the chunks a source takes too long with and stops the download when the
+// transfer is cancelled, until done is closed.
+func (d *rangeDownload) watch(done <-chan struct{}) {
+	ticker := d.s.Clock.NewTicker(rangeChunkDeadline / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-d.t.done():
+			d.fail(d.t.err())
+			return
+		case <-ticker.C():
+		}
+		d.mu.Lock()
+		for chunk, reqs := range d.inFlight {
+			if len(reqs) != 1 || reqs[0].retried || d.s.Clock.Since(reqs[0].started) < rangeChunkDeadline {
+				continue
+			}
+			reqs[0].retried = true
+			log.Printf("[%s] chunk %d of (%s) is late from (%s), asking another source", d.s.Transport.Addr(), chunk, d.hashedKey, reqs[0].peer.RemoteAddr())
+			d.queue = append([]int{chunk}, d.queue...)
+		}
+		d.mu.Unlock()
+		d.wake.Broadcast()
+	}
+}
+
+// fail stops the download with err unless it already ended.
+func (d *rangeDownload) fail(err error) {
+	d.mu.Lock()
+	if d.err == nil && d.left > 0 {
+		d.err = err
+	}
+	d.mu.Unlock()
+	d.wake.Broadcast()
+}
+
+// work fetches chunks from one source until none are left or the source fails.
+func (d *rangeDownload) work(peer p2p.Node) {
+	defer func() {
+		d.mu.Lock()
+		d.workers--
+		if d.workers == 0 && d.left > 0 && d.err == nil {
+			d.err = errors.New("every source failed")
+		}
+		d.mu.Unlock()
+		d.wake.Broadcast()
+	}()
+	for {
+		chunk, req, ok := d.next(peer)
+		if !ok {
+			return
+		}
+		offset := int64(chunk) * rangeChunkSize
+		length := min(rangeChunkSize, d.size-offset)
+		data, err := d.s.fetchRange(peer, d.t.requestID(), d.namespace, d.hashedKey, offset, length, req.id, d.header)
+		if errors.Is(err, errStreamTruncated) {
+			// Another source delivered the chunk first and this one was cancelled.
+			d.finish(chunk, req, nil)
+			continue
+		}
+		if err != nil {
+			d.s.logf(d.t.requestID(), "fetching chunk %d of (%s) from (%s): %s", chunk, d.hashedKey, peer.RemoteAddr(), err)
+			d.finish(chunk, req, nil)
+			return
+		}
+		d.s.peerStats.record(peer.RemoteAddr().String(), length, d.s.Clock.Since(req.started))
+		if err := d.finish(chunk, req, data); err != nil {
+			d.fail(err)
+			return
+		}
+	}
+}
+
+// next waits for a chunk this source can fetch and records the request for it.
+//
+// Returns: The chunk, its request, and false once the download ended.
+func (d *rangeDownload) next(peer p2p.Node) (int, request, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if d.left == 0 || d.err != nil {
+			return 0, request{}, false
+		}
+		for i, chunk := range d.queue {
+			if d.done[chunk] || d.asked(chunk, peer) {
+				continue
+			}
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			req := request{peer: peer, id: d.s.nextRequestID(), started: d.s.Clock.Now()}
+			d.inFlight[chunk] = append(d.inFlight[chunk], req)
+			return chunk, req, true
+		}
+		d.wake.Wait()
+	}
+}
+
+// asked reports whether the chunk is already requested from the peer. d.mu must be held.
+func (d *rangeDownload) asked(chunk int, peer p2p.Node) bool {
+	for _, req := range d.inFlight[chunk] {
+		if req.peer == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// finish ends a request for a chunk. When data is not nil and the chunk is not written yet it
+// is written at its offset, and other sources still sending it are cancelled; when data is nil
+// the request failed and the chunk is queued again unless another source is still on it.
+func (d *rangeDownload) finish(chunk int, req request, data []byte) error {
+	d.mu.Lock()
+	var others []request
+	for _, r := range d.inFlight[chunk] {
+		if r.id != req.id {
+			others = append(others, r)
+		}
+	}
+	if len(others) > 0 {
+		d.inFlight[chunk] = others
+	} else {
+		delete(d.inFlight, chunk)
+	}
+	if d.done[chunk] || d.err != nil {
+		d.mu.Unlock()
+		return nil
+	}
+	if data == nil {
+		if len(others) == 0 {
+			d.queue = append([]int{chunk}, d.queue...)
+		}
+		d.mu.Unlock()
+		d.wake.Broadcast()
+		return nil
+	}
+	if _, err := d.file.WriteAt(data, int64(chunk)*rangeChunkSize); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.done[chunk] = true
+	d.left--
+	d.used[req.peer.RemoteAddr().String()] = true
+	d.mu.Unlock()
+	d.wake.Broadcast()
+	d.t.add(len(data))
+	for _, r := range others {
+		go d.s.cancelRequest([]p2p.Node{r.peer}, r.id)
+	}
+	return nil
+}
+
+// drain cancels the requests still in flight once the download ended and waits for the workers
+// to return. Connections whose answers do not end within rangeDrainTimeout are closed, since
+// their streams cannot be resynchronised.
+func (d *rangeDownload) drain() {
+	d.mu.Lock()
+	var pending []request
+	for _, reqs := range d.inFlight {
+		pending = append(pending, reqs...)
+	}
+	d.mu.Unlock()
+	for _, req := range pending {
+		d.s.cancelRequest([]p2p.Node{req.peer}, req.id)
+	}
+	select {
+	case <-d.stopped:
+		return
+	case <-d.s.Clock.After(rangeDrainTimeout):
+	}
+	d.mu.Lock()
+	var stuck []p2p.Node
+	for _, reqs := range d.inFlight {
+		for _, req := range reqs {
+			stuck = append(stuck, req.peer)
+		}
+	}
+	d.mu.Unlock()
+	for _, peer := range stuck {
+		log.Printf("[%s] closing (%s), which did not end its answer for (%s)", d.s.Transport.Addr(), peer.RemoteAddr(), d.hashedKey)
+		peer.Close()
+	}
+	<-d.stopped
+}
+
+// suppliers returns the sources that supplied chunks, in the order they rank.
+func (d *rangeDownload) suppliers() []p2p.Node {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var used []p2p.Node
+	for _, peer := range d.peers {
+		if d.used[peer.RemoteAddr().String()] {
+			used = append(used, peer)
+		}
+	}
+	return used
+}
+
+// fetchRange requests length bytes at offset of an object from a peer and reads its answer.
+// The request is sent under streamMu so it is not interleaved with an outgoing stream. An
+// answer that never comes is not given up here: the download's drain closes the connection.
+//
+// Returns: The bytes, and errStreamTruncated if the request was cancelled while answered.
+func (s *FileServer) fetchRange(peer p2p.Node, rid string, ns string, hashedKey string, offset int64, length int64, id uint64, want objectHeader) ([]byte, error) {
+	msg := Message{Payload: MessageGetRange{ID: s.ID, Key: hashedKey, Offset: offset, Length: length, RequestID: id, Namespace: ns}, RequestID: rid, ReplyID: id}
+	s.streamMu.Lock()
+	_, err := s.sendMessage([]p2p.Node{peer}, &msg)
+	s.streamMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	stream := s.awaitAnswer(peer, id, nil)
+	defer stream.Close()
+	var header objectHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if wait, busy := header.busy(); busy {
+		return nil, fmt.Errorf("%w, suggesting to ask again in %s", ErrBusy, wait)
+	}
+	if !header.Found {
+		return nil, errors.New("peer no longer holds the object")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	_, err = io.Copy(buf, streamReader(stream, rangeLength(header.Size, offset, length), s.capsOf(peer).chunked))
+	if err != nil {
+		return nil, err
+	}
+	if header != want {
+		return nil, errors.New("peer's copy of the object changed")
+	}
+	if int64(buf.Len()) != length {
+		return nil, fmt.Errorf("got %d of %d bytes", buf.Len(), length)
+	}
+	return buf.Bytes(), nil
+}
+
+// handleMessageGetRange answers a range request with the bytes of a stored object.
+func (s *FileServer) handleMessageGetRange(from string, q query, msg MessageGetRange) (err error) {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	cancelled := s.serving.begin(from, msg.RequestID)
+	defer s.serving.end(from, msg.RequestID)
+	stream, err := s.openAnswer(peer, q)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, stream.Close())
+	}()
+	if err := s.authorize(from, q.span, OpGet, msg.ID, msg.Namespace, msg.Key); err != nil {
+		return errors.Join(err, binary.Write(stream, binary.LittleEndian, deniedHeader))
+	}
+	// Requests for zero bytes only locate the object, which costs next to nothing to answer.
+	if msg.Length > 0 {
+		release, admitted := s.admitGet(peer, msg.ID, msg.Key)
+		if !admitted {
+			s.logf(q.span, "refused a range of (%s) to (%s) as busy", msg.Key, from)
+			return binary.Write(stream, binary.LittleEndian, busyHeader(s.busyRetryAfter()))
+		}
+		defer release()
+	}
+	ok, err = s.Storage.Has(msg.ID, msg.Key)
+	if err != nil {
+		s.logf(q.span, "could not check local disk for (%s), reporting not found: %s", msg.Key, err)
+	}
+	if !ok {
+		return binary.Write(stream, binary.LittleEndian, objectHeader{})
+	}
+	size, r, err := s.Storage.Read(msg.ID, msg.Key)
+	if err != nil {
+		s.logf(q.span, "could not open (%s), reporting not found: %s", msg.Key, err)
+		return binary.Write(stream, binary.LittleEndian, objectHeader{})
+	}
+	length := rangeLength(size, msg.Offset, msg.Length)
+	if length > 0 {
+		seeker, ok := r.(io.ReadSeekCloser)
+		if !ok {
+			return fmt.Errorf("stored object (%s) cannot be read from an offset", msg.Key)
+		}
+		if _, err := seeker.Seek(msg.Offset, io.SeekStart); err != nil {
+			return errors.Join(err, seeker.Close())
+		}
+	}
+	n, err := writeObjectRange(stream, size, s.objectSum(msg.ID, msg.Key), length, r, cancelled, s.capsOf(peer).chunked)
+	if s.testHookServed != nil && length > 0 {
+		s.testHookServed(msg.Key, n)
+	}
+	if errors.Is(err, errRequestCancelled) {
+		s.metrics.requestsCancelled.Add(1)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("sending a range of (%s) to %s: %w", msg.Key, peer.RemoteAddr(), err)
+	}
+	return nil
+}
+
+// writeObjectRange is writeObject for a range of the object: the header describes the whole
+// object while only length bytes of r follow it.
+func writeObjectRange(w io.Writer, size int64, sum [sha256.Size]byte, length int64, r io.Reader, cancelled *atomic.Bool, chunked bool) (n int64, err error) {
+	if rc, ok := r.(io.Closer); ok {
+		defer func() {
+			err = errors.Join(err, rc.Close())
+		}()
+	}
+	if err := binary.Write(w, binary.LittleEndian, objectHeader{Found: true, Size: size, Sum: sum}); err != nil {
+		return 0, err
+	}
+	return writeStream(w, r, length, cancelled, chunked)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parallelCluster starts a requester at :4000 fetching from up to three of its peers at once
+// and three sources holding a replica of data under key, which the requester does not hold.
+func parallelCluster(t *testing.T, key string, data []byte) (*p2p.MemoryNetwork, *FileServer, []*FileServer) {
+	t.Helper()
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.GetParallelism = 3
+	sources := []*FileServer{
+		makeMemoryServer(t, network, ":4001", ":4000"),
+		makeMemoryServer(t, network, ":4002", ":4000"),
+		makeMemoryServer(t, network, ":4003", ":4000"),
+	}
+	startCluster(t, append([]*FileServer{a}, sources...)...)
+	waitFor(t, func() bool { return len(a.peerList()) == 3 })
+
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+	for _, s := range sources {
+		waitFor(t, func() bool {
+			ok, _ := s.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+	}
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	return network, a, sources
+}
+
+func TestParallelGetAggregatesBandwidth(t *testing.T) {
+	const size = 6 * rangeChunkSize
+	data := randomData(t, size)
+	network, a, sources := parallelCluster(t, "large", data)
+	// Each source takes a while over a chunk, so the requester has every source busy at once.
+	sent := make(map[string]*atomic.Int64)
+	for _, s := range sources {
+		network.Policy.SetLink(s.Transport.Addr(), ":4000", p2p.LinkPolicy{Bandwidth: 8 << 20})
+		n := new(atomic.Int64)
+		sent[s.Transport.Addr()] = n
+		s.testHookServed = func(_ string, bytes int64) { n.Add(bytes) }
+	}
+
+	info, r, err := a.GetWithInfo("large")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	var total int64
+	var suppliers []string
+	for addr, n := range sent {
+		total += n.Load()
+		if n.Load() > 0 {
+			suppliers = append(suppliers, addr)
+		}
+	}
+	stored, err := sources[0].Storage.Stat(a.ID, crypto.HashKey("large"))
+	require.NoError(t, err)
+	assert.Equal(t, stored.Size, total, "every chunk of the stored replica should be sent once")
+	assert.Greater(t, len(suppliers), 1, "chunks should come from more than one source")
+	assert.Len(t, strings.Split(info.Peer, ","), len(suppliers), "every source sending chunks should be named")
+}
+
+func TestParallelGetSurvivesLostSource(t *testing.T) {
+	const size = 8 << 20
+	data := randomData(t, size)
+	network, a, sources := parallelCluster(t, "large", data)
+	for _, s := range sources {
+		network.Policy.SetLink(s.Transport.Addr(), ":4000", p2p.LinkPolicy{Bandwidth: 8 << 20})
+	}
+	// The second source goes away in the middle of the object.
+	network.Policy.SetLink(sources[1].Transport.Addr(), ":4000", p2p.LinkPolicy{Bandwidth: 8 << 20, DisconnectAt: 3 << 19})
+
+	r, err := a.Get("large")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.NoError(t, a.Storage.Verify(a.ID, "large"))
+
+	// The temporary copy is gone once the object is stored.
+	a.fetches.Wait()
+	report, err := a.Storage.Check(a.ID, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.TempFiles)
+}
+
+func TestPeerStatsRankFastestFirst(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	peers := a.peerList()
+	var stats peerStats
+	stats.record(peers[0].RemoteAddr().String(), 1<<20, time.Second)
+	assert.Equal(t, []p2p.Node{peers[1]}, stats.fastest(peers, 1), "peers not measured yet rank first")
+
+	stats.record(peers[1].RemoteAddr().String(), 4<<20, time.Second)
+	assert.Equal(t, []p2p.Node{peers[1], peers[0]}, stats.fastest(peers, 3))
+}
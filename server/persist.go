@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// The tables of the node's state, such as tombstones, aliases, pins and bans, are kept in
+// memory and persisted as JSON files in the storage root. Each starts unpersisted; its load
+// method attaches it to its file, restoring what loadJSON reads there, and from then on its
+// saveLocked method rewrites the file with saveJSON after every change, under the table's
+// mutex. A failed save is logged rather than returned, since the table in memory stays
+// usable and the next change saves it again.
+
+// saveJSON persists v as JSON at path with storage.WriteFileAtomic, so a crash while a table
+// of the node's state is saved leaves either its last saved content or the new one.
+func saveJSON(path string, v any, perm os.FileMode) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(path, b, perm)
+}
+
+// loadJSON decodes the table saved at path by saveJSON into v, leaving v untouched when
+// nothing was saved yet. Decoding errors name the table with what.
+func loadJSON(path string, what string, v any) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("reading %s %s: %w", what, path, err)
+	}
+	return nil
+}
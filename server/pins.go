@@ -0,0 +1,267 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// pinFileName is the file in the storage root holding the placement pins known to this node.
+const pinFileName = ".dfs-pins.json"
+
+// MessagePin tells peers where the sender placed one of its objects. An empty Nodes reverts
+// the object to automatic placement.
+type MessagePin struct {
+	Key   string   // Hashed key of the object
+	Nodes []string // Node IDs holding the object's replicas
+}
+
+// pin records the nodes an object is pinned to.
+type pin struct {
+	Owner string   `json:"owner"` // Identifier of the node owning the object
+	Key   string   `json:"key"`   // Hashed key of the object
+	Nodes []string `json:"nodes"` // Node IDs holding the object's replicas
+}
+
+// pinTable is the pins a node knows of, its own and those its peers announced. It is
+// persisted after every change so placements survive restarts.
+type pinTable struct {
+	mu      sync.Mutex
+	path    string                 // Location of the persisted table, empty until load is called
+	entries map[objectRef][]string // Pinned node IDs by object
+}
+
+// newPinTable returns an empty table that is not persisted until load is called.
+func newPinTable() *pinTable {
+	return &pinTable{entries: make(map[objectRef][]string)}
+}
+
+// load attaches the table to path, restoring the pins saved there.
+func (t *pinTable) load(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	var saved []pin
+	if err := loadJSON(path, "pins", &saved); err != nil {
+		return err
+	}
+	for _, p := range saved {
+		t.entries[objectRef{owner: p.Owner, key: p.Key}] = p.Nodes
+	}
+	return nil
+}
+
+// set pins an object to nodes, or unpins it when nodes is empty.
+func (t *pinTable) set(ref objectRef, nodes []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(nodes) == 0 {
+		delete(t.entries, ref)
+	} else {
+		t.entries[ref] = slices.Clone(nodes)
+	}
+	t.saveLocked()
+}
+
+// nodes returns the node IDs an object is pinned to, nil when it is placed automatically.
+func (t *pinTable) nodes(ref objectRef) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.entries[ref]
+}
+
+// count returns the number of objects pinned to a node.
+func (t *pinTable) count(id string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, nodes := range t.entries {
+		if slices.Contains(nodes, id) {
+			n++
+		}
+	}
+	return n
+}
+
+// saveLocked saves the pins sorted by object; the caller must hold mu.
+func (t *pinTable) saveLocked() {
+	if len(t.path) == 0 {
+		return
+	}
+	saved := make([]pin, 0, len(t.entries))
+	for ref, nodes := range t.entries {
+		saved = append(saved, pin{Owner: ref.owner, Key: ref.key, Nodes: nodes})
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		if saved[i].Owner != saved[j].Owner {
+			return saved[i].Owner < saved[j].Owner
+		}
+		return saved[i].Key < saved[j].Key
+	})
+	if err := saveJSON(t.path, saved, 0o644); err != nil {
+		log.Printf("persisting pins to %s: %s", t.path, err)
+	}
+}
+
+// loadPins attaches the pin table to its file in the storage root.
+func (s *FileServer) loadPins() error {
+	return s.pins.load(filepath.Join(s.Storage.Root, pinFileName))
+}
+
+// Pin places the replicas of one of this node's objects on the given nodes only, in place of
+// every peer. Connected nodes are pushed the object; offline bootstrap nodes are queued to
+// receive it once they reconnect. Later stores of the key replicate to the pinned nodes only,
+// and every peer is told of the pin so the cluster agrees on the placement. Replicas already
+// held by other nodes are kept.
+//
+// Parameters:
+//   - key: Key of an object stored on this node.
+//   - nodeIDs: Nodes holding the replicas: this node, connected peers or bootstrap nodes seen
+//     since the node started.
+//
+// Returns: An error if the object is not stored here or a node is unknown. A *BroadcastError
+// means the pin was recorded and pushed, but the peers it names were not told of it.
+func (s *FileServer) Pin(key string, nodeIDs []string) error {
+	if len(nodeIDs) == 0 {
+		return errors.New("no nodes to pin to")
+	}
+	ok, err := s.Storage.Has(s.ID, key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	connected, offline := s.nodesByID()
+	for _, id := range nodeIDs {
+		_, isConnected := connected[id]
+		_, isOffline := offline[id]
+		if id != s.ID && !isConnected && !isOffline {
+			return fmt.Errorf("unknown node %s", id)
+		}
+	}
+	hashedKey := crypto.HashKey(key)
+	s.pins.set(objectRef{owner: s.ID, key: hashedKey}, nodeIDs)
+	// The pinned nodes are pushed the object even if they were sent it recently.
+	s.pushes.forget(objectRef{owner: s.ID, key: hashedKey})
+	for _, id := range nodeIDs {
+		if peer, ok := connected[id]; ok {
+			if err := s.replicateKey(peer, key); err != nil {
+				log.Printf("[%s] pushing pinned (%s) to node %s, queued instead: %s", s.Transport.Addr(), key, id, err)
+				s.deferFailed(err, []p2p.Node{peer}, key)
+			}
+		} else if addr, ok := offline[id]; ok {
+			s.pending.add(addr, key)
+		}
+	}
+	return s.announcePin(hashedKey, nodeIDs)
+}
+
+// Unpin reverts one of this node's objects to automatic placement, replicating it to every
+// peer again, or to those its replication policy places it on. Connected peers are pushed the
+// object and offline bootstrap nodes are queued.
+//
+// Returns: Any errors pushing the object, after which it is queued for the bootstrap nodes
+// among the failed peers, or telling peers of the change.
+func (s *FileServer) Unpin(key string) error {
+	hashedKey := crypto.HashKey(key)
+	ref := objectRef{owner: s.ID, key: hashedKey}
+	pinned := s.pins.nodes(ref)
+	if pinned == nil {
+		return nil
+	}
+	s.pins.set(ref, nil)
+	var errs []error
+	if ok, err := s.Storage.Has(s.ID, key); err == nil && ok {
+		s.deferReplication(key)
+		for _, peer := range s.placement(key, s.peerList()) {
+			if slices.Contains(pinned, peer.Hello().NodeID) {
+				continue
+			}
+			if err := s.replicateKey(peer, key); err != nil {
+				s.deferFailed(err, []p2p.Node{peer}, key)
+				errs = append(errs, fmt.Errorf("pushing (%s) to (%s): %w", key, peer.RemoteAddr(), err))
+			}
+		}
+	}
+	return errors.Join(append(errs, s.announcePin(hashedKey, nil))...)
+}
+
+// announcePin tells every peer that supports pins where an object is placed.
+func (s *FileServer) announcePin(hashedKey string, nodeIDs []string) error {
+	peers, _ := s.peersWith(s.peerList(), func(c peerCaps) bool { return c.pins })
+	return s.sendCoalesced(peers, &Message{Payload: MessagePin{Key: hashedKey, Nodes: nodeIDs}})
+}
+
+// nodesByID returns the connected peers and the addresses of the offline bootstrap nodes,
+// both keyed by node ID.
+func (s *FileServer) nodesByID() (map[string]p2p.Node, map[string]string) {
+	connected := make(map[string]p2p.Node)
+	for _, peer := range s.peerList() {
+		connected[peer.Hello().NodeID] = peer
+	}
+	offline := make(map[string]string)
+	for _, addr := range s.offlineBootstrapNodes() {
+		s.peerLock.Lock()
+		id, ok := s.bootstrapIDs[addr]
+		s.peerLock.Unlock()
+		if ok {
+			offline[id] = addr
+		}
+	}
+	return connected, offline
+}
+
+// placement returns the peers one of this node's objects is replicated to: those it is pinned
+// to, those its replication policy places it on, or all of peers taking replicas when neither
+// limits it.
+func (s *FileServer) placement(key string, peers []p2p.Node) []p2p.Node {
+	peers = replicaPeers(peers)
+	pinned := s.pins.nodes(objectRef{owner: s.ID, key: crypto.HashKey(key)})
+	if pinned == nil {
+		var ok bool
+		if pinned, ok = s.policyPlacement(key); !ok {
+			return peers
+		}
+	}
+	placed := make([]p2p.Node, 0, len(pinned))
+	for _, peer := range peers {
+		if slices.Contains(pinned, peerPlacementNode(peer).id) {
+			placed = append(placed, peer)
+		}
+	}
+	return placed
+}
+
+// placedOn reports whether one of this node's objects belongs on the bootstrap node at addr.
+func (s *FileServer) placedOn(key string, addr string) bool {
+	pinned := s.pins.nodes(objectRef{owner: s.ID, key: crypto.HashKey(key)})
+	if pinned == nil {
+		var ok bool
+		if pinned, ok = s.policyPlacement(key); !ok {
+			return true
+		}
+	}
+	s.peerLock.Lock()
+	id, ok := s.bootstrapIDs[addr]
+	s.peerLock.Unlock()
+	return ok && slices.Contains(pinned, id)
+}
+
+// handleMessagePin records the placement a peer announced for one of its objects. The pin is
+// recorded for the node the peer identified as in its handshake.
+func (s *FileServer) handleMessagePin(from string, msg MessagePin) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	s.pins.set(objectRef{owner: peer.Hello().NodeID, key: msg.Key}, msg.Nodes)
+	return nil
+}
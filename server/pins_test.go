@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinTablePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), pinFileName)
+	pins := newPinTable()
+	require.NoError(t, pins.load(path))
+	pins.set(objectRef{owner: "a", key: "k1"}, []string{"b", "c"})
+	pins.set(objectRef{owner: "a", key: "k2"}, []string{"b"})
+	pins.set(objectRef{owner: "a", key: "k2"}, nil)
+
+	reloaded := newPinTable()
+	require.NoError(t, reloaded.load(path))
+	assert.Equal(t, []string{"b", "c"}, reloaded.nodes(objectRef{owner: "a", key: "k1"}))
+	assert.Nil(t, reloaded.nodes(objectRef{owner: "a", key: "k2"}))
+	assert.Equal(t, 1, reloaded.count("c"))
+}
+
+func TestPinAndUnpin(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	const key = "dataset"
+	hashedKey := crypto.HashKey(key)
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("v1"))))
+	for _, s := range []*FileServer{b, c} {
+		waitFor(t, func() bool {
+			ok, _ := s.Storage.Has(a.ID, hashedKey)
+			return ok
+		})
+	}
+
+	assert.Error(t, a.Pin(key, []string{"unknown"}), "unknown nodes are rejected")
+	assert.ErrorIs(t, a.Pin("missing", []string{b.ID}), ErrKeyNotFound)
+
+	// Pinning pushes the object to b even though b dropped its replica.
+	require.NoError(t, b.Storage.Delete(a.ID, hashedKey))
+	require.NoError(t, a.Pin(key, []string{b.ID}))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, hashedKey)
+		return ok
+	})
+	waitFor(t, func() bool { return b.pins.count(b.ID) == 1 && c.pins.count(b.ID) == 1 })
+	info, err := b.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.Pinned)
+
+	// Later stores only reach the pinned node.
+	require.NoError(t, c.Storage.Delete(a.ID, hashedKey))
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("v2"))))
+	settle(t, a, c)
+	ok, err := c.Storage.Has(a.ID, hashedKey)
+	require.NoError(t, err)
+	assert.False(t, ok, "c is not among the pinned nodes")
+
+	// Unpinning places the object on every peer again.
+	require.NoError(t, a.Unpin(key))
+	waitFor(t, func() bool {
+		ok, _ := c.Storage.Has(a.ID, hashedKey)
+		return ok
+	})
+	waitFor(t, func() bool { return b.pins.count(b.ID) == 0 })
+}
+
+func TestPinToOfflineNode(t *testing.T) {
+	b := makeServer(t, ":4001")
+	a := makeServer(t, ":4000", ":4001")
+	startCluster(t, b, a)
+
+	const key = "dataset"
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("data"))))
+	b.Stop()
+	for _, peer := range b.peerList() {
+		require.NoError(t, peer.Close())
+	}
+	waitFor(t, func() bool { return len(a.peerList()) == 0 })
+
+	// b is offline but known, so the push is queued until it returns.
+	require.NoError(t, a.Pin(key, []string{b.ID}))
+	assert.Equal(t, []string{key}, a.pending.keys(":4001"))
+
+	back := makeServer(t, ":4001")
+	back.ID = b.ID
+	startCluster(t, back)
+	require.Eventually(t, func() bool {
+		ok, _ := back.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	}, 10*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return len(a.pending.keys(":4001")) == 0 }, time.Second, 10*time.Millisecond)
+}
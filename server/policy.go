@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// zoneLabel is the node label ZoneSpread spreads replicas over.
+const zoneLabel = "zone"
+
+// Policy sets how the objects under a key prefix are placed and cached. The zero
+// Policy replicates every object to every peer, as when no policy applies.
+type Policy struct {
+	ReplicationFactor int  `json:"replication_factor,omitempty"` // Peers each object is replicated to, zero for every peer
+	MinReplicas       int  `json:"min_replicas,omitempty"`       // Replicas VerifyCluster expects at least, defaults to ReplicationFactor
+	ZoneSpread        bool `json:"zone_spread,omitempty"`        // Places replicas on nodes of distinct zones before a second one in any zone
+	NoCache           bool `json:"no_cache,omitempty"`           // Keeps the objects out of the object cache
+}
+
+// minReplicas returns the replicas VerifyCluster expects at least, zero when every node is
+// expected to hold one.
+func (p Policy) minReplicas() int {
+	if p.MinReplicas > 0 {
+		return p.MinReplicas
+	}
+	return p.ReplicationFactor
+}
+
+// validate reports a policy whose numbers make no sense.
+func (p Policy) validate() error {
+	if p.ReplicationFactor < 0 || p.MinReplicas < 0 {
+		return fmt.Errorf("replication factor and minimum replicas must not be negative")
+	}
+	if p.ReplicationFactor > 0 && p.MinReplicas > p.ReplicationFactor {
+		return fmt.Errorf("minimum replicas %d exceed the replication factor %d", p.MinReplicas, p.ReplicationFactor)
+	}
+	return nil
+}
+
+// policyTable holds the policies of a node by key prefix. They are replaced as a whole, so a
+// key never resolves against a mix of old and new policies.
+type policyTable struct {
+	mu       sync.RWMutex
+	prefixes map[string]Policy // Policies by key prefix
+}
+
+// set replaces every policy.
+func (t *policyTable) set(policies map[string]Policy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prefixes = make(map[string]Policy, len(policies))
+	for prefix, p := range policies {
+		t.prefixes[prefix] = p
+	}
+}
+
+// resolve returns the policy of the longest prefix of key, and that prefix.
+//
+// Returns: The policy, the prefix it is set for, and whether any prefix matched.
+func (t *policyTable) resolve(key string) (Policy, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var (
+		best  Policy
+		match string
+		found bool
+	)
+	for prefix, p := range t.prefixes {
+		if strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(match)) {
+			best, match, found = p, prefix, true
+		}
+	}
+	return best, match, found
+}
+
+// LoadPolicies reads replication policies from a JSON file holding an object of policies by
+// key prefix, such as {"scratch/": {"replication_factor": 1}}.
+//
+// Returns: The policies, or an error if the file cannot be read or a policy is invalid.
+func LoadPolicies(path string) (map[string]Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies map[string]Policy
+	if err := json.Unmarshal(b, &policies); err != nil {
+		return nil, fmt.Errorf("reading policies %s: %w", path, err)
+	}
+	for prefix, p := range policies {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("policy for %q in %s: %w", prefix, path, err)
+		}
+	}
+	return policies, nil
+}
+
+// ReloadPolicies replaces the replication policies set with Policies. Later stores, catch-ups
+// of reconnected bootstrap nodes, read repairs and verifications follow the new policies;
+// replicas already placed are kept.
+//
+// Returns: An error naming an invalid policy, in which case the current ones are kept.
+func (s *FileServer) ReloadPolicies(policies map[string]Policy) error {
+	for prefix, p := range policies {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("policy for %q: %w", prefix, err)
+		}
+	}
+	s.policies.set(policies)
+	log.Printf("[%s] loaded %d replication policies", s.Transport.Addr(), len(policies))
+	return nil
+}
+
+// Policy returns the replication policy a key resolves to: that of the longest prefix set in
+// Policies matching it, or the zero Policy when none does.
+func (s *FileServer) Policy(key string) Policy {
+	p, _, _ := s.policies.resolve(key)
+	return p
+}
+
+// placementNode is a node an object may be placed on.
+type placementNode struct {
+	id   string // Identifier of the node
+	zone string // Zone the node is labeled with, empty when it has none
+}
+
+// placeOn returns the nodes of candidates a policy with a replication factor places an object
+// on. Nodes are ranked by rendezvous hashing of their ID with the object's hashed key, so
+// every node picks the same ones and a node joining or leaving only moves the objects it
+// ranks first for. With ZoneSpread the best-ranked node of every zone comes first.
+func placeOn(hashedKey string, candidates []placementNode, p Policy) []string {
+	ranked := slices.Clone(candidates)
+	scores := make(map[string]string, len(ranked))
+	for _, c := range ranked {
+		sum := sha256.Sum256([]byte(c.id + "/" + hashedKey))
+		scores[c.id] = hex.EncodeToString(sum[:])
+	}
+	sort.Slice(ranked, func(i, j int) bool { return scores[ranked[i].id] > scores[ranked[j].id] })
+	if p.ZoneSpread {
+		seen := make(map[string]bool)
+		var first, rest []placementNode
+		for _, c := range ranked {
+			if seen[c.zone] {
+				rest = append(rest, c)
+				continue
+			}
+			seen[c.zone] = true
+			first = append(first, c)
+		}
+		ranked = append(first, rest...)
+	}
+	placed := make([]string, 0, p.ReplicationFactor)
+	for _, c := range ranked[:min(p.ReplicationFactor, len(ranked))] {
+		placed = append(placed, c.id)
+	}
+	return placed
+}
+
+// peerPlacementNode describes a peer for placeOn, by the node ID of its handshake, or its
+// address for peers that sent none.
+func peerPlacementNode(peer p2p.Node) placementNode {
+	hello := peer.Hello()
+	id := hello.NodeID
+	if len(id) == 0 {
+		id = peer.RemoteAddr().String()
+	}
+	return placementNode{id: id, zone: hello.Labels[zoneLabel]}
+}
+
+// placementNodes returns the nodes this node's objects may be placed on: its connected peers
+// that take replicas and did not recently refuse one for lack of space, and the offline bootstrap nodes
+// whose node ID it knows.
+func (s *FileServer) placementNodes() []placementNode {
+	var nodes []placementNode
+	full := s.fullPeers()
+	for _, peer := range replicaPeers(s.peerList()) {
+		if node := peerPlacementNode(peer); !slices.Contains(full, node.id) {
+			nodes = append(nodes, node)
+		}
+	}
+	for _, addr := range s.offlineBootstrapNodes() {
+		s.peerLock.Lock()
+		id, ok := s.bootstrapIDs[addr]
+		s.peerLock.Unlock()
+		if ok && !slices.ContainsFunc(nodes, func(n placementNode) bool { return n.id == id }) {
+			nodes = append(nodes, placementNode{id: id})
+		}
+	}
+	return nodes
+}
+
+// policyPlacement returns the node IDs one of this node's objects is placed on by its
+// policy, and false when the policy does not limit its replicas. Offline bootstrap nodes are
+// placed on like connected peers, so the object reaches them when they reconnect.
+func (s *FileServer) policyPlacement(key string) ([]string, bool) {
+	p := s.Policy(key)
+	if p.ReplicationFactor <= 0 {
+		return nil, false
+	}
+	return placeOn(crypto.HashKey(key), s.placementNodes(), p), true
+}
+
+// placedFor returns those of keys, of this node's objects, that their policy places on peer
+// or that no policy limits, and none if peer takes no replicas.
+func (s *FileServer) placedFor(peer p2p.Node, keys []string) []string {
+	if !takesReplicas(peer) {
+		return nil
+	}
+	id := peerPlacementNode(peer).id
+	var placed []string
+	for _, key := range keys {
+		if nodes, ok := s.policyPlacement(key); !ok || slices.Contains(nodes, id) {
+			placed = append(placed, key)
+		}
+	}
+	return placed
+}
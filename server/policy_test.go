@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyLongestPrefixWins(t *testing.T) {
+	var table policyTable
+	table.set(map[string]Policy{
+		"":              {NoCache: true},
+		"logs/":         {ReplicationFactor: 1},
+		"logs/audit/":   {ReplicationFactor: 3, MinReplicas: 2},
+		"logs/audit/x/": {ReplicationFactor: 2},
+	})
+	tests := []struct {
+		key    string
+		prefix string
+	}{
+		{key: "photo.png", prefix: ""},
+		{key: "logs/app.log", prefix: "logs/"},
+		{key: "logs/audit/2024.log", prefix: "logs/audit/"},
+		{key: "logs/audit/x/1", prefix: "logs/audit/x/"},
+		{key: "logs", prefix: ""},
+	}
+	for _, tt := range tests {
+		_, prefix, ok := table.resolve(tt.key)
+		assert.True(t, ok)
+		assert.Equal(t, tt.prefix, prefix, tt.key)
+	}
+
+	// Zone spread takes one node of each zone before a second one of any.
+	nodes := []placementNode{{id: "a", zone: "eu"}, {id: "b", zone: "eu"}, {id: "c", zone: "eu"}, {id: "d", zone: "us"}}
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		placed := placeOn(key, nodes, Policy{ReplicationFactor: 2, ZoneSpread: true})
+		assert.Contains(t, placed, "d", key)
+		assert.Len(t, placed, 2)
+	}
+}
+
+func TestLoadPoliciesRejectsInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"scratch/": {"replication_factor": 1}}`), 0o644))
+	policies, err := LoadPolicies(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Policy{"scratch/": {ReplicationFactor: 1}}, policies)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"scratch/": {"replication_factor": 1, "min_replicas": 2}}`), 0o644))
+	_, err = LoadPolicies(path)
+	assert.Error(t, err)
+}
+
+// replicaCount returns how many of the nodes hold a replica of one of owner's objects.
+func replicaCount(owner *FileServer, key string, nodes ...*FileServer) int {
+	n := 0
+	for _, s := range nodes {
+		if ok, _ := s.Storage.Has(owner.ID, crypto.HashKey(key)); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestStoreFollowsReloadedPolicies(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	d := makeMemoryServer(t, network, ":4003", ":4000")
+	startCluster(t, a, b, c, d)
+	waitFor(t, func() bool { return len(a.peerList()) == 3 })
+
+	require.NoError(t, a.ReloadPolicies(map[string]Policy{"scratch/": {ReplicationFactor: 1}}))
+	require.NoError(t, a.Store("scratch/1", bytes.NewReader([]byte("one"))))
+	require.NoError(t, a.Store("kept", bytes.NewReader([]byte("everywhere"))))
+	waitFor(t, func() bool { return replicaCount(a, "kept", b, c, d) == 3 })
+	assert.Equal(t, 1, replicaCount(a, "scratch/1", b, c, d))
+
+	// An invalid reload keeps the policies in force.
+	assert.Error(t, a.ReloadPolicies(map[string]Policy{"scratch/": {ReplicationFactor: -1}}))
+	assert.Equal(t, 1, a.Policy("scratch/x").ReplicationFactor)
+
+	require.NoError(t, a.ReloadPolicies(map[string]Policy{"scratch/": {ReplicationFactor: 2}}))
+	require.NoError(t, a.Store("scratch/2", bytes.NewReader([]byte("two"))))
+	waitFor(t, func() bool { return replicaCount(a, "scratch/2", b, c, d) == 2 })
+	assert.Never(t, func() bool { return replicaCount(a, "scratch/2", b, c, d) > 2 }, 200*time.Millisecond, 20*time.Millisecond)
+}
+
+func TestVerifyReportsPolicyViolations(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	require.NoError(t, a.ReloadPolicies(map[string]Policy{
+		"critical/": {ReplicationFactor: 2, MinReplicas: 2},
+		"scratch/":  {ReplicationFactor: 1},
+	}))
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	d := makeMemoryServer(t, network, ":4003", ":4000")
+	startCluster(t, a, b, c, d)
+	waitFor(t, func() bool { return len(a.peerList()) == 3 })
+
+	require.NoError(t, a.Store("critical/manifest", bytes.NewReader([]byte("manifest"))))
+	require.NoError(t, a.Store("scratch/tmp", bytes.NewReader([]byte("tmp"))))
+	waitFor(t, func() bool {
+		return replicaCount(a, "critical/manifest", b, c, d) == 2 && replicaCount(a, "scratch/tmp", b, c, d) == 1
+	})
+	report := a.VerifyCluster(false)
+	assert.True(t, report.Healthy(), "objects placed by their policy were reported: %+v", report.Findings)
+
+	for _, s := range []*FileServer{b, c, d} {
+		if ok, _ := s.Storage.Has(a.ID, crypto.HashKey("critical/manifest")); ok {
+			require.NoError(t, s.Storage.Delete(a.ID, crypto.HashKey("critical/manifest")))
+			break
+		}
+	}
+	report = a.VerifyCluster(false)
+	require.Len(t, report.Findings, 1)
+	assert.Equal(t, FindingPolicy, report.Findings[0].Kind)
+	assert.Equal(t, "critical/manifest", report.Findings[0].Key)
+	assert.Contains(t, report.Findings[0].Detail, `1 replicas, the policy for "critical/" wants at least 2`)
+}
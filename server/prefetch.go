@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPrefetchConcurrency is the number of prefetch workers used when none is requested.
+const defaultPrefetchConcurrency = 4
+
+// PrefetchResult reports the outcome of prefetching one key.
+type PrefetchResult struct {
+	Key     string // Requested key
+	Skipped bool   // The key was already held locally and was not downloaded
+	Size    int64  // Plaintext size of the object, when it is held locally after the prefetch
+	Peer    string // Address of the peer the object was fetched from, empty unless it was downloaded
+	Err     error  // Why the key could not be prefetched
+}
+
+// PrefetchReport summarises a prefetch run. Results are in the order the keys were given.
+type PrefetchReport struct {
+	Fetched int              // Keys downloaded from peers
+	Skipped int              // Keys already held locally
+	Failed  int              // Keys that could not be fetched, including those cancelled before they were tried
+	Results []PrefetchResult // Per-key outcomes
+}
+
+// Prefetch pulls the given keys from the cluster into local storage so later Gets are served
+// from disk. See PrefetchContext.
+func (s *FileServer) Prefetch(keys []string, concurrency int) (PrefetchReport, error) {
+	return s.PrefetchContext(context.Background(), keys, concurrency)
+}
+
+// PrefetchContext pulls the given keys from the cluster into local storage using up to
+// concurrency workers. Keys already held locally are skipped; the rest go through the
+// network Get path, including its negative cache. Failures are reported per key. When ctx
+// is cancelled, keys not yet started are marked with the context's error and returned.
+//
+// Parameters:
+//   - ctx: Context whose cancellation stops the run.
+//   - keys: Keys to fetch.
+//   - concurrency: Maximum number of keys processed at once, defaults to defaultPrefetchConcurrency.
+//
+// Returns: A report of every key and the context's error if the run was cancelled.
+func (s *FileServer) PrefetchContext(ctx context.Context, keys []string, concurrency int) (PrefetchReport, error) {
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	report := PrefetchReport{Results: make([]PrefetchResult, len(keys))}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(concurrency, len(keys)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				report.Results[i] = s.prefetchKey(keys[i])
+			}
+		}()
+	}
+
+	next := 0
+feed:
+	for ; next < len(keys) && ctx.Err() == nil; next++ {
+		select {
+		case jobs <- next:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := next; i < len(keys); i++ {
+		report.Results[i] = PrefetchResult{Key: keys[i], Err: ctx.Err()}
+	}
+	for _, r := range report.Results {
+		switch {
+		case r.Err != nil:
+			report.Failed++
+		case r.Skipped:
+			report.Skipped++
+		default:
+			report.Fetched++
+		}
+	}
+	fmt.Printf("[%s] prefetched %d keys, skipped %d, failed %d\n", s.Transport.Addr(), report.Fetched, report.Skipped, report.Failed)
+	if next < len(keys) {
+		return report, ctx.Err()
+	}
+	return report, nil
+}
+
+// prefetchKey brings a single key into local storage unless it is already there.
+func (s *FileServer) prefetchKey(key string) PrefetchResult {
+	result := PrefetchResult{Key: key}
+	ok, err := s.Storage.Has(s.ID, key)
+	if err != nil {
+		log.Printf("[%s] could not check local disk for (%s), trying peers: %s", s.Transport.Addr(), key, err)
+	}
+	if ok {
+		meta, err := s.Storage.Stat(s.ID, key)
+		result.Skipped, result.Size, result.Err = true, meta.PlainSize, err
+		return result
+	}
+	info, r, err := s.GetWithInfo(key)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Size, result.Peer, result.Err = info.Size, info.Peer, r.Close()
+	return result
+}
+
+// prefetchFromFile prefetches the keys listed in PrefetchFile once the server has connected
+// to a peer, stopping early if the server is stopped.
+func (s *FileServer) prefetchFromFile() {
+	keys, err := readKeyList(s.PrefetchFile)
+	if err != nil {
+		log.Printf("[%s] prefetch: %s", s.Transport.Addr(), err)
+		return
+	}
+	s.prefetchOnceConnected(keys)
+}
+
+// prefetchOnceConnected prefetches keys once the server has connected to a peer, stopping
+// early if the server is stopped.
+func (s *FileServer) prefetchOnceConnected(keys []string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.quitch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for len(s.peerList()) == 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Clock.After(100 * time.Millisecond):
+		}
+	}
+	if _, err := s.PrefetchContext(ctx, keys, s.PrefetchConcurrency); err != nil {
+		log.Printf("[%s] prefetch: %s", s.Transport.Addr(), err)
+	}
+}
+
+// readKeyList reads a newline-separated list of keys, ignoring blank lines.
+func readKeyList(path string) (keys []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, f.Close())
+	}()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
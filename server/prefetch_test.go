@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetch(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("warm_%d", i)
+		keys = append(keys, key)
+		require.NoError(t, a.Store(key, bytes.NewReader([]byte(key))))
+	}
+	waitFor(t, func() bool {
+		for _, key := range keys {
+			okB, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			okC, _ := c.Storage.Has(a.ID, crypto.HashKey(key))
+			if !okB || !okC {
+				return false
+			}
+		}
+		return true
+	})
+	for _, key := range keys[:6] {
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+	}
+	kept, err := a.Storage.Metadata(a.ID, keys[6])
+	require.NoError(t, err)
+
+	report, err := a.Prefetch(append(keys, "warm_missing"), 3)
+	require.NoError(t, err)
+	assert.Equal(t, 6, report.Fetched)
+	assert.Equal(t, 4, report.Skipped)
+	assert.Equal(t, 1, report.Failed)
+	for i, r := range report.Results[:len(keys)] {
+		require.NoError(t, r.Err, r.Key)
+		assert.Equal(t, int64(len(keys[i])), r.Size, r.Key)
+		assert.Equal(t, i >= 6, r.Skipped, r.Key)
+		assert.Equal(t, i >= 6, r.Peer == "", r.Key)
+	}
+	assert.ErrorIs(t, report.Results[len(keys)].Err, ErrKeyNotFound)
+
+	after, err := a.Storage.Metadata(a.ID, keys[6])
+	require.NoError(t, err)
+	assert.Equal(t, kept.ModTime, after.ModTime, "present keys must not be downloaded again")
+	for _, key := range keys {
+		ok, err := a.Storage.Has(a.ID, key)
+		require.NoError(t, err)
+		assert.True(t, ok, key)
+	}
+}
+
+func TestPrefetchCancelled(t *testing.T) {
+	a := makeServer(t, ":4000")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := a.PrefetchContext(ctx, []string{"one", "two", "three"}, 2)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 3, report.Failed)
+	for _, r := range report.Results {
+		assert.ErrorIs(t, r.Err, context.Canceled, r.Key)
+	}
+}
+
+func TestReadKeyList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	require.NoError(t, os.WriteFile(path, []byte("a.png\n\n  b.png \nc.png"), 0o644))
+	keys, err := readKeyList(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.png", "b.png", "c.png"}, keys)
+}
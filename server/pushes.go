@@ -0,0 +1,169 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+const (
+	// defaultPushDedupTTL is how long a replica delivered to a peer is not pushed to it again
+	// when PushDedupTTL is not set.
+	defaultPushDedupTTL = 10 * time.Second
+	// maxPushEntries bounds the pushes remembered across peers.
+	maxPushEntries = 1 << 14
+)
+
+// pushState is what a replica push should do given the pushes of the same object to the
+// same peer before it.
+type pushState uint8
+
+const (
+	pushLead      pushState = iota // Send the replica, reporting the result to pushes that join it
+	pushJoin                       // Wait for the same content already being sent and take its result
+	pushDelivered                  // Skip the peer, which was sent the same content recently
+)
+
+// pushContent identifies the content of a replica, whatever IV encrypted it.
+type pushContent struct {
+	sum     string // Hex-encoded SHA-256 of the plaintext, or of the replica bytes when the plaintext is unknown
+	version uint64 // Version of the object, zero when its key is not versioned
+}
+
+// push is a replica sent, or being sent, to a peer.
+type push struct {
+	content pushContent   // Content sent
+	done    chan struct{} // Closed once the push finished
+	err     error         // Why the push failed, set before done is closed
+	at      time.Time     // When the push was delivered, zero while it is in flight or if it failed
+}
+
+// pushTable tracks the replicas pushed to each peer, so the retry queue, catch-up, read
+// repair and Store pushing the same object to the same peer at about the same time send it
+// once.
+type pushTable struct {
+	clock   clock.Clock                    // Times the pushes, the real clock when nil
+	mu      sync.Mutex                     // Guards entries and size
+	entries map[string]map[objectRef]*push // Latest push of each object by peer address
+	size    int                            // Pushes in entries across peers
+}
+
+// begin registers a push of an object to a peer. A push of the content in flight to the peer
+// joins it, and one of the content delivered to it within ttl is skipped, unless fresh is
+// set because the replica carries something, such as an acknowledgement request, the earlier
+// push did not.
+//
+// Returns: The push to finish with end when the state is pushLead, or to wait for when it is
+// pushJoin; nil when the push is not tracked, as the table is full.
+func (pt *pushTable) begin(addr string, ref objectRef, content pushContent, ttl time.Duration, fresh bool) (*push, pushState) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.entries == nil {
+		pt.entries = make(map[string]map[objectRef]*push)
+	}
+	now := clock.Or(pt.clock).Now()
+	peer := pt.entries[addr]
+	if p, ok := peer[ref]; ok && !fresh && p.content == content {
+		switch {
+		case p.at.IsZero() && p.err == nil:
+			return p, pushJoin
+		case !p.at.IsZero() && now.Sub(p.at) < ttl:
+			return p, pushDelivered
+		}
+	}
+	if _, ok := peer[ref]; !ok && !pt.makeRoomLocked(now, ttl) {
+		return nil, pushLead
+	}
+	if peer == nil {
+		peer = make(map[objectRef]*push)
+		pt.entries[addr] = peer
+	}
+	if _, ok := peer[ref]; !ok {
+		pt.size++
+	}
+	p := &push{content: content, done: make(chan struct{})}
+	peer[ref] = p
+	return p, pushLead
+}
+
+// makeRoomLocked drops expired pushes, then any finished one, once the table is full; the caller
+// must hold mu.
+//
+// Returns: Whether there is room for another push.
+func (pt *pushTable) makeRoomLocked(now time.Time, ttl time.Duration) bool {
+	if pt.size < maxPushEntries {
+		return true
+	}
+	for _, peer := range pt.entries {
+		for ref, p := range peer {
+			if !p.at.IsZero() && now.Sub(p.at) >= ttl || p.err != nil {
+				delete(peer, ref)
+				pt.size--
+			}
+		}
+	}
+	for _, peer := range pt.entries {
+		for ref, p := range peer {
+			if pt.size < maxPushEntries {
+				return true
+			}
+			if !p.at.IsZero() {
+				delete(peer, ref)
+				pt.size--
+			}
+		}
+	}
+	return pt.size < maxPushEntries
+}
+
+// end finishes a push led by begin, handing its result to the pushes that joined it.
+func (pt *pushTable) end(p *push, err error) {
+	if p == nil {
+		return
+	}
+	pt.mu.Lock()
+	if err == nil {
+		p.at = clock.Or(pt.clock).Now()
+	}
+	p.err = err
+	pt.mu.Unlock()
+	close(p.done)
+}
+
+// wait waits for a push joined by begin to finish.
+//
+// Returns: The result of the push.
+func (p *push) wait() error {
+	<-p.done
+	return p.err
+}
+
+// forget drops the pushes of an object, which was deleted or changed in place on its peers.
+func (pt *pushTable) forget(ref objectRef) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for _, peer := range pt.entries {
+		if _, ok := peer[ref]; ok {
+			delete(peer, ref)
+			pt.size--
+		}
+	}
+}
+
+// drop forgets the pushes to a peer that disconnected, which may come back without them.
+func (pt *pushTable) drop(addr string) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.size -= len(pt.entries[addr])
+	delete(pt.entries, addr)
+}
+
+// pushDedupTTL returns how long a replica delivered to a peer is not pushed to it again, or a
+// negative value when pushes are not deduplicated.
+func (s *FileServer) pushDedupTTL() time.Duration {
+	if s.PushDedupTTL == 0 {
+		return defaultPushDedupTTL
+	}
+	return s.PushDedupTTL
+}
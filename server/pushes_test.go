@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushTable(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	pt := &pushTable{clock: clk}
+	ref := objectRef{owner: "a", key: "key"}
+	content := pushContent{sum: "sum"}
+
+	p, state := pt.begin(":4001", ref, content, time.Minute, false)
+	require.Equal(t, pushLead, state)
+	joined, state := pt.begin(":4001", ref, content, time.Minute, false)
+	assert.Equal(t, pushJoin, state)
+	assert.Same(t, p, joined)
+	_, state = pt.begin(":4002", ref, content, time.Minute, false)
+	assert.Equal(t, pushLead, state, "other peers are pushed on their own")
+
+	// A failed push is handed to those that joined it and retried by the next.
+	failure := errors.New("link down")
+	pt.end(p, failure)
+	assert.ErrorIs(t, joined.wait(), failure)
+	p, state = pt.begin(":4001", ref, content, time.Minute, false)
+	require.Equal(t, pushLead, state)
+	pt.end(p, nil)
+	_, state = pt.begin(":4001", ref, content, time.Minute, false)
+	assert.Equal(t, pushDelivered, state)
+
+	// Other content, a fresh replica or an expired delivery is pushed again.
+	_, state = pt.begin(":4001", ref, pushContent{sum: "sum", version: 2}, time.Minute, false)
+	assert.Equal(t, pushLead, state)
+	p, state = pt.begin(":4001", ref, content, time.Minute, true)
+	assert.Equal(t, pushLead, state)
+	pt.end(p, nil)
+	clk.Advance(time.Minute)
+	p, state = pt.begin(":4001", ref, content, time.Minute, false)
+	assert.Equal(t, pushLead, state)
+	pt.end(p, nil)
+
+	// Deleted objects and disconnected peers are forgotten.
+	pt.forget(ref)
+	_, state = pt.begin(":4001", ref, content, time.Minute, false)
+	assert.Equal(t, pushLead, state)
+	pt.drop(":4001")
+	pt.drop(":4002")
+	assert.Zero(t, pt.size)
+	assert.Empty(t, pt.entries)
+}
+
+func TestPushTableBounded(t *testing.T) {
+	pt := &pushTable{clock: clock.NewFake(time.Unix(0, 0))}
+	content := pushContent{sum: "sum"}
+	var inFlight []*push
+	for i := 0; i < maxPushEntries; i++ {
+		p, _ := pt.begin(":4001", objectRef{owner: "a", key: fmt.Sprint(i)}, content, time.Minute, false)
+		inFlight = append(inFlight, p)
+	}
+	// Pushes in flight are never evicted; a push past them is not tracked.
+	p, state := pt.begin(":4001", objectRef{owner: "a", key: "extra"}, content, time.Minute, false)
+	assert.Equal(t, pushLead, state)
+	assert.Nil(t, p)
+	pt.end(p, nil)
+
+	// Finished pushes make room.
+	pt.end(inFlight[0], nil)
+	p, _ = pt.begin(":4001", objectRef{owner: "a", key: "extra"}, content, time.Minute, false)
+	assert.NotNil(t, p)
+	assert.Equal(t, maxPushEntries, pt.size)
+}
+
+// TestConcurrentPushesCrossOnce pushes one object to a peer from Store, the retry queue and
+// catch-up at the same time. The link is slowed so the pushes overlap; the object crosses it
+// once.
+func TestConcurrentPushesCrossOnce(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	data := randomData(t, 256<<10)
+	_, err := a.Storage.Write(a.ID, "key", bytes.NewReader(data))
+	require.NoError(t, err)
+	peer := a.peerList()[0]
+	// 256 KB at 1 MB per second keep the push in flight for a quarter of a second.
+	network.Policy.SetLink(":4000", ":4001", p2p.LinkPolicy{Bandwidth: 1 << 20})
+
+	subsystems := map[string]func() error{
+		"store":    func() error { return a.Store("key", bytes.NewReader(data)) },
+		"retry":    func() error { return a.replicateKey(peer, "key") },
+		"catch-up": func() error { return a.replicateKey(peer, "key") },
+	}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	for name, push := range subsystems {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := push()
+			mu.Lock()
+			errs[name] = err
+			mu.Unlock()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	for name, err := range errs {
+		assert.NoError(t, err, name)
+	}
+
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("key"))
+		return ok
+	})
+	carried := network.Policy.Carried(":4000", ":4001")
+	assert.GreaterOrEqual(t, carried, int64(len(data)))
+	assert.Less(t, carried, int64(2*len(data)), "the object crossed the link more than once")
+	assert.EqualValues(t, 2, a.Metrics()["pushes_deduplicated"])
+
+	// Once the peer reconnects, it may have lost what it was sent.
+	peer.Close()
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && a.peerList()[0] != peer })
+	require.NoError(t, a.replicateKey(a.peerList()[0], "key"))
+	assert.EqualValues(t, 2, a.Metrics()["pushes_deduplicated"])
+	assert.GreaterOrEqual(t, network.Policy.Carried(":4000", ":4001"), carried+int64(len(data)))
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// ErrQuotaExceeded is returned when a replica would take its origin past the bytes this node
+// stores on the origin's behalf.
+var ErrQuotaExceeded = errors.New("origin quota exceeded")
+
+// MessageStoreRejected tells the sender of a replica that it was refused and why, so a full
+// peer is told apart from a failed one.
+type MessageStoreRejected struct {
+	ID         string        // Identifier of the node owning the object
+	Key        string        // Hashed key of the object
+	Reason     string        // Why the replica was refused
+	NoSpace    bool          // Whether the peer is out of disk space, so the replica belongs elsewhere
+	Denied     bool          // Whether the peer's Authorizer denied the sender storing the replica
+	Busy       bool          // Whether the peer was at its admission limits, so the replica is sent again later
+	RetryAfter time.Duration // How long the peer suggests waiting before sending a busy replica again
+}
+
+// originQuota returns the bytes this node stores on behalf of an origin, or zero for no limit.
+// Objects this node owns are never capped.
+func (s *FileServer) originQuota(id string) int64 {
+	if id == s.ID {
+		return 0
+	}
+	if quota, ok := s.OriginQuotas[id]; ok {
+		return quota
+	}
+	return s.OriginQuota
+}
+
+// admitReplica checks that the Authorizer lets the sender store the replica and that storing
+// size bytes under key keeps the origin within its quota, counting the object the replica
+// replaces as freed. A refused replica is recorded and the sender is told with a
+// MessageStoreRejected.
+//
+// Parameters:
+//   - from: Address of the peer that sent the replica.
+//   - span: Span of the request the replica was sent for, empty if none.
+//   - id: Origin, the node owning the object.
+//   - ns: Namespace the sender declared for the key.
+//   - key: Hashed key of the object.
+//   - size: Bytes the replica takes on disk.
+//
+// Returns: An error wrapping ErrUnauthorized, ErrLeased when another node holds a lease on the
+// key, ErrQuotaExceeded, ErrNoSpace when the disk has less free space than MinFreeBytes, or
+// ErrDraining while the node is being decommissioned, if the replica was refused, or any error
+// reading the origin's usage.
+func (s *FileServer) admitReplica(from string, span string, id string, ns string, key string, size int64) error {
+	if err := s.authorize(from, span, OpStore, id, ns, key); err != nil {
+		return s.refuseReplica(from, id, key, fmt.Errorf("replica (%s): %w", key, err), err)
+	}
+	if err := s.admitLeased(from, id, key); err != nil {
+		return err
+	}
+	if s.draining.Load() {
+		return s.refuseReplica(from, id, key, fmt.Errorf("replica (%s): %w", key, ErrDraining), ErrDraining)
+	}
+	if err := s.checkFreeSpace(); err != nil {
+		s.diskFull(err)
+		return s.refuseReplica(from, id, key, fmt.Errorf("replica (%s): %w", key, err), err)
+	}
+	quota := s.originQuota(id)
+	if quota <= 0 {
+		return nil
+	}
+	used, err := s.Storage.OwnerBytes(id)
+	if err != nil {
+		return err
+	}
+	old, err := s.Storage.OwnerSize(id, key)
+	if err != nil {
+		return err
+	}
+	if used-old+size <= quota {
+		return nil
+	}
+	s.quotaMu.Lock()
+	s.rejected[id]++
+	s.quotaMu.Unlock()
+	err = fmt.Errorf("replica (%s): origin (%s) holds %d of %d bytes, %d more refused: %w", key, id, used, quota, size, ErrQuotaExceeded)
+	return s.refuseReplica(from, id, key, err, ErrQuotaExceeded)
+}
+
+// refuseReplica tells the sender of a replica that it was refused with a MessageStoreRejected
+// giving reason.
+//
+// Returns: err, joined with any error telling the sender.
+func (s *FileServer) refuseReplica(from string, id string, key string, err error, reason error) error {
+	if peer, ok := s.peer(from); ok {
+		rejected := MessageStoreRejected{ID: id, Key: key, Reason: reason.Error(), NoSpace: errors.Is(reason, ErrNoSpace), Denied: errors.Is(reason, ErrUnauthorized)}
+		if errors.Is(reason, ErrBusy) {
+			rejected.Busy, rejected.RetryAfter = true, s.busyRetryAfter()
+		}
+		if _, serr := s.sendMessage([]p2p.Node{peer}, &Message{Payload: rejected}); serr != nil {
+			err = errors.Join(err, serr)
+		}
+	}
+	return err
+}
+
+// originRejections returns the replicas refused by origin ID since the node started.
+func (s *FileServer) originRejections() map[string]int64 {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if len(s.rejected) == 0 {
+		return nil
+	}
+	rejected := make(map[string]int64, len(s.rejected))
+	for id, n := range s.rejected {
+		rejected[id] = n
+	}
+	return rejected
+}
+
+// handleMessageStoreRejected records that a peer refused a replica this node sent. A peer out
+// of disk space is left out of placements for a while, and a replica of this node's own
+// objects it refused is placed elsewhere.
+func (s *FileServer) handleMessageStoreRejected(from string, msg MessageStoreRejected) error {
+	s.metrics.replicasRejected.Add(1)
+	log.Printf("[%s] peer (%s) refused replica (%s): %s", s.Transport.Addr(), from, msg.Key, msg.Reason)
+	if msg.Denied {
+		s.metrics.replicasDenied.Add(1)
+	}
+	if msg.Busy {
+		s.metrics.replicasBusy.Add(1)
+		if msg.ID == s.ID {
+			go s.resendBusy(from, msg.Key, msg.RetryAfter)
+		}
+		return nil
+	}
+	if !msg.NoSpace {
+		return nil
+	}
+	s.metrics.replicasNoSpace.Add(1)
+	s.peerFull(from)
+	if msg.ID == s.ID {
+		go s.redrive(msg.Key)
+	}
+	return nil
+}
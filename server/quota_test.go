@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"fmt"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginQuotas(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	// Each replica takes its content plus the IV on disk.
+	const size = 40
+	replica := int64(size + aes.BlockSize)
+	a.OriginQuotas = map[string]int64{
+		b.ID: 2 * replica,
+		c.ID: 10 * replica,
+	}
+	// b streams its replicas and c sends them inline, so both store paths are covered.
+	b.InlineThreshold = -1
+	startCluster(t, a, b, c)
+
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte{byte('0' + i)}, size)
+		require.NoError(t, b.Store(fmt.Sprintf("b_%d", i), bytes.NewReader(data)))
+		require.NoError(t, c.Store(fmt.Sprintf("c_%d", i), bytes.NewReader(data)))
+	}
+	waitFor(t, func() bool { return b.Metrics()["replicas_rejected"] == 1 })
+	waitFor(t, func() bool {
+		ok, _ := a.Storage.Has(c.ID, crypto.HashKey("c_2"))
+		return ok
+	})
+	assert.Zero(t, c.Metrics()["replicas_rejected"])
+
+	ok, err := a.Storage.Has(b.ID, crypto.HashKey("b_2"))
+	require.NoError(t, err)
+	assert.False(t, ok, "replica past b's quota was stored")
+
+	info, err := a.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{b.ID: 1}, info.OriginRejected)
+	assert.Equal(t, 2*replica, info.OriginBytes[b.ID])
+	assert.Equal(t, 3*replica, info.OriginBytes[c.ID])
+
+	// Rewriting a key within the quota replaces its bytes rather than adding to them.
+	before, err := a.Storage.Metadata(b.ID, crypto.HashKey("b_0"))
+	require.NoError(t, err)
+	require.NoError(t, b.Store("b_0", bytes.NewReader(bytes.Repeat([]byte{'x'}, size))))
+	waitFor(t, func() bool {
+		meta, err := a.Storage.Metadata(b.ID, crypto.HashKey("b_0"))
+		return err == nil && meta.Checksum != before.Checksum
+	})
+	assert.Equal(t, int64(1), b.Metrics()["replicas_rejected"])
+}
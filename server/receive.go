@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// recvChunkSize bounds each read of a replica's stream, so its bytes reach the disk and are
+// accounted for one chunk at a time.
+const recvChunkSize = 64 << 10
+
+// ErrReplicaSize is returned when the stream of a replica is shorter or longer than the size
+// its MessageStoreFile announced. A short stream also wraps io.ErrUnexpectedEOF.
+var ErrReplicaSize = errors.New("replica size mismatch")
+
+// replicaReader reads the stream of a replica in chunks of at most recvChunkSize, stopping at
+// the size its message announced, and counts the bytes received.
+type replicaReader struct {
+	stream  io.Reader // Stream of the replica
+	muxed   bool      // Whether the stream is multiplexed, so it ends on its own and bytes past its size can be counted
+	left    int64     // Announced bytes not read yet
+	n       int64     // Bytes read, including those drained
+	extra   int64     // Bytes the sender streamed past the announced size
+	started time.Time // When the stream was accepted
+}
+
+// Read reads at most recvChunkSize of the bytes still announced.
+func (r *replicaReader) Read(b []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	b = b[:min(int64(len(b)), r.left, recvChunkSize)]
+	n, err := r.stream.Read(b)
+	r.left -= int64(n)
+	r.n += int64(n)
+	return n, err
+}
+
+// drain discards what is left of the stream, keeping the connection aligned with the next
+// message. A stream sent after a marker is read up to its announced size only, as the bytes
+// after it are the next frame; a multiplexed one is read to its end, counting the bytes past
+// its size.
+func (r *replicaReader) drain() error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	if !r.muxed {
+		return nil
+	}
+	extra, err := io.Copy(io.Discard, r.stream)
+	r.extra += extra
+	return err
+}
+
+// misdelivered compares the bytes received with the size announced for key.
+//
+// Returns: An error wrapping ErrReplicaSize naming the discrepancy, or nil if the sizes match.
+func (r *replicaReader) misdelivered(key string, size int64) error {
+	if r.left > 0 {
+		return fmt.Errorf("replica (%s): received %d of %d bytes, %d short: %w", key, r.n, size, r.left, errors.Join(ErrReplicaSize, io.ErrUnexpectedEOF))
+	}
+	if r.extra > 0 {
+		return fmt.Errorf("replica (%s): received %d bytes past the %d announced: %w", key, r.extra, size, ErrReplicaSize)
+	}
+	return nil
+}
+
+// receiveReplica stages the stream of a replica announced by msg, then checks that exactly
+// msg.Size bytes arrived and that they match msg.Checksum before committing it in place of
+// the object held under its key, if any. A replica that fails the checks, or does not fit on
+// the disk, is discarded and the sender told why with a MessageStoreRejected. The rate it arrived at is recorded for its
+// sender, so a receiver bound by its disk shows in Stats.
+func (s *FileServer) receiveReplica(from string, rr *replicaReader, msg MessageStoreFile) error {
+	txID := crypto.GenerateID()
+	n, sum, err := s.Storage.Stage(txID, msg.ID, msg.Key, rr)
+	err = errors.Join(err, rr.drain())
+	s.receiveStats.record(from, rr.n+rr.extra, s.Clock.Since(rr.started))
+	if err != nil {
+		return s.refuseIfFull(from, msg.ID, msg.Key, errors.Join(err, s.Storage.Abort(txID)), false)
+	}
+	if err := rr.misdelivered(msg.Key, msg.Size); err != nil {
+		s.metrics.misdelivered.Add(1)
+		return s.refuseReplica(from, msg.ID, msg.Key, errors.Join(err, s.Storage.Abort(txID)), err)
+	}
+	if sum != msg.Checksum {
+		err := fmt.Errorf("replica (%s): %w", msg.Key, storage.ErrContentCorrupted)
+		return s.refuseReplica(from, msg.ID, msg.Key, errors.Join(err, s.Storage.Abort(txID)), err)
+	}
+	if err := s.Storage.Commit(txID); err != nil {
+		return err
+	}
+	s.diskWritable()
+	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	return nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReceiveRejectsMisdeliveredReplica streams replicas shorter and longer than their
+// message announces, each followed at once by another message. Neither replica may be
+// committed, the sender is told of the discrepancy, and the message after the stream is
+// still read as a message.
+func TestReceiveRejectsMisdeliveredReplica(t *testing.T) {
+	tests := []struct {
+		name  string
+		delta int
+	}{
+		{name: "short", delta: -10},
+		{name: "long", delta: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := p2p.NewMemoryNetwork(1)
+			a := makeMemoryServer(t, network, ":4000")
+			b := makeMemoryServer(t, network, ":4001", ":4000")
+			startCluster(t, a, b)
+			waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+			peer := a.peerList()[0]
+			require.True(t, a.capsOf(peer).mux)
+
+			rep, err := a.prepareReplica("misdelivered", bytes.NewReader(randomData(t, 64<<10)))
+			require.NoError(t, err)
+			msg := MessageStoreFile{ID: a.ID, Key: rep.key, Size: rep.size(), Checksum: rep.checksum}
+			sent := append(rep.data, randomData(t, max(tt.delta, 0))...)[:len(rep.data)+tt.delta]
+			_, err = a.sendMessage([]p2p.Node{peer}, &Message{Payload: msg})
+			require.NoError(t, err)
+			stream, err := a.openStream(peer)
+			require.NoError(t, err)
+			_, err = stream.Write(sent)
+			require.NoError(t, err)
+			require.NoError(t, stream.Close())
+
+			// The message right after the stream is answered.
+			nodes := a.ClusterInfo()
+			require.Len(t, nodes, 2)
+			assert.Empty(t, nodes[1].Err)
+			assert.Equal(t, b.ID, nodes[1].ID)
+
+			waitFor(t, func() bool { return a.Metrics()["replicas_rejected"] == 1 })
+			assert.Equal(t, int64(1), b.Metrics()["replicas_misdelivered"])
+			ok, err := b.Storage.Has(a.ID, rep.key)
+			require.NoError(t, err)
+			assert.False(t, ok, "a misdelivered replica must not be committed")
+			staged, err := os.ReadDir(filepath.Join(b.Storage.Root, ".dfs-staging"))
+			require.NoError(t, err)
+			assert.Empty(t, staged)
+			info, err := b.Stats()
+			require.NoError(t, err)
+			assert.Contains(t, info.ReceiveRates, b.peerList()[0].RemoteAddr().String())
+
+			// A well-formed replica on the same connection still gets through.
+			require.NoError(t, a.Store("after", bytes.NewReader([]byte("intact"))))
+			waitFor(t, func() bool {
+				return b.Storage.Verify(a.ID, crypto.HashKey("after")) == nil
+			})
+		})
+	}
+}
+
+// streamFramings are the two ways a replica is streamed: multiplexed, and after a marker on
+// the connection itself.
+var streamFramings = map[string]p2p.Capabilities{
+	"mux":    supportedCaps,
+	"legacy": supportedCaps &^ p2p.CapMux,
+}
+
+// requireGet checks that s reads back data for key.
+func requireGet(t *testing.T, s *FileServer, key string, data []byte) {
+	t.Helper()
+	r, err := s.Get(key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	assert.Equal(t, data, got)
+}
+
+// TestStoreAfterDestinationKilledMidStream cuts the connection to one destination while a
+// replica is streamed to it. The other destination keeps both that replica and the next one,
+// and both objects are read back from it.
+func TestStoreAfterDestinationKilledMidStream(t *testing.T) {
+	for name, caps := range streamFramings {
+		t.Run(name, func(t *testing.T) {
+			network := p2p.NewMemoryNetwork(1)
+			a := makeMemoryServer(t, network, ":4000")
+			b := makeMemoryServer(t, network, ":4001", ":4000")
+			c := makeMemoryServer(t, network, ":4002", ":4000")
+			actAs(b, caps)
+			actAs(c, caps)
+			startCluster(t, a, b, c)
+			waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+			first, second := randomData(t, 256<<10), randomData(t, 256<<10)
+			network.Policy.SetLink(":4000", ":4002", p2p.LinkPolicy{DisconnectAt: 64 << 10})
+			a.Store("first", bytes.NewReader(first))
+			a.Store("second", bytes.NewReader(second))
+
+			for _, key := range []string{"first", "second"} {
+				waitFor(t, func() bool { return replicaCount(a, key, b) == 1 })
+			}
+			assert.Equal(t, string(first), replicaContent(t, b, a, "first"))
+			assert.Equal(t, string(second), replicaContent(t, b, a, "second"))
+			require.NoError(t, a.Storage.Delete(a.ID, "first"))
+			require.NoError(t, a.Storage.Delete(a.ID, "second"))
+			requireGet(t, a, "first", first)
+			requireGet(t, a, "second", second)
+		})
+	}
+}
+
+// TestStoreAfterReplicationCancelled stops a Store while its replica is streamed. The peer
+// discards the partial replica, and the next Store on the same connection gets through.
+func TestStoreAfterReplicationCancelled(t *testing.T) {
+	for name, caps := range streamFramings {
+		t.Run(name, func(t *testing.T) {
+			network := p2p.NewMemoryNetwork(1)
+			a := makeMemoryServer(t, network, ":4000")
+			b := makeMemoryServer(t, network, ":4001", ":4000")
+			actAs(b, caps)
+			startCluster(t, a, b)
+			waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+			// The first report of the replica's progress cancels the Store.
+			opts := TransferOpts{ProgressInterval: 4 << 10, Progress: func(p TransferProgress) {
+				if p.Phase == TransferReplicate {
+					a.CancelTransfer(p.ID)
+				}
+			}}
+			err := a.StoreContext(context.Background(), "big.iso", bytes.NewReader(randomData(t, 256<<10)), opts)
+			require.ErrorIs(t, err, context.Canceled)
+			assert.Equal(t, int64(1), a.Metrics()["streams_aborted"])
+
+			data := randomData(t, 64<<10)
+			require.NoError(t, a.Store("after", bytes.NewReader(data)))
+			waitFor(t, func() bool { return replicaCount(a, "after", b) == 1 })
+			assert.Equal(t, string(data), replicaContent(t, b, a, "after"))
+			assert.Zero(t, replicaCount(a, "big.iso", b), "a partial replica must not be committed")
+			assert.Len(t, a.peerList(), 1, "the connection should have been kept")
+			require.NoError(t, a.Storage.Delete(a.ID, "after"))
+			requireGet(t, a, "after", data)
+		})
+	}
+}
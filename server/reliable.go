@@ -0,0 +1,509 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// reliableFileName is the journal in the storage root of the durable control messages peers
+// have not acknowledged, and the sequence numbers applied from each peer.
+const reliableFileName = ".dfs-reliable.jsonl"
+
+const (
+	// defaultAckRetryInterval is how long an unacknowledged control message waits before it is
+	// sent again when AckRetryInterval is not set.
+	defaultAckRetryInterval = time.Second
+	// maxAckRetryDoublings bounds the backoff of a peer that keeps not acknowledging, which
+	// doubles the retry interval after each attempt.
+	maxAckRetryDoublings = 6
+	// maxReliableBacklog is the most unacknowledged messages held for one peer. Past it the
+	// oldest are given up on, and the peer skips them.
+	maxReliableBacklog = 10000
+	// minReliableCompaction is the fewest records the acknowledgement log grows by before it
+	// is rewritten.
+	minReliableCompaction = 1024
+)
+
+// delivery is the guarantee a control message is sent with to peers supporting acknowledgements.
+type delivery int
+
+const (
+	// deliveryBestEffort sends the message once; it is lost if the connection drops.
+	deliveryBestEffort delivery = iota
+	// deliveryReliable sends the message again until the peer acknowledges it, for as long as
+	// this node runs.
+	deliveryReliable
+	// deliveryDurable also persists the message, so it is sent again after a restart.
+	deliveryDurable
+)
+
+// deliveryOf returns the guarantee a payload is sent with. Deletes, pins and alias changes are
+// durable, since a peer missing one keeps an object, a placement or a target given up; pruned
+// versions are only reliable, since a version left behind is pruned again with the next one.
+//
+// The handlers of these messages are idempotent: deleting a missing replica, pinning a key to
+// the nodes it is pinned to, applying an alias change no later than the one known and deleting
+// versions already pruned change nothing, so a message applied again after this node
+// restarted, when its sequence starts over, does no harm.
+func deliveryOf(payload any) delivery {
+	switch payload.(type) {
+	case MessageDeleteFile, MessagePin, MessageAlias:
+		return deliveryDurable
+	case MessageDeleteVersions:
+		return deliveryReliable
+	}
+	return deliveryBestEffort
+}
+
+// MessageReliable carries a control message a peer must acknowledge with a MessageAck once it
+// has applied it. Messages are numbered per peer in the order they were sent, and a peer only
+// applies the one following the last it applied, so each is applied once and in order however
+// often it is sent again.
+type MessageReliable struct {
+	Epoch uint64 // Run of the sender the sequence belongs to; sequences start over with each run
+	Seq   uint64 // Sequence number of the message, from one
+	First uint64 // Lowest sequence number the sender still holds; those before it were given up on
+	Entry []byte // The message, in the form written by encodeMessage
+}
+
+// MessageAck acknowledges every MessageReliable of a sender's run up to and including Seq.
+type MessageAck struct {
+	Epoch uint64 // Epoch of the messages acknowledged
+	Seq   uint64 // Sequence number of the last message applied
+}
+
+// reliableEntry is a message held until the peer acknowledges it.
+type reliableEntry struct {
+	seq     uint64 // Sequence number of the message
+	entry   []byte // Encoded message
+	durable bool   // Whether the message is persisted
+}
+
+// reliableOutbox is the messages a peer has not acknowledged.
+type reliableOutbox struct {
+	next     uint64          // Sequence number of the last message added
+	entries  []reliableEntry // Unacknowledged messages in sequence order
+	attempts int             // Times the messages were sent again without progress
+	retryAt  time.Time       // When they are next sent again
+}
+
+// reliableWindow is the progress of the messages received from a peer.
+type reliableWindow struct {
+	Epoch   uint64 `json:"epoch"`   // Run of the peer the messages belong to
+	Applied uint64 `json:"applied"` // Sequence number of the last message applied
+}
+
+// reliableRecord is one line of the persisted reliableLog, a journal of the changes to the
+// durable messages held for peers and to the progress of the messages received from them.
+type reliableRecord struct {
+	Peer   string          `json:"peer"`             // Node ID of the peer
+	Add    []byte          `json:"add,omitempty"`    // Durable message added for the peer
+	Drop   int             `json:"drop,omitempty"`   // Oldest durable messages of the peer acknowledged or given up on
+	Forget bool            `json:"forget,omitempty"` // The peer left, and its messages were dropped
+	Window *reliableWindow `json:"window,omitempty"` // Progress of the messages received from the peer
+}
+
+// reliableLog numbers the control messages sent to each peer, holds them until they are
+// acknowledged, and records which were applied from each peer. Every change to durable
+// messages or to the progress of a peer is appended to a journal, which is rewritten with
+// only what is left once it has grown to twice its size after the last rewrite.
+type reliableLog struct {
+	mu        sync.Mutex
+	path      string                     // Location of the journal, empty until load is called
+	epoch     uint64                     // Run of this node, which numbers its messages afresh
+	outboxes  map[string]*reliableOutbox // Messages waiting for acknowledgement by node ID
+	windows   map[string]reliableWindow  // Progress of the messages received by node ID
+	records   int                        // Records in the journal
+	compactAt int                        // Records past which the journal is rewritten
+}
+
+// newReliableLog returns a log numbering messages under epoch, not persisted until load is
+// called.
+func newReliableLog(epoch uint64) *reliableLog {
+	return &reliableLog{
+		epoch:    epoch,
+		outboxes: make(map[string]*reliableOutbox),
+		windows:  make(map[string]reliableWindow),
+	}
+}
+
+// load replays the journal at path, if any, and persists later changes there. Durable
+// messages left unacknowledged by an earlier run are numbered afresh under this run's epoch.
+// A last record cut short by a crash is ignored.
+func (l *reliableLog) load(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	held := make(map[string][][]byte)
+	lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var r reliableRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return fmt.Errorf("reading acknowledgement log %s: %w", path, err)
+		}
+		switch {
+		case r.Forget:
+			delete(held, r.Peer)
+		case r.Window != nil:
+			l.windows[r.Peer] = *r.Window
+		case r.Drop > 0:
+			held[r.Peer] = held[r.Peer][min(r.Drop, len(held[r.Peer])):]
+		default:
+			held[r.Peer] = append(held[r.Peer], r.Add)
+		}
+	}
+	for id, entries := range held {
+		for _, entry := range entries {
+			l.addLocked(id, entry, true)
+		}
+	}
+	return l.compactLocked()
+}
+
+// add numbers a message for a peer and holds it until the peer acknowledges it. A peer that
+// had nothing left to acknowledge is sent its messages again from retryAt.
+//
+// Returns: The message to send the peer.
+func (l *reliableLog) add(id string, entry []byte, durable bool, retryAt time.Time) MessageReliable {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	msg, dropped := l.addLocked(id, entry, durable)
+	if o := l.outboxes[id]; len(o.entries) == 1 {
+		o.retryAt = retryAt
+	}
+	if dropped > 0 {
+		l.appendLocked(reliableRecord{Peer: id, Drop: dropped})
+	}
+	if durable {
+		l.appendLocked(reliableRecord{Peer: id, Add: entry})
+	}
+	return msg
+}
+
+// addLocked adds a message; the caller must hold mu.
+//
+// Returns: The message to send the peer, and the number of durable messages given up on to
+// make room for it.
+func (l *reliableLog) addLocked(id string, entry []byte, durable bool) (MessageReliable, int) {
+	o, ok := l.outboxes[id]
+	if !ok {
+		o = &reliableOutbox{}
+		l.outboxes[id] = o
+	}
+	o.next++
+	o.entries = append(o.entries, reliableEntry{seq: o.next, entry: entry, durable: durable})
+	dropped := 0
+	if n := len(o.entries) - maxReliableBacklog; n > 0 {
+		dropped = countDurable(o.entries[:n])
+		o.entries = o.entries[n:]
+	}
+	return MessageReliable{Epoch: l.epoch, Seq: o.next, First: o.entries[0].seq, Entry: entry}, dropped
+}
+
+// countDurable returns the number of durable messages among entries.
+func countDurable(entries []reliableEntry) int {
+	n := 0
+	for _, e := range entries {
+		if e.durable {
+			n++
+		}
+	}
+	return n
+}
+
+// ack forgets the messages a peer acknowledged and resets its backoff, sending those left
+// again from retryAt. Acknowledgements of an earlier run's messages are ignored.
+func (l *reliableLog) ack(id string, epoch uint64, seq uint64, retryAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	o, ok := l.outboxes[id]
+	if !ok || epoch != l.epoch {
+		return
+	}
+	n := 0
+	for n < len(o.entries) && o.entries[n].seq <= seq {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	durable := countDurable(o.entries[:n])
+	o.entries = o.entries[n:]
+	o.attempts = 0
+	o.retryAt = retryAt
+	if durable > 0 {
+		l.appendLocked(reliableRecord{Peer: id, Drop: durable})
+	}
+}
+
+// due returns the messages a peer has not acknowledged if they are due to be sent again, and
+// backs off the next attempt.
+func (l *reliableLog) due(id string, now time.Time, interval time.Duration) []MessageReliable {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	o, ok := l.outboxes[id]
+	if !ok || len(o.entries) == 0 || now.Before(o.retryAt) {
+		return nil
+	}
+	o.retryAt = now.Add(interval << min(o.attempts, maxAckRetryDoublings))
+	o.attempts++
+	msgs := make([]MessageReliable, len(o.entries))
+	for i, e := range o.entries {
+		msgs[i] = MessageReliable{Epoch: l.epoch, Seq: e.seq, First: o.entries[0].seq, Entry: e.entry}
+	}
+	return msgs
+}
+
+// rewind makes the messages a peer has not acknowledged due at once, with the backoff reset.
+func (l *reliableLog) rewind(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if o, ok := l.outboxes[id]; ok {
+		o.attempts = 0
+		o.retryAt = time.Time{}
+	}
+}
+
+// forget drops the messages held for a peer that left the cluster.
+func (l *reliableLog) forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.outboxes[id]; !ok {
+		return
+	}
+	delete(l.outboxes, id)
+	l.appendLocked(reliableRecord{Peer: id, Forget: true})
+}
+
+// accept decides whether a message from a peer is applied: only the one following the last
+// applied is, and the peer's progress is advanced before the caller applies it. A message of
+// a new epoch starts the peer's progress over, and one whose sender gave up on the messages
+// before First skips them.
+//
+// Returns: Whether to apply the message, and the sequence number of the last message applied,
+// to acknowledge.
+func (l *reliableLog) accept(id string, msg MessageReliable) (bool, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	was, ok := l.windows[id]
+	w := was
+	if !ok || w.Epoch != msg.Epoch {
+		w = reliableWindow{Epoch: msg.Epoch}
+	}
+	if msg.First > w.Applied+1 {
+		w.Applied = msg.First - 1
+	}
+	apply := msg.Seq == w.Applied+1
+	if apply {
+		w.Applied = msg.Seq
+	}
+	if !ok || w != was {
+		l.windows[id] = w
+		l.appendLocked(reliableRecord{Peer: id, Window: &w})
+	}
+	return apply, w.Applied
+}
+
+// appendLocked adds records to the journal, rewriting it once it has grown enough. Failures
+// are logged since the in-memory log stays usable; the caller must hold mu.
+func (l *reliableLog) appendLocked(records ...reliableRecord) {
+	if len(l.path) == 0 {
+		return
+	}
+	if l.records+len(records) > l.compactAt {
+		if err := l.compactLocked(); err != nil {
+			log.Printf("persisting acknowledgement log %s: %s", l.path, err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Printf("persisting acknowledgement log %s: %s", l.path, err)
+			return
+		}
+		buf.Write(append(b, '\n'))
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		_, err = f.Write(buf.Bytes())
+		err = errors.Join(err, f.Close())
+	}
+	if err != nil {
+		log.Printf("persisting acknowledgement log %s: %s", l.path, err)
+		return
+	}
+	l.records += len(records)
+}
+
+// compactLocked rewrites the journal with one record per durable message held and per peer
+// whose messages were applied; the caller must hold mu.
+func (l *reliableLog) compactLocked() error {
+	var buf bytes.Buffer
+	records := 0
+	write := func(r reliableRecord) error {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+		records++
+		return nil
+	}
+	for id, o := range l.outboxes {
+		for _, e := range o.entries {
+			if !e.durable {
+				continue
+			}
+			if err := write(reliableRecord{Peer: id, Add: e.entry}); err != nil {
+				return err
+			}
+		}
+	}
+	for id, w := range l.windows {
+		if err := write(reliableRecord{Peer: id, Window: &w}); err != nil {
+			return err
+		}
+	}
+	if err := storage.WriteFileAtomic(l.path, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	l.records = records
+	l.compactAt = 2*records + minReliableCompaction
+	return nil
+}
+
+// loadReliable attaches the acknowledgement log to its file in the storage root.
+func (s *FileServer) loadReliable() error {
+	return s.reliable.load(filepath.Join(s.Storage.Root, reliableFileName))
+}
+
+// ackRetryInterval returns how long an unacknowledged control message waits before it is sent
+// again, negative when control messages are sent once without acknowledgement.
+func (s *FileServer) ackRetryInterval() time.Duration {
+	if s.AckRetryInterval == 0 {
+		return defaultAckRetryInterval
+	}
+	return s.AckRetryInterval
+}
+
+// sendReliable numbers a message for each of peers, which must support acknowledgements, and
+// sends it, holding it until the peer acknowledges it. Peers it cannot be sent to now are only
+// logged, since it is sent again.
+func (s *FileServer) sendReliable(peers []p2p.Node, msg *Message, class delivery) {
+	if len(peers) == 0 {
+		return
+	}
+	entry, err := encodeMessage(msg, true)
+	if err != nil {
+		log.Printf("[%s] encoding %T: %s", s.Transport.Addr(), msg.Payload, err)
+		return
+	}
+	retryAt := s.Clock.Now().Add(s.ackRetryInterval())
+	for _, peer := range peers {
+		wrapped := s.reliable.add(peerPlacementNode(peer).id, entry, class == deliveryDurable, retryAt)
+		s.sendTracked(peer, wrapped)
+	}
+}
+
+// sendTracked sends a numbered message to a peer, coalesced with others when it can be.
+func (s *FileServer) sendTracked(peer p2p.Node, msg MessageReliable) {
+	if err := s.sendCoalesced([]p2p.Node{peer}, &Message{Payload: msg}); err != nil {
+		log.Printf("[%s] sending message %d to (%s), to be retried: %s", s.Transport.Addr(), msg.Seq, peer.RemoteAddr(), err)
+	}
+}
+
+// reliableLoop sends the messages peers have not acknowledged again, backing off each peer
+// that keeps not acknowledging, until the server is stopped.
+func (s *FileServer) reliableLoop() {
+	ticker := s.Clock.NewTicker(s.ackRetryInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			peers, _ := s.peersWith(s.peerList(), func(caps peerCaps) bool { return caps.reliable })
+			for _, peer := range peers {
+				s.retryReliable(peer)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// retryReliable sends a peer the messages it has not acknowledged, if they are due.
+func (s *FileServer) retryReliable(peer p2p.Node) {
+	msgs := s.reliable.due(peerPlacementNode(peer).id, s.Clock.Now(), s.ackRetryInterval())
+	s.metrics.reliableRetries.Add(int64(len(msgs)))
+	for _, msg := range msgs {
+		s.sendTracked(peer, msg)
+	}
+}
+
+// resendReliable sends a peer that connected the messages it has not acknowledged at once,
+// since they were most likely lost with its last connection.
+func (s *FileServer) resendReliable(peer p2p.Node) {
+	if s.ackRetryInterval() < 0 || !s.capsOf(peer).reliable {
+		return
+	}
+	s.reliable.rewind(peerPlacementNode(peer).id)
+	s.retryReliable(peer)
+}
+
+// handleMessageReliable applies a numbered message if it follows the last one applied from
+// the peer, then acknowledges every message applied so far. Messages applied before are
+// counted as duplicates and acknowledged again, since the last acknowledgement was lost.
+func (s *FileServer) handleMessageReliable(from string, msg MessageReliable) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	entry, err := s.receive(from, msg.Entry)
+	if err != nil {
+		return s.rejectMessage(from, fmt.Errorf("decoding message %d: %w", msg.Seq, err))
+	}
+	switch entry.Payload.(type) {
+	case MessageReliable, MessageBatch:
+		return fmt.Errorf("message %d from (%s) wraps a %T", msg.Seq, from, entry.Payload)
+	}
+	apply, applied := s.reliable.accept(peerPlacementNode(peer).id, msg)
+	if apply {
+		err = s.handleMessage(from, &entry)
+	} else if msg.Seq <= applied {
+		s.metrics.reliableDuplicates.Add(1)
+	}
+	ack := &Message{Payload: MessageAck{Epoch: msg.Epoch, Seq: applied}}
+	return errors.Join(err, s.sendCoalesced([]p2p.Node{peer}, ack))
+}
+
+// handleMessageAck forgets the messages a peer acknowledged.
+func (s *FileServer) handleMessageAck(from string, msg MessageAck) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	s.reliable.ack(peerPlacementNode(peer).id, msg.Epoch, msg.Seq, s.Clock.Now().Add(s.ackRetryInterval()))
+	return nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unacked returns the number of messages s holds for the node with the given ID.
+func unacked(s *FileServer, id string) int {
+	s.reliable.mu.Lock()
+	defer s.reliable.mu.Unlock()
+	if o, ok := s.reliable.outboxes[id]; ok {
+		return len(o.entries)
+	}
+	return 0
+}
+
+// TestDeleteAppliedOnceAfterLostAck cuts the connection after b applied a delete but before a
+// heard its acknowledgement. After reconnecting, a sends the delete again, and b must not apply
+// it a second time: a replica b was sent in between survives.
+func TestDeleteAppliedOnceAfterLostAck(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.AckRetryInterval = time.Hour
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	require.NoError(t, a.Store("report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 1 })
+
+	network.Policy.Partition(":4001", ":4000")
+	require.NoError(t, a.Delete("report"))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 0 })
+	assert.Equal(t, 1, unacked(a, b.ID))
+
+	// The replica is back on b before the delete reaches it again.
+	rep, err := a.prepareReplica("report", bytes.NewReader([]byte("kept")))
+	require.NoError(t, err)
+	_, err = b.Storage.Write(a.ID, crypto.HashKey("report"), bytes.NewReader(rep.data))
+	require.NoError(t, err)
+
+	network.Policy.PartitionBetween(":4000", ":4001")
+	waitFor(t, func() bool { return len(a.peerList()) == 0 })
+	network.Policy.Heal()
+	waitFor(t, func() bool { return unacked(a, b.ID) == 0 })
+	assert.Equal(t, int64(1), b.Metrics()["reliable_duplicates"])
+	assert.Equal(t, "kept", replicaContent(t, b, a, "report"))
+}
+
+// TestDeleteDeliveredAfterLostMessage cuts the connection after a delete was lost on its way
+// to b, which applies it once a sends it again on reconnecting.
+func TestDeleteDeliveredAfterLostMessage(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.AckRetryInterval = time.Hour
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	require.NoError(t, a.Store("report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 1 })
+
+	network.Policy.Partition(":4000", ":4001")
+	frames := a.Metrics()["coalesced_frames"]
+	require.NoError(t, a.Delete("report"))
+	// The delete leaves a once its coalescing window passes, and is lost on the way.
+	waitFor(t, func() bool { return a.Metrics()["coalesced_frames"] > frames })
+	require.Equal(t, 1, replicaCount(a, "report", b), "the delete should have been lost")
+
+	network.Policy.PartitionBetween(":4000", ":4001")
+	waitFor(t, func() bool { return len(a.peerList()) == 0 })
+	network.Policy.Heal()
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 0 })
+	waitFor(t, func() bool { return unacked(a, b.ID) == 0 })
+	assert.Zero(t, b.Metrics()["reliable_duplicates"])
+}
+
+// TestDeleteRetriedWhileConnected sends a delete again, with the connection left open, once
+// the loss of the first copy is noticed by the missing acknowledgement.
+func TestDeleteRetriedWhileConnected(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.AckRetryInterval = 50 * time.Millisecond
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	require.NoError(t, a.Store("report", bytes.NewReader([]byte("draft"))))
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 1 })
+
+	network.Policy.Partition(":4000", ":4001")
+	require.NoError(t, a.Delete("report"))
+	waitFor(t, func() bool { return a.Metrics()["reliable_retries"] > 0 })
+	network.Policy.Heal()
+	waitFor(t, func() bool { return replicaCount(a, "report", b) == 0 })
+	waitFor(t, func() bool { return unacked(a, b.ID) == 0 })
+	assert.Positive(t, a.Metrics()["reliable_retries"])
+}
+
+func TestReliableLogPersistsDurableMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), reliableFileName)
+	l := newReliableLog(1)
+	require.NoError(t, l.load(path))
+	now := time.Now()
+	l.add("b", []byte("delete"), true, now)
+	l.add("b", []byte("prune"), false, now)
+	l.add("b", []byte("pin"), true, now)
+	l.ack("b", 1, 1, now)
+
+	// A new run holds the durable message left, numbered afresh.
+	restarted := newReliableLog(2)
+	require.NoError(t, restarted.load(path))
+	msgs := restarted.due("b", now, time.Second)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, MessageReliable{Epoch: 2, Seq: 1, First: 1, Entry: []byte("pin")}, msgs[0])
+	assert.Empty(t, restarted.due("b", now, time.Second), "the retry should back off")
+}
+
+func TestReliableLogAccept(t *testing.T) {
+	l := newReliableLog(1)
+	for _, step := range []struct {
+		name    string
+		msg     MessageReliable
+		apply   bool
+		applied uint64
+	}{
+		{"first", MessageReliable{Epoch: 7, Seq: 1, First: 1}, true, 1},
+		{"next", MessageReliable{Epoch: 7, Seq: 2, First: 1}, true, 2},
+		{"duplicate", MessageReliable{Epoch: 7, Seq: 2, First: 1}, false, 2},
+		{"gap", MessageReliable{Epoch: 7, Seq: 4, First: 1}, false, 2},
+		{"given up on", MessageReliable{Epoch: 7, Seq: 6, First: 5}, false, 4},
+		{"after the skip", MessageReliable{Epoch: 7, Seq: 5, First: 5}, true, 5},
+		{"new run", MessageReliable{Epoch: 8, Seq: 1, First: 1}, true, 1},
+	} {
+		apply, applied := l.accept("a", step.msg)
+		assert.Equal(t, step.apply, apply, step.name)
+		assert.Equal(t, step.applied, applied, step.name)
+	}
+}
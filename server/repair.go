@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultReadRepairInterval is the least time between read repairs of one key when
+	// ReadRepairInterval is not set.
+	defaultReadRepairInterval = 30 * time.Second
+	// readRepairMaxSize is the largest object whose replicas are read repaired, as the winning
+	// copy is held in memory until every stale peer has been sent it.
+	readRepairMaxSize = preVerifyMaxSize
+)
+
+// objectStamp precedes the objectHeader of every answer to a MessageGetFile sent to peers
+// supporting read repair, describing the sender's copy so the requester can tell which of the
+// copies it was offered is the newest.
+type objectStamp struct {
+	Version uint64 // Version of the copy, zero when its key is not versioned
+	ModTime int64  // When the copy was written, in Unix nanoseconds; zero when none is held
+}
+
+// newerThan orders copies by version, then by the time they were written.
+func (st objectStamp) newerThan(other objectStamp) bool {
+	if st.Version != other.Version {
+		return st.Version > other.Version
+	}
+	return st.ModTime > other.ModTime
+}
+
+// objectStamp returns the stamp of a stored object, zero if it is not held.
+func (s *FileServer) objectStamp(id string, key string) objectStamp {
+	meta, err := s.Storage.Metadata(id, key)
+	if err != nil {
+		return objectStamp{}
+	}
+	return objectStamp{Version: meta.Version, ModTime: meta.ModTime.UnixNano()}
+}
+
+// repairCopy is one peer's answer to a fetch, as seen by read repair.
+type repairCopy struct {
+	peer  p2p.Node          // Peer that answered
+	found bool              // Whether the peer holds the object
+	stamp objectStamp       // Version and write time of the peer's copy
+	sum   [sha256.Size]byte // Checksum of the peer's copy
+}
+
+// readRepair collects the answers of the peers supporting read repair during one fetch,
+// together with the bytes of the newest copy offered.
+type readRepair struct {
+	copies   []repairCopy      // Answers of the peers, in the order they were read
+	best     *repairCopy       // Newest copy whose bytes were kept, nil if none was
+	data     []byte            // Encrypted bytes of best
+	received [sha256.Size]byte // Checksum of the copy written to local storage
+}
+
+// offer records a peer's answer. It reports whether the copy is newer than every copy kept so
+// far and small enough to be kept, in which case its bytes should be passed to keep.
+func (rr *readRepair) offer(c repairCopy, size int64) bool {
+	rr.copies = append(rr.copies, c)
+	return c.found && size <= readRepairMaxSize && (rr.best == nil || c.stamp.newerThan(rr.best.stamp))
+}
+
+// keep holds the verified bytes of a copy offer accepted.
+func (rr *readRepair) keep(c repairCopy, data []byte) {
+	rr.best = &c
+	rr.data = data
+}
+
+// repairTable deduplicates and throttles read repairs, so a hot key read by many callers is
+// repaired at most once per interval.
+type repairTable struct {
+	clock clock.Clock // Times the intervals, the real clock when nil
+	mu    sync.Mutex
+	last  map[string]time.Time // When each key was last repaired, zero while its repair runs
+}
+
+// begin reports whether a repair of key may start now, recording it if so.
+func (r *repairTable) begin(key string, interval time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		r.last = make(map[string]time.Time)
+	}
+	now := clock.Or(r.clock).Now()
+	for k, at := range r.last {
+		if !at.IsZero() && now.Sub(at) >= interval {
+			delete(r.last, k)
+		}
+	}
+	if _, busy := r.last[key]; busy {
+		return false
+	}
+	r.last[key] = time.Time{}
+	return true
+}
+
+// end records that the repair of key finished, starting its interval.
+func (r *repairTable) end(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last[key] = clock.Or(r.clock).Now()
+}
+
+// readRepairInterval returns the least time between read repairs of one key, or a negative
+// value when read repair is disabled.
+func (s *FileServer) readRepairInterval() time.Duration {
+	if s.ReadRepairInterval == 0 {
+		return defaultReadRepairInterval
+	}
+	return s.ReadRepairInterval
+}
+
+// writeStamp writes the stamp of an object ahead of its header, when the peer it is sent to
+// supports read repair.
+func (s *FileServer) writeStamp(w io.Writer, peer p2p.Node, id string, key string) error {
+	if !s.capsOf(peer).repair {
+		return nil
+	}
+	return binary.Write(w, binary.LittleEndian, s.objectStamp(id, key))
+}
+
+// repair brings the copies of an object a fetch was offered in line with the newest of them:
+// peers that lack the object or hold another copy are sent the newest one, and so is local
+// storage once served is closed, if the copy the fetch kept was not the newest. Repairs run
+// at most once per ReadRepairInterval for each key; only peers the object is placed on are
+// repaired.
+//
+// Parameters:
+//   - key: Plain key of the object.
+//   - hashedKey: Key the object is held under on peers.
+//   - rr: Answers the fetch collected.
+//   - served: Closed once the fetch's caller has read the local copy.
+func (s *FileServer) repair(key string, hashedKey string, rr *readRepair, served <-chan struct{}) {
+	if rr.best == nil {
+		return
+	}
+	winner := *rr.best
+	var stale []p2p.Node
+	for _, c := range rr.copies {
+		if !c.found || c.sum != winner.sum {
+			stale = append(stale, c.peer)
+		}
+	}
+	stale = s.placement(key, stale)
+	localStale := rr.received != winner.sum
+	if len(stale) == 0 && !localStale {
+		return
+	}
+	if !s.repairs.begin(key, s.readRepairInterval()) {
+		s.metrics.readRepairsSkipped.Add(1)
+		return
+	}
+	defer s.repairs.end(key)
+
+	var errs []error
+	if localStale {
+		<-served
+		if _, err := s.Storage.WriteDecrypt(s.dataCipher(key), s.ID, key, bytes.NewReader(rr.data)); err != nil {
+			errs = append(errs, err)
+		} else {
+			s.metrics.readRepairs.Add(1)
+		}
+	}
+	if len(stale) > 0 {
+		rep := replica{
+			id:       s.ID,
+			key:      hashedKey,
+			data:     rr.data,
+			checksum: hex.EncodeToString(winner.sum[:]),
+			version:  winner.stamp.Version,
+		}
+		_, err := s.replicate(stale, rep)
+		repaired := len(stale)
+		var berr *BroadcastError
+		if errors.As(err, &berr) {
+			repaired -= len(berr.Failed())
+		}
+		s.metrics.readRepairs.Add(int64(repaired))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("[%s] read repair of (%s): %s", s.Transport.Addr(), key, err)
+	} else {
+		log.Printf("[%s] read repair of (%s) sent the newest copy to %d peers", s.Transport.Addr(), key, len(stale))
+	}
+	s.publish(NotifyRepair, key)
+}
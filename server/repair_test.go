@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairTableThrottles(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	repairs := repairTable{clock: clk}
+	require.True(t, repairs.begin("k", time.Hour))
+	assert.False(t, repairs.begin("k", time.Hour), "a running repair is not duplicated")
+	repairs.end("k")
+	assert.False(t, repairs.begin("k", time.Hour), "the key was repaired within the interval")
+	assert.True(t, repairs.begin("other", time.Hour))
+
+	repairs.end("other")
+	clk.Advance(59 * time.Minute)
+	assert.False(t, repairs.begin("other", time.Hour), "the key was repaired within the interval")
+	clk.Advance(time.Minute)
+	assert.True(t, repairs.begin("other", time.Hour), "the interval has passed")
+}
+
+func TestReadRepair(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	a.VersionedPrefixes = []string{""}
+	var events eventRecorder
+	b.OnNotify = events.record
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+	require.NoError(t, b.Watch(":4000"))
+
+	const key = "report"
+	hashedKey := crypto.HashKey(key)
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("first draft"))))
+	waitFor(t, func() bool {
+		meta, err := c.Storage.Metadata(a.ID, hashedKey)
+		return err == nil && meta.Version == 1
+	})
+	_, r, err := c.Storage.Read(a.ID, hashedKey)
+	require.NoError(t, err)
+	old, err := io.ReadAll(r)
+	require.NoError(t, err)
+	r.(io.Closer).Close()
+
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("final version"))))
+	for _, s := range []*FileServer{b, c} {
+		waitFor(t, func() bool {
+			meta, err := s.Storage.Metadata(a.ID, hashedKey)
+			return err == nil && meta.Version == 2
+		})
+	}
+	current, err := b.Storage.Metadata(a.ID, hashedKey)
+	require.NoError(t, err)
+
+	// Plant the first version back on c, then read through a, which has lost its copy.
+	_, err = c.Storage.Write(a.ID, hashedKey, bytes.NewReader(old))
+	require.NoError(t, err)
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	got, err := a.Get(key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(got)
+	require.NoError(t, err)
+
+	// Whichever copy the read was served from, every node ends up with the newest one.
+	waitFor(t, func() bool {
+		meta, err := c.Storage.Metadata(a.ID, hashedKey)
+		return err == nil && meta.Checksum == current.Checksum && meta.Version == 2
+	})
+	waitFor(t, func() bool {
+		_, r, err := a.Storage.Read(a.ID, key)
+		if err != nil {
+			return false
+		}
+		defer r.(io.Closer).Close()
+		data, err := io.ReadAll(r)
+		return err == nil && string(data) == "final version"
+	})
+	assert.GreaterOrEqual(t, a.Metrics()["read_repairs"], int64(1))
+	waitFor(t, func() bool {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		for _, ev := range events.events {
+			if ev.Op == NotifyRepair && ev.Key == key {
+				return true
+			}
+		}
+		return false
+	})
+}
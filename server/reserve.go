@@ -0,0 +1,333 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// reservationTTL is how long a key stays reserved for a StoreIfAbsent call that does not
+	// release it, so a node crashing during the call does not keep others from creating it.
+	reservationTTL = 5 * time.Second
+	// reserveTimeout bounds how long StoreIfAbsent waits for the peers to answer a reservation.
+	reserveTimeout = 2 * time.Second
+	// reserveRetryInterval is how long StoreIfAbsent waits before asking again for a key
+	// reserved by a call that yields to it.
+	reserveRetryInterval = 20 * time.Millisecond
+)
+
+// MessageReserveKey asks a peer to reserve a key for a StoreIfAbsent call. The peer answers
+// with a MessageReserveAnswer.
+type MessageReserveKey struct {
+	RequestID uint64   // Identifier the answer is sent back with
+	Key       string   // Hashed key
+	Holder    reserver // Call the key is reserved for
+}
+
+// MessageReserveAnswer tells the sender of a MessageReserveKey whether the key was reserved.
+type MessageReserveAnswer struct {
+	RequestID uint64   // Identifier the reservation was asked for with
+	Exists    bool     // Whether the peer holds the key, in which case nothing was reserved
+	Holder    reserver // Call the key is reserved for, the requester's when it was granted
+	Err       string   // Why the peer could not tell, empty when it could
+}
+
+// MessageReleaseKey drops a reservation made with MessageReserveKey.
+type MessageReleaseKey struct {
+	Key    string   // Hashed key
+	Holder reserver // Call the key was reserved for; reservations of other calls are kept
+}
+
+// reserver identifies a StoreIfAbsent call. When two calls race for a key, the one ordered
+// first, by node ID and then by sequence, wins.
+type reserver struct {
+	Node string // ID of the node making the call
+	Seq  uint64 // Number of the call on that node
+}
+
+// before reports whether r wins a race for a key against o.
+func (r reserver) before(o reserver) bool {
+	if r.Node != o.Node {
+		return r.Node < o.Node
+	}
+	return r.Seq < o.Seq
+}
+
+// reservation is a key reserved for a call until it expires.
+type reservation struct {
+	holder  reserver  // Call the key is reserved for
+	expires time.Time // When the reservation lapses unless renewed
+}
+
+// reservationTable is the keys reserved on this node, by this node's calls and its peers'.
+type reservationTable struct {
+	clock   clock.Clock // Expires the reservations
+	mu      sync.Mutex
+	entries map[string]reservation // Reservations by hashed key
+}
+
+// newReservationTable returns an empty table.
+func newReservationTable(clk clock.Clock) *reservationTable {
+	return &reservationTable{clock: clock.Or(clk), entries: make(map[string]reservation)}
+}
+
+// reserve reserves key for holder for reservationTTL, renewing holder's own reservation,
+// unless another call holds a reservation that has not expired.
+//
+// Returns: The call the key is reserved for, holder when it was granted.
+func (t *reservationTable) reserve(key string, holder reserver) reserver {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	for k, r := range t.entries {
+		if !now.Before(r.expires) {
+			delete(t.entries, k)
+		}
+	}
+	if r, ok := t.entries[key]; ok && r.holder != holder {
+		return r.holder
+	}
+	t.entries[key] = reservation{holder: holder, expires: now.Add(reservationTTL)}
+	return holder
+}
+
+// releaseNode drops the reservations held for the calls of a node.
+func (t *reservationTable) releaseNode(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, r := range t.entries {
+		if r.holder.Node == node {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// release drops the reservation of key if it is held for holder.
+func (t *reservationTable) release(key string, holder reserver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.entries[key]; ok && r.holder == holder {
+		delete(t.entries, key)
+	}
+}
+
+// reserveAnswer is a MessageReserveAnswer received from a peer.
+type reserveAnswer struct {
+	from string // Address of the peer
+	MessageReserveAnswer
+}
+
+// reserveCalls routes the answers to reservations to the StoreIfAbsent calls waiting for them.
+type reserveCalls struct {
+	mu      sync.Mutex                    // Guards waiting
+	waiting map[uint64]chan reserveAnswer // Answers by identifier of the reservation
+}
+
+// begin returns the channel the answers of up to peers peers to reservation id are delivered on.
+func (c *reserveCalls) begin(id uint64, peers int) <-chan reserveAnswer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waiting == nil {
+		c.waiting = make(map[uint64]chan reserveAnswer)
+	}
+	ch := make(chan reserveAnswer, peers)
+	c.waiting[id] = ch
+	return ch
+}
+
+// end stops delivering the answers to reservation id; later ones are dropped.
+func (c *reserveCalls) end(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.waiting, id)
+}
+
+// deliver hands an answer to the call waiting for it, if any.
+func (c *reserveCalls) deliver(answer reserveAnswer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.waiting[answer.RequestID]; ok {
+		select {
+		case ch <- answer:
+		default:
+		}
+	}
+}
+
+// StoreIfAbsent stores a file like Store, but only if no node holds the key yet, so that of
+// several nodes creating a key at once exactly one does. The key is first reserved on this
+// node and every peer: the call gives up without writing when a node holds the key, or
+// reserved it for a call that wins the race, the one from the node with the lowest ID, and
+// waits out reservations of calls that lose. Reservations are released when the call returns,
+// and lapse after reservationTTL when the node that made them crashed. Peers too old to
+// reserve keys are not asked.
+//
+// Returns: Whether the key was created, and any errors. As for Store, a *BroadcastError means
+// the key was created but not replicated to the peers it names.
+func (s *FileServer) StoreIfAbsent(key string, r io.Reader) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	hashedKey := crypto.HashKey(key)
+	holder := reserver{Node: s.ID, Seq: s.nextRequestID()}
+	peers, _ := s.peersWith(s.peerList(), func(c peerCaps) bool { return c.reserve })
+	defer s.releaseKey(peers, hashedKey, holder)
+	reserved, err := s.reserveKey(peers, key, hashedKey, holder)
+	if !reserved || err != nil {
+		return false, err
+	}
+	err = s.Store(key, r)
+	var berr *BroadcastError
+	return err == nil || errors.As(err, &berr), err
+}
+
+// reserveKey reserves a key for holder on this node and the peers, asking again while a call
+// that yields to holder keeps it reserved somewhere.
+//
+// Returns: Whether every node reserved the key for holder, false when a node holds the key or
+// reserved it for a call that wins, and any errors.
+func (s *FileServer) reserveKey(peers []p2p.Node, key string, hashedKey string, holder reserver) (bool, error) {
+	deadline := s.Clock.Now().Add(reservationTTL)
+	for {
+		if ok, err := s.Storage.Has(s.ID, key); ok || err != nil {
+			return false, err
+		}
+		answers, err := s.reserveRound(peers, hashedKey, holder)
+		if err != nil {
+			return false, fmt.Errorf("reserving (%s): %w", key, err)
+		}
+		var yielding *reserver
+		for _, answer := range answers {
+			switch {
+			case answer.Exists, answer.Holder.before(holder):
+				return false, nil
+			case answer.Holder != holder:
+				yielding = &answer.Holder
+			}
+		}
+		if yielding == nil {
+			return true, nil
+		}
+		if !s.Clock.Now().Before(deadline) {
+			return false, fmt.Errorf("reserving (%s): still reserved for a call of node %s", key, yielding.Node)
+		}
+		s.Clock.Sleep(reserveRetryInterval)
+	}
+}
+
+// reserveRound asks this node and the peers to reserve a key for holder, once.
+//
+// Returns: The answers, this node's first, and an error if a peer could not be asked, could
+// not tell, or did not answer within reserveTimeout.
+func (s *FileServer) reserveRound(peers []p2p.Node, hashedKey string, holder reserver) ([]MessageReserveAnswer, error) {
+	answers := make([]MessageReserveAnswer, 0, len(peers)+1)
+	local, err := s.reserveLocal(hashedKey, holder)
+	if err != nil {
+		return nil, err
+	}
+	answers = append(answers, local)
+	if len(peers) == 0 {
+		return answers, nil
+	}
+
+	id := s.nextRequestID()
+	ch := s.reserveCalls.begin(id, len(peers))
+	defer s.reserveCalls.end(id)
+	msg := &Message{Payload: MessageReserveKey{RequestID: id, Key: hashedKey, Holder: holder}}
+	if _, err := s.sendMessage(peers, msg); err != nil {
+		return nil, err
+	}
+	timeout := s.Clock.After(reserveTimeout)
+	answered := make(map[string]bool, len(peers))
+	for len(answered) < len(peers) {
+		select {
+		case answer := <-ch:
+			if len(answer.Err) > 0 {
+				return nil, fmt.Errorf("peer (%s): %s", answer.from, answer.Err)
+			}
+			answered[answer.from] = true
+			answers = append(answers, answer.MessageReserveAnswer)
+		case <-timeout:
+			return nil, fmt.Errorf("%d of %d peers did not answer in time", len(peers)-len(answered), len(peers))
+		}
+	}
+	return answers, nil
+}
+
+// reserveLocal reserves a key for holder on this node, unless it holds a replica of the key.
+func (s *FileServer) reserveLocal(hashedKey string, holder reserver) (MessageReserveAnswer, error) {
+	exists, err := s.holdsReplica(hashedKey)
+	if err != nil || exists {
+		return MessageReserveAnswer{Exists: exists}, err
+	}
+	return MessageReserveAnswer{Holder: s.reservations.reserve(hashedKey, holder)}, nil
+}
+
+// holdsReplica reports whether this node holds a replica of another node's object stored
+// under the hashed key.
+func (s *FileServer) holdsReplica(hashedKey string) (bool, error) {
+	owners, err := s.Storage.Owners()
+	if err != nil {
+		return false, err
+	}
+	for _, owner := range owners {
+		if owner == s.ID {
+			// The node's own objects are stored under their plain keys.
+			continue
+		}
+		if ok, err := s.Storage.Has(owner, hashedKey); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// releaseKey drops the reservations made for holder on this node and the peers.
+func (s *FileServer) releaseKey(peers []p2p.Node, hashedKey string, holder reserver) {
+	s.reservations.release(hashedKey, holder)
+	if len(peers) == 0 {
+		return
+	}
+	if _, err := s.sendMessage(peers, &Message{Payload: MessageReleaseKey{Key: hashedKey, Holder: holder}}); err != nil {
+		log.Printf("[%s] releasing a reservation: %s", s.Transport.Addr(), err)
+	}
+}
+
+// handleMessageReserveKey reserves a key for a peer's StoreIfAbsent call, unless this node
+// holds a replica of it, and answers with the outcome.
+func (s *FileServer) handleMessageReserveKey(from string, msg MessageReserveKey) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	answer, err := s.reserveLocal(msg.Key, msg.Holder)
+	answer.RequestID = msg.RequestID
+	if err != nil {
+		answer.Err = err.Error()
+	}
+	_, serr := s.sendMessage([]p2p.Node{peer}, &Message{Payload: answer})
+	return errors.Join(err, serr)
+}
+
+// handleMessageReserveAnswer hands the answer to a reservation to the call waiting for it.
+func (s *FileServer) handleMessageReserveAnswer(from string, msg MessageReserveAnswer) error {
+	if s.staleAnswer(from, "reservation answer", msg.RequestID) {
+		return nil
+	}
+	s.reserveCalls.deliver(reserveAnswer{from: from, MessageReserveAnswer: msg})
+	return nil
+}
+
+// handleMessageReleaseKey drops a reservation made for a peer's StoreIfAbsent call.
+func (s *FileServer) handleMessageReleaseKey(_ string, msg MessageReleaseKey) error {
+	s.reservations.release(msg.Key, msg.Holder)
+	return nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreIfAbsentRace(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000", ":4001")
+	racers := []*FileServer{a, b}
+	for _, s := range racers {
+		s.Namespaces = []string{"locks"}
+	}
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 && len(b.peerList()) == 2 && len(c.peerList()) == 2 })
+	// Each racer can read the other's replica, whichever wins.
+	require.NoError(t, a.GrantNamespace("locks", b.ID))
+	require.NoError(t, b.GrantNamespace("locks", a.ID))
+
+	const key = "locks/leader"
+	var (
+		wg      sync.WaitGroup
+		created [2]bool
+		errs    [2]error
+	)
+	for i, s := range racers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			created[i], errs[i] = s.StoreIfAbsent(key, strings.NewReader(s.ID))
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.NotEqual(t, created[0], created[1], "exactly one racer creates the key")
+	winner, loser := a, b
+	if created[1] {
+		winner, loser = b, a
+	}
+
+	// The loser wrote nothing and reads the winner's content from its replica.
+	ok, err := loser.Storage.Has(loser.ID, key)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	waitFor(t, func() bool {
+		ok, _ := loser.Storage.Has(winner.ID, crypto.HashKey(key))
+		return ok
+	})
+	r, err := loser.GetReplica(winner.ID, key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, winner.ID, string(got))
+
+	// Once the key exists, no node creates it again, the winner included.
+	for _, s := range []*FileServer{winner, loser, c} {
+		created, err := s.StoreIfAbsent(key, strings.NewReader("late"))
+		require.NoError(t, err)
+		assert.False(t, created, s.Transport.Addr())
+	}
+	assert.Empty(t, c.reservations.entries, "reservations are released when the calls return")
+}
+
+func TestStoreIfAbsentWaitsOutLosingReservation(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	clk := clock.NewFake(time.Now())
+	a.Clock = clk
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+
+	// A call ordered after a's holds the key on b, as if it was still deciding; a asks again
+	// once the retry interval passed, and gets the key after the reservation was released.
+	const key = "leader"
+	later := reserver{Node: a.ID + "~", Seq: 1}
+	require.Equal(t, later, b.reservations.reserve(crypto.HashKey(key), later))
+	done := make(chan bool)
+	go func() {
+		created, err := a.StoreIfAbsent(key, bytes.NewReader([]byte("a")))
+		assert.NoError(t, err)
+		done <- created
+	}()
+	// The first round leaves its answer timeout pending and sleeps before the next.
+	clk.BlockUntil(2)
+	b.reservations.release(crypto.HashKey(key), later)
+	clk.Advance(reserveRetryInterval)
+	assert.True(t, <-done)
+
+	// A call ordered before b's wins the key, so b gives up without writing.
+	earlier := reserver{Node: "", Seq: 1}
+	require.Equal(t, earlier, a.reservations.reserve(crypto.HashKey("other"), earlier))
+	created, err := b.StoreIfAbsent("other", bytes.NewReader([]byte("b")))
+	require.NoError(t, err)
+	assert.False(t, created)
+	ok, err := b.Storage.Has(b.ID, "other")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestReservationTable(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	table := newReservationTable(clk)
+	first, second := reserver{Node: "a", Seq: 1}, reserver{Node: "b", Seq: 1}
+
+	assert.Equal(t, first, table.reserve("k", first))
+	assert.Equal(t, first, table.reserve("k", second), "the key stays reserved for the first call")
+	table.release("k", second)
+	assert.Equal(t, first, table.reserve("k", second), "only the holder releases a reservation")
+
+	// Renewing extends the reservation; once it lapses another call gets the key.
+	clk.Advance(reservationTTL - time.Second)
+	assert.Equal(t, first, table.reserve("k", first))
+	clk.Advance(reservationTTL - time.Second)
+	assert.Equal(t, first, table.reserve("k", second))
+	clk.Advance(time.Second)
+	assert.Equal(t, second, table.reserve("k", second), "a crashed holder's reservation expires")
+	table.release("k", second)
+	assert.Empty(t, table.entries)
+
+	assert.True(t, first.before(second))
+	assert.True(t, reserver{Node: "a", Seq: 1}.before(reserver{Node: "a", Seq: 2}))
+	assert.False(t, second.before(first))
+}
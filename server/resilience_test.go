@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeMemoryServer is makeServer over a MemoryNetwork, so the links between servers can be
+// degraded by its policy.
+func makeMemoryServer(t testing.TB, network *p2p.MemoryNetwork, listenAddr string, nodes ...string) *FileServer {
+	tr := network.Transport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFuncSHA256,
+		Transport:         tr,
+		BootstrapNodes:    nodes,
+	})
+	tr.HandshakeFunc = s.Handshake
+	tr.OnNode = s.OnNode
+	tr.OnNodeClosed = s.OnNodeClosed
+	return s
+}
+
+// randomData returns size random bytes.
+func randomData(t testing.TB, size int) []byte {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+// hasPeers reports whether s is connected to any peer.
+func hasPeers(s *FileServer) bool {
+	return len(s.peerList()) > 0
+}
+
+func TestStoreReplicatesAfterPartitionHeals(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	network.Policy.PartitionBetween(":4000", ":4001")
+	waitFor(t, func() bool { return !hasPeers(a) && !hasPeers(b) })
+
+	// The write succeeds on its own and its replica waits for the partition to heal.
+	data := randomData(t, 10<<10)
+	require.NoError(t, b.Store("partitioned", bytes.NewReader(data)))
+	ok, err := a.Storage.Has(b.ID, crypto.HashKey("partitioned"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	network.Policy.Heal()
+	waitFor(t, func() bool {
+		ok, _ := a.Storage.Has(b.ID, crypto.HashKey("partitioned"))
+		return ok
+	})
+	require.NoError(t, a.Storage.Verify(b.ID, crypto.HashKey("partitioned")))
+}
+
+func TestStoreResendsReplicaCutMidStream(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	b := makeMemoryServer(t, network, ":4001")
+	a := makeMemoryServer(t, network, ":4000", ":4001")
+	startCluster(t, b, a)
+
+	// Cut the connection partway through the replica's bytes.
+	network.Policy.SetLink(":4000", ":4001", p2p.LinkPolicy{DisconnectAt: 20 << 10})
+	data := randomData(t, 64<<10)
+	var berr *BroadcastError
+	require.ErrorAs(t, a.Store("cut", bytes.NewReader(data)), &berr)
+
+	// a redials its bootstrap node and replays the replica that did not get through.
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("cut"))
+		return ok && b.Storage.Verify(a.ID, crypto.HashKey("cut")) == nil
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, "cut"))
+	r, err := a.Get("cut")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestGetRejectsCorruptingLink(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	data := randomData(t, 64<<10)
+	require.NoError(t, a.Store("fragile", bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("fragile"))
+		return ok
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, "fragile"))
+
+	// Flip a byte of the object itself, past the stream marker and the object header.
+	offset := int64(1 + binary.Size(objectHeader{}) + 1000)
+	network.Policy.SetLink(":4001", ":4000", p2p.LinkPolicy{CorruptAt: offset})
+	_, err := a.Get("fragile")
+	assert.ErrorIs(t, err, ErrUnavailable, "a damaged copy does not make the object absent")
+	ok, err := a.Storage.Has(a.ID, "fragile")
+	require.NoError(t, err)
+	assert.False(t, ok, "damaged bytes were kept as the object")
+
+	// The scripted corruption fired once and the stream stayed aligned, so a retry succeeds.
+	r, err := a.Get("fragile")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestGetOverSlowLink(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	network.Policy.SetBetween(":4000", ":4001", p2p.LinkPolicy{Latency: 100 * time.Millisecond, Bandwidth: 1 << 20})
+
+	data := randomData(t, 100<<10)
+	require.NoError(t, a.Store("slow", bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("slow"))
+		return ok
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, "slow"))
+	start := time.Now()
+	r, err := a.Get("slow")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "the request and answer each cross the latency")
+}
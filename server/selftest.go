@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+const (
+	// selfTestStreamBytes is how much the transport check streams over a loopback connection.
+	selfTestStreamBytes = 100 << 20
+	// selfTestTimeout bounds the loopback stream and the probe of each seed.
+	selfTestTimeout = time.Minute
+	// selfTestDir names the scratch directory the storage checks use inside StorageRoot.
+	selfTestDir = ".dfs-selftest"
+)
+
+// selfTestSizes are the sizes of the random data the crypto check encrypts and decrypts.
+var selfTestSizes = []int{0, 1, 4 << 10, 1<<20 + 7}
+
+// SelfTestCheck is the outcome of one check of SelfTest.
+type SelfTestCheck struct {
+	Name    string        `json:"name"`    // What was checked: crypto, storage, filesystem, transport or seed <addr>
+	Passed  bool          `json:"passed"`  // Whether the check passed
+	Detail  string        `json:"detail"`  // What was measured, or why the check failed
+	Elapsed time.Duration `json:"elapsed"` // Time the check took
+}
+
+// SelfTestReport is the outcome of every check of SelfTest, in the order they ran.
+type SelfTestReport struct {
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// Passed reports whether every check passed.
+func (r SelfTestReport) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// selfTestStep is a check of SelfTest, returning what it measured.
+type selfTestStep struct {
+	name string
+	run  func() (string, error)
+}
+
+// SelfTest checks that this host can run the node before it joins a cluster: that random
+// data of several sizes survives an encryption round trip under EncKey, that an object can be
+// written with a flush to disk, read back and deleted, that renames replace files atomically
+// and file locks hold on StorageRoot's filesystem, that two nodes can greet each other and
+// stream 100 MB over a loopback connection of the Transport, and, when BootstrapNodes are set,
+// that each is reachable and which protocol version it speaks. Seeds are only greeted, never
+// joined. The storage checks work in a scratch directory of StorageRoot, removed afterwards,
+// and need the root not to be in use, so SelfTest runs before Start.
+//
+// Returns: The outcome of every check, and an error naming the checks that failed.
+func (s *FileServer) SelfTest() (SelfTestReport, error) {
+	checks := []selfTestStep{
+		{"crypto", s.selfTestCrypto},
+		{"storage", s.selfTestStorage},
+		{"filesystem", s.selfTestFilesystem},
+		{"transport", s.selfTestTransport},
+	}
+	for _, addr := range s.BootstrapNodes {
+		checks = append(checks, selfTestStep{"seed " + addr, func() (string, error) { return s.selfTestSeed(addr) }})
+	}
+	var report SelfTestReport
+	var errs []error
+	for _, c := range checks {
+		start := time.Now()
+		detail, err := c.run()
+		check := SelfTestCheck{Name: c.name, Passed: err == nil, Detail: detail, Elapsed: time.Since(start)}
+		if err != nil {
+			check.Detail = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	return report, errors.Join(errs...)
+}
+
+// selfTestCrypto encrypts and decrypts random data of every size of selfTestSizes.
+func (s *FileServer) selfTestCrypto() (string, error) {
+	total := 0
+	start := time.Now()
+	for _, size := range selfTestSizes {
+		plain := make([]byte, size)
+		if _, err := rand.Read(plain); err != nil {
+			return "", fmt.Errorf("reading the entropy source: %w", err)
+		}
+		sealed := new(bytes.Buffer)
+		if _, err := crypto.CopyEncrypt(s.EncKey, bytes.NewReader(plain), sealed); err != nil {
+			return "", fmt.Errorf("encrypting %d bytes: %w", size, err)
+		}
+		if size >= 16 && bytes.Contains(sealed.Bytes(), plain) {
+			return "", fmt.Errorf("encrypting %d bytes left them in the clear", size)
+		}
+		opened := new(bytes.Buffer)
+		if _, err := crypto.CopyDecrypt(s.EncKey, sealed, opened); err != nil {
+			return "", fmt.Errorf("decrypting %d bytes: %w", size, err)
+		}
+		if !bytes.Equal(opened.Bytes(), plain) {
+			return "", fmt.Errorf("%d bytes did not survive an encryption round trip", size)
+		}
+		total += size
+	}
+	return fmt.Sprintf("%d sizes up to %d bytes round-tripped at %s/s", len(selfTestSizes), selfTestSizes[len(selfTestSizes)-1], formatRate(int64(2*total), time.Since(start))), nil
+}
+
+// selfTestStore returns a store over a scratch directory of StorageRoot configured like the
+// node's own, flushing every write, and removes the directory when done is called.
+func (s *FileServer) selfTestStore() (*storage.Store, func(), error) {
+	dir := filepath.Join(s.Storage.Root, selfTestDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	opts := s.Storage.StoreOpts
+	opts.Root = filepath.Join(dir, "store")
+	opts.SyncWrites = true
+	opts.OnChange, opts.OnSlowIO = nil, nil
+	store := storage.NewStore(opts)
+	done := func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+	if err := store.Init(); err != nil {
+		done()
+		return nil, nil, err
+	}
+	return store, done, nil
+}
+
+// selfTestStorage writes an object with a flush to disk, reads it back and deletes it.
+func (s *FileServer) selfTestStorage() (string, error) {
+	store, done, err := s.selfTestStore()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	content := make([]byte, 1<<20)
+	if _, err := rand.Read(content); err != nil {
+		return "", fmt.Errorf("reading the entropy source: %w", err)
+	}
+	start := time.Now()
+	if _, err := store.Write(s.ID, "selftest", bytes.NewReader(content)); err != nil {
+		return "", fmt.Errorf("writing: %w", err)
+	}
+	wrote := time.Since(start)
+	start = time.Now()
+	_, r, err := store.Read(s.ID, "selftest")
+	if err != nil {
+		return "", fmt.Errorf("reading: %w", err)
+	}
+	read, err := io.ReadAll(r)
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading: %w", err)
+	}
+	if !bytes.Equal(read, content) {
+		return "", errors.New("the object read back differs from the one written")
+	}
+	readIn := time.Since(start)
+	start = time.Now()
+	if err := store.Delete(s.ID, "selftest"); err != nil {
+		return "", fmt.Errorf("deleting: %w", err)
+	}
+	if ok, err := store.Has(s.ID, "selftest"); ok || err != nil {
+		return "", errors.Join(errors.New("the object is still there once deleted"), err)
+	}
+	return fmt.Sprintf("1 MiB written and flushed in %s, read in %s, deleted in %s", roundElapsed(wrote), roundElapsed(readIn), roundElapsed(time.Since(start))), nil
+}
+
+// selfTestFilesystem checks that a second store cannot take the lock on StorageRoot, then
+// renames a file over another in it.
+func (s *FileServer) selfTestFilesystem() (string, error) {
+	opts := s.Storage.StoreOpts
+	opts.OnChange, opts.OnSlowIO = nil, nil
+	holder := storage.NewStore(opts)
+	if err := holder.Init(); err != nil {
+		return "", fmt.Errorf("locking the storage root: %w", err)
+	}
+	defer holder.Close()
+	err := storage.NewStore(opts).Init()
+	if err == nil {
+		return "", errors.New("file locks do not hold: a second store took the locked storage root")
+	}
+	if !errors.Is(err, storage.ErrRootLocked) {
+		return "", fmt.Errorf("checking the lock on the storage root: %w", err)
+	}
+
+	dir := filepath.Join(s.Storage.Root, selfTestDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "renamed")
+	if err := os.WriteFile(target, []byte("old"), 0o644); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, "renamed.tmp")
+	if err := os.WriteFile(tmp, []byte("new"), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return "", fmt.Errorf("renaming over a file: %w", err)
+	}
+	if b, err := os.ReadFile(target); err != nil || string(b) != "new" {
+		return "", errors.Join(errors.New("a rename did not replace the file it was renamed over"), err)
+	}
+	return "locks hold, renames replace files atomically", nil
+}
+
+// selfTestNet returns how the Transport listens and dials, through its Listen and Connect
+// options when it has them.
+func (s *FileServer) selfTestNet() (listen func(string, string) (net.Listener, error), connect func(string, string) (net.Conn, error)) {
+	listen, connect = net.Listen, func(network string, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, selfTestTimeout)
+	}
+	if tr, ok := s.Transport.(*p2p.TCPTransport); ok {
+		if tr.Listen != nil {
+			listen = tr.Listen
+		}
+		if tr.Connect != nil {
+			connect = tr.Connect
+		}
+	}
+	return listen, connect
+}
+
+// selfTestTransport greets a loopback connection with this node's hello from both ends, then
+// streams selfTestStreamBytes over it.
+func (s *FileServer) selfTestTransport() (string, error) {
+	listen, connect := s.selfTestNet()
+	l, err := listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("listening on loopback: %w", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	out, err := connect("tcp", l.Addr().String())
+	if err != nil {
+		return "", fmt.Errorf("dialing loopback: %w", err)
+	}
+	defer out.Close()
+	in, ok := <-accepted
+	if !ok {
+		return "", errors.New("accepting the loopback connection failed")
+	}
+	defer in.Close()
+
+	greet := p2p.HelloHandshakeFunc(s.Hello())
+	greeted := make(chan error, 1)
+	go func() {
+		greeted <- greet(p2p.NewTCPPeer(in, false))
+	}()
+	start := time.Now()
+	if err := errors.Join(greet(p2p.NewTCPPeer(out, true)), <-greeted); err != nil {
+		return "", fmt.Errorf("handshake: %w", err)
+	}
+	handshake := time.Since(start)
+
+	deadline := time.Now().Add(selfTestTimeout)
+	if err := errors.Join(out.SetDeadline(deadline), in.SetDeadline(deadline)); err != nil {
+		return "", err
+	}
+	received := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(io.Discard, in)
+		if err == nil && n != selfTestStreamBytes {
+			err = fmt.Errorf("received %d of %d bytes", n, selfTestStreamBytes)
+		}
+		received <- err
+	}()
+	start = time.Now()
+	chunk := make([]byte, 64<<10)
+	var sendErr error
+	for sent := 0; sent < selfTestStreamBytes && sendErr == nil; sent += len(chunk) {
+		_, sendErr = out.Write(chunk)
+	}
+	if sendErr == nil {
+		sendErr = out.Close()
+	}
+	if err := errors.Join(sendErr, <-received); err != nil {
+		return "", fmt.Errorf("streaming: %w", err)
+	}
+	elapsed := time.Since(start)
+	return fmt.Sprintf("handshake in %s, %d MiB streamed at %s/s", roundElapsed(handshake), selfTestStreamBytes>>20, formatRate(selfTestStreamBytes, elapsed)), nil
+}
+
+// selfTestSeed greets the seed at addr and reports its node ID and protocol version, closing
+// the connection without joining.
+func (s *FileServer) selfTestSeed(addr string) (string, error) {
+	_, connect := s.selfTestNet()
+	start := time.Now()
+	conn, err := connect("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("unreachable: %w", err)
+	}
+	defer conn.Close()
+	peer := p2p.NewTCPPeer(conn, true)
+	if err := p2p.HelloHandshakeFunc(s.Hello())(peer); err != nil {
+		return "", err
+	}
+	hello := peer.Hello()
+	detail := fmt.Sprintf("node %s answered in %s, protocol version %d", hello.NodeID, roundElapsed(time.Since(start)), hello.ProtocolVersion)
+	if hello.ProtocolVersion != p2p.ProtocolVersion {
+		detail += fmt.Sprintf(" (this build speaks %d)", p2p.ProtocolVersion)
+	}
+	return detail, nil
+}
+
+// roundElapsed rounds a duration measured by a self-test for display.
+func roundElapsed(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(10 * time.Microsecond)
+}
+
+// formatRate formats n bytes moved in d as a rate in binary units.
+func formatRate(n int64, d time.Duration) string {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	rate := float64(n) / d.Seconds()
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for ; rate >= 1024 && i < len(units)-1; i++ {
+		rate /= 1024
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", rate), ".0") + " " + units[i]
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingWriter fails every write, as a disk gone read-only does.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("read-only file system")
+}
+
+func TestSelfTestPasses(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	seed := makeMemoryServer(t, network, ":4000")
+	startCluster(t, seed, makeMemoryServer(t, network, ":4001", ":4000"))
+	s := makeMemoryServer(t, network, ":4002", ":4000")
+
+	report, err := s.SelfTest()
+	require.NoError(t, err)
+	require.True(t, report.Passed())
+	names := make([]string, len(report.Checks))
+	for i, c := range report.Checks {
+		names[i] = c.Name
+		assert.NotEmpty(t, c.Detail, c.Name)
+	}
+	assert.Equal(t, []string{"crypto", "storage", "filesystem", "transport", "seed :4000"}, names)
+	assert.Contains(t, report.Checks[3].Detail, "100 MiB streamed")
+	assert.Contains(t, report.Checks[4].Detail, seed.ID)
+	assert.Contains(t, report.Checks[4].Detail, "protocol version 5")
+
+	// The checks leave nothing behind in the root, and the node can still start on it.
+	_, err = os.Stat(filepath.Join(s.StorageRoot, selfTestDir))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Empty(t, s.peerList(), "the seed is only greeted, not joined")
+	require.NoError(t, s.Storage.Init())
+	require.NoError(t, s.Storage.Close())
+}
+
+func TestSelfTestReportsFailures(t *testing.T) {
+	for _, tc := range []struct {
+		check string
+		force func(t *testing.T, network *p2p.MemoryNetwork, s *FileServer)
+	}{
+		{"crypto", func(t *testing.T, _ *p2p.MemoryNetwork, s *FileServer) {
+			s.EncKey = []byte("too short")
+		}},
+		{"storage", func(t *testing.T, _ *p2p.MemoryNetwork, s *FileServer) {
+			s.Storage.WrapWrites = func(io.Writer) io.Writer { return failingWriter{} }
+		}},
+		{"filesystem", func(t *testing.T, _ *p2p.MemoryNetwork, s *FileServer) {
+			// Another process holds the root.
+			other := storage.NewStore(storage.StoreOpts{Root: s.StorageRoot, PathTransformFunc: s.PathTransformFunc})
+			require.NoError(t, other.Init())
+			t.Cleanup(func() { other.Close() })
+		}},
+		{"transport", func(t *testing.T, network *p2p.MemoryNetwork, _ *FileServer) {
+			// The loopback address is taken.
+			taken := network.Transport(p2p.TCPTransportOpts{ListenAddr: "127.0.0.1:0", HandshakeFunc: p2p.NOPHandshakeFunc, Decoder: p2p.DefaultDecoder{}})
+			require.NoError(t, taken.ListenAndAccept())
+			t.Cleanup(func() { taken.Close() })
+		}},
+		{"seed :4999", func(t *testing.T, _ *p2p.MemoryNetwork, s *FileServer) {
+			s.BootstrapNodes = append(s.BootstrapNodes, ":4999")
+		}},
+	} {
+		t.Run(tc.check, func(t *testing.T) {
+			network := p2p.NewMemoryNetwork(1)
+			s := makeMemoryServer(t, network, ":4001")
+			tc.force(t, network, s)
+
+			report, err := s.SelfTest()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.check+":")
+			assert.False(t, report.Passed())
+			for _, c := range report.Checks {
+				assert.Equal(t, c.Name != tc.check, c.Passed, "%s: %s", c.Name, c.Detail)
+			}
+		})
+	}
+}
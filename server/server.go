@@ -2,14 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
 	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
 	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
 	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
@@ -17,223 +28,1393 @@ import (
 
 // FileServerOpts defines options used for configuring the FileServer instance.
 type FileServerOpts struct {
-	ID                string                    // Unique identifier for the server node
-	EncKey            []byte                    // Encryption key for file storage and transmission
-	StorageRoot       string                    // Root path for file storage
-	PathTransformFunc storage.PathTransformFunc // Function to transform file paths based on the key
-	Transport         p2p.Link                  // Transport layer for peer-to-peer communication
-	BootstrapNodes    []string                  // List of nodes for initial network bootstrap
+	ID                     string                      // Unique identifier for the server node
+	EncKey                 []byte                      // Encryption key for file storage and transmission
+	StorageRoot            string                      // Root path for file storage
+	PathTransformFunc      storage.PathTransformFunc   // Function to transform file paths based on the key
+	PathTransformName      string                      // Registered path transform name, used when PathTransformFunc is nil
+	Transport              p2p.Link                    // Transport layer for peer-to-peer communication
+	BootstrapNodes         []string                    // List of nodes for initial network bootstrap
+	Bootstrap              BootstrapSource             // Source of the bootstrap nodes, such as a DNSBootstrap; BootstrapNodes when nil
+	OnCorruption           func(key string, err error) // Optional callback invoked when a corrupt local object is detected
+	NegativeCacheTTL       time.Duration               // How long a cluster-wide miss is remembered; zero disables negative caching
+	NegativeCacheSize      int                         // Maximum number of remembered misses, defaults to defaultNegativeCacheEntries
+	BatchInFlight          int                         // Maximum objects per batch frame in StoreBatch/GetBatch, defaults to defaultBatchInFlight
+	GCInterval             time.Duration               // How often storage garbage collection runs; zero disables it
+	GCGracePeriod          time.Duration               // Minimum age of orphaned files before GC removes them, defaults to storage.DefaultGCGracePeriod
+	PrefetchFile           string                      // Optional newline-separated list of keys pulled from the cluster at startup
+	PrefetchConcurrency    int                         // Number of keys prefetched at once, defaults to defaultPrefetchConcurrency
+	AllowDangerousRoot     bool                        // Lets the storage root live in a system directory or next to the binary
+	CatchUpConcurrency     int                         // Bootstrap nodes caught up on missed replications at once, defaults to defaultCatchUpConcurrency
+	CatchUpRate            int                         // Objects per second replayed to a reconnected bootstrap node, defaults to defaultCatchUpRate
+	Labels                 map[string]string           // Node attributes advertised to peers in the handshake, such as zone=eu-1 or role=edge
+	OnNotify               NotifyFunc                  // Optional callback receiving the events of the nodes this node watches
+	NotifyLogSize          int                         // Most notification events kept for subscribers, defaults to defaultNotifyLogSize
+	NotifyLogAge           time.Duration               // Oldest notification event kept for subscribers, defaults to defaultNotifyLogAge
+	TrashRetention         time.Duration               // How long deleted objects can be restored; zero deletes them at once
+	TrashPurgeInterval     time.Duration               // How often expired objects are purged from the trash, defaults to defaultTrashPurgeInterval
+	VersionedPrefixes      []string                    // Key prefixes whose overwrites keep earlier versions; an empty prefix versions every key
+	VersionKeepLast        int                         // Versions kept per key, zero for no limit
+	VersionMaxAge          time.Duration               // Age past which versions other than the newest are pruned, zero for no limit
+	InlineThreshold        int                         // Largest object sent inside its message instead of a stream, defaults to defaultInlineThreshold; negative disables it
+	HandlerWorkers         int                         // Incoming messages handled at once across peers, defaults to defaultHandlerWorkers
+	OriginQuota            int64                       // Bytes stored on behalf of each other node, zero for no limit
+	OriginQuotas           map[string]int64            // Per-origin overrides of OriginQuota by node ID; zero lifts the limit
+	ListPageSize           int                         // Keys requested per page by ListNetwork, defaults to defaultListPageSize
+	CacheBytes             int64                       // Memory for the content of recently read objects; zero disables the cache
+	CacheObjectMax         int64                       // Largest object kept in the cache, defaults to defaultCacheObjectMax
+	StartupCheck           StartupCheck                // What Start does with the storage consistency check, defaults to CheckRepair
+	ForceUnlock            bool                        // Takes over a storage root still locked by a process of this host that is no longer running
+	GetParallelism         int                         // Peers an object is fetched from at once, in chunks, by the fastest first; zero or one fetches it whole from one peer
+	GetHedges              int                         // Extra peers a whole-object fetch asks when the ones asked are slow to start answering; zero asks every peer at once
+	HedgeDelay             time.Duration               // Wait for a peer to start answering before hedging; zero uses the 95th percentile of its recent first-byte latencies
+	SyncWrites             bool                        // Flushes objects and replicas to disk before a write returns or a replica is acknowledged
+	MirrorAll              bool                        // Holds a replica of every object in the cluster, backfilling those created while the node was away
+	MirrorConcurrency      int                         // Batches of objects pulled at once by a mirror backfill, defaults to defaultMirrorConcurrency
+	MirrorRate             int                         // Objects per second pulled by a mirror backfill, defaults to defaultMirrorRate
+	TombstoneRetention     time.Duration               // How long deletions are remembered for mirrors, defaults to defaultTombstoneRetention
+	ReadRepairInterval     time.Duration               // Least time between read repairs of one key, defaults to defaultReadRepairInterval; negative disables read repair
+	Namespaces             []string                    // Namespaces whose keys, named "<namespace>/...", are encrypted with a key of their own that GrantNamespace shares
+	LinkInsteadOfCopy      bool                        // StoreFile hard-links files on the storage root's filesystem into it rather than copying them
+	AuditFetches           bool                        // Records every object fetched from peers, and where from, in the audit log
+	Clock                  clock.Clock                 // Times timeouts, intervals, expiries and backoffs, defaults to the real clock; tests use a clock.Fake
+	AllowDeleteAll         bool                        // Lets DeletePrefix delete a whole namespace, or every key, given an empty prefix
+	MaxProtocolErrors      int                         // Malformed or unknown messages tolerated on a peer's connection before it is closed, defaults to defaultMaxProtocolErrors
+	DialOnDemand           bool                        // Get dials the nodes known to hold an object that it is not connected to, at the address they advertise
+	EphemeralDials         bool                        // Connections Get dials on demand are closed once the fetch is done rather than kept as peers
+	MaxPeers               int                         // Peers past which a connection dialed on demand is closed once its fetch is done; zero for no limit
+	PushDedupTTL           time.Duration               // How long a replica delivered to a peer is not pushed to it again, defaults to defaultPushDedupTTL; negative disables deduplicating pushes
+	Policies               map[string]Policy           // Replication and caching policies by key prefix, a namespace as "<namespace>/"; the longest matching prefix applies
+	CoalesceWindow         time.Duration               // How long deletes and notifications wait to be packed with others for the same peer, defaults to defaultCoalesceWindow; negative disables coalescing
+	CoalesceMaxEntries     int                         // Messages packed into one batched message at most, defaults to defaultCoalesceEntries
+	MinFreeBytes           int64                       // Free disk space below which replicas are refused with ErrNoSpace; zero for no limit
+	OnDiskFull             func(err error)             // Optional callback invoked when the node stops accepting writes for lack of disk space
+	SkewCheckInterval      time.Duration               // How often peers are pinged to measure their clock offset, defaults to defaultSkewCheckInterval; negative disables the pings
+	MaxClockSkew           time.Duration               // Peer clock offset past which a warning is raised, defaults to defaultMaxClockSkew; negative disables the warnings
+	ExcludeClockSkew       time.Duration               // Peer clock offset past which the write times of its copies are ignored by read repair, which then orders them by version alone; zero trusts every clock
+	OnClockSkew            ClockSkewFunc               // Optional callback invoked when a peer's clock is found off by more than MaxClockSkew, ahead when offset is positive
+	AckRetryInterval       time.Duration               // Wait before deletes, pins and pruned versions a peer has not acknowledged are sent again, doubling with each attempt; defaults to defaultAckRetryInterval, negative sends them once
+	Chaos                  *ChaosConfig                // Faults injected for soak testing; Start refuses it unless built with the chaos tag or DFS_CHAOS=1 is set
+	FollowWrites           bool                        // Get streams a key being stored on this node as its content is read, rather than waiting for the local write
+	NoListen               bool                        // Start opens no listener, so the node only dials out; peers never dial it and place no replicas on it
+	AcceptReplicas         bool                        // A NoListen node takes replicas from the peers connected to it like any other node
+	ChallengeInterval      time.Duration               // How often the replicas of a sample of this node's objects are challenged to prove they are held; zero disables the background challenges
+	ChallengeSampleRate    float64                     // Fraction of this node's objects whose replicas each round of challenges, and each deep VerifyCluster, challenges; defaults to defaultChallengeSampleRate, negative disables challenges in VerifyCluster
+	Authorizer             Authorizer                  // Decides which stores, gets, deletes and listings of peers are served; nil serves them all
+	MmapThreshold          int64                       // Local objects larger than this are read through a memory mapping rather than read calls; zero disables mapping
+	SlowIOLatency          time.Duration               // p99 duration of the local disk's writes, reads or deletes past which its IO counts as degraded; zero never counts it degraded by latency
+	SlowIOThroughput       int64                       // Bytes per second large writes to the local disk must keep up for its IO not to count as degraded; zero never counts it degraded by throughput
+	OnSlowIO               func(reason string)         // Optional callback invoked with the reason when the local disk's IO starts counting as degraded, and with an empty one when it stops
+	DegradedCheckInterval  time.Duration               // How often peers are asked whether their disks are degraded, so fetches prefer other sources; zero never asks and ranks peers by their rates alone
+	ContentTransforms      []storage.ContentTransform  // Transforms objects and replicas are encoded with on the local disk, such as to compress or encrypt them at rest; each is read by the transforms recorded with it, so nodes and restarts may differ. Empty stores them as written
+	ContentKeys            storage.KeyFunc             // Looks up the key encryption keys of ContentTransforms encrypting at rest, and of those objects were written with before; nil when none do
+	MaintenanceConcurrency int                         // Most maintenance jobs of one resource class, such as GC and trash purges writing to disk, run at once; defaults to 1
+	MaxServingGets         int                         // Whole and ranged objects served to peers at once, past which their get requests are refused as busy; zero for no limit
+	MaxReceivingReplicas   int                         // Replicas streamed from peers received at once, past which they are refused as busy and sent again later; zero for no limit
+	MaxInflightBytes       int64                       // Bytes of the objects being served and replicas being received at once, past which requests are refused as busy; zero for no limit
+	BusyRetryAfter         time.Duration               // Wait suggested to peers refused as busy before they try again, defaults to defaultBusyRetryAfter
+	SnapshotCopy           bool                        // Whether Snapshot copies objects rather than hard-linking them, so snapshots share no blocks with the store; objects that cannot be linked are copied either way
 }
 
+// defaultNegativeCacheEntries bounds the negative cache when NegativeCacheSize is not set.
+const defaultNegativeCacheEntries = 1024
+
+// ErrKeyNotFound is returned by Get when neither the local store nor any peer holds the key,
+// as reported by every peer asked.
+var ErrKeyNotFound = errors.New("key not found")
+
+// preVerifyMaxSize is the largest local object that Get verifies in full before serving it.
+// Larger objects are verified while they are streamed to the caller.
+const preVerifyMaxSize = 4 << 20
+
 // FileServer represents the main server responsible for managing files in a distributed manner.
 type FileServer struct {
-	FileServerOpts                     // Embeds options to make configuration easier
-	peerLock       sync.Mutex          // Mutex to ensure thread-safe access to peers
-	peers          map[string]p2p.Node // Map of connected peers with peer address as a key
-	Storage        *storage.Store      // Storage layer to manage local file storage
-	quitch         chan struct{}       // Channel to signal termination of the server
+	FileServerOpts                                // Embeds options to make configuration easier
+	peerLock       sync.Mutex                     // Mutex to ensure thread-safe access to peers
+	peers          map[string]p2p.Node            // Map of connected peers with peer address as a key
+	bootstrapPeers map[string]p2p.Node            // Connected bootstrap nodes keyed by their configured address
+	pending        *pendingQueue                  // Replications owed to bootstrap nodes that were offline
+	streamMu       sync.Mutex                     // Serialises outgoing replication messages and their streams
+	catchUpSem     chan struct{}                  // Limits how many bootstrap nodes are caught up at once
+	fetchTurn      chan struct{}                  // Held, by sending to it, by the fetch asking peers that match answers to requests by order
+	fetches        sync.WaitGroup                 // Fetches still reading the answers of peers
+	Storage        *storage.Store                 // Storage layer to manage local file storage
+	quitch         chan struct{}                  // Channel to signal termination of the server
+	stopOnce       sync.Once                      // Guards quitch against being closed twice
+	stopped        chan struct{}                  // Closed once the loop has exited, its handlers have returned and the storage is released
+	handlers       sync.WaitGroup                 // Workers of peers' message queues still running
+	ready          chan struct{}                  // Closed once Start has opened the storage and is listening
+	negCache       *negativeCache                 // Recently missed keys, nil when negative caching is disabled
+	cache          *objectCache                   // Content of recently read objects, nil when CacheBytes is not set
+	metrics        metrics                        // Counters exposed through Metrics
+	maintenance    *maintenance                   // Schedules the background jobs such as GC, run from Start
+	startedAt      atomic.Pointer[time.Time]      // When Start was called, nil before
+	notify         *notifyLog                     // Notifications owed to subscribers of this node
+	watching       map[string]bool                // Bootstrap nodes whose notifications this node subscribes to
+	notifySeen     map[string]uint64              // Highest notification sequence processed by publisher node ID
+	txMu           sync.Mutex                     // Guards txs
+	txs            map[string]txState             // Transactions staged for peers by transaction ID
+	transfers      transferTable                  // Store and Get calls in flight
+	dispatch       *dispatcher                    // Routes incoming messages to handlers by payload type
+	quotaMu        sync.Mutex                     // Guards rejected
+	rejected       map[string]int64               // Replicas refused for exceeding their quota, by origin ID
+	draining       atomic.Bool                    // Set by Decommission; replicas are refused from then on
+	leaving        map[string]bool                // Peers that announced they are leaving, by address; guarded by peerLock
+	departed       map[string]bool                // Bootstrap nodes that left the cluster and are not redialed; guarded by peerLock
+	checkMu        sync.Mutex                     // Guards checks
+	checks         map[string]storage.CheckReport // Storage check reports from startup, by owner ID
+	requestSeq     atomic.Uint64                  // Sequence of the last get request sent
+	incarnation    uint32                         // Random number identifying this run of the node, carried by request IDs
+	incarnations   map[string]nodeRun             // Run of every node last seen connected, by node ID; guarded by peerLock
+	serving        requestTable                   // Cancellation flags of the get requests being answered
+	peerStats      peerStats                      // Recent fetch rates of the peers, ranking the sources of parallel downloads
+	firstBytes     latencies                      // Recent first-byte latencies of the peers, timing hedged fetches
+	receiveStats   peerStats                      // Recent rates replicas were received at from each peer
+	caps           p2p.Capabilities               // Optional features advertised to peers; tests lower it to act as an older node
+	acks           ackTable                       // StoreDurable calls waiting for replica acknowledgements
+	tombstones     *tombstoneTable                // Deletions remembered so mirrors do not pull deleted objects back
+	mirror         *mirrorState                   // Work and backfill progress of MirrorAll
+	keys           *keystore                      // Namespace keys granted to this node by their owners
+	pins           *pinTable                      // Placement pins of this node's objects and those its peers announced
+	aliases        *aliasTable                    // Aliases of the cluster, the latest change to each
+	bootstrapIDs   map[string]string              // Node ID of every bootstrap node seen, by configured address; guarded by peerLock
+	repairs        repairTable                    // Keys read repaired recently, throttling further repairs
+	pushes         pushTable                      // Replicas being pushed or recently delivered to each peer
+	reservations   *reservationTable              // Keys reserved for StoreIfAbsent calls, this node's and its peers'
+	reserveCalls   reserveCalls                   // StoreIfAbsent calls waiting for the answers to their reservations
+	leases         *leaseTable                    // Keys leased to this node and its peers
+	appendMu       sync.Mutex                     // Serialises appends, so peers receive them in the order they were made
+	directory      *directory                     // Advertised address of every node heard of, by node ID
+	holders        *holderTable                   // Nodes sent replicas of this node's objects, dialed by fetches not connected to them
+	dialing        map[string]chan p2p.Node       // Fetches waiting for nodes they dialed to connect, by node ID; guarded by peerLock
+	fetchOnly      map[string]bool                // Connections dialed for a fetch not done yet, kept off replication, by address; guarded by peerLock
+	bans           *banTable                      // Peers dropped with DropPeer whose connections are refused for a while
+	bootstrapAt    map[string]time.Time           // When each bootstrap node last connected, by configured address; guarded by peerLock
+	redialWait     map[string]time.Duration       // Backoff before redialing bootstrap nodes whose connections closed at once; guarded by peerLock
+	seeds          []string                       // Addresses of the bootstrap nodes, from the Bootstrap source; guarded by peerLock
+	seedIPs        map[string][]net.IP            // Addresses the host name of each seed resolved to when last dialed; guarded by peerLock
+	goneSeeds      map[string]bool                // Seed addresses gone from the Bootstrap source, no longer dialed; guarded by peerLock
+	selfSeeds      map[string]bool                // Seed addresses found to reach this node itself, never dialed again; guarded by peerLock
+	policies       policyTable                    // Replication policies by key prefix, replaced by ReloadPolicies
+	outbox         *outbox                        // Deletes and notifications waiting to be packed into batched messages
+	space          spaceState                     // Whether this node's disk has room for writes, and which peers' do not
+	skew           skewTable                      // Clock offsets measured for peers
+	reliable       *reliableLog                   // Control messages peers have not acknowledged, and those applied from each peer
+	chaos          *chaos                         // Faults injected, nil unless Chaos is set
+	writing        writeTable                     // Stores in flight on this node, which Gets of their keys wait for or follow
+	listSnapshots  snapshotTable                  // Key snapshots of the listings being paged through
+	admission      *admission                     // Gets served and replicas received in flight, counted against their limits
+	// testHookPrepared, when set, runs in StoreAtomic once every peer prepared and before any commits.
+	testHookPrepared func()
+	// testHookServed, when set, runs in sendObject with the number of bytes of the object sent.
+	testHookServed func(key string, n int64)
+	// testHookBeforeAck, when set, runs before a stored replica is acknowledged.
+	testHookBeforeAck func(key string)
+	// testHookGetFile, when set, runs in handleMessageGetFile before the answer is started.
+	testHookGetFile func(key string)
+	// testHookAnswer, when set, runs in readAnswer once the start of a peer's answer is read.
+	testHookAnswer func(peer p2p.Node)
+}
+
+// init registers the codec ContentTransforms encrypt at rest with, on the crypto package's cipher.
+func init() {
+	storage.RegisterCodec(storage.AESCTRCodec, storage.NewEnvelopeCodec(crypto.NewAESEnvelope()))
 }
 
 // NewFileServer initializes and returns a new FileServer instance.
 // It sets up storage with the provided options and generates a unique ID if not supplied.
 func NewFileServer(opts FileServerOpts) *FileServer {
+	opts.Clock = clock.Or(opts.Clock)
 	storeOpts := storage.StoreOpts{
-		Root:              opts.StorageRoot,
-		PathTransformFunc: opts.PathTransformFunc,
+		Root:               opts.StorageRoot,
+		PathTransformFunc:  opts.PathTransformFunc,
+		PathTransformName:  opts.PathTransformName,
+		GCGracePeriod:      opts.GCGracePeriod,
+		AllowDangerousRoot: opts.AllowDangerousRoot,
+		TrashRetention:     opts.TrashRetention,
+		ForceUnlock:        opts.ForceUnlock,
+		SyncWrites:         opts.SyncWrites,
+		Clock:              opts.Clock,
+		MmapThreshold:      opts.MmapThreshold,
+		SlowIOLatency:      opts.SlowIOLatency,
+		SlowIOThroughput:   opts.SlowIOThroughput,
+		ContentTransforms:  opts.ContentTransforms,
+		LookupKey:          opts.ContentKeys,
+	}
+	cache := newObjectCache(opts.CacheBytes, opts.CacheObjectMax)
+	if cache != nil {
+		storeOpts.OnChange = cache.invalidate
 	}
 	if len(opts.ID) == 0 {
 		opts.ID = crypto.GenerateID()
 	}
-	return &FileServer{
+	if opts.MaxProtocolErrors <= 0 {
+		opts.MaxProtocolErrors = defaultMaxProtocolErrors
+	}
+	if opts.TrashPurgeInterval <= 0 {
+		opts.TrashPurgeInterval = defaultTrashPurgeInterval
+	}
+	if opts.CatchUpConcurrency <= 0 {
+		opts.CatchUpConcurrency = defaultCatchUpConcurrency
+	}
+	incarnation := newIncarnation()
+	s := &FileServer{
 		FileServerOpts: opts,
 		Storage:        storage.NewStore(storeOpts),
 		quitch:         make(chan struct{}),
+		stopped:        make(chan struct{}),
+		ready:          make(chan struct{}),
+		maintenance:    newMaintenance(opts.Clock, opts.MaintenanceConcurrency),
 		peers:          make(map[string]p2p.Node),
+		bootstrapPeers: make(map[string]p2p.Node),
+		pending:        newPendingQueue(),
+		catchUpSem:     make(chan struct{}, opts.CatchUpConcurrency),
+		fetchTurn:      make(chan struct{}, 1),
+		negCache:       newNegativeCache(opts.NegativeCacheTTL, opts.NegativeCacheSize, opts.Clock),
+		cache:          cache,
+		notify:         newNotifyLog(opts.NotifyLogSize, opts.NotifyLogAge, opts.Clock),
+		watching:       make(map[string]bool),
+		notifySeen:     make(map[string]uint64),
+		txs:            make(map[string]txState),
+		dispatch:       newDispatcher(opts.HandlerWorkers),
+		rejected:       make(map[string]int64),
+		leaving:        make(map[string]bool),
+		departed:       make(map[string]bool),
+		caps:           supportedCaps,
+		tombstones:     newTombstoneTable(opts.TombstoneRetention, opts.Clock),
+		mirror:         newMirrorState(opts.Clock),
+		keys:           newKeystore(opts.EncKey),
+		pins:           newPinTable(),
+		aliases:        newAliasTable(),
+		bootstrapIDs:   make(map[string]string),
+		transfers:      transferTable{clock: opts.Clock},
+		repairs:        repairTable{clock: opts.Clock},
+		pushes:         pushTable{clock: opts.Clock},
+		reservations:   newReservationTable(opts.Clock),
+		leases:         newLeaseTable(),
+		directory:      newDirectory(),
+		holders:        newHolderTable(),
+		dialing:        make(map[string]chan p2p.Node),
+		fetchOnly:      make(map[string]bool),
+		bans:           newBanTable(),
+		bootstrapAt:    make(map[string]time.Time),
+		redialWait:     make(map[string]time.Duration),
+		seedIPs:        make(map[string][]net.IP),
+		goneSeeds:      make(map[string]bool),
+		selfSeeds:      make(map[string]bool),
+		incarnation:    incarnation,
+		incarnations:   make(map[string]nodeRun),
+		acks:           ackTable{incarnation: incarnation},
+		outbox:         newOutbox(),
+		reliable:       newReliableLog(uint64(incarnation)),
+		admission:      newAdmission(opts.Clock),
+	}
+	s.Storage.Overhead = s.storedOverhead
+	s.Storage.OnSlowIO = s.slowIO
+	s.policies.set(opts.Policies)
+	s.registerHandlers()
+	return s
+}
+
+// storedOverhead returns the bytes the objects of owner id are stored with besides their
+// content: the IV of the replicas of other nodes' objects, none for this node's own. Its
+// signature matches storage.StoreOpts.Overhead.
+func (s *FileServer) storedOverhead(id string) int64 {
+	if id == s.ID {
+		return 0
+	}
+	return crypto.Overhead
+}
+
+// peerList returns a snapshot of the connected peers, leaving out those that announced they
+// are leaving and the connections dialed for a fetch.
+func (s *FileServer) peerList() []p2p.Node {
+	return s.connectedPeers(false)
+}
+
+// fetchPeers returns the peers asked for objects: those of peerList and the connections
+// dialed for a fetch.
+func (s *FileServer) fetchPeers() []p2p.Node {
+	return s.connectedPeers(true)
+}
+
+// connectedPeers returns a snapshot of the connected peers that are not leaving, including
+// those dialed for a fetch if fetchOnly is set.
+func (s *FileServer) connectedPeers(fetchOnly bool) []p2p.Node {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peers := make([]p2p.Node, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		if !s.leaving[addr] && (fetchOnly || !s.fetchOnly[addr]) {
+			peers = append(peers, peer)
+		}
 	}
+	return peers
+}
+
+// peer returns the connected peer with the given address.
+func (s *FileServer) peer(addr string) (p2p.Node, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// BroadcastError reports the peers a message could not be delivered to. Every other peer
+// received it, so callers decide whether partial delivery is acceptable.
+type BroadcastError struct {
+	failed map[string]error // Send error by peer address
+	total  int              // Number of peers the message was sent to
+}
+
+// Error lists the failed peers in address order.
+func (e *BroadcastError) Error() string {
+	addrs := make([]string, 0, len(e.failed))
+	for addr := range e.failed {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	msgs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		msgs[i] = fmt.Sprintf("%s: %s", addr, e.failed[addr])
+	}
+	return fmt.Sprintf("broadcast failed for %d of %d peers: %s", len(e.failed), e.total, strings.Join(msgs, "; "))
+}
+
+// Failed returns the send error of every peer the message was not delivered to, keyed by address.
+func (e *BroadcastError) Failed() map[string]error {
+	return e.failed
+}
+
+// Unwrap returns the individual send errors.
+func (e *BroadcastError) Unwrap() []error {
+	errs := make([]error, 0, len(e.failed))
+	for _, err := range e.failed {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
 // broadcast sends a message to all connected peers in the network.
+//
+// Returns: A *BroadcastError naming the peers that could not be reached, or any encoding errors.
 func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
-	}
-	for _, peer := range s.peers {
-		// Send message type byte indicating the incoming message
-		if err := peer.Send([]byte{p2p.IncomingMessage}); err != nil {
-			return err
+	_, err := s.sendMessage(s.peerList(), msg)
+	return err
+}
+
+// sendMessage sends a message to each of the given peers, carrying on past peers that fail.
+//
+// Returns: The peers the message was delivered to, and a *BroadcastError if any peer failed
+// or the encoding error if the message could not be framed.
+func (s *FileServer) sendMessage(peers []p2p.Node, msg *Message) ([]p2p.Node, error) {
+	// Each form of the message is framed once, the first time a peer needs it.
+	frames := make(map[bool][]byte, 2)
+	delivered := make([]p2p.Node, 0, len(peers))
+	failed := make(map[string]error)
+	for _, peer := range peers {
+		// Messages queued for the peer before this one go first.
+		s.flushOutbox(peer)
+		typed := s.capsOf(peer).typed
+		frame, ok := frames[typed]
+		if !ok {
+			var err error
+			if frame, err = frameMessage(msg, typed); err != nil {
+				return delivered, err
+			}
+			frames[typed] = frame
 		}
-		// Send the actual message payload
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+		if err := peer.Send(frame); err != nil {
+			failed[peer.RemoteAddr().String()] = err
+			continue
 		}
+		delivered = append(delivered, peer)
 	}
-	return nil
+	if len(failed) > 0 {
+		return delivered, &BroadcastError{failed: failed, total: len(peers)}
+	}
+	return delivered, nil
 }
 
-// Message defines a generic message with a payload that can hold any data type.
+// Message defines a generic message. Its payload must be of a type registered with
+// RegisterMessage, as it is identified on the wire by its MessageType.
 type Message struct {
-	Payload any
+	Payload   any
+	RequestID string // Request ID of the operation the message is sent for, empty if none; peers log their part of it with it
+	ReplyID   uint64 // ID the answer to the message is routed back with, zero when answers are matched to requests by order
 }
 
 // MessageStoreFile represents a message for storing a file with ID, encryption key, and size.
 type MessageStoreFile struct {
-	ID   string // Unique identifier for the message
-	Key  string // Encrypted key for the file
-	Size int64  // Size of the file to store
+	ID        string // Unique identifier for the message
+	Key       string // Encrypted key for the file
+	Size      int64  // Exact number of stream bytes that follow
+	Checksum  string // Hex-encoded SHA-256 of the stream bytes
+	Version   uint64 // Version of the object, zero when its key is not versioned
+	Immutable bool   // Whether the owner stored the object as immutable
+	AckID     uint64 // Identifier of the MessageStoreAck wanted once the replica is stored, zero for none
+	Namespace string // Namespace of the key, empty if it has none or the sender does not know it
 }
 
 // MessageGetFile represents a request message to get a file with ID and encryption key.
 type MessageGetFile struct {
-	ID  string // Identifier for the file
-	Key string // Encrypted key to retrieve the file
+	ID        string // Identifier for the file
+	Key       string // Encrypted key to retrieve the file
+	RequestID uint64 // Identifier a MessageCancel names the request by, zero if it cannot be cancelled
+	Namespace string // Namespace of the key, empty if it has none
+}
+
+// ObjectInfo describes an object returned by GetWithInfo.
+type ObjectInfo struct {
+	Key      string      // Key the object was requested with
+	Size     int64       // Size of the plaintext content in bytes
+	Checksum string      // Hex-encoded SHA-256 of the plaintext content, empty for objects stored before checksums
+	ModTime  time.Time   // Time the local copy was written
+	Peer     string      // Address of the peer the object was fetched from, comma-separated when several sent chunks of it; empty when served from local disk
+	Source   FetchSource // Where the object was served from
+
+	ContentType string // MIME type recorded when the object was stored, empty for objects fetched from peers or stored before content types were recorded
 }
 
 // Get retrieves a file by key.
 // If it exists locally, it is read from local storage.
 // If not, it broadcasts a network request to retrieve the file from peers.
+// When no peer serves it, the error is a *FetchError matching ErrKeyNotFound if every peer
+// reported the file missing and ErrUnavailable if some could not tell. A file being stored on
+// this node is read once its local copy is written, or as its content arrives with
+// FollowWrites, and never fetched from peers.
 func (s *FileServer) Get(key string) (io.Reader, error) {
+	_, r, err := s.GetWithInfo(key)
+	return r, err
+}
+
+// GetRange retrieves length bytes of a file starting at offset, fetching the file from the
+// network like Get when it is not held locally. A negative length reads to the end of the
+// file. Only reads that reach the end of a large local object have its checksum verified.
+//
+// Parameters:
+//   - key: Key of the file.
+//   - offset: Position of the first byte returned.
+//   - length: Number of bytes returned at most, or a negative value for the rest of the file.
+//
+// Returns: A reader for the range, which the caller must close, and any errors.
+func (s *FileServer) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	_, r, err := s.GetWithInfo(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil && !errors.Is(err, io.EOF) {
+		r.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, length), r}, nil
+}
+
+// GetWithInfo retrieves a file by key like Get and also describes it. Objects fetched from
+// the network are decrypted into local storage first, so the reported size is always the
+// plaintext size. The caller must close the returned reader.
+func (s *FileServer) GetWithInfo(key string) (ObjectInfo, io.ReadCloser, error) {
+	return s.GetContext(context.Background(), key, TransferOpts{})
+}
+
+// StatKey describes a file held locally from its recorded metadata, without reading its
+// content or asking peers. A key naming an alias describes the object its aliases lead to.
+//
+// Returns: The file's description, or an error wrapping ErrKeyNotFound if it is not held
+// locally, or ErrAliasLoop if its aliases loop.
+func (s *FileServer) StatKey(key string) (ObjectInfo, error) {
+	target, err := s.aliases.resolve(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	meta, err := s.Storage.Stat(s.ID, target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, aliasError(key, target, fmt.Errorf("%w: %s", ErrKeyNotFound, target))
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:      key,
+		Size:     meta.PlainSize,
+		Checksum: meta.Checksum,
+		ModTime:  meta.ModTime,
+		Source:   FetchSource{Kind: SourceLocal},
+
+		ContentType: meta.ContentType,
+	}, nil
+}
+
+// DropLocalCopy removes this node's copy of one of its objects and nothing else: peers keep
+// their replicas, no delete is recorded, and the next Get fetches the object from them.
+//
+// Returns: An error wrapping ErrInvalidKey for an empty key, and any errors removing the copy.
+func (s *FileServer) DropLocalCopy(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return s.Storage.Delete(s.ID, key)
+}
+
+// getTransfer retrieves a file for GetContext, reporting the network fetch to t.
+func (s *FileServer) getTransfer(t *transfer, key string) (ObjectInfo, io.ReadCloser, error) {
+	if info, r, ok, err := s.getWriting(t, key); ok || err != nil {
+		return info, r, err
+	}
+	if info, r, ok := s.readCached(key); ok {
+		return info, r, nil
+	}
+
 	// Check if the file exists locally
-	if s.Storage.Has(s.ID, key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.Storage.Read(s.ID, key)
-		return r, err
+	ok, err := s.Storage.Has(s.ID, key)
+	if err != nil {
+		// Presence is unknown; fall back to the network rather than failing outright.
+		s.logf(t.requestID(), "could not check local disk for (%s), trying peers: %s", key, err)
+	}
+	if ok {
+		info, r, err := s.readLocal(t.requestID(), key)
+		if !errors.Is(err, storage.ErrContentCorrupted) {
+			return info, r, err
+		}
+		s.reportCorruption(key, err)
+	}
+
+	// Keys deleted with their prefix are not pulled back from peers that missed the delete
+	if s.tombstones.coversPrefix(s.ID, key) {
+		return ObjectInfo{}, nil, fmt.Errorf("%w: %s (deleted with its prefix)", ErrKeyNotFound, key)
+	}
+
+	// Fail fast if the cluster recently reported the key missing
+	hashedKey := crypto.HashKey(key)
+	if s.negCache.has(negativeKey(s.ID, hashedKey)) {
+		s.metrics.negativeCacheHits.Add(1)
+		return ObjectInfo{}, nil, fmt.Errorf("%w: %s (cached miss)", ErrKeyNotFound, key)
 	}
 
 	// The file does not exist locally, attempt to fetch it from the network
-	fmt.Printf("File %s not found locally, fetching from network...\n", key)
+	s.logf(t.requestID(), "(%s) not found locally, fetching it from peers", key)
+	dialed := s.dialHolders(hashedKey)
+	defer s.releaseDialed(dialed)
+	// Busy peers were skipped for the others; when none served the object, they are asked
+	// again once the wait they suggested is over.
+	for attempt := 1; ; attempt++ {
+		info, r, err := s.fetch(t, key, hashedKey)
+		var ferr *FetchError
+		if !errors.As(err, &ferr) || attempt > maxBusyRetries {
+			return info, r, err
+		}
+		wait, busy := ferr.retryAfter()
+		if !busy {
+			return info, r, err
+		}
+		wait = busyBackoff(wait, attempt)
+		s.metrics.busyRetries.Add(1)
+		s.logf(t.requestID(), "peers holding (%s) are busy, asking again in %s", key, wait)
+		select {
+		case <-s.Clock.After(wait):
+		case <-t.done():
+			return ObjectInfo{}, nil, t.err()
+		}
+	}
+}
+
+// fetch fetches an object from peers once, in parallel, hedged or whole as configured.
+func (s *FileServer) fetch(t *transfer, key string, hashedKey string) (ObjectInfo, io.ReadCloser, error) {
+	if s.GetParallelism > 1 {
+		return s.getParallel(t, key, hashedKey)
+	}
+	if s.GetHedges > 0 {
+		return s.fetchHedged(t, key, hashedKey)
+	}
+	return s.fetchWhole(t, key, hashedKey)
+}
+
+// fetchWhole asks every peer for an object and decrypts the first complete copy that arrives
+// into local storage, recording the rate the sending peer delivered it at. Once every peer
+// has answered, the copies older than the newest one offered are read repaired.
+//
+// Parameters:
+//   - t: Transfer the fetch is reported to.
+//   - key: Plain key of the object.
+//   - hashedKey: Key the object is held under on peers.
+//
+// Returns: The object's description and content, and any errors; a *FetchError when no peer
+// served the object.
+func (s *FileServer) fetchWhole(t *transfer, key string, hashedKey string) (ObjectInfo, io.ReadCloser, error) {
+	requestID, rid := s.nextRequestID(), t.requestID()
 	msg := Message{
 		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: crypto.HashKey(key),
+			ID:        s.ID,
+			Key:       hashedKey,
+			RequestID: requestID,
+			Namespace: keyNamespace(key),
 		},
+		RequestID: rid,
+		ReplyID:   requestID,
 	}
 
-	// Broadcast the request to all peers
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	// The timeout runs from the start, so a fetch waiting for its turn to ask peers that
+	// answer by order gives up like one waiting for their answers.
+	began := s.Clock.Now()
+	timer := s.Clock.NewTimer(fetchTimeout)
+	targets := s.fetchPeers()
+	// Peers that cannot route answers to requests by ID answer in the order they were asked,
+	// so only one fetch may ask them at a time; it keeps the turn until their answers are in
+	// or given up.
+	outcomes := newFetchOutcomes(key, began)
+	_, ordered := s.peersWith(targets, func(c peerCaps) bool { return c.replies })
+	if len(ordered) > 0 {
+		select {
+		case s.fetchTurn <- struct{}{}:
+		case <-t.done():
+			timer.Stop()
+			return ObjectInfo{}, nil, t.err()
+		case <-timer.C():
+			outcomes.broadcast(targets, nil, began)
+			return ObjectInfo{}, nil, outcomes.err(s.Clock.Now())
+		}
+	}
+	release := func() {
+		if len(ordered) > 0 {
+			<-s.fetchTurn
+		}
 	}
+	peers, err := s.sendMessage(targets, &msg)
+	var berr *BroadcastError
+	if err != nil && !errors.As(err, &berr) {
+		timer.Stop()
+		release()
+		return ObjectInfo{}, nil, err
+	}
+	if berr != nil {
+		s.logf(rid, "fetching (%s): %s", key, berr)
+	}
+	// Peers that could not be asked or did not answer may hold the key, so the outcome of
+	// every peer is kept to tell a miss from an object that could not be fetched.
+	outcomes.broadcast(targets, berr, began)
 
 	// Create channels to listen for responses and errors
-	responseCh := make(chan io.Reader, 1)
+	responseCh := make(chan FetchSource, 1)
 	errorCh := make(chan error, 1)
 
-	// Timeout to stop waiting for peers after a certain duration
-	timeout := time.After(2 * time.Second)
+	// Closed once the caller has been served, after which read repair may replace the local copy
+	served := make(chan struct{})
+	defer close(served)
+	// Closed once the answers not in yet are given up, when the fetch times out or is
+	// cancelled; answers arriving later are discarded.
+	abandoned := make(chan struct{})
+	// Closed once every answer has been read or given up
+	finished := make(chan struct{})
 
 	// Listen for responses from peers in a separate goroutine
+	s.fetches.Add(1)
 	go func() {
-		for _, peer := range s.peers {
-			// Receive the file size from the peer
-			var fileSize int64
-			err := binary.Read(peer, binary.LittleEndian, &fileSize)
-			if err != nil {
+		defer s.fetches.Done()
+		defer close(finished)
+		defer release()
+		var (
+			received bool
+			rr       = new(readRepair)
+		)
+		// Headers are read as they arrive, so a stalled peer does not hide the answers of the
+		// peers after it; copies are still taken in the order the peers were asked.
+		answers := make([]chan fetchAnswer, len(peers))
+		for i, peer := range peers {
+			answers[i] = make(chan fetchAnswer, 1)
+			go func() { answers[i] <- s.readAnswer(peer, requestID, abandoned, outcomes) }()
+		}
+		for i, peer := range peers {
+			ans := <-answers[i]
+			if ans.err != nil {
+				continue
 			}
-			// Handle if the peer sends a "FileNotFound" signal
-			if fileSize == 0 {
-				// Peer doesn't have the file, continue to the next peer
+			stream, caps, header := ans.stream, ans.caps, ans.header
+			offered := repairCopy{peer: peer, found: header.Found, stamp: s.arbitrationStamp(peer, ans.stamp), sum: header.Sum}
+			// A peer that denied or shed the request is neither compared nor repaired.
+			keep := caps.repair && !header.refused() && rr.offer(offered, header.Size)
+			if !header.Found {
 				continue
 			}
+			fileSize := header.Size
 
-			// Create a limited reader to avoid reading beyond the file size
-			limitedReader := io.LimitReader(peer, fileSize)
+			// Read the object's chunks, which stop early if the request is cancelled
+			objectReader := streamReader(stream, fileSize, caps.chunked)
+			// The newest copy is kept whole so read repair can hand it to stale peers
+			var kept *bytes.Buffer
+			if keep {
+				kept = new(bytes.Buffer)
+				objectReader = io.TeeReader(objectReader, kept)
+			}
+			if received || t.err() != nil {
+				// Another peer already supplied the file; drain this copy to keep the connection in sync
+				sum := sha256.New()
+				_, err := io.Copy(sum, objectReader)
+				stream.Close()
+				if err != nil && !errors.Is(err, errStreamTruncated) {
+					s.logf(rid, "draining response from (%s): %s", peer.RemoteAddr(), err)
+				}
+				if err == nil && keep && header.verify(sum) == nil {
+					rr.keep(offered, kept.Bytes())
+				}
+				continue
+			}
 
 			// Write the received file to local storage (decrypt it in the process)
-			n, err := s.Storage.WriteDecrypt(s.EncKey, s.ID, key, limitedReader)
+			t.phase(TransferFetch, peer.RemoteAddr().String(), fileSize)
+			started := s.Clock.Now()
+			sum := sha256.New()
+			n, err := s.Storage.WriteDecrypt(s.dataCipher(key), s.ID, key, t.reader(io.TeeReader(objectReader, sum)))
+			if _, derr := io.Copy(io.Discard, objectReader); err == nil {
+				err = derr
+			}
+			if err == nil {
+				// Bytes damaged on the way must not be kept as the object.
+				err = header.verify(sum)
+			}
+			// Close the stream after reading
+			stream.Close()
 			if err != nil {
-				errorCh <- err
-				return
+				s.logf(rid, "receiving (%s) from (%s): %s", key, peer.RemoteAddr(), err)
+				outcomes.failed(peer, err, s.Clock.Now())
+				// Drop the partial copy so it is not served as the object.
+				if derr := s.Storage.Delete(s.ID, key); derr != nil {
+					s.logf(rid, "discarding partial (%s): %s", key, derr)
+				}
+				continue
 			}
 
-			fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
-
-			// Close the peer stream after reading
-			peer.CloseStream()
+			s.logf(rid, "received (%d) bytes of (%s) over the network from (%s)", n, key, peer.RemoteAddr())
+			s.peerStats.record(peer.RemoteAddr().String(), fileSize, s.Clock.Since(started))
+			if keep {
+				rr.keep(offered, kept.Bytes())
+			}
+			rr.received = header.Sum
 
-			// Successfully received the file, send the reader to the response channel
-			_, r, err := s.Storage.Read(s.ID, key)
-			if err != nil {
-				errorCh <- err
-				return
+			// Successfully received the file into local storage; keep reading the remaining responses
+			received = true
+			responseCh <- remoteSource([]p2p.Node{peer}, s.Clock.Since(began), fileSize)
+		}
+		if received {
+			if s.readRepairInterval() >= 0 {
+				go s.repair(key, hashedKey, rr, served)
 			}
-			responseCh <- r
 			return
 		}
-		// No peers had the file, send an error
-		errorCh <- fmt.Errorf("file %s not found on any peers", key)
+		// No peers served the file, send an error telling a miss from a failure
+		ferr := outcomes.err(s.Clock.Now())
+		if ferr.NotFound() {
+			s.negCache.add(negativeKey(s.ID, hashedKey))
+		}
+		errorCh <- ferr
 	}()
 
 	// Wait for the response, an error, or timeout
 	select {
-	case r := <-responseCh:
-		// Successfully got the file from a peer
-		return r, nil
+	case src := <-responseCh:
+		// Successfully got the file from a peer, serve the local copy. The answers read for
+		// read repair are still given up once the fetch times out.
+		go func() {
+			defer timer.Stop()
+			select {
+			case <-timer.C():
+				close(abandoned)
+			case <-finished:
+			}
+		}()
+		return s.serveFetched(rid, key, src)
 	case err := <-errorCh:
 		// An error occurred while trying to get the file
-		return nil, err
-	case <-timeout:
-		// Timeout occurred, no peer responded in time
-		return nil, fmt.Errorf("timed out waiting for file %s from the network", key)
+		timer.Stop()
+		return ObjectInfo{}, nil, err
+	case <-t.done():
+		// The transfer was cancelled; the peers stop streaming and the fetch drains what they
+		// already sent in the background
+		timer.Stop()
+		close(abandoned)
+		go s.cancelRequest(peers, requestID)
+		return ObjectInfo{}, nil, t.err()
+	case <-timer.C():
+		// Timeout occurred; the peers that had not answered yet timed out
+		close(abandoned)
+		go s.cancelRequest(peers, requestID)
+		return ObjectInfo{}, nil, outcomes.err(s.Clock.Now())
+	}
+}
+
+// fetchTimeout is how long a fetch waits for peers to answer.
+const fetchTimeout = 2 * time.Second
+
+// fetchAnswer is the start of a peer's answer to a MessageGetFile.
+type fetchAnswer struct {
+	stream io.ReadCloser // Rest of the answer, closed already unless the object was found
+	caps   peerCaps      // Capabilities of the peer
+	stamp  objectStamp   // Stamp of the peer's copy, zero unless the peer supports read repair
+	header objectHeader  // Size and checksum of the peer's copy, if found
+	err    error         // Why the answer could not be read
+}
+
+// readAnswer waits for a peer's answer to the MessageGetFile sent with id to be handed over
+// and reads its stamp and header, recording the outcome of a peer that lacks the object or
+// failed. An answer not in by the time abandoned is closed is left to time out.
+func (s *FileServer) readAnswer(peer p2p.Node, id uint64, abandoned <-chan struct{}, outcomes *fetchOutcomes) fetchAnswer {
+	if s.testHookAnswer != nil {
+		defer s.testHookAnswer(peer)
+	}
+	ans := fetchAnswer{stream: s.awaitAnswer(peer, id, abandoned), caps: s.capsOf(peer)}
+	if ans.stream == nil {
+		ans.err = errAnswerAbandoned
+		return ans
+	}
+	if ans.caps.repair {
+		ans.err = binary.Read(ans.stream, binary.LittleEndian, &ans.stamp)
+	}
+	if ans.err == nil {
+		ans.err = binary.Read(ans.stream, binary.LittleEndian, &ans.header)
+	}
+	if ans.err != nil {
+		ans.stream.Close()
+		log.Printf("[%s] reading response from (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), ans.err)
+		outcomes.failed(peer, ans.err, s.Clock.Now())
+		return ans
+	}
+	if !ans.header.Found {
+		ans.stream.Close()
+		outcomes.missed(peer, ans.header, s.Clock.Now())
+	}
+	return ans
+}
+
+// negativeKey identifies an object in the negative cache by its owner ID and hashed key.
+func negativeKey(id string, hashedKey string) string {
+	return id + "/" + hashedKey
+}
+
+// readCached serves a locally stored file from the object cache.
+//
+// Returns: The file's description and content, and whether it was cached.
+func (s *FileServer) readCached(key string) (ObjectInfo, io.ReadCloser, bool) {
+	if s.cache == nil {
+		return ObjectInfo{}, nil, false
+	}
+	info, data, ok := s.cache.get(s.ID, key)
+	if !ok {
+		s.metrics.cacheMisses.Add(1)
+		return ObjectInfo{}, nil, false
+	}
+	s.metrics.cacheHits.Add(1)
+	info.Source = FetchSource{Kind: SourceCache}
+	return info, io.NopCloser(bytes.NewReader(data)), true
+}
+
+// readLocal opens a locally stored file for request rid, verifying its checksum up front for
+// small objects and while streaming for larger ones. Small objects read in full are added to
+// the object cache, unless their replication policy keeps them out of it.
+func (s *FileServer) readLocal(rid string, key string) (info ObjectInfo, rc io.ReadCloser, err error) {
+	fill := s.cache.begin(s.ID, key)
+	var content []byte
+	defer func() {
+		if s.Policy(key).NoCache {
+			content = nil
+		}
+		s.cache.finish(fill, info, content)
+	}()
+	meta, err := s.Storage.Stat(s.ID, key)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	size, r, err := s.Storage.ReadVerified(s.ID, key)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	if size <= preVerifyMaxSize {
+		b, err := io.ReadAll(r)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return ObjectInfo{}, nil, err
+		}
+		content = b
+		r = io.NopCloser(bytes.NewReader(b))
+	}
+	s.logf(rid, "serving file (%s) from local disk", key)
+	info = ObjectInfo{
+		Key:      key,
+		Size:     meta.PlainSize,
+		Checksum: meta.Checksum,
+		ModTime:  meta.ModTime,
+		Source:   FetchSource{Kind: SourceLocal},
+
+		ContentType: meta.ContentType,
+	}
+	return info, r, nil
+}
+
+// reportCorruption discards a corrupt local copy so it can be replaced from the network
+// and notifies the OnCorruption callback.
+func (s *FileServer) reportCorruption(key string, err error) {
+	log.Printf("[%s] local copy of (%s) is corrupt, fetching from network: %s", s.Transport.Addr(), key, err)
+	if err := s.Storage.Delete(s.ID, key); err != nil {
+		log.Printf("[%s] failed to discard corrupt copy of (%s): %s", s.Transport.Addr(), key, err)
+	}
+	if s.OnCorruption != nil {
+		s.OnCorruption(key, err)
 	}
 }
 
-// Store saves a file locally and broadcasts a storage message to the network.
+// Store saves a file locally and broadcasts a storage message to the network, or only to the
+// nodes the key is pinned to with Pin or placed on by its Policy. The content type sniffed
+// from the first 512 bytes is recorded with it, to be served by GetWithInfo. Bootstrap
+// nodes that are offline, or that the replica could not be sent to, are queued to receive
+// it once they reconnect. A *BroadcastError means the file was stored and replicated to
+// every peer except those it names. Keys matching VersionedPrefixes keep their earlier
+// content as versions, pruned according to VersionKeepLast and VersionMaxAge. Keys stored as
+// immutable with StoreWithMetadata fail with an error wrapping ErrImmutable unless they are
+// given the content they hold. An empty key fails with an error wrapping ErrInvalidKey;
+// ErrorKind tells which errors are worth retrying.
 func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
-	size, err := s.Storage.Write(s.ID, key, tee)
+	return s.StoreContext(context.Background(), key, r, TransferOpts{})
+}
+
+// storeTransfer stores a file for StoreContext, reporting progress to t and recording meta with
+// it. The content is read in full before anything is written, so a transfer cancelled while
+// reading leaves no trace.
+func (s *FileServer) storeTransfer(t *transfer, key string, r io.Reader, meta ObjectMetadata) error {
+	_, err := s.storeReplicated(t, key, r, s.peerList(), 0, meta)
+	return err
+}
+
+// storeReplicated writes a file locally and replicates it to those of peers it is placed on,
+// like storeTransfer, recording meta with it. When ackID is not zero, peers able to acknowledge replicas are asked to, naming the acknowledgement
+// with it.
+//
+// Returns: Number of plaintext bytes stored, and any errors as for Store.
+func (s *FileServer) storeReplicated(t *transfer, key string, r io.Reader, peers []p2p.Node, ackID uint64, meta ObjectMetadata) (_ int64, err error) {
+	t.phase(TransferRead, "", readerSize(r))
+	// Gets of the key wait for, or follow, the local write rather than asking peers.
+	w := s.writing.begin(key, readerSize(r))
+	defer func() {
+		s.writing.end(key, w, err)
+	}()
+	content, err := w.readAll(t.reader(r))
 	if err != nil {
-		return err
+		return 0, err
 	}
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  crypto.HashKey(key),
-			Size: size + 16, // Account for extra encryption padding
-		},
+	size := int64(len(content))
+	if held, err := s.checkWritable(key, bytes.NewReader(content)); held || err != nil {
+		return size, err
 	}
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	peers = s.placement(key, peers)
+	var version uint64
+	if s.versioned(key) {
+		written, err := s.Storage.WriteNextVersion(s.ID, key, bytes.NewReader(content))
+		if err != nil {
+			return 0, err
+		}
+		version = written.Version
+	} else if _, err := s.Storage.Write(s.ID, key, bytes.NewReader(content)); err != nil {
+		if noSpace(err) {
+			s.diskFull(err)
+			return 0, fmt.Errorf("storing (%s): %w", key, errors.Join(ErrNoSpace, err))
+		}
+		return 0, err
+	}
+	s.diskWritable()
+	if err := s.recordContentType(key, meta.ContentType, content); err != nil {
+		return 0, err
 	}
-	time.Sleep(5 * time.Millisecond)
-	var peers []io.Writer
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	if meta.Immutable {
+		if err := s.Storage.SetImmutable(s.ID, key); err != nil {
+			return 0, err
+		}
 	}
-	// Send the file to all connected peers
-	mw := io.MultiWriter(peers...)
-	_, err = mw.Write([]byte{p2p.IncomingStream})
+	s.writing.end(key, w, nil)
+	s.objectStored(objectRef{owner: s.ID, key: crypto.HashKey(key)})
+	s.publishEvent(NotifyEvent{Op: NotifyStore, Key: key, RequestID: t.requestID()})
+	rep, err := s.prepareReplica(key, bytes.NewReader(content))
 	if err != nil {
-		return err
+		return size, err
+	}
+	rep.version = version
+	rep.ackID = ackID
+	s.deferReplication(key)
+	n, err := s.replicateTransfer(t, peers, rep)
+	if version > 0 {
+		s.pruneVersions(key)
 	}
-	n, err := crypto.CopyEncrypt(s.EncKey, fileBuffer, mw)
 	if err != nil {
-		return err
+		s.deferFailed(err, peers, key)
+		return size, err
 	}
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
-	return nil
+	s.logf(t.requestID(), "stored (%s) and replicated %d bytes to %d peers", key, n, len(peers))
+	return size, nil
+}
+
+// replicate sends a replica to the given peers as a MessageStoreFile followed by its stream,
+// carrying on past peers that fail.
+//
+// Returns: Number of replica bytes written to each peer that received it, and a
+// *BroadcastError naming the peers that did not.
+func (s *FileServer) replicate(peers []p2p.Node, rep replica) (int, error) {
+	return s.replicateTransfer(nil, peers, rep)
+}
+
+// replicateTransfer replicates like replicate, one peer at a time, reporting the progress of
+// each stream to t. Once t is cancelled the remaining peers are skipped and named in the
+// *BroadcastError; a stream already started is completed to keep the connection usable.
+//
+// A peer already being sent the same content by another caller is not sent it again: the
+// call waits for that push and takes its result. One sent it within PushDedupTTL is skipped.
+func (s *FileServer) replicateTransfer(t *transfer, peers []p2p.Node, rep replica) (int, error) {
+	berr := &BroadcastError{failed: make(map[string]error), total: len(peers)}
+	ref := objectRef{owner: rep.id, key: rep.key}
+	ttl := s.pushDedupTTL()
+	n := 0
+	var lead []p2p.Node
+	led := make(map[string]*push)
+	joined := make(map[string]*push)
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		if ttl < 0 {
+			lead = append(lead, peer)
+			continue
+		}
+		p, state := s.pushes.begin(addr, ref, rep.content(), ttl, rep.ackID != 0)
+		switch state {
+		case pushLead:
+			lead = append(lead, peer)
+			led[addr] = p
+		case pushJoin:
+			joined[addr] = p
+			s.metrics.pushesDeduplicated.Add(1)
+		case pushDelivered:
+			n = int(rep.size())
+			s.metrics.pushesDeduplicated.Add(1)
+		}
+	}
+	sent, err := s.pushReplica(t, lead, rep, berr)
+	for addr, p := range led {
+		s.pushes.end(p, errors.Join(err, berr.failed[addr]))
+	}
+	if err != nil {
+		return sent, err
+	}
+	n = max(n, sent)
+	// Joined pushes are waited for once streamMu is released, as their leaders may need it.
+	for addr, p := range joined {
+		if err := p.wait(); err != nil {
+			berr.failed[addr] = err
+			continue
+		}
+		n = int(rep.size())
+	}
+	if len(berr.failed) > 0 {
+		return n, berr
+	}
+	return n, nil
+}
+
+// pushReplica sends a replica to each of peers in turn for replicateTransfer, recording the
+// peers that fail in berr.
+//
+// Returns: Number of replica bytes written to each peer that received it, and any errors
+// other than those of single peers.
+func (s *FileServer) pushReplica(t *transfer, peers []p2p.Node, rep replica, berr *BroadcastError) (int, error) {
+	s.streamMu.Lock()
+	defer s.streamMu.Unlock()
+	n := 0
+	// Send the message, then the file, to each peer in turn
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		if err := t.err(); err != nil {
+			berr.failed[addr] = err
+			continue
+		}
+		caps := s.capsOf(peer)
+		// Peers that cannot acknowledge replicas are not asked to.
+		ackID := rep.ackID
+		if !caps.acks {
+			ackID = 0
+		}
+		if rep.file == nil && len(rep.data) <= s.inlineThreshold() && caps.inline {
+			if err := s.sendInline(t, peer, rep, ackID); err != nil {
+				berr.failed[addr] = err
+				continue
+			}
+			n = len(rep.data)
+			s.replicaSent(peer, rep)
+			continue
+		}
+		msg := Message{
+			Payload: MessageStoreFile{
+				ID:        rep.id,
+				Key:       rep.key,
+				Size:      rep.size(),
+				Checksum:  rep.checksum,
+				Version:   rep.version,
+				Immutable: rep.immutable,
+				AckID:     ackID,
+				Namespace: rep.namespace,
+			},
+			RequestID: t.requestID(),
+		}
+		if _, err := s.sendMessage([]p2p.Node{peer}, &msg); err != nil {
+			var perr *BroadcastError
+			if !errors.As(err, &perr) {
+				return n, err
+			}
+			berr.failed[addr] = perr.failed[addr]
+			continue
+		}
+		t.phase(TransferReplicate, addr, rep.size())
+		stream, err := s.openStream(peer)
+		if err == nil {
+			sent := &sentStream{WriteCloser: stream}
+			if rep.file != nil {
+				err = t.sendFile(sent, rep.file, rep.size())
+			} else {
+				err = t.send(sent, rep.data)
+			}
+			if err == nil {
+				err = sent.Close()
+			}
+			// A stream cut short is aborted, so the peer does not read the next message as part of it.
+			if err != nil {
+				err = errors.Join(err, s.abortStream(peer, sent, rep.size()))
+			}
+		}
+		if err != nil {
+			berr.failed[addr] = err
+			continue
+		}
+		n = int(rep.size())
+		s.replicaSent(peer, rep)
+	}
+	return n, nil
 }
 
-// Stop stops the FileServer by closing the quitch channel.
+// replica is an object encrypted for replication, together with the exact length and
+// checksum of the bytes sent over the wire.
+type replica struct {
+	id        string   // Identifier of the node owning the object
+	key       string   // Hashed key the replica is stored under on peers
+	data      []byte   // Encrypted object exactly as streamed to peers
+	file      *os.File // Encrypted object streamed to peers in place of data, nil when data holds it
+	fileSize  int64    // Length of file
+	checksum  string   // Hex-encoded SHA-256 of the bytes streamed to peers
+	version   uint64   // Version of the object, zero when its key is not versioned
+	immutable bool     // Whether the object is immutable, so peers keep it write-once too
+	ackID     uint64   // Identifier peers acknowledge the replica with, zero when no acknowledgement is wanted
+	plainSum  string   // Hex-encoded SHA-256 of the IV, if chosen, and plaintext when this node encrypted the replica; empty otherwise
+	namespace string   // Namespace of the plain key when this node encrypted the replica; empty otherwise
+}
+
+// content identifies what the replica holds, so pushes of it encrypted with different IVs
+// are recognised as the same.
+func (r replica) content() pushContent {
+	if len(r.plainSum) > 0 {
+		return pushContent{sum: r.plainSum, version: r.version}
+	}
+	return pushContent{sum: r.checksum, version: r.version}
+}
+
+// size returns the number of bytes streamed to peers.
+func (r replica) size() int64 {
+	if r.file != nil {
+		return r.fileSize
+	}
+	return int64(len(r.data))
+}
+
+// prepareReplica encrypts the plaintext of key into the payload sent to peers, so the size
+// and checksum announced to them describe the bytes that actually follow. The replica is
+// immutable if the local copy of key is.
+func (s *FileServer) prepareReplica(key string, plain io.Reader) (replica, error) {
+	return s.prepareReplicaIV(key, nil, plain)
+}
+
+// prepareReplicaIV prepares a replica like prepareReplica, encrypted with iv rather than a
+// random IV unless iv is nil.
+func (s *FileServer) prepareReplicaIV(key string, iv []byte, plain io.Reader) (replica, error) {
+	enc := new(bytes.Buffer)
+	// Replicas encrypted with a chosen IV are only the same content when the IV is too.
+	plainHash := sha256.New()
+	plainHash.Write(iv)
+	plain = io.TeeReader(plain, plainHash)
+	var err error
+	if iv == nil {
+		_, err = crypto.CopyEncrypt(s.dataKey(key), plain, enc)
+	} else {
+		_, err = crypto.CopyEncryptIV(s.dataKey(key), iv, plain, enc)
+	}
+	if err != nil {
+		return replica{}, err
+	}
+	sum := sha256.Sum256(enc.Bytes())
+	return replica{
+		id:        s.ID,
+		key:       crypto.HashKey(key),
+		data:      enc.Bytes(),
+		checksum:  hex.EncodeToString(sum[:]),
+		immutable: s.immutable(s.ID, key),
+		plainSum:  hex.EncodeToString(plainHash.Sum(nil)),
+		namespace: keyNamespace(key),
+	}, nil
+}
+
+// Stop stops the FileServer by closing the quitch channel. Once Start has made the server
+// ready, Stop also waits until the messages being handled are done and the storage is released,
+// so nothing writes to the store after it returns.
 func (s *FileServer) Stop() {
-	close(s.quitch)
+	s.quit()
+	select {
+	case <-s.ready:
+		<-s.stopped
+	default:
+	}
+}
+
+// quit closes the quitch channel without waiting for the loop to exit.
+func (s *FileServer) quit() {
+	s.stopOnce.Do(func() { close(s.quitch) })
+}
+
+// Ready returns a channel closed once Start has opened the storage and the transport is
+// listening, unless NoListen is set, so the node serves requests. It is never closed if Start fails before.
+func (s *FileServer) Ready() <-chan struct{} {
+	return s.ready
 }
 
-// OnNode handles a new peer connection by adding it to the peer list.
+// Hello returns the handshake metadata this node advertises to its peers.
+func (s *FileServer) Hello() p2p.HelloFrame {
+	hello := p2p.HelloFrame{
+		NodeID:          s.ID,
+		AdvertiseAddr:   s.Transport.Addr(),
+		ProtocolVersion: p2p.ProtocolVersion,
+		Capabilities:    s.caps,
+		Labels:          s.Labels,
+		Peers:           s.peerAddrs(),
+		Incarnation:     s.incarnation,
+	}
+	if s.NoListen {
+		// There is no address to dial the node at.
+		hello.AdvertiseAddr = ""
+		hello.NoListen, hello.AcceptReplicas = true, s.AcceptReplicas
+	}
+	return hello
+}
+
+// Handshake exchanges hello frames with a new peer; assign it to the transport's HandshakeFunc.
+func (s *FileServer) Handshake(p p2p.Node) error {
+	return p2p.HelloHandshakeFunc(s.Hello())(p)
+}
+
+// OnNode handles a new peer connection by adding it to the peer list, or refuses it if the
+// peer is banned or is this node itself, dialed through a seed address that reaches it. A
+// reconnected bootstrap node is sent the replications it missed while it was offline.
 func (s *FileServer) OnNode(p p2p.Node) error {
+	if until, banned := s.peerBanned(p); banned {
+		return fmt.Errorf("peer (%s) is banned until %s", p.RemoteAddr(), until.Format(time.RFC3339))
+	}
+	addr, isBootstrap := s.bootstrapAddr(p.RemoteAddr().String())
+	if id := p.Hello().NodeID; len(id) > 0 && id == s.ID {
+		if isBootstrap {
+			s.forgetSelfSeed(addr)
+		}
+		return fmt.Errorf("peer (%s) is this node itself", p.RemoteAddr())
+	}
+	if lastAddr, restarted := s.noteIncarnation(p); restarted {
+		s.peerRestarted(p, lastAddr)
+	}
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 	s.peers[p.RemoteAddr().String()] = p
-	log.Printf("connected to remote %s", p.RemoteAddr())
+	delete(s.leaving, p.RemoteAddr().String())
+	s.directory.learn(p.Hello())
+	s.claimDialedLocked(p)
+	if isBootstrap {
+		// A node that left and rejoined is a member again.
+		delete(s.departed, addr)
+		s.bootstrapPeers[addr] = p
+		s.bootstrapIDs[addr] = p.Hello().NodeID
+		s.bootstrapAt[addr] = s.Clock.Now()
+		go s.drainPending(addr, p)
+		if s.watching[addr] {
+			go func() {
+				if err := s.subscribe(p); err != nil {
+					log.Printf("[%s] subscribing to (%s): %s", s.Transport.Addr(), addr, err)
+				}
+			}()
+		}
+	}
+	if s.MirrorAll {
+		// Objects stored while the two were apart are pulled from the peer.
+		s.mirror.requestBackfill()
+	}
+	// The peer's clock is measured now rather than at the next check.
+	go s.pingPeers([]p2p.Node{p})
+	// Control messages the peer did not acknowledge were likely lost with its last connection.
+	go s.resendReliable(p)
+	go s.shareLeases(p)
+	go s.shareAliases(p)
+	hello := p.Hello()
+	log.Printf("connected to remote %s (node %s, labels %v)", p.RemoteAddr(), hello.NodeID, hello.Labels)
 	return nil
 }
 
+// OnNodeClosed removes a disconnected peer from the peer list. Bootstrap nodes are redialed
+// until they come back or the server is stopped, unless they left the cluster; those whose
+// connection closed soon after it was made are redialed after a backoff.
+func (s *FileServer) OnNodeClosed(p p2p.Node) {
+	s.dropSubscriber(p.RemoteAddr().String())
+	s.dispatch.forgetStrikes(p.RemoteAddr().String())
+	s.serving.drop(p.RemoteAddr().String())
+	s.peerStats.drop(p.RemoteAddr().String())
+	s.receiveStats.drop(p.RemoteAddr().String())
+	s.firstBytes.drop(p.RemoteAddr().String())
+	s.abortTxsFrom(p.RemoteAddr().String())
+	s.pushes.drop(p.RemoteAddr().String())
+	s.outbox.drop(p)
+	addr, isBootstrap := s.bootstrapAddr(p.RemoteAddr().String())
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if s.peers[p.RemoteAddr().String()] == p {
+		delete(s.peers, p.RemoteAddr().String())
+		delete(s.leaving, p.RemoteAddr().String())
+		delete(s.fetchOnly, p.RemoteAddr().String())
+	}
+	log.Printf("disconnected from remote %s", p.RemoteAddr())
+	if !isBootstrap || s.bootstrapPeers[addr] != p {
+		return
+	}
+	delete(s.bootstrapPeers, addr)
+	if s.departed[addr] {
+		return
+	}
+	select {
+	case <-s.quitch:
+	default:
+		go s.redialAfter(addr, s.redialWaitLocked(addr))
+	}
+}
+
 // loop is the main event loop for processing incoming messages and terminating when quitch is closed.
-func (s *FileServer) loop() {
+// A fatal transport error stops the server and is returned.
+func (s *FileServer) loop() error {
 	defer func() {
+		defer close(s.stopped)
+		// The queued messages are dropped once quitch is closed; those being handled still use the storage.
+		s.handlers.Wait()
 		log.Println("File server stopped")
+		if err := s.Storage.Close(); err != nil {
+			fmt.Printf("Error releasing storage: %s", err)
+		}
 		err := s.Transport.Close()
 		if err != nil {
 			fmt.Printf("Error closing transport: %s", err)
@@ -243,134 +1424,316 @@ func (s *FileServer) loop() {
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Printf("decoding error: %s", err)
+			msg, err := s.receive(rpc.From, rpc.Payload)
+			if err != nil {
+				if err := s.rejectMessage(rpc.From, fmt.Errorf("decoding message: %w", err)); err != nil {
+					log.Println("Error handling message", err)
+				}
+				continue
 			}
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("Error handling message", err)
+			if cancel, ok := msg.Payload.(MessageCancel); ok {
+				// Cancellations skip the queue, whose worker may be streaming the answer they stop.
+				s.serving.cancel(rpc.From, cancel.RequestID)
+				continue
 			}
+			s.enqueue(rpc.From, &msg)
+		case err := <-s.Transport.Err():
+			log.Printf("[%s] transport failed, shutting down: %s", s.Transport.Addr(), err)
+			s.quit()
+			return err
 		case <-s.quitch:
-			return
+			return nil
 		}
 	}
 }
 
-// handleMessage handles incoming messages and dispatches them based on a message type.
-func (s *FileServer) handleMessage(from string, msg *Message) error {
-	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
-	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+// GC collects garbage in the storage of every owner held by this node and logs what was reclaimed.
+//
+// Returns: The combined report of all owners and any errors.
+func (s *FileServer) GC() (storage.GCReport, error) {
+	var total storage.GCReport
+	ids, err := s.Storage.Owners()
+	if err != nil {
+		return total, err
 	}
-	return nil
+	var errs []error
+	for _, id := range ids {
+		report, err := s.Storage.GC(id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("gc %s: %w", id, err))
+		}
+		total.DirsRemoved += report.DirsRemoved
+		total.OrphansRemoved += report.OrphansRemoved
+		total.BytesReclaimed += report.BytesReclaimed
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		log.Printf("[%s] gc: %s", s.Transport.Addr(), err)
+	}
+	log.Printf("[%s] gc removed %d directories and %d orphans, reclaiming %d bytes",
+		s.Transport.Addr(), total.DirsRemoved, total.OrphansRemoved, total.BytesReclaimed)
+	return total, err
 }
 
-// handleMessageStoreFile handles a request to store a file and writes it locally.
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+// handleMessageStoreFile handles a request to store a file and writes it locally, then
+// acknowledges it if the sender asked to.
+func (s *FileServer) handleMessageStoreFile(from string, span string, msg MessageStoreFile) (err error) {
+	defer func() {
+		err = s.ackReplica(from, msg.Key, msg.AckID, err)
+	}()
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) not found", from)
 	}
-	n, err := s.Storage.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
-	if err != nil {
+	stream := peer.AcceptStream()
+	defer stream.Close()
+	rr := &replicaReader{stream: stream, muxed: s.capsOf(peer).mux, left: msg.Size, started: s.Clock.Now()}
+	if err := s.admitReplica(from, span, msg.ID, msg.Namespace, msg.Key, msg.Size); err != nil {
+		// Keep the connection aligned with the next message.
+		return errors.Join(err, rr.drain())
+	}
+	if held, err := s.admitOverwrite(from, msg.ID, msg.Key, msg.Checksum); held || err != nil {
+		return errors.Join(err, rr.drain())
+	}
+	release, admitted := s.admitReceive(peer, msg.Size)
+	if !admitted {
+		err := s.refuseReplica(from, msg.ID, msg.Key, fmt.Errorf("replica (%s): %w", msg.Key, ErrBusy), ErrBusy)
+		return errors.Join(err, rr.drain())
+	}
+	defer release()
+	if msg.Version > 0 {
+		return s.storeReplicaVersion(from, msg, rr)
+	}
+	if err := s.receiveReplica(from, rr, msg); err != nil {
 		return err
 	}
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
-	peer.CloseStream()
+	if err := s.markImmutable(msg.ID, msg.Key, msg.Immutable); err != nil {
+		return err
+	}
+	s.objectStored(objectRef{owner: msg.ID, key: msg.Key})
+	s.logf(span, "stored replica (%s) of %d bytes from (%s)", msg.Key, msg.Size, from)
 	return nil
 }
 
-// handleMessageGetFile handles a request to retrieve a file, sending it to the requesting peer.
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	// Check if the file exists on the local storage
-	if !s.Storage.Has(msg.ID, msg.Key) {
-		// File not found - send a "FileNotFound" signal to the requesting peer
-		peer, ok := s.peers[from]
-		if !ok {
-			return fmt.Errorf("peer (%s) not found", from)
-		}
-		err := peer.Send([]byte{p2p.FileNotFound}) // Send a specific byte indicating file not found
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("[%s] file (%s) not found on disk", s.Transport.Addr(), msg.Key)
-	}
-
-	// File found - proceed to send the file to the requesting peer
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-	fileSize, r, err := s.Storage.Read(msg.ID, msg.Key)
+// checkReplica compares a received object with the checksum declared by its sender, deleting it on mismatch.
+func (s *FileServer) checkReplica(id string, key string, checksum string) error {
+	meta, err := s.Storage.Metadata(id, key)
 	if err != nil {
 		return err
 	}
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer func(rc io.ReadCloser) {
-			err := rc.Close()
-			if err != nil {
-				log.Fatal("error closing connection", err)
-			}
-		}(rc)
+	if meta.Checksum == checksum {
+		return nil
+	}
+	if err := s.Storage.Delete(id, key); err != nil {
+		return err
 	}
+	return storage.ErrContentCorrupted
+}
 
-	// Get the requesting peer
-	peer, ok := s.peers[from]
+// handleMessageGetFile handles a request to retrieve a file, sending it to the requesting peer.
+func (s *FileServer) handleMessageGetFile(from string, q query, msg MessageGetFile) error {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) not found", from)
 	}
+	if s.testHookGetFile != nil {
+		s.testHookGetFile(msg.Key)
+	}
+	if err := s.authorize(from, q.span, OpGet, msg.ID, msg.Namespace, msg.Key); err != nil {
+		return errors.Join(err, s.sendRefusal(peer, q, deniedHeader))
+	}
+	release, admitted := s.admitGet(peer, msg.ID, msg.Key)
+	if !admitted {
+		s.logf(q.span, "refused (%s) to (%s) as busy", msg.Key, from)
+		return s.sendRefusal(peer, q, busyHeader(s.busyRetryAfter()))
+	}
+	defer release()
 
-	// Notify the peer that an incoming stream is starting
-	err = peer.Send([]byte{p2p.IncomingStream})
-	if err != nil {
+	if sent, err := s.sendObjectInline(peer, q, msg.ID, msg.Key); sent || err != nil {
+		if sent {
+			s.logf(q.span, "served (%s) inline to (%s)", msg.Key, from)
+		}
 		return err
 	}
-
-	// Send the file size before sending the file content
-	err = binary.Write(peer, binary.LittleEndian, fileSize)
+	cancelled := s.serving.begin(from, msg.RequestID)
+	defer s.serving.end(from, msg.RequestID)
+	// Open the stream the answer is sent on. The stamp and header are buffered and reach the
+	// peer together, ahead of the object bytes.
+	stream, err := s.openAnswer(peer, q)
 	if err != nil {
 		return err
 	}
+	if err := s.writeStamp(stream, peer, msg.ID, msg.Key); err != nil {
+		return errors.Join(err, stream.Close())
+	}
+	err = s.sendObject(q.span, peer, stream, msg.ID, msg.Key, cancelled)
+	return ignoreCancelled(errors.Join(err, stream.Close()))
+}
 
-	// Send the file content
-	n, err := io.Copy(peer, r)
+// sendObject writes the header of a stored object followed by its bytes to w, the stream to
+// peer, or a header marking it missing if it is not held locally so the requester moves on to
+// the next peer. Once cancelled is set the object is truncated and an error wrapping
+// errRequestCancelled returned. Its progress is logged under span.
+func (s *FileServer) sendObject(span string, peer p2p.Node, w io.Writer, id string, key string, cancelled *atomic.Bool) error {
+	// Check if the file exists on the local storage
+	ok, err := s.Storage.Has(id, key)
+	if err != nil {
+		s.logf(span, "could not check local disk for (%s), reporting not found: %s", key, err)
+	}
+	if !ok {
+		return binary.Write(w, binary.LittleEndian, objectHeader{})
+	}
+	size, r, err := s.Storage.Read(id, key)
 	if err != nil {
+		s.logf(span, "could not open (%s), reporting not found: %s", key, err)
+		return binary.Write(w, binary.LittleEndian, objectHeader{})
+	}
+	s.logf(span, "serving file (%s) over the network", key)
+	n, err := writeObject(w, size, s.objectSum(id, key), r, cancelled, s.capsOf(peer).chunked)
+	if s.testHookServed != nil {
+		s.testHookServed(key, n)
+	}
+	if errors.Is(err, errRequestCancelled) {
+		s.metrics.requestsCancelled.Add(1)
+		s.logf(span, "stopped serving (%s) to %s after %d of %d bytes, the request was cancelled", key, peer.RemoteAddr(), n, size)
 		return err
 	}
-
-	// Log the transfer
-	fmt.Printf("[%s] written %d bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	if err != nil {
+		return fmt.Errorf("sending (%s) to %s: %w", key, peer.RemoteAddr(), err)
+	}
+	s.logf(span, "written %d bytes of (%s) over the network to %s", n, key, peer.RemoteAddr())
 	return nil
 }
 
+// objectHeader precedes every object sent in answer to MessageGetFile and MessageGetBatch.
+type objectHeader struct {
+	Found bool              // Whether the peer holds the object; no bytes follow when it does not
+	Size  int64             // Number of object bytes that follow, possibly zero; without Found, -1 when the peer denied the request and -2 when it was busy
+	Sum   [sha256.Size]byte // SHA-256 of the object bytes, all zeroes when the peer has no checksum for it; for a busy peer, the wait it suggests
+}
+
+// objectSum returns the recorded checksum of a stored object, or all zeroes if it has none.
+func (s *FileServer) objectSum(id string, key string) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	if meta, err := s.Storage.Metadata(id, key); err == nil {
+		hex.Decode(sum[:], []byte(meta.Checksum))
+	}
+	return sum
+}
+
+// verify compares the hash of the object bytes received after the header with its sum.
+//
+// Returns: storage.ErrContentCorrupted if they differ.
+func (h objectHeader) verify(received hash.Hash) error {
+	if h.Sum == ([sha256.Size]byte{}) || bytes.Equal(received.Sum(nil), h.Sum[:]) {
+		return nil
+	}
+	return storage.ErrContentCorrupted
+}
+
+// writeObject writes a header carrying size and sum followed by size bytes of r to the peer,
+// in chunks when chunked is set, then closes r if it is an io.Closer. A failed close is joined
+// into the returned error rather than ignored. Once cancelled is set, a chunked object is
+// truncated before its next chunk.
+//
+// Returns: Number of content bytes written and any errors.
+func writeObject(w io.Writer, size int64, sum [sha256.Size]byte, r io.Reader, cancelled *atomic.Bool, chunked bool) (n int64, err error) {
+	if rc, ok := r.(io.Closer); ok {
+		defer func() {
+			err = errors.Join(err, rc.Close())
+		}()
+	}
+	// Send the file size before sending the file content
+	if err := binary.Write(w, binary.LittleEndian, objectHeader{Found: true, Size: size, Sum: sum}); err != nil {
+		return 0, err
+	}
+	return writeStream(w, r, size, cancelled, chunked)
+}
+
+// bootstrapNetwork connects to every bootstrap node, retrying those that are not reachable yet.
+// The seeds are looked up once before it returns; a failed lookup is logged and retried in the
+// background, as are the refreshes of a source that changes, so bootstrapping never fails.
 func (s *FileServer) bootstrapNetwork() error {
-	for _, addr := range s.BootstrapNodes {
-		if len(addr) == 0 {
-			continue
-		}
-		go func(addr string) {
-			fmt.Printf("[%s] attempting to connect with remote: %s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error", err)
-			}
-		}(addr)
+	source := s.bootstrapSource()
+	failed := s.refreshSeedsLogged(source) != nil
+	if failed || source.RefreshInterval() > 0 {
+		go s.seedLoop(source, failed)
 	}
 	return nil
 }
 
 func (s *FileServer) Start() error {
 	fmt.Printf("[%s] starting fileserver...\n", s.Transport.Addr())
-	if err := s.Transport.ListenAndAccept(); err != nil {
+	now := s.Clock.Now()
+	s.startedAt.Store(&now)
+	if err := s.startChaos(); err != nil {
 		return err
 	}
-	err := s.bootstrapNetwork()
-	if err != nil {
+	s.admission.limit(s.MaxServingGets, s.MaxReceivingReplicas, s.MaxInflightBytes)
+	if err := s.Storage.Init(); err != nil {
 		return err
 	}
-	s.loop()
-	return nil
+	// The storage root stays locked until the loop exits.
+	if err := s.open(); err != nil {
+		return errors.Join(err, s.Storage.Close())
+	}
+	if err := s.registerMaintenance(); err != nil {
+		return errors.Join(err, s.Storage.Close())
+	}
+	go s.maintenance.run(s.quitch)
+	if len(s.PrefetchFile) > 0 {
+		go s.prefetchFromFile()
+	}
+	if s.MirrorAll {
+		s.startMirror()
+	}
+	if s.skewCheckInterval() > 0 {
+		go s.skewLoop()
+	}
+	if s.ackRetryInterval() > 0 {
+		go s.reliableLoop()
+	}
+	close(s.ready)
+	return s.loop()
 }
 
-func init() {
-	gob.Register(MessageStoreFile{})
-	gob.Register(MessageGetFile{})
+// open restores the state the server persisted in its storage, then joins the network.
+func (s *FileServer) open() error {
+	if err := s.checkStorage(); err != nil {
+		return err
+	}
+	if err := s.loadPending(); err != nil {
+		return err
+	}
+	if err := s.loadNotify(); err != nil {
+		return err
+	}
+	if err := s.loadTombstones(); err != nil {
+		return err
+	}
+	if err := s.loadKeystore(); err != nil {
+		return err
+	}
+	if err := s.loadPins(); err != nil {
+		return err
+	}
+	if err := s.loadAliases(); err != nil {
+		return err
+	}
+	if err := s.loadBans(); err != nil {
+		return err
+	}
+	if err := s.loadReliable(); err != nil {
+		return err
+	}
+	// Transactions staged before a restart can no longer be committed.
+	if err := s.Storage.AbortAll(); err != nil {
+		return err
+	}
+	if !s.NoListen {
+		if err := s.Transport.ListenAndAccept(); err != nil {
+			return err
+		}
+	}
+	return s.bootstrapNetwork()
 }
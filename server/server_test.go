@@ -0,0 +1,506 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeServer builds a FileServer listening on listenAddr with its storage under a test temp dir.
+func makeServer(t testing.TB, listenAddr string, nodes ...string) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:            crypto.NewEncryptionKey(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: storage.CASPathTransformFuncSHA256,
+		Transport:         tr,
+		BootstrapNodes:    nodes,
+	})
+	tr.HandshakeFunc = s.Handshake
+	tr.OnNode = s.OnNode
+	tr.OnNodeClosed = s.OnNodeClosed
+	return s
+}
+
+// startCluster starts the given servers in order, each once the one before is ready, and
+// waits until each has connected to a peer.
+func startCluster(t testing.TB, servers ...*FileServer) {
+	for _, s := range servers {
+		started := make(chan error, 1)
+		go func(s *FileServer) {
+			started <- s.Start()
+		}(s)
+		select {
+		case <-s.Ready():
+			go func() {
+				if err := <-started; err != nil {
+					t.Error(err)
+				}
+			}()
+		case err := <-started:
+			t.Fatalf("starting %s: %v", s.Transport.Addr(), err)
+		}
+	}
+	t.Cleanup(func() {
+		// Stop returns once the messages being handled are done and the ports are released.
+		for _, s := range servers {
+			s.Stop()
+		}
+	})
+	for _, s := range servers {
+		waitFor(t, func() bool {
+			s.peerLock.Lock()
+			defer s.peerLock.Unlock()
+			return len(s.peers) > 0
+		})
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t testing.TB, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// settle returns once to has handled every message from sent it before. Messages from one
+// peer are handled in order, so it is enough that to handles a messagePing sent after them.
+func settle(t testing.TB, from *FileServer, to *FileServer) {
+	t.Helper()
+	handled := make(chan struct{})
+	require.NoError(t, Subscribe(to, func(string, messagePing) { close(handled) }))
+	var peers []p2p.Node
+	for _, peer := range from.peerList() {
+		if peer.Hello().NodeID == to.ID {
+			peers = append(peers, peer)
+		}
+	}
+	require.Len(t, peers, 1)
+	_, err := from.sendMessage(peers, &Message{Payload: messagePing{}})
+	require.NoError(t, err)
+	<-handled
+}
+
+func TestGetHealsCorruptLocalObject(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	var corrupted []string
+	a.OnCorruption = func(key string, err error) {
+		corrupted = append(corrupted, key)
+	}
+
+	key := "corrupt_me.png"
+	data := []byte("the bytes a peer still holds intact")
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	})
+
+	path := fmt.Sprintf("%s/%s/%s", a.StorageRoot, a.ID, storage.CASPathTransformFuncSHA256(key).FullPath())
+	require.NoError(t, os.WriteFile(path, []byte("the bytes rotted away on the local disk"), 0o644))
+
+	r, err := a.Get(key)
+	require.NoError(t, err)
+	b2, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, b2)
+	assert.Equal(t, []string{key}, corrupted)
+	assert.NoError(t, a.Storage.Verify(a.ID, key), "local copy should have been replaced")
+}
+
+func TestGetWithInfoReportsPlaintextSize(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	key := "sized.png"
+	data := []byte("twenty-seven bytes of data!")
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	})
+
+	info, r, err := a.GetWithInfo(key)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, int64(len(data)), info.Size, "local hit")
+	assert.NotEmpty(t, info.Checksum)
+
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	remote, r, err := a.GetWithInfo(key)
+	require.NoError(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, int64(len(data)), remote.Size, "remote hit")
+	assert.Equal(t, info.Checksum, remote.Checksum)
+
+	// The replica's metadata records the plain size too, though it holds the encrypted object.
+	replica, err := b.Storage.Stat(a.ID, crypto.HashKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), replica.PlainSize)
+	assert.Greater(t, replica.Size, replica.PlainSize)
+	stat, err := a.StatKey(key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), stat.Size)
+}
+
+func TestGetCachesClusterWideMiss(t *testing.T) {
+	a := makeServer(t, ":4000")
+	a.negCache = newNegativeCache(time.Minute, 0, nil)
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	key := "not_there_yet.png"
+	_, err := a.Get(key)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Equal(t, int64(0), a.Metrics()["negative_cache_hits"])
+
+	_, err = a.Get(key)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Equal(t, int64(1), a.Metrics()["negative_cache_hits"])
+
+	data := []byte("finally here")
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	})
+	r, err := a.Get(key)
+	require.NoError(t, err, "a store must invalidate the cached miss")
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, int64(1), a.Metrics()["negative_cache_hits"])
+}
+
+func TestStoreReplicatesBoundarySizes(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	for _, size := range []int{0, 1, 32<<10 - 1, 32 << 10, 32<<10 + 1, 64 << 10} {
+		key := fmt.Sprintf("boundary_%d", size)
+		data := bytes.Repeat([]byte{'x'}, size)
+		require.NoError(t, a.Store(key, bytes.NewReader(data)), key)
+		waitFor(t, func() bool {
+			ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+		require.NoError(t, b.Storage.Verify(a.ID, crypto.HashKey(key)), key)
+
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+		r, err := a.Get(key)
+		require.NoError(t, err, key)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, key)
+	}
+}
+
+// pipeNode is a p2p.Node over an in-memory pipe whose streams need no read loop hand-over.
+type pipeNode struct {
+	net.Conn
+}
+
+func (p pipeNode) Send(b []byte) error {
+	_, err := p.Write(b)
+	return err
+}
+
+func (p pipeNode) Flush() error { return nil }
+
+func (p pipeNode) AcceptStream() io.ReadCloser { return io.NopCloser(p.Conn) }
+
+// OpenStream writes the stream to the pipe; pipeNode advertises no capabilities, so it is
+// only ever sent streams after a marker.
+func (p pipeNode) OpenStream() io.WriteCloser { return pipeStream{p.Conn} }
+
+// OpenReply writes the answer to the pipe like any other stream.
+func (p pipeNode) OpenReply(uint64) io.WriteCloser { return pipeStream{p.Conn} }
+
+// AwaitReply hands over the pipe, as AcceptStream does.
+func (p pipeNode) AwaitReply(uint64, <-chan struct{}) io.ReadCloser { return io.NopCloser(p.Conn) }
+
+// pipeStream is a stream written to a pipe, which stays open once the stream is closed.
+type pipeStream struct {
+	io.Writer
+}
+
+func (pipeStream) Close() error { return nil }
+
+func (p pipeNode) Hello() p2p.HelloFrame { return p2p.HelloFrame{} }
+
+// faultyWriter forwards at most n bytes, flipping the byte at flip when it is within range,
+// and reports every write as complete.
+type faultyWriter struct {
+	w    io.Writer
+	n    int
+	flip int
+}
+
+func (f *faultyWriter) Write(p []byte) (int, error) {
+	out := append([]byte(nil), p[:min(len(p), f.n)]...)
+	if f.flip >= 0 && f.flip < len(out) {
+		out[f.flip] ^= 0xff
+	}
+	f.n -= len(out)
+	f.flip -= len(p)
+	if _, err := f.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestHandleStoreFileEnforcesSizeAndChecksum(t *testing.T) {
+	a := makeServer(t, ":4000")
+	rep, err := a.prepareReplica("enforced.png", bytes.NewReader(bytes.Repeat([]byte("payload"), 1000)))
+	require.NoError(t, err)
+	msg := MessageStoreFile{ID: a.ID, Key: rep.key, Size: int64(len(rep.data)), Checksum: rep.checksum}
+
+	tests := []struct {
+		name    string
+		n       int
+		flip    int
+		wantErr error
+	}{
+		{name: "intact", n: len(rep.data), flip: -1},
+		{name: "truncated", n: len(rep.data) - 100, flip: -1, wantErr: io.ErrUnexpectedEOF},
+		{name: "corrupted", n: len(rep.data), flip: 500, wantErr: storage.ErrContentCorrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := makeServer(t, ":4001")
+			local, remote := net.Pipe()
+			b.peers["faulty"] = pipeNode{Conn: local}
+			go func() {
+				w := &faultyWriter{w: remote, n: tt.n, flip: tt.flip}
+				w.Write(rep.data)
+				remote.Close()
+			}()
+
+			err := b.handleMessageStoreFile("faulty", "", msg)
+			ok, herr := b.Storage.Has(msg.ID, msg.Key)
+			require.NoError(t, herr)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				assert.True(t, ok)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.False(t, ok, "a rejected replica must not be kept")
+		})
+	}
+}
+
+// brokenListener fails every Accept with a permanent error.
+type brokenListener struct {
+	net.Listener
+}
+
+func (brokenListener) Accept() (net.Conn, error) { return nil, assert.AnError }
+
+func (brokenListener) Close() error { return nil }
+
+func TestStartReturnsFatalTransportError(t *testing.T) {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":4000",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+		Listen:        func(string, string) (net.Listener, error) { return brokenListener{}, nil },
+	})
+	s := NewFileServer(FileServerOpts{
+		EncKey:      crypto.NewEncryptionKey(),
+		StorageRoot: t.TempDir(),
+		Transport:   tr,
+	})
+
+	done := make(chan error)
+	go func() { done <- s.Start() }()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, assert.AnError)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Start did not return after the transport failed")
+	}
+	s.Stop() // stopping an already stopped server must not panic
+}
+
+func TestReadyOnceStarted(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	s := makeMemoryServer(t, network, ":4000")
+	select {
+	case <-s.Ready():
+		t.Fatal("ready before Start")
+	default:
+	}
+	done := make(chan error)
+	go func() { done <- s.Start() }()
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatal("not ready after Start")
+	}
+	s.Stop()
+	assert.NoError(t, <-done)
+}
+
+// failingCloser is a reader whose Close always fails.
+type failingCloser struct {
+	io.Reader
+}
+
+func (failingCloser) Close() error { return assert.AnError }
+
+func TestWriteObjectReportsCloseError(t *testing.T) {
+	local, remote := net.Pipe()
+	data := []byte("content that still gets delivered")
+	received := make(chan []byte)
+	go func() {
+		var header objectHeader
+		if err := binary.Read(remote, binary.LittleEndian, &header); err != nil {
+			received <- nil
+			return
+		}
+		b, _ := io.ReadAll(newChunkReader(remote, header.Size))
+		received <- b
+	}()
+
+	n, err := writeObject(pipeNode{Conn: local}, int64(len(data)), sha256.Sum256(data), failingCloser{bytes.NewReader(data)}, nil, true)
+	assert.ErrorIs(t, err, assert.AnError, "the close failure must reach the caller")
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, <-received)
+}
+
+func TestSendObjectTellsEmptyFromMissing(t *testing.T) {
+	a := makeServer(t, ":4000")
+	require.NoError(t, a.Storage.Init())
+	_, err := a.Storage.Write("owner", "empty", bytes.NewReader(nil))
+	require.NoError(t, err)
+
+	for key, want := range map[string]objectHeader{
+		"empty":   {Found: true, Size: 0, Sum: sha256.Sum256(nil)},
+		"missing": {Found: false},
+	} {
+		local, remote := net.Pipe()
+		go func() {
+			assert.NoError(t, a.sendObject("", pipeNode{Conn: local}, local, "owner", key, nil))
+			local.Close()
+		}()
+		var got objectHeader
+		require.NoError(t, binary.Read(remote, binary.LittleEndian, &got), key)
+		assert.Equal(t, want, got, key)
+		rest, err := io.ReadAll(remote)
+		require.NoError(t, err)
+		assert.Empty(t, rest, key)
+	}
+}
+
+func TestGetBatchBoundarySizes(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	sizes := []int{0, 1, 32<<10 - 1, 32 << 10, 32<<10 + 1}
+	var keys []string
+	for _, size := range sizes {
+		key := fmt.Sprintf("batch_boundary_%d", size)
+		keys = append(keys, key)
+		require.NoError(t, a.Store(key, bytes.NewReader(bytes.Repeat([]byte{'y'}, size))))
+		waitFor(t, func() bool {
+			ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+			return ok
+		})
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+	}
+	results, err := a.GetBatch(keys)
+	require.NoError(t, err)
+	for i, res := range results {
+		require.NoError(t, res.Err, keys[i])
+		assert.Equal(t, bytes.Repeat([]byte{'y'}, sizes[i]), res.Data, keys[i])
+		assert.Equal(t, int64(sizes[i]), res.Info.Size, keys[i])
+	}
+}
+
+func TestBroadcastSkipsFailedPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	s := makeServer(t, ":4000")
+	var (
+		peers  []p2p.Node
+		remote []net.Conn
+	)
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		accepted, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+		defer accepted.Close()
+		peers = append(peers, p2p.NewTCPPeer(conn, true))
+		remote = append(remote, accepted)
+	}
+	require.NoError(t, peers[1].Close())
+
+	msg := Message{Payload: MessageGetFile{ID: s.ID, Key: "key"}}
+	delivered, err := s.sendMessage(peers, &msg)
+	var berr *BroadcastError
+	require.ErrorAs(t, err, &berr)
+	assert.Len(t, berr.Failed(), 1)
+	assert.Contains(t, berr.Failed(), peers[1].RemoteAddr().String())
+	assert.Equal(t, []p2p.Node{peers[0], peers[2]}, delivered)
+
+	for _, i := range []int{0, 2} {
+		var rpc p2p.RPC
+		require.NoError(t, remote[i].SetReadDeadline(time.Now().Add(time.Second)))
+		require.NoError(t, p2p.DefaultDecoder{}.Decode(remote[i], &rpc))
+		got, err := decodeMessage(rpc.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, msg.Payload, got.Payload)
+	}
+}
+
+func TestHandshakeExchangesLabels(t *testing.T) {
+	a := makeServer(t, ":4000")
+	a.Labels = map[string]string{"zone": "eu-1", "role": "edge"}
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	for _, peer := range b.peerList() {
+		hello := peer.Hello()
+		assert.Equal(t, a.ID, hello.NodeID)
+		assert.Equal(t, a.Labels, hello.Labels)
+		assert.True(t, hello.Capabilities.Has(p2p.CapBatch))
+	}
+	for _, peer := range a.peerList() {
+		assert.Equal(t, b.ID, peer.Hello().NodeID)
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+const (
+	// defaultSkewCheckInterval is how often peers are pinged for their clock when
+	// SkewCheckInterval is not set.
+	defaultSkewCheckInterval = 30 * time.Second
+	// defaultMaxClockSkew is the clock offset past which a peer is warned about when
+	// MaxClockSkew is not set.
+	defaultMaxClockSkew = 2 * time.Second
+)
+
+// ClockSkewFunc receives the node ID of a peer whose clock is off by more than MaxClockSkew,
+// and the offset measured, positive when the peer's clock is ahead.
+type ClockSkewFunc func(nodeID string, offset time.Duration)
+
+// MessagePing carries the sender's wall time to a peer, which answers with a MessagePong so
+// the sender can estimate how far the peer's clock is off its own.
+type MessagePing struct {
+	SentAt int64 // Wall time of the sender, in Unix nanoseconds
+}
+
+// MessagePong answers a MessagePing.
+type MessagePong struct {
+	SentAt     int64 // SentAt of the ping, echoed
+	ReceivedAt int64 // Wall time of the answering node when the ping arrived, in Unix nanoseconds
+}
+
+// clockOffset is the latest estimate of a peer's clock offset.
+type clockOffset struct {
+	offset time.Duration // How far the peer's clock is ahead of this node's, negative when behind
+	skewed bool          // Whether the offset is past MaxClockSkew
+}
+
+// skewTable holds the clock offsets measured for peers, by node ID.
+type skewTable struct {
+	mu    sync.Mutex
+	peers map[string]clockOffset
+}
+
+// get returns the clock offset measured for a peer.
+func (t *skewTable) get(id string) (clockOffset, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.peers[id]
+	return o, ok
+}
+
+// set records the clock offset measured for a peer.
+//
+// Returns: The estimate it replaced, and whether there was one.
+func (t *skewTable) set(id string, o clockOffset) (clockOffset, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.peers == nil {
+		t.peers = make(map[string]clockOffset)
+	}
+	was, ok := t.peers[id]
+	t.peers[id] = o
+	return was, ok
+}
+
+// skewCheckInterval returns how often peers are pinged for their clock, negative when the
+// checks are disabled.
+func (s *FileServer) skewCheckInterval() time.Duration {
+	if s.SkewCheckInterval == 0 {
+		return defaultSkewCheckInterval
+	}
+	return s.SkewCheckInterval
+}
+
+// maxClockSkew returns the clock offset past which a peer is warned about, negative when
+// skew is never warned about.
+func (s *FileServer) maxClockSkew() time.Duration {
+	if s.MaxClockSkew == 0 {
+		return defaultMaxClockSkew
+	}
+	return s.MaxClockSkew
+}
+
+// skewLoop pings every peer for its clock each SkewCheckInterval until the server is stopped.
+func (s *FileServer) skewLoop() {
+	ticker := s.Clock.NewTicker(s.skewCheckInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			s.pingPeers(s.peerList())
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// pingPeers sends a MessagePing to those of peers that measure clock offsets. Their answers
+// are handled by handleMessagePong.
+func (s *FileServer) pingPeers(peers []p2p.Node) {
+	if s.skewCheckInterval() < 0 {
+		return
+	}
+	peers, _ = s.peersWith(peers, func(caps peerCaps) bool { return caps.clock })
+	if len(peers) == 0 {
+		return
+	}
+	msg := &Message{Payload: MessagePing{SentAt: s.Clock.Now().UnixNano()}}
+	if _, err := s.sendMessage(peers, msg); err != nil {
+		log.Printf("[%s] pinging peers for their clock: %s", s.Transport.Addr(), err)
+	}
+}
+
+// handleMessagePing answers a ping with this node's wall time.
+func (s *FileServer) handleMessagePing(from string, msg MessagePing) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	pong := MessagePong{SentAt: msg.SentAt, ReceivedAt: s.Clock.Now().UnixNano()}
+	_, err := s.sendMessage([]p2p.Node{peer}, &Message{Payload: pong})
+	return err
+}
+
+// handleMessagePong estimates a peer's clock offset from its answer to a ping, taking the
+// peer to have read its clock halfway through the round trip. A peer whose offset moves past
+// MaxClockSkew is logged, counted and passed to OnClockSkew; one coming back within it is
+// logged.
+func (s *FileServer) handleMessagePong(from string, msg MessagePong) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	rtt := time.Duration(s.Clock.Now().UnixNano() - msg.SentAt)
+	if rtt < 0 {
+		return fmt.Errorf("pong from (%s) answers a ping from the future", from)
+	}
+	offset := time.Duration(msg.ReceivedAt-msg.SentAt) - rtt/2
+	limit := s.maxClockSkew()
+	skewed := limit >= 0 && offset.Abs() > limit
+	id := peerPlacementNode(peer).id
+	was, _ := s.skew.set(id, clockOffset{offset: offset, skewed: skewed})
+	switch {
+	case skewed && !was.skewed:
+		s.metrics.clockSkewed.Add(1)
+		log.Printf("[%s] clock of peer (%s) is off by %s, more than the %s tolerated", s.Transport.Addr(), from, offset.Round(time.Millisecond), limit)
+		if s.OnClockSkew != nil {
+			s.OnClockSkew(id, offset)
+		}
+	case !skewed && was.skewed:
+		log.Printf("[%s] clock of peer (%s) is back within %s", s.Transport.Addr(), from, limit)
+	}
+	return nil
+}
+
+// untrustedClock reports whether a peer's clock is off by more than ExcludeClockSkew, so the
+// write times it reports are not compared with other nodes'.
+func (s *FileServer) untrustedClock(peer p2p.Node) bool {
+	if s.ExcludeClockSkew <= 0 {
+		return false
+	}
+	o, ok := s.skew.get(peerPlacementNode(peer).id)
+	return ok && o.offset.Abs() > s.ExcludeClockSkew
+}
+
+// arbitrationStamp returns the stamp a peer's copy is compared with others by in read repair.
+// The write time of a copy held by a peer whose clock cannot be trusted is left out, so the
+// copy only wins by its version.
+func (s *FileServer) arbitrationStamp(peer p2p.Node, stamp objectStamp) objectStamp {
+	if s.untrustedClock(peer) {
+		stamp.ModTime = 0
+	}
+	return stamp
+}
+
+// describeClock fills in the clock offset measured for the peer a NodeInfo describes.
+func (s *FileServer) describeClock(info *NodeInfo, peer p2p.Node) {
+	o, ok := s.skew.get(peerPlacementNode(peer).id)
+	if !ok {
+		return
+	}
+	info.ClockOffset = &o.offset
+	info.ClockSkewed = o.skewed
+	info.ClockUntrusted = s.untrustedClock(peer)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// offsetClock is the real clock with its wall time moved by offset.
+type offsetClock struct {
+	clock.Real
+	offset time.Duration
+}
+
+func (c offsetClock) Now() time.Time { return time.Now().Add(c.offset) }
+
+func TestClockSkewDetected(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	skewed := offsetClock{offset: 10 * time.Minute}
+	b.Clock, b.Storage.Clock = skewed, skewed
+	a.ExcludeClockSkew = time.Minute
+	var (
+		mu      sync.Mutex
+		warned  []string
+		offsets []time.Duration
+	)
+	a.OnClockSkew = func(nodeID string, offset time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		warned = append(warned, nodeID)
+		offsets = append(offsets, offset)
+	}
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	// b is pinged on connecting, and found to be ahead; c is not warned about.
+	waitFor(t, func() bool { return a.Metrics()["clock_skew_warnings"] == 1 })
+	mu.Lock()
+	require.Equal(t, []string{b.ID}, warned)
+	assert.InDelta(t, float64(10*time.Minute), float64(offsets[0]), float64(time.Second))
+	mu.Unlock()
+
+	info := a.ClusterInfo()
+	var sawB, sawC bool
+	for _, node := range info {
+		switch node.ID {
+		case b.ID:
+			sawB = true
+			require.NotNil(t, node.ClockOffset)
+			assert.InDelta(t, float64(10*time.Minute), float64(*node.ClockOffset), float64(time.Second))
+			assert.True(t, node.ClockSkewed)
+			assert.True(t, node.ClockUntrusted)
+		case c.ID:
+			sawC = true
+			waitFor(t, func() bool {
+				_, ok := a.skew.get(c.ID)
+				return ok
+			})
+			o, _ := a.skew.get(c.ID)
+			assert.False(t, o.skewed)
+		}
+	}
+	assert.True(t, sawB && sawC)
+
+	// Checking again does not warn about b twice.
+	a.pingPeers(a.peerList())
+	settle(t, a, b)
+	settle(t, b, a)
+	assert.Equal(t, int64(1), a.Metrics()["clock_skew_warnings"])
+}
+
+func TestSkewedPeerLeftOutOfReadRepair(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	c := makeMemoryServer(t, network, ":4002", ":4000")
+	skewed := offsetClock{offset: 10 * time.Minute}
+	b.Clock, b.Storage.Clock = skewed, skewed
+	a.ExcludeClockSkew = time.Minute
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+	waitFor(t, func() bool { return a.Metrics()["clock_skew_warnings"] == 1 })
+
+	const key = "report"
+	hashedKey := crypto.HashKey(key)
+	rep, err := a.prepareReplica(key, bytes.NewReader([]byte("first draft")))
+	require.NoError(t, err)
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("final version"))))
+	waitFor(t, func() bool { return replicaCount(a, key, b, c) == 2 })
+	current, err := c.Storage.Metadata(a.ID, hashedKey)
+	require.NoError(t, err)
+
+	// b writes the first draft back with its clock ten minutes ahead, so by write time its
+	// copy looks the newest; a, which has lost its copy, must not believe it.
+	_, err = b.Storage.Write(a.ID, hashedKey, bytes.NewReader(rep.data))
+	require.NoError(t, err)
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	got, err := a.Get(key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(got)
+	require.NoError(t, err)
+
+	waitFor(t, func() bool {
+		meta, err := b.Storage.Metadata(a.ID, hashedKey)
+		return err == nil && meta.Checksum == current.Checksum
+	})
+	waitFor(t, func() bool {
+		_, r, err := a.Storage.Read(a.ID, key)
+		if err != nil {
+			return false
+		}
+		defer r.(io.Closer).Close()
+		data, err := io.ReadAll(r)
+		return err == nil && string(data) == "final version"
+	})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+const (
+	// snapshotManifestName is the file of a snapshot describing it, written last so a snapshot
+	// without one is known to be incomplete.
+	snapshotManifestName = "manifest.json"
+	// snapshotStoreDir is the directory of a snapshot holding the captured storage root.
+	snapshotStoreDir = "store"
+)
+
+// snapshotStateFiles are the files in the storage root holding the state of the node besides
+// its objects, captured with them.
+var snapshotStateFiles = []string{
+	aliasFileName,
+	pinFileName,
+	tombstoneFileName,
+	keystoreFileName,
+	notifyFileName,
+	pendingFileName,
+	reliableFileName,
+	banFileName,
+	auditLogFileName,
+}
+
+// SnapshotManifest describes a snapshot taken with Snapshot.
+type SnapshotManifest struct {
+	Node    string                  `json:"node"`            // ID of the node snapshotted, which a node restored from it must run as
+	Time    time.Time               `json:"time"`            // When the keys captured were indexed
+	Seq     uint64                  `json:"seq"`             // Changes made to the indexed keys before the snapshot
+	Objects []storage.SnapshotEntry `json:"objects"`         // Objects captured, with the checksums they matched, by owner and key
+	State   []string                `json:"state,omitempty"` // Files of the node's state captured with the objects
+	Elapsed time.Duration           `json:"elapsed"`         // How long the snapshot took
+}
+
+// Snapshot backs the node up into dir while it keeps serving reads and writes. The keys of
+// every owner indexed when it starts are captured, each object checked against its checksum
+// as it is, with storage.Store.Snapshot: hard-linked, unless SnapshotCopy is set or the
+// objects cannot be linked, so a snapshot costs little space until the objects change. The
+// node's aliases, pins, tombstones, keys and other state are copied with them, and a manifest
+// listing every object and its checksum is written last. RestoreSnapshot makes a store of the
+// snapshot to start the node again from.
+//
+// Objects written while the snapshot runs are captured as they were when their turn came, and
+// keys written after it started are left out, as are version histories and the trash.
+//
+// Parameters:
+//   - dir: Directory to write the snapshot to, which must be empty or not exist.
+//
+// Returns: The manifest of the snapshot, and any errors.
+func (s *FileServer) Snapshot(dir string) (SnapshotManifest, error) {
+	start := time.Now()
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return SnapshotManifest{}, fmt.Errorf("snapshot directory %s is not empty", dir)
+	}
+	storeDir := filepath.Join(dir, snapshotStoreDir)
+	snap, objects, err := s.Storage.Snapshot(storeDir, !s.SnapshotCopy)
+	if err != nil {
+		return SnapshotManifest{}, err
+	}
+	manifest := SnapshotManifest{Node: s.ID, Time: snap.Time, Seq: snap.Seq, Objects: objects}
+	for _, name := range snapshotStateFiles {
+		b, err := os.ReadFile(filepath.Join(s.Storage.Root, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = os.WriteFile(filepath.Join(storeDir, name), b, 0o644)
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("snapshot of %s: %w", name, err)
+		}
+		manifest.State = append(manifest.State, name)
+	}
+	manifest.Elapsed = time.Since(start)
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, snapshotManifestName), b, 0o644); err != nil {
+		return manifest, err
+	}
+	log.Printf("[%s] snapshot of %d objects written to %s in %s", s.Transport.Addr(), len(objects), dir, manifest.Elapsed.Round(time.Millisecond))
+	return manifest, nil
+}
+
+// RestoreSnapshot makes a storage root of a snapshot taken with Snapshot, for a node to start
+// on. The node must run with the ID the manifest names, and the encryption key of the node
+// snapshotted to read the replicas it held for peers. Files are hard-linked from the snapshot
+// where the filesystem allows it, which the restored store copies before changing in place,
+// and copied otherwise. The node itself checks the content of its objects as it runs.
+//
+// Parameters:
+//   - dir: Directory of the snapshot.
+//   - storageRoot: Storage root to restore into, which must be empty or not exist.
+//
+// Returns: The manifest of the snapshot, and an error if the snapshot is incomplete, the root
+// is in use or an object of the manifest is missing once restored.
+func RestoreSnapshot(dir string, storageRoot string) (SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	b, err := os.ReadFile(filepath.Join(dir, snapshotManifestName))
+	if err != nil {
+		return manifest, fmt.Errorf("%s holds no complete snapshot: %w", dir, err)
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, fmt.Errorf("reading the manifest of %s: %w", dir, err)
+	}
+	if _, err := storage.CopyTree(filepath.Join(dir, snapshotStoreDir), storageRoot, true); err != nil {
+		return manifest, err
+	}
+	for _, o := range manifest.Objects {
+		if _, err := os.Stat(filepath.Join(storageRoot, filepath.FromSlash(o.Path))); err != nil {
+			return manifest, fmt.Errorf("restoring (%s) of %s: %w", o.Key, o.Owner, err)
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checksumOf returns the hex-encoded SHA-256 of the content read from r.
+func checksumOf(t *testing.T, r io.Reader) string {
+	t.Helper()
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	require.NoError(t, err)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestSnapshotDuringWritesRestores(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	for i := range 20 {
+		require.NoError(t, a.Store(fmt.Sprintf("settled/%d", i), bytes.NewReader(randomData(t, 4<<10))))
+		require.NoError(t, b.Store(fmt.Sprintf("peer/%d", i), bytes.NewReader(randomData(t, 4<<10))))
+	}
+	require.NoError(t, a.Link("settled/latest", "settled/0"))
+	waitFor(t, func() bool { keys, _ := a.Storage.Keys(b.ID); return len(keys) == 20 })
+
+	// Writers keep storing, overwriting and appending while the snapshot is taken.
+	var (
+		stop   atomic.Bool
+		writes atomic.Int64
+		wg     sync.WaitGroup
+	)
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				key := fmt.Sprintf("busy/%d-%d", w, i%10)
+				var err error
+				if i%3 == 2 {
+					_, err = a.Append(key, bytes.NewReader(randomData(t, 1<<10)))
+				} else {
+					err = a.Store(key, bytes.NewReader(randomData(t, 16<<10)))
+				}
+				assert.NoError(t, err)
+				writes.Add(1)
+			}
+		}()
+	}
+	waitFor(t, func() bool { return writes.Load() >= 20 })
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	before := writes.Load()
+	manifest, err := a.Snapshot(dir)
+	during := writes.Load() - before
+	stop.Store(true)
+	wg.Wait()
+	require.NoError(t, err)
+	t.Logf("%d writes while the snapshot was taken", during)
+
+	assert.Equal(t, a.ID, manifest.Node)
+	assert.Contains(t, manifest.State, aliasFileName)
+	owners := map[string]int{}
+	for _, o := range manifest.Objects {
+		owners[o.Owner]++
+	}
+	assert.GreaterOrEqual(t, owners[a.ID], 21, "the settled keys and some being written")
+	assert.Equal(t, 20, owners[b.ID], "the replicas of the peer")
+	_, err = a.Snapshot(dir)
+	assert.Error(t, err, "a snapshot into a directory in use")
+
+	// A node started on the restored store, as the node snapshotted, reads back every object.
+	root := filepath.Join(t.TempDir(), "restored")
+	restoredManifest, err := RestoreSnapshot(dir, root)
+	require.NoError(t, err)
+	assert.Equal(t, len(manifest.Objects), len(restoredManifest.Objects))
+	network = p2p.NewMemoryNetwork(1)
+	tr := network.Transport(p2p.TCPTransportOpts{ListenAddr: ":4000", HandshakeFunc: p2p.NOPHandshakeFunc, Decoder: p2p.DefaultDecoder{}})
+	c := NewFileServer(FileServerOpts{
+		ID:                manifest.Node,
+		EncKey:            a.EncKey,
+		StorageRoot:       root,
+		PathTransformFunc: storage.CASPathTransformFuncSHA256,
+		Transport:         tr,
+	})
+	tr.HandshakeFunc, tr.OnNode, tr.OnNodeClosed = c.Handshake, c.OnNode, c.OnNodeClosed
+	d := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, c, d)
+
+	for _, o := range manifest.Objects {
+		_, r, err := c.Storage.Read(o.Owner, o.Key)
+		require.NoError(t, err, o.Key)
+		assert.Equal(t, o.Checksum, checksumOf(t, r), "object (%s) of %s", o.Key, o.Owner)
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+		if o.Owner == c.ID {
+			r, err := c.Get(o.Key)
+			require.NoError(t, err, o.Key)
+			assert.Equal(t, o.Checksum, checksumOf(t, r), "get of (%s)", o.Key)
+		}
+	}
+	target, ok := c.aliases.target("settled/latest")
+	assert.True(t, ok)
+	assert.Equal(t, "settled/0", target)
+}
+
+func TestRestoreSnapshotRefusesIncompleteSnapshotAndRootInUse(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	a.SnapshotCopy = true
+	startCluster(t, a, b)
+	require.NoError(t, a.Store("report", bytes.NewReader([]byte("quarterly numbers"))))
+
+	_, err := RestoreSnapshot(t.TempDir(), filepath.Join(t.TempDir(), "restored"))
+	assert.ErrorContains(t, err, "no complete snapshot")
+
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	manifest, err := a.Snapshot(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, manifest.Objects)
+	for _, o := range manifest.Objects {
+		assert.False(t, o.Linked, "objects are copied with SnapshotCopy")
+	}
+	_, err = RestoreSnapshot(dir, a.Storage.Root)
+	assert.ErrorContains(t, err, "not empty")
+}
@@ -0,0 +1,117 @@
+//go:build soak
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	soakIterations = flag.Int("soak.iterations", 300, "store, get and delete rounds run by the soak test")
+	soakSeed       = flag.Int64("soak.seed", 1, "seed of the faults injected and the workload of the soak test")
+)
+
+// TestSoakChaos runs a store, get and delete workload on a five node cluster whose nodes
+// inject faults, then checks that every write acknowledged as durable survived. Run it with
+//
+//	go test -tags soak -run TestSoakChaos -soak.iterations 1000 ./server
+func TestSoakChaos(t *testing.T) {
+	t.Setenv(chaosEnv, "1")
+	const nodes, minReplicas = 5, 2
+	network := p2p.NewMemoryNetwork(*soakSeed)
+	servers := make([]*FileServer, nodes)
+	addrs := make([]string, nodes)
+	for i := range servers {
+		addrs[i] = fmt.Sprintf(":%d", 4000+i)
+		servers[i] = makeMemoryServer(t, network, addrs[i], addrs[:i]...)
+		servers[i].AckRetryInterval = 200 * time.Millisecond
+		servers[i].Chaos = &ChaosConfig{
+			Seed:            *soakSeed + int64(i)*100,
+			HandlerDelay:    0.05,
+			MaxHandlerDelay: 20 * time.Millisecond,
+			DropControl:     0.05,
+			DiskFull:        0.02,
+			Disconnect:      0.1,
+			Interval:        200 * time.Millisecond,
+		}
+	}
+	startCluster(t, servers...)
+
+	type write struct {
+		owner *FileServer
+		data  []byte
+	}
+	acknowledged := make(map[string]write)
+	rng := rand.New(rand.NewSource(*soakSeed))
+	for i := range *soakIterations {
+		owner := servers[rng.Intn(nodes)]
+		key := fmt.Sprintf("soak/%05d", i)
+		data := make([]byte, 1+rng.Intn(64<<10))
+		rng.Read(data)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := owner.StoreDurable(ctx, key, bytes.NewReader(data), minReplicas)
+		cancel()
+		if err == nil {
+			acknowledged[key] = write{owner: owner, data: data}
+		} else {
+			t.Logf("store %s on %s not acknowledged: %s", key, owner.Transport.Addr(), err)
+		}
+
+		// Every few rounds an earlier object is read back or deleted.
+		for key, w := range acknowledged {
+			switch rng.Intn(3) {
+			case 0:
+				r, err := w.owner.Get(key)
+				require.NoError(t, err, "reading %s", key)
+				got, err := io.ReadAll(r)
+				require.NoError(t, err, "reading %s", key)
+				require.Equal(t, w.data, got, "content of %s", key)
+			case 1:
+				if err := w.owner.Delete(key); err == nil {
+					delete(acknowledged, key)
+				}
+			}
+			break
+		}
+	}
+
+	// With the faults stopped and the cluster reconnected, every acknowledged write is held by
+	// its owner and at least minReplicas peers.
+	for _, s := range servers {
+		s.chaos.pause()
+	}
+	for _, s := range servers {
+		waitFor(t, func() bool { return len(s.peerList()) == nodes-1 })
+	}
+	for key, w := range acknowledged {
+		var holders []*FileServer
+		for _, s := range servers {
+			if s != w.owner {
+				holders = append(holders, s)
+			}
+		}
+		require.GreaterOrEqual(t, replicaCount(w.owner, key, holders...), minReplicas, "replicas of %s", key)
+		r, err := w.owner.Get(key)
+		require.NoError(t, err, "reading %s", key)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err, "reading %s", key)
+		require.Equal(t, w.data, got, "content of %s", key)
+	}
+	var injected int64
+	for _, s := range servers {
+		m := s.Metrics()
+		injected += m["chaos_handler_delays"] + m["chaos_frames_dropped"] + m["chaos_disk_full"] + m["chaos_disconnects"]
+	}
+	require.Positive(t, injected, "no faults were injected")
+	t.Logf("%d of %d writes acknowledged and kept, %d faults injected", len(acknowledged), *soakIterations, injected)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// Kinds of FetchSource.
+const (
+	SourceLocal  = "local"  // Read from this node's disk
+	SourceCache  = "cache"  // Read from the object cache
+	SourceRemote = "remote" // Fetched from peers into local storage
+)
+
+// FetchSource describes where a Get was served from.
+type FetchSource struct {
+	Kind    string        `json:"kind"`              // One of the Source constants
+	PeerID  string        `json:"peer_id,omitempty"` // Node ID of the peer that sent the object, comma-separated when several sent chunks of it
+	Addr    string        `json:"addr,omitempty"`    // Address of the peer that sent the object, likewise
+	Latency time.Duration `json:"latency,omitempty"` // Time from asking the peers until the object was stored locally
+	Bytes   int64         `json:"bytes,omitempty"`   // Encrypted bytes received over the network
+}
+
+// remoteSource describes a fetch from peers that took latency.
+func remoteSource(peers []p2p.Node, latency time.Duration, bytes int64) FetchSource {
+	ids := make([]string, 0, len(peers))
+	addrs := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		ids = append(ids, peer.Hello().NodeID)
+		addrs = append(addrs, peer.RemoteAddr().String())
+	}
+	return FetchSource{
+		Kind:    SourceRemote,
+		PeerID:  strings.Join(ids, ","),
+		Addr:    strings.Join(addrs, ","),
+		Latency: latency,
+		Bytes:   bytes,
+	}
+}
+
+// serveFetched serves an object just fetched from peers for request rid out of local storage,
+// describing where it came from. The fetch is published as a NotifyFetch event and, with
+// AuditFetches set, recorded in the audit log.
+func (s *FileServer) serveFetched(rid string, key string, src FetchSource) (ObjectInfo, io.ReadCloser, error) {
+	info, r, err := s.readLocal(rid, key)
+	if err != nil {
+		return info, r, err
+	}
+	info.Peer, info.Source = src.Addr, src
+	s.publishEvent(NotifyEvent{Op: NotifyFetch, Key: key, Source: &src, RequestID: rid})
+	if s.AuditFetches {
+		if err := s.audit(auditEntry{Op: "fetch", Owner: s.ID, Key: key, Source: &src, RequestID: rid}); err != nil {
+			s.logf(rid, "recording the fetch of (%s) in the audit log: %s", key, err)
+		}
+	}
+	return info, r, nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchSource(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	a.cache = newObjectCache(1<<20, 1<<20)
+	a.Storage.OnChange = a.cache.invalidate
+	a.AuditFetches = true
+	var events eventRecorder
+	b.OnNotify = events.record
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+	require.NoError(t, b.Watch(":4000"))
+
+	get := func(key string) ObjectInfo {
+		t.Helper()
+		info, r, err := a.GetWithInfo(key)
+		require.NoError(t, err)
+		_, err = io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		return info
+	}
+
+	const key = "invoices/march"
+	content := []byte("amount due")
+	require.NoError(t, a.Store(key, bytes.NewReader(content)))
+	assert.Equal(t, FetchSource{Kind: SourceLocal}, get(key).Source)
+	assert.Equal(t, FetchSource{Kind: SourceCache}, get(key).Source)
+
+	// Once the local copy is gone the object comes from b.
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	})
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	info := get(key)
+	src := info.Source
+	assert.Equal(t, SourceRemote, src.Kind)
+	assert.Equal(t, b.ID, src.PeerID)
+	assert.Equal(t, info.Peer, src.Addr)
+	assert.Greater(t, src.Bytes, int64(len(content)), "the encrypted copy carries its IV")
+	assert.Positive(t, src.Latency)
+
+	// The fetch is published to subscribers and recorded in the audit log.
+	waitFor(t, func() bool {
+		events.mu.Lock()
+		defer events.mu.Unlock()
+		for _, ev := range events.events {
+			if ev.Op == NotifyFetch && ev.Source != nil && ev.Source.PeerID == b.ID {
+				return true
+			}
+		}
+		return false
+	})
+	log, err := os.ReadFile(filepath.Join(a.Storage.Root, auditLogFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(log), `"op":"fetch"`)
+	assert.Contains(t, string(log), b.ID)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+// sendBufSize is the size of the buffers replicas are streamed from files through.
+const sendBufSize = 64 << 10
+
+// sendBufs pools the buffers replicas are streamed from files through.
+var sendBufs = sync.Pool{New: func() any {
+	b := make([]byte, sendBufSize)
+	return &b
+}}
+
+// StoreFile stores a file already on disk like Store, without reading it into memory: its
+// size is taken from the file, its content is copied into local storage, or hard-linked there
+// when LinkInsteadOfCopy is set and the file is on the storage root's filesystem, and the
+// replica sent to peers is encrypted into a temporary file and streamed from it. A linked file
+// must not be modified afterwards. The file is read from its start whatever its offset, and is
+// not closed.
+//
+// Returns: Any errors, as for Store.
+func (s *FileServer) StoreFile(key string, f *os.File) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("storing (%s): %s is not a regular file", key, f.Name())
+	}
+	size := fi.Size()
+	t := s.transfers.start(context.Background(), s.NewRequestID(), "store", key, TransferOpts{})
+	defer s.transfers.done(t)
+	t.phase(TransferRead, "", size)
+	if held, err := s.checkWritable(key, io.NewSectionReader(f, 0, size)); held || err != nil {
+		return err
+	}
+	peers := s.placement(key, s.peerList())
+	var version uint64
+	if s.versioned(key) {
+		written, err := s.Storage.WriteNextVersion(s.ID, key, io.NewSectionReader(f, 0, size))
+		if err != nil {
+			return err
+		}
+		version = written.Version
+	} else if _, err := s.Storage.WriteFile(s.ID, key, f, s.LinkInsteadOfCopy); err != nil {
+		if noSpace(err) {
+			s.diskFull(err)
+			return fmt.Errorf("storing (%s): %w", key, errors.Join(ErrNoSpace, err))
+		}
+		return err
+	}
+	head, err := sniffFile(f)
+	if err != nil {
+		return err
+	}
+	if err := s.recordContentType(key, "", head); err != nil {
+		return err
+	}
+	s.objectStored(objectRef{owner: s.ID, key: crypto.HashKey(key)})
+	s.publish(NotifyStore, key)
+
+	rep, err := s.prepareFileReplica(key, size)
+	if err != nil {
+		return err
+	}
+	if rep.file != nil {
+		defer func() {
+			rep.file.Close()
+			os.Remove(rep.file.Name())
+		}()
+	}
+	rep.version = version
+	s.deferReplication(key)
+	_, err = s.replicateTransfer(t, peers, rep)
+	if version > 0 {
+		s.pruneVersions(key)
+	}
+	if err != nil {
+		s.deferFailed(err, peers, key)
+	}
+	return err
+}
+
+// StoreFilePath stores the file at path like StoreFile.
+func (s *FileServer) StoreFilePath(key string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return errors.Join(s.StoreFile(key, f), f.Close())
+}
+
+// prepareFileReplica encrypts the local copy of key for replication like prepareReplica. Objects
+// small enough to be sent inline are encrypted in memory; larger ones into a temporary file in
+// the storage root, which the caller must close and remove.
+func (s *FileServer) prepareFileReplica(key string, size int64) (replica, error) {
+	_, r, err := s.Storage.Read(s.ID, key)
+	if err != nil {
+		return replica{}, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if size <= int64(s.inlineThreshold()) {
+		return s.prepareReplica(key, r)
+	}
+	tmp, err := s.Storage.CreateTemp()
+	if err != nil {
+		return replica{}, err
+	}
+	h, plainHash := sha256.New(), sha256.New()
+	n, err := crypto.CopyEncrypt(s.dataKey(key), io.TeeReader(r, plainHash), io.MultiWriter(tmp, h))
+	if err != nil {
+		return replica{}, errors.Join(err, tmp.Close(), os.Remove(tmp.Name()))
+	}
+	return replica{
+		id:        s.ID,
+		key:       crypto.HashKey(key),
+		file:      tmp,
+		fileSize:  int64(n),
+		checksum:  hex.EncodeToString(h.Sum(nil)),
+		immutable: s.immutable(s.ID, key),
+		plainSum:  hex.EncodeToString(plainHash.Sum(nil)),
+		namespace: keyNamespace(key),
+	}, nil
+}
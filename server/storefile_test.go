@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreFile(t *testing.T) {
+	a := makeServer(t, ":4000")
+	a.LinkInsteadOfCopy = true
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	content := bytes.Repeat([]byte("large file "), 50000)
+	path := filepath.Join(t.TempDir(), "upload.bin")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+
+	const key = "uploads/large.bin"
+	require.NoError(t, a.StoreFilePath(key, path))
+	source, err := os.Stat(path)
+	require.NoError(t, err)
+	size, r, err := a.Storage.Read(a.ID, key)
+	require.NoError(t, err)
+	stored, err := r.(*os.File).Stat()
+	require.NoError(t, r.(io.Closer).Close())
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.True(t, os.SameFile(source, stored), "the object is a hard link to the file")
+
+	// b holds an encrypted replica a can be served from.
+	hashedKey := crypto.HashKey(key)
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, hashedKey)
+		return ok
+	})
+	require.NoError(t, b.Storage.Verify(a.ID, hashedKey))
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	rc, err := a.Get(key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// No temporary file is left behind.
+	temps, err := filepath.Glob(filepath.Join(a.Storage.Root, "*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, temps)
+}
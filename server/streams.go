@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// openStream starts the stream following a message to peer, which the peer's handler for
+// the message reads with AcceptStream. Streams to peers supporting multiplexing share the
+// connection with other traffic; to other peers the stream is written to the connection
+// after a stream marker, and nothing else may be sent to the peer until it is closed.
+// Closing the stream sends whatever is still buffered.
+func (s *FileServer) openStream(peer p2p.Node) (io.WriteCloser, error) {
+	if s.capsOf(peer).mux {
+		w := peer.OpenStream()
+		return &muxedStream{Writer: bufio.NewWriterSize(w, muxBufferSize), w: w}, nil
+	}
+	// The marker is buffered and sent with the stream's first bytes.
+	if _, err := peer.Write([]byte{p2p.IncomingStream}); err != nil {
+		return nil, err
+	}
+	return connStream{peer: peer}, nil
+}
+
+// openAnswer starts the stream answering q from peer. Peers supporting CapReplies claim it
+// by the ID of the request, however many other answers they are sent meanwhile; other peers
+// take it as the next stream, matching answers to their requests by order.
+func (s *FileServer) openAnswer(peer p2p.Node, q query) (io.WriteCloser, error) {
+	if q.reply != 0 && s.capsOf(peer).replies {
+		w := peer.OpenReply(q.reply)
+		return &muxedStream{Writer: bufio.NewWriterSize(w, muxBufferSize), w: w}, nil
+	}
+	return s.openStream(peer)
+}
+
+// errAnswerAbandoned is the error of an answer its requester stopped waiting for.
+var errAnswerAbandoned = errors.New("answer abandoned")
+
+// awaitAnswer waits for the stream answering the request id sent to peer. Peers supporting
+// CapReplies send it routed to id; other peers answer in the order they were asked, so the
+// caller must hold fetchTurn and the next stream is the answer.
+//
+// Returns: The stream, or nil if abandoned is closed before it arrives. A peer answering by
+// order is then disconnected, so its late answer cannot be taken for the next request's.
+func (s *FileServer) awaitAnswer(peer p2p.Node, id uint64, abandoned <-chan struct{}) io.ReadCloser {
+	if s.capsOf(peer).replies {
+		return peer.AwaitReply(id, abandoned)
+	}
+	accepted := make(chan io.ReadCloser, 1)
+	go func() { accepted <- peer.AcceptStream() }()
+	select {
+	case stream := <-accepted:
+		return stream
+	case <-abandoned:
+		log.Printf("[%s] dropping (%s), which did not answer in time", s.Transport.Addr(), peer.RemoteAddr())
+		peer.Close()
+		(<-accepted).Close()
+		return nil
+	}
+}
+
+// sendAnswer sends b as the stream answering q from peer.
+func (s *FileServer) sendAnswer(peer p2p.Node, q query, b []byte) error {
+	stream, err := s.openAnswer(peer, q)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(b)
+	return errors.Join(err, stream.Close())
+}
+
+// sendStream sends b as the stream following a message to peer.
+func (s *FileServer) sendStream(peer p2p.Node, b []byte) error {
+	stream, err := s.openStream(peer)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(b)
+	return errors.Join(err, stream.Close())
+}
+
+// muxBufferSize is the size of the buffer collecting small writes to a multiplexed stream,
+// so a header and the bytes after it do not each take a chunk of their own.
+const muxBufferSize = 32 << 10
+
+// muxedStream buffers the writes to a multiplexed stream.
+type muxedStream struct {
+	*bufio.Writer
+	w io.WriteCloser // The stream
+}
+
+// Close sends the buffered bytes and ends the stream.
+func (m *muxedStream) Close() error {
+	return errors.Join(m.Flush(), m.w.Close())
+}
+
+// connStream is a stream written to the connection itself, after a stream marker.
+type connStream struct {
+	peer p2p.Node
+}
+
+// Write writes to the connection, which may buffer the bytes until the stream is closed.
+func (c connStream) Write(b []byte) (int, error) {
+	return c.peer.Write(b)
+}
+
+// ReadFrom copies r to the connection, handing the copy to the peer when it can take it.
+func (c connStream) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.peer, r)
+}
+
+// Close sends the buffered bytes of the stream.
+func (c connStream) Close() error {
+	return c.peer.Flush()
+}
+
+// maxAbortPadding bounds the padding sent to end a stream cut short after a stream marker;
+// past it, the connection is closed rather than filled with that many bytes.
+const maxAbortPadding = 64 << 20
+
+// sentStream counts the bytes written to a stream and keeps the error writing it failed
+// with, so a stream cut short can be aborted.
+type sentStream struct {
+	io.WriteCloser
+	n   int64 // Bytes written
+	err error // Error writing or closing the stream, nil while it works
+}
+
+// Write writes to the stream, counting the bytes written.
+func (s *sentStream) Write(b []byte) (int, error) {
+	n, err := s.WriteCloser.Write(b)
+	s.n += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// Close ends the stream.
+func (s *sentStream) Close() error {
+	err := s.WriteCloser.Close()
+	if err != nil {
+		s.err = err
+	}
+	return err
+}
+
+// abortStream ends a stream to peer that could not be sent in full, so the peer discards the
+// partial object and reads messages again. A multiplexed stream is closed early, which the peer
+// refuses as a short stream. A stream after a marker is padded with zeros to the size
+// announced, which the peer reads and refuses as its checksum does not match; if writing to
+// the connection failed, or the padding would be too long, the connection cannot be realigned
+// and is closed, for it to be opened afresh.
+func (s *FileServer) abortStream(peer p2p.Node, stream *sentStream, size int64) error {
+	s.metrics.streamsAborted.Add(1)
+	if _, ok := stream.WriteCloser.(*muxedStream); ok {
+		return stream.WriteCloser.Close()
+	}
+	left := size - stream.n
+	if stream.err == nil && left <= maxAbortPadding {
+		pad := make([]byte, min(left, 32<<10))
+		for left > 0 && stream.err == nil {
+			n, _ := stream.Write(pad[:min(left, int64(len(pad)))])
+			left -= int64(n)
+		}
+		if stream.err == nil && stream.Close() == nil {
+			return nil
+		}
+	}
+	return peer.Close()
+}
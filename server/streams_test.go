@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGetDuringLargeReplica fetches an object over a connection that is busy receiving a
+// large replica. The link is slowed so the replica takes seconds to arrive, as a 1 GB one
+// would over a real network; the object's stream is multiplexed with it rather than queued
+// behind it.
+func TestGetDuringLargeReplica(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 })
+	assert.Zero(t, b.Metrics()["peers_without_mux"])
+
+	small := randomData(t, 64<<10)
+	require.NoError(t, b.Store("small", bytes.NewReader(small)))
+	waitFor(t, func() bool {
+		ok, _ := a.Storage.Has(b.ID, crypto.HashKey("small"))
+		return ok
+	})
+	require.NoError(t, b.Storage.Delete(b.ID, "small"))
+
+	// 32 MB at 8 MB per second keep the connection from a to b busy for four seconds.
+	network.Policy.SetLink(":4000", ":4001", p2p.LinkPolicy{Bandwidth: 8 << 20})
+	large := randomData(t, 32<<20)
+	replicating := make(chan struct{})
+	stored := make(chan error, 1)
+	go func() {
+		var once bool
+		err := a.StoreContext(context.Background(), "large", bytes.NewReader(large), TransferOpts{
+			ProgressInterval: 256 << 10,
+			Progress: func(p TransferProgress) {
+				if p.Phase == TransferReplicate && p.Done >= 1<<20 && !once {
+					once = true
+					close(replicating)
+				}
+			},
+		})
+		stored <- err
+	}()
+	select {
+	case <-replicating:
+	case <-time.After(10 * time.Second):
+		t.Fatal("replication did not start")
+	}
+
+	start := time.Now()
+	r, err := b.Get("small")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, small, got)
+	assert.Less(t, time.Since(start), time.Second, "the get waited for the replica")
+	select {
+	case err := <-stored:
+		t.Fatalf("the replica finished before the get, which proves nothing: %v", err)
+	default:
+	}
+
+	require.NoError(t, <-stored)
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey("large"))
+		return ok
+	})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// syncTimeout bounds how long SyncWith waits for each answer from the peer.
+const syncTimeout = 5 * time.Second
+
+// MessageSyncTree asks a peer for part of the Merkle summary of an owner's keys.
+type MessageSyncTree struct {
+	ID       string   // Owner whose keys are compared
+	Prefixes []string // Inner nodes whose child digests, or buckets whose keys, are wanted
+}
+
+// MessageSyncKeys asks a peer for every key it holds for an owner. It is used with peers
+// that do not advertise p2p.CapSyncTree.
+type MessageSyncKeys struct {
+	ID string // Owner whose keys are listed
+}
+
+// syncResponse is the stream sent in answer to MessageSyncTree and MessageSyncKeys.
+type syncResponse struct {
+	Root     string              // Digest of the root of the responder's tree
+	Children map[string][]string // Child digests by requested inner node
+	Keys     map[string][]string // Keys by requested bucket
+	All      []string            // Every key, in answer to MessageSyncKeys
+	Err      string              // Why the request could not be answered
+}
+
+// SyncDiff lists the keys that differ between this node and a peer for one owner.
+type SyncDiff struct {
+	Pull     []string // Keys the peer holds that this node lacks
+	Push     []string // Keys this node holds that the peer lacks
+	Messages int      // Requests sent to the peer to find the difference
+}
+
+// SyncWith compares the keys held for owner id with those of the peer at addr. When the peer
+// supports it, only the branches of the Merkle summaries that differ are walked, so the
+// cost depends on the size of the difference rather than the number of keys; otherwise the
+// full key lists are exchanged.
+//
+// Parameters:
+//   - addr: Address of a connected peer, as used to key the peer list.
+//   - id: Owner whose keys are compared.
+//
+// Returns: The keys to pull from and push to the peer, and any errors.
+func (s *FileServer) SyncWith(addr string, id string) (SyncDiff, error) {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return SyncDiff{}, fmt.Errorf("peer (%s) not found", addr)
+	}
+	if !s.capsOf(peer).syncTree {
+		return s.syncKeys(peer, id)
+	}
+	return s.syncTree(peer, id)
+}
+
+// syncTree walks the differing branches of the local and remote Merkle summaries, one level
+// per request, and compares the keys of the buckets that differ.
+func (s *FileServer) syncTree(peer p2p.Node, id string) (SyncDiff, error) {
+	var diff SyncDiff
+	prefixes := []string{""}
+	for len(prefixes) > 0 {
+		resp, err := s.exchangeSync(peer, &Message{Payload: MessageSyncTree{ID: id, Prefixes: prefixes}})
+		diff.Messages++
+		if err != nil {
+			return diff, err
+		}
+		if len(prefixes) == 1 && len(prefixes[0]) == 0 {
+			root, err := s.Storage.MerkleDigest(id, "")
+			if err != nil {
+				return diff, err
+			}
+			if root == resp.Root {
+				return diff, nil
+			}
+		}
+		var next []string
+		for _, prefix := range prefixes {
+			if len(prefix) == storage.MerkleDepth {
+				local, err := s.Storage.BucketKeys(id, prefix)
+				if err != nil {
+					return diff, err
+				}
+				pull, push := diffKeys(local, resp.Keys[prefix])
+				diff.Pull, diff.Push = append(diff.Pull, pull...), append(diff.Push, push...)
+				continue
+			}
+			local, err := s.Storage.MerkleChildren(id, prefix)
+			if err != nil {
+				return diff, err
+			}
+			remote := resp.Children[prefix]
+			if len(remote) != len(local) {
+				return diff, fmt.Errorf("peer (%s) sent %d digests for %q, want %d", peer.RemoteAddr(), len(remote), prefix, len(local))
+			}
+			for i := range local {
+				if local[i] != remote[i] {
+					next = append(next, fmt.Sprintf("%s%x", prefix, i))
+				}
+			}
+		}
+		prefixes = next
+	}
+	return diff, nil
+}
+
+// syncKeys compares the full key lists of this node and the peer.
+func (s *FileServer) syncKeys(peer p2p.Node, id string) (SyncDiff, error) {
+	diff := SyncDiff{Messages: 1}
+	resp, err := s.exchangeSync(peer, &Message{Payload: MessageSyncKeys{ID: id}})
+	if err != nil {
+		return diff, err
+	}
+	local, err := s.Storage.Keys(id)
+	if err != nil {
+		return diff, err
+	}
+	diff.Pull, diff.Push = diffKeys(local, resp.All)
+	return diff, nil
+}
+
+// diffKeys returns the keys only in remote and the keys only in local.
+func diffKeys(local []string, remote []string) (pull []string, push []string) {
+	have := make(map[string]bool, len(local))
+	for _, key := range local {
+		have[key] = true
+	}
+	for _, key := range remote {
+		if !have[key] {
+			pull = append(pull, key)
+		}
+		delete(have, key)
+	}
+	for _, key := range local {
+		if have[key] {
+			push = append(push, key)
+		}
+	}
+	return pull, push
+}
+
+// exchangeSync sends a sync request to one peer and reads its answer.
+func (s *FileServer) exchangeSync(peer p2p.Node, msg *Message) (syncResponse, error) {
+	var resp syncResponse
+	if err := s.exchange(peer, msg, &resp, syncTimeout); err != nil {
+		return resp, err
+	}
+	if len(resp.Err) > 0 {
+		return resp, fmt.Errorf("peer (%s): %s", peer.RemoteAddr(), resp.Err)
+	}
+	return resp, nil
+}
+
+// sendSyncResponse answers a sync request. A request that could not be answered still gets
+// a response, carrying the error, so the requester's connection stays in sync.
+func (s *FileServer) sendSyncResponse(from string, q query, resp syncResponse, err error) error {
+	if err != nil {
+		resp = syncResponse{Err: err.Error()}
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
+
+// handleMessageSyncTree answers a MessageSyncTree with the requested part of the Merkle summary.
+func (s *FileServer) handleMessageSyncTree(from string, q query, msg MessageSyncTree) error {
+	resp, err := s.syncTreeResponse(msg)
+	return s.sendSyncResponse(from, q, resp, err)
+}
+
+// syncTreeResponse collects the root digest and, for every requested prefix, the child
+// digests of an inner node or the keys of a bucket.
+func (s *FileServer) syncTreeResponse(msg MessageSyncTree) (syncResponse, error) {
+	root, err := s.Storage.MerkleDigest(msg.ID, "")
+	if err != nil {
+		return syncResponse{}, err
+	}
+	resp := syncResponse{
+		Root:     root,
+		Children: make(map[string][]string),
+		Keys:     make(map[string][]string),
+	}
+	for _, prefix := range msg.Prefixes {
+		if len(prefix) == storage.MerkleDepth {
+			resp.Keys[prefix], err = s.Storage.BucketKeys(msg.ID, prefix)
+		} else {
+			resp.Children[prefix], err = s.Storage.MerkleChildren(msg.ID, prefix)
+		}
+		if err != nil {
+			return syncResponse{}, err
+		}
+	}
+	return resp, nil
+}
+
+// handleMessageSyncKeys answers a MessageSyncKeys with every key held for the owner.
+func (s *FileServer) handleMessageSyncKeys(from string, q query, msg MessageSyncKeys) error {
+	keys, err := s.Storage.Keys(msg.ID)
+	return s.sendSyncResponse(from, q, syncResponse{All: keys}, err)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seedKeys writes each key under owner with its own name as content.
+func seedKeys(t *testing.T, s *FileServer, owner string, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		_, err := s.Storage.Write(owner, key, bytes.NewReader([]byte(key)))
+		require.NoError(t, err)
+	}
+}
+
+func TestSyncWithReconcilesSmallDifference(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	owner := "owner"
+	shared := make([]string, 1000)
+	for i := range shared {
+		shared[i] = fmt.Sprintf("shared_%d", i)
+	}
+	seedKeys(t, a, owner, shared...)
+	seedKeys(t, b, owner, shared...)
+	seedKeys(t, a, owner, "only_a_1", "only_a_2", "only_a_3")
+	seedKeys(t, b, owner, "only_b_1", "only_b_2")
+
+	peers := b.peerList()
+	require.Len(t, peers, 1)
+	diff, err := b.SyncWith(peers[0].RemoteAddr().String(), owner)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"only_a_1", "only_a_2", "only_a_3"}, diff.Pull)
+	assert.ElementsMatch(t, []string{"only_b_1", "only_b_2"}, diff.Push)
+	assert.LessOrEqual(t, diff.Messages, 3)
+
+	// The full-list fallback used with peers lacking the capability finds the same difference.
+	full, err := b.syncKeys(peers[0], owner)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, diff.Pull, full.Pull)
+	assert.ElementsMatch(t, diff.Push, full.Push)
+
+	// Once the stores agree, a single message settles it.
+	seedKeys(t, b, owner, diff.Pull...)
+	seedKeys(t, a, owner, diff.Push...)
+	diff, err = b.SyncWith(peers[0].RemoteAddr().String(), owner)
+	require.NoError(t, err)
+	assert.Empty(t, diff.Pull)
+	assert.Empty(t, diff.Push)
+	assert.Equal(t, 1, diff.Messages)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// tombstoneFileName is the file in the storage root holding the tombstones of deleted objects.
+const tombstoneFileName = ".dfs-tombstones.json"
+
+// defaultTombstoneRetention is how long tombstones are kept when TombstoneRetention is not set.
+const defaultTombstoneRetention = 7 * 24 * time.Hour
+
+// tombstone records that an object was deleted, so mirrors that missed the delete drop their
+// copy instead of pulling it back from a peer that missed it too. A range tombstone, left by
+// DeletePrefix on the owner, covers every key starting with a prefix instead.
+type tombstone struct {
+	Owner  string    `json:"owner"`            // Identifier of the node owning the object
+	Key    string    `json:"key"`              // Hashed key of the object, or the plain prefix of a range tombstone
+	Time   time.Time `json:"time"`             // When the object was deleted
+	Prefix bool      `json:"prefix,omitempty"` // Whether this is a range tombstone
+}
+
+// objectRef names an object, or a replica, by owner and hashed key.
+type objectRef struct {
+	owner string // Identifier of the node owning the object
+	key   string // Hashed key of the object
+}
+
+// tombstoneTable is the tombstones a node knows of, kept until they are older than the
+// retention. It is persisted after every change so deletes are remembered across restarts.
+type tombstoneTable struct {
+	clock     clock.Clock // Ages the tombstones
+	mu        sync.Mutex
+	path      string                  // Location of the persisted table, empty until load is called
+	retention time.Duration           // Age past which tombstones are forgotten
+	entries   map[objectRef]time.Time // Deletion time by object
+	ranges    map[objectRef]time.Time // Deletion time of range tombstones, by owner and plain prefix
+}
+
+// newTombstoneTable returns an empty table that is not persisted until load is called.
+func newTombstoneTable(retention time.Duration, clk clock.Clock) *tombstoneTable {
+	if retention <= 0 {
+		retention = defaultTombstoneRetention
+	}
+	return &tombstoneTable{
+		clock:     clock.Or(clk),
+		retention: retention,
+		entries:   make(map[objectRef]time.Time),
+		ranges:    make(map[objectRef]time.Time),
+	}
+}
+
+// load attaches the table to path, restoring the tombstones saved there.
+func (t *tombstoneTable) load(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	var saved []tombstone
+	if err := loadJSON(path, "tombstones", &saved); err != nil {
+		return err
+	}
+	for _, ts := range saved {
+		t.addLocked(ts)
+	}
+	return nil
+}
+
+// add records a deletion, keeping the later one when the object already has a tombstone.
+func (t *tombstoneTable) add(ts tombstone) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.addLocked(ts) {
+		t.saveLocked()
+	}
+}
+
+// addAll records many deletions, persisting the table once.
+func (t *tombstoneTable) addAll(list []tombstone) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	added := false
+	for _, ts := range list {
+		added = t.addLocked(ts) || added
+	}
+	if added {
+		t.saveLocked()
+	}
+}
+
+// addLocked adds an entry unless a later one is known, and reports whether it did; the caller
+// must hold mu.
+func (t *tombstoneTable) addLocked(ts tombstone) bool {
+	ref := objectRef{owner: ts.Owner, key: ts.Key}
+	entries := t.entries
+	if ts.Prefix {
+		entries = t.ranges
+	}
+	if known, ok := entries[ref]; ok && !known.Before(ts.Time) {
+		return false
+	}
+	entries[ref] = ts.Time
+	return true
+}
+
+// clear forgets the tombstone of an object stored again.
+func (t *tombstoneTable) clear(ref objectRef) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.entries[ref]; !ok {
+		return
+	}
+	delete(t.entries, ref)
+	t.saveLocked()
+}
+
+// covers reports whether a copy of the object written at modTime predates its deletion.
+func (t *tombstoneTable) covers(ref objectRef, modTime time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deleted, ok := t.entries[ref]
+	return ok && modTime.Before(deleted)
+}
+
+// coversPrefix reports whether a range tombstone covers the plain key of one of owner's
+// objects.
+func (t *tombstoneTable) coversPrefix(owner string, key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ref := range t.ranges {
+		if ref.owner == owner && strings.HasPrefix(key, ref.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the tombstones of objects within the retention, ordered by owner and key.
+// Range tombstones are only consulted where they were left, so they are not listed.
+func (t *tombstoneTable) list() []tombstone {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneLocked(t.clock.Now())
+	list := make([]tombstone, 0, len(t.entries))
+	for ref, deleted := range t.entries {
+		list = append(list, tombstone{Owner: ref.owner, Key: ref.key, Time: deleted})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Owner != list[j].Owner {
+			return list[i].Owner < list[j].Owner
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// pruneLocked forgets the tombstones older than the retention; the caller must hold mu.
+func (t *tombstoneTable) pruneLocked(now time.Time) {
+	for _, entries := range []map[objectRef]time.Time{t.entries, t.ranges} {
+		for ref, deleted := range entries {
+			if now.Sub(deleted) > t.retention {
+				delete(entries, ref)
+			}
+		}
+	}
+}
+
+// saveLocked saves the tombstones still within the retention; the caller must hold mu.
+func (t *tombstoneTable) saveLocked() {
+	if len(t.path) == 0 {
+		return
+	}
+	t.pruneLocked(t.clock.Now())
+	saved := make([]tombstone, 0, len(t.entries)+len(t.ranges))
+	for ref, deleted := range t.entries {
+		saved = append(saved, tombstone{Owner: ref.owner, Key: ref.key, Time: deleted})
+	}
+	for ref, deleted := range t.ranges {
+		saved = append(saved, tombstone{Owner: ref.owner, Key: ref.key, Time: deleted, Prefix: true})
+	}
+	if err := saveJSON(t.path, saved, 0o644); err != nil {
+		log.Printf("persisting tombstones to %s: %s", t.path, err)
+	}
+}
+
+// loadTombstones attaches the tombstone table to its file in the storage root.
+func (s *FileServer) loadTombstones() error {
+	return s.tombstones.load(filepath.Join(s.Storage.Root, tombstoneFileName))
+}
+
+// objectDeleted records the deletion of an object, or of a replica, for mirrors. The holders
+// of a deleted object of this node are forgotten, as are the pushes of the object to peers.
+func (s *FileServer) objectDeleted(ref objectRef, deleted time.Time) {
+	s.tombstones.add(tombstone{Owner: ref.owner, Key: ref.key, Time: deleted})
+	s.pushes.forget(ref)
+	if ref.owner == s.ID {
+		s.holders.forget(ref.key)
+	}
+}
+
+// objectStored records that an object, or a replica, is held again: misses cached for it and
+// its tombstone no longer apply, and a backfill waiting for it moves on.
+func (s *FileServer) objectStored(ref objectRef) {
+	s.negCache.invalidate(negativeKey(ref.owner, ref.key))
+	s.tombstones.clear(ref)
+	s.mirror.arrived(ref)
+}
+
+// applyTombstone records a deletion learnt from a peer and drops the local replica of the
+// object if it predates the deletion. Objects this node owns are never touched, as it is the
+// authority on them.
+func (s *FileServer) applyTombstone(ts tombstone) {
+	if ts.Owner == s.ID || ts.Prefix {
+		return
+	}
+	ref := objectRef{owner: ts.Owner, key: ts.Key}
+	s.tombstones.add(ts)
+	meta, err := s.Storage.Stat(ts.Owner, ts.Key)
+	if err != nil || !s.tombstones.covers(ref, meta.ModTime) {
+		return
+	}
+	if err := s.Storage.Delete(ts.Owner, ts.Key); err != nil {
+		log.Printf("[%s] dropping deleted replica (%s): %s", s.Transport.Addr(), ts.Key, err)
+		return
+	}
+	fmt.Printf("[%s] dropped replica (%s) deleted by its owner\n", s.Transport.Addr(), ts.Key)
+}
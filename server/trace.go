@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// requestIDKey is the context key WithRequestID stores a request ID under.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx naming the request an operation started with it, such
+// as StoreContext or GetContext, belongs to, so its log lines, messages, events and errors
+// carry id rather than one the node makes up. The gateway passes the ID of each HTTP request
+// on this way.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID set on ctx with WithRequestID, or "" if none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestError is an error returned by an operation started on this node, naming the request
+// ID its log lines on every node took part in it carry, so a failure can be traced from a
+// report quoting it.
+type RequestError struct {
+	RequestID string // ID the operation was logged with
+	Err       error  // What went wrong
+}
+
+// Error returns the error followed by the request ID.
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s (request %s)", e.Err, e.RequestID)
+}
+
+// Unwrap returns the underlying error.
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// RequestIDOf returns the request ID of the operation that returned err.
+//
+// Returns: The ID, and false if err does not wrap a *RequestError.
+func RequestIDOf(err error) (string, bool) {
+	var rerr *RequestError
+	if !errors.As(err, &rerr) {
+		return "", false
+	}
+	return rerr.RequestID, true
+}
+
+// NewRequestID returns a request ID unique across the cluster and restarts of the node: the
+// first eight characters of the node's ID and a correlation ID from nextRequestID, such as
+// 3fa2c81e-1a0000002a.
+func (s *FileServer) NewRequestID() string {
+	return fmt.Sprintf("%s-%x", s.ID[:min(len(s.ID), 8)], s.nextRequestID())
+}
+
+// requestID returns the request ID ctx carries, or a new one.
+func (s *FileServer) requestID(ctx context.Context) string {
+	if id := RequestIDFromContext(ctx); len(id) > 0 {
+		return id
+	}
+	return s.NewRequestID()
+}
+
+// span returns the ID this node logs the part of request rid it handles for a peer with: rid
+// followed by a slash and the start of the node's ID, or "" for messages of peers that send
+// no request IDs.
+func (s *FileServer) span(rid string) string {
+	if len(rid) == 0 {
+		return ""
+	}
+	return rid + "/" + s.ID[:min(len(s.ID), 8)]
+}
+
+// withRequestID wraps err, if any, in a *RequestError naming rid, unless it already names one.
+func withRequestID(rid string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := RequestIDOf(err); ok {
+		return err
+	}
+	return &RequestError{RequestID: rid, Err: err}
+}
+
+// logf logs a line of request rid, or of no request if it is empty, after the address of the
+// node, so the lines every node logs for one request can be told apart from the others.
+func (s *FileServer) logf(rid string, format string, args ...any) {
+	if len(rid) == 0 {
+		log.Printf("[%s] "+format, append([]any{s.Transport.Addr()}, args...)...)
+		return
+	}
+	log.Printf("[%s] [req %s] "+format, append([]any{s.Transport.Addr(), rid}, args...)...)
+}
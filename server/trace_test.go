@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logCapture collects the lines logged while a test runs.
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// logged reports whether a line logged so far mentions word.
+func (c *logCapture) logged(word string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Contains(c.buf.String(), word)
+}
+
+// lines returns the lines logged so far that mention one of words, then forgets every line.
+func (c *logCapture) lines(words ...string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lines []string
+	for _, line := range strings.Split(c.buf.String(), "\n") {
+		for _, w := range words {
+			if strings.Contains(line, w) {
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	c.buf.Reset()
+	return lines
+}
+
+// captureLogs sends the log to a logCapture until the test ends.
+func captureLogs(t *testing.T) *logCapture {
+	c := new(logCapture)
+	log.SetOutput(c)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return c
+}
+
+// requestLines checks that every line logged by the node at addr carries the span of request
+// rid that node logs with, and returns how many there are.
+func requestLines(t *testing.T, lines []string, addr string, span string) int {
+	t.Helper()
+	n := 0
+	for _, line := range lines {
+		if strings.Contains(line, "["+addr+"]") {
+			assert.Contains(t, line, "[req "+span+"]", "line of another request")
+			n++
+		}
+	}
+	return n
+}
+
+// TestGetLogsOneRequestID fetches an object a node lacks from its peer. Every line the two
+// nodes log about it carries the request ID of the Get, with the peer's span suffix on the
+// peer, which the fetch audit record and the errors of failed gets name too.
+func TestGetLogsOneRequestID(t *testing.T) {
+	network := p2p.NewMemoryNetwork(1)
+	a := makeMemoryServer(t, network, ":4000")
+	a.AuditFetches = true
+	b := makeMemoryServer(t, network, ":4001", ":4000")
+	startCluster(t, a, b)
+	waitFor(t, func() bool { return len(a.peerList()) == 1 })
+
+	logs := captureLogs(t)
+	for _, size := range []int{100, 64 << 10} {
+		key := "reports/q3"
+		require.NoError(t, a.Store(key, bytes.NewReader(randomData(t, size))))
+		// The lines of the store are logged before those of the get are looked at.
+		waitFor(t, func() bool { return logs.logged("stored replica") })
+		logs.lines()
+		require.NoError(t, a.Storage.Delete(a.ID, key))
+
+		_, r, err := a.GetContext(WithRequestID(context.Background(), "get-1"), key, TransferOpts{})
+		require.NoError(t, err)
+		r.Close()
+		waitFor(t, func() bool { return logs.logged("[req " + b.span("get-1") + "]") })
+		lines := logs.lines(key, crypto.HashKey(key))
+		assert.NotZero(t, requestLines(t, lines, ":4000", "get-1"), "requester lines of a %d byte get", size)
+		assert.NotZero(t, requestLines(t, lines, ":4001", b.span("get-1")), "peer lines of a %d byte get", size)
+		assert.True(t, strings.HasPrefix(b.span("get-1"), "get-1/"))
+	}
+	audit, err := os.ReadFile(filepath.Join(a.Storage.Root, auditLogFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(audit), `"request_id":"get-1"`)
+
+	// A failed get names the request ID its lines were logged with.
+	_, err = a.Get("missing")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	rid, ok := RequestIDOf(err)
+	require.True(t, ok)
+	assert.Contains(t, err.Error(), "(request "+rid+")")
+	assert.True(t, strings.HasPrefix(rid, a.ID[:8]+"-"))
+	assert.NotZero(t, requestLines(t, logs.lines("missing"), ":4000", rid))
+	assert.NotEqual(t, rid, a.NewRequestID())
+}
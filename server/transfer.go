@@ -0,0 +1,371 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// defaultProgressInterval is how many bytes pass between progress callbacks when
+// TransferOpts.ProgressInterval is not set.
+const defaultProgressInterval = 64 << 10
+
+// ErrTransferNotFound is returned by CancelTransfer when no transfer with the ID is in flight.
+var ErrTransferNotFound = errors.New("transfer not found")
+
+// TransferPhase is the step a transfer is in.
+type TransferPhase uint8
+
+const (
+	TransferRead      TransferPhase = iota + 1 // Reading the content given to Store, or the caller reading a Get
+	TransferReplicate                          // Streaming a replica to Peer
+	TransferFetch                              // Receiving the object from Peer
+)
+
+// String returns the name of the phase.
+func (p TransferPhase) String() string {
+	switch p {
+	case TransferRead:
+		return "read"
+	case TransferReplicate:
+		return "replicate"
+	case TransferFetch:
+		return "fetch"
+	default:
+		return fmt.Sprintf("TransferPhase(%d)", uint8(p))
+	}
+}
+
+// TransferProgress reports how far a transfer got in its current phase.
+type TransferProgress struct {
+	ID    uint64        // Transfer the progress belongs to
+	Key   string        // Key being transferred
+	Phase TransferPhase // Current step of the transfer
+	Done  int64         // Bytes transferred in the current phase
+	Total int64         // Size of the current phase, -1 when unknown
+	Peer  string        // Address of the peer the bytes are exchanged with, empty for local work
+}
+
+// TransferOpts configures StoreContext and GetContext.
+type TransferOpts struct {
+	Progress         func(TransferProgress) // Optional callback, never invoked concurrently for the same transfer
+	ProgressInterval int64                  // Bytes between progress callbacks, defaults to defaultProgressInterval
+	Metadata         ObjectMetadata         // Recorded with the object by StoreContext, as by StoreWithMetadata
+}
+
+// Transfer describes a Store or Get in flight.
+type Transfer struct {
+	ID        uint64           // Identifier passed to CancelTransfer
+	RequestID string           // Request ID the transfer is logged with, on this node and its peers
+	Op        string           // "store" or "get"
+	Key       string           // Key being transferred
+	Started   time.Time        // When the transfer began
+	Progress  TransferProgress // Latest progress of the transfer
+}
+
+// transferTable tracks the transfers in flight.
+type transferTable struct {
+	clock  clock.Clock          // Times the transfers, the real clock when nil
+	mu     sync.Mutex           // Guards next and active
+	next   uint64               // ID of the last transfer started
+	active map[uint64]*transfer // Transfers in flight by ID
+}
+
+// transfer is a Store or Get in flight. A nil *transfer reports nothing and is never cancelled.
+type transfer struct {
+	info     Transfer           // Description returned by Transfers, guarded by mu
+	ctx      context.Context    // Cancelled by CancelTransfer or the caller
+	cancel   context.CancelFunc // Cancels ctx
+	opts     TransferOpts       // Progress callback and interval
+	mu       sync.Mutex         // Guards info and reported
+	reported int64              // Done when the callback last ran
+	cbMu     sync.Mutex         // Serialises progress callbacks
+	finish   sync.Once          // Removes the transfer from the table once
+}
+
+// StoreContext stores a file like Store, reporting progress to opts.Progress. The transfer is
+// listed by Transfers until it returns and stops when ctx is done or CancelTransfer is called:
+// before anything is written while the content is read, or before the next peer once it was
+// stored locally.
+//
+// Parameters:
+//   - ctx: Context bounding the transfer.
+//   - key: Key of the file.
+//   - r: Content of the file.
+//   - opts: Progress reporting options and the metadata recorded with the file.
+//
+// Returns: Any errors, as for Store. A cancelled transfer returns an error wrapping ctx.Err().
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader, opts TransferOpts) error {
+	rid := s.requestID(ctx)
+	if err := checkKey(key); err != nil {
+		return withRequestID(rid, err)
+	}
+	t := s.transfers.start(ctx, rid, "store", key, opts)
+	defer s.transfers.done(t)
+	return withRequestID(rid, s.storeTransfer(t, key, r, opts.Metadata))
+}
+
+// GetContext retrieves a file like GetWithInfo, reporting progress to opts.Progress. The
+// transfer is listed by Transfers until the returned reader is read to the end or closed, and
+// stops when ctx is done or CancelTransfer is called, after which the reader fails. A key
+// naming an alias reads the object its aliases lead to; see Link.
+//
+// Parameters:
+//   - ctx: Context bounding the transfer.
+//   - key: Key of the file.
+//   - opts: Progress reporting options.
+//
+// Returns: A description of the file, a reader the caller must close, and any errors.
+func (s *FileServer) GetContext(ctx context.Context, key string, opts TransferOpts) (ObjectInfo, io.ReadCloser, error) {
+	rid := s.requestID(ctx)
+	if err := checkKey(key); err != nil {
+		return ObjectInfo{}, nil, withRequestID(rid, err)
+	}
+	target, err := s.aliases.resolve(key)
+	if err != nil {
+		return ObjectInfo{}, nil, withRequestID(rid, err)
+	}
+	t := s.transfers.start(ctx, rid, "get", key, opts)
+	info, rc, err := s.getTransfer(t, target)
+	if err != nil {
+		s.transfers.done(t)
+		return info, nil, withRequestID(rid, aliasError(key, target, err))
+	}
+	info.Key = key
+	t.phase(TransferRead, "", info.Size)
+	return info, &transferReader{r: t.reader(rc), rc: rc, done: func() { s.transfers.done(t) }}, nil
+}
+
+// Transfers lists the Store and Get calls in flight, oldest first.
+func (s *FileServer) Transfers() []Transfer {
+	s.transfers.mu.Lock()
+	defer s.transfers.mu.Unlock()
+	list := make([]Transfer, 0, len(s.transfers.active))
+	for _, t := range s.transfers.active {
+		t.mu.Lock()
+		list = append(list, t.info)
+		t.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CancelTransfer stops a transfer listed by Transfers.
+//
+// Returns: ErrTransferNotFound when the transfer already finished.
+func (s *FileServer) CancelTransfer(id uint64) error {
+	s.transfers.mu.Lock()
+	t, ok := s.transfers.active[id]
+	s.transfers.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrTransferNotFound, id)
+	}
+	t.cancel()
+	return nil
+}
+
+// start registers a new transfer of request rid.
+func (tt *transferTable) start(ctx context.Context, rid string, op string, key string, opts TransferOpts) *transfer {
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = defaultProgressInterval
+	}
+	t := &transfer{opts: opts}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.active == nil {
+		tt.active = make(map[uint64]*transfer)
+	}
+	tt.next++
+	t.info = Transfer{ID: tt.next, RequestID: rid, Op: op, Key: key, Started: clock.Or(tt.clock).Now()}
+	t.info.Progress = TransferProgress{ID: tt.next, Key: key}
+	tt.active[tt.next] = t
+	return t
+}
+
+// done removes a finished transfer and releases its context.
+func (tt *transferTable) done(t *transfer) {
+	t.finish.Do(func() {
+		tt.mu.Lock()
+		delete(tt.active, t.info.ID)
+		tt.mu.Unlock()
+		t.cancel()
+	})
+}
+
+// err returns why the transfer was stopped, or nil while it may go on.
+func (t *transfer) err() error {
+	if t == nil {
+		return nil
+	}
+	select {
+	case <-t.ctx.Done():
+		return fmt.Errorf("transfer %d: %w", t.info.ID, t.ctx.Err())
+	default:
+		return nil
+	}
+}
+
+// requestID returns the request ID of the transfer, or "" for a nil transfer.
+func (t *transfer) requestID() string {
+	if t == nil {
+		return ""
+	}
+	return t.info.RequestID
+}
+
+// done returns a channel closed when the transfer is stopped, or nil for a nil transfer.
+func (t *transfer) done() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	return t.ctx.Done()
+}
+
+// phase starts a new phase of the transfer.
+func (t *transfer) phase(phase TransferPhase, peer string, total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.info.Progress.Phase, t.info.Progress.Peer = phase, peer
+	t.info.Progress.Done, t.info.Progress.Total = 0, total
+	t.reported = 0
+	t.mu.Unlock()
+}
+
+// add counts n more bytes of the current phase, running the progress callback once
+// ProgressInterval bytes passed since it last ran or the phase is complete.
+func (t *transfer) add(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	p := &t.info.Progress
+	p.Done += int64(n)
+	report := t.opts.Progress != nil && (p.Done-t.reported >= t.opts.ProgressInterval || p.Done == p.Total)
+	if report {
+		t.reported = p.Done
+	}
+	progress := *p
+	t.mu.Unlock()
+	if report {
+		t.cbMu.Lock()
+		t.opts.Progress(progress)
+		t.cbMu.Unlock()
+	}
+}
+
+// reader wraps r so the bytes read through it are counted and reads fail once the transfer
+// is stopped.
+func (t *transfer) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, t: t}
+}
+
+// send writes data to a peer's stream in ProgressInterval chunks, counting each one, and
+// stops once the transfer is stopped.
+func (t *transfer) send(w io.Writer, data []byte) error {
+	if t == nil {
+		_, err := w.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		if err := t.err(); err != nil {
+			return err
+		}
+		chunk := data[:min(int64(len(data)), t.opts.ProgressInterval)]
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		t.add(len(chunk))
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// sendFile writes the first size bytes of f to a peer's stream through a pooled buffer, from the start
+// of the file whatever its offset, counting them like send.
+func (t *transfer) sendFile(w io.Writer, f *os.File, size int64) error {
+	buf := sendBufs.Get().(*[]byte)
+	defer sendBufs.Put(buf)
+	r := io.NewSectionReader(f, 0, size)
+	for sent := int64(0); sent < size; {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			if err := t.send(w, (*buf)[:n]); err != nil {
+				return err
+			}
+			sent += int64(n)
+		}
+		if errors.Is(err, io.EOF) && sent < size {
+			// The file shrank since it was measured.
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	return nil
+}
+
+// progressReader counts the bytes read from r for a transfer.
+type progressReader struct {
+	r io.Reader // Source of the bytes
+	t *transfer // Transfer the bytes are counted for
+}
+
+// Read reads from the source unless the transfer was stopped.
+func (p *progressReader) Read(b []byte) (int, error) {
+	if err := p.t.err(); err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	p.t.add(n)
+	return n, err
+}
+
+// transferReader is the reader returned by GetContext. The transfer finishes when the
+// reader reaches the end of the object, fails or is closed.
+type transferReader struct {
+	r    io.Reader     // Counting reader over rc
+	rc   io.ReadCloser // Object being read
+	done func()        // Finishes the transfer
+	err  error         // Error that ended the reads, returned again by later ones
+}
+
+// Read reads the object, finishing the transfer at its end or on error.
+func (t *transferReader) Read(b []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	n, err := t.r.Read(b)
+	if err != nil {
+		t.err = err
+		t.done()
+	}
+	return n, err
+}
+
+// Close finishes the transfer and closes the object.
+func (t *transferReader) Close() error {
+	t.done()
+	return t.rc.Close()
+}
+
+// readerSize returns the number of bytes left in r when it can tell, or -1.
+func readerSize(r io.Reader) int64 {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return int64(l.Len())
+	}
+	return -1
+}
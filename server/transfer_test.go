@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// progressLog records the progress reported for a transfer.
+type progressLog struct {
+	mu     sync.Mutex
+	events []TransferProgress
+}
+
+// record appends an event; it is used as TransferOpts.Progress.
+func (l *progressLog) record(p TransferProgress) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, p)
+}
+
+// phase returns the events of one phase, checking that progress never goes backwards.
+func (l *progressLog) phase(t *testing.T, phase TransferPhase) []TransferProgress {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []TransferProgress
+	for _, ev := range l.events {
+		if ev.Phase != phase {
+			continue
+		}
+		if len(events) > 0 && ev.Peer == events[len(events)-1].Peer {
+			assert.GreaterOrEqual(t, ev.Done, events[len(events)-1].Done)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestStoreAndGetProgress(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	key, data := "video.mp4", bytes.Repeat([]byte("frame"), 20000)
+	var stored progressLog
+	opts := TransferOpts{Progress: stored.record, ProgressInterval: 8 << 10}
+	require.NoError(t, a.StoreContext(context.Background(), key, bytes.NewReader(data), opts))
+	read := stored.phase(t, TransferRead)
+	require.NotEmpty(t, read)
+	assert.Greater(t, len(read), 5)
+	assert.Equal(t, int64(len(data)), read[len(read)-1].Done)
+	assert.Equal(t, int64(len(data)), read[len(read)-1].Total)
+	replicated := stored.phase(t, TransferReplicate)
+	require.NotEmpty(t, replicated)
+	last := replicated[len(replicated)-1]
+	assert.Equal(t, last.Total, last.Done)
+	assert.Equal(t, key, last.Key)
+	assert.NotEmpty(t, last.Peer)
+	assert.Empty(t, a.Transfers())
+
+	// Fetching the object back from the peer reports the fetch, then the caller's reads.
+	require.NoError(t, a.Storage.Delete(a.ID, key))
+	var fetched progressLog
+	_, rc, err := a.GetContext(context.Background(), key, TransferOpts{Progress: fetched.record, ProgressInterval: 8 << 10})
+	require.NoError(t, err)
+	require.Len(t, a.Transfers(), 1)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, data, got)
+	assert.NotEmpty(t, fetched.phase(t, TransferFetch))
+	read = fetched.phase(t, TransferRead)
+	require.NotEmpty(t, read)
+	assert.Equal(t, int64(len(data)), read[len(read)-1].Done)
+	assert.Empty(t, a.Transfers())
+}
+
+func TestCancelTransferMidStream(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	// The content arrives in chunks; the first progress report cancels the transfer.
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := make([]byte, 4<<10)
+		for i := 0; i < 64; i++ {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	defer pr.Close()
+	cancelled := false
+	opts := TransferOpts{ProgressInterval: 4 << 10, Progress: func(p TransferProgress) {
+		if !cancelled {
+			cancelled = true
+			assert.NoError(t, a.CancelTransfer(p.ID))
+		}
+	}}
+	err := a.StoreContext(context.Background(), "big.iso", pr, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	ok, err := a.Storage.Has(a.ID, "big.iso")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, a.Transfers())
+	assert.ErrorIs(t, a.CancelTransfer(1), ErrTransferNotFound)
+
+	// A download stops mid-read once cancelled.
+	require.NoError(t, a.Store("small.txt", bytes.NewReader(bytes.Repeat([]byte("x"), 64<<10))))
+	_, rc, err := a.GetContext(context.Background(), "small.txt", TransferOpts{})
+	require.NoError(t, err)
+	defer rc.Close()
+	buf := make([]byte, 1024)
+	_, err = rc.Read(buf)
+	require.NoError(t, err)
+	transfers := a.Transfers()
+	require.Len(t, transfers, 1)
+	assert.Equal(t, int64(1024), transfers[0].Progress.Done)
+	require.NoError(t, a.CancelTransfer(transfers[0].ID))
+	_, err = rc.Read(buf)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, a.Transfers())
+}
+
+// BenchmarkTransferReader guards the cost of counting progress on the stream paths; compare
+// it with BenchmarkPlainReader.
+func BenchmarkTransferReader(b *testing.B) {
+	var tt transferTable
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		t := tt.start(context.Background(), "", "get", "bench", TransferOpts{Progress: func(TransferProgress) {}})
+		t.phase(TransferRead, "", int64(len(data)))
+		if _, err := io.Copy(io.Discard, t.reader(bytes.NewReader(data))); err != nil {
+			b.Fatal(err)
+		}
+		tt.done(t)
+	}
+}
+
+// BenchmarkPlainReader is the baseline for BenchmarkTransferReader.
+func BenchmarkPlainReader(b *testing.B) {
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		// Hide bytes.Reader's WriterTo so both benchmarks copy through a buffer.
+		if _, err := io.Copy(io.Discard, struct{ io.Reader }{bytes.NewReader(data)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+const (
+	// defaultTrashPurgeInterval is how often the trash is purged when TrashPurgeInterval is not set.
+	defaultTrashPurgeInterval = time.Minute
+	// restoreTimeout bounds how long Restore waits for each peer.
+	restoreTimeout = 5 * time.Second
+)
+
+// MessageDeleteFile asks peers to delete their replica of an object. Peers keep it in their
+// trash when they were configured with a TrashRetention.
+type MessageDeleteFile struct {
+	ID        string // Identifier of the node owning the object
+	Key       string // Hashed key of the object
+	Force     bool   // Whether the replica is deleted even if it is immutable, as by ForceDelete
+	Namespace string // Namespace of the key, empty if it has none
+}
+
+// MessageRestoreFile asks a peer to restore its replica of an object from the trash. The
+// receiver answers with a restoreResponse.
+type MessageRestoreFile struct {
+	ID  string // Identifier of the node owning the object
+	Key string // Hashed key of the object
+}
+
+// restoreResponse is the stream sent in answer to MessageRestoreFile.
+type restoreResponse struct {
+	Err string // Why the replica could not be restored, empty when the peer holds it again
+}
+
+// Delete removes an object locally and from every connected peer. With a TrashRetention the
+// object is only moved to the trash, where Restore can find it until it expires.
+//
+// Peers are told with the other deletes made within CoalesceWindow, in one message.
+//
+// Deleting an alias removes the alias alone, on every node, and leaves the object it points
+// at as it is.
+//
+// Returns: Any errors. A *BroadcastError means the object was deleted locally and on every
+// peer except those it names; peers told in a batched message that cannot be reached are
+// only logged. An error wrapping ErrImmutable means the object is immutable and only
+// ForceDelete removes it.
+func (s *FileServer) Delete(key string) error {
+	rid := s.NewRequestID()
+	if err := checkKey(key); err != nil {
+		return withRequestID(rid, err)
+	}
+	if _, isAlias := s.aliases.target(key); isAlias {
+		return withRequestID(rid, s.unlink(rid, key))
+	}
+	if s.immutable(s.ID, key) {
+		return withRequestID(rid, fmt.Errorf("deleting (%s): %w", key, ErrImmutable))
+	}
+	return withRequestID(rid, s.deleteObject(rid, key, false))
+}
+
+// deleteObject deletes an object for Delete and ForceDelete as request rid, asking peers to
+// delete their replicas even if they are immutable when force is set.
+func (s *FileServer) deleteObject(rid string, key string, force bool) error {
+	if err := s.Storage.Delete(s.ID, key); err != nil {
+		return err
+	}
+	hashedKey := crypto.HashKey(key)
+	s.objectDeleted(objectRef{owner: s.ID, key: hashedKey}, s.Clock.Now())
+	s.publishEvent(NotifyEvent{Op: NotifyDelete, Key: key, RequestID: rid})
+	s.logf(rid, "deleted (%s), telling peers", key)
+	msg := &Message{Payload: MessageDeleteFile{ID: s.ID, Key: hashedKey, Force: force, Namespace: keyNamespace(key)}, RequestID: rid}
+	return s.sendCoalesced(s.peerList(), msg)
+}
+
+// Restore brings back an object deleted within the retention window, along with the
+// replicas peers kept in their trash. If the local copy was already purged, the object is
+// pulled from a peer that could restore its replica.
+//
+// Returns: storage.ErrNotInTrash when no node holds a restorable copy, and any other errors.
+func (s *FileServer) Restore(key string) error {
+	localErr := s.Storage.Restore(s.ID, key)
+	if localErr != nil && !errors.Is(localErr, storage.ErrNotInTrash) {
+		return localErr
+	}
+	hashedKey := crypto.HashKey(key)
+	s.objectStored(objectRef{owner: s.ID, key: hashedKey})
+	restored := 0
+	for _, peer := range s.peerList() {
+		var resp restoreResponse
+		err := s.exchange(peer, &Message{Payload: MessageRestoreFile{ID: s.ID, Key: hashedKey}}, &resp, restoreTimeout)
+		if err == nil && len(resp.Err) > 0 {
+			err = newRemoteError(resp.Err)
+		}
+		if err != nil {
+			log.Printf("[%s] peer (%s) did not restore (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), key, err)
+			continue
+		}
+		restored++
+	}
+	if localErr != nil {
+		if restored == 0 {
+			return localErr
+		}
+		// The local copy was purged; fetching the object stores it locally again.
+		_, r, err := s.GetWithInfo(key)
+		if err != nil {
+			return fmt.Errorf("pulling restored (%s) from peers: %w", key, err)
+		}
+		r.Close()
+	}
+	s.publish(NotifyStore, key)
+	return nil
+}
+
+// PurgeTrash permanently removes the objects of every owner that stayed in the trash longer
+// than TrashRetention.
+//
+// Returns: Number of objects removed and any errors.
+func (s *FileServer) PurgeTrash() (int, error) {
+	ids, err := s.Storage.Owners()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		total int
+		errs  []error
+	)
+	for _, id := range ids {
+		n, err := s.Storage.PurgeTrash(id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("purge %s: %w", id, err))
+		}
+		total += n
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		log.Printf("[%s] purge: %s", s.Transport.Addr(), err)
+	}
+	if total > 0 {
+		log.Printf("[%s] purged %d objects from the trash", s.Transport.Addr(), total)
+	}
+	return total, err
+}
+
+// handleMessageDeleteFile deletes a peer's replica, remembering the deletion for mirrors. An
+// immutable replica is kept unless the deletion is forced, which is recorded in the audit log.
+// Deletions are not answered, so one the Authorizer denies is only logged and audited here.
+func (s *FileServer) handleMessageDeleteFile(from string, span string, msg MessageDeleteFile) error {
+	if err := s.authorize(from, span, OpDelete, msg.ID, msg.Namespace, msg.Key); err != nil {
+		return err
+	}
+	if s.immutable(msg.ID, msg.Key) {
+		if !msg.Force {
+			return fmt.Errorf("deleting replica (%s): %w", msg.Key, ErrImmutable)
+		}
+		if err := s.audit(auditEntry{Op: "force-delete", Owner: msg.ID, Key: msg.Key, RequestID: span}); err != nil {
+			return fmt.Errorf("deleting replica (%s): %w", msg.Key, err)
+		}
+	}
+	s.objectDeleted(objectRef{owner: msg.ID, key: msg.Key}, s.Clock.Now())
+	s.logf(span, "deleting replica (%s) for (%s)", msg.Key, from)
+	return s.Storage.Delete(msg.ID, msg.Key)
+}
+
+// handleMessageRestoreFile restores a replica from the trash. A replica that was never
+// deleted counts as restored.
+func (s *FileServer) handleMessageRestoreFile(from string, q query, msg MessageRestoreFile) error {
+	err := s.Storage.Restore(msg.ID, msg.Key)
+	if errors.Is(err, fs.ErrExist) {
+		err = nil
+	}
+	var resp restoreResponse
+	if err != nil {
+		resp.Err = err.Error()
+	} else {
+		s.objectStored(objectRef{owner: msg.ID, key: msg.Key})
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
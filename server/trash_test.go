@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteAndRestoreAcrossCluster(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	for _, s := range []*FileServer{a, b} {
+		s.Storage.TrashRetention = time.Hour
+	}
+	startCluster(t, a, b)
+
+	key, data := "reports/q3.pdf", []byte("quarterly numbers")
+	require.NoError(t, a.Store(key, bytes.NewReader(data)))
+	replicaHeld := func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	}
+	waitFor(t, replicaHeld)
+
+	require.NoError(t, a.Delete(key))
+	waitFor(t, func() bool { return !replicaHeld() })
+	ok, err := a.Storage.Has(a.ID, key)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, a.Restore(key))
+	assert.True(t, replicaHeld())
+	r, err := a.Get(key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Once the local trash is purged the object is pulled back from the peer's trash.
+	require.NoError(t, a.Delete(key))
+	waitFor(t, func() bool { return !replicaHeld() })
+	require.NoError(t, os.RemoveAll(filepath.Join(a.Storage.Root, a.ID, ".trash")))
+	require.NoError(t, a.Restore(key))
+	ok, err = a.Storage.Has(a.ID, key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	r, err = a.Get(key)
+	require.NoError(t, err)
+	got, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestRestoreWithoutTrashedCopy(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	key := "gone.txt"
+	require.NoError(t, a.Store(key, bytes.NewReader([]byte("bye"))))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return ok
+	})
+	// Without a retention the object is deleted for good on every node.
+	require.NoError(t, a.Delete(key))
+	waitFor(t, func() bool {
+		ok, _ := b.Storage.Has(a.ID, crypto.HashKey(key))
+		return !ok
+	})
+	err := a.Restore(key)
+	assert.True(t, errors.Is(err, storage.ErrNotInTrash), err)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/p2p"
+)
+
+// txTimeout bounds how long StoreAtomic waits for each peer to answer a prepare or a commit.
+const txTimeout = 10 * time.Second
+
+// MessageTxPrepare announces a stream carrying the encrypted objects of a transaction back
+// to back. The receiver stages them and answers with a txVote.
+type MessageTxPrepare struct {
+	TxID    string       // Transaction the objects belong to
+	ID      string       // Identifier of the node owning the objects
+	Entries []BatchEntry // Objects in stream and commit order
+}
+
+// MessageTxCommit makes the staged objects of a prepared transaction visible. The receiver
+// answers with a txVote.
+type MessageTxCommit struct {
+	TxID string // Transaction to commit
+}
+
+// MessageTxAbort discards the staged objects of a transaction.
+type MessageTxAbort struct {
+	TxID string // Transaction to discard
+}
+
+// txVote is the stream sent in answer to MessageTxPrepare and MessageTxCommit.
+type txVote struct {
+	Err string // Why the request failed, empty on success
+}
+
+// StoreAtomic stores a set of objects all or nothing, locally and on every connected peer.
+// Every node first stages the objects out of sight; only once all of them staged every object
+// successfully are the objects committed, in item order, so readers that find the last item
+// also find the others. Publish a manifest as the last item to make it visible only after the
+// objects it lists. If any node fails to stage, the transaction is aborted everywhere.
+//
+// Parameters:
+//   - items: Objects to store; keys must be unique.
+//
+// Returns: Any errors. A *BroadcastError names the peers that failed to commit after every
+// node prepared; the transaction is committed locally and on the other peers, and those peers
+// discard their staged copy.
+func (s *FileServer) StoreAtomic(items []StoreItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if err := checkKey(item.Key); err != nil {
+			return err
+		}
+		if seen[item.Key] {
+			return fmt.Errorf("%w: duplicate key %q in transaction", ErrInvalidKey, item.Key)
+		}
+		seen[item.Key] = true
+	}
+
+	txID := crypto.GenerateID()
+	msg, payload, err := s.stageLocal(txID, items)
+	if err != nil {
+		return errors.Join(err, s.Storage.Abort(txID))
+	}
+
+	// Phase one: every peer stages the objects and votes.
+	peers := s.peerList()
+	for _, peer := range peers {
+		var vote txVote
+		err := s.exchangeStream(peer, &Message{Payload: msg}, payload, &vote, txTimeout)
+		if err == nil && len(vote.Err) > 0 {
+			err = newRemoteError(vote.Err)
+		}
+		if err != nil {
+			s.abortTx(txID, peers)
+			return fmt.Errorf("transaction aborted, peer (%s) failed to prepare: %w", peer.RemoteAddr(), err)
+		}
+	}
+	if s.testHookPrepared != nil {
+		s.testHookPrepared()
+	}
+
+	// Phase two: every node commits.
+	berr := &BroadcastError{failed: make(map[string]error), total: len(peers)}
+	for _, peer := range peers {
+		var vote txVote
+		err := s.exchange(peer, &Message{Payload: MessageTxCommit{TxID: txID}}, &vote, txTimeout)
+		if err == nil && len(vote.Err) > 0 {
+			err = newRemoteError(vote.Err)
+		}
+		if err != nil {
+			berr.failed[peer.RemoteAddr().String()] = err
+		}
+	}
+	if err := s.Storage.Commit(txID); err != nil {
+		return err
+	}
+	for _, item := range items {
+		s.objectStored(objectRef{owner: s.ID, key: crypto.HashKey(item.Key)})
+		s.publish(NotifyStore, item.Key)
+	}
+	if len(berr.failed) > 0 {
+		return berr
+	}
+	return nil
+}
+
+// stageLocal stages the plaintext of every item in the local store and prepares the
+// encrypted copies sent to peers.
+//
+// Returns: The prepare message, the stream following it, and any errors.
+func (s *FileServer) stageLocal(txID string, items []StoreItem) (MessageTxPrepare, []byte, error) {
+	msg := MessageTxPrepare{TxID: txID, ID: s.ID, Entries: make([]BatchEntry, 0, len(items))}
+	payload := new(bytes.Buffer)
+	for _, item := range items {
+		content, err := io.ReadAll(item.Data)
+		if err != nil {
+			return msg, nil, fmt.Errorf("staging (%s): %w", item.Key, err)
+		}
+		held, err := s.checkWritable(item.Key, bytes.NewReader(content))
+		if err != nil {
+			return msg, nil, err
+		}
+		if held {
+			// An immutable key given the content it holds is left as it is.
+			continue
+		}
+		if _, _, err := s.Storage.Stage(txID, s.ID, item.Key, bytes.NewReader(content)); err != nil {
+			return msg, nil, fmt.Errorf("staging (%s): %w", item.Key, err)
+		}
+		rep, err := s.prepareReplica(item.Key, bytes.NewReader(content))
+		if err != nil {
+			return msg, nil, err
+		}
+		msg.Entries = append(msg.Entries, BatchEntry{Key: rep.key, Size: int64(len(rep.data)), Checksum: rep.checksum, Namespace: rep.namespace})
+		payload.Write(rep.data)
+	}
+	return msg, payload.Bytes(), nil
+}
+
+// abortTx discards a transaction locally and asks the peers to do the same. Peers that never
+// staged it ignore the request.
+func (s *FileServer) abortTx(txID string, peers []p2p.Node) {
+	if err := s.Storage.Abort(txID); err != nil {
+		log.Printf("[%s] aborting transaction (%s): %s", s.Transport.Addr(), txID, err)
+	}
+	if _, err := s.sendMessage(peers, &Message{Payload: MessageTxAbort{TxID: txID}}); err != nil {
+		log.Printf("[%s] aborting transaction (%s) on peers: %s", s.Transport.Addr(), txID, err)
+	}
+}
+
+// handleMessageTxPrepare stages the objects of a transaction and votes on it. The whole
+// stream is consumed even when staging fails, keeping the connection aligned.
+func (s *FileServer) handleMessageTxPrepare(from string, q query, msg MessageTxPrepare) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) not found", from)
+	}
+	stream := peer.AcceptStream()
+	var (
+		errs   []error
+		staged int64 // Bytes staged by earlier entries, charged to the origin's quota as well
+	)
+	for _, e := range msg.Entries {
+		lr := &io.LimitedReader{R: stream, N: e.Size}
+		if len(errs) == 0 {
+			staged += e.Size
+			if err := s.admitReplica(from, "", msg.ID, e.Namespace, e.Key, staged); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 0 {
+			n, sum, err := s.Storage.Stage(msg.TxID, msg.ID, e.Key, lr)
+			switch {
+			case err != nil:
+				errs = append(errs, err)
+			case n != e.Size:
+				errs = append(errs, fmt.Errorf("object (%s): received %d of %d bytes: %w", e.Key, n, e.Size, io.ErrUnexpectedEOF))
+			case sum != e.Checksum:
+				errs = append(errs, fmt.Errorf("object (%s): checksum %s, want %s", e.Key, sum, e.Checksum))
+			}
+		}
+		if _, err := io.Copy(io.Discard, lr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	stream.Close()
+
+	vote := txVote{}
+	if err := errors.Join(errs...); err != nil {
+		vote.Err = err.Error()
+		errs = append(errs, s.Storage.Abort(msg.TxID))
+	} else {
+		s.txMu.Lock()
+		s.txs[msg.TxID] = txState{from: from, id: msg.ID, entries: msg.Entries}
+		s.txMu.Unlock()
+	}
+	return errors.Join(append(errs, s.sendValue(from, q, vote))...)
+}
+
+// txState is a transaction this node staged for a peer.
+type txState struct {
+	from    string       // Address of the peer coordinating the transaction
+	id      string       // Identifier of the node owning the objects
+	entries []BatchEntry // Staged objects
+}
+
+// handleMessageTxCommit commits a staged transaction and reports the outcome.
+func (s *FileServer) handleMessageTxCommit(from string, q query, msg MessageTxCommit) error {
+	s.txMu.Lock()
+	tx, ok := s.txs[msg.TxID]
+	delete(s.txs, msg.TxID)
+	s.txMu.Unlock()
+	var err error
+	if !ok {
+		err = fmt.Errorf("transaction (%s) is not prepared", msg.TxID)
+	} else if err = s.Storage.Commit(msg.TxID); err == nil {
+		for _, e := range tx.entries {
+			s.objectStored(objectRef{owner: tx.id, key: e.Key})
+		}
+	}
+	vote := txVote{}
+	if err != nil {
+		vote.Err = err.Error()
+	}
+	return errors.Join(err, s.sendValue(from, q, vote))
+}
+
+// handleMessageTxAbort discards a staged transaction.
+func (s *FileServer) handleMessageTxAbort(msg MessageTxAbort) error {
+	s.txMu.Lock()
+	delete(s.txs, msg.TxID)
+	s.txMu.Unlock()
+	return s.Storage.Abort(msg.TxID)
+}
+
+// abortTxsFrom discards the transactions staged for a peer whose connection closed: its
+// commit can no longer arrive, so keeping them would only leak disk space.
+func (s *FileServer) abortTxsFrom(addr string) {
+	s.txMu.Lock()
+	var txIDs []string
+	for txID, tx := range s.txs {
+		if tx.from == addr {
+			txIDs = append(txIDs, txID)
+			delete(s.txs, txID)
+		}
+	}
+	s.txMu.Unlock()
+	for _, txID := range txIDs {
+		if err := s.Storage.Abort(txID); err != nil {
+			log.Printf("[%s] aborting transaction (%s): %s", s.Transport.Addr(), txID, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// txKeys are published by the transaction tests, manifest last.
+var txKeys = []string{"artifact/blob_1", "artifact/blob_2", "artifact/manifest"}
+
+// txItems returns StoreItems for txKeys with their key as content.
+func txItems() []StoreItem {
+	items := make([]StoreItem, len(txKeys))
+	for i, key := range txKeys {
+		items[i] = StoreItem{Key: key, Data: bytes.NewReader([]byte(key))}
+	}
+	return items
+}
+
+// visibleKeys returns the transaction keys, stored by owner, that s holds.
+func visibleKeys(t *testing.T, s *FileServer, owner *FileServer) []string {
+	var visible []string
+	for _, key := range txKeys {
+		id, stored := owner.ID, crypto.HashKey(key)
+		if s == owner {
+			stored = key
+		}
+		ok, err := s.Storage.Has(id, stored)
+		require.NoError(t, err)
+		if ok {
+			visible = append(visible, key)
+		}
+	}
+	return visible
+}
+
+// stagingEmpty reports whether s holds no staged transactions.
+func stagingEmpty(s *FileServer) bool {
+	entries, err := os.ReadDir(filepath.Join(s.Storage.Root, ".dfs-staging"))
+	return errors.Is(err, os.ErrNotExist) || (err == nil && len(entries) == 0)
+}
+
+func TestStoreAtomicCommitsEverywhere(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	require.NoError(t, a.StoreAtomic(txItems()))
+	for _, s := range []*FileServer{a, b, c} {
+		assert.Equal(t, txKeys, visibleKeys(t, s, a))
+		assert.True(t, stagingEmpty(s))
+	}
+	r, err := a.Get("artifact/manifest")
+	require.NoError(t, err)
+	content := new(bytes.Buffer)
+	_, err = content.ReadFrom(r)
+	require.NoError(t, err)
+	assert.Equal(t, "artifact/manifest", content.String())
+
+	err = a.StoreAtomic([]StoreItem{{Key: "k", Data: bytes.NewReader(nil)}, {Key: "k", Data: bytes.NewReader(nil)}})
+	assert.ErrorContains(t, err, "duplicate key")
+}
+
+func TestStoreAtomicAbortsWhenPeerRejectsPrepare(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+	// A file in place of c's staging area makes it fail to stage anything.
+	require.NoError(t, os.WriteFile(filepath.Join(c.Storage.Root, ".dfs-staging"), nil, 0o644))
+
+	err := a.StoreAtomic(txItems())
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "failed to prepare")
+	for _, s := range []*FileServer{a, b, c} {
+		assert.Empty(t, visibleKeys(t, s, a))
+	}
+	waitFor(t, func() bool { return stagingEmpty(a) && stagingEmpty(b) })
+}
+
+func TestStoreAtomicPeerDiesBeforeCommit(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	a.testHookPrepared = func() {
+		assert.False(t, stagingEmpty(c), "c prepared the transaction")
+		c.Stop()
+		for _, peer := range c.peerList() {
+			require.NoError(t, peer.Close())
+		}
+		waitFor(t, func() bool { return len(a.peerList()) == 1 })
+	}
+	err := a.StoreAtomic(txItems())
+	var berr *BroadcastError
+	require.ErrorAs(t, err, &berr)
+	assert.Len(t, berr.Failed(), 1)
+
+	// The nodes that got the commit show everything; c shows nothing and drops its staged copy.
+	assert.Equal(t, txKeys, visibleKeys(t, a, a))
+	assert.Equal(t, txKeys, visibleKeys(t, b, a))
+	assert.Empty(t, visibleKeys(t, c, a))
+	waitFor(t, func() bool { return stagingEmpty(c) })
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// verifyDeepTimeout bounds how long VerifyCluster waits for a page of a deep verification,
+// for which the peer re-hashes every object of the page.
+const verifyDeepTimeout = time.Minute
+
+// Kinds of VerifyFinding.
+const (
+	FindingUnderReplicated = "under-replicated" // Nodes the object is placed on lack a copy
+	FindingDivergent       = "divergent"        // Replicas differ from the newest one
+	FindingMissedDelete    = "missed-delete"    // Nodes hold a copy older than a deletion of the object
+	FindingCorrupt         = "corrupt"          // Copies no longer match their checksum
+	FindingUnaudited       = "unaudited"        // A node could not be audited
+	FindingPolicy          = "policy-violation" // Fewer replicas than the object's policy wants
+)
+
+// MessageVerifyKeys asks a peer for a page of every object it holds, its own and replicas,
+// described for VerifyCluster.
+type MessageVerifyKeys struct {
+	Cursor string // Next cursor of the previous page, "" for the first page
+	Limit  int    // Most objects wanted, capped by maxListPageSize
+	Deep   bool   // Whether every object of the page is re-hashed against its checksum
+}
+
+// verifyEntry describes one object a node holds. Objects are named by their owner and the
+// hashed key replicas carry, so a node's own objects line up with their replicas.
+type verifyEntry struct {
+	Owner    string    // Identifier of the node owning the object
+	Key      string    // Hashed key of the object
+	Plain    string    // Key the object was stored under, set only for the node's own objects
+	Checksum string    // Recorded checksum of the copy
+	Version  uint64    // Version of the copy, zero when its key is not versioned
+	ModTime  time.Time // When the copy was written
+	Corrupt  bool      // Whether a deep verification found the copy damaged
+}
+
+// verifyKeysResponse is the stream sent in answer to MessageVerifyKeys.
+type verifyKeysResponse struct {
+	Entries    []verifyEntry // Objects of the page, by owner then key
+	Tombstones []tombstone   // Deletions the node knows of, sent with the first page only
+	Next       string        // Cursor of the next page, "" when this is the last
+	Err        string        // Why the request could not be answered
+	Seq        uint64        // Sequence number of the snapshot the page was listed from
+	Time       time.Time     // When that snapshot was taken
+}
+
+// VerifyFinding is one problem found by VerifyCluster.
+type VerifyFinding struct {
+	Kind   string   `json:"kind"`             // One of the Finding constants
+	Owner  string   `json:"owner,omitempty"`  // Node owning the object
+	Key    string   `json:"key,omitempty"`    // Key of the object, hashed when its owner's copy was not seen
+	Nodes  []string `json:"nodes"`            // Nodes the problem is on
+	Detail string   `json:"detail,omitempty"` // What exactly is wrong
+}
+
+// VerifyReport is the outcome of VerifyCluster.
+type VerifyReport struct {
+	Nodes      int             `json:"nodes"`      // Nodes audited
+	Objects    int             `json:"objects"`    // Distinct objects seen
+	Copies     int             `json:"copies"`     // Copies seen, owners' and replicas
+	Deep       bool            `json:"deep"`       // Whether every copy was re-hashed
+	Challenged int             `json:"challenged"` // Replicas challenged to prove they are held
+	Findings   []VerifyFinding `json:"findings"`   // Problems found, by kind, owner and key
+
+	// Snapshots are the points in time each audited node was listed at, so nodes that
+	// reported from far apart, whose findings may only reflect writes in between, stand out.
+	Snapshots []ListSnapshot `json:"snapshots"`
+}
+
+// Healthy reports whether the audit found no problem.
+func (r VerifyReport) Healthy() bool {
+	return len(r.Findings) == 0
+}
+
+// verifyPage returns a page of every object this node holds, from the snapshot of every
+// owner's keys the audit took with its first page. Positions within the snapshot are
+// "<owner>/<key>", which is unambiguous as node IDs hold no slash.
+//
+// Returns: The page, with the cursor of the next page, and any errors.
+func (s *FileServer) verifyPage(cursor string, limit int, deep bool) (verifyKeysResponse, error) {
+	id, snap, pos, err := s.pageSnapshot(cursor, s.Storage.Owners)
+	if err != nil {
+		return verifyKeysResponse{}, err
+	}
+	page := func(entries []verifyEntry, next string) verifyKeysResponse {
+		return verifyKeysResponse{Entries: entries, Next: s.pageCursor(id, next), Seq: snap.Seq, Time: snap.Time}
+	}
+	owners := snap.Owners()
+	afterOwner, afterKey, _ := strings.Cut(pos, "/")
+	var entries []verifyEntry
+	for i, owner := range owners {
+		if owner < afterOwner {
+			continue
+		}
+		keyCursor := ""
+		if owner == afterOwner {
+			keyCursor = afterKey
+		}
+		keys, next := snap.ListKeys(owner, "", keyCursor, limit-len(entries))
+		for _, key := range keys {
+			meta, err := s.Storage.Metadata(owner, key)
+			if err != nil {
+				// Deleted since the snapshot.
+				continue
+			}
+			entry := verifyEntry{Owner: owner, Key: key, Checksum: meta.Checksum, Version: meta.Version, ModTime: meta.ModTime}
+			if owner == s.ID {
+				entry.Plain, entry.Key = key, crypto.HashKey(key)
+			}
+			if deep {
+				entry.Corrupt = errors.Is(s.Storage.Verify(owner, key), storage.ErrContentCorrupted)
+			}
+			entries = append(entries, entry)
+		}
+		if len(next) > 0 {
+			return page(entries, owner+"/"+next), nil
+		}
+		if len(entries) == limit && i+1 < len(owners) {
+			// The page is full; the next one starts with the following owner.
+			return page(entries, owners[i+1]+"/"), nil
+		}
+	}
+	return page(entries, ""), nil
+}
+
+// handleMessageVerifyKeys answers a MessageVerifyKeys with a page of the objects this node
+// holds. A request that could not be answered still gets a response, carrying the error, so
+// the requester's connection stays in sync.
+func (s *FileServer) handleMessageVerifyKeys(from string, q query, msg MessageVerifyKeys) error {
+	limit := msg.Limit
+	if limit <= 0 || limit > maxListPageSize {
+		limit = maxListPageSize
+	}
+	resp, err := s.verifyPage(msg.Cursor, limit, msg.Deep)
+	if len(msg.Cursor) == 0 {
+		resp.Tombstones = s.tombstones.list()
+	}
+	if err != nil {
+		resp = verifyKeysResponse{Err: err.Error()}
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
+
+// heldCopy is a copy of an object seen by VerifyCluster.
+type heldCopy struct {
+	node  string      // Node holding the copy
+	entry verifyEntry // How the node described it
+}
+
+// VerifyCluster audits the consistency of this node and every connected peer. It collects
+// what each node holds, a page at a time, and reports:
+//   - objects missing from nodes they are placed on: the nodes they are pinned to, or every
+//     node audited when they are neither pinned nor limited by a replication factor;
+//   - objects with fewer replicas than the MinReplicas, or ReplicationFactor, of the policy
+//     their key resolves to on this node;
+//   - replicas whose checksum or version differ from the newest replica;
+//   - copies older than a deletion of their object that some node recorded;
+//   - with deep, copies that no longer match their checksum, and replicas of a sample of this
+//     node's objects, ChallengeSampleRate of them, that fail a challenge to prove they are
+//     held, which are replicated again as by ChallengeReplicas.
+//
+// Nodes that cannot be audited, such as peers predating the verification, are reported too,
+// and their copies are not expected.
+//
+// Parameters:
+//   - deep: Whether every node re-hashes its copies, which reads every object in the cluster.
+//
+// Returns: The report, whose Healthy method tells whether anything was found.
+func (s *FileServer) VerifyCluster(deep bool) VerifyReport {
+	report := VerifyReport{Deep: deep}
+	objects := make(map[objectRef][]heldCopy)
+	plain := make(map[objectRef]string)
+	deleted := make(map[objectRef]time.Time)
+	var audited []string
+	collect := func(node string, entries []verifyEntry, tombstones []tombstone) {
+		for _, entry := range entries {
+			ref := objectRef{owner: entry.Owner, key: entry.Key}
+			objects[ref] = append(objects[ref], heldCopy{node: node, entry: entry})
+			if len(entry.Plain) > 0 {
+				plain[ref] = entry.Plain
+			}
+		}
+		for _, ts := range tombstones {
+			ref := objectRef{owner: ts.Owner, key: ts.Key}
+			if ts.Time.After(deleted[ref]) {
+				deleted[ref] = ts.Time
+			}
+		}
+	}
+
+	// This node is listed a page at a time, like its peers.
+	pageSize := s.listPageSize()
+	collect(s.ID, nil, s.tombstones.list())
+	for cursor := ""; ; {
+		resp, err := s.verifyPage(cursor, pageSize, deep)
+		if err != nil {
+			report.Findings = append(report.Findings, VerifyFinding{Kind: FindingUnaudited, Nodes: []string{s.ID}, Detail: err.Error()})
+			break
+		}
+		if len(cursor) == 0 {
+			report.Snapshots = append(report.Snapshots, ListSnapshot{Node: s.ID, Seq: resp.Seq, Time: resp.Time})
+		}
+		collect(s.ID, resp.Entries, nil)
+		if cursor = resp.Next; len(cursor) == 0 {
+			audited = append(audited, s.ID)
+			break
+		}
+	}
+	timeout := listTimeout
+	if deep {
+		timeout = verifyDeepTimeout
+	}
+	for _, peer := range s.peerList() {
+		id := peer.Hello().NodeID
+		if !s.capsOf(peer).verify {
+			report.Findings = append(report.Findings, VerifyFinding{Kind: FindingUnaudited, Nodes: []string{id}, Detail: "the node does not support verification"})
+			continue
+		}
+		for cursor := ""; ; {
+			var resp verifyKeysResponse
+			msg := &Message{Payload: MessageVerifyKeys{Cursor: cursor, Limit: pageSize, Deep: deep}}
+			err := s.exchange(peer, msg, &resp, timeout)
+			if err == nil && len(resp.Err) > 0 {
+				err = newRemoteError(resp.Err)
+			}
+			if err != nil {
+				report.Findings = append(report.Findings, VerifyFinding{Kind: FindingUnaudited, Nodes: []string{id}, Detail: err.Error()})
+				break
+			}
+			if len(cursor) == 0 {
+				report.Snapshots = append(report.Snapshots, ListSnapshot{Node: id, Seq: resp.Seq, Time: resp.Time})
+			}
+			collect(id, resp.Entries, resp.Tombstones)
+			if cursor = resp.Next; len(cursor) == 0 {
+				audited = append(audited, id)
+				break
+			}
+		}
+	}
+	report.Nodes = len(audited)
+
+	refs := make([]objectRef, 0, len(objects))
+	for ref, copies := range objects {
+		refs = append(refs, ref)
+		report.Copies += len(copies)
+	}
+	report.Objects = len(refs)
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].owner != refs[j].owner {
+			return refs[i].owner < refs[j].owner
+		}
+		return refs[i].key < refs[j].key
+	})
+	for _, ref := range refs {
+		key := plain[ref]
+		if len(key) == 0 {
+			key = ref.key
+		}
+		finding := func(kind string, nodes []string, detail string) {
+			report.Findings = append(report.Findings, VerifyFinding{Kind: kind, Owner: ref.owner, Key: key, Nodes: nodes, Detail: detail})
+		}
+		copies := objects[ref]
+		if at, ok := deleted[ref]; ok {
+			// Copies written after the deletion belong to a later store of the key.
+			var missed []string
+			live := copies[:0:0]
+			for _, c := range copies {
+				if c.entry.ModTime.After(at) {
+					live = append(live, c)
+				} else {
+					missed = append(missed, c.node)
+				}
+			}
+			if len(missed) > 0 {
+				finding(FindingMissedDelete, missed, fmt.Sprintf("deleted at %s", at.UTC().Format(time.RFC3339)))
+			}
+			copies = live
+		}
+		if len(copies) == 0 {
+			continue
+		}
+
+		var corrupt []string
+		var newest *verifyEntry
+		for i, c := range copies {
+			if c.entry.Corrupt {
+				corrupt = append(corrupt, c.node)
+			}
+			// Owners hold the plaintext, so only replicas are compared with each other.
+			if c.node != ref.owner && (newest == nil || c.entry.Version > newest.Version ||
+				c.entry.Version == newest.Version && c.entry.ModTime.After(newest.ModTime)) {
+				newest = &copies[i].entry
+			}
+		}
+		if len(corrupt) > 0 {
+			finding(FindingCorrupt, corrupt, "the content no longer matches its checksum")
+		}
+		if newest != nil {
+			var divergent []string
+			for _, c := range copies {
+				if c.node != ref.owner && (c.entry.Checksum != newest.Checksum || c.entry.Version != newest.Version) {
+					divergent = append(divergent, c.node)
+				}
+			}
+			if len(divergent) > 0 {
+				finding(FindingDivergent, divergent, fmt.Sprintf("replicas differ from the newest one, version %d written %s", newest.Version, newest.ModTime.UTC().Format(time.RFC3339)))
+			}
+		}
+
+		placed := audited
+		policy, prefix, _ := s.policies.resolve(key)
+		if want := policy.minReplicas(); want > 0 {
+			replicas := 0
+			for _, c := range copies {
+				if c.node != ref.owner {
+					replicas++
+				}
+			}
+			if replicas < want {
+				nodes := make([]string, 0, len(copies))
+				for _, c := range copies {
+					nodes = append(nodes, c.node)
+				}
+				finding(FindingPolicy, nodes, fmt.Sprintf("%d replicas, the policy for %q wants at least %d", replicas, prefix, want))
+			}
+		}
+		if policy.ReplicationFactor > 0 {
+			// The policy checked the replicas; which nodes hold them is up to placement.
+			placed = nil
+		}
+		if pinned := s.pins.nodes(ref); pinned != nil {
+			placed = append([]string{ref.owner}, pinned...)
+		}
+		var missing []string
+		for _, node := range placed {
+			if !slices.Contains(audited, node) || slices.Contains(missing, node) {
+				continue
+			}
+			if !slices.ContainsFunc(copies, func(c heldCopy) bool { return c.node == node }) {
+				missing = append(missing, node)
+			}
+		}
+		if len(missing) > 0 {
+			finding(FindingUnderReplicated, missing, fmt.Sprintf("%d copies, %d expected", len(copies), len(copies)+len(missing)))
+		}
+	}
+	if rate := s.challengeSampleRate(); deep && rate > 0 {
+		challenged := s.ChallengeReplicas(rate)
+		report.Challenged = challenged.Challenged
+		report.Findings = append(report.Findings, challenged.Suspect...)
+	}
+	return report
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCluster(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	c := makeServer(t, ":4002", ":4000")
+	a.VersionedPrefixes = []string{""}
+	a.ListPageSize = 2
+	// Challenges pick objects at random, so they are left out of deep verification here.
+	a.ChallengeSampleRate = -1
+	startCluster(t, a, b, c)
+	waitFor(t, func() bool { return len(a.peerList()) == 2 })
+
+	keys := []string{"ledger", "report", "notes", "photos/cat.jpg"}
+	for _, key := range keys {
+		require.NoError(t, a.Store(key, bytes.NewReader([]byte(key))))
+	}
+	for _, s := range []*FileServer{b, c} {
+		for _, key := range keys {
+			waitFor(t, func() bool {
+				ok, _ := s.Storage.Has(a.ID, crypto.HashKey(key))
+				return ok
+			})
+		}
+	}
+	report := a.VerifyCluster(false)
+	assert.True(t, report.Healthy(), "%+v", report.Findings)
+	assert.Equal(t, 3, report.Nodes)
+	assert.Equal(t, len(keys), report.Objects)
+	assert.Equal(t, 3*len(keys), report.Copies)
+
+	// c holds a stale replica of report and b lost its replica of ledger.
+	_, err := c.Storage.Write(a.ID, crypto.HashKey("report"), bytes.NewReader([]byte("stale")))
+	require.NoError(t, err)
+	require.NoError(t, b.Storage.Delete(a.ID, crypto.HashKey("ledger")))
+
+	report = a.VerifyCluster(true)
+	assert.False(t, report.Healthy())
+	assert.ElementsMatch(t, []VerifyFinding{
+		{Kind: FindingUnderReplicated, Owner: a.ID, Key: "ledger", Nodes: []string{b.ID}, Detail: "2 copies, 3 expected"},
+		{Kind: FindingDivergent, Owner: a.ID, Key: "report", Nodes: []string{c.ID}},
+	}, withoutDetail(report.Findings, FindingDivergent))
+}
+
+// withoutDetail clears the detail of the findings of the given kind, whose text depends on when
+// the objects were written.
+func withoutDetail(findings []VerifyFinding, kind string) []VerifyFinding {
+	for i := range findings {
+		if findings[i].Kind == kind {
+			findings[i].Detail = ""
+		}
+	}
+	return findings
+}
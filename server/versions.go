@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/storage"
+)
+
+// versionTimeout bounds how long GetVersion waits for each peer.
+const versionTimeout = 5 * time.Second
+
+// MessageDeleteVersions asks peers to drop versions of an object pruned by its owner.
+type MessageDeleteVersions struct {
+	ID       string   // Identifier of the node owning the object
+	Key      string   // Hashed key of the object
+	Versions []uint64 // Versions to drop
+}
+
+// MessageGetVersion asks a peer for one version of an object. The receiver answers with a
+// versionResponse.
+type MessageGetVersion struct {
+	ID      string // Identifier of the node owning the object
+	Key     string // Hashed key of the object
+	Version uint64 // Version wanted
+}
+
+// versionResponse is the stream sent in answer to MessageGetVersion.
+type versionResponse struct {
+	Data []byte // Encrypted content of the version
+	Err  string // Why the version could not be sent
+}
+
+// versioned reports whether key matches one of VersionedPrefixes.
+func (s *FileServer) versioned(key string) bool {
+	for _, prefix := range s.VersionedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetVersion retrieves one version of a file, from local storage or, when it is not held
+// locally, from the first peer holding its replica.
+//
+// Parameters:
+//   - key: Key of the file.
+//   - version: Version number, as listed by ListVersions.
+//
+// Returns: A reader the caller must close, and any errors. ErrKeyNotFound means no node
+// holds the version.
+func (s *FileServer) GetVersion(key string, version uint64) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	_, r, err := s.Storage.ReadVersion(s.ID, key, version)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return r, err
+	}
+	msg := &Message{Payload: MessageGetVersion{ID: s.ID, Key: crypto.HashKey(key), Version: version}}
+	for _, peer := range s.peerList() {
+		var resp versionResponse
+		if err := s.exchange(peer, msg, &resp, versionTimeout); err != nil {
+			log.Printf("[%s] fetching version %d of (%s) from (%s): %s", s.Transport.Addr(), version, key, peer.RemoteAddr(), err)
+			continue
+		}
+		if len(resp.Err) > 0 {
+			continue
+		}
+		plain := new(bytes.Buffer)
+		if _, err := crypto.CopyDecrypt(s.dataKey(key), bytes.NewReader(resp.Data), plain); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(plain), nil
+	}
+	return nil, fmt.Errorf("%w: %s version %d", ErrKeyNotFound, key, version)
+}
+
+// ListVersions lists the versions of a file held locally, oldest first. The newest is the
+// content served by Get.
+//
+// Returns: Metadata of every version, empty when the key is not versioned, and any errors.
+func (s *FileServer) ListVersions(key string) ([]storage.Metadata, error) {
+	return s.Storage.Versions(s.ID, key)
+}
+
+// pruneVersions applies the retention policy to a key and asks peers to drop the versions
+// removed locally.
+func (s *FileServer) pruneVersions(key string) {
+	if s.VersionKeepLast <= 0 && s.VersionMaxAge <= 0 {
+		return
+	}
+	pruned, err := s.Storage.PruneVersions(s.ID, key, s.VersionKeepLast, s.VersionMaxAge)
+	if err != nil {
+		log.Printf("[%s] pruning versions of (%s): %s", s.Transport.Addr(), key, err)
+	}
+	if len(pruned) == 0 {
+		return
+	}
+	msg := &Message{Payload: MessageDeleteVersions{ID: s.ID, Key: crypto.HashKey(key), Versions: pruned}}
+	if err := s.sendCoalesced(s.peerList(), msg); err != nil {
+		log.Printf("[%s] propagating pruned versions of (%s): %s", s.Transport.Addr(), key, err)
+	}
+}
+
+// storeReplicaVersion writes a versioned replica announced by msg, keeping the connection
+// aligned with the next message even if the write fails. A version that is not exactly the
+// size announced, or does not match its checksum, is deleted and the sender told why.
+func (s *FileServer) storeReplicaVersion(from string, msg MessageStoreFile, rr *replicaReader) error {
+	meta, err := s.Storage.WriteVersion(msg.ID, msg.Key, msg.Version, rr)
+	err = errors.Join(err, rr.drain())
+	s.receiveStats.record(from, rr.n+rr.extra, s.Clock.Since(rr.started))
+	if err != nil {
+		return err
+	}
+	if serr := rr.misdelivered(msg.Key, msg.Size); serr != nil {
+		s.metrics.misdelivered.Add(1)
+		err = serr
+	} else if meta.Checksum != msg.Checksum {
+		err = fmt.Errorf("replica (%s) version %d: %w", msg.Key, msg.Version, storage.ErrContentCorrupted)
+	}
+	if err != nil {
+		derr := s.Storage.DeleteVersions(msg.ID, msg.Key, []uint64{msg.Version})
+		return s.refuseReplica(from, msg.ID, msg.Key, errors.Join(err, derr), err)
+	}
+	if err := s.markImmutable(msg.ID, msg.Key, msg.Immutable); err != nil {
+		return err
+	}
+	s.objectStored(objectRef{owner: msg.ID, key: msg.Key})
+	fmt.Printf("[%s] written version %d, %d bytes to disk\n", s.Transport.Addr(), msg.Version, meta.Size)
+	return nil
+}
+
+// handleMessageDeleteVersions drops pruned versions of a replica.
+func (s *FileServer) handleMessageDeleteVersions(msg MessageDeleteVersions) error {
+	return s.Storage.DeleteVersions(msg.ID, msg.Key, msg.Versions)
+}
+
+// handleMessageGetVersion answers a MessageGetVersion with the encrypted content of a replica version.
+func (s *FileServer) handleMessageGetVersion(from string, q query, msg MessageGetVersion) error {
+	var resp versionResponse
+	_, r, err := s.Storage.ReadVersion(msg.ID, msg.Key, msg.Version)
+	if err == nil {
+		resp.Data, err = io.ReadAll(r)
+		err = errors.Join(err, r.Close())
+	}
+	if err != nil {
+		resp = versionResponse{Err: err.Error()}
+	}
+	return errors.Join(s.sendValue(from, q, resp), err)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readString reads r to the end and closes it.
+func readString(t *testing.T, r io.ReadCloser) string {
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// replicaVersions returns the version numbers of key that s holds for owner.
+func replicaVersions(t *testing.T, s *FileServer, owner *FileServer, key string) []uint64 {
+	versions, err := s.Storage.Versions(owner.ID, crypto.HashKey(key))
+	require.NoError(t, err)
+	var numbers []uint64
+	for _, v := range versions {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+func TestVersionedOverwriteAndPrune(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	a.VersionedPrefixes = []string{"docs/"}
+	a.VersionKeepLast = 2
+	startCluster(t, a, b)
+
+	key := "docs/readme.md"
+	for _, content := range []string{"draft", "review", "final"} {
+		require.NoError(t, a.Store(key, bytes.NewReader([]byte(content))))
+	}
+	r, err := a.Get(key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "final", string(got))
+
+	versions, err := a.ListVersions(key)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, uint64(2), versions[0].Version)
+	assert.Equal(t, uint64(3), versions[1].Version)
+	rc, err := a.GetVersion(key, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "review", readString(t, rc))
+	_, err = a.GetVersion(key, 1)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// The replica pruned the same version and serves the history the owner lost.
+	waitFor(t, func() bool { return len(replicaVersions(t, b, a, key)) == 2 })
+	assert.Equal(t, []uint64{2, 3}, replicaVersions(t, b, a, key))
+	require.NoError(t, a.Storage.DeleteVersions(a.ID, key, []uint64{2}))
+	rc, err = a.GetVersion(key, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "review", readString(t, rc))
+
+	// Keys outside the versioned prefixes are overwritten in place.
+	require.NoError(t, a.Store("plain", bytes.NewReader([]byte("x"))))
+	versions, err = a.ListVersions("plain")
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestReplicaVersionsOutOfOrder(t *testing.T) {
+	a := makeServer(t, ":4000")
+	b := makeServer(t, ":4001", ":4000")
+	startCluster(t, a, b)
+
+	key := "ledger"
+	for _, v := range []uint64{2, 1} {
+		rep, err := a.prepareReplica(key, bytes.NewReader([]byte{byte('0' + v)}))
+		require.NoError(t, err)
+		rep.version = v
+		_, err = a.replicate(a.peerList(), rep)
+		require.NoError(t, err)
+	}
+	waitFor(t, func() bool { return len(replicaVersions(t, b, a, key)) == 2 })
+	meta, err := b.Storage.Metadata(a.ID, crypto.HashKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), meta.Version)
+
+	// The owner has no copy and pulls the newest version from the replica.
+	r, err := a.Get(key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "2", string(got))
+}
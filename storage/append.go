@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Append adds the content from the reader to the end of the object with the specified key,
+// creating the object when it does not exist. The size and checksum in its metadata are carried
+// on from the hash state saved by the previous append rather than by reading the object again;
+// the first append to an object hashes its content once, and fails with ErrContentCorrupted if
+// it no longer matches its checksum. An object hard-linked by WriteFile or Snapshot is copied
+// first, leaving the file it was linked to intact. When the reader fails the object is cut back
+// to its size before the append. An object stored behind a header is rewritten whole instead, encoded as
+// the store now encodes objects, as is one too short yet to tell whether it would start like a
+// header.
+//
+// Parameters:
+//   - id: Identifier for the storage path.
+//   - key: Key for locating the file.
+//   - r: Reader for the content to append.
+//
+// Returns: Number of bytes appended and any errors.
+func (s *Store) Append(id string, key string, r io.Reader) (n int64, err error) {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	defer s.changed(id, key)
+	meta, h, err := s.appendState(id, key)
+	if err != nil {
+		return 0, err
+	}
+	encoded, err := s.storedEncoded(id, key)
+	if err != nil {
+		return 0, err
+	}
+	cw := &checksumWriter{w: io.Discard, hash: h, n: meta.Size}
+	if encoded || meta.Size < int64(len(objectMagic)) {
+		meta.Stored, err = s.rewriteObject(id, key, func(old io.Reader) io.Reader {
+			return io.MultiReader(old, io.TeeReader(r, cw))
+		})
+		n = cw.n - meta.Size
+	} else {
+		n, err = s.appendFile(id, key, meta, cw, r)
+	}
+	if err != nil {
+		return n, err
+	}
+	sum := cw.metadata()
+	meta.Size, meta.Checksum, meta.ModTime, meta.Linked = sum.Size, sum.Checksum, s.now(), false
+	if meta.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return n, err
+	}
+	if err := s.writeMetadata(id, key, meta); err != nil {
+		return n, err
+	}
+	return n, s.indexKey(id, key)
+}
+
+// Truncate cuts the object with the specified key down to size bytes, or extends it with zeros
+// to size bytes, and records its new size and checksum. The IV recorded with SetReplicaIV is
+// cleared, as content written past the new size must not be encrypted with it again. An object
+// stored behind a header is rewritten whole, encoded as the store now encodes objects.
+//
+// Parameters:
+//   - id: Identifier for the storage path.
+//   - key: Key for locating the file.
+//   - size: Size of the object afterwards.
+//
+// Returns: fs.ErrNotExist if there is no object under the key, and any other errors.
+func (s *Store) Truncate(id string, key string, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("storage: truncating %s to a negative size", key)
+	}
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	defer s.changed(id, key)
+	meta, err := s.Metadata(id, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Objects written before metadata was recorded have none to bring up to date.
+		meta, err = Metadata{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.fullPath(id, key)); err != nil {
+		return err
+	}
+	encoded, err := s.storedEncoded(id, key)
+	if err != nil {
+		return err
+	}
+	if encoded {
+		meta.Stored, err = s.rewriteObject(id, key, func(old io.Reader) io.Reader {
+			// Content past the old end reads as zeros, as a truncated file's does.
+			return io.LimitReader(io.MultiReader(old, zeros{}), size)
+		})
+	} else {
+		err = s.truncateFile(id, key, meta.Linked, size)
+	}
+	if err != nil {
+		return err
+	}
+	h, _, err := s.hashObject(id, key)
+	if err != nil {
+		return err
+	}
+	meta.Size, meta.Checksum = size, hex.EncodeToString(h.Sum(nil))
+	meta.ModTime, meta.Linked, meta.ReplicaIV = s.now(), false, nil
+	if meta.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+	if err := s.writeMetadata(id, key, meta); err != nil {
+		return err
+	}
+	return s.indexKey(id, key)
+}
+
+// appendFile appends the content from r to the end of the object file as it is, through cw,
+// cutting it back to its size in meta when r fails.
+func (s *Store) appendFile(id string, key string, meta Metadata, cw *checksumWriter, r io.Reader) (n int64, err error) {
+	f, err := s.openFileForAppending(id, key, meta.Linked)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// A failed close can mean the data never reached the disk.
+		err = errors.Join(err, s.closeWritten(f))
+	}()
+	cw.w = f
+	n, err = copyPooled(cw, r)
+	if err != nil {
+		return n, errors.Join(err, f.Truncate(meta.Size))
+	}
+	return n, nil
+}
+
+// truncateFile cuts or extends the object file as it is to size bytes.
+func (s *Store) truncateFile(id string, key string, linked bool, size int64) error {
+	f, err := s.openFileForAppending(id, key, linked)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return s.closeWritten(f)
+}
+
+// storedEncoded reports whether the object with the specified key is stored behind a header,
+// false when there is no object.
+func (s *Store) storedEncoded(id string, key string) (bool, error) {
+	f, err := os.Open(s.fullPath(id, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, encoded, err := readHeader(f)
+	return encoded, err
+}
+
+// rewriteObject replaces the object with the specified key by the content returned by content
+// from its current content, empty when there is no object, encoding it as the store now
+// encodes objects. The new content is written to a temporary file renamed over the object, so a
+// failure leaves the object as it was.
+//
+// Returns: The bytes the object takes on disk when stored behind a header, zero otherwise, and
+// any errors.
+func (s *Store) rewriteObject(id string, key string, content func(old io.Reader) io.Reader) (stored int64, err error) {
+	full := s.fullPath(id, key)
+	var old io.ReadCloser = io.NopCloser(strings.NewReader(""))
+	if _, r, err := s.readStream(id, key); err == nil {
+		old = r
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	s.dirMu.RLock()
+	err = os.MkdirAll(filepath.Dir(full), os.ModePerm)
+	var tmp *os.File
+	if err == nil {
+		tmp, err = os.CreateTemp(filepath.Dir(full), filepath.Base(full)+"-*.tmp")
+	}
+	s.dirMu.RUnlock()
+	if err != nil {
+		return 0, errors.Join(err, old.Close())
+	}
+	enc, err := s.newEncoder(s.objectWriter(tmp))
+	if err == nil {
+		_, err = copyPooled(enc, content(old))
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	// The old content is closed before the rename, which some systems refuse over open files.
+	err = errors.Join(err, old.Close(), s.closeWritten(tmp))
+	if err == nil {
+		err = os.Rename(tmp.Name(), full)
+	}
+	if err != nil {
+		return 0, errors.Join(err, ignoreNotExist(os.Remove(tmp.Name())))
+	}
+	return enc.stored(), nil
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+// Read fills p with zeros.
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// appendState returns the metadata of the object with the specified key and the checksum
+// state to carry on from, an empty object's when the object does not exist.
+func (s *Store) appendState(id string, key string) (Metadata, hash.Hash, error) {
+	meta, err := s.Metadata(id, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		ok, err := s.Has(id, key)
+		if err != nil {
+			return meta, nil, err
+		}
+		if ok {
+			// The object predates metadata: hash it as the first append to it.
+			return s.rehashState(id, key, Metadata{})
+		}
+		return Metadata{}, sha256.New(), nil
+	}
+	if err != nil {
+		return meta, nil, err
+	}
+	h := sha256.New()
+	if len(meta.HashState) > 0 && h.(encoding.BinaryUnmarshaler).UnmarshalBinary(meta.HashState) == nil {
+		return meta, h, nil
+	}
+	return s.rehashState(id, key, meta)
+}
+
+// rehashState hashes the content of an object for appending to it, checking it against the
+// checksum in meta if there is one.
+func (s *Store) rehashState(id string, key string, meta Metadata) (Metadata, hash.Hash, error) {
+	h, n, err := s.hashObject(id, key)
+	if err != nil {
+		return meta, nil, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if len(meta.Checksum) > 0 && sum != meta.Checksum {
+		return meta, nil, ErrContentCorrupted
+	}
+	meta.Size, meta.Checksum = n, sum
+	return meta, h, nil
+}
+
+// hashObject returns the checksum state after hashing the content of an object, and the size
+// of the content.
+func (s *Store) hashObject(id string, key string) (hash.Hash, int64, error) {
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := copyPooled(h, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, n, nil
+}
+
+// openFileForAppending opens an object for writing at its end, creating it and its directories
+// when it does not exist. A linked object, or one whose file has other links such as those of a
+// snapshot, is first replaced by a copy of itself.
+func (s *Store) openFileForAppending(id string, key string, linked bool) (*os.File, error) {
+	full := s.fullPath(id, key)
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	if err := os.MkdirAll(filepath.Dir(full), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if linked || sharedObject(full) {
+		if err := unlinkCopy(full); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+// unlinkCopy replaces the file at path by a copy of it, so that writing to it leaves the other
+// links to the file untouched.
+func unlinkCopy(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := copyPooled(tmp, src); err != nil {
+		return errors.Join(err, tmp.Close(), os.Remove(tmp.Name()))
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Join(err, os.Remove(tmp.Name()))
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+// readObject returns the content of an object, failing the test if it cannot be read.
+func readObject(t *testing.T, s *Store, id string, key string) string {
+	t.Helper()
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAll(t, r)
+}
+
+func TestStoreAppend(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	if _, err := s.Write(id, "log", bytes.NewReader([]byte("first;"))); err != nil {
+		t.Fatal(err)
+	}
+	want := "first;"
+	for _, record := range []string{"second;", "", "third;"} {
+		n, err := s.Append(id, "log", bytes.NewReader([]byte(record)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(record)) {
+			t.Errorf("got %d bytes appended want %d", n, len(record))
+		}
+		want += record
+	}
+	if got := readObject(t, s, id, "log"); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+	meta, err := s.Metadata(id, "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len(want)) {
+		t.Errorf("got size %d want %d", meta.Size, len(want))
+	}
+	if err := s.Verify(id, "log"); err != nil {
+		t.Errorf("expected the appended object to verify, got %s", err)
+	}
+
+	// Appending creates missing objects.
+	if _, err := s.Append(id, "new", bytes.NewReader([]byte("created"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, id, "new"); got != "created" {
+		t.Errorf("got %q want %q", got, "created")
+	}
+	if err := s.Verify(id, "new"); err != nil {
+		t.Errorf("expected the created object to verify, got %s", err)
+	}
+}
+
+func TestStoreAppendRefusesCorruptObject(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	if _, err := s.Write(id, "log", bytes.NewReader([]byte("record;"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.fullPath(id, "log"), []byte("rotten;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append(id, "log", bytes.NewReader([]byte("more;"))); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v want %v", err, ErrContentCorrupted)
+	}
+}
+
+func TestStoreAppendFailedReaderLeavesObject(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	if _, err := s.Write(id, "log", bytes.NewReader([]byte("record;"))); err != nil {
+		t.Fatal(err)
+	}
+	broken := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("reader broke")))
+	if _, err := s.Append(id, "log", broken); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	if got := readObject(t, s, id, "log"); got != "record;" {
+		t.Errorf("got %q want %q", got, "record;")
+	}
+	if err := s.Verify(id, "log"); err != nil {
+		t.Errorf("expected the object to verify, got %s", err)
+	}
+}
+
+func TestStoreAppendToLinkedFile(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	path := filepath.Join(t.TempDir(), "source")
+	if err := os.WriteFile(path, []byte("source;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := s.WriteFile(id, "linked", f, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append(id, "linked", bytes.NewReader([]byte("more;"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, id, "linked"); got != "source;more;" {
+		t.Errorf("got %q want %q", got, "source;more;")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "source;" {
+		t.Errorf("the linked file changed to %q", b)
+	}
+}
+
+func TestStoreTruncate(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	if _, err := s.Write(id, "log", bytes.NewReader([]byte("first;second;"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetReplicaIV(id, "log", []byte("0123456789abcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Truncate(id, "log", int64(len("first;"))); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Metadata(id, "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len("first;")) || meta.ReplicaIV != nil {
+		t.Errorf("got %+v want %d bytes and no replica IV", meta, len("first;"))
+	}
+	if _, err := s.Append(id, "log", bytes.NewReader([]byte("other;"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, id, "log"); got != "first;other;" {
+		t.Errorf("got %q want %q", got, "first;other;")
+	}
+	if err := s.Verify(id, "log"); err != nil {
+		t.Errorf("expected the truncated object to verify, got %s", err)
+	}
+	if err := s.Truncate(id, "missing", 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v want %v", err, fs.ErrNotExist)
+	}
+}
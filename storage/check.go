@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CheckReport describes the inconsistencies Check found in the store for one owner, and
+// whether they were repaired.
+//
+// Fields:
+//   - TempFiles: Temporary files in the storage root left behind by interrupted writes.
+//   - Untracked: Keys of intact objects on disk that the key index does not list.
+//   - Missing: Keys the key index lists whose object is not on disk.
+//   - Corrupt: Keys of unindexed objects whose content does not match their metadata, such as
+//     objects cut short by a crash while they were written.
+//   - Repaired: Whether the inconsistencies were repaired: temporary files and corrupt objects
+//     removed, untracked objects indexed and missing ones dropped from the index.
+type CheckReport struct {
+	TempFiles []string `json:"temp_files,omitempty"`
+	Untracked []string `json:"untracked,omitempty"`
+	Missing   []string `json:"missing,omitempty"`
+	Corrupt   []string `json:"corrupt,omitempty"`
+	Repaired  bool     `json:"repaired,omitempty"`
+}
+
+// Clean reports whether the check found nothing wrong.
+func (r CheckReport) Clean() bool {
+	return len(r.TempFiles) == 0 && len(r.Untracked) == 0 && len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// String summarises the report in one line.
+func (r CheckReport) String() string {
+	s := fmt.Sprintf("%d temp files, %d untracked, %d missing, %d corrupt",
+		len(r.TempFiles), len(r.Untracked), len(r.Missing), len(r.Corrupt))
+	if r.Repaired {
+		s += ", repaired"
+	}
+	return s
+}
+
+// Check looks for the inconsistencies an unclean shutdown can leave in the store: temporary
+// files, objects on disk that the key index does not list and index entries whose object is
+// gone. Unindexed objects are re-hashed; those matching their metadata are untracked, the rest
+// corrupt. The store marker is checked against the configured path transform first, and a
+// mismatch is returned as an error wrapping ErrTransformMismatch. Temporary files belong to
+// the whole store, so every owner's report lists them until they are removed.
+//
+// Check must not run alongside writes to the owner's objects.
+//
+// Parameters:
+//   - id: Owner whose objects are checked.
+//   - repair: Whether to repair what is found rather than only report it.
+//
+// Returns: The report and any errors.
+func (s *Store) Check(id string, repair bool) (CheckReport, error) {
+	var report CheckReport
+	if err := s.checkMarker(); err != nil {
+		return report, err
+	}
+	indexed, err := s.Keys(id)
+	if err != nil {
+		return report, err
+	}
+	temps, err := s.tempFiles()
+	if err != nil {
+		return report, err
+	}
+	report.TempFiles = temps
+	onDisk, err := s.describedObjects(id)
+	if err != nil {
+		return report, err
+	}
+	listed := make(map[string]bool, len(indexed))
+	for _, key := range indexed {
+		listed[key] = true
+		if onDisk[key] {
+			continue
+		}
+		// Objects stored before metadata existed are only found by their path.
+		if ok, err := s.Has(id, key); err != nil {
+			return report, err
+		} else if !ok {
+			report.Missing = append(report.Missing, key)
+		}
+	}
+	for key := range onDisk {
+		if listed[key] {
+			continue
+		}
+		switch err := s.Verify(id, key); {
+		case errors.Is(err, ErrContentCorrupted):
+			report.Corrupt = append(report.Corrupt, key)
+		case err != nil:
+			return report, err
+		default:
+			report.Untracked = append(report.Untracked, key)
+		}
+	}
+	sort.Strings(report.Untracked)
+	sort.Strings(report.Corrupt)
+	if !repair || report.Clean() {
+		return report, nil
+	}
+	return report, s.repair(id, &report)
+}
+
+// repair fixes what Check found and marks the report repaired.
+func (s *Store) repair(id string, report *CheckReport) error {
+	var errs []error
+	for _, name := range report.TempFiles {
+		errs = append(errs, ignoreNotExist(os.Remove(filepath.Join(s.Root, name))))
+	}
+	for _, key := range report.Untracked {
+		errs = append(errs, s.indexKey(id, key))
+	}
+	for _, key := range report.Missing {
+		errs = append(errs, s.unindexKey(id, key))
+	}
+	for _, key := range report.Corrupt {
+		// The object was never indexed, so only its files are removed.
+		for _, path := range []string{s.fullPath(id, key), s.metadataPath(id, key)} {
+			errs = append(errs, ignoreNotExist(os.Remove(path)))
+		}
+		s.changed(id, key)
+	}
+	err := errors.Join(errs...)
+	report.Repaired = err == nil
+	return err
+}
+
+// checkMarker verifies that the store marker records the configured path transform and the
+// hash it derives paths with. Stores without a configured transform name or a marker pass.
+func (s *Store) checkMarker() error {
+	if len(s.PathTransformName) == 0 {
+		return nil
+	}
+	marker, err := s.readMarker()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hash := s.PathTransformFunc("").Hash
+	if marker.PathTransform != s.PathTransformName || (len(hash) > 0 && marker.Hash != hash) {
+		return fmt.Errorf("%w: %s records %q with %s paths but %q with %s paths is in use",
+			ErrTransformMismatch, s.Root, marker.PathTransform, marker.Hash, s.PathTransformName, hash)
+	}
+	return nil
+}
+
+// tempFiles returns the names of the temporary files in the storage root: files renamed into
+// place once written, ending in ".tmp", and writability probes left by Init.
+func (s *Store) tempFiles() ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".tmp") || strings.HasPrefix(e.Name(), ".dfs-probe-") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// describedObjects returns the keys of an owner's live objects. Objects stored
+// before metadata existed carry no key and are left out, as are metadata files whose object
+// is gone or lives where the path transform would not place it; GC removes those.
+func (s *Store) describedObjects(id string) (map[string]bool, error) {
+	objects := make(map[string]bool)
+	err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return ignoreNotExist(err)
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metadataSuffix) {
+			return skipReserved(d)
+		}
+		meta, err := readMetadataFile(path)
+		if err != nil || len(meta.Key) == 0 || filepath.Clean(s.metadataPath(id, meta.Key)) != filepath.Clean(path) {
+			return nil
+		}
+		if ok, err := s.Has(id, meta.Key); err != nil || !ok {
+			return err
+		}
+		objects[meta.Key] = true
+		return nil
+	})
+	return objects, ignoreNotExist(err)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// inconsistentStore returns a store, reopened as after a crash, whose owner "owner" has key
+// "c" untracked, "d" untracked and cut short, "b" indexed but missing and a temporary file
+// left in the root.
+func inconsistentStore(t *testing.T) *Store {
+	t.Helper()
+	root := t.TempDir()
+	opts := StoreOpts{Root: root, PathTransformName: CASTransformName}
+	s := NewStore(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	id := "owner"
+	writeKeys(t, s, id, "a", "b")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Objects written by a store that never opened the index database are not in it.
+	writeKeys(t, NewStore(opts), id, "c", "d")
+	if err := os.Remove(s.fullPath(id, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.fullPath(id, "d"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, ".dfs-pending.json.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewStore(opts)
+	if err := reopened.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return reopened
+}
+
+func TestCheckDetects(t *testing.T) {
+	s := inconsistentStore(t)
+	report, err := s.Check("owner", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CheckReport{
+		TempFiles: []string{".dfs-pending.json.tmp"},
+		Untracked: []string{"c"},
+		Missing:   []string{"b"},
+		Corrupt:   []string{"d"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %+v want %+v", report, want)
+	}
+
+	// Detecting changes nothing, so a second check finds the same.
+	again, err := s.Check("owner", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, want) {
+		t.Errorf("got report %+v on the second check want %+v", again, want)
+	}
+}
+
+func TestCheckRepairs(t *testing.T) {
+	s := inconsistentStore(t)
+	report, err := s.Check("owner", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired || report.Clean() {
+		t.Errorf("got report %+v want the inconsistencies found and repaired", report)
+	}
+
+	keys, err := s.Keys("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %q want %q", keys, want)
+	}
+	if ok, err := s.Has("owner", "d"); err != nil || ok {
+		t.Errorf("got %v, %v for the corrupt object want it removed", ok, err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, ".dfs-pending.json.tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v for the temporary file want it removed", err)
+	}
+
+	report, err = s.Check("owner", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("got report %+v after repairing want a clean store", report)
+	}
+}
+
+func TestCheckMarkerMismatch(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeMarker(storeMarker{PathTransform: "other", Hash: HashSHA256}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Check("owner", true); !errors.Is(err, ErrTransformMismatch) {
+		t.Errorf("got %v want %v", err, ErrTransformMismatch)
+	}
+}
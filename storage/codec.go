@@ -0,0 +1,538 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Names of the codecs.
+const (
+	GzipCodec   = "gzip"    // Compresses content, registered by default; parameter "level" is the gzip level, 6 by default
+	AESCTRCodec = "aes-ctr" // Encrypts content at rest with the codec NewEnvelopeCodec returns, once registered; parameter "key" names the key encryption key
+)
+
+// maxHeaderSize bounds the header of an object, so a corrupt length cannot make a reader
+// allocate without limit.
+const maxHeaderSize = 64 << 10
+
+// objectMagic starts the header of an object stored behind one. An object whose file does not
+// start with it is stored as it was written, as every object was before headers existed.
+var objectMagic = [8]byte{0x89, 'D', 'F', 'S', 'O', 'B', 'J', '\n'}
+
+// ContentTransform is one step of encoding the content of objects on disk, such as compressing
+// or encrypting it.
+//
+// Fields:
+//   - ID: Name of the codec applying the step, as registered with RegisterCodec.
+//   - Params: Parameters of the codec. Those configured are completed by the codec for each
+//     object, such as with its own key, and recorded in its header.
+type ContentTransform struct {
+	ID     string            `json:"id"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// KeyFunc returns the key encryption key with the given ID, for codecs encrypting content.
+type KeyFunc func(keyID string) ([]byte, error)
+
+// Codec encodes and decodes content for one kind of ContentTransform.
+type Codec interface {
+	// Prepare completes the configured parameters for encoding one object, such as with a
+	// fresh key, returning those a decoder needs. params must not be modified.
+	Prepare(params map[string]string, keys KeyFunc) (map[string]string, error)
+	// Encode returns a writer encoding content into w with the prepared parameters. Closing it
+	// flushes the encoding without closing w.
+	Encode(w io.Writer, params map[string]string, keys KeyFunc) (io.WriteCloser, error)
+	// Decode returns a reader of the content encoded in r with the given parameters.
+	Decode(r io.Reader, params map[string]string, keys KeyFunc) (io.Reader, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		GzipCodec: gzipCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available under the given ID, replacing any codec previously
+// registered with that ID.
+func RegisterCodec(id string, c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[id] = c
+}
+
+// GetCodec returns the codec registered under the given ID.
+//
+// Returns: The codec and true if the ID is registered, nil and false otherwise.
+func GetCodec(id string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+// codecFor returns the codec of a transform, or an error naming the transform if it is not
+// registered.
+func codecFor(t ContentTransform) (Codec, error) {
+	c, ok := GetCodec(t.ID)
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown content transform %q", t.ID)
+	}
+	return c, nil
+}
+
+// objectHeader is written behind objectMagic and a big-endian uint32 of its encoded length at
+// the front of an object stored behind a header.
+type objectHeader struct {
+	Transforms []ContentTransform `json:"transforms"` // In the order they were applied; empty when the content is stored as is
+}
+
+// writeHeader writes the magic, length and encoding of hdr to w.
+func writeHeader(w io.Writer, hdr objectHeader) error {
+	body, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 0, len(objectMagic)+4+len(body))
+	b = append(b, objectMagic[:]...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	_, err = w.Write(append(b, body...))
+	return err
+}
+
+// readHeader reads the header from the start of an object.
+//
+// Returns: The header and true if the object starts with one, false if it is stored as it
+// was written, and an error wrapping ErrContentCorrupted if the header cannot be read whole.
+func readHeader(r io.Reader) (objectHeader, bool, error) {
+	var hdr objectHeader
+	var magic [len(objectMagic)]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return hdr, false, nil
+		}
+		return hdr, false, err
+	}
+	if magic != objectMagic {
+		return hdr, false, nil
+	}
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return hdr, true, fmt.Errorf("%w: object header cut short", ErrContentCorrupted)
+	}
+	if size > maxHeaderSize {
+		return hdr, true, fmt.Errorf("%w: object header of %d bytes", ErrContentCorrupted, size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return hdr, true, fmt.Errorf("%w: object header cut short", ErrContentCorrupted)
+	}
+	if err := json.Unmarshal(body, &hdr); err != nil {
+		return hdr, true, fmt.Errorf("%w: malformed object header: %v", ErrContentCorrupted, err)
+	}
+	return hdr, true, nil
+}
+
+// Encoding returns the transforms the object with the specified key is encoded with on disk,
+// as its header names them.
+//
+// Returns: The transforms in the order they were applied, none for an object stored as it was
+// written, and any errors.
+func (s *Store) Encoding(id string, key string) ([]ContentTransform, error) {
+	f, err := os.Open(s.fullPath(id, key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hdr, _, err := readHeader(f)
+	return hdr.Transforms, err
+}
+
+// objectEncoder is the writer the content of an object is written to its file through. With
+// transforms configured it writes a header naming them, completed for the object, and encodes
+// the content behind it; otherwise the content is written as it is. Content that starts like a
+// header is then written behind an empty one so it is not mistaken for one, the first bytes
+// being held back until they show whether it does.
+type objectEncoder struct {
+	file    *countingWriter  // The file, counting the bytes written to it
+	w       io.Writer        // Where content is written, nil until its first bytes are seen
+	stages  []io.WriteCloser // Encoders in the order content goes through them
+	pending []byte           // First bytes of content held back
+	encoded bool             // Whether a header was written
+}
+
+// newEncoder returns the encoder for the content of an object written to w, writing its
+// header first when the store encodes objects.
+func (s *Store) newEncoder(w io.Writer) (*objectEncoder, error) {
+	e := &objectEncoder{file: &countingWriter{w: w}}
+	if len(s.ContentTransforms) == 0 {
+		return e, nil
+	}
+	return e, e.start(s.ContentTransforms, s.LookupKey)
+}
+
+// start writes the header for transforms and sets up their encoders.
+func (e *objectEncoder) start(transforms []ContentTransform, keys KeyFunc) error {
+	hdr := objectHeader{Transforms: make([]ContentTransform, len(transforms))}
+	used := make([]Codec, len(transforms))
+	for i, t := range transforms {
+		c, err := codecFor(t)
+		if err != nil {
+			return err
+		}
+		params, err := c.Prepare(t.Params, keys)
+		if err != nil {
+			return fmt.Errorf("storage: preparing content transform %q: %w", t.ID, err)
+		}
+		hdr.Transforms[i], used[i] = ContentTransform{ID: t.ID, Params: params}, c
+	}
+	if err := writeHeader(e.file, hdr); err != nil {
+		return err
+	}
+	e.encoded, e.w = true, e.file
+	e.stages = make([]io.WriteCloser, len(used))
+	for i := len(used) - 1; i >= 0; i-- {
+		stage, err := used[i].Encode(e.w, hdr.Transforms[i].Params, keys)
+		if err != nil {
+			return fmt.Errorf("storage: encoding with content transform %q: %w", hdr.Transforms[i].ID, err)
+		}
+		e.stages[i], e.w = stage, stage
+	}
+	return nil
+}
+
+// Write encodes p into the file.
+func (e *objectEncoder) Write(p []byte) (int, error) {
+	if e.w != nil {
+		return e.w.Write(p)
+	}
+	e.pending = append(e.pending, p...)
+	if len(e.pending) < len(objectMagic) {
+		return len(p), nil
+	}
+	if err := e.flushPending(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flushPending writes the content held back, behind an empty header if it starts like one.
+func (e *objectEncoder) flushPending() error {
+	e.w = e.file
+	if bytes.HasPrefix(e.pending, objectMagic[:]) {
+		if err := e.start(nil, nil); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write(e.pending)
+	e.pending = nil
+	return err
+}
+
+// Close writes any content still held back and flushes the encoders, leaving the file open.
+func (e *objectEncoder) Close() error {
+	if e.w == nil {
+		if err := e.flushPending(); err != nil {
+			return err
+		}
+	}
+	for _, stage := range e.stages {
+		if err := stage.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stored returns the bytes written to the file, header included, for an object stored behind
+// a header, zero for one stored as it was written.
+func (e *objectEncoder) stored() int64 {
+	if !e.encoded {
+		return 0
+	}
+	return e.file.n
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p to the underlying writer, counting the bytes written.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openObject opens the object file at path for reading its content. A file larger than
+// MmapThreshold is read through a memory mapping, or with read calls if it cannot be mapped.
+// A file starting with a header is decoded by the transforms the header names, whichever the
+// store is configured with, and its reader only seeks forward; any other file is read as it
+// is, and its reader also seeks, reads at offsets and writes itself to a writer.
+//
+// Returns: Size of the content, a reader for it, and any errors.
+func (s *Store) openObject(path string) (int64, io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, nil, errors.Join(err, file.Close())
+	}
+	var r io.ReadSeekCloser = file
+	if s.MmapThreshold > 0 && fi.Size() > s.MmapThreshold {
+		if m, err := s.mapReader(file, fi.Size()); err == nil {
+			r = m
+		}
+	}
+	hdr, encoded, err := readHeader(r)
+	if err == nil && !encoded {
+		if _, err = r.Seek(0, io.SeekStart); err == nil {
+			return fi.Size(), r, nil
+		}
+	}
+	if err != nil {
+		return 0, nil, errors.Join(err, r.Close())
+	}
+	dec, err := s.decoder(r, hdr.Transforms)
+	if err != nil {
+		return 0, nil, errors.Join(err, r.Close())
+	}
+	size, err := s.contentSize(path, hdr.Transforms)
+	if err != nil {
+		return 0, nil, errors.Join(err, r.Close())
+	}
+	return size, &decodedReader{Reader: dec, file: r}, nil
+}
+
+// decoder returns a reader of the content encoded in r by transforms, undoing the last
+// applied first.
+func (s *Store) decoder(r io.Reader, transforms []ContentTransform) (io.Reader, error) {
+	for i := len(transforms) - 1; i >= 0; i-- {
+		c, err := codecFor(transforms[i])
+		if err != nil {
+			return nil, err
+		}
+		if r, err = c.Decode(r, transforms[i].Params, s.LookupKey); err != nil {
+			return nil, fmt.Errorf("storage: decoding with content transform %q: %w", transforms[i].ID, err)
+		}
+	}
+	return r, nil
+}
+
+// contentSize returns the size of the content of the object file at path, encoded by
+// transforms, as its metadata records it. Without metadata the content is decoded to count it.
+func (s *Store) contentSize(path string, transforms []ContentTransform) (int64, error) {
+	if meta, err := readMetadataFile(path + metadataSuffix); err == nil {
+		return meta.Size, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, _, err := readHeader(f); err != nil {
+		return 0, err
+	}
+	dec, err := s.decoder(f, transforms)
+	if err != nil {
+		return 0, err
+	}
+	return copyPooled(io.Discard, dec)
+}
+
+// decodedReader reads the content of an object through the decoders of its transforms. As
+// decoders cannot go back, it seeks forward only, reading past the content skipped.
+type decodedReader struct {
+	io.Reader
+	file io.Closer // The object's file, or its mapping
+	pos  int64     // Offset of the next Read in the content
+}
+
+// Read reads decoded content.
+func (d *decodedReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	d.pos += int64(n)
+	return n, err
+}
+
+// Seek moves to an offset in the content at or past the current one. Seeking from the end,
+// or back, is not supported.
+func (d *decodedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	default:
+		return d.pos, errors.New("storage: encoded objects cannot be read from their end")
+	}
+	if offset < d.pos {
+		return d.pos, errors.New("storage: encoded objects cannot be read backwards")
+	}
+	_, err := io.CopyN(io.Discard, d, offset-d.pos)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return d.pos, err
+}
+
+// Close closes the object's file.
+func (d *decodedReader) Close() error {
+	return d.file.Close()
+}
+
+// gzipCodec compresses content with gzip.
+type gzipCodec struct{}
+
+// Prepare fills in the default level and checks the configured one.
+func (gzipCodec) Prepare(params map[string]string, _ KeyFunc) (map[string]string, error) {
+	level := params["level"]
+	if len(level) == 0 {
+		level = "6"
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < gzip.HuffmanOnly || n > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip level %q", level)
+	}
+	return map[string]string{"level": level}, nil
+}
+
+// Encode compresses content into w at the prepared level.
+func (gzipCodec) Encode(w io.Writer, params map[string]string, _ KeyFunc) (io.WriteCloser, error) {
+	level, err := strconv.Atoi(params["level"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip level %q", params["level"])
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// Decode decompresses the content in r.
+func (gzipCodec) Decode(r io.Reader, _ map[string]string, _ KeyFunc) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// EnvelopeCipher encrypts the content of objects for the codec NewEnvelopeCodec returns, each
+// under a key of its own wrapped under a key encryption key. crypto.NewAESEnvelope returns one;
+// the store depends on no particular cipher.
+type EnvelopeCipher interface {
+	// Suite names the cipher suite, recorded with every object encrypted.
+	Suite() string
+	// NewKey generates the key and IV of one object, returning the IV and the key wrapped
+	// under kek, bound to kekID.
+	NewKey(kek []byte, kekID string) (iv []byte, wrapped []byte, err error)
+	// Encrypt returns a writer encrypting into w with the key NewKey wrapped.
+	Encrypt(w io.Writer, kek []byte, kekID string, iv []byte, wrapped []byte) (io.Writer, error)
+	// Decrypt returns a reader decrypting r with the key NewKey wrapped.
+	Decrypt(r io.Reader, kek []byte, kekID string, iv []byte, wrapped []byte) (io.Reader, error)
+}
+
+// envelopeCodec encrypts content with its cipher under a key of its own for every object,
+// recorded in its header wrapped under the key encryption key named by the "key" parameter.
+// Rotating key encryption keys then only needs the old ones kept for reading.
+type envelopeCodec struct {
+	cipher EnvelopeCipher
+}
+
+// NewEnvelopeCodec returns a codec encrypting content with c, to be registered as AESCTRCodec
+// or under a name of its own for another cipher.
+func NewEnvelopeCodec(c EnvelopeCipher) Codec {
+	return envelopeCodec{cipher: c}
+}
+
+// Prepare generates the object's key and IV and wraps the key.
+func (c envelopeCodec) Prepare(params map[string]string, keys KeyFunc) (map[string]string, error) {
+	if suite := params["suite"]; len(suite) > 0 && suite != c.cipher.Suite() {
+		return nil, fmt.Errorf("unsupported cipher suite %q", suite)
+	}
+	kek, err := lookupKEK(params["key"], keys)
+	if err != nil {
+		return nil, err
+	}
+	iv, wrapped, err := c.cipher.NewKey(kek, params["key"])
+	if err != nil {
+		return nil, fmt.Errorf("key encryption key %q: %w", params["key"], err)
+	}
+	return map[string]string{
+		"suite":   c.cipher.Suite(),
+		"key":     params["key"],
+		"iv":      hex.EncodeToString(iv),
+		"wrapped": hex.EncodeToString(wrapped),
+	}, nil
+}
+
+// Encode encrypts content into w.
+func (c envelopeCodec) Encode(w io.Writer, params map[string]string, keys KeyFunc) (io.WriteCloser, error) {
+	kek, iv, wrapped, err := c.objectKey(params, keys)
+	if err != nil {
+		return nil, err
+	}
+	// Hiding Close from the cipher leaves w open when the encoder is closed.
+	enc, err := c.cipher.Encrypt(struct{ io.Writer }{w}, kek, params["key"], iv, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{enc}, nil
+}
+
+// Decode decrypts the content in r.
+func (c envelopeCodec) Decode(r io.Reader, params map[string]string, keys KeyFunc) (io.Reader, error) {
+	kek, iv, wrapped, err := c.objectKey(params, keys)
+	if err != nil {
+		return nil, err
+	}
+	return c.cipher.Decrypt(r, kek, params["key"], iv, wrapped)
+}
+
+// objectKey returns the key encryption key, IV and wrapped key an object was encrypted with.
+func (c envelopeCodec) objectKey(params map[string]string, keys KeyFunc) (kek []byte, iv []byte, wrapped []byte, err error) {
+	if params["suite"] != c.cipher.Suite() {
+		return nil, nil, nil, fmt.Errorf("unsupported cipher suite %q", params["suite"])
+	}
+	if kek, err = lookupKEK(params["key"], keys); err != nil {
+		return nil, nil, nil, err
+	}
+	if iv, err = hex.DecodeString(params["iv"]); err != nil {
+		return nil, nil, nil, errors.New("invalid IV")
+	}
+	if wrapped, err = hex.DecodeString(params["wrapped"]); err != nil {
+		return nil, nil, nil, errors.New("invalid wrapped key")
+	}
+	return kek, iv, wrapped, nil
+}
+
+// lookupKEK returns the key encryption key keyID.
+func lookupKEK(keyID string, keys KeyFunc) ([]byte, error) {
+	if len(keyID) == 0 {
+		return nil, errors.New(`no key encryption key named by the "key" parameter`)
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("no keys to look up key encryption key %q in", keyID)
+	}
+	kek, err := keys(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("looking up key encryption key %q: %w", keyID, err)
+	}
+	return kek, nil
+}
+
+// nopWriteCloser is a writer whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close returns nil.
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+// testKeys holds the key encryption keys of the stores in the conformance tests.
+var testKeys = map[string][]byte{
+	"kek-1": bytes.Repeat([]byte{1}, 32),
+	"kek-2": bytes.Repeat([]byte{2}, 16),
+}
+
+func init() {
+	RegisterCodec(AESCTRCodec, NewEnvelopeCodec(crypto.NewAESEnvelope()))
+}
+
+func lookupTestKey(keyID string) ([]byte, error) {
+	if k, ok := testKeys[keyID]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no key %q", keyID)
+}
+
+// transformCombinations are the encodings objects are written with in the conformance tests.
+var transformCombinations = map[string][]ContentTransform{
+	"none":     nil,
+	"gzip":     {{ID: GzipCodec}},
+	"aes":      {{ID: AESCTRCodec, Params: map[string]string{"key": "kek-1"}}},
+	"gzip+aes": {{ID: GzipCodec, Params: map[string]string{"level": "9"}}, {ID: AESCTRCodec, Params: map[string]string{"key": "kek-2"}}},
+	"aes+gzip": {{ID: AESCTRCodec, Params: map[string]string{"key": "kek-1"}}, {ID: GzipCodec, Params: map[string]string{"level": "1"}}},
+}
+
+// conformanceContents are written under every combination: compressible, incompressible,
+// empty and starting like an object header.
+func conformanceContents() map[string][]byte {
+	random := make([]byte, 100<<10)
+	for i := range random {
+		random[i] = byte(i*7919 + i>>8)
+	}
+	return map[string][]byte{
+		"text":   bytes.Repeat([]byte("the quick brown fox "), 5000),
+		"random": random,
+		"empty":  nil,
+		"magic":  append(objectMagic[:], "not a header"...),
+	}
+}
+
+func checksumOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestContentTransformConformance(t *testing.T) {
+	root := t.TempDir()
+	id := crypto.GenerateID()
+	contents := conformanceContents()
+	for name, transforms := range transformCombinations {
+		writer := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFuncSHA256, ContentTransforms: transforms, LookupKey: lookupTestKey})
+		for kind, content := range contents {
+			key := name + "/" + kind
+			if _, err := writer.Write(id, key, bytes.NewReader(content)); err != nil {
+				t.Fatalf("%s: %s", key, err)
+			}
+		}
+		txKey := name + "/staged"
+		if _, _, err := writer.Stage("tx-"+name, id, txKey, bytes.NewReader(contents["text"])); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Commit("tx-" + name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.WriteNextVersion(id, name+"/versioned", bytes.NewReader(contents["random"])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A store with other defaults, reading through memory mappings too, reads every object by
+	// the transforms its header names.
+	reader := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFuncSHA256, MmapThreshold: 1, LookupKey: lookupTestKey,
+		ContentTransforms: []ContentTransform{{ID: GzipCodec, Params: map[string]string{"level": "3"}}}})
+	for name, transforms := range transformCombinations {
+		want := map[string][]byte{name + "/staged": contents["text"], name + "/versioned": contents["random"]}
+		for kind, content := range contents {
+			want[name+"/"+kind] = content
+		}
+		for key, content := range want {
+			size, r, err := reader.Read(id, key)
+			if err != nil {
+				t.Fatalf("%s: %s", key, err)
+			}
+			got, err := io.ReadAll(r)
+			r.(io.Closer).Close()
+			if err != nil {
+				t.Fatalf("%s: %s", key, err)
+			}
+			if !bytes.Equal(got, content) || size != int64(len(content)) {
+				t.Errorf("%s: got %d bytes sized %d want %d", key, len(got), size, len(content))
+			}
+			if err := reader.Verify(id, key); err != nil {
+				t.Errorf("%s: expected to verify, got %s", key, err)
+			}
+			meta, err := reader.Metadata(id, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Checksum != checksumOf(content) {
+				t.Errorf("%s: checksum is not of the content", key)
+			}
+			encoding, err := reader.Encoding(id, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoding) != len(transforms) {
+				t.Fatalf("%s: got %d transforms in the header want %d", key, len(encoding), len(transforms))
+			}
+			for i := range transforms {
+				if encoding[i].ID != transforms[i].ID {
+					t.Errorf("%s: got transform %q want %q", key, encoding[i].ID, transforms[i].ID)
+				}
+			}
+			if (meta.Stored > 0) != (len(transforms) > 0 || bytes.HasPrefix(content, objectMagic[:])) {
+				t.Errorf("%s: got %d bytes stored behind a header", key, meta.Stored)
+			}
+		}
+		_, r, err := reader.ReadVersion(id, name+"/versioned", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, r); got != string(contents["random"]) {
+			t.Errorf("%s: version 1 differs from what was written", name)
+		}
+	}
+}
+
+func TestContentTransformAppendAndTruncate(t *testing.T) {
+	root := t.TempDir()
+	id := crypto.GenerateID()
+	for name, transforms := range transformCombinations {
+		writer := NewStore(StoreOpts{Root: root, ContentTransforms: transforms, LookupKey: lookupTestKey})
+		other := NewStore(StoreOpts{Root: root, ContentTransforms: transformCombinations["aes"], LookupKey: lookupTestKey})
+		if _, err := writer.Write(id, name, strings.NewReader("first;")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Append(id, name, strings.NewReader("second;")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Append(id, name, strings.NewReader("third;")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readObject(t, other, id, name); got != "first;second;third;" {
+			t.Errorf("%s: got %q after appending", name, got)
+		}
+		if err := other.Truncate(id, name, 25); err != nil {
+			t.Fatal(err)
+		}
+		if got := readObject(t, writer, id, name); got != "first;second;third;\x00\x00\x00\x00\x00\x00" {
+			t.Errorf("%s: got %q after extending", name, got)
+		}
+		if err := writer.Truncate(id, name, 5); err != nil {
+			t.Fatal(err)
+		}
+		if got := readObject(t, other, id, name); got != "first" {
+			t.Errorf("%s: got %q after truncating", name, got)
+		}
+		if err := other.Verify(id, name); err != nil {
+			t.Errorf("%s: expected to verify, got %s", name, err)
+		}
+	}
+}
+
+func TestContentTransformLegacyObjects(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), ContentTransforms: transformCombinations["gzip+aes"], LookupKey: lookupTestKey})
+	id := crypto.GenerateID()
+	// An object written before headers existed has no magic and is read as it is.
+	if err := os.MkdirAll(filepath.Dir(s.fullPath(id, "legacy")), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.fullPath(id, "legacy"), []byte("written long ago"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, id, "legacy"); got != "written long ago" {
+		t.Errorf("got %q", got)
+	}
+	encoding, err := s.Encoding(id, "legacy")
+	if err != nil || encoding != nil {
+		t.Errorf("expected no transforms for a legacy object, got %v, %v", encoding, err)
+	}
+	// Appending to it keeps it as it is.
+	if _, err := s.Append(id, "legacy", strings.NewReader(", appended now")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, id, "legacy"); got != "written long ago, appended now" {
+		t.Errorf("got %q", got)
+	}
+	if encoding, _ := s.Encoding(id, "legacy"); encoding != nil {
+		t.Errorf("expected the appended legacy object to stay as it is, got %v", encoding)
+	}
+}
+
+func TestContentTransformErrors(t *testing.T) {
+	root := t.TempDir()
+	id := crypto.GenerateID()
+	s := NewStore(StoreOpts{Root: root, ContentTransforms: transformCombinations["aes"], LookupKey: lookupTestKey})
+	if _, err := s.Write(id, "secret", strings.NewReader("classified")); err != nil {
+		t.Fatal(err)
+	}
+	// Without the key encryption key the object cannot be read.
+	if _, _, err := NewStore(StoreOpts{Root: root}).Read(id, "secret"); err == nil {
+		t.Error("expected an error reading without keys")
+	}
+	unknown := NewStore(StoreOpts{Root: root, ContentTransforms: []ContentTransform{{ID: "rot13"}}})
+	if _, err := unknown.Write(id, "other", strings.NewReader("text")); err == nil || !strings.Contains(err.Error(), "rot13") {
+		t.Errorf("expected an unknown transform to be refused, got %v", err)
+	}
+
+	// A header cut short is reported as corruption.
+	b, err := os.ReadFile(s.fullPath(id, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.fullPath(id, "secret"), b[:len(objectMagic)+6], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Read(id, "secret"); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v want ErrContentCorrupted", err)
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// copyBufSize is the size of the buffers objects are copied through.
+const copyBufSize = 32 << 10
+
+// copyBufs pools the buffers objects are copied through, sparing an allocation per write.
+var copyBufs = sync.Pool{New: func() any {
+	b := make([]byte, copyBufSize)
+	return &b
+}}
+
+// copyPooled copies src to dst like io.Copy, through a pooled buffer.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// WriteFile saves the content of a file already on disk. With link set the object is a hard
+// link to the file, sharing its blocks rather than copying them; files that cannot be linked,
+// such as those on another filesystem, are copied instead, as are files when the store encodes
+// objects and files starting like an object header. A linked file must not be modified
+// afterwards, as that changes the stored object too, which Verify then reports as corrupt.
+//
+// Parameters:
+//   - id: Identifier for the storage path.
+//   - key: Key for locating the file.
+//   - f: File to store, read from its start whatever its offset.
+//   - link: Whether to hard-link the file when possible.
+//
+// Returns: The metadata recorded for the object, and any errors.
+func (s *Store) WriteFile(id string, key string, f *os.File, link bool) (Metadata, error) {
+	if link && len(s.ContentTransforms) == 0 {
+		if err := s.linkFile(id, key, f); err == nil {
+			return s.Metadata(id, key)
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return Metadata{}, err
+	}
+	if _, err := s.writeObject(id, key, io.NewSectionReader(f, 0, fi.Size()), 0); err != nil {
+		return Metadata{}, err
+	}
+	return s.Metadata(id, key)
+}
+
+// linkFile stores the file as a hard link to it, recording its checksum in the metadata.
+func (s *Store) linkFile(id string, key string, f *os.File) (err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, encoded, err := readHeader(io.NewSectionReader(f, 0, fi.Size())); err != nil || encoded {
+		return errors.Join(err, errors.New("storage: file starts like an object header"))
+	}
+	cw := newChecksumWriter(io.Discard)
+	if _, err := copyPooled(cw, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return err
+	}
+	defer s.changed(id, key)
+	if err := s.linkObject(f.Name(), id, key); err != nil {
+		return err
+	}
+	meta := cw.metadata()
+	meta.Linked = true
+	if err := s.writeMetadata(id, key, meta); err != nil {
+		return err
+	}
+	return s.indexKey(id, key)
+}
+
+// linkObject hard-links the file at path as the object with the specified key, replacing the
+// object held under the key if any.
+func (s *Store) linkObject(path string, id string, key string) error {
+	link := s.link
+	if link == nil {
+		link = os.Link
+	}
+	full := s.fullPath(id, key)
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s/%s", s.Root, id, s.PathTransformFunc(key).PathName), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Remove(full); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := link(path, full); err != nil {
+		return err
+	}
+	return s.syncPath(full)
+}
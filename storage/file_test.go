@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+func TestStoreWriteFile(t *testing.T) {
+	data := bytes.Repeat([]byte("file on disk "), 10000)
+	path := filepath.Join(t.TempDir(), "source")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	source, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("link", func(t *testing.T) {
+		s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+		id := crypto.GenerateID()
+		meta, err := s.WriteFile(id, "linked", f, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Size != int64(len(data)) {
+			t.Errorf("got size %d want %d", meta.Size, len(data))
+		}
+		stored, err := os.Stat(s.fullPath(id, "linked"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(source, stored) {
+			t.Error("expected the object to share the inode of the file")
+		}
+		if err := s.Verify(id, "linked"); err != nil {
+			t.Errorf("expected linked object to verify, got %s", err)
+		}
+
+		// Writing the object again leaves the file alone.
+		if _, err := s.Write(id, "linked", bytes.NewReader([]byte("replaced"))); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Error("expected the linked file to keep its content")
+		}
+	})
+
+	t.Run("copy when linking fails", func(t *testing.T) {
+		s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+		// Stands in for a storage root on another filesystem.
+		s.link = func(string, string) error { return &os.LinkError{Op: "link", Err: syscall.EXDEV} }
+		id := crypto.GenerateID()
+		if _, err := s.WriteFile(id, "copied", f, true); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := os.Stat(s.fullPath(id, "copied"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(source, stored) {
+			t.Error("expected the object to be a copy of the file")
+		}
+		_, r, err := s.ReadVerified(id, "copied")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("got %d bytes want the %d bytes of the file", len(b), len(data))
+		}
+	})
+}
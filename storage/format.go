@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// formatFileName is the file in the storage root recording the on-disk format of the store.
+const formatFileName = "FORMAT"
+
+// formatVersion is the on-disk format this build writes. Stores without a FORMAT file that
+// already hold data are taken to be in format 1.
+//
+//   - 1: Objects laid out loose, some without a metadata sidecar, and no key index.
+//   - 2: Every object named by its key is described by a sidecar, and owners are indexed in
+//     per-owner journals.
+//   - 3: The key index is kept in the index database instead of journals.
+const formatVersion = 3
+
+// Features a store in the current format may record.
+const (
+	FeatureMetadata = "metadata" // Objects are described by metadata sidecars
+	FeatureIndex    = "index"    // The keys of every owner are indexed
+)
+
+// formatFeatures are the features of stores in the current format, which this build reads.
+var formatFeatures = []string{FeatureMetadata, FeatureIndex}
+
+// ErrUnsupportedFormat is returned by Init for a store written by a newer build, whose format
+// version or features this build does not understand.
+var ErrUnsupportedFormat = errors.New("storage: unsupported on-disk format")
+
+// ErrUpgradeRequired is returned by Init for a store in an older format whose upgrade cannot
+// run automatically.
+var ErrUpgradeRequired = errors.New("storage: on-disk format upgrade required")
+
+// Format is the content of the FORMAT file.
+//
+// Fields:
+//   - Version: On-disk format version of the store.
+//   - Features: Features of the store, all of which a build must understand to open it.
+//   - Upgrading: Name of the upgrade under way, left set when one was interrupted.
+type Format struct {
+	Version   int      `json:"version"`
+	Features  []string `json:"features,omitempty"`
+	Upgrading string   `json:"upgrading,omitempty"`
+}
+
+// formatUpgrade moves a store from one format version to the next. Its run must be safe to
+// repeat, so an upgrade interrupted part-way is resumed by running it again.
+type formatUpgrade struct {
+	from      int                                           // Version upgraded from, to from+1
+	name      string                                        // Name the upgrade is logged and reported under
+	automatic bool                                          // Whether Init may run it, rather than only Upgrade
+	run       func(s *Store, dryRun bool) ([]string, error) // Upgrades the store, returning what was or would be changed
+}
+
+// upgrades are the format upgrades in the order they run.
+var upgrades = []formatUpgrade{
+	{from: 1, name: "index", automatic: true, run: (*Store).upgradeToIndex},
+	{from: 2, name: "index-db", automatic: true, run: (*Store).upgradeToIndexDB},
+}
+
+// UpgradeStep describes one upgrade run, or planned by a dry run, by Upgrade.
+//
+// Fields:
+//   - From: Format version the step upgrades from.
+//   - To: Format version the step upgrades to.
+//   - Name: Name of the upgrade.
+//   - Changes: What the step changed, or would change on a dry run.
+type UpgradeStep struct {
+	From    int
+	To      int
+	Name    string
+	Changes []string
+}
+
+// UpgradeReport lists the steps of an upgrade.
+type UpgradeReport struct {
+	From   int
+	To     int
+	DryRun bool
+	Steps  []UpgradeStep
+}
+
+// String renders the report as one line per step followed by its changes.
+func (r UpgradeReport) String() string {
+	if len(r.Steps) == 0 {
+		return fmt.Sprintf("format %d is current", r.From)
+	}
+	var sb strings.Builder
+	verb := "upgraded"
+	if r.DryRun {
+		verb = "would upgrade"
+	}
+	for _, step := range r.Steps {
+		fmt.Fprintf(&sb, "%s from format %d to %d (%s)\n", verb, step.From, step.To, step.Name)
+		for _, change := range step.Changes {
+			fmt.Fprintf(&sb, "  %s\n", change)
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// formatPath returns the location of the FORMAT file.
+func (s *Store) formatPath() string {
+	return filepath.Join(s.Root, formatFileName)
+}
+
+// readFormat loads the FORMAT file. A store without one is in the current format when it
+// holds no data yet and in format 1 otherwise.
+//
+// Returns: The format, whether it was read from the file, and any errors.
+func (s *Store) readFormat() (Format, bool, error) {
+	var format Format
+	b, err := os.ReadFile(s.formatPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		if s.hasUnmarkedData() {
+			return Format{Version: 1}, false, nil
+		}
+		return Format{Version: formatVersion, Features: formatFeatures}, false, nil
+	}
+	if err != nil {
+		return format, false, err
+	}
+	if err := json.Unmarshal(b, &format); err != nil {
+		return format, false, fmt.Errorf("storage: reading %s: %w", s.formatPath(), err)
+	}
+	return format, true, nil
+}
+
+// writeFormat persists the FORMAT file, replacing it in one step.
+func (s *Store) writeFormat(format Format) error {
+	b, err := json.Marshal(format)
+	if err != nil {
+		return err
+	}
+	tmp := s.formatPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.formatPath()); err != nil {
+		return err
+	}
+	return s.syncPath(s.formatPath())
+}
+
+// checkFormat refuses a store in a format this build does not understand and upgrades one in
+// an older format, unless ManualUpgrade is set. A store needing an upgrade that cannot run
+// automatically is refused with ErrUpgradeRequired.
+func (s *Store) checkFormat() error {
+	format, recorded, err := s.readFormat()
+	if err != nil {
+		return err
+	}
+	if format.Version > formatVersion {
+		return fmt.Errorf("%w: %s is in format %d, but this build reads formats up to %d; "+
+			"run a newer build", ErrUnsupportedFormat, s.Root, format.Version, formatVersion)
+	}
+	for _, feature := range format.Features {
+		if !slices.Contains(formatFeatures, feature) {
+			return fmt.Errorf("%w: %s uses feature %q, which this build does not support; "+
+				"run a newer build", ErrUnsupportedFormat, s.Root, feature)
+		}
+	}
+	if format.Version == formatVersion {
+		if recorded {
+			return nil
+		}
+		return s.writeFormat(format)
+	}
+	if s.ManualUpgrade {
+		return nil
+	}
+	for _, u := range upgrades {
+		if u.from >= format.Version && !u.automatic {
+			return fmt.Errorf("%w: %s is in format %d and the %q upgrade to format %d must be run "+
+				"by hand; stop the node and run \"dfsctl upgrade --root %s\"",
+				ErrUpgradeRequired, s.Root, format.Version, u.name, u.from+1, s.Root)
+		}
+	}
+	_, err = s.Upgrade(false)
+	return err
+}
+
+// Upgrade runs the upgrades that bring the store to the current format, in order, recording
+// the version reached in the FORMAT file after each, so an interrupted upgrade resumes from
+// the step it was in. With dryRun nothing is changed and the report lists what would be.
+// Init must have been called first, with ManualUpgrade set for a store whose upgrade cannot
+// run automatically.
+//
+// Returns: The steps run, or planned on a dry run, and any errors.
+func (s *Store) Upgrade(dryRun bool) (UpgradeReport, error) {
+	format, _, err := s.readFormat()
+	if err != nil {
+		return UpgradeReport{}, err
+	}
+	report := UpgradeReport{From: format.Version, To: format.Version, DryRun: dryRun}
+	if len(format.Upgrading) > 0 && !dryRun {
+		log.Printf("storage: resuming the interrupted %q upgrade of %s", format.Upgrading, s.Root)
+	}
+	for _, u := range upgrades {
+		if u.from != format.Version {
+			continue
+		}
+		if !dryRun {
+			log.Printf("storage: upgrading %s from format %d to %d (%s)", s.Root, u.from, u.from+1, u.name)
+			format.Upgrading = u.name
+			if err := s.writeFormat(format); err != nil {
+				return report, err
+			}
+		}
+		changes, err := u.run(s, dryRun)
+		report.Steps = append(report.Steps, UpgradeStep{From: u.from, To: u.from + 1, Name: u.name, Changes: changes})
+		if err != nil {
+			return report, fmt.Errorf("storage: upgrading %s from format %d (%s): %w", s.Root, u.from, u.name, err)
+		}
+		format.Version = u.from + 1
+		report.To = format.Version
+		if !dryRun {
+			format.Upgrading = ""
+			if format.Version == formatVersion {
+				format.Features = formatFeatures
+			}
+			if err := s.writeFormat(format); err != nil {
+				return report, err
+			}
+			log.Printf("storage: upgraded %s to format %d", s.Root, format.Version)
+		}
+	}
+	return report, nil
+}
+
+// upgradeToIndex upgrades a store from the loose layout of format 1. Objects without a
+// metadata sidecar are described by one when their key can be recovered from their path, as
+// with the flat transform; those whose paths hash their keys are left as they are, still
+// readable by key but not listed. The key index of every owner is then rebuilt.
+func (s *Store) upgradeToIndex(dryRun bool) ([]string, error) {
+	ids, err := s.Owners()
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for _, id := range ids {
+		err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return ignoreNotExist(err)
+			}
+			if d.IsDir() || strings.HasSuffix(path, metadataSuffix) {
+				return skipReserved(d)
+			}
+			if _, err := os.Stat(path + metadataSuffix); !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			key, ok := s.looseKey(id, path)
+			if !ok {
+				changes = append(changes, fmt.Sprintf("leave %s: its key cannot be recovered from its path", path))
+				return nil
+			}
+			changes = append(changes, fmt.Sprintf("describe %s/%s", id, key))
+			if dryRun {
+				return nil
+			}
+			return s.describeLoose(id, key, path)
+		})
+		if err != nil {
+			return changes, err
+		}
+	}
+	if dryRun {
+		changes = append(changes, fmt.Sprintf("rebuild the key index of %d owners", len(ids)))
+		return changes, nil
+	}
+	keys, err := s.RebuildIndex()
+	changes = append(changes, fmt.Sprintf("rebuilt the key index of %d owners: %d keys", len(ids), keys))
+	return changes, err
+}
+
+// upgradeToIndexDB moves the key index of format 2 from per-owner journals into the index
+// database, rebuilding it from the metadata on disk, and removes the journals.
+func (s *Store) upgradeToIndexDB(dryRun bool) ([]string, error) {
+	journals, err := filepath.Glob(filepath.Join(s.Root, indexJournalPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return []string{fmt.Sprintf("rebuild the key index into %s and remove %d journals", indexFileName, len(journals))}, nil
+	}
+	keys, err := s.RebuildIndex()
+	return []string{fmt.Sprintf("rebuilt the key index into %s: %d keys, %d journals removed", indexFileName, keys, len(journals))}, err
+}
+
+// looseKey recovers the key of the object at path, held for owner id, by finding the trailing
+// part of the path the transform maps back to it.
+func (s *Store) looseKey(id string, path string) (string, bool) {
+	rel, err := filepath.Rel(filepath.Join(s.Root, id), path)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		key := strings.Join(parts[i:], "/")
+		if filepath.Clean(s.fullPath(id, key)) == filepath.Clean(path) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// describeLoose writes the metadata sidecar of a loose object, dated when the file was last
+// modified.
+func (s *Store) describeLoose(id string, key string, path string) (err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	_, r, err := s.openObject(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, r.Close())
+	}()
+	cw := newChecksumWriter(io.Discard)
+	if _, err := copyPooled(cw, r); err != nil {
+		return err
+	}
+	meta := cw.metadata()
+	meta.Key = key
+	meta.ModTime = fi.ModTime()
+	if _, encoded := r.(*decodedReader); encoded {
+		meta.Stored = fi.Size()
+	}
+	meta.PlainSize = s.plainSize(id, meta.Size)
+	return writeMetadataFile(s.metadataPath(id, key), meta, s.SyncWrites)
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// legacyFixture lays out a store in format 1 under a new root, as builds before key indexes
+// left it with the flat transform: two loose objects without metadata, one described by a
+// sidecar but not indexed, and a file whose key cannot be recovered from its path.
+func legacyFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"owner/notes/notes":           "loose notes",
+		"owner/photos/cat/photos/cat": "loose cat",
+		"owner/report/report":         "described report",
+		"owner/ab/cd/abcdef":          "anonymous",
+		"other/notes/notes":           "another owner's notes",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := Metadata{Key: "report", Size: int64(len("described report"))}
+	if err := writeMetadataFile(filepath.Join(root, "owner", "report", "report"+metadataSuffix), meta, false); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// readFormatFile decodes the FORMAT file of root.
+func readFormatFile(t *testing.T, root string) Format {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(root, formatFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var format Format
+	if err := json.Unmarshal(b, &format); err != nil {
+		t.Fatal(err)
+	}
+	return format
+}
+
+func TestNewStoreRecordsFormat(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	format := readFormatFile(t, root)
+	if format.Version != formatVersion || !slices.Equal(format.Features, formatFeatures) {
+		t.Errorf("got format %+v, want version %d with %v", format, formatVersion, formatFeatures)
+	}
+}
+
+func TestUpgradeDryRun(t *testing.T) {
+	root := legacyFixture(t)
+	s := NewStore(StoreOpts{Root: root, PathTransformName: FlatTransformName, ManualUpgrade: true})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	report, err := s.Upgrade(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.From != 1 || report.To != formatVersion || len(report.Steps) != 2 {
+		t.Fatalf("got report %+v", report)
+	}
+	out := report.String()
+	for _, want := range []string{
+		"would upgrade from format 1 to 2 (index)",
+		"describe owner/notes",
+		"describe owner/photos/cat",
+		"describe other/notes",
+		"leave " + filepath.Join(root, "owner", "ab", "cd", "abcdef"),
+		"rebuild the key index of 2 owners",
+		"would upgrade from format 2 to 3 (index-db)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "describe owner/report") {
+		t.Errorf("the described object is described again:\n%s", out)
+	}
+
+	// Nothing was changed.
+	if _, err := os.Stat(filepath.Join(root, formatFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the dry run wrote the FORMAT file: %v", err)
+	}
+	if _, err := s.Metadata("owner", "notes"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the dry run described an object: %v", err)
+	}
+}
+
+func TestInitUpgradesLegacyLayout(t *testing.T) {
+	root := legacyFixture(t)
+	s := NewStore(StoreOpts{Root: root, PathTransformName: FlatTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	format := readFormatFile(t, root)
+	if format.Version != formatVersion || len(format.Upgrading) > 0 {
+		t.Errorf("got format %+v after the upgrade", format)
+	}
+
+	keys, err := s.Keys("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if want := []string{"notes", "photos/cat", "report"}; !slices.Equal(keys, want) {
+		t.Errorf("got keys %v want %v", keys, want)
+	}
+	// The upgraded store is in the index-DB layout: the keys are in the index database.
+	for _, key := range keys {
+		entry, ok, err := s.Index().Lookup("owner", key)
+		if err != nil || !ok || entry.Meta.Key != key {
+			t.Errorf("got %+v, %v, %v looking %s up in the index database", entry, ok, err, key)
+		}
+	}
+	for key, want := range map[string]string{"notes": "loose notes", "photos/cat": "loose cat"} {
+		if err := s.Verify("owner", key); err != nil {
+			t.Errorf("verifying %s: %s", key, err)
+		}
+		_, r, err := s.Read("owner", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if err != nil || string(got) != want {
+			t.Errorf("read %s: got %q, %v", key, got, err)
+		}
+	}
+	if keys, err := s.Keys("other"); err != nil || !slices.Equal(keys, []string{"notes"}) {
+		t.Errorf("got keys %v, %v for the other owner", keys, err)
+	}
+	// The file whose key is unknown is left where it was.
+	if _, err := os.Stat(filepath.Join(root, "owner", "ab", "cd", "abcdef")); err != nil {
+		t.Error(err)
+	}
+
+	// Opening the store again finds it current.
+	s.Close()
+	s = NewStore(StoreOpts{Root: root, PathTransformName: FlatTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.Upgrade(false)
+	if err != nil || len(report.Steps) > 0 {
+		t.Errorf("got report %+v, %v for a current store", report, err)
+	}
+}
+
+func TestUpgradeResumes(t *testing.T) {
+	root := legacyFixture(t)
+	// A crash during the upgrade leaves it recorded as under way.
+	b, err := json.Marshal(Format{Version: 1, Upgrading: "index"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, formatFileName), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(StoreOpts{Root: root, PathTransformName: FlatTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if format := readFormatFile(t, root); format.Version != formatVersion || len(format.Upgrading) > 0 {
+		t.Errorf("got format %+v after resuming", format)
+	}
+	if ok, err := s.Has("owner", "notes"); err != nil || !ok {
+		t.Errorf("lost an object resuming the upgrade: %v", err)
+	}
+}
+
+func TestInitRefusesNewerFormat(t *testing.T) {
+	for name, format := range map[string]Format{
+		"version": {Version: formatVersion + 1},
+		"feature": {Version: formatVersion, Features: []string{FeatureIndex, "compression"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			b, err := json.Marshal(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, formatFileName), b, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s := NewStore(StoreOpts{Root: root, ManualUpgrade: true})
+			if err := s.Init(); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("got %v, want ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
+
+func TestInitRefusesManualUpgrade(t *testing.T) {
+	saved := upgrades
+	t.Cleanup(func() { upgrades = saved })
+	upgrades = []formatUpgrade{{from: 1, name: "rewrite", run: func(*Store, bool) ([]string, error) {
+		return []string{"rewrite everything"}, nil
+	}}}
+
+	root := legacyFixture(t)
+	s := NewStore(StoreOpts{Root: root, PathTransformName: FlatTransformName})
+	err := s.Init()
+	if !errors.Is(err, ErrUpgradeRequired) || !strings.Contains(err.Error(), "dfsctl upgrade --root") {
+		t.Fatalf("got %v, want ErrUpgradeRequired with instructions", err)
+	}
+
+	// Run by hand, the upgrade goes through.
+	s = NewStore(StoreOpts{Root: root, PathTransformName: FlatTransformName, ManualUpgrade: true})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	report, err := s.Upgrade(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Steps) != 1 || report.Steps[0].Name != "rewrite" {
+		t.Errorf("got report %+v", report)
+	}
+	if format := readFormatFile(t, root); format.Version != 2 {
+		t.Errorf("got format %+v after the upgrade", format)
+	}
+}
+
+func TestInitUpgradesJournaledIndex(t *testing.T) {
+	root := t.TempDir()
+	opts := StoreOpts{Root: root, PathTransformName: CASTransformName}
+	s := NewStore(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, s, "owner", "a", "b")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Format 2 kept the index in per-owner journals rather than the index database.
+	b, err := json.Marshal(Format{Version: 2, Features: formatFeatures})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, formatFileName), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, indexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	journal := filepath.Join(root, indexJournalPrefix+"owner")
+	if err := os.WriteFile(journal, []byte("+\"a\" 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStore(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if format := readFormatFile(t, root); format.Version != formatVersion || len(format.Upgrading) > 0 {
+		t.Errorf("got format %+v after the upgrade", format)
+	}
+	if _, err := os.Stat(journal); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the journal was left behind: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, ok, err := s.Index().Lookup("owner", key); err != nil || !ok {
+			t.Errorf("got %v, %v looking %s up want it indexed", ok, err, key)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultGCGracePeriod is how old an orphaned file must be before GC removes it when
+// StoreOpts.GCGracePeriod is not set.
+const DefaultGCGracePeriod = time.Hour
+
+// GCReport summarises what a GC pass reclaimed.
+//
+// Fields:
+//   - DirsRemoved: Number of empty directories pruned.
+//   - OrphansRemoved: Number of orphaned objects and metadata files removed.
+//   - BytesReclaimed: Total size of the orphaned files removed.
+type GCReport struct {
+	DirsRemoved    int   `json:"dirs_removed"`
+	OrphansRemoved int   `json:"orphans_removed"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+// gcGracePeriod returns the configured grace period, falling back to DefaultGCGracePeriod.
+func (s *Store) gcGracePeriod() time.Duration {
+	if s.GCGracePeriod > 0 {
+		return s.GCGracePeriod
+	}
+	return DefaultGCGracePeriod
+}
+
+// GC reclaims space under the given id. It removes orphans, meaning metadata files whose
+// object is gone and objects whose metadata records a key the path transform places
+// elsewhere, once they are older than the grace period. It then prunes empty directories
+// bottom-up. Objects written before metadata was recorded are never treated as orphans.
+// GC is safe to run alongside reads and writes.
+//
+// Parameters:
+//   - id: Identifier whose objects are collected.
+//
+// Returns: A report of what was reclaimed and any errors.
+func (s *Store) GC(id string) (GCReport, error) {
+	var (
+		report GCReport
+		errs   []error
+		dirs   []string
+		top    = filepath.Join(s.Root, id)
+		// Files are timed by the filesystem, not the store's clock.
+		cutoff = time.Now().Add(-s.gcGracePeriod())
+	)
+	err := filepath.WalkDir(top, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if err := skipReserved(d); err != nil {
+				return err
+			}
+			if path != top {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, metadataSuffix) {
+			return nil
+		}
+		n, err := s.collectOrphan(id, path, cutoff)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if n > 0 {
+			report.OrphansRemoved++
+			report.BytesReclaimed += n
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// WalkDir visits parents before their children, so walking backwards empties directories bottom-up.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if s.removeEmptyDir(dirs[i]) {
+			report.DirsRemoved++
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// collectOrphan removes the metadata file at metaPath, and the object next to it, if they
+// are orphaned and older than cutoff.
+//
+// Returns: Number of bytes reclaimed, zero when nothing was removed, and any errors.
+func (s *Store) collectOrphan(id string, metaPath string, cutoff time.Time) (int64, error) {
+	objectPath := strings.TrimSuffix(metaPath, metadataSuffix)
+	metaInfo, err := os.Stat(metaPath)
+	if err != nil {
+		return 0, ignoreNotExist(err)
+	}
+	if metaInfo.ModTime().After(cutoff) {
+		return 0, nil
+	}
+	objectInfo, err := os.Stat(objectPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return metaInfo.Size(), ignoreNotExist(os.Remove(metaPath))
+	}
+	if err != nil {
+		return 0, err
+	}
+	meta, err := readMetadataFile(metaPath)
+	if err != nil || len(meta.Key) == 0 {
+		// Without a recorded key there is no telling where the object belongs; keep it.
+		return 0, nil
+	}
+	if filepath.Clean(s.fullPath(id, meta.Key)) == filepath.Clean(objectPath) {
+		return 0, nil
+	}
+	if objectInfo.ModTime().After(cutoff) {
+		return 0, nil
+	}
+	if err := os.Remove(objectPath); err != nil {
+		return 0, ignoreNotExist(err)
+	}
+	return objectInfo.Size() + metaInfo.Size(), ignoreNotExist(os.Remove(metaPath))
+}
+
+// removeEmptyDir removes dir if it is empty, excluding writers from creating objects in it meanwhile.
+//
+// Returns: True if the directory was removed.
+func (s *Store) removeEmptyDir(dir string) bool {
+	s.dirMu.Lock()
+	defer s.dirMu.Unlock()
+	// os.Remove refuses to delete a directory that is not empty.
+	return os.Remove(dir) == nil
+}
+
+// Owners returns the identifiers that have objects in the store.
+func (s *Store) Owners() ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		// Dot directories, like the staging area, hold no owner's objects.
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// ignoreNotExist returns nil for errors reporting a missing file, which another writer or
+// deleter may legitimately have removed first.
+func ignoreNotExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
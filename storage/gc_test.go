@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countDirs counts the directories below root, excluding root itself.
+func countDirs(t *testing.T, root string) int {
+	n := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// readKey returns the content stored under key, failing the test if it cannot be read.
+func readKey(t *testing.T, s *Store, id string, key string) []byte {
+	_, r, err := s.ReadVerified(id, key)
+	if err != nil {
+		t.Fatalf("reading %s: %s", key, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %s", key, err)
+	}
+	return b
+}
+
+func TestStoreGCPrunesEmptyDirectories(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	live := []byte("still needed")
+	if _, err := s.Write(id, "live", bytes.NewReader(live)); err != nil {
+		t.Fatal(err)
+	}
+	baseline := countDirs(t, s.Root)
+
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("churn_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(id, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countDirs(t, s.Root); n <= baseline {
+		t.Fatalf("expected deletes to leave empty directories behind, got %d want more than %d", n, baseline)
+	}
+
+	report, err := s.GC(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countDirs(t, s.Root); n != baseline {
+		t.Errorf("got %d directories after GC want %d", n, baseline)
+	}
+	if report.DirsRemoved == 0 || report.OrphansRemoved != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if got := readKey(t, s, id, "live"); !bytes.Equal(got, live) {
+		t.Errorf("got %s want %s", got, live)
+	}
+}
+
+func TestStoreGCRemovesOrphans(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256, GCGracePeriod: time.Minute})
+	id := "owner"
+	for _, key := range []string{"live", "stale", "dangling"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key+" data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A copy of "stale" left at a location its key no longer maps to, and metadata whose object is gone.
+	stalePath := filepath.Join(s.Root, id, "leftover", "stale")
+	if err := os.MkdirAll(filepath.Dir(stalePath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(s.fullPath(id, "stale"), stalePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(s.metadataPath(id, "stale"), stalePath+metadataSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(s.fullPath(id, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.GC(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OrphansRemoved != 0 {
+		t.Fatalf("orphans within the grace period must be kept, got %+v", report)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{stalePath, stalePath + metadataSuffix, s.metadataPath(id, "dangling")} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err = s.GC(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OrphansRemoved != 2 || report.BytesReclaimed == 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err := os.Stat(filepath.Dir(stalePath)); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be pruned, got %v", filepath.Dir(stalePath), err)
+	}
+	if got := readKey(t, s, id, "live"); string(got) != "live data" {
+		t.Errorf("got %s want live data", got)
+	}
+}
+
+func TestStoreGCConcurrentWrites(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := s.GC(id); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("concurrent_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := s.Delete(id, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 1; i < 200; i += 2 {
+		key := fmt.Sprintf("concurrent_%d", i)
+		if got := readKey(t, s, id, key); string(got) != key {
+			t.Errorf("got %s want %s", got, key)
+		}
+	}
+}
+
+func TestStoreUsage(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	for _, id := range []string{"a", "b"} {
+		for _, key := range []string{"one", "three"} {
+			if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	objects, n, err := s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 4 || n != 16 {
+		t.Errorf("got %d objects and %d bytes want 4 and 16", objects, n)
+	}
+}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexFileName is the bbolt database in the storage root that persists the key index.
+const indexFileName = ".dfs-index.db"
+
+// indexLockTimeout bounds the wait for the lock bbolt takes on the database, which only
+// another process holding the root could still have.
+const indexLockTimeout = time.Second
+
+var (
+	keysBucket  = []byte("keys")  // Holds a bucket per owner, mapping its keys to their IndexEntry
+	refsBucket  = []byte("refs")  // Maps content checksums to the number of keys holding that content
+	stateBucket = []byte("state") // Bookkeeping of the index itself
+	openKey     = []byte("open")  // Set in stateBucket while a store has the index open
+	seqKey      = []byte("seq")   // Changes made to the indexed keys, in stateBucket, committed with each change
+)
+
+// Index is the key index of a store persisted in a bbolt database in its root. It records the
+// size and metadata of every indexed object, by owner and key, how many keys hold each
+// content checksum, and how many changes the keys have seen, so the sequence of a
+// KeySnapshot keeps counting across restarts. Store.Init opens it and Store.Close closes it.
+//
+// An object is written to disk first and indexed after, each change committed in a transaction
+// of its own, so a crash in between leaves the index behind the disk. The index is marked open
+// until it is closed; Init finding it still marked, or not finding it at all, rebuilds it
+// from the metadata of the objects on disk with Store.RebuildIndex.
+type Index struct {
+	db *bolt.DB
+}
+
+// IndexEntry is what the index records of an object.
+//
+// Fields:
+//   - Size: Number of bytes the object takes on disk.
+//   - Meta: Metadata of the object as its sidecar recorded it when it was indexed. Objects
+//     stored before metadata existed have none.
+type IndexEntry struct {
+	Size int64    `json:"size"`
+	Meta Metadata `json:"meta"`
+}
+
+// openIndex opens the index database at path, creating it if it is missing, and marks it open.
+// Commits are flushed to disk unless noSync is set.
+//
+// Returns: The index, whether it may be behind the disk because it was just created or was
+// not closed by the last store to open it, and any errors.
+func openIndex(path string, noSync bool) (*Index, bool, error) {
+	_, err := os.Stat(path)
+	stale := errors.Is(err, fs.ErrNotExist)
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: indexLockTimeout, NoSync: noSync})
+	if err != nil {
+		return nil, false, fmt.Errorf("storage: opening index %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, refsBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		state := tx.Bucket(stateBucket)
+		stale = stale || state.Get(openKey) != nil
+		return state.Put(openKey, []byte{1})
+	})
+	if err != nil {
+		return nil, false, errors.Join(fmt.Errorf("storage: opening index %s: %w", path, err), db.Close())
+	}
+	return &Index{db: db}, stale, nil
+}
+
+// close marks the index closed, so the next store to open it trusts it, and closes it.
+func (ix *Index) close() error {
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Delete(openKey)
+	})
+	return errors.Join(err, ix.db.Close())
+}
+
+// Lookup returns the entry of an owner's key.
+//
+// Returns: The entry, whether the key is indexed, and any errors.
+func (ix *Index) Lookup(id string, key string) (IndexEntry, bool, error) {
+	var (
+		entry IndexEntry
+		found bool
+	)
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, found, err = getEntry(tx, id, key)
+		return err
+	})
+	return entry, found, err
+}
+
+// seq returns the number of changes made to the indexed keys.
+func (ix *Index) seq() (uint64, error) {
+	var seq uint64
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(stateBucket).Get(seqKey); v != nil {
+			seq = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return seq, err
+}
+
+// Refs returns how many indexed keys hold content with the given checksum.
+func (ix *Index) Refs(checksum string) (int, error) {
+	var n uint64
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(refsBucket).Get([]byte(checksum)); v != nil {
+			n = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return int(n), err
+}
+
+// lookupAll returns the entries of those of an owner's keys that are indexed, read at once.
+func (ix *Index) lookupAll(id string, keys []string) (map[string]IndexEntry, error) {
+	entries := make(map[string]IndexEntry, len(keys))
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			entry, ok, err := getEntry(tx, id, key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				entries[key] = entry
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// load adds the keys indexed for an owner to o.
+func (ix *Index) load(id string, o *ownerIndex) error {
+	return ix.db.View(func(tx *bolt.Tx) error {
+		owner := tx.Bucket(keysBucket).Bucket([]byte(id))
+		if owner == nil {
+			return nil
+		}
+		return owner.ForEach(func(k []byte, v []byte) error {
+			var entry IndexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("storage: reading index entry (%s) of %s: %w", k, id, err)
+			}
+			o.insert(string(k), entry.Size)
+			return nil
+		})
+	})
+}
+
+// put records the entry of an owner's key, replacing any it had, and seq as the number of
+// changes made to the indexed keys.
+func (ix *Index) put(id string, key string, entry IndexEntry, seq uint64) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		if err := putSeq(tx, seq); err != nil {
+			return err
+		}
+		return putEntry(tx, id, key, entry)
+	})
+}
+
+// update replaces the metadata of an owner's key if it is indexed.
+func (ix *Index) update(id string, key string, meta Metadata) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		entry, ok, err := getEntry(tx, id, key)
+		if err != nil || !ok {
+			return err
+		}
+		entry.Meta = meta
+		return putEntry(tx, id, key, entry)
+	})
+}
+
+// remove forgets an owner's key, recording seq as the number of changes made to the indexed keys.
+func (ix *Index) remove(id string, key string, seq uint64) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		if err := putSeq(tx, seq); err != nil {
+			return err
+		}
+		owner := tx.Bucket(keysBucket).Bucket([]byte(id))
+		if owner == nil {
+			return nil
+		}
+		old, ok, err := getEntry(tx, id, key)
+		if err != nil || !ok {
+			return err
+		}
+		if err := addRef(tx, old.Meta.Checksum, -1); err != nil {
+			return err
+		}
+		return owner.Delete([]byte(key))
+	})
+}
+
+// reset replaces every entry of the index with entries, by owner and key, recording seq as the
+// number of changes made to the indexed keys.
+func (ix *Index) reset(entries map[string]map[string]IndexEntry, seq uint64) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		if err := putSeq(tx, seq); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{keysBucket, refsBucket} {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for id, keys := range entries {
+			for key, entry := range keys {
+				if err := putEntry(tx, id, key, entry); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// putSeq records seq as the number of changes made to the indexed keys within tx.
+func putSeq(tx *bolt.Tx, seq uint64) error {
+	return tx.Bucket(stateBucket).Put(seqKey, binary.BigEndian.AppendUint64(nil, seq))
+}
+
+// getEntry reads the entry of an owner's key within tx.
+func getEntry(tx *bolt.Tx, id string, key string) (IndexEntry, bool, error) {
+	var entry IndexEntry
+	owner := tx.Bucket(keysBucket).Bucket([]byte(id))
+	if owner == nil {
+		return entry, false, nil
+	}
+	v := owner.Get([]byte(key))
+	if v == nil {
+		return entry, false, nil
+	}
+	if err := json.Unmarshal(v, &entry); err != nil {
+		return entry, false, fmt.Errorf("storage: reading index entry (%s) of %s: %w", key, id, err)
+	}
+	return entry, true, nil
+}
+
+// putEntry records the entry of an owner's key within tx, moving the reference the key held
+// on its old content to its new one.
+func putEntry(tx *bolt.Tx, id string, key string, entry IndexEntry) error {
+	owner, err := tx.Bucket(keysBucket).CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	old, ok, err := getEntry(tx, id, key)
+	if err != nil {
+		return err
+	}
+	if !ok || old.Meta.Checksum != entry.Meta.Checksum {
+		if ok {
+			if err := addRef(tx, old.Meta.Checksum, -1); err != nil {
+				return err
+			}
+		}
+		if err := addRef(tx, entry.Meta.Checksum, 1); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return owner.Put([]byte(key), b)
+}
+
+// addRef adds delta to the keys counted as holding content with the given checksum, forgetting
+// the checksum once none does. Objects without a recorded checksum are not counted.
+func addRef(tx *bolt.Tx, checksum string, delta int) error {
+	if len(checksum) == 0 {
+		return nil
+	}
+	refs := tx.Bucket(refsBucket)
+	var n uint64
+	if v := refs.Get([]byte(checksum)); v != nil {
+		n = binary.BigEndian.Uint64(v)
+	}
+	n = uint64(max(int64(n)+int64(delta), 0))
+	if n == 0 {
+		return refs.Delete([]byte(checksum))
+	}
+	return refs.Put([]byte(checksum), binary.BigEndian.AppendUint64(nil, n))
+}
+
+// indexPath returns the location of the index database.
+func (s *Store) indexPath() string {
+	return filepath.Join(s.Root, indexFileName)
+}
+
+// openIndex opens the index database of the store, unless it is open already, noting whether
+// it has to be rebuilt before it can be trusted.
+func (s *Store) openIndex() error {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	if s.index.db != nil {
+		return nil
+	}
+	db, stale, err := openIndex(s.indexPath(), !s.SyncWrites)
+	if err != nil {
+		return err
+	}
+	seq, err := db.seq()
+	if err != nil {
+		return errors.Join(err, db.close())
+	}
+	s.index.db, s.index.stale = db, stale
+	// The sequence goes on from where the last store to open the root left it.
+	s.index.seq = max(s.index.seq, seq)
+	// Owners loaded before Init were scanned from disk; they are loaded from the index instead.
+	s.index.owners = make(map[string]*ownerIndex)
+	return nil
+}
+
+// closeIndex closes the index database, if it is open.
+func (s *Store) closeIndex() error {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	if s.index.db == nil {
+		return nil
+	}
+	db := s.index.db
+	s.index.db = nil
+	s.index.owners = make(map[string]*ownerIndex)
+	return db.close()
+}
+
+// reconcileIndex rebuilds the index if it may be behind the disk. A store in an older format
+// is left to the upgrade, which rebuilds it.
+func (s *Store) reconcileIndex() error {
+	s.index.mu.Lock()
+	stale := s.index.stale
+	s.index.mu.Unlock()
+	if !stale {
+		return nil
+	}
+	if format, _, err := s.readFormat(); err != nil || format.Version < formatVersion {
+		return err
+	}
+	keys, err := s.RebuildIndex()
+	if err != nil {
+		return fmt.Errorf("storage: reconciling the index of %s: %w", s.Root, err)
+	}
+	if keys > 0 {
+		log.Printf("storage: rebuilt the index of %s from the disk: %d keys", s.Root, keys)
+	}
+	return nil
+}
+
+// Index returns the persisted key index of the store, or nil until Init opens it.
+func (s *Store) Index() *Index {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	return s.index.db
+}
+
+// Lookup returns the metadata of those of an owner's keys that are indexed, from the index
+// rather than each object's sidecar, so a listing reads them at once. Plain sizes missing
+// from metadata written before they were recorded are filled in. Before Init, and for
+// objects indexed without metadata, it falls back to Stat.
+//
+// Returns: The metadata by key and any errors.
+func (s *Store) Lookup(id string, keys []string) (map[string]Metadata, error) {
+	db := s.Index()
+	var entries map[string]IndexEntry
+	if db != nil {
+		var err error
+		if entries, err = db.lookupAll(id, keys); err != nil {
+			return nil, err
+		}
+	}
+	metas := make(map[string]Metadata, len(keys))
+	for _, key := range keys {
+		entry, ok := entries[key]
+		if db != nil && !ok {
+			continue
+		}
+		meta := entry.Meta
+		if len(meta.Key) == 0 {
+			var err error
+			if meta, err = s.Stat(id, key); err != nil {
+				continue
+			}
+		}
+		if meta.PlainSize == 0 && meta.Size > 0 {
+			meta.PlainSize = s.plainSize(id, meta.Size)
+		}
+		metas[key] = meta
+	}
+	return metas, nil
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// crashExitCode is what the crash helper exits with from between an object's rename and the
+// index commit.
+const crashExitCode = 3
+
+// TestIndexCrashHelper is run by TestIndexCrashBetweenRenameAndCommit in a process of its own.
+// It opens the store at DFS_CRASH_ROOT and exits, without closing it, once the change named by
+// DFS_CRASH_OP is on disk and before the index database commits it.
+func TestIndexCrashHelper(t *testing.T) {
+	root := os.Getenv("DFS_CRASH_ROOT")
+	if len(root) == 0 {
+		t.Skip("only run by TestIndexCrashBetweenRenameAndCommit")
+	}
+	s := NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.beforeIndex = func(string, string) { os.Exit(crashExitCode) }
+	switch op := os.Getenv("DFS_CRASH_OP"); op {
+	case "write":
+		writeKeys(t, s, "owner", "new")
+	case "delete":
+		if err := s.Delete("owner", "gone"); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown operation %q", op)
+	}
+	t.Fatal("the store should have crashed before indexing the change")
+}
+
+func TestIndexCrashBetweenRenameAndCommit(t *testing.T) {
+	for op, want := range map[string][]string{
+		"write":  {"gone", "kept", "new"},
+		"delete": {"kept"},
+	} {
+		t.Run(op, func(t *testing.T) {
+			root := t.TempDir()
+			opts := StoreOpts{Root: root, PathTransformName: CASTransformName}
+			s := NewStore(opts)
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			writeKeys(t, s, "owner", "kept", "gone")
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestIndexCrashHelper$")
+			cmd.Env = append(os.Environ(), "DFS_CRASH_ROOT="+root, "DFS_CRASH_OP="+op)
+			out, err := cmd.CombinedOutput()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != crashExitCode {
+				t.Fatalf("got %v from the crashing process want exit code %d:\n%s", err, crashExitCode, out)
+			}
+
+			// The database was left open, so the next Init reconciles it with the disk.
+			s = NewStore(opts)
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			keys, err := s.Keys("owner")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("got keys %q after the crash want %q", keys, want)
+			}
+			for _, key := range []string{"gone", "kept", "new"} {
+				entry, ok, err := s.Index().Lookup("owner", key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				held := slices.Contains(want, key)
+				if ok != held {
+					t.Errorf("got %s indexed %v want %v", key, ok, held)
+				} else if ok && entry.Meta.Checksum != checksumOf([]byte(key)) {
+					t.Errorf("got checksum %s for %s want %s", entry.Meta.Checksum, key, checksumOf([]byte(key)))
+				}
+				refs, err := s.Index().Refs(checksumOf([]byte(key)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantRefs := 0
+				if held {
+					wantRefs = 1
+				}
+				if refs != wantRefs {
+					t.Errorf("got %d refs to the content of %s want %d", refs, key, wantRefs)
+				}
+			}
+			if objects, n, err := s.Usage(); err != nil || objects != len(want) {
+				t.Errorf("got %d objects, %d bytes, %v in use want %d objects", objects, n, err, len(want))
+			}
+		})
+	}
+}
+
+func TestIndexRefsAndLookup(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Write("owner", key, bytes.NewReader([]byte("shared"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refs, err := s.Index().Refs(checksumOf([]byte("shared"))); err != nil || refs != 2 {
+		t.Errorf("got %d, %v refs want 2", refs, err)
+	}
+	// Rewriting a key moves its reference to the new content.
+	writeKeys(t, s, "owner", "b")
+	if refs, err := s.Index().Refs(checksumOf([]byte("shared"))); err != nil || refs != 1 {
+		t.Errorf("got %d, %v refs after rewriting want 1", refs, err)
+	}
+	if err := s.Delete("owner", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := s.Index().Refs(checksumOf([]byte("shared"))); err != nil || refs != 0 {
+		t.Errorf("got %d, %v refs after deleting want 0", refs, err)
+	}
+
+	// Metadata set after the write is looked up from the index.
+	if err := s.SetContentType("owner", "b", "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	metas, err := s.Lookup("owner", []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metas["a"]; ok || len(metas) != 1 {
+		t.Errorf("got metadata of %d keys want only b", len(metas))
+	}
+	if meta := metas["b"]; meta.ContentType != "text/plain" || meta.Checksum != checksumOf([]byte("b")) || meta.PlainSize != 1 {
+		t.Errorf("got metadata %+v of b", meta)
+	}
+}
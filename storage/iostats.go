@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// IOOp is a kind of storage operation whose timing the store measures.
+type IOOp string
+
+// Operations measured by the store.
+const (
+	IOWrite        IOOp = "write"         // Objects written with Write
+	IOWriteDecrypt IOOp = "write_decrypt" // Objects decrypted into the store with WriteDecrypt
+	IORead         IOOp = "read"          // Objects opened with Read; reading their content is up to the caller and not timed
+	IODelete       IOOp = "delete"        // Objects removed with Delete
+)
+
+// ioOps is every IOOp, in the order their figures are checked against the thresholds.
+var ioOps = []IOOp{IOWrite, IOWriteDecrypt, IORead, IODelete}
+
+const (
+	// ioSamples is how many recent durations of each kind of operation its p99 is taken over.
+	ioSamples = 128
+	// ioCheckEvery is how many operations of a kind pass between checks of its figures against
+	// SlowIOLatency and SlowIOThroughput, and how many are needed before the first.
+	ioCheckEvery = 16
+	// ioMinRateBytes is the size below which an operation is too short to measure throughput by.
+	ioMinRateBytes = 64 << 10
+	// ioSmoothing is the weight of the newest measurement in the moving averages.
+	ioSmoothing = 0.2
+)
+
+// OpStats describes the recent timing of one kind of storage operation.
+type OpStats struct {
+	Count      int64         `json:"count"`                // Operations measured since the store was created
+	Bytes      int64         `json:"bytes"`                // Bytes they moved
+	Latency    time.Duration `json:"latency"`              // Moving average of their durations
+	P99        time.Duration `json:"p99"`                  // 99th percentile of the durations of the last 128
+	Throughput int64         `json:"throughput,omitempty"` // Moving average of the bytes per second of those moving at least 64 KiB, zero if none did
+}
+
+// IOStats describes the timing of the operations of a store.
+type IOStats struct {
+	Ops      map[IOOp]OpStats `json:"ops"`                // Figures of each kind of operation that ran
+	Degraded string           `json:"degraded,omitempty"` // Why the store's IO counts as slow, empty while it does not
+}
+
+// opMonitor holds the recent timing of one kind of operation.
+type opMonitor struct {
+	count   int64
+	bytes   int64
+	latency float64                  // Moving average of the durations, in nanoseconds
+	rate    float64                  // Moving average of the bytes per second, zero until measured
+	samples [ioSamples]time.Duration // Last durations, oldest overwritten first
+	next    int                      // Index of samples the next duration goes to
+	slow    string                   // Why the operation counts as slow, empty while it does not
+}
+
+// p99 returns the 99th percentile of the recent durations.
+func (o *opMonitor) p99() time.Duration {
+	n := min(o.count, ioSamples)
+	if n == 0 {
+		return 0
+	}
+	sorted := slices.Clone(o.samples[:n])
+	slices.Sort(sorted)
+	return sorted[(n*99+99)/100-1]
+}
+
+// stats returns the figures of the operation.
+func (o *opMonitor) stats() OpStats {
+	return OpStats{
+		Count:      o.count,
+		Bytes:      o.bytes,
+		Latency:    time.Duration(o.latency),
+		P99:        o.p99(),
+		Throughput: int64(o.rate),
+	}
+}
+
+// ioMonitor measures the operations of a store and tells when they turn slow.
+type ioMonitor struct {
+	mu       sync.Mutex
+	ops      map[IOOp]*opMonitor
+	degraded string // Why the store's IO counts as slow, empty while it does not
+}
+
+// newIOMonitor returns a monitor that measured nothing yet.
+func newIOMonitor() *ioMonitor {
+	return &ioMonitor{ops: make(map[IOOp]*opMonitor)}
+}
+
+// record folds an operation of n bytes that took d into the figures of op, checking them
+// against the thresholds every ioCheckEvery operations; zero thresholds are not checked.
+//
+// Returns: Why the store's IO counts as slow afterwards, and whether that changed.
+func (m *ioMonitor) record(op IOOp, n int64, d time.Duration, maxP99 time.Duration, minRate int64) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.ops[op]
+	if !ok {
+		o = new(opMonitor)
+		m.ops[op] = o
+	}
+	o.count++
+	o.bytes += n
+	o.samples[o.next] = d
+	o.next = (o.next + 1) % ioSamples
+	if o.count == 1 {
+		o.latency = float64(d)
+	} else {
+		o.latency += ioSmoothing * (float64(d) - o.latency)
+	}
+	if n >= ioMinRateBytes && d > 0 {
+		rate := float64(n) / d.Seconds()
+		if o.rate == 0 {
+			o.rate = rate
+		} else {
+			o.rate += ioSmoothing * (rate - o.rate)
+		}
+	}
+	if o.count%ioCheckEvery != 0 {
+		return m.degraded, false
+	}
+	o.slow = ""
+	if p99 := o.p99(); maxP99 > 0 && p99 > maxP99 {
+		o.slow = fmt.Sprintf("p99 %s latency of %s is past %s", op, p99, maxP99)
+	} else if minRate > 0 && o.rate > 0 && int64(o.rate) < minRate {
+		o.slow = fmt.Sprintf("%s throughput of %d bytes/s is below %d", op, int64(o.rate), minRate)
+	}
+	was := m.degraded
+	m.degraded = ""
+	for _, op := range ioOps {
+		if o, ok := m.ops[op]; ok && len(o.slow) > 0 {
+			m.degraded = o.slow
+			break
+		}
+	}
+	return m.degraded, m.degraded != was
+}
+
+// stats returns the figures of every kind of operation measured.
+func (m *ioMonitor) stats() IOStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := IOStats{Ops: make(map[IOOp]OpStats, len(m.ops)), Degraded: m.degraded}
+	for op, o := range m.ops {
+		stats.Ops[op] = o.stats()
+	}
+	return stats
+}
+
+// waitedReader counts the time spent waiting for the content of an object, such as a replica
+// arriving from a peer, which is not the disk's to answer for.
+type waitedReader struct {
+	r      io.Reader
+	clock  clock.Clock // The store's IOClock
+	waited time.Duration
+}
+
+func (w *waitedReader) Read(p []byte) (int, error) {
+	start := w.clock.Now()
+	n, err := w.r.Read(p)
+	w.waited += w.clock.Since(start)
+	return n, err
+}
+
+// measure records an operation of n bytes started at start that failed with err, unless it
+// failed, less the time it waited for its content. Its duration is taken from IOClock rather
+// than Clock, as it times the disk. A change to whether the store's IO is slow is
+// logged and passed to OnSlowIO.
+func (s *Store) measure(op IOOp, start time.Time, waited time.Duration, n int64, err error) {
+	if s.io == nil || err != nil {
+		return
+	}
+	degraded, changed := s.io.record(op, n, s.ioClock().Since(start)-waited, s.SlowIOLatency, s.SlowIOThroughput)
+	if !changed {
+		return
+	}
+	if len(degraded) > 0 {
+		log.Printf("storage IO of %s is slow: %s", s.Root, degraded)
+	} else {
+		log.Printf("storage IO of %s is no longer slow", s.Root)
+	}
+	if s.OnSlowIO != nil {
+		s.OnSlowIO(degraded)
+	}
+}
+
+// ioClock returns the clock the store's operations are timed by.
+func (s *Store) ioClock() clock.Clock {
+	return clock.Or(s.IOClock)
+}
+
+// Stats returns the recent timing of the store's writes, reads and deletes, and whether its IO
+// counts as slow by SlowIOLatency and SlowIOThroughput.
+func (s *Store) Stats() IOStats {
+	if s.io == nil {
+		return IOStats{Ops: map[IOOp]OpStats{}}
+	}
+	return s.io.stats()
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// slowDisk makes every write take 50ms on the store's IO clock while slow is set, as a failing
+// disk does.
+type slowDisk struct {
+	w     io.Writer
+	slow  *atomic.Bool
+	clock *clock.Fake
+}
+
+func (d slowDisk) Write(p []byte) (int, error) {
+	if d.slow.Load() {
+		d.clock.Advance(50 * time.Millisecond)
+	}
+	return d.w.Write(p)
+}
+
+func TestSlowIOIsDetected(t *testing.T) {
+	var slow atomic.Bool
+	var mu sync.Mutex
+	var events []string
+	ioClock := clock.NewFake(time.Now())
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFuncSHA256,
+		IOClock:           ioClock,
+		WrapWrites:        func(w io.Writer) io.Writer { return slowDisk{w: w, slow: &slow, clock: ioClock} },
+		SlowIOLatency:     25 * time.Millisecond,
+		OnSlowIO: func(reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, reason)
+		},
+	})
+	write := func(n int) {
+		t.Helper()
+		for i := range n {
+			if _, err := s.Write("owner", fmt.Sprintf("key-%d", i), bytes.NewReader([]byte("content"))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write(ioSamples)
+	if stats := s.Stats(); len(stats.Degraded) > 0 {
+		t.Fatalf("a healthy disk counts as slow: %s", stats.Degraded)
+	}
+	slow.Store(true)
+	write(ioCheckEvery)
+	stats := s.Stats()
+	if !strings.Contains(stats.Degraded, "p99 write latency") {
+		t.Fatalf("got degraded %q, want the write latency named", stats.Degraded)
+	}
+	if w := stats.Ops[IOWrite]; w.Count != ioSamples+ioCheckEvery || w.P99 != 50*time.Millisecond {
+		t.Errorf("got write figures %+v", w)
+	}
+
+	// Once the slow writes have aged out of the samples the store recovers.
+	slow.Store(false)
+	write(ioSamples)
+	if stats := s.Stats(); len(stats.Degraded) > 0 {
+		t.Errorf("the disk still counts as slow after it recovered: %s", stats.Degraded)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || len(events[0]) == 0 || len(events[1]) > 0 {
+		t.Errorf("got OnSlowIO events %q, want one when slow and one when recovered", events)
+	}
+}
+
+func TestSlowThroughputIsDetected(t *testing.T) {
+	var slow atomic.Bool
+	slow.Store(true)
+	ioClock := clock.NewFake(time.Now())
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFuncSHA256,
+		IOClock:           ioClock,
+		WrapWrites:        func(w io.Writer) io.Writer { return slowDisk{w: w, slow: &slow, clock: ioClock} },
+		SlowIOThroughput:  1 << 30,
+	})
+	data := bytes.Repeat([]byte("x"), ioMinRateBytes)
+	for i := range ioCheckEvery {
+		if _, err := s.Write("owner", fmt.Sprint(i), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := s.Stats()
+	if !strings.Contains(stats.Degraded, "write throughput") {
+		t.Errorf("got degraded %q, want the write throughput named", stats.Degraded)
+	}
+	// Every object reached the disk in writes of copyBufSize, each taking the 50ms injected.
+	want := int64(copyBufSize * 20)
+	if w := stats.Ops[IOWrite]; w.Throughput != want {
+		t.Errorf("got throughput %d want %d", w.Throughput, want)
+	}
+	if _, _, err := s.Read("owner", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("owner", "0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []IOOp{IORead, IODelete} {
+		if s.Stats().Ops[op].Count != 1 {
+			t.Errorf("%s was not measured", op)
+		}
+	}
+}
+
+// BenchmarkWrite guards the cost of measuring writes; compare it with
+// BenchmarkWriteUnmeasured.
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, true)
+}
+
+// BenchmarkWriteUnmeasured is the baseline for BenchmarkWrite.
+func BenchmarkWriteUnmeasured(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+func benchmarkWrite(b *testing.B, measured bool) {
+	s := NewStore(StoreOpts{Root: b.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	if !measured {
+		s.io = nil
+	}
+	data := make([]byte, 4<<10)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Write("owner", fmt.Sprint(i%64), bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// linksCounted tells whether the hard links of a file can be counted on this platform; it
+// cannot be here, so snapshots copy objects rather than linking them.
+const linksCounted = false
+
+// hasOtherLinks cannot count the links of a file on this platform, and reports none.
+func hasOtherLinks(fi os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// linksCounted tells whether the hard links of a file can be counted on this platform.
+const linksCounted = true
+
+// hasOtherLinks reports whether the file described by fi has more than one hard link.
+func hasOtherLinks(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
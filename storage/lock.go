@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file in the storage root that the process using the store holds locked.
+const lockFileName = ".dfs-lock"
+
+// ErrRootLocked is returned by Init when another process holds the storage root.
+var ErrRootLocked = errors.New("storage root already in use")
+
+// errLockHeld is returned by lockFile when another open file holds the lock.
+var errLockHeld = errors.New("lock held")
+
+// lockOwner is the content of the lock file, identifying the process holding the root.
+type lockOwner struct {
+	PID      int    `json:"pid"`
+	Hostname string `json:"hostname"`
+}
+
+// String describes the owner for error messages.
+func (o lockOwner) String() string {
+	return fmt.Sprintf("PID %d on %s", o.PID, o.Hostname)
+}
+
+// lockPath returns the location of the lock file.
+func (s *Store) lockPath() string {
+	return filepath.Join(s.Root, lockFileName)
+}
+
+// lockRoot takes an exclusive lock on the storage root, recording this process in the lock
+// file, so that two processes never use one root at once. The operating system releases the
+// lock when its holder exits, so a lock file left by a crash is simply taken over. A root still
+// locked by a process that no longer runs on this host, as can happen when the lock outlives
+// its holder on a network filesystem, is only taken over when ForceUnlock is set.
+func (s *Store) lockRoot() error {
+	if s.lock != nil {
+		return nil
+	}
+	f, err := os.OpenFile(s.lockPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("storage: opening lock %s: %w", s.lockPath(), err)
+	}
+	err = lockFile(f)
+	if errors.Is(err, errLockHeld) {
+		f, err = s.contendLock(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	hostname, _ := os.Hostname()
+	b, err := json.Marshal(lockOwner{PID: os.Getpid(), Hostname: hostname})
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(b, 0)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("storage: writing lock %s: %w", s.lockPath(), err), unlockFile(f), f.Close())
+	}
+	s.lock = f
+	return nil
+}
+
+// contendLock handles a lock held by another open file. The holder is reported unless
+// ForceUnlock is set and it is a process on this host that is no longer alive, in which case
+// the lock file is replaced by a new one, locked by this process.
+func (s *Store) contendLock(f *os.File) (*os.File, error) {
+	owner, err := readLockOwner(f)
+	if err != nil {
+		return f, fmt.Errorf("%w by an unknown process (%s): %w", ErrRootLocked, s.Root, err)
+	}
+	hostname, _ := os.Hostname()
+	if !s.ForceUnlock {
+		return f, fmt.Errorf("%w by %s (%s); if that process has crashed, force the unlock",
+			ErrRootLocked, owner, s.Root)
+	}
+	if owner.Hostname != hostname || processAlive(owner.PID) {
+		return f, fmt.Errorf("%w by %s (%s), which may still be running; refusing to force the unlock",
+			ErrRootLocked, owner, s.Root)
+	}
+	f.Close()
+	if err := os.Remove(s.lockPath()); err != nil {
+		return nil, fmt.Errorf("storage: removing stale lock %s: %w", s.lockPath(), err)
+	}
+	f, err = os.OpenFile(s.lockPath(), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("storage: replacing stale lock %s: %w", s.lockPath(), err)
+	}
+	if err := lockFile(f); err != nil {
+		return f, fmt.Errorf("%w (%s): %w", ErrRootLocked, s.Root, err)
+	}
+	fmt.Printf("storage: took over the lock on %s from %s, which is no longer running\n", s.Root, owner)
+	return f, nil
+}
+
+// readLockOwner reads the process recorded in a lock file.
+func readLockOwner(f *os.File) (lockOwner, error) {
+	var owner lockOwner
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<10))
+	if err != nil {
+		return owner, err
+	}
+	return owner, json.Unmarshal(b, &owner)
+}
+
+// Close closes the index database opened by Init and releases the lock on the storage root.
+// The store must not be used by this process once it is closed, since another process may
+// then take the root over.
+//
+// Returns: Any errors closing the index or releasing the lock.
+func (s *Store) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	// The index database is closed while the root is still held, so no other store opens it first.
+	err := s.closeIndex()
+	f := s.lock
+	s.lock = nil
+	return errors.Join(err, unlockFile(f), f.Close())
+}
@@ -0,0 +1,20 @@
+//go:build !unix && !windows
+
+package storage
+
+import "os"
+
+// lockFile does nothing on platforms without file locks; the lock file only records the holder.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing on platforms without file locks.
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+// processAlive assumes the process is alive, since its liveness cannot be checked.
+func processAlive(pid int) bool {
+	return true
+}
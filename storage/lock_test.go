@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// deadPID returns the PID of a process that has exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// writeLockOwner records owner in the lock file of root, as its holder would.
+func writeLockOwner(t *testing.T, root string, owner lockOwner) {
+	t.Helper()
+	b, err := json.Marshal(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(root, lockFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitLocksRoot(t *testing.T) {
+	root := t.TempDir()
+	first := NewStore(StoreOpts{Root: root})
+	if err := first.Init(); err != nil {
+		t.Fatal(err)
+	}
+	second := NewStore(StoreOpts{Root: root})
+	err := second.Init()
+	if !errors.Is(err, ErrRootLocked) {
+		t.Fatalf("got %v want %v", err, ErrRootLocked)
+	}
+	if want := fmt.Sprintf("storage root already in use by PID %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q want it to contain %q", err, want)
+	}
+	if err := first.Init(); err != nil {
+		t.Errorf("reinitialising the store holding the lock should succeed, got %s", err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Init(); err != nil {
+		t.Fatalf("the root should be free once closed, got %s", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitTakesOverLockOfExitedProcess(t *testing.T) {
+	root := t.TempDir()
+	hostname, _ := os.Hostname()
+	// A crashed process leaves its lock file behind, but not the lock.
+	writeLockOwner(t, root, lockOwner{PID: deadPID(t), Hostname: hostname})
+	s := NewStore(StoreOpts{Root: root})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	owner, err := readLockOwner(s.lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.PID != os.Getpid() {
+		t.Errorf("got lock owner %s want PID %d", owner, os.Getpid())
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	root := t.TempDir()
+	hostname, _ := os.Hostname()
+	holder := NewStore(StoreOpts{Root: root})
+	if err := holder.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+
+	// A live holder is never forced out.
+	forced := NewStore(StoreOpts{Root: root, ForceUnlock: true})
+	if err := forced.Init(); !errors.Is(err, ErrRootLocked) {
+		t.Fatalf("got %v want %v", err, ErrRootLocked)
+	}
+
+	// The lock outlived a process that no longer runs, which left the index database unlocked.
+	if err := holder.closeIndex(); err != nil {
+		t.Fatal(err)
+	}
+	writeLockOwner(t, root, lockOwner{PID: deadPID(t), Hostname: hostname})
+	if err := NewStore(StoreOpts{Root: root}).Init(); !errors.Is(err, ErrRootLocked) {
+		t.Fatalf("got %v without forcing the unlock want %v", err, ErrRootLocked)
+	}
+	if err := forced.Init(); err != nil {
+		t.Fatalf("forcing the unlock of a dead holder should succeed, got %s", err)
+	}
+	defer forced.Close()
+	if err := NewStore(StoreOpts{Root: root}).Init(); !errors.Is(err, ErrRootLocked) {
+		t.Errorf("got %v want the forced lock to be held", err)
+	}
+}
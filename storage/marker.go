@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// markerFileName is the file in the storage root recording how the store was laid out.
+const markerFileName = ".dfs-store"
+
+// ErrTransformMismatch is returned by Init when the configured path transform differs
+// from the one the store was created with.
+var ErrTransformMismatch = errors.New("storage: path transform does not match the existing store")
+
+// storeMarker is the content of the marker file. Markers written before the hash was
+// recorded, like stores created before markers existed, describe SHA-1 layouts.
+type storeMarker struct {
+	PathTransform string `json:"path_transform"`
+	Hash          string `json:"hash,omitempty"`
+	Version       int    `json:"version,omitempty"`
+}
+
+// markerPath returns the location of the marker file.
+func (s *Store) markerPath() string {
+	return fmt.Sprintf("%s/%s", s.Root, markerFileName)
+}
+
+// Init prepares the store for use, checking in order:
+//
+//  1. The root: made absolute, created if missing, and refused unless it is a writable
+//     directory outside system paths.
+//  2. The lock: the root is held until Close; one another process holds is refused with
+//     ErrRootLocked.
+//  3. The path transform: a configured PathTransformName must match the store marker, which a
+//     new store gets written; a mismatch is refused with ErrTransformMismatch. A store
+//     recorded with SHA-1 keeps its SHA-1 paths until MigrateHash.
+//  4. The index database: opened, and created if missing.
+//  5. The FORMAT file: a newer format is refused with ErrUnsupportedFormat, an older one is
+//     upgraded, or refused with ErrUpgradeRequired when its upgrade must be run by hand.
+//  6. The index again: rebuilt from the disk if it is new or was not closed cleanly.
+func (s *Store) Init() (err error) {
+	if err := s.prepareRoot(); err != nil {
+		return err
+	}
+	if err := s.lockRoot(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, s.Close())
+		}
+	}()
+	if err := s.checkTransform(); err != nil {
+		return err
+	}
+	if err := s.openIndex(); err != nil {
+		return err
+	}
+	if err := s.checkFormat(); err != nil {
+		return err
+	}
+	return s.reconcileIndex()
+}
+
+// checkTransform checks the configured PathTransformName against the store marker, writing
+// the marker for a new store, and switches to the hash the store derives paths with.
+func (s *Store) checkTransform() error {
+	if len(s.PathTransformName) == 0 {
+		return nil
+	}
+	fn, ok := GetPathTransform(s.PathTransformName)
+	if !ok {
+		return fmt.Errorf("storage: unknown path transform %q", s.PathTransformName)
+	}
+	hash := fn("").Hash
+	marker, err := s.readMarker()
+	if errors.Is(err, fs.ErrNotExist) {
+		marker = storeMarker{PathTransform: s.PathTransformName, Hash: hash, Version: formatVersion}
+		if hash == HashSHA256 && s.hasUnmarkedData() {
+			marker.Hash = HashSHA1
+		}
+		if err := s.useHash(marker.Hash); err != nil {
+			return err
+		}
+		return s.writeMarker(marker)
+	}
+	if err != nil {
+		return err
+	}
+	if marker.PathTransform != s.PathTransformName {
+		return fmt.Errorf("%w: %s was created with %q but %q is configured; open it with %q, "+
+			"or stop the node and run: dfsctl migrate --root %s --from %s --to %s",
+			ErrTransformMismatch, s.Root, marker.PathTransform, s.PathTransformName, marker.PathTransform,
+			s.Root, marker.PathTransform, s.PathTransformName)
+	}
+	return s.useHash(marker.Hash)
+}
+
+// useHash switches the store to the variant of its named transform that derives paths with
+// the given hash, which is a no-op when the configured transform already uses it or does
+// not hash keys at all.
+func (s *Store) useHash(hash string) error {
+	current := s.PathTransformFunc("").Hash
+	if len(current) == 0 || current == hash {
+		return nil
+	}
+	name := s.PathTransformName
+	if hash == HashSHA1 {
+		name = LegacyTransformName(name)
+	}
+	fn, ok := GetPathTransform(name)
+	if !ok || fn("").Hash != hash {
+		return fmt.Errorf("%w: %s uses %s paths but transform %q has no %s variant",
+			ErrTransformMismatch, s.Root, hash, s.PathTransformName, hash)
+	}
+	s.PathTransformFunc = fn
+	return nil
+}
+
+// hasUnmarkedData reports whether the root already holds objects written before the store
+// marker existed, which were laid out with SHA-1 and loose.
+func (s *Store) hasUnmarkedData() bool {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case lockFileName, markerFileName, formatFileName, indexFileName:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// readMarker loads the store marker, treating a marker without a hash as SHA-1.
+func (s *Store) readMarker() (storeMarker, error) {
+	var marker storeMarker
+	b, err := os.ReadFile(s.markerPath())
+	if err != nil {
+		return marker, err
+	}
+	if err := json.Unmarshal(b, &marker); err != nil {
+		return marker, fmt.Errorf("storage: reading marker %s: %w", s.markerPath(), err)
+	}
+	if len(marker.Hash) == 0 {
+		marker.Hash = HashSHA1
+	}
+	return marker, nil
+}
+
+// writeMarker persists the store marker, creating the storage root if necessary.
+func (s *Store) writeMarker(marker storeMarker) error {
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.markerPath(), b, 0o644)
+}
@@ -0,0 +1,545 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Merkle summary of an owner's keys is a fixed two-level tree. Keys are bucketed by the
+// first two hex digits of their SHA-256, so a node is addressed by a hex prefix: "" is the
+// root, one digit names one of its MerkleFanout children and two digits name a bucket.
+const (
+	MerkleFanout  = 16
+	MerkleDepth   = 2
+	merkleBuckets = MerkleFanout * MerkleFanout
+)
+
+// indexJournalPrefix names the per-owner journal files that persisted the key index before
+// the index database, which the upgrade to it removes.
+const indexJournalPrefix = ".dfs-index-"
+
+// keyIndex tracks the keys held for every owner together with the Merkle summary over them.
+// Between Init and Close it is backed by the index database, which owners are loaded from;
+// otherwise owners are scanned from disk and nothing is persisted.
+type keyIndex struct {
+	mu     sync.Mutex
+	owners map[string]*ownerIndex // Loaded owners by ID
+	seq    uint64                 // Changes made to the indexed keys, persisted with them in db
+	db     *Index                 // Index database between Init and Close, nil otherwise
+	stale  bool                   // Whether db may be behind the disk until it is rebuilt
+}
+
+// ownerIndex is the key index of a single owner.
+type ownerIndex struct {
+	buckets [merkleBuckets]map[string]int64  // Keys grouped by bucket, mapped to their size on disk
+	digests [merkleBuckets][sha256.Size]byte // Bucket digests, valid unless the bucket is dirty
+	dirty   [merkleBuckets]bool              // Buckets changed since their digest was computed
+	live    int                              // Keys currently indexed
+	bytes   int64                            // Total size of the indexed objects
+	sorted  []string                         // Every indexed key in sorted order, for listing
+	shared  bool                             // Whether a KeySnapshot holds sorted, so it is copied before it changes
+}
+
+// bucketOf returns the bucket a key belongs to.
+func bucketOf(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(sum[0])
+}
+
+// insert adds a key holding size bytes, reporting whether it was not indexed already with
+// that size. Resizing a key leaves the bucket digest alone, as it only covers the keys.
+func (o *ownerIndex) insert(key string, size int64) bool {
+	b := bucketOf(key)
+	if o.buckets[b] == nil {
+		o.buckets[b] = make(map[string]int64)
+	}
+	if old, ok := o.buckets[b][key]; ok {
+		if old == size {
+			return false
+		}
+		o.buckets[b][key] = size
+		o.bytes += size - old
+		return true
+	}
+	o.buckets[b][key] = size
+	o.bytes += size
+	o.dirty[b] = true
+	o.live++
+	o.ownSorted()
+	i := sort.SearchStrings(o.sorted, key)
+	o.sorted = append(o.sorted, "")
+	copy(o.sorted[i+1:], o.sorted[i:])
+	o.sorted[i] = key
+	return true
+}
+
+// drop removes a key, reporting whether it was indexed.
+func (o *ownerIndex) drop(key string) bool {
+	b := bucketOf(key)
+	size, ok := o.buckets[b][key]
+	if !ok {
+		return false
+	}
+	delete(o.buckets[b], key)
+	o.bytes -= size
+	o.dirty[b] = true
+	o.live--
+	o.ownSorted()
+	i := sort.SearchStrings(o.sorted, key)
+	o.sorted = append(o.sorted[:i], o.sorted[i+1:]...)
+	return true
+}
+
+// ownSorted copies the sorted keys before they change if a snapshot holds them.
+func (o *ownerIndex) ownSorted() {
+	if o.shared {
+		o.sorted = slices.Clone(o.sorted)
+		o.shared = false
+	}
+}
+
+// bucketKeys returns the keys of a bucket in sorted order.
+func (o *ownerIndex) bucketKeys(b int) []string {
+	keys := make([]string, 0, len(o.buckets[b]))
+	for key := range o.buckets[b] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bucketDigest returns the digest of a bucket, recomputing it if the bucket is dirty. An empty
+// bucket digests to all zeroes.
+func (o *ownerIndex) bucketDigest(b int) [sha256.Size]byte {
+	if !o.dirty[b] {
+		return o.digests[b]
+	}
+	var sum [sha256.Size]byte
+	if len(o.buckets[b]) > 0 {
+		h := sha256.New()
+		var size [4]byte
+		for _, key := range o.bucketKeys(b) {
+			binary.BigEndian.PutUint32(size[:], uint32(len(key)))
+			h.Write(size[:])
+			h.Write([]byte(key))
+		}
+		copy(sum[:], h.Sum(nil))
+	}
+	o.digests[b], o.dirty[b] = sum, false
+	return sum
+}
+
+// digest returns the digest of the node at prefix. Inner nodes hash their children's
+// digests; a subtree without keys digests to all zeroes.
+func (o *ownerIndex) digest(prefix string) [sha256.Size]byte {
+	if len(prefix) == MerkleDepth {
+		b, _ := strconv.ParseUint(prefix, 16, 8)
+		return o.bucketDigest(int(b))
+	}
+	var (
+		sum   [sha256.Size]byte
+		empty = true
+		h     = sha256.New()
+	)
+	for _, child := range childPrefixes(prefix) {
+		d := o.digest(child)
+		if d != sum {
+			empty = false
+		}
+		h.Write(d[:])
+	}
+	if empty {
+		return sum
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// childPrefixes returns the prefixes of the children of the node at prefix.
+func childPrefixes(prefix string) []string {
+	children := make([]string, MerkleFanout)
+	for i := range children {
+		children[i] = prefix + strconv.FormatInt(int64(i), 16)
+	}
+	return children
+}
+
+// validPrefix checks that prefix addresses a node of the tree.
+func validPrefix(prefix string) error {
+	if len(prefix) > MerkleDepth {
+		return fmt.Errorf("storage: merkle prefix %q is deeper than %d", prefix, MerkleDepth)
+	}
+	for _, c := range prefix {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return fmt.Errorf("storage: merkle prefix %q is not lowercase hex", prefix)
+		}
+	}
+	return nil
+}
+
+// ownerIndex returns the loaded index of an owner, loading it from the index database or,
+// when there is none or it has yet to be rebuilt, scanning the owner's metadata. The caller
+// must hold s.index.mu.
+func (s *Store) ownerIndex(id string) (*ownerIndex, error) {
+	if o, ok := s.index.owners[id]; ok {
+		return o, nil
+	}
+	o := &ownerIndex{}
+	var err error
+	if s.index.db != nil && !s.index.stale {
+		err = s.index.db.load(id, o)
+	} else {
+		_, err = s.scanOwner(id, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.index.owners[id] = o
+	return o, nil
+}
+
+// scanOwner indexes the keys recorded in the metadata of an owner's objects. Objects stored
+// before metadata existed carry no key and are not indexed.
+//
+// Returns: The entries the index database records for the keys indexed, and any errors.
+func (s *Store) scanOwner(id string, o *ownerIndex) (map[string]IndexEntry, error) {
+	entries := make(map[string]IndexEntry)
+	err := filepath.WalkDir(filepath.Join(s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return ignoreNotExist(err)
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metadataSuffix) {
+			return skipReserved(d)
+		}
+		meta, err := readMetadataFile(path)
+		if err != nil || len(meta.Key) == 0 {
+			return nil
+		}
+		if ok, err := s.Has(id, meta.Key); err == nil && ok {
+			size := s.objectSize(id, meta.Key)
+			o.insert(meta.Key, size)
+			entries[meta.Key] = IndexEntry{Size: size, Meta: meta}
+		}
+		return nil
+	})
+	return entries, ignoreNotExist(err)
+}
+
+// objectSize returns the size of the object under key on disk, or zero when it cannot be read.
+func (s *Store) objectSize(id string, key string) int64 {
+	info, err := os.Stat(s.fullPath(id, key))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// indexKey records that an object was written under key, together with its size on disk and
+// the metadata its sidecar now holds. The object is on disk before the index database commits
+// the change, so a crash in between leaves the key for Init to reconcile.
+func (s *Store) indexKey(id string, key string) error {
+	size := s.objectSize(id, key)
+	meta, _ := s.Metadata(id, key)
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return err
+	}
+	if o.insert(key, size) {
+		s.index.seq++
+	}
+	if s.index.db == nil {
+		return nil
+	}
+	if s.beforeIndex != nil {
+		s.beforeIndex(id, key)
+	}
+	return s.index.db.put(id, key, IndexEntry{Size: size, Meta: meta}, s.index.seq)
+}
+
+// unindexKey records that the object under key was deleted.
+func (s *Store) unindexKey(id string, key string) error {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return err
+	}
+	if o.drop(key) {
+		s.index.seq++
+	}
+	if s.index.db == nil {
+		return nil
+	}
+	if s.beforeIndex != nil {
+		s.beforeIndex(id, key)
+	}
+	return s.index.db.remove(id, key, s.index.seq)
+}
+
+// reindexMetadata records metadata rewritten in the sidecar of an indexed object in the index
+// database too.
+func (s *Store) reindexMetadata(id string, key string, meta Metadata) error {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	if s.index.db == nil {
+		return nil
+	}
+	return s.index.db.update(id, key, meta)
+}
+
+// MerkleDigest returns the hex-encoded digest of the node at prefix in the Merkle summary of
+// an owner's keys. Two stores hold the same keys under a node exactly when its digests match.
+//
+// Parameters:
+//   - id: Owner whose keys are summarised.
+//   - prefix: Node address, "" for the root.
+//
+// Returns: The digest and any errors.
+func (s *Store) MerkleDigest(id string, prefix string) (string, error) {
+	if err := validPrefix(prefix); err != nil {
+		return "", err
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return "", err
+	}
+	d := o.digest(prefix)
+	return hex.EncodeToString(d[:]), nil
+}
+
+// MerkleChildren returns the hex-encoded digests of the MerkleFanout children of an inner node,
+// in prefix order.
+//
+// Parameters:
+//   - id: Owner whose keys are summarised.
+//   - prefix: Address of an inner node, shorter than MerkleDepth.
+//
+// Returns: The child digests and any errors.
+func (s *Store) MerkleChildren(id string, prefix string) ([]string, error) {
+	if err := validPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if len(prefix) == MerkleDepth {
+		return nil, fmt.Errorf("storage: merkle bucket %q has no children", prefix)
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	children := childPrefixes(prefix)
+	digests := make([]string, len(children))
+	for i, child := range children {
+		d := o.digest(child)
+		digests[i] = hex.EncodeToString(d[:])
+	}
+	return digests, nil
+}
+
+// BucketKeys returns the sorted keys of an owner that fall in the bucket at prefix.
+//
+// Parameters:
+//   - id: Owner whose keys are listed.
+//   - prefix: Bucket address of MerkleDepth hex digits.
+//
+// Returns: The keys and any errors.
+func (s *Store) BucketKeys(id string, prefix string) ([]string, error) {
+	if err := validPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if len(prefix) != MerkleDepth {
+		return nil, fmt.Errorf("storage: merkle prefix %q is not a bucket", prefix)
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := strconv.ParseUint(prefix, 16, 8)
+	return o.bucketKeys(int(b)), nil
+}
+
+// Keys returns every indexed key of an owner in sorted order.
+func (s *Store) Keys(id string) ([]string, error) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), o.sorted...), nil
+}
+
+// KeysWithPrefix returns the indexed keys of an owner starting with prefix, in sorted order.
+func (s *Store) KeysWithPrefix(id string, prefix string) ([]string, error) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.SearchStrings(o.sorted, prefix)
+	j := i
+	for j < len(o.sorted) && strings.HasPrefix(o.sorted[j], prefix) {
+		j++
+	}
+	return append([]string(nil), o.sorted[i:j]...), nil
+}
+
+// RebuildIndex discards the key index of every owner and rebuilds it from the metadata of the
+// objects on disk, in the index database too once Init has opened it. It recovers an index
+// that lost changes, such as a write that crashed after its object reached the disk but before
+// the index committed it, or an index database that was damaged or deleted. Journals left by
+// the index of format 2 are removed. Writes made while it runs wait for it to finish.
+//
+// Returns: The number of keys indexed and any errors.
+func (s *Store) RebuildIndex() (int, error) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	s.index.owners = make(map[string]*ownerIndex)
+	ids, err := s.Owners()
+	if err != nil {
+		return 0, err
+	}
+	keys := 0
+	entries := make(map[string]map[string]IndexEntry, len(ids))
+	for _, id := range ids {
+		o := &ownerIndex{}
+		if entries[id], err = s.scanOwner(id, o); err != nil {
+			return keys, err
+		}
+		s.index.owners[id] = o
+		keys += o.live
+	}
+	if s.index.db != nil {
+		// The rebuilt index may differ from the one snapshots were taken of, so it counts as a change.
+		s.index.seq++
+		if err := s.index.db.reset(entries, s.index.seq); err != nil {
+			return keys, err
+		}
+		s.index.stale = false
+	}
+	return keys, removeJournals(s.Root)
+}
+
+// removeJournals removes the key journals of format 2 from the storage root.
+func removeJournals(root string) error {
+	journals, err := filepath.Glob(filepath.Join(root, indexJournalPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range journals {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListKeys returns a page of an owner's indexed keys in sorted order. Pages are addressed by
+// the last key of the previous page rather than an offset, so keys written or deleted between
+// calls never make a page repeat or skip keys that exist throughout. Use SnapshotKeys for
+// pages that are consistent with each other.
+//
+// Parameters:
+//   - id: Owner whose keys are listed.
+//   - prefix: Only keys starting with prefix are listed.
+//   - cursor: Keys up to and including cursor are skipped; "" starts from the first key.
+//   - limit: Most keys returned.
+//
+// Returns: The keys, the cursor of the next page or "" when this is the last, and any errors.
+func (s *Store) ListKeys(id string, prefix string, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("storage: list limit %d is not positive", limit)
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return nil, "", err
+	}
+	keys, next := pageKeys(o.sorted, prefix, cursor, limit)
+	return keys, next, nil
+}
+
+// pageKeys returns the page of sorted keys starting with prefix that follows cursor, and the
+// cursor of the next page or "" when this is the last.
+func pageKeys(sorted []string, prefix string, cursor string, limit int) ([]string, string) {
+	i := sort.SearchStrings(sorted, prefix)
+	if len(cursor) > 0 {
+		// Resume strictly after the cursor, which may have been deleted since.
+		i = max(i, sort.Search(len(sorted), func(j int) bool { return sorted[j] > cursor }))
+	}
+	var keys []string
+	for ; i < len(sorted) && strings.HasPrefix(sorted[i], prefix); i++ {
+		if len(keys) == limit {
+			return keys, keys[len(keys)-1]
+		}
+		keys = append(keys, sorted[i])
+	}
+	return keys, ""
+}
+
+// KeySnapshot is the indexed keys of some owners at one point in time. Listings paging
+// through a snapshot rather than the live index see every key that was indexed when it was
+// taken and none written since, however the keys change between pages.
+type KeySnapshot struct {
+	Seq  uint64              // Changes made to the indexed keys before the snapshot, counted across restarts once Init has opened the index database
+	Time time.Time           // When the snapshot was taken
+	keys map[string][]string // Sorted keys by owner, shared with the index until they change
+}
+
+// SnapshotKeys captures the indexed keys of the given owners at once. Taking a snapshot copies
+// nothing; the index copies an owner's keys the next time they change instead.
+//
+// Returns: The snapshot and any errors loading the owners' indexes.
+func (s *Store) SnapshotKeys(ids ...string) (*KeySnapshot, error) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	snap := &KeySnapshot{Seq: s.index.seq, Time: s.now(), keys: make(map[string][]string, len(ids))}
+	for _, id := range ids {
+		o, err := s.ownerIndex(id)
+		if err != nil {
+			return nil, err
+		}
+		o.shared = true
+		snap.keys[id] = o.sorted[:len(o.sorted):len(o.sorted)]
+	}
+	return snap, nil
+}
+
+// Owners returns the owners whose keys the snapshot holds, sorted.
+func (k *KeySnapshot) Owners() []string {
+	owners := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		owners = append(owners, id)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// ListKeys returns a page of an owner's keys in the snapshot, like Store.ListKeys. Owners the
+// snapshot was not taken of have no keys.
+//
+// Returns: The keys and the cursor of the next page or "" when this is the last.
+func (k *KeySnapshot) ListKeys(id string, prefix string, cursor string, limit int) ([]string, string) {
+	return pageKeys(k.keys[id], prefix, cursor, max(limit, 1))
+}
@@ -0,0 +1,391 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// writeKeys stores each key with its own name as content.
+func writeKeys(t *testing.T, s *Store, id string, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// rootDigest returns the Merkle root of an owner, failing the test on error.
+func rootDigest(t *testing.T, s *Store, id string) string {
+	t.Helper()
+	d, err := s.MerkleDigest(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestMerkleIncrementalDigests(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key_%d", i))
+	}
+	writeKeys(t, s, id, keys...)
+	before := rootDigest(t, s, id)
+
+	writeKeys(t, s, id, "extra")
+	if d := rootDigest(t, s, id); d == before {
+		t.Fatal("root digest did not change after a write")
+	}
+	// Rewriting an existing key leaves the key set, and so the digest, unchanged.
+	withExtra := rootDigest(t, s, id)
+	writeKeys(t, s, id, "key_3")
+	if d := rootDigest(t, s, id); d != withExtra {
+		t.Errorf("rewriting a key changed the root digest")
+	}
+	if err := s.Delete(id, "extra"); err != nil {
+		t.Fatal(err)
+	}
+	if d := rootDigest(t, s, id); d != before {
+		t.Errorf("got root %s after removing the extra key want %s", d, before)
+	}
+
+	// A store built from scratch over the same keys agrees on every node.
+	other := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	writeKeys(t, other, id, keys...)
+	for _, prefix := range []string{"", "a", "3f"} {
+		got, err := s.MerkleDigest(id, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := other.MerkleDigest(id, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("prefix %q: got %s want %s", prefix, got, want)
+		}
+	}
+	all, err := s.Keys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(keys) {
+		t.Errorf("got %d keys want %d", len(all), len(keys))
+	}
+}
+
+func TestMerkleIndexPersists(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	writeKeys(t, s, id, "a", "b", "c", "quoted \"key\"\nwith newline")
+	if err := s.Delete(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	want := rootDigest(t, s, id)
+	wantKeys, err := s.Keys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFuncSHA256})
+	if got := rootDigest(t, reopened, id); got != want {
+		t.Errorf("got root %s after reopening want %s", got, want)
+	}
+	gotKeys, err := reopened.Keys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotKeys, wantKeys) {
+		t.Errorf("got keys %q want %q", gotKeys, wantKeys)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	root := t.TempDir()
+	opts := StoreOpts{Root: root, PathTransformName: CASTransformName}
+	s := NewStore(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	id := "owner"
+	writeKeys(t, s, id, "a", "b")
+	writeKeys(t, s, "other", "x")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Changes made by a store that never opened the index database leave the database, which
+	// was closed cleanly and is trusted, out of step with the disk.
+	offline := NewStore(opts)
+	writeKeys(t, offline, id, "c")
+	if err := offline.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	want := rootDigest(t, offline, id)
+
+	reopened := NewStore(opts)
+	if err := reopened.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rootDigest(t, reopened, id); got == want {
+		t.Fatal("the index database should have been trusted")
+	}
+
+	n, err := reopened.RebuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d keys indexed want 3", n)
+	}
+	if got := rootDigest(t, reopened, id); got != want {
+		t.Errorf("got root %s after rebuilding want %s", got, want)
+	}
+	for owner, wantKeys := range map[string][]string{id: {"b", "c"}, "other": {"x"}} {
+		keys, err := reopened.Keys(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, wantKeys) {
+			t.Errorf("got keys %q of %s want %q", keys, owner, wantKeys)
+		}
+	}
+	if bytes, err := reopened.OwnerBytes(id); err != nil || bytes != 2 {
+		t.Errorf("got %d bytes, %v for %s want 2", bytes, err, id)
+	}
+	if _, ok, err := reopened.Index().Lookup(id, "a"); err != nil || ok {
+		t.Errorf("got %v, %v looking the deleted key up want it gone", ok, err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rebuilt database is what the next store to open the root loads.
+	again := NewStore(opts)
+	if err := again.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if got := rootDigest(t, again, id); got != want {
+		t.Errorf("got root %s after reopening the rebuilt index want %s", got, want)
+	}
+}
+
+func TestMerkleConcurrentWrites(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("w%d_%d", w, i)
+				if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.MerkleDigest(id, ""); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	other := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 50; i++ {
+			writeKeys(t, other, id, fmt.Sprintf("w%d_%d", w, i))
+		}
+	}
+	if got, want := rootDigest(t, s, id), rootDigest(t, other, id); got != want {
+		t.Errorf("got root %s want %s", got, want)
+	}
+}
+
+// listAll pages through an owner's keys under prefix, limit keys at a time.
+func listAll(t *testing.T, s *Store, id string, prefix string, limit int) []string {
+	t.Helper()
+	var all []string
+	cursor := ""
+	for {
+		keys, next, err := s.ListKeys(id, prefix, cursor, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > limit {
+			t.Fatalf("got page of %d keys with limit %d", len(keys), limit)
+		}
+		all = append(all, keys...)
+		if len(next) == 0 {
+			return all
+		}
+		cursor = next
+	}
+}
+
+func TestListKeysPages(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	writeKeys(t, s, id, "a/1", "a/2", "a/3", "a/4", "ab", "b/1", "b/2")
+
+	for _, tc := range []struct {
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{"", 1, []string{"a/1", "a/2", "a/3", "a/4", "ab", "b/1", "b/2"}},
+		{"", 7, []string{"a/1", "a/2", "a/3", "a/4", "ab", "b/1", "b/2"}},
+		{"a/", 2, []string{"a/1", "a/2", "a/3", "a/4"}},
+		{"a/", 4, []string{"a/1", "a/2", "a/3", "a/4"}},
+		{"a/", 100, []string{"a/1", "a/2", "a/3", "a/4"}},
+		{"a", 3, []string{"a/1", "a/2", "a/3", "a/4", "ab"}},
+		{"b/2", 1, []string{"b/2"}},
+		{"c", 1, nil},
+	} {
+		if got := listAll(t, s, id, tc.prefix, tc.limit); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("prefix %q limit %d: got %q want %q", tc.prefix, tc.limit, got, tc.want)
+		}
+	}
+
+	// A page that ends exactly on the last key reports no further pages.
+	keys, next, err := s.ListKeys(id, "a/", "", 4)
+	if err != nil || len(keys) != 4 || len(next) != 0 {
+		t.Errorf("got %q, next %q, %v for a full last page", keys, next, err)
+	}
+	if _, _, err := s.ListKeys(id, "", "", 0); err == nil {
+		t.Error("zero limit accepted")
+	}
+}
+
+func TestListKeysConcurrentMutation(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	writeKeys(t, s, id, "k1", "k3", "k5", "k7")
+
+	keys, next, err := s.ListKeys(id, "", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Between pages the cursor key is deleted and keys land before and after it.
+	if err := s.Delete(id, "k3"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, s, id, "k0", "k4", "k8")
+	rest, _, err := s.ListKeys(id, "", next, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := append(keys, rest...)
+	want := []string{"k1", "k3", "k4", "k5", "k7", "k8"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestKeySnapshotIsolated(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	writeKeys(t, s, id, "k1", "k3", "k5", "k7")
+
+	snap, err := s.SnapshotKeys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, next := snap.ListKeys(id, "", "", 2)
+	// Between pages keys are deleted and written on either side of the cursor.
+	if err := s.Delete(id, "k3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "k7"); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, s, id, "k0", "k4", "k8")
+	rest, last := snap.ListKeys(id, "", next, 10)
+	if got, want := append(keys, rest...), []string{"k1", "k3", "k5", "k7"}; !reflect.DeepEqual(got, want) || len(last) != 0 {
+		t.Errorf("got %q, next %q, want %q", got, last, want)
+	}
+
+	later, err := s.SnapshotKeys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if later.Seq != snap.Seq+5 {
+		t.Errorf("sequence went from %d to %d over 5 changes", snap.Seq, later.Seq)
+	}
+	if got, _ := later.ListKeys(id, "", "", 10); !reflect.DeepEqual(got, []string{"k0", "k1", "k4", "k5", "k8"}) {
+		t.Errorf("later snapshot holds %q", got)
+	}
+	if got, _ := later.ListKeys("other", "", "", 10); got != nil {
+		t.Errorf("owner not in the snapshot has keys %q", got)
+	}
+}
+
+func TestKeySnapshotSeqSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+	opts := StoreOpts{Root: root, PathTransformName: CASTransformName}
+	s := NewStore(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, s, "owner", "a", "b")
+	before, err := s.SnapshotKeys("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStore(opts)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	reopened, err := s.SnapshotKeys("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Seq != before.Seq {
+		t.Errorf("got sequence %d after reopening want %d", reopened.Seq, before.Seq)
+	}
+	if err := s.Delete("owner", "a"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.SnapshotKeys("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Seq != before.Seq+1 {
+		t.Errorf("got sequence %d after a change want %d", after.Seq, before.Seq+1)
+	}
+}
+
+func TestKeysWithPrefix(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	writeKeys(t, s, id, "logs/b", "logs/a", "logsx", "log", "tmp/a")
+	for prefix, want := range map[string][]string{
+		"logs/": {"logs/a", "logs/b"},
+		"log":   {"log", "logs/a", "logs/b", "logsx"},
+		"tmp/":  {"tmp/a"},
+		"zzz":   nil,
+		"":      {"log", "logs/a", "logs/b", "logsx", "tmp/a"},
+	} {
+		got, err := s.KeysWithPrefix(id, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v for %q want %v", got, prefix, want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metadataSuffix is appended to an object's full path to name its metadata sidecar file.
+const metadataSuffix = ".meta"
+
+// ErrContentCorrupted is returned when the bytes of a stored object no longer match
+// the checksum recorded when the object was written.
+var ErrContentCorrupted = errors.New("storage: content checksum mismatch")
+
+// ErrSizeMismatch is returned by Verify when the plain size recorded for an object is not what
+// its content yields.
+var ErrSizeMismatch = errors.New("storage: recorded plain size mismatch")
+
+// Metadata holds the bookkeeping recorded alongside every stored object.
+//
+// Fields:
+//   - Key: The key the object was stored under, needed to re-derive hashed paths.
+//   - Size: Number of bytes of content written for the object.
+//   - Checksum: Hex-encoded SHA-256 of the content written for the object.
+//   - ModTime: Time the object was written.
+//   - Version: Version number of the object, zero when its key is not versioned.
+//   - Immutable: Whether the object was marked write-once with SetImmutable.
+//   - Linked: Whether the object is a hard link made by WriteFile.
+//   - HashState: State of the checksum after the last append, so the next one goes on from it.
+//   - ReplicaIV: IV the replicas of the object are encrypted with, recorded with SetReplicaIV.
+//   - ContentType: MIME type of the content, recorded with SetContentType.
+//   - PlainSize: Number of bytes of content the object yields, once decrypted if its owner's
+//     objects are stored encrypted, as StoreOpts.Overhead tells. Zero in metadata written before it was recorded, until
+//     Stat fills it in.
+//   - Verified: When Verify last found the content intact. Writing or appending to the object
+//     leaves it before ModTime, as the content it vouched for is gone.
+//   - Stored: Number of bytes the object takes on disk, its header included, when it is stored
+//     behind a header; zero when it is stored as its content was written, taking Size bytes.
+type Metadata struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	Checksum    string    `json:"checksum"`
+	ModTime     time.Time `json:"mod_time"`
+	Version     uint64    `json:"version,omitempty"`
+	Immutable   bool      `json:"immutable,omitempty"`
+	Linked      bool      `json:"linked,omitempty"`
+	HashState   []byte    `json:"hash_state,omitempty"`
+	ReplicaIV   []byte    `json:"replica_iv,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	PlainSize   int64     `json:"plain_size,omitempty"`
+	Verified    time.Time `json:"verified,omitempty"`
+	Stored      int64     `json:"stored,omitempty"`
+}
+
+// metadataPath returns the location of the metadata sidecar for the given id and key.
+func (s *Store) metadataPath(id string, key string) string {
+	return s.fullPath(id, key) + metadataSuffix
+}
+
+// writeMetadata persists the metadata sidecar for the given id and key.
+func (s *Store) writeMetadata(id string, key string, meta Metadata) error {
+	meta.Key = key
+	meta.PlainSize = s.plainSize(id, meta.Size)
+	if meta.ModTime.IsZero() {
+		meta.ModTime = s.now()
+	}
+	return writeMetadataFile(s.metadataPath(id, key), meta, s.SyncWrites)
+}
+
+// plainSize returns the bytes of content an object of owner id yields when size bytes of it
+// are stored.
+func (s *Store) plainSize(id string, size int64) int64 {
+	if s.Overhead == nil {
+		return size
+	}
+	return max(size-s.Overhead(id), 0)
+}
+
+// writeMetadataFile encodes meta into the metadata sidecar at path, replacing the sidecar in
+// one step so a crash leaves either the old metadata or meta, never a part of either. The new
+// sidecar is written beside the old one first; with sync set, it is flushed to disk before it
+// replaces the old one, and the directory after.
+func writeMetadataFile(path string, meta Metadata, sync bool) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// A name of its own, as the sidecar may be rewritten by two callers at once.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	err = f.Chmod(0o644)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if err := errors.Join(err, f.Close()); err != nil {
+		return errors.Join(err, os.Remove(f.Name()))
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errors.Join(err, os.Remove(f.Name()))
+	}
+	if sync {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Metadata returns the metadata recorded for the object with the specified key.
+// Objects written before checksums were recorded return fs.ErrNotExist.
+func (s *Store) Metadata(id string, key string) (Metadata, error) {
+	return readMetadataFile(s.metadataPath(id, key))
+}
+
+// SetImmutable marks the object with the specified key as write-once in its metadata. The
+// store does not enforce the flag itself, and writing the object again clears it.
+func (s *Store) SetImmutable(id string, key string) error {
+	meta, err := s.Metadata(id, key)
+	if err != nil || meta.Immutable {
+		return err
+	}
+	meta.Immutable = true
+	return s.rewriteMetadata(id, key, meta)
+}
+
+// SetReplicaIV records in the metadata of the object with the specified key the IV its replicas
+// are encrypted with, so content appended to it can be encrypted to continue them. Writing or
+// truncating the object clears it, as its replicas are then encrypted afresh.
+func (s *Store) SetReplicaIV(id string, key string, iv []byte) error {
+	meta, err := s.Metadata(id, key)
+	if err != nil {
+		return err
+	}
+	meta.ReplicaIV = iv
+	return s.rewriteMetadata(id, key, meta)
+}
+
+// SetContentType records the MIME type of the object with the specified key in its metadata.
+// Appending to the object keeps it, and writing the object again clears it.
+func (s *Store) SetContentType(id string, key string, contentType string) error {
+	meta, err := s.Metadata(id, key)
+	if err != nil || meta.ContentType == contentType {
+		return err
+	}
+	meta.ContentType = contentType
+	return s.rewriteMetadata(id, key, meta)
+}
+
+// rewriteMetadata replaces the metadata sidecar of an existing object and its index entry.
+func (s *Store) rewriteMetadata(id string, key string, meta Metadata) error {
+	if err := writeMetadataFile(s.metadataPath(id, key), meta, s.SyncWrites); err != nil {
+		return err
+	}
+	return s.reindexMetadata(id, key, meta)
+}
+
+// Stat returns the metadata of the object with the specified key. Objects written before
+// metadata was recorded report only the size and modification time of the file on disk, and
+// their plain size. Metadata written before plain sizes were recorded has it filled in.
+func (s *Store) Stat(id string, key string) (Metadata, error) {
+	meta, err := s.Metadata(id, key)
+	if err == nil && meta.PlainSize == 0 && meta.Size > 0 {
+		s.backfillPlainSize(id, key, &meta)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return meta, err
+	}
+	fi, err := os.Stat(s.fullPath(id, key))
+	if err != nil {
+		return meta, err
+	}
+	return Metadata{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), PlainSize: s.plainSize(id, fi.Size())}, nil
+}
+
+// backfillPlainSize works out the plain size of an object whose metadata was written before
+// plain sizes were, and records it so it is only worked out once. A store that cannot record
+// it still reports it, working it out again on the next Stat.
+func (s *Store) backfillPlainSize(id string, key string, meta *Metadata) {
+	meta.PlainSize = s.plainSize(id, meta.Size)
+	if meta.PlainSize == 0 {
+		// An encrypted empty object: there is nothing to record.
+		return
+	}
+	s.rewriteMetadata(id, key, *meta)
+}
+
+// readMetadataFile decodes the metadata sidecar at path.
+func readMetadataFile(path string) (Metadata, error) {
+	var meta Metadata
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// Verify re-hashes the object with the specified key and compares it with its recorded checksum,
+// then checks the plain size recorded for it against what its content yields. An intact object
+// has the time recorded as Metadata.Verified.
+//
+// Returns: ErrContentCorrupted on a checksum mismatch, an error wrapping ErrSizeMismatch when
+// only the plain size is wrong, nil if both match or no checksum was recorded.
+func (s *Store) Verify(id string, key string) (err error) {
+	meta, err := s.Metadata(id, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, r.Close())
+	}()
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != meta.Checksum {
+		return ErrContentCorrupted
+	}
+	if plain := s.plainSize(id, n); meta.PlainSize > 0 && meta.PlainSize != plain {
+		return fmt.Errorf("%w: %d bytes recorded, content yields %d", ErrSizeMismatch, meta.PlainSize, plain)
+	}
+	return s.markVerified(id, key, meta)
+}
+
+// markVerified records that the object was found intact, unless it was written while it was
+// being re-hashed. The sidecar is not synced: losing the time on a crash only makes the object
+// look unverified.
+func (s *Store) markVerified(id string, key string, verified Metadata) error {
+	meta, err := s.Metadata(id, key)
+	if err != nil || meta.Checksum != verified.Checksum || !meta.ModTime.Equal(verified.ModTime) {
+		return nil
+	}
+	meta.Verified = s.now()
+	if err := writeMetadataFile(s.metadataPath(id, key), meta, false); err != nil {
+		return err
+	}
+	return s.reindexMetadata(id, key, meta)
+}
+
+// ReadVerified opens the object with the specified key and checks its content against the
+// recorded checksum while it is streamed. A mismatch is reported as ErrContentCorrupted by
+// Read once the end of the object is reached and again by Close.
+//
+// Parameters:
+//   - id: Identifier for the storage path.
+//   - key: Key for locating the file.
+//
+// Returns: File size, a verifying reader for the file content, and any errors.
+func (s *Store) ReadVerified(id string, key string) (int64, io.ReadCloser, error) {
+	size, r, err := s.readStream(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	meta, err := s.Metadata(id, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return size, r, nil
+	}
+	if err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	return size, &verifyingReader{ReadCloser: r, hash: sha256.New(), want: meta.Checksum}, nil
+}
+
+// verifyingReader hashes everything read through it and compares the digest at EOF.
+type verifyingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+	err  error
+}
+
+// Read reads from the underlying object, replacing io.EOF with ErrContentCorrupted on mismatch.
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+		v.err = ErrContentCorrupted
+		return n, v.err
+	}
+	return n, err
+}
+
+// WriteTo writes the rest of the object to w like Read, hashing it on the way. An object that
+// writes itself, as a mapped one does, is hashed and written without being copied first.
+func (v *verifyingReader) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := v.ReadCloser.(io.WriterTo)
+	if !ok {
+		return io.Copy(w, struct{ io.Reader }{v})
+	}
+	n, err := wt.WriteTo(io.MultiWriter(w, v.hash))
+	if err == nil && hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+		v.err = ErrContentCorrupted
+		err = v.err
+	}
+	return n, err
+}
+
+// Close closes the underlying object, reporting ErrContentCorrupted if a mismatch was detected.
+func (v *verifyingReader) Close() error {
+	return errors.Join(v.ReadCloser.Close(), v.err)
+}
+
+// checksumWriter forwards writes to an underlying writer while hashing and counting them.
+type checksumWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	n    int64
+}
+
+// newChecksumWriter wraps w so the bytes written through it can be summarised as Metadata.
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, hash: sha256.New()}
+}
+
+// Write writes p to the underlying writer and adds the written bytes to the running checksum.
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.hash.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// metadata returns the size and checksum of everything written so far.
+func (c *checksumWriter) metadata() Metadata {
+	return Metadata{Size: c.n, Checksum: hex.EncodeToString(c.hash.Sum(nil))}
+}
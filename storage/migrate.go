@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MigrateHash moves every object in the store to the layout its named transform produces
+// with the given hash algorithm and records the new hash in the store marker. Init must
+// have been called first. Objects whose metadata does not record their key cannot be
+// relocated; they are left in place and reported in the returned error.
+//
+// Returns: Number of objects moved and any errors.
+func (s *Store) MigrateHash(hash string) (int, error) {
+	marker, err := s.readMarker()
+	if err != nil {
+		return 0, fmt.Errorf("storage: migrating %s: %w", s.Root, err)
+	}
+	if marker.Hash == hash {
+		return 0, nil
+	}
+	if err := s.useHash(hash); err != nil {
+		return 0, err
+	}
+	moved, err := s.relocateAll()
+	marker.Hash = hash
+	if werr := s.writeMarker(marker); werr != nil {
+		err = errors.Join(err, werr)
+	}
+	return moved, err
+}
+
+// MigrateTransform moves every object in the store to the layout of the named path transform,
+// with the hash that transform uses, and records it in the store marker so the store opens
+// with it from then on. Init must have been called with the transform the store was created
+// with. Objects whose metadata does not record their key cannot be relocated; they are left
+// in place and reported in the returned error.
+//
+// Returns: Number of objects moved and any errors.
+func (s *Store) MigrateTransform(name string) (int, error) {
+	marker, err := s.readMarker()
+	if err != nil {
+		return 0, fmt.Errorf("storage: migrating %s: %w", s.Root, err)
+	}
+	if marker.PathTransform == name {
+		return 0, nil
+	}
+	fn, ok := GetPathTransform(name)
+	if !ok {
+		return 0, fmt.Errorf("storage: unknown path transform %q", name)
+	}
+	s.PathTransformName, s.PathTransformFunc = name, fn
+	moved, err := s.relocateAll()
+	marker.PathTransform, marker.Hash = name, fn("").Hash
+	if werr := s.writeMarker(marker); werr != nil {
+		err = errors.Join(err, werr)
+	}
+	return moved, err
+}
+
+// relocateAll moves every object not yet where the current transform expects it there. Objects
+// already moved may be walked again and are skipped.
+//
+// Returns: Number of objects moved and any errors.
+func (s *Store) relocateAll() (int, error) {
+	var (
+		moved int
+		errs  []error
+	)
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metadataSuffix) {
+			return skipReserved(d)
+		}
+		id, meta, err := s.migrationSource(path)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		oldPath := strings.TrimSuffix(path, metadataSuffix)
+		if oldPath == filepath.Clean(s.fullPath(id, meta.Key)) {
+			return nil
+		}
+		if err := s.relocate(id, meta.Key, oldPath); err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		moved++
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return moved, errors.Join(errs...)
+}
+
+// migrationSource reads the metadata sidecar at path and derives the id the object belongs to.
+func (s *Store) migrationSource(path string) (string, Metadata, error) {
+	var meta Metadata
+	rel, err := filepath.Rel(s.Root, path)
+	if err != nil {
+		return "", meta, err
+	}
+	id, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	meta, err = readMetadataFile(path)
+	if err != nil {
+		return "", meta, fmt.Errorf("storage: reading %s: %w", path, err)
+	}
+	if len(meta.Key) == 0 {
+		return "", meta, fmt.Errorf("storage: %s does not record its key and cannot be relocated", path)
+	}
+	return id, meta, nil
+}
+
+// relocate moves the object at oldPath and its metadata to where the current transform expects them.
+func (s *Store) relocate(id string, key string, oldPath string) error {
+	newPath := s.fullPath(id, key)
+	s.dirMu.RLock()
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		s.dirMu.RUnlock()
+		return err
+	}
+	err := os.Rename(oldPath, newPath)
+	s.dirMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath+metadataSuffix, newPath+metadataSuffix); err != nil {
+		return err
+	}
+	removeEmptyParents(filepath.Dir(oldPath), filepath.Join(s.Root, id))
+	return nil
+}
+
+// removeEmptyParents removes dir and its ancestors while they are empty, stopping at stop.
+func removeEmptyParents(dir string, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+// mapFunc maps the first size bytes of a file read-only.
+type mapFunc func(f *os.File, size int64) ([]byte, error)
+
+// mmapReader reads an object through a read-only memory mapping of its file, so concurrent
+// readers of a large object share the page cache without a read call or buffer copy each.
+// The file is kept open while it is mapped, so the object can be deleted or renamed by a
+// write meanwhile without the mapping going away.
+type mmapReader struct {
+	mu   sync.RWMutex // Held for reading by ReadAt, for writing by the calls that move off and by Close
+	file *os.File     // File the mapping was made from
+	data []byte       // The mapping, nil once closed
+	off  int64        // Offset of the next Read
+}
+
+// mapReader maps file, of size bytes, for reading.
+//
+// Returns: The reader, or an error if the file cannot be mapped.
+func (s *Store) mapReader(file *os.File, size int64) (*mmapReader, error) {
+	mmap := s.mmap
+	if mmap == nil {
+		mmap = mapFile
+	}
+	data, err := mmap(file, size)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReader{file: file, data: data}, nil
+}
+
+// guardFault turns the fault of reading a page the mapping no longer has, as when its file
+// is truncated under it, into an error wrapping io.ErrUnexpectedEOF. Other panics go on.
+// It must be deferred after debug.SetPanicOnFault(true).
+func guardFault(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(interface{ Addr() uintptr }); !ok {
+		panic(r)
+	}
+	*err = fmt.Errorf("reading mapped object: %v: %w", r, io.ErrUnexpectedEOF)
+}
+
+// Read copies the bytes at the offset into p.
+func (m *mmapReader) Read(p []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if m.off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer guardFault(&err)
+	n = copy(p, m.data[m.off:])
+	m.off += int64(n)
+	return n, nil
+}
+
+// ReadAt copies the bytes at off into p, leaving the offset of Read as it is.
+func (m *mmapReader) ReadAt(p []byte, off int64) (n int, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer guardFault(&err)
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTo writes the bytes from the offset to the end of the object to w straight from the
+// mapping, so io.Copy hashes or sends them without copying them into a buffer first.
+func (m *mmapReader) WriteTo(w io.Writer) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	if m.off >= int64(len(m.data)) {
+		return 0, nil
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer guardFault(&err)
+	written, err := w.Write(m.data[m.off:])
+	m.off += int64(written)
+	return int64(written), err
+}
+
+// Seek sets the offset of the next Read.
+func (m *mmapReader) Seek(offset int64, whence int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	m.off = offset
+	return offset, nil
+}
+
+// Close unmaps the object and closes its file. Closing it again reports os.ErrClosed, as a
+// file would.
+func (m *mmapReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return os.ErrClosed
+	}
+	err := unmapFile(m.data)
+	m.data = nil
+	return errors.Join(err, m.file.Close())
+}
@@ -0,0 +1,6 @@
+//go:build darwin || freebsd
+
+package storage
+
+// adviseSequential does nothing where the syscall package offers no madvise.
+func adviseSequential([]byte) {}
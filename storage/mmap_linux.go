@@ -0,0 +1,9 @@
+package storage
+
+import "syscall"
+
+// adviseSequential tells the kernel a mapping is read in order, so it reads ahead further.
+// The advice is only a hint, so failing to give it is ignored.
+func adviseSequential(data []byte) {
+	syscall.Madvise(data, syscall.MADV_SEQUENTIAL)
+}
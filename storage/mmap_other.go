@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile reports that files cannot be mapped on this platform, so they are read instead.
+func mapFile(*os.File, int64) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// unmapFile does nothing, as nothing is ever mapped.
+func unmapFile([]byte) error {
+	return nil
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+// newMmapStore returns a store mapping objects larger than 1 KiB, holding one of size bytes.
+func newMmapStore(t testing.TB, size int) (*Store, string, []byte) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256, MmapThreshold: 1 << 10})
+	id := crypto.GenerateID()
+	data := make([]byte, size)
+	rand.Read(data)
+	if _, err := s.Write(id, "large", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	return s, id, data
+}
+
+// openMapped reads the large object of a store from newMmapStore, skipping the test where
+// files cannot be mapped.
+func openMapped(t *testing.T, s *Store, id string) *mmapReader {
+	t.Helper()
+	_, r, err := s.Read(id, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := r.(*mmapReader)
+	if !ok {
+		r.(io.Closer).Close()
+		t.Skip("files cannot be mapped on this platform")
+	}
+	return m
+}
+
+func TestMmapRead(t *testing.T) {
+	s, id, data := newMmapStore(t, 64<<10)
+	m := openMapped(t, s, id)
+	got, err := io.ReadAll(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("expected the mapped object to read as written")
+	}
+	if _, err := m.Seek(1000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 100)
+	if _, err := io.ReadFull(m, part); err != nil || !bytes.Equal(part, data[1000:1100]) {
+		t.Errorf("expected bytes 1000 to 1100 after seeking, got %v", err)
+	}
+	if n, err := m.ReadAt(part, int64(len(data))-50); n != 50 || err != io.EOF || !bytes.Equal(part[:50], data[len(data)-50:]) {
+		t.Errorf("expected the last 50 bytes and io.EOF, got %d and %v", n, err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("got %v closing again want %v", err, os.ErrClosed)
+	}
+	if _, err := m.Read(part); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("got %v reading once closed want %v", err, os.ErrClosed)
+	}
+
+	// The checksum is verified over the mapping.
+	_, r, err := s.ReadVerified(id, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Error("expected the verified copy to hash as written")
+	}
+	if err := os.WriteFile(s.fullPath(id, "large"), make([]byte, len(data)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err = s.ReadVerified(id, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, r); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v want %v", err, ErrContentCorrupted)
+	}
+	if err := r.Close(); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v from Close want %v", err, ErrContentCorrupted)
+	}
+
+	// Objects up to the threshold are read as files.
+	if _, err := s.Write(id, "small", bytes.NewReader(data[:1<<10])); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err = s.readStream(id, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok := r.(*os.File); !ok {
+		t.Errorf("got a %T for an object at the threshold want a file", r)
+	}
+}
+
+func TestMmapFallback(t *testing.T) {
+	s, id, data := newMmapStore(t, 64<<10)
+	// Stands in for a file system that cannot map files.
+	s.mmap = func(*os.File, int64) ([]byte, error) { return nil, errors.ErrUnsupported }
+	_, r, err := s.ReadVerified(id, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("expected the object to be read from its file")
+	}
+	_, r, err = s.readStream(id, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok := r.(*os.File); !ok {
+		t.Errorf("got a %T want a file", r)
+	}
+}
+
+// TestMmapConcurrentReaders reads one object through many mappings at once, and through one
+// mapping shared by goroutines while it is closed, which the race detector checks.
+func TestMmapConcurrentReaders(t *testing.T) {
+	s, id, data := newMmapStore(t, 256<<10)
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, r, err := s.Read(id, "large")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("expected the object to read as written, got %v", err)
+			}
+			if err := r.(io.Closer).Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	m := openMapped(t, s, id)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 4<<10)
+			for off := int64(i) * 1024; ; off += int64(len(p)) {
+				n, err := m.ReadAt(p, off)
+				if errors.Is(err, os.ErrClosed) || err == io.EOF {
+					return
+				}
+				if err != nil || !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+					t.Errorf("expected bytes at %d to read as written, got %v", off, err)
+					return
+				}
+			}
+		}()
+	}
+	if err := m.Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestMmapOutlivesDeletion(t *testing.T) {
+	s, id, data := newMmapStore(t, 64<<10)
+	m := openMapped(t, s, id)
+	defer m.Close()
+	if _, err := s.Write(id, "large", bytes.NewReader([]byte("overwritten"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "large"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("expected the mapping to keep the content it was opened with")
+	}
+}
+
+func TestMmapTruncatedUnderReader(t *testing.T) {
+	s, id, _ := newMmapStore(t, 64<<10)
+	m := openMapped(t, s, id)
+	defer m.Close()
+	if err := os.Truncate(s.fullPath(id, "large"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(m); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v reading a truncated mapping want %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := io.Copy(sha256.New(), m); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v writing a truncated mapping want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// BenchmarkConcurrentReads reads a 500 MB object with 50 readers at once, through read calls
+// and through mappings.
+func BenchmarkConcurrentReads(b *testing.B) {
+	for _, bench := range []struct {
+		name      string
+		threshold int64
+	}{{"read", 0}, {"mmap", 1}} {
+		b.Run(bench.name, func(b *testing.B) {
+			s, id, _ := newMmapStore(b, 500<<20)
+			s.MmapThreshold = bench.threshold
+			b.SetBytes(50 * 500 << 20)
+			b.ResetTimer()
+			for range b.N {
+				var wg sync.WaitGroup
+				for range 50 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, r, err := s.Read(id, "large")
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						// Both readers are read into a buffer, as a peer's stream is.
+						if _, err := io.Copy(io.Discard, struct{ io.Reader }{r}); err != nil {
+							b.Error(err)
+						}
+						r.(io.Closer).Close()
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
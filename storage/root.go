@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrDangerousRoot is returned by Init when the storage root is a system directory or the
+// directory of the running binary and StoreOpts.AllowDangerousRoot is not set.
+var ErrDangerousRoot = errors.New("storage: refusing to use a system directory as the storage root")
+
+// systemDirs are directories that must never be used as, or hold, a storage root.
+var systemDirs = []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/lib64", "/proc", "/sbin", "/sys", "/usr"}
+
+// prepareRoot makes the storage root absolute, creates it if it is missing and checks that
+// it is a writable directory in a safe location.
+func (s *Store) prepareRoot() error {
+	abs, err := filepath.Abs(s.Root)
+	if err != nil {
+		return fmt.Errorf("storage: resolving root %s: %w", s.Root, err)
+	}
+	s.Root = abs
+	// Check before creating anything so a bad root leaves no directories behind, and again
+	// once symlinks can be resolved.
+	if err := s.checkRootLocation(s.Root); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+		return fmt.Errorf("storage: creating root %s: %w", s.Root, err)
+	}
+	fi, err := os.Stat(s.Root)
+	if err != nil {
+		return fmt.Errorf("storage: root %s: %w", s.Root, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("storage: root %s is not a directory", s.Root)
+	}
+	resolved, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return fmt.Errorf("storage: resolving root %s: %w", s.Root, err)
+	}
+	if err := s.checkRootLocation(resolved); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(s.Root, ".dfs-probe-*")
+	if err != nil {
+		return fmt.Errorf("storage: root %s is not writable: %w", s.Root, err)
+	}
+	return errors.Join(probe.Close(), os.Remove(probe.Name()))
+}
+
+// checkRootLocation rejects a root path that is "/", lies in a system directory or is the
+// directory holding the running binary, unless AllowDangerousRoot is set.
+func (s *Store) checkRootLocation(path string) error {
+	if s.AllowDangerousRoot {
+		return nil
+	}
+	if path == string(filepath.Separator) {
+		return fmt.Errorf("%w: %s is the filesystem root; set AllowDangerousRoot to override", ErrDangerousRoot, s.Root)
+	}
+	for _, dir := range systemDirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+			return fmt.Errorf("%w: %s lies in %s; set AllowDangerousRoot to override", ErrDangerousRoot, s.Root, dir)
+		}
+	}
+	if exe, err := os.Executable(); err == nil {
+		if exeDir, err := filepath.EvalSymlinks(filepath.Dir(exe)); err == nil && exeDir == path {
+			return fmt.Errorf("%w: %s is the directory of the running binary; set AllowDangerousRoot to override", ErrDangerousRoot, s.Root)
+		}
+	}
+	return nil
+}
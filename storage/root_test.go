@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitCreatesRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "nested", "root")
+	s := NewStore(StoreOpts{Root: root})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		t.Fatalf("expected %s to be created, got %v", root, err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the index database and the lock file, held until Close, and the FORMAT file are left.
+	if len(entries) != 3 || entries[0].Name() != indexFileName || entries[1].Name() != lockFileName ||
+		entries[2].Name() != formatFileName {
+		t.Errorf("the writability probe should be removed, found %d entries", len(entries))
+	}
+}
+
+func TestInitAbsolutizesRelativeRoot(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	s := NewStore(StoreOpts{Root: "relative_root"})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.Abs("relative_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Root != want {
+		t.Errorf("got root %s want %s", s.Root, want)
+	}
+}
+
+func TestInitRejectsFileRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "not_a_dir")
+	if err := os.WriteFile(root, []byte("oops"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewStore(StoreOpts{Root: root}).Init(); err == nil {
+		t.Error("expected a root that is a file to be rejected")
+	}
+}
+
+func TestInitRejectsReadOnlyRoot(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks do not apply to root")
+	}
+	root := t.TempDir()
+	if err := os.Chmod(root, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(root, 0o755) })
+	if err := NewStore(StoreOpts{Root: root}).Init(); err == nil {
+		t.Error("expected a read-only root to be rejected")
+	}
+}
+
+func TestInitRejectsDangerousRoot(t *testing.T) {
+	for _, root := range []string{"/", "/etc/dfs-should-not-exist"} {
+		err := NewStore(StoreOpts{Root: root}).Init()
+		if !errors.Is(err, ErrDangerousRoot) {
+			t.Errorf("%s: got %v want %v", root, err, ErrDangerousRoot)
+		}
+	}
+	if _, err := os.Stat("/etc/dfs-should-not-exist"); !os.IsNotExist(err) {
+		t.Errorf("a rejected root must not be created, got %v", err)
+	}
+}
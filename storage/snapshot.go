@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// snapshotAttempts is how many times Snapshot captures an object that does not match its
+	// checksum before giving up on the snapshot.
+	snapshotAttempts = 5
+	// snapshotRetryDelay is how much longer Snapshot waits before each capture of an object
+	// than before the last, giving a write in progress time to finish.
+	snapshotRetryDelay = 50 * time.Millisecond
+)
+
+// ErrSnapshotMismatch is returned by Snapshot when an object matched its checksum in none of
+// snapshotAttempts captures, as it kept being written while captured or its content is
+// corrupt.
+var ErrSnapshotMismatch = errors.New("storage: object did not match its checksum while snapshotted")
+
+// SnapshotEntry describes an object captured by Snapshot.
+//
+// Fields:
+//   - Owner: ID of the owner the object is held for.
+//   - Key: Key the object is stored under.
+//   - Path: Location of the object relative to the root of the snapshot.
+//   - Size: Number of bytes of content of the object.
+//   - Checksum: Hex-encoded SHA-256 of the content, which the captured object matched.
+//   - Linked: Whether the object was hard-linked into the snapshot rather than copied.
+type SnapshotEntry struct {
+	Owner    string `json:"owner"`
+	Key      string `json:"key"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Linked   bool   `json:"linked,omitempty"`
+}
+
+// Snapshot captures the objects of every owner into dir, laid out as a store root of its own
+// that a store can be opened on: the objects and their metadata, the store marker and the
+// FORMAT file. The index database is not captured; the first store to open the snapshot
+// rebuilds it from the metadata. The keys captured are those indexed when the snapshot starts,
+// taken with SnapshotKeys, so writes go on while it runs. Each object is captured as it is
+// when its turn comes, and checked against the checksum in its metadata; one caught half
+// written is captured again. Keys deleted before their turn are left out. Version histories,
+// the trash and the staging area are not captured.
+//
+// With link set objects are hard-linked into dir, sharing their blocks, where the filesystem
+// allows it; appends and truncations then copy an object before changing it, so neither copy
+// sees the other's changes. Objects that cannot be linked, and every object on platforms
+// where the links of a file cannot be counted, are copied.
+//
+// Parameters:
+//   - dir: Directory to capture the objects into, which must be empty or not exist.
+//   - link: Whether to hard-link objects when possible.
+//
+// Returns: The keys indexed when the snapshot started, the objects captured sorted by owner
+// and key, and any errors, such as ErrSnapshotMismatch.
+func (s *Store) Snapshot(dir string, link bool) (*KeySnapshot, []SnapshotEntry, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		return nil, nil, err
+	} else if len(entries) > 0 {
+		return nil, nil, fmt.Errorf("storage: snapshot directory %s is not empty", dir)
+	}
+	ids, err := s.Owners()
+	if err != nil {
+		return nil, nil, err
+	}
+	snap, err := s.SnapshotKeys(ids...)
+	if err != nil {
+		return nil, nil, err
+	}
+	link = link && linksCounted
+	var captured []SnapshotEntry
+	for _, id := range snap.Owners() {
+		for _, key := range snap.keys[id] {
+			entry, ok, err := s.captureObject(dir, id, key, link)
+			if err != nil {
+				return snap, captured, fmt.Errorf("storage: snapshot of (%s) of %s: %w", key, id, err)
+			}
+			if ok {
+				captured = append(captured, entry)
+			}
+		}
+	}
+	for _, name := range []string{markerFileName, formatFileName} {
+		if err := copyFile(filepath.Join(s.Root, name), filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return snap, captured, err
+		}
+	}
+	return snap, captured, nil
+}
+
+// captureObject captures an object and its metadata into the snapshot in dir, again while the
+// metadata cannot be read or the captured object does not match the checksum in it. Linking holds
+// appendMu, so no append already past its check for other links writes to the linked object
+// afterwards.
+//
+// Returns: The entry of the object, false when it was deleted before it was captured, and any
+// errors.
+func (s *Store) captureObject(dir string, id string, key string, link bool) (SnapshotEntry, bool, error) {
+	full := s.fullPath(id, key)
+	rel, err := filepath.Rel(s.Root, full)
+	if err != nil {
+		return SnapshotEntry{}, false, err
+	}
+	dst := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return SnapshotEntry{}, false, err
+	}
+	entry := SnapshotEntry{Owner: id, Key: key, Path: filepath.ToSlash(rel)}
+	var lastErr error
+	for attempt := range snapshotAttempts {
+		// A write in progress is not paced by the store's clock, so the wait is real time.
+		time.Sleep(time.Duration(attempt) * snapshotRetryDelay)
+		meta, metaErr := s.Metadata(id, key)
+		if metaErr != nil && !errors.Is(metaErr, fs.ErrNotExist) {
+			// Metadata is rewritten in place, so it may be read half written.
+			lastErr = metaErr
+			continue
+		}
+		if link {
+			s.appendMu.Lock()
+		}
+		linked, err := s.captureFile(full, dst, link)
+		if link {
+			s.appendMu.Unlock()
+		}
+		var sum string
+		var n int64
+		if err == nil {
+			sum, n, err = s.checksumFile(dst)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return entry, false, ignoreNotExist(os.Remove(dst))
+		}
+		if err != nil {
+			return entry, false, err
+		}
+		// Objects written before metadata was recorded have no checksum to match.
+		if metaErr == nil && sum != meta.Checksum {
+			lastErr = ErrSnapshotMismatch
+			continue
+		}
+		if metaErr == nil {
+			if err := writeMetadataFile(dst+metadataSuffix, meta, false); err != nil {
+				return entry, false, err
+			}
+		}
+		entry.Size, entry.Checksum, entry.Linked = n, sum, linked
+		return entry, true, nil
+	}
+	return entry, false, lastErr
+}
+
+// captureFile hard-links the file at src as dst when link is set, copying it when it cannot be
+// linked or link is not set, replacing any earlier capture.
+//
+// Returns: Whether the file was linked, and any errors.
+func (s *Store) captureFile(src string, dst string, link bool) (bool, error) {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if link {
+		linkFn := s.link
+		if linkFn == nil {
+			linkFn = os.Link
+		}
+		err := linkFn(src, dst)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			return err == nil, err
+		}
+	}
+	return false, copyFile(src, dst)
+}
+
+// checksumFile returns the checksum of the content of the object file at path, decoded as the
+// store reads objects, and the number of bytes of content.
+func (s *Store) checksumFile(path string) (string, int64, error) {
+	_, r, err := s.openObject(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := copyPooled(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// copyFile copies the file at src to a new file at dst.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := copyPooled(out, in); err != nil {
+		return errors.Join(err, out.Close(), os.Remove(dst))
+	}
+	return out.Close()
+}
+
+// CopyTree recreates the files under src at dst, hard-linking them when link is set and the
+// filesystem allows it, copying them otherwise. Files are linked only on platforms where the
+// links of a file can be counted, so stores on either side copy an object before changing it.
+// dst must be empty or not exist.
+//
+// Returns: The number of files recreated and any errors.
+func CopyTree(src string, dst string, link bool) (int, error) {
+	if entries, err := os.ReadDir(dst); err == nil && len(entries) > 0 {
+		return 0, fmt.Errorf("storage: %s is not empty", dst)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	link = link && linksCounted
+	files := 0
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		files++
+		if link && os.Link(path, target) == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+	return files, err
+}
+
+// sharedObject reports whether the object file at path has hard links besides its own, such
+// as those Snapshot makes, so it must be copied before it is changed in place.
+func sharedObject(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && hasOtherLinks(fi)
+}
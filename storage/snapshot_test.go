@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+)
+
+func TestStoreSnapshot(t *testing.T) {
+	for _, link := range []bool{true, false} {
+		t.Run(map[bool]string{true: "link", false: "copy"}[link], func(t *testing.T) {
+			s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformName: CASTransformName})
+			if err := s.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			a, b := crypto.GenerateID(), crypto.GenerateID()
+			for id, keys := range map[string][]string{a: {"one", "two"}, b: {"three"}} {
+				for _, key := range keys {
+					if _, err := s.Write(id, key, bytes.NewReader([]byte(key+" of "+id))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			dir := filepath.Join(t.TempDir(), "snapshot")
+			snap, entries, err := s.Snapshot(dir, link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 3 || len(snap.Owners()) != 2 {
+				t.Fatalf("got %d objects of %d owners, want 3 of 2", len(entries), len(snap.Owners()))
+			}
+			for _, e := range entries {
+				meta, err := s.Metadata(e.Owner, e.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Checksum != meta.Checksum || e.Size != meta.Size || e.Linked != (link && linksCounted) {
+					t.Errorf("got entry %+v for metadata %+v", e, meta)
+				}
+			}
+			if _, _, err := s.Snapshot(dir, link); err == nil {
+				t.Error("expected a snapshot into a directory in use to fail")
+			}
+
+			// Changes after the snapshot leave it as it was.
+			if _, err := s.Append(a, "one", bytes.NewReader([]byte(" and more"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Truncate(a, "two", 2); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Write(b, "four", bytes.NewReader([]byte("later"))); err != nil {
+				t.Fatal(err)
+			}
+			if got := readObject(t, s, a, "one"); got != "one of "+a+" and more" {
+				t.Errorf("got %q after appending", got)
+			}
+
+			restored := NewStore(StoreOpts{Root: dir, PathTransformName: CASTransformName})
+			if err := restored.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer restored.Close()
+			for id, keys := range map[string][]string{a: {"one", "two"}, b: {"three"}} {
+				got, err := restored.Keys(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(keys) {
+					t.Errorf("got keys %v of %s, want %v", got, id, keys)
+				}
+				for _, key := range keys {
+					if got := readObject(t, restored, id, key); got != key+" of "+id {
+						t.Errorf("got %q in the snapshot, want %q", got, key+" of "+id)
+					}
+					if err := restored.Verify(id, key); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStoreSnapshotCapturesAgain(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+	id := crypto.GenerateID()
+	if _, err := s.Write(id, "busy", bytes.NewReader([]byte("complete content"))); err != nil {
+		t.Fatal(err)
+	}
+	// The first capture finds the object half written.
+	links := 0
+	s.link = func(src string, dst string) error {
+		if links++; links == 1 {
+			return os.WriteFile(dst, []byte("compl"), 0o644)
+		}
+		return os.Link(src, dst)
+	}
+	_, entries, err := s.Snapshot(filepath.Join(t.TempDir(), "snapshot"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || links != 2 {
+		t.Fatalf("got %d objects in %d captures, want 1 in 2", len(entries), links)
+	}
+
+	// An object that never matches its checksum fails the snapshot.
+	s.link = func(_ string, dst string) error {
+		return os.WriteFile(dst, []byte("corrupt"), 0o644)
+	}
+	_, _, err = s.Snapshot(filepath.Join(t.TempDir(), "snapshot"), true)
+	if !errors.Is(err, ErrSnapshotMismatch) {
+		t.Errorf("got %v want ErrSnapshotMismatch", err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "copy")
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a", "b", "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := CopyTree(src, dst, true)
+	if err != nil || n != 1 {
+		t.Fatalf("got %d files, %v", n, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "a", "b", "file"))
+	if err != nil || string(b) != "content" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	if _, err := CopyTree(src, dst, true); err == nil {
+		t.Error("expected a copy into a directory in use to fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// freeBytes cannot tell the free bytes on this platform.
+func freeBytes(path string) (int64, error) {
+	return 0, fmt.Errorf("storage: free space of %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stagingDirName is the directory in the storage root holding the objects of uncommitted
+// transactions, one subdirectory per transaction.
+const stagingDirName = ".dfs-staging"
+
+// stagedObject is an object written to the staging area and waiting for its commit.
+type stagedObject struct {
+	id   string   // Owner the object is committed for
+	key  string   // Key the object is committed under
+	path string   // Location of the staged content
+	meta Metadata // Metadata written when the object is committed
+}
+
+// stagingArea tracks the staged objects of every open transaction in the order they were
+// staged.
+type stagingArea struct {
+	mu  sync.Mutex
+	txs map[string][]stagedObject // Staged objects by transaction ID
+}
+
+// stagingPath returns the directory holding the staged objects of a transaction.
+func (s *Store) stagingPath(txID string) string {
+	return filepath.Join(s.Root, stagingDirName, txID)
+}
+
+// Stage writes an object to the staging area of a transaction. Staged objects are invisible
+// to reads until the transaction is committed.
+//
+// Parameters:
+//   - txID: Transaction the object belongs to.
+//   - id: Owner the object is committed for.
+//   - key: Key the object is committed under.
+//   - r: Reader for the object content.
+//
+// Returns: Number of bytes staged, the hex-encoded SHA-256 of the content, and any errors.
+func (s *Store) Stage(txID string, id string, key string, r io.Reader) (int64, string, error) {
+	if len(txID) == 0 || filepath.Base(txID) != txID {
+		return 0, "", fmt.Errorf("storage: invalid transaction ID %q", txID)
+	}
+	dir := s.stagingPath(txID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256([]byte(id + "/" + key))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	var n int64
+	enc, err := s.newEncoder(s.objectWriter(f))
+	cw := newChecksumWriter(enc)
+	if err == nil {
+		n, err = io.Copy(cw, r)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if cerr := s.closeWritten(f); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, "", errors.Join(err, os.Remove(path))
+	}
+	meta := cw.metadata()
+	meta.Stored = enc.stored()
+	s.staging.mu.Lock()
+	defer s.staging.mu.Unlock()
+	if s.staging.txs == nil {
+		s.staging.txs = make(map[string][]stagedObject)
+	}
+	s.staging.txs[txID] = append(s.staging.txs[txID], stagedObject{id: id, key: key, path: path, meta: meta})
+	return n, meta.Checksum, nil
+}
+
+// Commit moves the staged objects of a transaction into the store, in the order they were
+// staged, so an object staged last becomes visible last.
+//
+// Returns: Any errors; objects committed before a failure stay in the store.
+func (s *Store) Commit(txID string) error {
+	s.staging.mu.Lock()
+	objects, ok := s.staging.txs[txID]
+	delete(s.staging.txs, txID)
+	s.staging.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("storage: no staged transaction %q", txID)
+	}
+	for _, obj := range objects {
+		if err := s.commitObject(obj); err != nil {
+			return errors.Join(err, os.RemoveAll(s.stagingPath(txID)))
+		}
+	}
+	return os.RemoveAll(s.stagingPath(txID))
+}
+
+// commitObject renames a staged object into place and records it.
+func (s *Store) commitObject(obj stagedObject) error {
+	defer s.changed(obj.id, obj.key)
+	pathKey := s.PathTransformFunc(obj.key)
+	s.dirMu.RLock()
+	err := os.MkdirAll(filepath.Join(s.Root, obj.id, pathKey.PathName), os.ModePerm)
+	if err == nil {
+		err = os.Rename(obj.path, s.fullPath(obj.id, obj.key))
+	}
+	s.dirMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := s.writeMetadata(obj.id, obj.key, obj.meta); err != nil {
+		return err
+	}
+	return s.indexKey(obj.id, obj.key)
+}
+
+// Abort discards the staged objects of a transaction.
+func (s *Store) Abort(txID string) error {
+	s.staging.mu.Lock()
+	delete(s.staging.txs, txID)
+	s.staging.mu.Unlock()
+	return os.RemoveAll(s.stagingPath(txID))
+}
+
+// AbortAll discards every staged transaction, such as those left behind by a restart.
+func (s *Store) AbortAll() error {
+	s.staging.mu.Lock()
+	s.staging.txs = nil
+	s.staging.mu.Unlock()
+	return os.RemoveAll(filepath.Join(s.Root, stagingDirName))
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStageCommitAndAbort(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id := "owner"
+	for _, key := range []string{"blob", "manifest"} {
+		if _, _, err := s.Stage("tx1", id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := s.Stage("tx2", id, "discarded", bytes.NewReader([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Has(id, "manifest"); ok {
+		t.Fatal("staged object is visible before the commit")
+	}
+	owners, err := s.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 0 {
+		t.Errorf("got owners %q, want none: the staging area is not an owner", owners)
+	}
+
+	if err := s.Commit("tx1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"blob", "manifest"} {
+		_, r, err := s.ReadVerified(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != key {
+			t.Errorf("got %q want %q", b, key)
+		}
+	}
+	keys, err := s.Keys(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got keys %q after the commit, want 2", keys)
+	}
+	if err := s.Commit("tx1"); err == nil {
+		t.Error("committing a transaction twice succeeded")
+	}
+
+	if err := s.Abort("tx2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Has(id, "discarded"); ok {
+		t.Error("aborted object is visible")
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, stagingDirName, "tx2")); !os.IsNotExist(err) {
+		t.Errorf("aborted transaction left files behind: %v", err)
+	}
+}
+
+func TestAbortAllClearsStaging(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	if _, _, err := s.Stage("tx", "owner", "key", bytes.NewReader([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Stage("../escape", "owner", "key", bytes.NewReader(nil)); err == nil {
+		t.Error("staged under a transaction ID that is not a plain name")
+	}
+	if err := s.AbortAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, stagingDirName)); !os.IsNotExist(err) {
+		t.Errorf("staging area survived AbortAll: %v", err)
+	}
+	if err := s.Commit("tx"); err == nil {
+		t.Error("committed a transaction discarded by AbortAll")
+	}
+}
+
+// fullDisk fails every write once limit bytes were written, as a full disk would.
+type fullDisk struct {
+	w     io.Writer
+	limit int
+}
+
+func (d *fullDisk) Write(b []byte) (int, error) {
+	if len(b) > d.limit {
+		n, _ := d.w.Write(b[:d.limit])
+		d.limit = 0
+		return n, syscall.ENOSPC
+	}
+	d.limit -= len(b)
+	return d.w.Write(b)
+}
+
+func TestStageOnFullDiskLeavesNothing(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	s.WrapWrites = func(w io.Writer) io.Writer { return &fullDisk{w: w, limit: 10} }
+	_, _, err := s.Stage("tx", "owner", "key", bytes.NewReader(bytes.Repeat([]byte("x"), 100)))
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("got %v want ENOSPC", err)
+	}
+	if err := s.Abort("tx"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, stagingDirName, "tx")); !os.IsNotExist(err) {
+		t.Errorf("failed stage left files behind: %v", err)
+	}
+}
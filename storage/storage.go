@@ -1,17 +1,19 @@
 package storage
 
 import (
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
 )
 
 const DefaultRootDirName = "dfs-net"
@@ -24,28 +26,38 @@ const DefaultRootDirName = "dfs-net"
 //
 // Returns: A PathKey struct with `PathName` as a folder structure and `FileName` as the full hash.
 func CASPathTransformFunc(key string) PathKey {
-	hash := sha1.Sum([]byte(key))
-	hashStr := hex.EncodeToString(hash[:])
-	blockSize := 5
-	sliceLen := len(hashStr) / blockSize
-	paths := make([]string, sliceLen)
-	for i := 0; i < sliceLen; i++ {
-		from, to := i*blockSize, (i+1)*blockSize
-		paths[i] = hashStr[from:to]
-	}
-	return PathKey{
-		PathName: strings.Join(paths, "/"),
-		FileName: hashStr,
-	}
+	return casTransform(key)
 }
 
+// CASPathTransformFuncSHA256 is the SHA-256 counterpart of CASPathTransformFunc and the CAS layout
+// used for new stores. It nests objects under eight 5-character directories of the key's SHA-256
+// hash, the same depth as the SHA-1 layout, and names the file after the full hash.
+//
+// Parameters:
+//   - key: A unique identifier for the content.
+//
+// Returns: A PathKey struct with `PathName` as a folder structure and `FileName` as the full hash.
+func CASPathTransformFuncSHA256(key string) PathKey {
+	return casTransformSHA256(key)
+}
+
+var (
+	// casTransform is the transform behind CASPathTransformFunc: 5-character blocks over the whole SHA-1 hash.
+	casTransform = NewCASTransformHash(HashSHA1, 5, 0)
+	// casTransformSHA256 is the transform behind CASPathTransformFuncSHA256.
+	casTransformSHA256 = NewCASTransformHash(HashSHA256, 5, 8)
+)
+
 // PathTransformFunc defines a function signature for transforming keys into paths.
 type PathTransformFunc func(string) PathKey
 
 // PathKey represents the storage path structure with `PathName` as the directory path and `FileName` as the final file.
+// Hash names the algorithm the path was derived from (HashSHA1 or HashSHA256), or is empty
+// when the key is used verbatim.
 type PathKey struct {
 	PathName string
 	FileName string
+	Hash     string
 }
 
 // FirstPathName returns the first directory in the `PathName`.
@@ -67,9 +79,65 @@ func (p PathKey) FullPath() string {
 // Fields:
 //   - Root: Root directory for storage.
 //   - PathTransformFunc: Function to transform keys to paths.
+//   - PathTransformName: Registered name of the path transform. When set, it selects the
+//     transform if PathTransformFunc is nil and is recorded in the store marker by Init.
+//   - GCGracePeriod: How old an orphaned file must be before GC removes it, defaults to DefaultGCGracePeriod.
+//   - AllowDangerousRoot: Lets Init accept a root inside a system directory or the binary's own directory.
+//   - TrashRetention: How long deleted objects stay restorable in the trash; zero deletes them at once.
+//   - OnChange: Called after the current content of an object may have changed, whether it was
+//     written, deleted, restored or committed, and even when the change failed part-way. Clear
+//     calls it once with an empty id and key. Nil when nothing needs to know.
+//   - ForceUnlock: Lets Init take over a root still locked by a process of this host that is no
+//     longer running.
+//   - SyncWrites: Flushes objects, their metadata and the directories holding them to disk
+//     before a write returns, so a write that succeeded survives a crash of the machine.
+//   - Clock: Times the writes of objects and decides when trashed objects and old versions
+//     expire. The real clock when nil.
+//   - WrapWrites: Wraps the file every object is written through, such as to fail writes in
+//     tests. Nil when objects are written to their file directly.
+//   - ManualUpgrade: Leaves a store in an older on-disk format as it is in Init, for Upgrade
+//     to be called instead, such as to report what it would change first.
+//   - MmapThreshold: Objects larger than this many bytes are read through a memory mapping of
+//     their file rather than read calls, where the platform and file system allow it. Zero
+//     reads every object with read calls.
+//   - Overhead: Returns the bytes the objects of an owner are stored with besides their
+//     content, such as the IV of encrypted ones, so the plain size recorded for them is what
+//     decrypting them yields. Nil when every object is stored in the clear.
+//   - SlowIOLatency: The p99 duration of any kind of operation in Stats past which the store's
+//     IO counts as slow. Zero never counts it slow by latency.
+//   - SlowIOThroughput: The bytes per second writes of at least 64 KiB must keep up, on
+//     average, for the store's IO not to count as slow. Zero never counts it slow by throughput.
+//   - OnSlowIO: Called with the reason when the store's IO starts counting as slow, and with
+//     an empty one when it stops. Nil when nothing needs to know.
+//   - IOClock: Times the store's operations for Stats, apart from Clock as it times the disk,
+//     such as to inject latency in tests. The real clock when nil.
+//   - ContentTransforms: The transforms objects are encoded with on disk, in the order they are
+//     applied, behind a header naming them. Objects are read by the transforms their header
+//     names, so changing these leaves objects already written readable. Empty stores objects
+//     as they are written.
+//   - LookupKey: Looks up the key encryption keys of transforms encrypting objects, both to write
+//     and to read them. Nil when no objects are encrypted at rest.
 type StoreOpts struct {
-	Root              string
-	PathTransformFunc PathTransformFunc
+	Root               string
+	PathTransformFunc  PathTransformFunc
+	PathTransformName  string
+	GCGracePeriod      time.Duration
+	AllowDangerousRoot bool
+	TrashRetention     time.Duration
+	OnChange           func(id string, key string)
+	ForceUnlock        bool
+	SyncWrites         bool
+	Clock              clock.Clock
+	WrapWrites         func(w io.Writer) io.Writer
+	ManualUpgrade      bool
+	MmapThreshold      int64
+	Overhead           func(id string) int64
+	SlowIOLatency      time.Duration
+	SlowIOThroughput   int64
+	OnSlowIO           func(reason string)
+	IOClock            clock.Clock
+	ContentTransforms  []ContentTransform
+	LookupKey          KeyFunc
 }
 
 // DefaultPathTransformFunc is the default path transformer, storing files without path splitting.
@@ -80,17 +148,32 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 // Store represents a storage system with a specified path structure and encryption options.
 type Store struct {
 	StoreOpts
+	dirMu    sync.RWMutex               // Held for reading while creating object directories, for writing while GC removes them
+	index    keyIndex                   // Keys held per owner and their Merkle summary
+	staging  stagingArea                // Objects of transactions that are not committed yet
+	verMu    sync.Mutex                 // Serialises writes to version histories so version numbers stay unique
+	appendMu sync.Mutex                 // Serialises appends and truncations, each carrying on the checksum of the last
+	lock     *os.File                   // Lock file held on the root between Init and Close, nil otherwise
+	link     func(string, string) error // Creates the hard links of WriteFile, os.Link when nil
+	mmap     mapFunc                    // Maps the files of objects past MmapThreshold, mapFile when nil
+	io       *ioMonitor                 // Timing of the store's operations, nil when they are not measured
+	// beforeIndex is called once an object's change is on disk, before the index database
+	// commits it, such as to crash in between in tests. Nil otherwise.
+	beforeIndex func(id string, key string)
 }
 
 // NewStore initializes and returns a new Store instance with the given options.
 func NewStore(opts StoreOpts) *Store {
+	if opts.PathTransformFunc == nil && len(opts.PathTransformName) > 0 {
+		opts.PathTransformFunc, _ = GetPathTransform(opts.PathTransformName)
+	}
 	if opts.PathTransformFunc == nil {
 		opts.PathTransformFunc = DefaultPathTransformFunc
 	}
 	if len(opts.Root) == 0 {
 		opts.Root = DefaultRootDirName
 	}
-	return &Store{StoreOpts: opts}
+	return &Store{StoreOpts: opts, index: keyIndex{owners: make(map[string]*ownerIndex)}, io: newIOMonitor()}
 }
 
 // Has checks if a file with the specified key exists in the store.
@@ -99,17 +182,51 @@ func NewStore(opts StoreOpts) *Store {
 //   - id: An identifier to create a unique path.
 //   - key: The key to locate the file.
 //
-// Returns: True if the file exists, false otherwise.
-func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, fs.ErrNotExist)
+// Returns: True if the file exists, false if it does not, and an error if its presence
+// could not be determined (e.g. permission denied or an IO error).
+func (s *Store) Has(id string, key string) (bool, error) {
+	_, err := os.Stat(s.fullPath(id, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Clear deletes all files in the root storage directory.
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	s.index.owners = make(map[string]*ownerIndex)
+	s.index.seq++
+	defer s.changed("", "")
+	if s.lock == nil {
+		return os.RemoveAll(s.Root)
+	}
+	// The lock file and the open index database stay, the index emptied, so the root remains held.
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	var errs []error
+	for _, e := range entries {
+		if e.Name() != lockFileName && e.Name() != indexFileName {
+			errs = append(errs, os.RemoveAll(filepath.Join(s.Root, e.Name())))
+		}
+	}
+	if s.index.db != nil {
+		errs = append(errs, s.index.db.reset(nil, s.index.seq))
+	}
+	return errors.Join(errs...)
+}
+
+// changed reports a possible change to the current content of an object to OnChange.
+func (s *Store) changed(id string, key string) {
+	if s.OnChange != nil {
+		s.OnChange(id, key)
+	}
 }
 
 // Delete removes the file corresponding to the specified key from storage.
@@ -117,13 +234,34 @@ func (s *Store) Clear() error {
 // Parameters:
 //   - id: An identifier to create a unique path.
 //   - key: The key to locate the file.
-func (s *Store) Delete(id string, key string) error {
+//
+// Only the object, its metadata and its version history are removed; directories left empty
+// are reclaimed by GC.
+// When TrashRetention is set they are moved into the owner's trash instead, from where
+// Restore can bring them back until PurgeTrash removes them.
+func (s *Store) Delete(id string, key string) (err error) {
 	pathKey := s.PathTransformFunc(key)
+	defer func(start time.Time) { s.measure(IODelete, start, 0, 0, err) }(s.ioClock().Now())
+	defer s.changed(id, key)
 	defer func() {
 		log.Printf("deleted [%s] from disk", pathKey.FileName)
 	}()
-	firstPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
-	return os.RemoveAll(firstPathWithRoot)
+	if s.TrashRetention > 0 {
+		return s.trash(id, key)
+	}
+	var errs []error
+	for _, path := range []string{s.fullPath(id, key), s.metadataPath(id, key)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err := os.RemoveAll(s.versionDir(id, key)); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		errs = append(errs, s.unindexKey(id, key))
+	}
+	return errors.Join(errs...)
 }
 
 // Write saves the contents from the reader to storage, creating directories if necessary.
@@ -135,28 +273,58 @@ func (s *Store) Delete(id string, key string) error {
 //
 // Returns: Number of bytes written and any errors.
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+	start, src := s.ioClock().Now(), &waitedReader{r: r, clock: s.ioClock()}
+	n, err := s.writeStream(id, key, src)
+	s.measure(IOWrite, start, src.waited, n, err)
+	return n, err
+}
+
+// StreamCipher decrypts the content WriteDecrypt stores. crypto.NewAESCTR returns one; the
+// store depends on no particular cipher.
+type StreamCipher interface {
+	// Decrypt decrypts src into dst, returning the number of bytes of src decrypted.
+	Decrypt(dst io.Writer, src io.Reader) (int64, error)
 }
 
-// WriteDecrypt saves encrypted content from the reader, decrypting it with the provided key.
+// WriteDecrypt saves encrypted content from the reader, decrypting it with the provided cipher.
 //
 // Parameters:
-//   - encKey: Key for decrypting the content.
+//   - c: Cipher for decrypting the content.
 //   - id: Identifier for the storage path.
 //   - key: Key for locating the file.
 //   - r: Reader for the encrypted content.
 //
 // Returns: Number of bytes written and any errors.
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+func (s *Store) WriteDecrypt(c StreamCipher, id string, key string, r io.Reader) (n int64, err error) {
+	src := &waitedReader{r: r, clock: s.ioClock()}
+	defer func(start time.Time) { s.measure(IOWriteDecrypt, start, src.waited, n, err) }(s.ioClock().Now())
+	defer s.changed(id, key)
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
-	n, err := crypto.CopyDecrypt(encKey, r, f)
+	defer func() {
+		// A failed close can mean the data never reached the disk.
+		err = errors.Join(err, s.closeWritten(f))
+	}()
+	enc, err := s.newEncoder(s.objectWriter(f))
+	if err != nil {
+		return 0, err
+	}
+	cw := newChecksumWriter(enc)
+	nw, err := c.Decrypt(cw, src)
+	if err == nil {
+		err = enc.Close()
+	}
 	if err != nil {
 		return 0, err
 	}
-	return int64(n), err
+	meta := cw.metadata()
+	meta.Stored = enc.stored()
+	if err := s.writeMetadata(id, key, meta); err != nil {
+		return 0, err
+	}
+	return nw, s.indexKey(id, key)
 }
 
 // openFileForWriting prepares the file for writing, creating the necessary directories.
@@ -169,11 +337,29 @@ func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader)
 func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
 	pathKey := s.PathTransformFunc(key)
 	path := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return nil, err
 	}
-	fullPath := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	return os.Create(fullPath)
+	// An object hard-linked by WriteFile is unlinked rather than truncated, leaving the file it
+	// was linked to intact. Failing that, the object is truncated as before.
+	os.Remove(s.fullPath(id, key))
+	return os.Create(s.fullPath(id, key))
+}
+
+// objectWriter returns the writer the content of an object is written to f through.
+func (s *Store) objectWriter(f *os.File) io.Writer {
+	if s.WrapWrites == nil {
+		return f
+	}
+	return s.WrapWrites(f)
+}
+
+// fullPath returns the on-disk location of the object with the specified id and key.
+func (s *Store) fullPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 }
 
 // writeStream copy content from the reader to storage.
@@ -184,12 +370,40 @@ func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
 //   - R: Reader for the file contents.
 //
 // Returns: Number of bytes written and any errors.
-func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+func (s *Store) writeStream(id string, key string, r io.Reader) (n int64, err error) {
+	return s.writeObject(id, key, r, 0)
+}
+
+// writeObject copies content from the reader to storage like writeStream, recording version
+// in its metadata; zero marks an unversioned object.
+func (s *Store) writeObject(id string, key string, r io.Reader, version uint64) (n int64, err error) {
+	defer s.changed(id, key)
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	defer func() {
+		// A failed close can mean the data never reached the disk.
+		err = errors.Join(err, s.closeWritten(f))
+	}()
+	enc, err := s.newEncoder(s.objectWriter(f))
+	if err != nil {
+		return 0, err
+	}
+	cw := newChecksumWriter(enc)
+	n, err = copyPooled(cw, r)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return n, err
+	}
+	meta := cw.metadata()
+	meta.Version, meta.Stored = version, enc.stored()
+	if err := s.writeMetadata(id, key, meta); err != nil {
+		return n, err
+	}
+	return n, s.indexKey(id, key)
 }
 
 // Read retrieves the content corresponding to the specified key from storage.
@@ -198,28 +412,100 @@ func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
 //   - id: Identifier for the storage path.
 //   - key: Key for locating the file.
 //
-// Returns: File size, a reader for the file content, and any errors.
+// Returns: Content size, a reader for the file content, and any errors.
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
+	start := s.ioClock().Now()
+	n, r, err := s.readStream(id, key)
+	s.measure(IORead, start, 0, 0, err)
+	return n, r, err
 }
 
-// readStream opens a file for reading from storage.
+// readStream opens a file for reading from storage, decoding it as openObject does.
 //
 // Parameters:
 //   - id: Identifier for the storage path.
 //   - key: Key for locating the file.
 //
-// Returns: File size, a reader for the file content, and any errors.
+// Returns: Content size, a reader for the file content, and any errors.
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPath := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	file, err := os.Open(fullPath)
+	return s.openObject(s.fullPath(id, key))
+}
+
+// CreateTemp creates an empty temporary file in the storage root for content assembled before
+// it is stored. Its name ends in ".tmp", so Check reports it if it is left behind. The caller
+// must close and remove it.
+func (s *Store) CreateTemp() (*os.File, error) {
+	return os.CreateTemp(s.Root, ".dfs-fetch-*.tmp")
+}
+
+// closeWritten closes a file that was written, first flushing it and its directory to disk
+// when SyncWrites is set.
+func (s *Store) closeWritten(f *os.File) error {
+	if !s.SyncWrites {
+		return f.Close()
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return errors.Join(f.Close(), syncDir(filepath.Dir(f.Name())))
+}
+
+// syncPath flushes a file written by path, and its directory, to disk when SyncWrites is set.
+func (s *Store) syncPath(path string) error {
+	if !s.SyncWrites {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return errors.Join(f.Close(), syncDir(filepath.Dir(path)))
+}
+
+// syncDir flushes the entries of a directory to disk, so files created in it survive a crash.
+// Systems that cannot sync directories, such as Windows, report errors that are ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		return 0, nil, err
+		return err
 	}
-	fi, err := file.Stat()
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return errors.Join(err, d.Close())
+	}
+	return d.Close()
+}
+
+// WriteFileAtomic replaces the file at path with data in one step. The data is written to a
+// temporary file beside it and flushed to disk before it is renamed over path, and the
+// directory is flushed after, so after a crash path holds either its old content or data,
+// never a part or none of it.
+//
+// Parameters:
+//   - path: File to replace.
+//   - data: Content to write.
+//   - perm: Permissions of the file if it is created.
+//
+// Returns: Any errors, after which path is left as it was.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
-		return 0, nil, err
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(tmp))
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close(), os.Remove(tmp))
+	}
+	if err := f.Close(); err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Join(err, os.Remove(tmp))
 	}
-	return fi.Size(), file, nil
+	return syncDir(filepath.Dir(path))
 }
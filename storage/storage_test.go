@@ -2,8 +2,12 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/muhammadmahdiamirpour/distributed-file-system/crypto"
@@ -22,6 +26,22 @@ func TestPathTransformFunc(t *testing.T) {
 	}
 }
 
+func TestPathTransformFuncSHA256(t *testing.T) {
+	key := "mybestpictures"
+	pathKey := CASPathTransformFuncSHA256(key)
+	expectedFilename := "925c9743880760be19d52bb7327a82465092e48755a55c3245df190398a6dd32"
+	expectedPathName := "925c9/74388/0760b/e19d5/2bb73/27a82/46509/2e487"
+	if pathKey.PathName != expectedPathName {
+		t.Errorf("got %s want %s", pathKey.PathName, expectedPathName)
+	}
+	if pathKey.FileName != expectedFilename {
+		t.Errorf("got %s want %s", pathKey.FileName, expectedFilename)
+	}
+	if pathKey.Hash != HashSHA256 {
+		t.Errorf("got %s want %s", pathKey.Hash, HashSHA256)
+	}
+}
+
 func TestStore(t *testing.T) {
 	s := newStore()
 	id := crypto.GenerateID()
@@ -32,7 +52,7 @@ func TestStore(t *testing.T) {
 		if _, err := s.writeStream(id, key, bytes.NewReader(data)); err != nil {
 			t.Error(err)
 		}
-		if ok := s.Has(id, key); !ok {
+		if ok, err := s.Has(id, key); err != nil || !ok {
 			t.Errorf("expected to have key %s", key)
 		}
 		_, r, err := s.Read(id, key)
@@ -46,15 +66,343 @@ func TestStore(t *testing.T) {
 		if err := s.Delete(id, key); err != nil {
 			t.Error(err)
 		}
-		if ok := s.Has(id, key); ok {
+		if ok, err := s.Has(id, key); err != nil || ok {
 			t.Errorf("expected to not have key %s", key)
 		}
 	}
 }
 
+func TestStoreVerify(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	key := "verifiedkey"
+	data := []byte("some verified bytes")
+	if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, key); err != nil {
+		t.Errorf("expected intact object to verify, got %s", err)
+	}
+	meta, err := s.Metadata(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Verified.Before(meta.ModTime) {
+		t.Errorf("verified at %s, before the write at %s", meta.Verified, meta.ModTime)
+	}
+	if err := os.WriteFile(s.fullPath(id, key), []byte("some corrupted bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, key); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v want %v", err, ErrContentCorrupted)
+	}
+	_, r, err := s.ReadVerified(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v from Read want %v", err, ErrContentCorrupted)
+	}
+	if err := r.Close(); !errors.Is(err, ErrContentCorrupted) {
+		t.Errorf("got %v from Close want %v", err, ErrContentCorrupted)
+	}
+}
+
+// replicaOverhead returns a StoreOpts.Overhead for a store holding the objects of holder
+// encrypted with crypto.CopyEncrypt and the others in the clear.
+func replicaOverhead(holder string) func(string) int64 {
+	return func(id string) int64 {
+		if id == holder {
+			return crypto.Overhead
+		}
+		return 0
+	}
+}
+
+// TestStorePlainSize writes objects stored in the clear and encrypted in every way the store
+// writes them, and checks the plain size Stat reports is what reading them back yields.
+func TestStorePlainSize(t *testing.T) {
+	const owner, holder = "owner", "holder"
+	encKey := crypto.NewEncryptionKey()
+	plain := []byte("content whose plain size is recorded")
+	encrypt := func(p []byte) io.Reader {
+		buf := new(bytes.Buffer)
+		if _, err := crypto.CopyEncrypt(encKey, bytes.NewReader(p), buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	iv := make([]byte, crypto.Overhead)
+	for _, tc := range []struct {
+		name  string
+		id    string
+		plain []byte
+		write func(s *Store, id string) error
+	}{
+		{"clear", owner, plain, func(s *Store, id string) error {
+			_, err := s.Write(id, "key", bytes.NewReader(plain))
+			return err
+		}},
+		{"decrypted", owner, plain, func(s *Store, id string) error {
+			_, err := s.WriteDecrypt(crypto.NewAESCTR(encKey), id, "key", encrypt(plain))
+			return err
+		}},
+		{"encrypted", holder, plain, func(s *Store, id string) error {
+			_, err := s.Write(id, "key", encrypt(plain))
+			return err
+		}},
+		{"encrypted empty", holder, nil, func(s *Store, id string) error {
+			_, err := s.Write(id, "key", encrypt(nil))
+			return err
+		}},
+		{"encrypted version", holder, plain, func(s *Store, id string) error {
+			_, err := s.WriteVersion(id, "key", 1, encrypt(plain))
+			return err
+		}},
+		{"encrypted staged", holder, plain, func(s *Store, id string) error {
+			if _, _, err := s.Stage("tx", id, "key", encrypt(plain)); err != nil {
+				return err
+			}
+			return s.Commit("tx")
+		}},
+		{"encrypted appended", holder, plain, func(s *Store, id string) error {
+			buf := new(bytes.Buffer)
+			if _, err := crypto.CopyEncryptIV(encKey, iv, bytes.NewReader(plain[:10]), buf); err != nil {
+				return err
+			}
+			if _, err := s.Write(id, "key", buf); err != nil {
+				return err
+			}
+			buf.Reset()
+			if _, err := crypto.CopyEncryptAt(encKey, iv, 10, bytes.NewReader(plain[10:]), buf); err != nil {
+				return err
+			}
+			_, err := s.Append(id, "key", buf)
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256,
+				Overhead: replicaOverhead(holder)})
+			if err := tc.write(s, tc.id); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := s.Stat(tc.id, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, r, err := s.Read(tc.id, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.(io.Closer).Close()
+			got := new(bytes.Buffer)
+			if tc.id == holder {
+				_, err = crypto.CopyDecrypt(encKey, r, got)
+			} else {
+				_, err = io.Copy(got, r)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), tc.plain) {
+				t.Fatalf("got %q want %q", got, tc.plain)
+			}
+			if meta.PlainSize != int64(got.Len()) {
+				t.Errorf("got plain size %d, reading yields %d bytes", meta.PlainSize, got.Len())
+			}
+			if err := s.Verify(tc.id, "key"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestStorePlainSizeBackfill reads metadata written before plain sizes were recorded, which
+// Stat fills in and records, and checks Verify flags a plain size the content does not yield.
+func TestStorePlainSizeBackfill(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256,
+		Overhead: replicaOverhead("holder")})
+	stored := make([]byte, crypto.Overhead+100)
+	if _, err := s.Write("holder", "key", bytes.NewReader(stored)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Metadata("holder", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.PlainSize = 0
+	if err := writeMetadataFile(s.metadataPath("holder", "key"), meta, false); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := s.Stat("holder", "key"); err != nil || meta.PlainSize != 100 {
+		t.Fatalf("got plain size %d and %v want 100", meta.PlainSize, err)
+	}
+	if meta, err := s.Metadata("holder", "key"); err != nil || meta.PlainSize != 100 {
+		t.Errorf("expected the plain size to be recorded, got %d and %v", meta.PlainSize, err)
+	}
+
+	meta.PlainSize = 90
+	if err := writeMetadataFile(s.metadataPath("holder", "key"), meta, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify("holder", "key"); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("got %v want %v", err, ErrSizeMismatch)
+	}
+}
+
+func TestStoreSetImmutable(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	if _, err := s.Write(id, "frozen", bytes.NewReader([]byte("write once"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetImmutable(id, "frozen"); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Metadata(id, "frozen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Immutable || meta.Size != int64(len("write once")) {
+		t.Errorf("got %+v want an immutable object of %d bytes", meta, len("write once"))
+	}
+	if err := s.SetImmutable(id, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestStoreReplacesMetadataWhole(t *testing.T) {
+	for _, sync := range []bool{false, true} {
+		s := newStore()
+		s.SyncWrites = sync
+		id := crypto.GenerateID()
+		if _, err := s.Write(id, "notes", bytes.NewReader([]byte("rewritten metadata"))); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetContentType(id, "notes", "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Verify(id, "notes"); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := s.Metadata(id, "notes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.ContentType != "text/plain" || meta.Verified.IsZero() {
+			t.Errorf("got %+v want a verified text/plain object", meta)
+		}
+		// The sidecar is replaced by renaming a new one over it, which leaves nothing behind.
+		entries, err := os.ReadDir(filepath.Dir(s.metadataPath(id, "notes")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		want := []string{filepath.Base(s.fullPath(id, "notes")), filepath.Base(s.metadataPath(id, "notes"))}
+		if fmt.Sprint(names) != fmt.Sprint(want) {
+			t.Errorf("got %v want %v", names, want)
+		}
+		teardown(t, s)
+	}
+}
+
+func TestStoreSyncWrites(t *testing.T) {
+	s := newStore()
+	s.SyncWrites = true
+	id := crypto.GenerateID()
+	defer teardown(t, s)
+	data := []byte("some durable bytes")
+	if _, err := s.Write(id, "plain", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, "plain"); err != nil {
+		t.Errorf("expected synced object to verify, got %s", err)
+	}
+	if _, err := s.WriteNextVersion(id, "versioned", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s.Read(id, "versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if string(b) != string(data) {
+		t.Errorf("got %s want %s", b, data)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "table.json")
+	for _, content := range []string{"first", "second, longer than the first"} {
+		if err := WriteFileAtomic(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(path); err != nil || string(b) != content {
+			t.Errorf("got %q, %v want %q", b, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	// A file that cannot be replaced is left as it was.
+	if err := WriteFileAtomic(filepath.Join(path, "nested"), []byte("x"), 0o600); err == nil {
+		t.Error("expected writing under a file to fail")
+	}
+}
+
+func TestStoreHasStatFailure(t *testing.T) {
+	t.Run("permission denied", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("permission bits are not enforced for root")
+		}
+		s := newStore()
+		id := crypto.GenerateID()
+		defer teardown(t, s)
+		if _, err := s.Write(id, "lockedkey", bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+		idRoot := fmt.Sprintf("%s/%s", s.Root, id)
+		if err := os.Chmod(idRoot, 0o000); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(idRoot, os.ModePerm)
+		ok, err := s.Has(id, "lockedkey")
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("got %v want %v", err, fs.ErrPermission)
+		}
+		if ok {
+			t.Error("expected Has to report false when presence is unknown")
+		}
+	})
+	t.Run("path component is a file", func(t *testing.T) {
+		s := newStore()
+		id := crypto.GenerateID()
+		defer teardown(t, s)
+		if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fmt.Sprintf("%s/%s", s.Root, id), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ok, err := s.Has(id, "anykey")
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected a stat failure, got %v", err)
+		}
+		if ok {
+			t.Error("expected Has to report false when presence is unknown")
+		}
+	})
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
-		PathTransformFunc: CASPathTransformFunc,
+		PathTransformFunc: CASPathTransformFuncSHA256,
 	}
 	return NewStore(opts)
 }
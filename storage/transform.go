@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Names of the path transforms registered by default. The CAS transforms hash keys with
+// SHA-256; the SHA-1 layouts of existing stores are registered under LegacyTransformName.
+const (
+	FlatTransformName = "flat"
+	CASTransformName  = "cas"
+	CAS2TransformName = "cas2"
+)
+
+// Hash algorithms used to derive CAS paths.
+const (
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+)
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]PathTransformFunc{
+		FlatTransformName:                      DefaultPathTransformFunc,
+		CASTransformName:                       CASPathTransformFuncSHA256,
+		CAS2TransformName:                      NewCASTransform(2, 2),
+		LegacyTransformName(CASTransformName):  CASPathTransformFunc,
+		LegacyTransformName(CAS2TransformName): NewCASTransformHash(HashSHA1, 2, 2),
+	}
+)
+
+// LegacyTransformName returns the registry name of the SHA-1 variant of a CAS transform.
+func LegacyTransformName(name string) string {
+	return name + "-" + HashSHA1
+}
+
+// RegisterPathTransform makes a path transform available under the given name,
+// replacing any transform previously registered with that name.
+func RegisterPathTransform(name string, fn PathTransformFunc) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	transforms[name] = fn
+}
+
+// GetPathTransform returns the path transform registered under the given name.
+//
+// Returns: The transform and true if the name is registered, nil and false otherwise.
+func GetPathTransform(name string) (PathTransformFunc, bool) {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+	fn, ok := transforms[name]
+	return fn, ok
+}
+
+// NewCASTransform returns a content-addressable path transform that nests each object
+// under depth directories named after consecutive blockSize-character slices of the key's
+// SHA-256 hash. A depth of zero or less uses as many whole blocks as the hash provides.
+//
+// Parameters:
+//   - blockSize: Number of hash characters per directory level.
+//   - depth: Maximum number of directory levels.
+//
+// Returns: A PathTransformFunc producing `PathName` as the nested folders and `FileName` as the full hash.
+func NewCASTransform(blockSize int, depth int) PathTransformFunc {
+	return NewCASTransformHash(HashSHA256, blockSize, depth)
+}
+
+// NewCASTransformHash is like NewCASTransform but derives paths with the given hash algorithm.
+func NewCASTransformHash(hash string, blockSize int, depth int) PathTransformFunc {
+	if blockSize <= 0 {
+		panic(fmt.Sprintf("storage: invalid CAS block size %d", blockSize))
+	}
+	if hash != HashSHA1 && hash != HashSHA256 {
+		panic(fmt.Sprintf("storage: unsupported CAS hash %q", hash))
+	}
+	return func(key string) PathKey {
+		hashStr := hashKey(hash, key)
+		levels := len(hashStr) / blockSize
+		if depth > 0 && depth < levels {
+			levels = depth
+		}
+		paths := make([]string, levels)
+		for i := 0; i < levels; i++ {
+			from, to := i*blockSize, (i+1)*blockSize
+			paths[i] = hashStr[from:to]
+		}
+		return PathKey{
+			PathName: strings.Join(paths, "/"),
+			FileName: hashStr,
+			Hash:     hash,
+		}
+	}
+}
+
+// hashKey returns the hex-encoded digest of key under the given algorithm.
+func hashKey(hash string, key string) string {
+	if hash == HashSHA1 {
+		sum := sha1.Sum([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
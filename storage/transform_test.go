@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestPathTransformVariants(t *testing.T) {
+	key := "mybestpictures"
+	sha1Hash := "7037c790557f0d861c53d3bbd1fafe02dc3699e6"
+	hash := "925c9743880760be19d52bb7327a82465092e48755a55c3245df190398a6dd32"
+	tests := []struct {
+		name     string
+		fn       PathTransformFunc
+		pathName string
+		fileName string
+	}{
+		{FlatTransformName, mustGetPathTransform(t, FlatTransformName), key, key},
+		{CASTransformName, mustGetPathTransform(t, CASTransformName), "925c9/74388/0760b/e19d5/2bb73/27a82/46509/2e487", hash},
+		{CAS2TransformName, mustGetPathTransform(t, CAS2TransformName), "92/5c", hash},
+		{"cas 3x4", NewCASTransform(3, 4), "925/c97/438/807", hash},
+		{"cas depth beyond hash", NewCASTransform(20, 10), "925c9743880760be19d5/2bb7327a82465092e487/55a55c3245df190398a6", hash},
+		{LegacyTransformName(CASTransformName), mustGetPathTransform(t, LegacyTransformName(CASTransformName)), "7037c/79055/7f0d8/61c53/d3bbd/1fafe/02dc3/699e6", sha1Hash},
+		{LegacyTransformName(CAS2TransformName), mustGetPathTransform(t, LegacyTransformName(CAS2TransformName)), "70/37", sha1Hash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pathKey := tt.fn(key)
+			if pathKey.PathName != tt.pathName {
+				t.Errorf("got %s want %s", pathKey.PathName, tt.pathName)
+			}
+			if pathKey.FileName != tt.fileName {
+				t.Errorf("got %s want %s", pathKey.FileName, tt.fileName)
+			}
+		})
+	}
+}
+
+func TestRegisterPathTransform(t *testing.T) {
+	RegisterPathTransform("test-upper", func(key string) PathKey {
+		return PathKey{PathName: "upper", FileName: key}
+	})
+	fn, ok := GetPathTransform("test-upper")
+	if !ok {
+		t.Fatal("expected registered transform to be found")
+	}
+	if got := fn("k").FullPath(); got != "upper/k" {
+		t.Errorf("got %s want %s", got, "upper/k")
+	}
+	if _, ok := GetPathTransform("does-not-exist"); ok {
+		t.Error("expected unknown transform to be missing")
+	}
+}
+
+func TestInitRefusesTransformChange(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(); err != nil {
+		t.Errorf("reopening with the same transform should succeed, got %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStore(StoreOpts{Root: root, PathTransformName: CAS2TransformName})
+	if err := s.Init(); !errors.Is(err, ErrTransformMismatch) {
+		t.Errorf("got %v want %v", err, ErrTransformMismatch)
+	}
+	s = NewStore(StoreOpts{Root: t.TempDir(), PathTransformName: "does-not-exist"})
+	if err := s.Init(); err == nil {
+		t.Error("expected an unknown transform name to be rejected")
+	}
+}
+
+func TestMigrateTransform(t *testing.T) {
+	root := t.TempDir()
+	id := "node"
+	s := NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := s.MigrateTransform(CAS2TransformName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("got %d migrated objects want %d", n, 10)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); !errors.Is(err, ErrTransformMismatch) {
+		t.Fatalf("got %v want %v", err, ErrTransformMismatch)
+	}
+	s = NewStore(StoreOpts{Root: root, PathTransformName: CAS2TransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if string(b) != key {
+			t.Errorf("got %s want %s", b, key)
+		}
+	}
+}
+
+func TestInitKeepsSHA1Layout(t *testing.T) {
+	root := t.TempDir()
+	id := "node"
+	legacy := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	if _, err := legacy.Write(id, "oldkey", bytes.NewReader([]byte("old bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Has(id, "oldkey"); err != nil || !ok {
+		t.Fatalf("expected unmarked SHA-1 store to stay readable, got %v %v", ok, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening reads the hash back from the marker.
+	s = NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.PathTransformFunc("oldkey").Hash; got != HashSHA1 {
+		t.Errorf("got %s want %s", got, HashSHA1)
+	}
+}
+
+func TestMigrateHash(t *testing.T) {
+	root := t.TempDir()
+	id := "node"
+	legacy := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if _, err := legacy.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.MigrateHash(HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("got %d migrated objects want %d", n, 10)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStore(StoreOpts{Root: root, PathTransformName: CASTransformName})
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if got := s.PathTransformFunc(key).Hash; got != HashSHA256 {
+			t.Fatalf("got %s want %s", got, HashSHA256)
+		}
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if string(b) != key {
+			t.Errorf("got %s want %s", b, key)
+		}
+		if err := s.Verify(id, key); err != nil {
+			t.Error(err)
+		}
+	}
+	entries, err := os.ReadDir(fmt.Sprintf("%s/%s", root, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if CASPathTransformFunc("key_0").FirstPathName() == e.Name() {
+			t.Errorf("expected emptied SHA-1 directory %s to be removed", e.Name())
+		}
+	}
+}
+
+func mustGetPathTransform(t *testing.T, name string) PathTransformFunc {
+	fn, ok := GetPathTransform(name)
+	if !ok {
+		t.Fatalf("transform %q is not registered", name)
+	}
+	return fn
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// trashDirName is the directory under an owner's root holding deleted objects, one
+// subdirectory per deletion named after its time in Unix nanoseconds.
+const trashDirName = ".trash"
+
+// ErrNotInTrash is returned by Restore when no deleted copy of the object is within the
+// retention window.
+var ErrNotInTrash = errors.New("storage: object not found in trash")
+
+// now returns the current time of the store's clock.
+func (s *Store) now() time.Time {
+	return clock.Or(s.Clock).Now()
+}
+
+// skipReserved tells a WalkDir callback to skip the trash and version histories, whose
+// objects are not live.
+func skipReserved(d fs.DirEntry) error {
+	if d.IsDir() && (d.Name() == trashDirName || d.Name() == versionsDirName) {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// trashPath returns the trash directory of an owner.
+func (s *Store) trashPath(id string) string {
+	return filepath.Join(s.Root, id, trashDirName)
+}
+
+// trash moves an object and its metadata into the owner's trash.
+func (s *Store) trash(id string, key string) error {
+	pathKey := s.PathTransformFunc(key)
+	if _, err := os.Stat(s.fullPath(id, key)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	dir := filepath.Join(s.trashPath(id), strconv.FormatInt(s.now().UnixNano(), 10))
+	if err := s.moveObject(s.fullPath(id, key), filepath.Join(dir, pathKey.FullPath())); err != nil {
+		return err
+	}
+	if err := s.moveHistory(s.versionDir(id, key), filepath.Join(dir, versionsDirName, pathKey.FullPath())); err != nil {
+		return err
+	}
+	return s.unindexKey(id, key)
+}
+
+// moveObject renames the object at from, and its metadata when present, to to.
+func (s *Store) moveObject(from string, to string) error {
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	err := os.Rename(from+metadataSuffix, to+metadataSuffix)
+	return ignoreNotExist(err)
+}
+
+// trashTimes lists the deletion times in an owner's trash, newest first.
+func (s *Store) trashTimes(id string) ([]int64, error) {
+	entries, err := os.ReadDir(s.trashPath(id))
+	if err != nil {
+		return nil, ignoreNotExist(err)
+	}
+	var times []int64
+	for _, e := range entries {
+		if t, err := strconv.ParseInt(e.Name(), 10, 64); err == nil && e.IsDir() {
+			times = append(times, t)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+	return times, nil
+}
+
+// Restore moves the most recently deleted copy of an object back out of the trash, provided
+// it was deleted within the retention window.
+//
+// Parameters:
+//   - id: Owner of the object.
+//   - key: Key of the object.
+//
+// Returns: ErrNotInTrash when there is no copy to restore, an error wrapping fs.ErrExist
+// when the key holds an object again, and any other errors.
+func (s *Store) Restore(id string, key string) error {
+	times, err := s.trashTimes(id)
+	if err != nil {
+		return err
+	}
+	cutoff := s.now().Add(-s.TrashRetention).UnixNano()
+	rel := s.PathTransformFunc(key).FullPath()
+	for _, t := range times {
+		if t < cutoff {
+			break
+		}
+		from := filepath.Join(s.trashPath(id), strconv.FormatInt(t, 10), rel)
+		if _, err := os.Stat(from); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if ok, err := s.Has(id, key); err != nil || ok {
+			return errors.Join(err, fmt.Errorf("restoring %s: %w", key, fs.ErrExist))
+		}
+		defer s.changed(id, key)
+		if err := s.moveObject(from, s.fullPath(id, key)); err != nil {
+			return err
+		}
+		history := filepath.Join(s.trashPath(id), strconv.FormatInt(t, 10), versionsDirName, rel)
+		if err := s.moveHistory(history, s.versionDir(id, key)); err != nil {
+			return err
+		}
+		return s.indexKey(id, key)
+	}
+	return fmt.Errorf("%w: %s", ErrNotInTrash, key)
+}
+
+// PurgeTrash permanently removes the objects of an owner deleted longer ago than the
+// retention window.
+//
+// Returns: Number of objects removed and any errors.
+func (s *Store) PurgeTrash(id string) (int, error) {
+	times, err := s.trashTimes(id)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := s.now().Add(-s.TrashRetention).UnixNano()
+	var (
+		purged int
+		errs   []error
+	)
+	for _, t := range times {
+		if t >= cutoff {
+			continue
+		}
+		dir := filepath.Join(s.trashPath(id), strconv.FormatInt(t, 10))
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return ignoreNotExist(err)
+			}
+			if d.IsDir() || strings.HasSuffix(path, metadataSuffix) {
+				return skipReserved(d)
+			}
+			purged++
+			return nil
+		})
+		errs = append(errs, err, os.RemoveAll(dir))
+	}
+	return purged, errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// newTrashStore returns a store keeping deleted objects for an hour on a clock the test
+// controls.
+func newTrashStore(t *testing.T, clk *clock.Fake) *Store {
+	return NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFuncSHA256,
+		TrashRetention:    time.Hour,
+		Clock:             clk,
+	})
+}
+
+func TestTrashRestore(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	s := newTrashStore(t, clk)
+	id, key := "owner", "photos/cat.png"
+	data := []byte("whiskers")
+	writeKeys(t, s, id, "other")
+	if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	before := rootDigest(t, s, id)
+
+	if err := s.Delete(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Has(id, key); err != nil || ok {
+		t.Fatalf("got Has %v, %v for a trashed object want false", ok, err)
+	}
+	if objects, _, err := s.Usage(); err != nil || objects != 1 {
+		t.Errorf("got %d objects, %v in use want 1", objects, err)
+	}
+	if report, err := s.GC(id); err != nil || report.OrphansRemoved != 0 {
+		t.Errorf("gc removed %d orphans, %v want none", report.OrphansRemoved, err)
+	}
+
+	clk.Advance(30 * time.Minute)
+	if err := s.Restore(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if d := rootDigest(t, s, id); d != before {
+		t.Errorf("got root %s after restoring want %s", d, before)
+	}
+	_, r, err := s.ReadVerified(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q want %q", got, data)
+	}
+	if err := s.Restore(id, key); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("got %v restoring twice want ErrNotInTrash", err)
+	}
+}
+
+func TestTrashExpires(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	s := newTrashStore(t, clk)
+	id, key := "owner", "old.log"
+	writeKeys(t, s, id, key)
+	if err := s.Delete(id, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is purged within the retention window.
+	if n, err := s.PurgeTrash(id); err != nil || n != 0 {
+		t.Fatalf("purged %d, %v within retention want 0", n, err)
+	}
+	clk.Advance(time.Hour + time.Second)
+	if err := s.Restore(id, key); !errors.Is(err, ErrNotInTrash) {
+		t.Errorf("got %v restoring an expired object want ErrNotInTrash", err)
+	}
+	if n, err := s.PurgeTrash(id); err != nil || n != 1 {
+		t.Fatalf("purged %d, %v want 1", n, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.Root, id, trashDirName))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("got %d trash entries, %v after purging want none", len(entries), err)
+	}
+	if ok, err := s.Has(id, key); err != nil || ok {
+		t.Errorf("got Has %v, %v after purging want false", ok, err)
+	}
+}
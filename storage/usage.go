@@ -0,0 +1,82 @@
+package storage
+
+// Usage counts the indexed objects of every owner and the bytes they occupy on disk, excluding
+// metadata sidecars, as tracked by the key index. Objects stored before metadata existed carry
+// no key and are not counted.
+//
+// Returns: Number of objects, their total size in bytes and any errors.
+func (s *Store) Usage() (objects int, bytes int64, err error) {
+	ids, err := s.Owners()
+	if err != nil {
+		return 0, 0, err
+	}
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	for _, id := range ids {
+		o, err := s.ownerIndex(id)
+		if err != nil {
+			return objects, bytes, err
+		}
+		objects += o.live
+		bytes += o.bytes
+	}
+	return objects, bytes, nil
+}
+
+// FreeBytes returns the bytes available for new objects on the file system holding the root.
+//
+// Returns: The free bytes, or an error wrapping errors.ErrUnsupported on platforms where
+// they cannot be measured.
+func (s *Store) FreeBytes() (int64, error) {
+	return freeBytes(s.Root)
+}
+
+// OwnerBytes returns the bytes held on disk for an owner's indexed objects, as tracked by the
+// key index.
+//
+// Parameters:
+//   - id: Owner whose objects are counted.
+//
+// Returns: The total size in bytes and any errors.
+func (s *Store) OwnerBytes(id string) (int64, error) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return 0, err
+	}
+	return o.bytes, nil
+}
+
+// OwnerSize returns the size on disk of one indexed object of an owner, or zero when the key
+// is not indexed.
+func (s *Store) OwnerSize(id string, key string) (int64, error) {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+	o, err := s.ownerIndex(id)
+	if err != nil {
+		return 0, err
+	}
+	return o.buckets[bucketOf(key)][key], nil
+}
+
+// UsageByOwner returns the bytes held for every owner with objects in the store.
+//
+// Returns: The total size in bytes by owner ID and any errors.
+func (s *Store) UsageByOwner() (map[string]int64, error) {
+	ids, err := s.Owners()
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		n, err := s.OwnerBytes(id)
+		if err != nil {
+			return usage, err
+		}
+		if n > 0 {
+			usage[id] = n
+		}
+	}
+	return usage, nil
+}
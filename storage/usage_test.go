@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOwnerBytes(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFuncSHA256})
+	writeKeys(t, s, "alice", "a", "bb", "ccc")
+	writeKeys(t, s, "bob", "dddd")
+	// Rewriting a key replaces its size rather than adding to it.
+	if _, err := s.Write("alice", "a", bytes.NewReader([]byte("aaaaa"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("alice", "bb"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"alice": 8, "bob": 4}
+	got, err := s.UsageByOwner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) || got["alice"] != want["alice"] || got["bob"] != want["bob"] {
+		t.Errorf("got usage %v want %v", got, want)
+	}
+	if n, _ := s.OwnerSize("alice", "a"); n != 5 {
+		t.Errorf("got size %d for a want 5", n)
+	}
+
+	reopened := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFuncSHA256})
+	if n, err := reopened.OwnerBytes("alice"); err != nil || n != 8 {
+		t.Errorf("got %d, %v after reopening want 8", n, err)
+	}
+}
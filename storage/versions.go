@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionsDirName is the directory under an owner's root holding the history of versioned
+// objects, one directory per key with a file per version named after its number.
+const versionsDirName = ".versions"
+
+// versionDir returns the directory holding every version of an object.
+func (s *Store) versionDir(id string, key string) string {
+	return filepath.Join(s.Root, id, versionsDirName, s.PathTransformFunc(key).FullPath())
+}
+
+// versionPath returns the location of one version of an object.
+func (s *Store) versionPath(id string, key string, version uint64) string {
+	return filepath.Join(s.versionDir(id, key), strconv.FormatUint(version, 10))
+}
+
+// moveHistory renames the version history at from, when there is one, to to.
+func (s *Store) moveHistory(from string, to string) error {
+	if _, err := os.Stat(from); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// WriteNextVersion stores the content from the reader as a new version of an object, numbered
+// one above the highest version held, and makes it the current content.
+//
+// Parameters:
+//   - id: Owner of the object.
+//   - key: Key of the object.
+//   - r: Reader for the content.
+//
+// Returns: Metadata of the new version and any errors.
+func (s *Store) WriteNextVersion(id string, key string, r io.Reader) (Metadata, error) {
+	s.verMu.Lock()
+	defer s.verMu.Unlock()
+	versions, err := s.Versions(id, key)
+	if err != nil {
+		return Metadata{}, err
+	}
+	next := uint64(1)
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+	return s.writeVersionLocked(id, key, next, r)
+}
+
+// WriteVersion stores the content from the reader as the given version of an object. The
+// version becomes the current content unless a higher version is already held, so versions
+// can arrive in any order.
+//
+// Parameters:
+//   - id: Owner of the object.
+//   - key: Key of the object.
+//   - version: Version number, greater than zero.
+//   - r: Reader for the content.
+//
+// Returns: Metadata of the version and any errors.
+func (s *Store) WriteVersion(id string, key string, version uint64, r io.Reader) (Metadata, error) {
+	if version == 0 {
+		return Metadata{}, fmt.Errorf("storage: version of %s must be greater than zero", key)
+	}
+	s.verMu.Lock()
+	defer s.verMu.Unlock()
+	return s.writeVersionLocked(id, key, version, r)
+}
+
+// writeVersionLocked writes a version and its metadata, then copies it over the current
+// content if it is the newest. s.verMu must be held.
+func (s *Store) writeVersionLocked(id string, key string, version uint64, r io.Reader) (meta Metadata, err error) {
+	path := s.versionPath(id, key, version)
+	s.dirMu.RLock()
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	s.dirMu.RUnlock()
+	if err != nil {
+		return Metadata{}, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	enc, err := s.newEncoder(s.objectWriter(f))
+	cw := newChecksumWriter(enc)
+	if err == nil {
+		_, err = io.Copy(cw, r)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err = errors.Join(err, s.closeWritten(f)); err != nil {
+		return Metadata{}, err
+	}
+	meta = cw.metadata()
+	meta.Key, meta.Version, meta.ModTime, meta.Stored = key, version, s.now(), enc.stored()
+	meta.PlainSize = s.plainSize(id, meta.Size)
+	if err := writeMetadataFile(path+metadataSuffix, meta, s.SyncWrites); err != nil {
+		return Metadata{}, err
+	}
+
+	current, err := s.Metadata(id, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return meta, err
+	}
+	if err == nil && current.Version > version {
+		return meta, nil
+	}
+	_, content, err := s.openObject(path)
+	if err != nil {
+		return meta, err
+	}
+	defer func() {
+		err = errors.Join(err, content.Close())
+	}()
+	_, err = s.writeObject(id, key, content, version)
+	return meta, err
+}
+
+// Versions lists the versions held of an object, oldest first.
+//
+// Returns: Metadata of every version, empty when the object is not versioned, and any errors.
+func (s *Store) Versions(id string, key string) ([]Metadata, error) {
+	entries, err := os.ReadDir(s.versionDir(id, key))
+	if err != nil {
+		return nil, ignoreNotExist(err)
+	}
+	var versions []Metadata
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), metadataSuffix) {
+			continue
+		}
+		meta, err := readMetadataFile(filepath.Join(s.versionDir(id, key), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, meta)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// ReadVersion opens one version of an object, decoding it as Read does.
+//
+// Returns: Size of the version, a reader for its content, and any errors. A version that is
+// not held returns an error wrapping fs.ErrNotExist.
+func (s *Store) ReadVersion(id string, key string, version uint64) (int64, io.ReadCloser, error) {
+	return s.openObject(s.versionPath(id, key, version))
+}
+
+// PruneVersions removes the versions of an object that fall outside the retention policy.
+// The newest version is always kept.
+//
+// Parameters:
+//   - id: Owner of the object.
+//   - key: Key of the object.
+//   - keepLast: Number of newest versions kept, zero for no limit.
+//   - maxAge: Age past which versions are removed, zero for no limit.
+//
+// Returns: Numbers of the removed versions and any errors.
+func (s *Store) PruneVersions(id string, key string, keepLast int, maxAge time.Duration) ([]uint64, error) {
+	s.verMu.Lock()
+	defer s.verMu.Unlock()
+	versions, err := s.Versions(id, key)
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+	cutoff := s.now().Add(-maxAge)
+	var pruned []uint64
+	for i, v := range versions[:len(versions)-1] {
+		tooMany := keepLast > 0 && i < len(versions)-keepLast
+		tooOld := maxAge > 0 && v.ModTime.Before(cutoff)
+		if tooMany || tooOld {
+			pruned = append(pruned, v.Version)
+		}
+	}
+	return pruned, s.deleteVersionsLocked(id, key, pruned)
+}
+
+// DeleteVersions removes the given versions of an object. The current content is left alone.
+func (s *Store) DeleteVersions(id string, key string, versions []uint64) error {
+	s.verMu.Lock()
+	defer s.verMu.Unlock()
+	return s.deleteVersionsLocked(id, key, versions)
+}
+
+// deleteVersionsLocked removes versions and their metadata. s.verMu must be held.
+func (s *Store) deleteVersionsLocked(id string, key string, versions []uint64) error {
+	var errs []error
+	for _, v := range versions {
+		path := s.versionPath(id, key, v)
+		errs = append(errs, ignoreNotExist(os.Remove(path)), ignoreNotExist(os.Remove(path+metadataSuffix)))
+	}
+	return errors.Join(errs...)
+}
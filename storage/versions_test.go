@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/muhammadmahdiamirpour/distributed-file-system/clock"
+)
+
+// versionNumbers returns the numbers of the versions held of key.
+func versionNumbers(t *testing.T, s *Store, id string, key string) []uint64 {
+	t.Helper()
+	versions, err := s.Versions(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []uint64
+	for _, v := range versions {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+// readAll returns the content of a reader, failing the test on error.
+func readAll(t *testing.T, r io.ReadCloser) string {
+	t.Helper()
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestVersionsOverwrite(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id, key := "owner", "config.yaml"
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if _, err := s.WriteNextVersion(id, key, bytes.NewReader([]byte(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := versionNumbers(t, s, id, key); !reflect.DeepEqual(got, []uint64{1, 2, 3}) {
+		t.Errorf("got versions %v want [1 2 3]", got)
+	}
+	_, r, err := s.ReadVerified(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "v3" {
+		t.Errorf("got current content %q want v3", got)
+	}
+	if meta, err := s.Metadata(id, key); err != nil || meta.Version != 3 {
+		t.Errorf("got current version %d, %v want 3", meta.Version, err)
+	}
+	_, r, err = s.ReadVersion(id, key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "v1" {
+		t.Errorf("got version 1 %q want v1", got)
+	}
+	if _, _, err := s.ReadVersion(id, key, 9); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v reading a missing version want fs.ErrNotExist", err)
+	}
+	// Version histories stay out of the key listing.
+	if keys, err := s.Keys(id); err != nil || !reflect.DeepEqual(keys, []string{key}) {
+		t.Errorf("got keys %q, %v want only %q", keys, err, key)
+	}
+}
+
+func TestVersionsOutOfOrder(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256})
+	id, key := "owner", "replica"
+	for _, v := range []uint64{2, 1} {
+		if _, err := s.WriteVersion(id, key, v, bytes.NewReader([]byte{byte('0' + v)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, r, err := s.ReadVerified(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); got != "2" {
+		t.Errorf("got current content %q want the newer version 2", got)
+	}
+	if got := versionNumbers(t, s, id, key); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("got versions %v want [1 2]", got)
+	}
+	if _, err := s.WriteVersion(id, key, 0, bytes.NewReader(nil)); err == nil {
+		t.Error("expected an error writing version zero")
+	}
+}
+
+func TestVersionsPrune(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFuncSHA256, Clock: clk})
+	id, key := "owner", "log"
+	for i := 0; i < 5; i++ {
+		if _, err := s.WriteNextVersion(id, key, bytes.NewReader([]byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(time.Hour)
+	}
+
+	pruned, err := s.PruneVersions(id, key, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pruned, []uint64{1, 2}) {
+		t.Errorf("pruned %v want [1 2]", pruned)
+	}
+	// Versions 3 and 4 were written more than 90 minutes ago; the newest is always kept.
+	clk.Advance(2 * time.Hour)
+	pruned, err = s.PruneVersions(id, key, 0, 90*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pruned, []uint64{3, 4}) {
+		t.Errorf("pruned %v want [3 4]", pruned)
+	}
+	if got := versionNumbers(t, s, id, key); !reflect.DeepEqual(got, []uint64{5}) {
+		t.Errorf("got versions %v want [5]", got)
+	}
+
+	if err := s.Delete(id, key); err != nil {
+		t.Fatal(err)
+	}
+	if got := versionNumbers(t, s, id, key); len(got) != 0 {
+		t.Errorf("got versions %v after deleting the key want none", got)
+	}
+}